@@ -2,15 +2,21 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/rehearsal"
 	"github.com/percona/percona-backup-mongodb/pbm/restore"
 )
 
@@ -19,40 +25,147 @@ func init() {
 }
 
 type Agent struct {
-	pbm  *pbm.PBM
-	node *pbm.Node
+	pbm    *pbm.PBM
+	node   *pbm.Node
+	labels map[string]string
+	// id is the identity of the agent persisted across its restarts
+	id string
+	// pmmService is the PMM service name of the node
+	pmmService string
+	// postRestore are the commands run after the restore, see SetPostRestoreHooks
+	postRestore []string
+	hookTimeout time.Duration
+	// approval is the agent's own approval policy, see SetApproval
+	approval pbm.ApprovalPolicy
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// workers are the slots of the commands run at a time, see SetWorkers
+	workers chan struct{}
+	running sync.WaitGroup
+	// tasks are the commands being run by their start order
+	tasksMu  sync.Mutex
+	tasks    map[uint64]pbm.AgentTask
+	tasksSeq uint64
+
+	// lastHb is the time (unix nanoseconds) of the last status reported
+	lastHb int64
+
+	// log is the agent's log, see SetLogPrefix
+	log *log.Logger
 }
 
-func New(pbm *pbm.PBM) *Agent {
+func New(cn *pbm.PBM) *Agent {
 	return &Agent{
-		pbm: pbm,
+		pbm:     cn,
+		stop:    make(chan struct{}),
+		workers: make(chan struct{}, DefaultWorkers),
+		tasks:   make(map[uint64]pbm.AgentTask),
+		log:     log.New(log.Writer(), "", log.LstdFlags),
 	}
 }
 
+// SetLogPrefix sets the prefix of the agent's log lines, so the ones of
+// the agents run in the same process can be told apart
+func (a *Agent) SetLogPrefix(prefix string) {
+	a.log.SetPrefix(prefix)
+}
+
 func (a *Agent) AddNode(ctx context.Context, cn *mongo.Client, curi string) {
 	a.node = pbm.NewNode(ctx, "node0", cn, curi)
 }
 
+// SetLabels sets the agent's labels (e.g. dc, rack, env)
+// which backup source selectors are matched against
+func (a *Agent) SetLabels(labels map[string]string) {
+	a.labels = labels
+}
+
+// SetPMMService sets the PMM service name of the node (as it's added with
+// pmm-admin) the backup and restore annotations are bound to
+func (a *Agent) SetPMMService(name string) {
+	a.pmmService = name
+}
+
+// SetApproval sets the approval the restores and the deletes require
+// regardless of the config
+func (a *Agent) SetApproval(p pbm.ApprovalPolicy) {
+	a.approval = p
+}
+
+// LoadID loads the agent's identity from the file or, if there is no
+// file yet, generates and stores it. The default file is per node in
+// the user's config dir. The restarted agent takes over the locks and
+// the status entry of its previous run by the identity.
+func (a *Agent) LoadID(file string) error {
+	if file == "" {
+		im, err := a.node.GetIsMaster()
+		if err != nil {
+			return errors.Wrap(err, "get isMaster")
+		}
+		file, err = pbm.DefaultAgentIDFile(im.Me)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := pbm.LoadAgentID(file)
+	if err != nil {
+		return errors.Wrapf(err, "load agent id from %s", file)
+	}
+	a.id = id
+	a.pbm.SetAgentID(id)
+	a.log.Printf("agent id %s (%s)", id, file)
+	return nil
+}
+
 // Start starts listening the commands stream.
 func (a *Agent) Start() error {
+	err := backup.UnlockStale(a.pbm, a.node)
+	if err != nil {
+		a.log.Println("[ERROR] release stale fsync lock:", err)
+	}
+
+	if a.id != "" {
+		err = a.reclaim()
+		if err != nil {
+			a.log.Println("[ERROR] reclaim the previous run's state:", err)
+		}
+	}
+
+	go func() {
+		n, err := backup.SweepPartials(a.pbm, backup.PartialMaxAge)
+		if err != nil {
+			a.log.Println("[ERROR] clean up partial files:", err)
+		}
+		if n > 0 {
+			a.log.Printf("removed %d abandoned partial files", n)
+		}
+	}()
+
 	c, cerr, err := a.pbm.ListenCmd()
 	if err != nil {
 		return err
 	}
+	defer a.running.Wait()
+
+	go a.HbStatus()
+	go a.DispatchQueue()
+	go a.ScheduleVerify()
+	go a.OplogNoop()
 
 	for {
 		select {
+		case <-a.stop:
+			return nil
 		case cmd := <-c:
-			switch cmd.Cmd {
-			case pbm.CmdBackup:
-				log.Println("Got command", cmd.Cmd, cmd.Backup.Name)
-				a.Backup(cmd.Backup)
-			case pbm.CmdRestore:
-				log.Println("Got command", cmd.Cmd, cmd.Restore.BackupName)
-				a.Restore(cmd.Restore)
-			case pbm.CmdResyncBackupList:
-				log.Println("Got command", cmd.Cmd)
-				a.ResyncBackupList()
+			if a.stopping() {
+				a.log.Println("Agent is stopping, ignoring command", cmd.Cmd)
+				return nil
+			}
+			if !a.run(cmd) {
+				return nil
 			}
 		case err := <-cerr:
 			switch err.(type) {
@@ -64,29 +177,420 @@ func (a *Agent) Start() error {
 					return errors.New("change stream was closed")
 				}
 
-				log.Println("[ERROR] listening commands:", err)
+				a.log.Println("[ERROR] listening commands:", err)
 			}
 		}
 	}
 }
 
+// Stop makes the agent stop taking the new commands. Start returns
+// once the commands being run (if any) are finished.
+func (a *Agent) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+}
+
+func (a *Agent) stopping() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandOff gives up the operations the agent still runs so they don't wait
+// for the locks to go stale: the locks are released and the replsets are
+// marked failed, so the standby nodes take the backups over (see
+// backupStandby). The node is fsync-unlocked if the backup has locked it.
+// It's meant to be called on the shutdown when the operations weren't
+// finished in time.
+func (a *Agent) HandOff() error {
+	im, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster")
+	}
+
+	err = a.releaseLocks(im, "pbm-agent was stopped")
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(backup.UnlockStale(a.pbm, a.node), "release fsync lock")
+}
+
+// queueStartWait is how long the dispatched job may take to start
+// before the next queued job is considered
+const queueStartWait = time.Minute
+
+// DispatchQueue periodically starts the queued jobs. Only the primary
+// node of the leader replset does it, so the jobs are started one by
+// one in the order of the queue.
+func (a *Agent) DispatchQueue() {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for range tk.C {
+		err := a.dispatchQueued()
+		if err != nil {
+			a.log.Println("[ERROR] jobs queue:", err)
+		}
+	}
+}
+
+// dispatchQueued starts the first queued job which may run along with the
+// running operations, up to the cluster's concurrency limit. The job which
+// has to run alone (e.g. the restore) holds the ones queued after it.
+func (a *Agent) dispatchQueued() error {
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get node isMaster data")
+	}
+	if !nodeInfo.IsLeader() || !nodeInfo.IsMaster {
+		return nil
+	}
+
+	q, err := a.pbm.QueuedJobs()
+	if err != nil {
+		return errors.Wrap(err, "get queued jobs")
+	}
+	if len(q) == 0 {
+		return nil
+	}
+
+	cfg, err := a.pbm.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	locks, err := a.pbm.GetLocks(&pbm.LockHeader{})
+	if err != nil {
+		return errors.Wrap(err, "get locks")
+	}
+	ts, err := a.pbm.ClusterTime()
+	if err != nil {
+		return errors.Wrap(err, "read cluster time")
+	}
+	var live []pbm.LockHeader
+	running := make(map[string]struct{})
+	for _, l := range locks {
+		if !l.IsStale(ts) {
+			live = append(live, l.LockHeader)
+			running[string(l.Type)+"/"+l.BackupName] = struct{}{}
+		}
+	}
+	if len(running) >= cfg.Queue.Concurrency() {
+		return nil
+	}
+
+	var job *pbm.QueuedJob
+	for i := range q {
+		// the backup waits in the queue until the window opens,
+		// it doesn't hold up the other jobs meanwhile
+		if q[i].Type == pbm.CmdBackup && !q[i].Cmd.Backup.IgnoreWindow && cfg.Backup.Window.Check(time.Now()) != nil {
+			continue
+		}
+		if q[i].NotBefore > time.Now().Unix() {
+			continue
+		}
+		lh := q[i].Lock()
+		compatible := true
+		for _, l := range live {
+			if !lh.Compatible(l) {
+				compatible = false
+				break
+			}
+		}
+		if compatible {
+			job = &q[i]
+			break
+		}
+		// only the backups of the disjoint replsets may overtake the job
+		if lh.Type != pbm.CmdBackup || len(lh.Subset) == 0 {
+			return nil
+		}
+	}
+	if job == nil {
+		return nil
+	}
+
+	ok, err := a.pbm.ClaimQueuedJob(job.ID)
+	if err != nil {
+		return errors.Wrapf(err, "claim queued %s", job.Name)
+	}
+	if !ok {
+		return nil
+	}
+
+	a.log.Printf("[INFO] starting queued %s %s (%s)", job.Type, job.Name, job.Priority)
+	err = a.pbm.SendCmd(job.Cmd)
+	if err != nil {
+		// the job stays in the queue for the next attempt
+		rerr := a.pbm.ReleaseQueuedJob(job.ID)
+		if rerr != nil {
+			a.log.Printf("[ERROR] release queued %s %s: %v", job.Type, job.Name, rerr)
+		}
+		return errors.Wrapf(err, "send command for %s %s", job.Type, job.Name)
+	}
+	_, err = a.pbm.TakeQueuedJob(job.ID)
+	if err != nil {
+		a.log.Printf("[ERROR] remove started %s %s from the queue: %v", job.Type, job.Name, err)
+	}
+
+	// don't look at the queue until the job has taken the locks
+	tstart := time.Now()
+	for time.Since(tstart) < queueStartWait {
+		time.Sleep(time.Second * 1)
+		started, err := a.jobStarted(job)
+		if err != nil {
+			return errors.Wrapf(err, "check %s %s", job.Type, job.Name)
+		}
+		if started {
+			return nil
+		}
+	}
+	a.log.Printf("[WARNING] queued %s %s hasn't started in %v", job.Type, job.Name, queueStartWait)
+	return nil
+}
+
+// jobStarted returns true if the dispatched job has started:
+// the backup, the restore or the verification has the metadata, the delete
+// holds the lock (or is already done)
+func (a *Agent) jobStarted(job *pbm.QueuedJob) (bool, error) {
+	switch job.Type {
+	case pbm.CmdBackup:
+		bmeta, err := a.pbm.GetBackupMeta(job.Cmd.Backup.Name)
+		return err == nil && bmeta.Name != "", err
+	case pbm.CmdRestore:
+		rmeta, err := a.pbm.GetRestoreMeta(job.Cmd.Restore.Name)
+		return err == nil && rmeta.Name != "", err
+	case pbm.CmdVerify:
+		vmeta, err := a.pbm.GetVerifyMeta(job.Cmd.Verify.Name)
+		return err == nil && vmeta.Name != "", err
+	case pbm.CmdDeleteBackup:
+		if !job.Cmd.Delete.Expired {
+			bmeta, err := a.pbm.GetBackupMeta(job.Cmd.Delete.Backup)
+			if err != nil || bmeta.Name == "" {
+				return err == nil, err
+			}
+		}
+	}
+	locks, err := a.pbm.GetLocks(&pbm.LockHeader{Type: job.Type})
+	return len(locks) > 0, err
+}
+
+// reclaim cleans up after the previous run of the agent: the operations
+// it had been running died with it, so their locks are released right
+// away instead of waiting for them to go stale. The backup's replset is
+// marked failed so the standby nodes can take it over, the same way as
+// after a node loss. The leader's backup fails as a whole. The status
+// entries the agent left for the other nodes (e.g. before the host
+// rename) are removed.
+func (a *Agent) reclaim() error {
+	im, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster")
+	}
+
+	err = a.releaseLocks(im, "pbm-agent was restarted")
+	if err != nil {
+		return err
+	}
+
+	n, err := a.pbm.RemoveGhostAgents(a.id, im.SetName, im.Me)
+	if err != nil {
+		return errors.Wrap(err, "remove ghost statuses")
+	}
+	if n > 0 {
+		a.log.Printf("removed %d status entries of the agent for the other nodes", n)
+	}
+
+	prev, err := a.pbm.GetAgentStatus(im.SetName, im.Me)
+	if err == nil && prev.ID != "" && prev.ID != a.id {
+		ts, err := a.pbm.ClusterTime()
+		if err == nil && !prev.IsStale(ts) {
+			a.log.Printf("[WARNING] another agent (id %s) reports for the node %s/%s", prev.ID, im.SetName, im.Me)
+		}
+	}
+
+	return nil
+}
+
+// releaseLocks releases the locks taken by the agent (by its identity
+// or, if it has none, by the node) and marks their operations failed
+// with the given message
+func (a *Agent) releaseLocks(im *pbm.IsMaster, msg string) error {
+	lh := &pbm.LockHeader{AgentID: a.id}
+	if a.id == "" {
+		lh = &pbm.LockHeader{Replset: im.SetName, Node: im.Me}
+	}
+	locks, err := a.pbm.GetLocks(lh)
+	if err != nil {
+		return errors.Wrap(err, "get locks")
+	}
+	for _, l := range locks {
+		switch l.Type {
+		case pbm.CmdBackup:
+			var bmeta *pbm.BackupMeta
+			bmeta, err = a.pbm.GetBackupMeta(l.BackupName)
+			if err != nil {
+				break
+			}
+			// nobody is left to coordinate the backup
+			if (pbm.BackupCmd{Replsets: bmeta.Subset}).IsLeader(im) {
+				err = a.pbm.ChangeBackupState(l.BackupName, pbm.StatusError, msg)
+				break
+			}
+			err = a.pbm.ChangeRSState(l.BackupName, l.Replset, pbm.StatusError, msg)
+		case pbm.CmdRestore:
+			err = a.pbm.ChangeRestoreRSState(l.BackupName, l.Replset, pbm.StatusError, msg)
+		}
+		if err != nil {
+			a.log.Printf("[ERROR] mark %s %s failed: %v", l.Type, l.BackupName, err)
+		}
+		err = a.pbm.NewLock(l.LockHeader).Release()
+		if err != nil {
+			return errors.Wrapf(err, "release %s/%s lock", l.Type, l.BackupName)
+		}
+		a.log.Printf("released the lock of %s %s: %s", l.Type, l.BackupName, msg)
+	}
+	return nil
+}
+
+// HbStatus periodically reports the agent's state
+func (a *Agent) HbStatus() {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for range tk.C {
+		stat, err := a.status()
+		if err != nil {
+			a.log.Println("[ERROR] agent status:", err)
+			continue
+		}
+		err = a.pbm.SetAgentStatus(stat)
+		if err != nil {
+			a.log.Println("[ERROR] send agent status:", err)
+			continue
+		}
+		atomic.StoreInt64(&a.lastHb, time.Now().UnixNano())
+	}
+}
+
+// LastHeartbeat returns the time the agent's status was reported last.
+// It's zero until the first report.
+func (a *Agent) LastHeartbeat() time.Time {
+	ns := atomic.LoadInt64(&a.lastHb)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// status collects the agent's state. Failures of the particular checks
+// are reported in the state's error field.
+func (a *Agent) status() (pbm.AgentStat, error) {
+	var stat pbm.AgentStat
+	var errs []string
+
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		return stat, errors.Wrap(err, "get isMaster")
+	}
+	stat.ID = a.id
+	stat.Node = nodeInfo.Me
+	stat.RS = nodeInfo.SetName
+	stat.Labels = a.labels
+
+	ns, err := a.node.Status()
+	if err != nil {
+		errs = append(errs, "get node status: "+err.Error())
+	} else {
+		stat.StateStr = ns.StateStr
+	}
+
+	stat.ReplicationLag, err = a.node.ReplicationLag()
+	if err != nil {
+		errs = append(errs, "get replication lag: "+err.Error())
+	}
+
+	stat.DBPath, err = a.node.DBPath()
+	if err != nil {
+		errs = append(errs, "get dbpath: "+err.Error())
+	} else {
+		stat.DiskFree, err = pbm.DiskFree(stat.DBPath)
+		if err != nil {
+			errs = append(errs, "get free disk space: "+err.Error())
+		}
+	}
+
+	stat.Host, err = pbm.GetHostStat()
+	if err != nil {
+		errs = append(errs, "get host stat: "+err.Error())
+	}
+
+	_, stat.Maintenance, err = a.pbm.GetMaintenance(stat.RS, stat.Node)
+	if err != nil {
+		errs = append(errs, "get maintenance: "+err.Error())
+	}
+	locks, err := a.pbm.NodeLocks(stat.RS, stat.Node)
+	if err != nil {
+		errs = append(errs, "get locks: "+err.Error())
+	}
+	stat.Busy = len(locks) > 0
+	stat.Tasks = a.Tasks()
+
+	stat.Err = strings.Join(errs, "; ")
+	return stat, nil
+}
+
 // Backup starts backup
 func (a *Agent) Backup(bcp pbm.BackupCmd) {
-	q, err := backup.NodeSuits(bcp, a.node)
+	cfg, err := a.pbm.GetConfig()
 	if err != nil {
-		log.Println("[ERROR] backup: node check:", err)
+		a.log.Println("[ERROR] backup: get config:", err)
 		return
 	}
 
-	// node is not suitable for doing backup
-	if !q {
-		log.Println("Node in not suitable for backup")
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		a.log.Println("[ERROR] backup: get node isMaster data:", err)
 		return
 	}
 
-	nodeInfo, err := a.node.GetIsMaster()
+	if !pbm.MatchLabels(bcp.Selector, a.labels) {
+		// the backup can't go without the leader, so any node of the
+		// leading replset takes it if none of them matches the selector
+		if !bcp.IsLeader(nodeInfo) {
+			a.log.Printf("Node doesn't match the backup selector %s", pbm.LabelsString(bcp.Selector))
+			return
+		}
+		ok, err := a.pbm.HasLabeledAgent(nodeInfo.SetName, bcp.Selector)
+		if err != nil {
+			a.log.Println("[ERROR] backup: check the selector:", err)
+			return
+		}
+		if ok {
+			a.log.Printf("Node doesn't match the backup selector %s", pbm.LabelsString(bcp.Selector))
+			return
+		}
+		a.log.Printf("[WARNING] backup: no agent of the leading replset %s matches the selector %s, ignoring it", nodeInfo.SetName, pbm.LabelsString(bcp.Selector))
+	}
+	if !bcp.Includes(nodeInfo.SetName) {
+		a.log.Printf("Replset %s isn't a part of the backup %s", nodeInfo.SetName, bcp.Name)
+		return
+	}
+
+	if a.inMaintenance(nodeInfo) {
+		a.log.Printf("Node is in maintenance, skipping the backup %s", bcp.Name)
+		return
+	}
+
+	q, err := backup.NodeSuits(bcp, a.node, cfg.Backup)
 	if err != nil {
-		log.Println("[ERROR] backup: get node isMaster data:", err)
+		a.log.Println("[ERROR] backup: node check:", err)
+		return
+	}
+
+	// node is not suitable for doing backup
+	if !q {
+		a.log.Println("Node in not suitable for backup")
 		return
 	}
 
@@ -99,30 +603,204 @@ func (a *Agent) Backup(bcp pbm.BackupCmd) {
 		Replset:    nodeInfo.SetName,
 		Node:       nodeInfo.Me,
 		BackupName: bcp.Name,
+		Subset:     bcp.Replsets,
 	})
 
 	got, err := lock.Acquire()
 	if err != nil {
 		switch err.(type) {
 		case pbm.ErrConcurrentOp:
-			log.Println("[INFO] backup: acquiring lock:", err)
+			a.log.Println("[INFO] backup: acquiring lock:", err)
 		default:
-			log.Println("[ERROR] backup: acquiring lock:", err)
+			a.log.Println("[ERROR] backup: acquiring lock:", err)
 		}
 		return
 	}
 	if !got {
-		log.Println("Backup has been scheduled on another replset node")
+		a.log.Println("Backup has been scheduled on another replset node")
+		// the standby may run as long as the backup does, it mustn't
+		// hold the command from being handled meanwhile
+		if !bcp.IsLeader(nodeInfo) {
+			a.running.Add(1)
+			go func() {
+				defer a.running.Done()
+				a.backupStandby(bcp, nodeInfo, lock)
+			}()
+		}
 		return
 	}
 
-	log.Printf("Backup %s started on node %s/%s", bcp.Name, nodeInfo.SetName, nodeInfo.Me)
-	tstart := time.Now()
-	err = backup.New(a.pbm, a.node).Run(bcp)
+	a.log.Printf("Backup %s started on node %s/%s", bcp.Name, nodeInfo.SetName, nodeInfo.Me)
+	err = a.runBackup(bcp, nodeInfo, lock, backup.New(a.pbm, a.node).Run)
+	// only the leader restarts the failed backup so it would be done once
+	if err != nil && bcp.IsLeader(nodeInfo) {
+		a.restartBackup(bcp, nodeInfo, err)
+	}
+}
+
+// restartBackup queues a new backup if the failed one is allowed to be
+// restarted by the AutoRetry config. The restart waits out the backoff
+// in the jobs queue, so it survives the agent restart and is started by
+// the queue dispatcher along with the other jobs. Otherwise the failure
+// is final and it's reported with the final-failure event.
+func (a *Agent) restartBackup(bcp pbm.BackupCmd, nodeInfo *pbm.IsMaster, berr error) {
+	jlog := a.pbm.NewJobLogger(bcp.Name, nodeInfo.SetName, nodeInfo.Me)
+
+	cfg, err := a.pbm.GetConfig()
+	if err != nil {
+		a.log.Println("[ERROR] backup restart: get config:", err)
+		jlog.Errorf("final-failure", "backup failed, restart isn't possible: get config: %v", err)
+		return
+	}
+
+	retry := cfg.Backup.AutoRetry
+	attempt := bcp.Attempt + 1
+	switch {
+	case retry.Attempts == 0:
+		jlog.Errorf("final-failure", "backup failed: %v", berr)
+		return
+	case !backup.IsTransient(berr):
+		a.log.Printf("[ERROR] backup %s failed with non-transient error, no restarts would be made: %v", bcp.Name, berr)
+		jlog.Errorf("final-failure", "backup failed with non-transient error: %v", berr)
+		return
+	case attempt > retry.Attempts:
+		a.log.Printf("[ERROR] backup %s failed after %d restarts: %v", bcp.Name, bcp.Attempt, berr)
+		jlog.Errorf("final-failure", "backup failed after %d restarts: %v", bcp.Attempt, berr)
+		return
+	}
+
+	// exponential backoff plus up to 50% jitter
+	d := retry.Backoff(attempt)
+	d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+
+	origin := bcp.RetryOf
+	if origin == "" {
+		origin = bcp.Name
+	}
+	name, err := a.pbm.NewBackupName(cfg.Backup.NameTemplate, time.Now().Add(d), true)
 	if err != nil {
-		log.Println("[ERROR] backup:", err)
+		a.log.Println("[ERROR] backup restart: new backup name:", err)
+		jlog.Errorf("final-failure", "backup failed, restart isn't possible: new backup name: %v", err)
+		return
+	}
+	_, err = a.pbm.QueueJobAt(pbm.Cmd{
+		Cmd: pbm.CmdBackup,
+		Backup: pbm.BackupCmd{
+			Name:                name,
+			Compression:         bcp.Compression,
+			StoreName:           bcp.StoreName,
+			RetryOf:             origin,
+			Attempt:             attempt,
+			TimeoutSec:          bcp.TimeoutSec,
+			Type:                bcp.Type,
+			Base:                bcp.Base,
+			ExpireAt:            bcp.ExpireAt,
+			LegalHold:           bcp.LegalHold,
+			CheckGridFS:         bcp.CheckGridFS,
+			FsyncLock:           bcp.FsyncLock,
+			Selector:            bcp.Selector,
+			Replsets:            bcp.Replsets,
+			Tags:                bcp.Tags,
+			Profile:             bcp.Profile,
+			AdaptiveCompression: bcp.AdaptiveCompression,
+			MinCollSize:         bcp.MinCollSize,
+			MaxCollSize:         bcp.MaxCollSize,
+			ParallelCollections: bcp.ParallelCollections,
+			OplogFrom:           bcp.OplogFrom,
+			OplogUntil:          bcp.OplogUntil,
+			Replaces:            bcp.Replaces,
+		},
+	}, pbm.PriorityScheduled, time.Now().Add(d))
+	if err != nil {
+		a.log.Println("[ERROR] backup restart: queue backup:", err)
+		jlog.Errorf("final-failure", "backup failed, restart isn't possible: queue backup: %v", err)
+		return
+	}
+	a.log.Printf("[WARNING] backup %s failed, restart %d/%d as %s in %v: %v", bcp.Name, attempt, retry.Attempts, name, d, berr)
+	jlog.Warningf("retry", "backup failed, restart %d/%d as %s in %v: %v", attempt, retry.Attempts, name, d, berr)
+}
+
+// backupStandby watches the backup of the replset made by another node and
+// picks it up if the node was lost or the backup has failed and
+// FailurePolicyRetry allows retries.
+func (a *Agent) backupStandby(bcp pbm.BackupCmd, nodeInfo *pbm.IsMaster, lock *pbm.Lock) {
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-a.stop:
+			return
+		}
+
+		bmeta, err := a.pbm.GetBackupMeta(bcp.Name)
+		if err != nil {
+			a.log.Println("[ERROR] backup standby: get backup metadata:", err)
+			return
+		}
+		switch bmeta.Status {
+		case pbm.StatusStarting, pbm.StatusRunning:
+		case pbm.StatusDumpDone:
+			// the oplog of the replset which node was lost
+			// after the dump still can be redone
+		default:
+			// too late for the retry or backup has finished
+			return
+		}
+
+		for _, rs := range bmeta.Replsets {
+			if rs.Name != nodeInfo.SetName || rs.Status != pbm.StatusError {
+				continue
+			}
+			if !bmeta.RetryAllowed(rs) {
+				a.log.Printf("[INFO] backup standby: no retries left for %s", rs.Name)
+				return
+			}
+
+			if a.inMaintenance(nodeInfo) {
+				a.log.Printf("[INFO] backup standby: node is in maintenance, leaving %s to the other nodes", rs.Name)
+				return
+			}
+
+			got, err := lock.Acquire()
+			if err != nil {
+				a.log.Println("[ERROR] backup standby: acquiring lock:", err)
+				return
+			}
+			if !got {
+				// failed node still holds the lock or another standby got it first
+				continue
+			}
+
+			a.log.Printf("Backup %s restarted on node %s/%s, attempt %d", bcp.Name, nodeInfo.SetName, nodeInfo.Me, rs.Attempts+1)
+			a.runBackup(bcp, nodeInfo, lock, backup.New(a.pbm, a.node).Retry)
+			return
+		}
+	}
+}
+
+// inMaintenance returns true if the node's agent is in the maintenance mode.
+// The node is treated as being in the maintenance if it can't be checked.
+func (a *Agent) inMaintenance(nodeInfo *pbm.IsMaster) bool {
+	_, ok, err := a.pbm.GetMaintenance(nodeInfo.SetName, nodeInfo.Me)
+	if err != nil {
+		a.log.Println("[ERROR] check maintenance:", err)
+		return true
+	}
+	return ok
+}
+
+// runBackup runs the given backup func and releases the lock after
+func (a *Agent) runBackup(bcp pbm.BackupCmd, nodeInfo *pbm.IsMaster, lock *pbm.Lock, run func(pbm.BackupCmd) error) error {
+	tstart := time.Now()
+	a.annotate(pbm.CmdBackup, bcp.Name, nodeInfo, "started", nil)
+	berr := run(bcp)
+	if berr != nil {
+		a.log.Println("[ERROR] backup:", berr)
+		a.annotate(pbm.CmdBackup, bcp.Name, nodeInfo, "failed", berr)
 	} else {
-		log.Printf("Backup %s finished", bcp.Name)
+		a.log.Printf("Backup %s finished", bcp.Name)
+		a.annotate(pbm.CmdBackup, bcp.Name, nodeInfo, "finished", nil)
 	}
 
 	// In the case of fast backup (small db) we have to wait before releasing the lock.
@@ -140,20 +818,30 @@ func (a *Agent) Backup(bcp pbm.BackupCmd) {
 	if needToWait > 0 {
 		time.Sleep(needToWait)
 	}
-	err = lock.Release()
+	err := lock.Release()
 	if err != nil {
-		log.Printf("[ERROR] backup: unable to release backup lock for %v:%v\n", lock, err)
+		a.log.Printf("[ERROR] backup: unable to release backup lock for %v:%v\n", lock, err)
 	}
+
+	return berr
 }
 
-func (a *Agent) Restore(r pbm.RestoreCmd) {
+// Restore restores the backup on the node's replset. The opid is the ID
+// of the command the approval (if any) is used up by.
+func (a *Agent) Restore(r pbm.RestoreCmd, opid primitive.ObjectID) {
 	nodeInfo, err := a.node.GetIsMaster()
 	if err != nil {
-		log.Println("[ERROR] backup: get node isMaster data:", err)
+		a.log.Println("[ERROR] backup: get node isMaster data:", err)
 		return
 	}
 	if !nodeInfo.IsMaster {
-		log.Println("Node in not suitable for restore")
+		a.log.Println("Node in not suitable for restore")
+		return
+	}
+
+	err = a.pbm.CheckApproval(pbm.Cmd{Cmd: pbm.CmdRestore, Restore: r, ID: opid}, a.approval)
+	if err != nil {
+		a.log.Printf("[ERROR] restore of '%s' refused: %v", r.BackupName, err)
 		return
 	}
 
@@ -167,40 +855,120 @@ func (a *Agent) Restore(r pbm.RestoreCmd) {
 	got, err := lock.Acquire()
 
 	if err != nil {
-		log.Println("[ERROR] restore: acquiring lock:", err)
+		a.log.Println("[ERROR] restore: acquiring lock:", err)
 		return
 	}
 	if !got {
-		log.Println("[ERROR] unbale to run the restore while another backup or restore process running")
+		a.log.Println("[ERROR] unbale to run the restore while another backup or restore process running")
 		return
 	}
 	defer lock.Release()
 
-	log.Printf("[INFO] Restore of '%s' started", r.BackupName)
+	a.log.Printf("[INFO] Restore of '%s' started", r.BackupName)
+	a.annotate(pbm.CmdRestore, r.BackupName, nodeInfo, "started", nil)
 	err = restore.New(a.pbm, a.node).Run(r)
 	if err != nil {
-		log.Println("[ERROR] restore:", err)
+		a.log.Println("[ERROR] restore:", err)
+		a.annotate(pbm.CmdRestore, r.BackupName, nodeInfo, "failed", err)
+		a.postRestoreHooks(r, nodeInfo, err)
+		return
+	}
+	a.log.Printf("[INFO] Restore of '%s' finished successfully", r.BackupName)
+	a.annotate(pbm.CmdRestore, r.BackupName, nodeInfo, "finished", nil)
+	a.postRestoreHooks(r, nodeInfo, nil)
+}
+
+// annotate puts the event of the node's backup or restore on the PMM
+// dashboards if the PMM server is configured. It doesn't wait for the
+// server and the failures only are logged.
+func (a *Agent) annotate(typ pbm.Command, bcpName string, nodeInfo *pbm.IsMaster, event string, err error) {
+	cfg, cerr := a.pbm.GetConfig()
+	if cerr != nil {
+		a.log.Printf("[WARNING] pmm annotation: get config: %v", cerr)
+		return
+	}
+	if !cfg.PMM.Enabled() {
 		return
 	}
-	log.Printf("[INFO] Restore of '%s' finished successfully", r.BackupName)
+
+	an := pbm.PMMAnnotation{
+		Text: fmt.Sprintf("PBM %s of %s %s on %s/%s", typ, bcpName, event, nodeInfo.SetName, nodeInfo.Me),
+		Tags: []string{"pbm", string(typ), event, nodeInfo.SetName},
+	}
+	if err != nil {
+		an.Text += ": " + err.Error()
+	}
+	if a.pmmService != "" {
+		an.ServiceNames = []string{a.pmmService}
+	}
+	go func() {
+		err := cfg.PMM.Annotate(an)
+		if err != nil {
+			a.log.Printf("[WARNING] pmm annotation: %v", err)
+		}
+	}()
 }
 
 // ResyncBackupList uploads a backup list from the remote store
 func (a *Agent) ResyncBackupList() {
+	a.leaderOp(pbm.CmdResyncBackupList, "resync_list", a.pbm.ResyncBackupList)
+}
+
+// DeleteBackup deletes the given backup or all expired backups.
+// The opid is the ID of the command.
+func (a *Agent) DeleteBackup(d pbm.DeleteBackupCmd, opid primitive.ObjectID) {
+	a.leaderOp(pbm.CmdDeleteBackup, "delete_backup", func() error {
+		err := a.pbm.CheckApproval(pbm.Cmd{Cmd: pbm.CmdDeleteBackup, Delete: d, ID: opid}, a.approval)
+		if err != nil {
+			return errors.Wrap(err, "delete refused")
+		}
+		if d.Expired {
+			return backup.DeleteExpired(a.pbm)
+		}
+		return backup.DeleteBackup(a.pbm, d.Backup)
+	})
+}
+
+// BackupRetention sets the backup expiry and legal hold
+func (a *Agent) BackupRetention(r pbm.RetentionCmd) {
+	a.leaderOp(pbm.CmdBackupRetention, "backup_retention", func() error {
+		return backup.SetRetention(a.pbm, r.Backup, r.ExpireAt, r.LegalHold)
+	})
+}
+
+// Rehearse restores the backup into a throwaway mongod on the agent's
+// host and validates it. It runs in the background, the agent keeps
+// serving other commands meanwhile.
+func (a *Agent) Rehearse(r pbm.RehearsalCmd) {
+	go a.leaderOp(pbm.CmdRehearse, "rehearsal", func() error {
+		nodeInfo, err := a.node.GetIsMaster()
+		if err != nil {
+			return errors.Wrap(err, "get node isMaster data")
+		}
+		return rehearsal.Run(a.pbm, nodeInfo.Me, r)
+	})
+}
+
+// leaderOp runs the operation on the leader rs node which acquired the lock
+func (a *Agent) leaderOp(typ pbm.Command, logName string, op func() error) {
 	nodeInfo, err := a.node.GetIsMaster()
 	if err != nil {
-		log.Println("[ERROR] resync_list: get node isMaster data:", err)
+		a.log.Printf("[ERROR] %s: get node isMaster data: %v", logName, err)
 		return
 	}
 
 	if !nodeInfo.IsLeader() {
-		log.Println("[INFO] resync_list: not a memeber of the leader rs")
+		a.log.Printf("[INFO] %s: not a memeber of the leader rs", logName)
 		return
 	}
 
+	rs := nodeInfo.SetName
+	if typ == pbm.CmdRehearse {
+		rs = pbm.RehearsalReplset
+	}
 	lock := a.pbm.NewLock(pbm.LockHeader{
-		Type:    pbm.CmdResyncBackupList,
-		Replset: nodeInfo.SetName,
+		Type:    typ,
+		Replset: rs,
 		Node:    nodeInfo.Me,
 	})
 
@@ -208,24 +976,24 @@ func (a *Agent) ResyncBackupList() {
 	if err != nil {
 		switch err.(type) {
 		case pbm.ErrConcurrentOp:
-			log.Println("[INFO] resync_list: acquiring lock:", err)
+			a.log.Printf("[INFO] %s: acquiring lock: %v", logName, err)
 		default:
-			log.Println("[ERROR] resync_list: acquiring lock:", err)
+			a.log.Printf("[ERROR] %s: acquiring lock: %v", logName, err)
 		}
 		return
 	}
 	if !got {
-		log.Println("[INFO] resync_list: operation has been scheduled on another replset node")
+		a.log.Printf("[INFO] %s: operation has been scheduled on another replset node", logName)
 		return
 	}
 
 	tstart := time.Now()
-	log.Println("[INFO] resync_list: started")
-	err = a.pbm.ResyncBackupList()
+	a.log.Printf("[INFO] %s: started", logName)
+	err = op()
 	if err != nil {
-		log.Println("[ERROR] resync_list:", err)
+		a.log.Printf("[ERROR] %s: %v", logName, err)
 	} else {
-		log.Println("[INFO] resync_list: succeed")
+		a.log.Printf("[INFO] %s: succeed", logName)
 	}
 
 	needToWait := time.Second*1 - time.Since(tstart)
@@ -234,6 +1002,6 @@ func (a *Agent) ResyncBackupList() {
 	}
 	err = lock.Release()
 	if err != nil {
-		log.Printf("[ERROR] backup: unable to release backup lock for %v:%v\n", lock, err)
+		a.log.Printf("[ERROR] %s: unable to release lock for %v:%v\n", logName, lock, err)
 	}
 }
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// DefaultHookTimeout is the max duration of the hook command
+const DefaultHookTimeout = time.Minute * 5
+
+// hookOutputMax is the max length of the hook output logged
+const hookOutputMax = 4096
+
+// SetPostRestoreHooks sets the commands run by the agent after the restore
+// of its replset, e.g. to re-enable the application writes or to start the
+// data validation. They run one by one, each is killed after the timeout.
+func (a *Agent) SetPostRestoreHooks(hooks []string, timeout time.Duration) {
+	a.postRestore = hooks
+	a.hookTimeout = timeout
+	if a.hookTimeout <= 0 {
+		a.hookTimeout = DefaultHookTimeout
+	}
+}
+
+// postRestoreHooks runs the post-restore hooks with the restore context in
+// the environment. The restore lock is still held, so no backup or restore
+// starts until they finish. The failures only are logged.
+func (a *Agent) postRestoreHooks(r pbm.RestoreCmd, nodeInfo *pbm.IsMaster, rerr error) {
+	if len(a.postRestore) == 0 {
+		return
+	}
+
+	env := []string{
+		"PBM_HOOK=post-restore",
+		"PBM_RESTORE_NAME=" + r.Name,
+		"PBM_BACKUP_NAME=" + r.BackupName,
+		"PBM_REPLSET=" + nodeInfo.SetName,
+		"PBM_NODE=" + nodeInfo.Me,
+		"PBM_RESTORE_STATUS=" + string(pbm.StatusDone),
+	}
+	if rerr != nil {
+		env[len(env)-1] = "PBM_RESTORE_STATUS=" + string(pbm.StatusError)
+		env = append(env, "PBM_RESTORE_ERROR="+rerr.Error())
+	}
+	meta, err := a.pbm.GetRestoreMeta(r.Name)
+	if err != nil {
+		a.log.Printf("[WARNING] post-restore hooks: get restore metadata: %v", err)
+	} else {
+		for _, rs := range meta.Replsets {
+			if rs.Name == nodeInfo.SetName && rs.LastWriteTS.T > 0 {
+				env = append(env, fmt.Sprintf("PBM_RESTORED_TS=%d,%d", rs.LastWriteTS.T, rs.LastWriteTS.I))
+			}
+		}
+	}
+
+	for _, h := range a.postRestore {
+		start := time.Now()
+		out, err := runHook(h, env, a.hookTimeout)
+		if err != nil {
+			a.log.Printf("[WARNING] post-restore hook %q: %v\n%s", h, err, out)
+			continue
+		}
+		a.log.Printf("[INFO] post-restore hook %q finished in %v\n%s", h, time.Since(start).Round(time.Millisecond), out)
+	}
+}
+
+// runHook runs the hook command (the executable followed by its arguments,
+// no shell) with the env added to the agent's one. It returns the combined
+// output of the command.
+func runHook(hook string, env []string, timeout time.Duration) (string, error) {
+	args := strings.Fields(hook)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("killed after %v", timeout)
+	}
+
+	s := strings.TrimSpace(out.String())
+	if len(s) > hookOutputMax {
+		s = s[:hookOutputMax] + "..."
+	}
+	return s, err
+}
@@ -0,0 +1,382 @@
+package agent
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// balancerStopTimeout is how long to wait for the
+// current balancing round to finish stopping the balancer
+const balancerStopTimeout = time.Minute
+
+// maxBalancerHold is the longest the balancer is kept
+// stopped if the operation has no timeout of its own
+const maxBalancerHold = time.Hour * 24
+
+// Mongos is the agent connected to mongos. It takes over the cluster-level
+// operations of the backups and restores so the replset agents don't have
+// to: it holds the balancer stopped for the time of the operation, records
+// the sharded collections metadata of the backup and checks the GridFS buckets
+// which files and chunks may lie on different shards.
+type Mongos struct {
+	pbm  *pbm.PBM
+	ms   *pbm.Mongos
+	name string
+}
+
+// NewMongos creates the mongos agent. The name identifies the agent
+// among the other mongos agents (e.g. the mongos host:port).
+func NewMongos(cn *pbm.PBM, ms *pbm.Mongos, name string) *Mongos {
+	return &Mongos{
+		pbm:  cn,
+		ms:   ms,
+		name: name,
+	}
+}
+
+// Start starts listening the commands stream.
+func (a *Mongos) Start() error {
+	im, err := a.ms.GetIsMaster()
+	if err != nil {
+		return err
+	}
+	if !im.IsMongos() {
+		return errors.New("node isn't a mongos")
+	}
+
+	c, cerr, err := a.pbm.ListenCmd()
+	if err != nil {
+		return err
+	}
+
+	go a.HbStatus()
+
+	for {
+		select {
+		case cmd := <-c:
+			switch cmd.Cmd {
+			case pbm.CmdBackup:
+				log.Println("Got command", cmd.Cmd, cmd.Backup.Name)
+				go a.Backup(cmd.Backup)
+			case pbm.CmdRestore:
+				log.Println("Got command", cmd.Cmd, cmd.Restore.BackupName)
+				go a.Restore(cmd.Restore)
+			}
+		case err := <-cerr:
+			switch err.(type) {
+			case pbm.ErrorCursor:
+				return errors.Wrap(err, "stop listening")
+			default:
+				// channel closed / cursor is empty
+				if err == nil {
+					return errors.New("change stream was closed")
+				}
+
+				log.Println("[ERROR] listening commands:", err)
+			}
+		}
+	}
+}
+
+// HbStatus periodically reports the agent's state
+func (a *Mongos) HbStatus() {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for range tk.C {
+		stat := pbm.AgentStat{
+			Node:     a.name,
+			RS:       pbm.MongosReplset,
+			StateStr: "MONGOS",
+		}
+		var err error
+		stat.Host, err = pbm.GetHostStat()
+		if err != nil {
+			stat.Err = "get host stat: " + err.Error()
+		}
+		err = a.pbm.SetAgentStatus(stat)
+		if err != nil {
+			log.Println("[ERROR] send agent status:", err)
+		}
+	}
+}
+
+// Backup stops the balancer for the time of the backup
+// and records the sharded collections metadata
+func (a *Mongos) Backup(bcp pbm.BackupCmd) {
+	lock, ok := a.lock(pbm.CmdBackup, bcp.Name, bcp.Replsets)
+	if !ok {
+		return
+	}
+	defer lock.Release()
+
+	maxHold := time.Duration(bcp.TimeoutSec) * time.Second
+	if maxHold == 0 {
+		cfg, err := a.pbm.GetConfig()
+		if err != nil {
+			log.Printf("[ERROR] mongos: backup %s: get config: %v", bcp.Name, err)
+		}
+		maxHold = cfg.Backup.Timeout()
+	}
+
+	held, recorded, checked := false, false, !bcp.CheckGridFS
+	err := a.holdBalancer(bcp.Name, maxHold, func() (bool, error) {
+		bmeta, err := a.pbm.GetBackupMeta(bcp.Name)
+		if err != nil {
+			return false, errors.Wrap(err, "get backup metadata")
+		}
+		// the metadata is created by the leader agent,
+		// the shards wait for the mark before the dump
+		if bmeta.Name != "" && !held {
+			err = a.pbm.SetBalancerHeld(bcp.Name)
+			if err != nil {
+				return false, errors.Wrap(err, "mark the balancer as stopped")
+			}
+			held = true
+		}
+		if bmeta.Name != "" && !recorded {
+			err = a.recordShardedColls(bcp.Name)
+			if err != nil {
+				log.Printf("[ERROR] mongos: backup %s: %v", bcp.Name, err)
+			}
+			recorded = err == nil
+		}
+		if bmeta.Name != "" && !checked {
+			err = a.checkGridFS(bcp.Name)
+			if err != nil {
+				log.Printf("[WARNING] mongos: backup %s: GridFS check: %v", bcp.Name, err)
+			}
+			checked = true
+		}
+		return bmeta.IsFinished(), nil
+	}, func(wasOn bool) bool { return wasOn })
+	if err != nil {
+		log.Printf("[ERROR] mongos: backup %s: %v", bcp.Name, err)
+	}
+}
+
+// checkGridFS checks the chunks completeness of the cluster's GridFS buckets
+// reading them at a snapshot. Broken files don't fail the backup.
+func (a *Mongos) checkGridFS(bcpName string) error {
+	checks, err := a.ms.CheckGridFSBuckets(false, true)
+	if err != nil {
+		return errors.Wrap(err, "check buckets")
+	}
+	for _, c := range checks {
+		if !c.OK() {
+			log.Printf("[WARNING] GridFS %s", c)
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	return errors.Wrap(a.pbm.SetGridFS(bcpName, checks), "write check results")
+}
+
+func (a *Mongos) recordShardedColls(bcpName string) error {
+	colls, err := a.ms.ShardedCollections()
+	if err != nil {
+		return errors.Wrap(err, "get sharded collections")
+	}
+	return errors.Wrap(a.pbm.SetShardedColls(bcpName, colls), "write sharded collections")
+}
+
+// Restore stops the balancer for the time of the restore
+func (a *Mongos) Restore(r pbm.RestoreCmd) {
+	lock, ok := a.lock(pbm.CmdRestore, r.Name, nil)
+	if !ok {
+		return
+	}
+	defer lock.Release()
+
+	// the balancer goes back to the state recorded in the backup
+	// and to the one it had before the restore if there is no record
+	restoreOn := func(wasOn bool) bool { return wasOn }
+	bmeta, err := a.pbm.GetBackupMeta(r.BackupName)
+	if err != nil {
+		log.Printf("[WARNING] mongos: restore %s: get backup metadata: %v", r.Name, err)
+	} else if stopped, ok := bmeta.Settings.BalancerStopped(); ok {
+		restoreOn = func(bool) bool { return !stopped }
+	}
+
+	done := false
+	err = a.holdBalancer(r.Name, maxBalancerHold, func() (bool, error) {
+		rmeta, err := a.pbm.GetRestoreMeta(r.Name)
+		if err != nil {
+			return false, errors.Wrap(err, "get restore metadata")
+		}
+		switch rmeta.Status {
+		case pbm.StatusDone, pbm.StatusError:
+			done = rmeta.Status == pbm.StatusDone
+			return true, nil
+		}
+		return false, nil
+	}, restoreOn)
+	if err != nil {
+		log.Printf("[ERROR] mongos: restore %s: %v", r.Name, err)
+	}
+
+	if done && r.CheckGridFS {
+		err = a.checkRestoredGridFS(r.Name)
+		if err != nil {
+			log.Printf("[ERROR] mongos: restore %s: GridFS check: %v", r.Name, err)
+		}
+	}
+}
+
+// checkRestoredGridFS validates the restored GridFS buckets of the cluster:
+// chunks completeness and md5s. Nothing is written after the restore,
+// so the md5 reads that don't fit into a snapshot transaction go without it.
+func (a *Mongos) checkRestoredGridFS(name string) error {
+	checks, err := a.ms.CheckGridFSBuckets(true, false)
+	if err != nil {
+		return errors.Wrap(err, "check buckets")
+	}
+	for _, c := range checks {
+		if !c.OK() {
+			log.Printf("[WARNING] GridFS %s", c)
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	return errors.Wrap(a.pbm.SetRestoreGridFS(name, checks), "write check results")
+}
+
+// lock makes sure only one of the mongos agents serves the operation
+func (a *Mongos) lock(typ pbm.Command, name string, subset []string) (*pbm.Lock, bool) {
+	lock := a.pbm.NewLock(pbm.LockHeader{
+		Type:       typ,
+		Replset:    pbm.MongosLockReplset(name),
+		Node:       a.name,
+		BackupName: name,
+		Subset:     subset,
+	})
+	got, err := lock.Acquire()
+	if err != nil {
+		log.Printf("[ERROR] mongos: %s: acquiring lock: %v", typ, err)
+		return nil, false
+	}
+	if !got {
+		log.Printf("%s %s is served by another mongos agent", typ, name)
+		return nil, false
+	}
+	return lock, true
+}
+
+// holdBalancer stops the balancer (if it's on) and waits until
+// `done` reports the operation is finished, but no longer than maxHold.
+// The hold is shared by the concurrent operations (e.g. the backups of
+// the disjoint replsets subsets), and the last one to finish starts the
+// balancer if `after` says so, given whether it was on before the first
+// one stopped it. The operation that hasn't appeared within the time of
+// the operation start is considered failed to start.
+func (a *Mongos) holdBalancer(op string, maxHold time.Duration, done func() (bool, error), after func(wasOn bool) bool) error {
+	if maxHold <= 0 {
+		maxHold = maxBalancerHold
+	}
+
+	bs, err := a.ms.BalancerStatus()
+	if err != nil {
+		return errors.Wrap(err, "get balancer status")
+	}
+	err = a.pbm.AddBalancerHolder(op, bs.IsOn())
+	if err != nil {
+		return errors.Wrap(err, "hold balancer")
+	}
+	defer a.releaseBalancer(op, after)
+
+	if bs.IsOn() {
+		log.Println("stopping the balancer")
+		err = a.ms.BalancerStop(balancerStopTimeout)
+		if err != nil {
+			return errors.Wrap(err, "stop balancer")
+		}
+	}
+
+	tstart := time.Now()
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		if time.Since(tstart) > pbm.WaitActionStart*2 && !a.started() {
+			return errors.New("operation hasn't started")
+		}
+		if time.Since(tstart) > maxHold {
+			return errors.Errorf("the operation hasn't finished in %v", maxHold)
+		}
+		<-tk.C
+	}
+}
+
+// releaseBalancer drops the operation's hold (along with the ones of the
+// operations which mongos agents have died) and starts the balancer
+// if it was the last hold and `after` says so
+func (a *Mongos) releaseBalancer(op string, after func(wasOn bool) bool) {
+	ops := []string{op}
+	h, err := a.pbm.GetBalancerHold()
+	if err != nil {
+		log.Println("[ERROR] mongos: get balancer hold:", err)
+	}
+	if h != nil {
+		ts, err := a.pbm.ClusterTime()
+		if err != nil {
+			log.Println("[ERROR] mongos: read cluster time:", err)
+		}
+		for _, o := range h.Holders {
+			if o == op || err != nil {
+				continue
+			}
+			l, lerr := a.pbm.GetLockData(&pbm.LockHeader{Replset: pbm.MongosLockReplset(o), BackupName: o})
+			if lerr == mongo.ErrNoDocuments || lerr == nil && l.IsStale(ts) {
+				ops = append(ops, o)
+			}
+		}
+	}
+
+	h, err = a.pbm.RemoveBalancerHolders(ops...)
+	if err != nil {
+		log.Println("[ERROR] mongos: release balancer:", err)
+		return
+	}
+	if h == nil {
+		log.Println("the balancer is held by the other operations")
+		return
+	}
+	if !after(h.WasOn) {
+		return
+	}
+	log.Println("starting the balancer")
+	err = a.ms.BalancerStart()
+	if err != nil {
+		log.Println("[ERROR] mongos: start balancer:", err)
+	}
+}
+
+// started returns true if any of the replset agents has taken the operation
+func (a *Mongos) started() bool {
+	locks, err := a.pbm.GetLocks(&pbm.LockHeader{})
+	if err != nil {
+		log.Println("[ERROR] mongos: get locks:", err)
+		return true
+	}
+	for _, l := range locks {
+		switch {
+		case pbm.IsMongosLock(l.Replset), l.Replset == pbm.RehearsalReplset, l.Replset == pbm.StorageReplset:
+		default:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// noopCheckInterval is how often the primary checks if the oplog is idle
+const noopCheckInterval = time.Second * 5
+
+// OplogNoop periodically writes the no-op entry into the oplog of the idle
+// replset according to the backup config. Only the primary node does it.
+func (a *Agent) OplogNoop() {
+	tk := time.NewTicker(noopCheckInterval)
+	defer tk.Stop()
+	for range tk.C {
+		err := a.oplogNoop()
+		if err != nil {
+			a.log.Println("[ERROR] oplog no-op:", err)
+		}
+	}
+}
+
+func (a *Agent) oplogNoop() error {
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get node isMaster data")
+	}
+	if !nodeInfo.IsMaster || nodeInfo.SetName == "" {
+		return nil
+	}
+
+	cfg, err := a.pbm.GetConfig()
+	if err != nil {
+		if errors.Cause(err) == mongo.ErrNoDocuments {
+			return nil
+		}
+		return errors.Wrap(err, "get config")
+	}
+	idle := time.Duration(cfg.Backup.OplogNoopSec) * time.Second
+	if idle <= 0 {
+		return nil
+	}
+
+	last := nodeInfo.LastWrite.LastWriteDate
+	if last.IsZero() || time.Since(last) < idle {
+		return nil
+	}
+	return a.node.AppendOplogNote(bson.D{{"msg", "pbm: periodic noop"}})
+}
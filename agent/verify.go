@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/rehearsal"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// verifyCheckInterval is how often the leader checks
+// if the latest backup is due for the verification
+const verifyCheckInterval = time.Minute
+
+// ScheduleVerify periodically sends the command to verify the latest
+// successful backup according to the verify config. Only the primary
+// node of the leader replset does it.
+func (a *Agent) ScheduleVerify() {
+	tk := time.NewTicker(verifyCheckInterval)
+	defer tk.Stop()
+	for range tk.C {
+		err := a.scheduleVerify()
+		if err != nil {
+			a.log.Println("[ERROR] schedule verification:", err)
+		}
+	}
+}
+
+func (a *Agent) scheduleVerify() error {
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get node isMaster data")
+	}
+	if !nodeInfo.IsLeader() || !nodeInfo.IsMaster {
+		return nil
+	}
+
+	cfg, err := a.pbm.GetConfig()
+	if err != nil {
+		if errors.Cause(err) == mongo.ErrNoDocuments {
+			return nil
+		}
+		return errors.Wrap(err, "get config")
+	}
+	if cfg.Verify.Interval() == 0 {
+		return nil
+	}
+
+	last, err := a.pbm.VerificationsList(1, true)
+	if err != nil {
+		return errors.Wrap(err, "get last verification")
+	}
+	if len(last) > 0 && time.Since(time.Unix(last[0].StartTS, 0)) < cfg.Verify.Interval() {
+		return nil
+	}
+
+	bcps, err := a.pbm.FindBackups(pbm.BackupFilter{Status: pbm.StatusDone}, 1)
+	if err != nil {
+		return errors.Wrap(err, "get latest backup")
+	}
+	if len(bcps) == 0 {
+		return nil
+	}
+
+	name := "verify-" + time.Now().UTC().Format("20060102150405")
+	a.log.Printf("[INFO] scheduling verification %s of backup %s", name, bcps[0].Name)
+	err = a.pbm.SendCmd(pbm.Cmd{
+		Cmd: pbm.CmdVerify,
+		Verify: pbm.VerifyCmd{
+			Name:      name,
+			Backup:    bcps[0].Name,
+			Rehearse:  cfg.Verify.Rehearse,
+			Checks:    cfg.Verify.Checks,
+			Scheduled: true,
+		},
+	})
+	return errors.Wrap(err, "send command")
+}
+
+// Verify reads the backup files through and optionally rehearses
+// the restore of the backup. It runs in the background.
+func (a *Agent) Verify(v pbm.VerifyCmd) {
+	go a.leaderOp(pbm.CmdVerify, "verify", func() error {
+		return a.verify(v)
+	})
+}
+
+func (a *Agent) verify(v pbm.VerifyCmd) (err error) {
+	nodeInfo, err := a.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get node isMaster data")
+	}
+
+	meta := &pbm.VerifyMeta{
+		Name:      v.Name,
+		Backup:    v.Backup,
+		Node:      nodeInfo.Me,
+		Scheduled: v.Scheduled,
+		StartTS:   time.Now().UTC().Unix(),
+		Status:    pbm.StatusRunning,
+	}
+	err = a.pbm.SetVerifyMeta(meta)
+	if err != nil {
+		return errors.Wrap(err, "write verification meta to db")
+	}
+
+	defer func() {
+		meta.FinishTS = time.Now().UTC().Unix()
+		meta.Status = pbm.StatusDone
+		if err != nil {
+			meta.Status = pbm.StatusError
+			meta.Error = err.Error()
+			a.alertVerify(meta)
+		}
+		ferr := a.pbm.FinishVerify(meta)
+		if ferr != nil {
+			a.log.Printf("[ERROR] verify: save results: %v", ferr)
+		}
+	}()
+
+	meta.Files, meta.Docs, err = restore.Verify(a.pbm, v.Backup)
+	if err != nil {
+		return errors.Wrap(err, "read backup")
+	}
+	a.log.Printf("[INFO] verify: backup %s read through: %d files, %d documents", v.Backup, meta.Files, meta.Docs)
+
+	if !v.Rehearse {
+		return nil
+	}
+
+	bcp, err := a.pbm.GetBackupMeta(v.Backup)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	for _, rs := range bcp.Replsets {
+		name := v.Name + "-" + rs.Name
+		meta.Rehearsals = append(meta.Rehearsals, name)
+		err = rehearsal.Run(a.pbm, nodeInfo.Me, pbm.RehearsalCmd{
+			Name:    name,
+			Backup:  v.Backup,
+			Replset: rs.Name,
+			Checks:  rsChecks(v.Checks, rs, bcp.Replsets),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "rehearsal %s", name)
+		}
+
+		rm, err := a.pbm.GetRehearsalMeta(name)
+		if err != nil {
+			return errors.Wrapf(err, "get rehearsal %s results", name)
+		}
+		if !rm.Passed() {
+			return errors.Errorf("rehearsal %s: checks haven't passed", name)
+		}
+	}
+
+	return nil
+}
+
+// rsChecks returns the checks of the collections the replset has in
+// the backup. The checks of the namespaces no replset has recorded
+// are kept for every replset, so they still fail.
+func rsChecks(checks []pbm.RehearsalCheck, rs pbm.BackupReplset, all []pbm.BackupReplset) []pbm.RehearsalCheck {
+	has := func(r pbm.BackupReplset, ns string) bool {
+		for _, c := range r.Collections {
+			if c.NS == ns {
+				return true
+			}
+		}
+		return false
+	}
+
+	var rv []pbm.RehearsalCheck
+	for _, c := range checks {
+		ns := c.DB + "." + c.Collection
+		if has(rs, ns) {
+			rv = append(rv, c)
+			continue
+		}
+		recorded := false
+		for _, r := range all {
+			if has(r, ns) {
+				recorded = true
+				break
+			}
+		}
+		if !recorded {
+			rv = append(rv, c)
+		}
+	}
+	return rv
+}
+
+// alertVerify posts the failed verification's metadata to the alert URL
+func (a *Agent) alertVerify(meta *pbm.VerifyMeta) {
+	a.log.Printf("[ERROR] verification %s of backup %s has failed: %s", meta.Name, meta.Backup, meta.Error)
+
+	cfg, err := a.pbm.GetConfig()
+	if err != nil || cfg.Verify.AlertURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(meta)
+	if err != nil {
+		a.log.Println("[ERROR] verify alert: marshal:", err)
+		return
+	}
+	cl := http.Client{Timeout: time.Second * 10}
+	resp, err := cl.Post(cfg.Verify.AlertURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		a.log.Println("[ERROR] verify alert:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		a.log.Printf("[ERROR] verify alert: unexpected response %s", resp.Status)
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// DefaultWorkers is the default max number of the commands
+// the agent runs at a time
+const DefaultWorkers = 4
+
+// SetWorkers sets the max number of the commands the agent runs at a
+// time. The commands over it wait for the running ones to finish. The
+// conflicting operations (e.g. the backup and the restore) are still
+// serialized by the locks, the pool lets the ones which don't take the
+// replset lock (the verification, the rehearsal, the retention update)
+// run along with them.
+func (a *Agent) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	a.workers = make(chan struct{}, n)
+}
+
+// run starts the command once there is a free worker. It returns false
+// if the agent is stopped while waiting for the worker.
+func (a *Agent) run(cmd pbm.Cmd) bool {
+	select {
+	case a.workers <- struct{}{}:
+	case <-a.stop:
+		a.log.Println("Agent is stopping, ignoring command", cmd.Cmd)
+		return false
+	}
+
+	t := pbm.AgentTask{Cmd: cmd.Cmd, Name: cmd.JobName(), StartTS: time.Now().UTC().Unix()}
+	a.tasksMu.Lock()
+	a.tasksSeq++
+	id := a.tasksSeq
+	a.tasks[id] = t
+	a.tasksMu.Unlock()
+
+	a.running.Add(1)
+	go func() {
+		defer func() {
+			a.tasksMu.Lock()
+			delete(a.tasks, id)
+			a.tasksMu.Unlock()
+			<-a.workers
+			a.running.Done()
+		}()
+		a.exec(cmd)
+	}()
+	return true
+}
+
+// exec runs the command
+func (a *Agent) exec(cmd pbm.Cmd) {
+	err := a.accountRate(cmd)
+	if err != nil {
+		a.log.Printf("[ERROR] %s %s: %v", cmd.Cmd, cmd.JobName(), err)
+		return
+	}
+	if cmd.IdempotencyKey != "" {
+		prev, err := a.pbm.ClaimIdempotencyKey(cmd)
+		if err != nil {
+			a.log.Printf("[ERROR] %s %s: claim idempotency key: %v", cmd.Cmd, cmd.JobName(), err)
+			return
+		}
+		if prev != "" {
+			a.log.Printf("Skipping %s %s: %s has already been started with the idempotency key", cmd.Cmd, cmd.JobName(), prev)
+			return
+		}
+	}
+
+	switch cmd.Cmd {
+	case pbm.CmdBackup:
+		a.log.Println("Got command", cmd.Cmd, cmd.Backup.Name)
+		a.Backup(cmd.Backup)
+	case pbm.CmdRestore:
+		a.log.Println("Got command", cmd.Cmd, cmd.Restore.BackupName)
+		a.Restore(cmd.Restore, cmd.ID)
+	case pbm.CmdResyncBackupList:
+		a.log.Println("Got command", cmd.Cmd)
+		a.ResyncBackupList()
+	case pbm.CmdDeleteBackup:
+		a.log.Println("Got command", cmd.Cmd, cmd.Delete.Backup)
+		a.DeleteBackup(cmd.Delete, cmd.ID)
+	case pbm.CmdBackupRetention:
+		a.log.Println("Got command", cmd.Cmd, cmd.Retention.Backup)
+		a.BackupRetention(cmd.Retention)
+	case pbm.CmdRehearse:
+		a.log.Println("Got command", cmd.Cmd, cmd.Rehearsal.Backup)
+		a.Rehearse(cmd.Rehearsal)
+	case pbm.CmdVerify:
+		a.log.Println("Got command", cmd.Cmd, cmd.Verify.Backup)
+		a.Verify(cmd.Verify)
+	}
+}
+
+// accountRate accounts the command against the rate limits of the user
+// who has sent it
+func (a *Agent) accountRate(cmd pbm.Cmd) error {
+	cfg, err := a.pbm.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	err = a.pbm.AccountRequest(cfg.RateLimit.Requests, cmd)
+	if _, ok := err.(pbm.RateLimitError); ok {
+		return err
+	}
+	return errors.Wrap(err, "check rate limit")
+}
+
+// Tasks returns the commands being run, the earliest started first
+func (a *Agent) Tasks() []pbm.AgentTask {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+
+	ids := make([]uint64, 0, len(a.tasks))
+	for id := range a.tasks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	ts := make([]pbm.AgentTask, 0, len(ids))
+	for _, id := range ids {
+		ts = append(ts, a.tasks[id])
+	}
+	return ts
+}
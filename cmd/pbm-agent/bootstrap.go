@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v2"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+type bootstrapOpts struct {
+	rsConfig   string
+	pbmConfig  string
+	backup     string
+	addMembers bool
+	wait       time.Duration
+}
+
+// runBootstrap rebuilds a replica set from the backup on an empty node:
+// initiates a replset, waits for the node to become primary, restores
+// the backup's data and oplog and, if asked, adds the rest of members.
+func runBootstrap(mongoURI string, o bootstrapOpts) error {
+	mongoURI, err := pbm.NodeURI(mongoURI)
+	if err != nil {
+		return errors.Wrap(err, "node connection string")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rsbuf, err := ioutil.ReadFile(o.rsConfig)
+	if err != nil {
+		return errors.Wrap(err, "read replset config file")
+	}
+	var rscfg pbm.RSConfig
+	err = yaml.UnmarshalStrict(rsbuf, &rscfg)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal replset config")
+	}
+	if rscfg.ID == "" || len(rscfg.Members) == 0 {
+		return errors.New("replset config should have _id and at least one member")
+	}
+
+	cfgbuf, err := ioutil.ReadFile(o.pbmConfig)
+	if err != nil {
+		return errors.Wrap(err, "read pbm config file")
+	}
+
+	cn, err := connectNode(ctx, mongoURI, "pbm-agent-bootstrap")
+	if err != nil {
+		return err
+	}
+	defer cn.Disconnect(ctx)
+
+	node := pbm.NewNode(ctx, "node0", cn, mongoURI)
+
+	im, err := node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster data")
+	}
+	if im.SetName != "" {
+		return errors.Errorf("node is already a member of the replset %s", im.SetName)
+	}
+
+	initcfg := rscfg
+	if o.addMembers {
+		initcfg.Members = rscfg.Members[:1]
+	}
+	initcfg.Version = 1
+	log.Printf("initiating replset %s with %d member(s)", initcfg.ID, len(initcfg.Members))
+	err = node.ReplsetInitiate(initcfg)
+	if err != nil {
+		return errors.Wrap(err, "initiate replset")
+	}
+
+	err = node.WaitForPrimary(o.wait)
+	if err != nil {
+		return errors.Wrap(err, "wait for primary")
+	}
+	log.Println("node is primary")
+
+	pbmClient, err := pbm.New(ctx, mongoURI, "pbm-agent")
+	if err != nil {
+		return errors.Wrap(err, "connect to mongodb")
+	}
+	err = pbmClient.SetConfigByte(cfgbuf)
+	if err != nil {
+		return errors.Wrap(err, "set pbm config")
+	}
+
+	log.Printf("restoring backup '%s'", o.backup)
+	err = restore.New(pbmClient, node).Bootstrap(o.backup)
+	if err != nil {
+		return errors.Wrap(err, "restore")
+	}
+	log.Printf("backup '%s' restored", o.backup)
+
+	if !o.addMembers {
+		return nil
+	}
+
+	// members are added one by one since newer mongod versions
+	// don't allow to add more than one voting member per reconfig
+	for _, m := range rscfg.Members[1:] {
+		cur, err := node.GetReplsetConfig()
+		if err != nil {
+			return errors.Wrap(err, "get replset config")
+		}
+		cur.Version++
+		cur.Members = append(cur.Members, m)
+		err = node.ReplsetReconfig(*cur)
+		if err != nil {
+			return errors.Wrapf(err, "add member %s", m.Host)
+		}
+		log.Printf("member %s added", m.Host)
+	}
+
+	fmt.Println("replset is bootstrapped, start pbm-agent on each member")
+	return nil
+}
+
+// connectNode creates a direct connection to the node
+func connectNode(ctx context.Context, uri, appName string) (*mongo.Client, error) {
+	cn, err := mongo.NewClient(options.Client().ApplyURI(uri).SetAppName(appName).SetDirect(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "create node client")
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "node connect")
+	}
+	return cn, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/version"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("version", expvar.Func(func() interface{} {
+		return version.DefaultInfo
+	}))
+}
+
+// diagMux serves the API added once the agent has connected
+var diagMux = http.NewServeMux()
+
+// debugMux serves the pprof and expvar endpoints
+var debugMux = http.NewServeMux()
+
+// serveAPI adds the read-only cluster API to the diagnostics endpoints.
+// /v1/restore-points returns the points the cluster can be restored to.
+// /v1/backups and /v1/agents return the pages of the lists, see listPage.
+// /v1/maintenance returns the nodes which agents are in the maintenance mode.
+// /v1/approvals returns the approval requests, the audit trail of who has
+// requested and approved the restores and deletes.
+// /v1/queue returns the queued jobs in the order they will be started.
+// /v1/events streams the agents, backups and restores state changes,
+// see serveEvents.
+// /metrics exports the state of the backups catalog for Prometheus.
+// With `jobs` the backup and restore jobs can be submitted to /v1/jobs,
+// see serveJobs. The agent serving several instances serves the API
+// of the first instance connected.
+func serveAPI(cn *pbm.PBM, jobs bool) {
+	apiOnce.Do(func() { registerAPI(cn, jobs) })
+}
+
+var apiOnce sync.Once
+
+func registerAPI(cn *pbm.PBM, jobs bool) {
+	diagMux.Handle("/metrics", &metricsHandler{cn: cn})
+
+	diagMux.HandleFunc("/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(cn, w, r)
+	})
+
+	diagMux.Handle("/v1/restore-points", &pointsHandler{cn: cn})
+
+	diagMux.HandleFunc("/v1/backups", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pg, err := listPage(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := backupFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bcps, total, err := cn.FindBackupsPage(f, pg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "backups", newListResponse(pg, total, len(bcps), bcps))
+	})
+
+	diagMux.HandleFunc("/v1/agents", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pg, err := listPage(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := agentFilter(cn, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stats, total, err := cn.AgentsStatusPage(f, pg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "agents", newListResponse(pg, total, len(stats), stats))
+	})
+
+	diagMux.HandleFunc("/v1/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		ms, err := cn.Maintenances()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "maintenance", ms)
+	})
+
+	diagMux.HandleFunc("/v1/approvals", func(w http.ResponseWriter, r *http.Request) {
+		as, err := cn.Approvals(0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "approvals", as)
+	})
+
+	diagMux.HandleFunc("/v1/queue", func(w http.ResponseWriter, r *http.Request) {
+		q, err := cn.QueuedJobs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "queue", q)
+	})
+
+	if jobs {
+		diagMux.HandleFunc("/v1/jobs", func(w http.ResponseWriter, r *http.Request) {
+			serveJobs(cn, w, r)
+		})
+	}
+}
+
+// pointsHandler serves the restorable points of the cluster. The chain
+// check reads the storage, so the result is cached for metricsTTL.
+type pointsHandler struct {
+	cn *pbm.PBM
+
+	mu     sync.Mutex
+	points *backup.RestorablePoints
+	at     time.Time
+}
+
+func (p *pointsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pts, err := p.get()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "restore points", pts)
+}
+
+func (p *pointsHandler) get() (*backup.RestorablePoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.points != nil && time.Since(p.at) < metricsTTL {
+		return p.points, nil
+	}
+	pts, err := backup.GetRestorablePoints(p.cn)
+	if err != nil {
+		return nil, err
+	}
+	p.points, p.at = pts, time.Now()
+	return pts, nil
+}
+
+func writeJSON(w http.ResponseWriter, api string, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("[ERROR] %s API: %v", api, err)
+	}
+}
+
+// defaultPageLimit is the page size if the request doesn't set it
+const defaultPageLimit = 100
+
+// listPage reads the page of the list from the query parameters:
+// limit (default 100, max 1000), offset and sort (the field name,
+// "-" prefix for the descending order)
+func listPage(q url.Values) (pbm.Page, error) {
+	pg := pbm.Page{Limit: defaultPageLimit, Sort: q.Get("sort")}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		pg.Limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || pg.Limit < 1 || pg.Limit > pbm.MaxPageLimit {
+			return pg, errors.Errorf("limit has to be 1..%d", pbm.MaxPageLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		pg.Skip, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || pg.Skip < 0 {
+			return pg, errors.New("offset has to be a non-negative number")
+		}
+	}
+	return pg, nil
+}
+
+// listResponse is the page of the list. Next is the offset
+// of the next page, it's absent on the last page.
+type listResponse struct {
+	Total  int64       `json:"total"`
+	Offset int64       `json:"offset"`
+	Limit  int64       `json:"limit"`
+	Next   *int64      `json:"next,omitempty"`
+	Items  interface{} `json:"items"`
+}
+
+func newListResponse(pg pbm.Page, total int64, n int, items interface{}) listResponse {
+	r := listResponse{
+		Total:  total,
+		Offset: pg.Skip,
+		Limit:  pg.Limit,
+		Items:  items,
+	}
+	if next := pg.Skip + int64(n); n > 0 && next < total {
+		r.Next = &next
+	}
+	return r
+}
+
+// backupFilter reads the filter of the backups from the query parameters:
+// tag (key=value, repeatable), since and until (unix time or RFC3339),
+// type and status
+func backupFilter(q url.Values) (pbm.BackupFilter, error) {
+	f := pbm.BackupFilter{
+		Type:   pbm.BackupType(q.Get("type")),
+		Status: pbm.Status(q.Get("status")),
+	}
+
+	tags, err := keyValues(q["tag"])
+	if err != nil {
+		return f, errors.Wrap(err, "tag")
+	}
+	f.Tags = tags
+
+	f.Since, err = queryTime(q.Get("since"))
+	if err != nil {
+		return f, errors.Wrap(err, "since")
+	}
+	f.Until, err = queryTime(q.Get("until"))
+	if err != nil {
+		return f, errors.Wrap(err, "until")
+	}
+	return f, nil
+}
+
+// agentFilter reads the filter of the agents from the query parameters:
+// replset, node, label (key=value, repeatable) and lost (true/false)
+func agentFilter(cn *pbm.PBM, q url.Values) (pbm.AgentFilter, error) {
+	f := pbm.AgentFilter{
+		Replset: q.Get("replset"),
+		Node:    q.Get("node"),
+	}
+
+	labels, err := keyValues(q["label"])
+	if err != nil {
+		return f, errors.Wrap(err, "label")
+	}
+	f.Labels = labels
+
+	if v := q.Get("lost"); v != "" {
+		lost, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.Wrap(err, "lost")
+		}
+		f.Lost = &lost
+		f.Now, err = cn.ClusterTime()
+		if err != nil {
+			return f, errors.Wrap(err, "read cluster time")
+		}
+	}
+	return f, nil
+}
+
+func keyValues(vals []string) (map[string]string, error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(vals))
+	for _, kv := range vals {
+		i := strings.Index(kv, "=")
+		if i < 1 || strings.ContainsAny(kv[:i], ".$") {
+			return nil, errors.Errorf("invalid %q, expected key=value", kv)
+		}
+		m[kv[:i]] = kv[i+1:]
+	}
+	return m, nil
+}
+
+func queryTime(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, errors.Errorf("invalid time %q, expected unix time or RFC3339", v)
+	}
+	return t.Unix(), nil
+}
+
+// serveDiag exposes the pprof profiles on /debug/pprof/ and the expvar
+// runtime stats (incl. memstats) on /debug/vars to diagnose the long
+// running agent, along with the API. The endpoints are served on each of
+// the addresses, see listenSpec. Without TLS and the client certificates
+// they have no auth, so such address shouldn't be reachable from outside
+// the host (e.g. 127.0.0.1:6060 or the unix socket).
+func serveDiag(addrs []string) error {
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	debugMux.Handle("/debug/vars", expvar.Handler())
+
+	all := http.NewServeMux()
+	all.Handle("/debug/", debugMux)
+	all.Handle("/", diagMux)
+
+	for _, a := range addrs {
+		l, err := parseListenSpec(a)
+		if err != nil {
+			return errors.Wrap(err, "diagnostics address")
+		}
+		ln, err := l.listen()
+		if err != nil {
+			return errors.Wrapf(err, "listen on %s", l)
+		}
+
+		var h http.Handler = all
+		switch l.scope {
+		case scopeAPI:
+			h = diagMux
+		case scopeDebug:
+			h = debugMux
+		}
+		go func() {
+			log.Println("diagnostics endpoints are listening on", l)
+			err := http.Serve(ln, h)
+			if err != nil {
+				log.Printf("[ERROR] diagnostics endpoints on %s: %v", l, err)
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// eventsPoll is how often the cluster state is polled for the events
+const eventsPoll = time.Second * 2
+
+// eventsKeepalive is how often the comment is sent to the idle stream
+// so the proxies don't close it
+const eventsKeepalive = time.Second * 30
+
+// serveEvents streams the cluster events (see pbm.Event) as the
+// server-sent events: the "event" field is the type and the "data" one
+// is the JSON event. The type query parameter (comma separated, can be
+// repeated) limits the stream to the given types. The poll errors are
+// sent as the "poll_error" events, the stream goes on after them.
+func serveEvents(cn *pbm.PBM, w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	types := make(map[pbm.EventType]bool)
+	for _, v := range r.URL.Query()["type"] {
+		for _, t := range strings.Split(v, ",") {
+			types[pbm.EventType(strings.TrimSpace(t))] = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	evc, errc := cn.WatchEvents(r.Context(), eventsPoll)
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-evc:
+			if !ok {
+				return
+			}
+			if len(types) > 0 && !types[e.Type] {
+				continue
+			}
+			err = writeEvent(w, string(e.Type), e)
+		case perr, ok := <-errc:
+			if !ok {
+				return
+			}
+			log.Println("[ERROR] events API:", perr)
+			err = writeEvent(w, "poll_error", struct {
+				Error string `json:"error"`
+			}{perr.Error()})
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err != nil {
+			// the client has gone
+			return
+		}
+		fl.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, typ string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, data)
+	return err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// probeTimeout is the max duration of each readiness check
+const probeTimeout = time.Second * 3
+
+func init() {
+	diagMux.HandleFunc("/healthz", health.serveLive)
+	diagMux.HandleFunc("/readyz", health.serveReady)
+}
+
+// health is the state of the agent the probes report
+var health = &probes{}
+
+// probes serve the liveness and the readiness probes for the load
+// balancers and the Kubernetes. They are served from the start, the
+// agent is not ready until it has connected. The agent serving several
+// instances (see runAgents) is ready once all of them are.
+type probes struct {
+	mu        sync.RWMutex
+	instances int
+	targets   []*probeTarget
+}
+
+// probeTarget is the instance the agent has connected to
+type probeTarget struct {
+	name string
+	cn   *pbm.PBM
+	// node is the mongod (mongos) the agent serves
+	node *mongo.Client
+	// lastHb is the time of the last status reported, nil if the agent
+	// doesn't report it (the mongos one)
+	lastHb func() time.Time
+	since  time.Time
+}
+
+// expect sets the number of the instances the agent serves
+func (p *probes) expect(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.instances = n
+}
+
+// connected adds the clients the agent has connected to the instance
+// `name` with. The clients of the instance reconnected replace the old ones.
+func (p *probes) connected(name string, cn *pbm.PBM, node *mongo.Client, lastHb func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := &probeTarget{name: name, cn: cn, node: node, lastHb: lastHb, since: time.Now()}
+	for i := range p.targets {
+		if p.targets[i].name == name {
+			p.targets[i] = t
+			return
+		}
+	}
+	p.targets = append(p.targets, t)
+}
+
+// hbStale returns the time of the last status report if it's too old
+func (t *probeTarget) hbStale() (time.Time, bool) {
+	if t.lastHb == nil {
+		return time.Time{}, false
+	}
+	hb := t.lastHb()
+	if hb.IsZero() {
+		hb = t.since
+	}
+	return hb, time.Since(hb) > time.Duration(pbm.StaleFrameSec)*time.Second
+}
+
+// oldestHb returns the time of the oldest status report among the
+// instances, zero if none has been reported yet
+func (p *probes) oldestHb() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var oldest time.Time
+	for _, t := range p.targets {
+		if t.lastHb == nil {
+			continue
+		}
+		hb := t.lastHb()
+		if hb.IsZero() {
+			hb = t.since
+		}
+		if oldest.IsZero() || hb.Before(oldest) {
+			oldest = hb
+		}
+	}
+	return oldest
+}
+
+// serveLive fails only if the connected agent has stopped reporting its
+// status, i.e. it's stuck and has to be restarted
+func (p *probes) serveLive(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, t := range p.targets {
+		if hb, stale := t.hbStale(); stale {
+			http.Error(w, t.prefix(len(p.targets))+"no status reported since "+hb.Format(time.RFC3339), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// prefix returns the prefix of the instance's checks if there are several
+func (t *probeTarget) prefix(n int) string {
+	if n < 2 {
+		return ""
+	}
+	return t.name + " "
+}
+
+// readiness is the result of the readiness checks. Checks are "ok" or
+// the error. The agents are the number of the cluster's agents which
+// are alive and lost, the storage is whether it's configured.
+type readiness struct {
+	Ready   bool              `json:"ready"`
+	Checks  map[string]string `json:"checks"`
+	Agents  *agentsCount      `json:"agents,omitempty"`
+	Storage string            `json:"storage,omitempty"`
+}
+
+type agentsCount struct {
+	Alive int `json:"alive"`
+	Lost  int `json:"lost"`
+}
+
+// serveReady reports whether the agent has connected and both its node
+// and the PBM control collections are reachable
+func (p *probes) serveReady(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	res := readiness{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+			return
+		}
+		res.Checks[name] = "ok"
+	}
+
+	if len(p.targets) == 0 || len(p.targets) < p.instances {
+		res.Ready = false
+		res.Checks["connected"] = "the agent hasn't connected yet"
+		if len(p.targets) > 0 {
+			res.Checks["connected"] = fmt.Sprintf("%d of %d instances connected", len(p.targets), p.instances)
+		}
+		writeProbe(w, res)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	for _, t := range p.targets {
+		pre := t.prefix(len(p.targets))
+		check(pre+"node", t.node.Ping(ctx, nil))
+		check(pre+"pbm", t.cn.Conn.Ping(ctx, nil))
+		if hb, stale := t.hbStale(); stale {
+			res.Ready = false
+			res.Checks[pre+"heartbeat"] = "no status reported since " + hb.Format(time.RFC3339)
+		}
+	}
+
+	// the cluster state is of the first instance's cluster
+	t := p.targets[0]
+	if res.Checks[t.prefix(len(p.targets))+"pbm"] == "ok" {
+		res.Agents, res.Storage = t.clusterState()
+	}
+	writeProbe(w, res)
+}
+
+// clusterState returns the agents count and the storage state. They
+// don't affect the readiness, the failures leave them empty.
+func (t *probeTarget) clusterState() (*agentsCount, string) {
+	var ac *agentsCount
+	ts, err := t.cn.ClusterTime()
+	if err == nil {
+		stats, err := t.cn.AgentsStatus()
+		if err == nil {
+			ac = &agentsCount{}
+			for _, s := range stats {
+				if s.IsStale(ts) {
+					ac.Lost++
+				} else {
+					ac.Alive++
+				}
+			}
+		}
+	}
+
+	storage := "not configured"
+	stg, err := t.cn.GetStorage()
+	switch {
+	case err == nil && stg.Type != pbm.StorageUndef:
+		storage = string(stg.Type)
+	case err != nil && err != mongo.ErrNoDocuments:
+		storage = ""
+	}
+	return ac, storage
+}
+
+func writeProbe(w http.ResponseWriter, res readiness) {
+	if !res.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, "readiness", res)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runAgents runs the agent of each instance (mongod) given by the
+// connection strings in the same process, so the consolidated host doesn't
+// need the process per instance. Each instance has its own connections,
+// status entry and identity, the same as the separate agents would. The
+// agents are stopped together, the failure of one stops the rest.
+func runAgents(uris []string, o agentOpts, stopTimeout time.Duration, sv supervisor) error {
+	health.expect(len(uris))
+	go watchdog(health.oldestHb)
+
+	err := o.checkInstances(len(uris))
+	if err != nil {
+		return setupError{err}
+	}
+	if len(uris) == 1 {
+		return runAgent(uris[0], o.forInstance(1), stopTimeout, sv)
+	}
+	if o.idFile != "" {
+		return setupError{errors.New("--id-file can't be used with several instances, the default file is per node")}
+	}
+	o.tagLogs = true
+
+	f := newFanSupervisor(sv, len(uris))
+	errc := make(chan error, len(uris))
+	for i, uri := range uris {
+		go func(i int, uri string) {
+			// the connection string may have the password in it
+			errc <- errors.Wrapf(runAgent(uri, o.forInstance(i+1), stopTimeout, f.instance(i)), "instance #%d", i+1)
+		}(i, uri)
+	}
+
+	var first error
+	for range uris {
+		err := <-errc
+		if err == nil {
+			continue
+		}
+		log.Println("[ERROR]", err)
+		f.stopAll("another instance has failed")
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// fanSupervisor passes the stop requests of the supervisor to the agent
+// of each instance and reports the process ready once all of them are
+type fanSupervisor struct {
+	sv    supervisor
+	stops []chan string
+
+	mu       sync.Mutex
+	ready    int
+	stopping bool
+}
+
+func newFanSupervisor(sv supervisor, n int) *fanSupervisor {
+	f := &fanSupervisor{sv: sv}
+	for i := 0; i < n; i++ {
+		// the second request makes the agent hand the operations off
+		f.stops = append(f.stops, make(chan string, 2))
+	}
+	go func() {
+		for s := range sv.stopc() {
+			f.stopAll(s)
+		}
+	}()
+	return f
+}
+
+// stopAll asks the agent of each instance to stop
+func (f *fanSupervisor) stopAll(reason string) {
+	for _, c := range f.stops {
+		select {
+		case c <- reason:
+		default:
+		}
+	}
+}
+
+func (f *fanSupervisor) notify(s agentState, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch s {
+	case stateReady:
+		f.ready++
+		if f.ready == len(f.stops) {
+			f.sv.notify(stateReady, fmt.Sprintf("listening for the commands on %d instances", f.ready))
+		}
+	case stateStopping:
+		if !f.stopping {
+			f.stopping = true
+			f.sv.notify(stateStopping, status)
+		}
+	}
+}
+
+func (f *fanSupervisor) instance(i int) supervisor {
+	return instanceSupervisor{f: f, i: i}
+}
+
+// instanceSupervisor is the supervisor of the instance's agent
+type instanceSupervisor struct {
+	f *fanSupervisor
+	i int
+}
+
+func (s instanceSupervisor) notify(st agentState, status string) { s.f.notify(st, status) }
+
+func (s instanceSupervisor) stopc() <-chan string { return s.f.stops[s.i] }
+
+// instanceHelp is the help of the options which may be scoped to the instance
+const instanceHelp = "The value prefixed with <n>: (e.g. 2:dc=east) applies only to the n-th --mongodb-uri instance, the one without the prefix to all of them"
+
+// instancePrefix splits the `<n>:` prefix off the option's value.
+// It returns 0 if there is no prefix.
+func instancePrefix(v string) (int, string) {
+	i := strings.IndexByte(v, ':')
+	if i < 1 {
+		return 0, v
+	}
+	n, err := strconv.Atoi(v[:i])
+	if err != nil || n < 1 {
+		return 0, v
+	}
+	return n, v[i+1:]
+}
+
+// scoped returns the values of the option which apply to the instance #n,
+// with the prefix stripped. The instance's own ones go last.
+func scoped(vals []string, n int) []string {
+	var all, own []string
+	for _, v := range vals {
+		in, s := instancePrefix(v)
+		switch in {
+		case 0:
+			all = append(all, s)
+		case n:
+			own = append(own, s)
+		}
+	}
+	return append(all, own...)
+}
+
+// instanceValue returns the value of the single-valued option, the
+// instance's own one overrides the one of all instances
+func instanceValue(vals []string) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[len(vals)-1]
+}
+
+// forInstance returns the options of the instance #n (starting from 1)
+func (o agentOpts) forInstance(n int) agentOpts {
+	o.pmmService = scoped(o.pmmService, n)
+	o.postRestore = scoped(o.postRestore, n)
+
+	labels := make(map[string]string, len(o.labels))
+	var own [][2]string
+	for k, v := range o.labels {
+		in, key := instancePrefix(k)
+		switch in {
+		case 0:
+			labels[key] = v
+		case n:
+			own = append(own, [2]string{key, v})
+		}
+	}
+	for _, l := range own {
+		labels[l[0]] = l[1]
+	}
+	o.labels = labels
+	return o
+}
+
+// checkInstances checks the options scoped to the instance refer to
+// one of the `n` instances and the single-valued ones are set once
+func (o agentOpts) checkInstances(n int) error {
+	var vals []string
+	vals = append(vals, o.pmmService...)
+	vals = append(vals, o.postRestore...)
+	for k := range o.labels {
+		vals = append(vals, k)
+	}
+	for _, v := range vals {
+		if in, _ := instancePrefix(v); in > n {
+			return errors.Errorf("%q refers to the instance #%d, there are %d", v, in, n)
+		}
+	}
+
+	seen := make(map[int]bool)
+	for _, v := range o.pmmService {
+		in, _ := instancePrefix(v)
+		if seen[in] {
+			return errors.New("--pmm-service is set more than once for the same instance")
+		}
+		seen[in] = true
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// maxJobSpec is the max size of the job spec accepted by the API
+const maxJobSpec = 1 << 20
+
+type jobResponse struct {
+	Job     string `json:"job"`
+	State   string `json:"state"`
+	Created bool   `json:"created"`
+}
+
+// serveJobs submits the backup or restore job spec (YAML or JSON, see
+// pbm.JobSpec) posted to /v1/jobs. The job name is the key: the job which
+// already exists isn't submitted again and its state is returned with
+// 200 OK, so the same spec can be posted any number of times. The new job
+// is queued (or waits for the approval) and returned with 201 Created.
+func serveJobs(cn *pbm.PBM, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxJobSpec))
+	if err != nil {
+		http.Error(w, "read job spec: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := pbm.ParseJobSpec(buf)
+	if err != nil {
+		http.Error(w, "parse job spec: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := jobResponse{Job: fmt.Sprintf("%s/%s", j.Kind, j.Metadata.Name)}
+	res.State, err = cn.JobState(j)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res.State != "" {
+		writeJSON(w, "jobs", res)
+		return
+	}
+
+	res.State, err = cn.SubmitJob(j, time.Now())
+	if err != nil {
+		http.Error(w, "submit job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res.Created = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, "jobs", res)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenScope is the set of the endpoints served on the listener
+type listenScope string
+
+const (
+	scopeAll   listenScope = ""
+	scopeAPI   listenScope = "api"
+	scopeDebug listenScope = "debug"
+)
+
+// listenSpec is the address the diagnostics endpoints are served on:
+// host:port or unix:<path>, followed by the comma separated options.
+// cert=<file>,key=<file> serve TLS, client-ca=<file> requires the client
+// certificates signed by the CA. scope=api serves only the API and the
+// metrics, scope=debug only the pprof and expvar endpoints.
+//
+//	127.0.0.1:6060
+//	unix:/run/pbm-agent.sock,scope=api
+//	0.0.0.0:6443,cert=/etc/pbm/tls.crt,key=/etc/pbm/tls.key,scope=api
+type listenSpec struct {
+	network  string
+	addr     string
+	cert     string
+	key      string
+	clientCA string
+	scope    listenScope
+}
+
+func parseListenSpec(s string) (listenSpec, error) {
+	parts := strings.Split(s, ",")
+	l := listenSpec{network: "tcp", addr: strings.TrimSpace(parts[0])}
+	if strings.HasPrefix(l.addr, "unix:") {
+		l.network, l.addr = "unix", strings.TrimPrefix(l.addr, "unix:")
+	}
+	if l.addr == "" {
+		return l, errors.Errorf("%q: no address", s)
+	}
+
+	for _, o := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(o), "=", 2)
+		if len(kv) != 2 {
+			return l, errors.Errorf("%q: invalid option %q, expected key=value", s, o)
+		}
+		switch kv[0] {
+		case "cert":
+			l.cert = kv[1]
+		case "key":
+			l.key = kv[1]
+		case "client-ca":
+			l.clientCA = kv[1]
+		case "scope":
+			l.scope = listenScope(kv[1])
+			if l.scope != scopeAPI && l.scope != scopeDebug {
+				return l, errors.Errorf("%q: unknown scope %q, expected %s or %s", s, kv[1], scopeAPI, scopeDebug)
+			}
+		default:
+			return l, errors.Errorf("%q: unknown option %q", s, kv[0])
+		}
+	}
+	if (l.cert == "") != (l.key == "") {
+		return l, errors.Errorf("%q: both cert and key have to be set", s)
+	}
+	if l.clientCA != "" && l.cert == "" {
+		return l, errors.Errorf("%q: client-ca requires TLS (cert and key)", s)
+	}
+	return l, nil
+}
+
+func (l listenSpec) String() string {
+	s := l.addr
+	if l.network == "unix" {
+		s = "unix:" + s
+	}
+	if l.cert != "" {
+		s += " (tls)"
+	}
+	if l.scope != scopeAll {
+		s += " [" + string(l.scope) + "]"
+	}
+	return s
+}
+
+// listen opens the listener. The stale socket file left by the previous
+// run is removed. The socket is accessible to the owner and the group only.
+func (l listenSpec) listen() (net.Listener, error) {
+	if l.network == "unix" {
+		if fi, err := os.Stat(l.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", l.addr); err == nil {
+				c.Close()
+				return nil, errors.Errorf("%s is in use", l.addr)
+			}
+			os.Remove(l.addr)
+		}
+	}
+
+	ln, err := net.Listen(l.network, l.addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.network == "unix" {
+		err = os.Chmod(l.addr, 0660)
+		if err != nil {
+			ln.Close()
+			return nil, errors.Wrap(err, "set socket permissions")
+		}
+	}
+	if l.cert == "" {
+		return ln, nil
+	}
+
+	tc, err := l.tlsConfig()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tc), nil
+}
+
+func (l listenSpec) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(l.cert, l.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "load certificate")
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if l.clientCA == "" {
+		return tc, nil
+	}
+
+	pem, err := ioutil.ReadFile(l.clientCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "read client CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", l.clientCA)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	return tc, nil
+}
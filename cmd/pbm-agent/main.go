@@ -5,7 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/pkg/errors"
@@ -17,12 +18,67 @@ import (
 	"github.com/percona/percona-backup-mongodb/version"
 )
 
+const diagAddrHelp = "Serve pprof, expvar and the read-only API endpoints on the address, can be repeated. " +
+	"The address is host:port or unix:<path>, optionally followed by the comma separated cert=<file>,key=<file> (TLS), " +
+	"client-ca=<file> (require the client certificates) and scope=api|debug (serve only the API or the pprof and expvar). " +
+	"E.g. 127.0.0.1:6060 or unix:/run/pbm-agent.sock,scope=api. Off by default"
+
 func main() {
 	var (
 		pbmCmd      = kingpin.New("pbm-agent", "Percona Backup for MongoDB")
 		pbmAgentCmd = pbmCmd.Command("run", "Run agent").Default().Hidden()
 
-		mURI = pbmAgentCmd.Flag("mongodb-uri", "MongoDB connection string").Envar("PBM_MONGODB_URI").Required().String()
+		mURIs        = pbmAgentCmd.Flag("mongodb-uri", "MongoDB connection string (mongodb+srv:// resolves to the node on this host), can be repeated to serve several instances on the host by the same process").Envar("PBM_MONGODB_URI").Required().Strings()
+		mLabels      = pbmAgentCmd.Flag("label", "Agent label (e.g. dc=east), can be repeated. Backups can be restricted to the agents with the given labels. "+instanceHelp).StringMap()
+		mDiag        = pbmAgentCmd.Flag("diag-addr", diagAddrHelp).Envar("PBM_DIAG_ADDR").Strings()
+		mStopTimeout = pbmAgentCmd.Flag("shutdown-timeout", "On SIGTERM/SIGINT wait up to the given time for the running backup or restore to finish before handing it off to the other nodes").Envar("PBM_SHUTDOWN_TIMEOUT").Default("10m").Duration()
+		mServiceName = pbmAgentCmd.Flag("service-name", "Run as the Windows service of the given name. Set by <pbm-agent service install>").Hidden().String()
+		mIDFile      = pbmAgentCmd.Flag("id-file", "File the agent's identity is kept in across restarts. Defaults to <user config dir>/pbm-agent/<node>.id").Envar("PBM_AGENT_ID_FILE").String()
+		mTokens      = pbmAgentCmd.Flag("token", "Registration token of the agent (see pbm agent-token). Required if the cluster has the tokens, the agent serves only the replset the token is bound to. Can be repeated for the instances of different replsets").Envar("PBM_AGENT_TOKEN").Strings()
+		mPMMService  = pbmAgentCmd.Flag("pmm-service", "PMM service name of the node (as added with pmm-admin) the backup and restore annotations are bound to. They are shown on all dashboards if not set. "+instanceHelp).Envar("PBM_PMM_SERVICE").Strings()
+		mPostRestore = pbmAgentCmd.Flag("post-restore-hook", "Command (an executable with the arguments, no shell) run after the restore of the node's replset, can be repeated. The restore name, the backup, the replset, the status and the restored timestamp are passed in the PBM_* env vars. "+instanceHelp).Envar("PBM_POST_RESTORE_HOOK").Strings()
+		mHookTimeout = pbmAgentCmd.Flag("hook-timeout", "Max duration of each hook command").Default(agent.DefaultHookTimeout.String()).Duration()
+		mApproval    = pbmAgentCmd.Flag("approval", "Operation (restore, delete) the agent runs only when approved, whatever the approval config is. Can be repeated. Requires --approval-key").Envar("PBM_APPROVAL").Strings()
+		mApprovalKey = pbmAgentCmd.Flag("approval-key", "Approvers' public key file (PEM, PKIX ed25519). If set, only the approvals signed with the private one (pbm approval approve --key) are accepted").Envar("PBM_APPROVAL_KEY").String()
+		mJobsAPI     = pbmAgentCmd.Flag("jobs-api", "Accept the backup and restore job specs (see pbm apply) posted to /v1/jobs of the diag address. Whoever reaches the address can start the jobs, so keep it private").Envar("PBM_JOBS_API").Bool()
+		mWorkers     = pbmAgentCmd.Flag("workers", "Max number of the commands run at a time, e.g. the verification along with the backup. The conflicting operations are still run one by one").Default(strconv.Itoa(agent.DefaultWorkers)).Int()
+
+		bootstrapCmd        = pbmCmd.Command("bootstrap", "Initiate a new replset on an empty node and restore the backup into it")
+		bootstrapURI        = bootstrapCmd.Flag("mongodb-uri", "MongoDB connection string of the empty node").Envar("PBM_MONGODB_URI").Required().String()
+		bootstrapRSConfig   = bootstrapCmd.Flag("rs-config", "Replset config file (yaml or json). The first member has to be the node itself").Required().String()
+		bootstrapPBMConfig  = bootstrapCmd.Flag("config", "PBM config file with the backup storage").Required().String()
+		bootstrapBackup     = bootstrapCmd.Flag("backup", "Backup name to restore").Required().String()
+		bootstrapAddMembers = bootstrapCmd.Flag("add-members", "Initiate with the first member only and add the rest after the restore").Bool()
+		bootstrapWait       = bootstrapCmd.Flag("wait-primary", "How long to wait for the node to become primary").Default("2m").Duration()
+
+		seedCmd         = pbmCmd.Command("seed", "Restore the backup on an empty standalone node to join the replset without an initial sync")
+		seedURI         = seedCmd.Flag("mongodb-uri", "MongoDB connection string of the standalone node").Envar("PBM_MONGODB_URI").Required().String()
+		seedSourceURI   = seedCmd.Flag("source-uri", "MongoDB connection string of the replset (cluster) the backup belongs to").Required().String()
+		seedBackup      = seedCmd.Flag("backup", "Backup name to restore").Required().String()
+		seedReplset     = seedCmd.Flag("replset", "Replset the node will join. Defaults to the source-uri one").String()
+		seedOplogSizeMB = seedCmd.Flag("oplog-size-mb", "Size of the node's oplog").Default("1024").Int()
+
+		offlineCmd       = pbmCmd.Command("restore", "Restore the backup into the node without the cluster and the agents, e.g. when only the storage and one host survived")
+		offlineURI       = offlineCmd.Flag("mongodb-uri", "MongoDB connection string of the node (a standalone or a primary)").Envar("PBM_MONGODB_URI").Required().String()
+		offlinePBMConfig = offlineCmd.Flag("config", "PBM config file with the backup storage").Required().String()
+		offlineBackup    = offlineCmd.Flag("backup", "Backup name to restore. Its metadata is read from the storage unless --meta is given").String()
+		offlineMeta      = offlineCmd.Flag("meta", "Backup metadata file (<backup>.pbm.json) to use instead of the storage one").String()
+		offlineReplset   = offlineCmd.Flag("replset", "Replset of the backup to restore. Defaults to the node's replset or the only one in the backup").String()
+		offlineUntil     = offlineCmd.Flag("until", "Replay the backup's oplog up to the timestamp <T[,I]> or RFC3339 date instead of its end").String()
+
+		mongosCmd  = pbmCmd.Command("mongos", "Run agent connected to mongos which serves the cluster-level operations (balancer control, sharded collections metadata, GridFS checks)")
+		mongosURI  = mongosCmd.Flag("mongodb-uri", "MongoDB connection string of the mongos").Envar("PBM_MONGODB_URI").Required().String()
+		mongosName = mongosCmd.Flag("name", "Name of the agent among the other mongos agents. Defaults to the hostname").String()
+		mongosDiag = mongosCmd.Flag("diag-addr", diagAddrHelp).Envar("PBM_DIAG_ADDR").Strings()
+
+		serviceCmd           = pbmCmd.Command("service", "Manage the Windows service of the agent")
+		serviceInstallCmd    = serviceCmd.Command("install", "Install the agent as the Windows service which is started on the boot and restarted on the failure")
+		serviceInstallName   = serviceInstallCmd.Flag("name", "Service name").Default("pbm-agent").String()
+		serviceInstallUser   = serviceInstallCmd.Flag("user", "Account the service runs as. Defaults to LocalSystem").String()
+		serviceInstallPass   = serviceInstallCmd.Flag("password", "Password of the account").String()
+		serviceInstallArgs   = serviceInstallCmd.Arg("agent-flags", "Flags the agent is run with, put them after '--' (e.g. -- --mongodb-uri=mongodb://...)").Strings()
+		serviceUninstallCmd  = serviceCmd.Command("uninstall", "Stop and remove the Windows service of the agent")
+		serviceUninstallName = serviceUninstallCmd.Flag("name", "Service name").Default("pbm-agent").String()
 
 		versionCmd    = pbmCmd.Command("version", "PBM version info")
 		versionShort  = versionCmd.Flag("short", "Only version info").Default("false").Bool()
@@ -33,7 +89,7 @@ func main() {
 	cmd, err := pbmCmd.DefaultEnvars().Parse(os.Args[1:])
 	if err != nil && cmd != versionCmd.FullCommand() {
 		log.Println("Error: Parse command line parameters:", err)
-		return
+		os.Exit(exitSetup)
 	}
 
 	if cmd == versionCmd.FullCommand() {
@@ -48,18 +104,163 @@ func main() {
 		return
 	}
 
-	log.Println(runAgent(*mURI))
+	if cmd == serviceInstallCmd.FullCommand() {
+		err = installService(*serviceInstallName, *serviceInstallUser, *serviceInstallPass, *serviceInstallArgs)
+		if err != nil {
+			log.Println("Error: install service:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s is installed\n", *serviceInstallName)
+		return
+	}
+
+	if cmd == serviceUninstallCmd.FullCommand() {
+		err = uninstallService(*serviceUninstallName)
+		if err != nil {
+			log.Println("Error: uninstall service:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s is removed\n", *serviceUninstallName)
+		return
+	}
+
+	if cmd == bootstrapCmd.FullCommand() {
+		err = runBootstrap(*bootstrapURI, bootstrapOpts{
+			rsConfig:   *bootstrapRSConfig,
+			pbmConfig:  *bootstrapPBMConfig,
+			backup:     *bootstrapBackup,
+			addMembers: *bootstrapAddMembers,
+			wait:       *bootstrapWait,
+		})
+		if err != nil {
+			log.Println("Error: bootstrap:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == seedCmd.FullCommand() {
+		err = runSeed(*seedURI, seedOpts{
+			sourceURI:   *seedSourceURI,
+			backup:      *seedBackup,
+			replset:     *seedReplset,
+			oplogSizeMB: *seedOplogSizeMB,
+		})
+		if err != nil {
+			log.Println("Error: seed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == offlineCmd.FullCommand() {
+		err = runOffline(*offlineURI, offlineOpts{
+			pbmConfig: *offlinePBMConfig,
+			backup:    *offlineBackup,
+			meta:      *offlineMeta,
+			replset:   *offlineReplset,
+			until:     *offlineUntil,
+		})
+		if err != nil {
+			log.Println("Error: restore:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == mongosCmd.FullCommand() {
+		err = serveDiag(*mongosDiag)
+		if err != nil {
+			log.Println("Error:", err)
+			os.Exit(exitSetup)
+		}
+		err = runMongos(*mongosURI, *mongosName, newSysSupervisor())
+		if err != nil {
+			log.Println("Error:", err)
+		} else {
+			log.Println("pbm-agent stopped")
+		}
+		os.Exit(exitCode(err))
+	}
+
+	err = serveDiag(*mDiag)
+	if err != nil {
+		log.Println("Error:", err)
+		os.Exit(exitSetup)
+	}
+	approval, err := pbm.ParseApprovalPolicy(*mApproval, *mApprovalKey)
+	if err != nil {
+		log.Println("Error: approval:", err)
+		os.Exit(exitSetup)
+	}
+	run := func(sv supervisor) error {
+		return runAgents(*mURIs, agentOpts{
+			labels:      *mLabels,
+			idFile:      *mIDFile,
+			tokens:      *mTokens,
+			pmmService:  *mPMMService,
+			postRestore: *mPostRestore,
+			hookTimeout: *mHookTimeout,
+			workers:     *mWorkers,
+			approval:    approval,
+			jobsAPI:     *mJobsAPI,
+		}, *mStopTimeout, sv)
+	}
+	if *mServiceName != "" {
+		err = runService(*mServiceName, run)
+	} else {
+		err = run(newSysSupervisor())
+	}
+	if err != nil {
+		log.Println("Error:", err)
+	} else {
+		log.Println("pbm-agent stopped")
+	}
+	os.Exit(exitCode(err))
 }
 
-func runAgent(mongoURI string) error {
-	mongoURI = "mongodb://" + strings.Replace(mongoURI, "mongodb://", "", 1)
+type agentOpts struct {
+	// labels, pmmService and postRestore may be scoped to the instance,
+	// see forInstance
+	labels map[string]string
+	idFile string
+	// tokens are the registration tokens, any of them bound to
+	// the instance's replset lets the agent in
+	tokens     []string
+	pmmService []string
+	// postRestore are the post-restore hook commands
+	postRestore []string
+	hookTimeout time.Duration
+	// workers is the max number of the commands run at a time
+	workers int
+	// approval is the approval the agent requires on its own
+	approval pbm.ApprovalPolicy
+	// jobsAPI enables the jobs submission API
+	jobsAPI bool
+	// tagLogs prefixes the agent's log lines with the instance's node
+	tagLogs bool
+}
+
+// runAgent runs the agent until the supervisor stops it. It returns nil
+// if the agent is stopped gracefully.
+func runAgent(uri string, o agentOpts, stopTimeout time.Duration, sv supervisor) error {
+	mongoURI, err := pbm.NodeURI(uri)
+	if err != nil {
+		return setupError{errors.Wrap(err, "node connection string")}
+	}
+	// the pbm collections are written on the primary,
+	// the SRV string's replset is kept for that
+	rsURI, err := pbm.ResolveURI(uri)
+	if err != nil {
+		return setupError{errors.Wrap(err, "replset connection string")}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	node, err := mongo.NewClient(options.Client().ApplyURI(mongoURI).SetAppName("pbm-agent-exec").SetDirect(true))
 	if err != nil {
-		return errors.Wrap(err, "create node client")
+		return setupError{errors.Wrap(err, "create node client")}
 	}
 	err = node.Connect(ctx)
 	if err != nil {
@@ -71,15 +272,120 @@ func runAgent(mongoURI string) error {
 		return errors.Wrap(err, "node ping")
 	}
 
-	pbmClient, err := pbm.New(ctx, mongoURI, "pbm-agent")
+	pbmClient, err := pbm.New(ctx, rsURI, "pbm-agent")
 	if err != nil {
 		return errors.Wrap(err, "connect to mongodb")
 	}
 
+	// the replset connection may be served by another member
+	im, err := pbm.NewNode(ctx, "node0", node, mongoURI).GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster")
+	}
+	if im.IsMongos() {
+		return setupError{errors.New("the node is mongos, run <pbm-agent mongos> for it")}
+	}
+
+	cfg, err := pbmClient.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	// the registration is accounted before the tokens are checked, so
+	// the limit holds off the agent which keeps trying the wrong token.
+	// The agent over the limit exits with the failure, so it is restarted
+	// by the supervisor and gets in later.
+	err = pbmClient.CheckRegistrationRate(cfg.RateLimit.Registrations, im.SetName+"/"+im.Me)
+	if err != nil {
+		return errors.Wrapf(err, "register the agent of %s/%s", im.SetName, im.Me)
+	}
+	reg, err := pbmClient.GetRegistration()
+	if err != nil {
+		return errors.Wrap(err, "get registration tokens")
+	}
+	err = checkTokens(reg, o.tokens, im.SetName)
+	if err != nil {
+		return setupError{errors.Wrapf(err, "register the agent of %s/%s", im.SetName, im.Me)}
+	}
+
+	serveAPI(pbmClient, o.jobsAPI)
+
 	agnt := agent.New(pbmClient)
 	// TODO: pass only options and connect while createing a node?
 	agnt.AddNode(ctx, node, mongoURI)
+	if o.tagLogs {
+		agnt.SetLogPrefix(fmt.Sprintf("[%s/%s] ", im.SetName, im.Me))
+	}
+	agnt.SetLabels(o.labels)
+	agnt.SetPMMService(instanceValue(o.pmmService))
+	agnt.SetPostRestoreHooks(o.postRestore, o.hookTimeout)
+	agnt.SetWorkers(o.workers)
+	agnt.SetApproval(o.approval)
+	// the agent still works without the persistent identity,
+	// it just can't recognize its previous run
+	err = agnt.LoadID(o.idFile)
+	if err != nil {
+		log.Println("[WARNING] agent identity:", err)
+	}
+
+	health.connected(im.SetName+"/"+im.Me, pbmClient, node, agnt.LastHeartbeat)
 
 	fmt.Println("pbm agent is listening for the commands")
-	return errors.Wrap(agnt.Start(), "listen the commands stream")
+	errc := make(chan error, 1)
+	go func() { errc <- agnt.Start() }()
+	sv.notify(stateReady, fmt.Sprintf("listening for the commands on %s/%s", im.SetName, im.Me))
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "listen the commands stream")
+	case s := <-sv.stopc():
+		log.Printf("got %s, stopping: no new commands are taken, waiting up to %v for the running ones", s, stopTimeout)
+	}
+
+	sv.notify(stateStopping, "waiting for the running operations to finish")
+	agnt.Stop()
+	select {
+	case err := <-errc:
+		if err != nil {
+			log.Println("[ERROR] listen the commands stream:", err)
+		}
+	case <-time.After(stopTimeout):
+		log.Println("[WARNING] the running operations aren't finished in time, handing them off")
+		handOff(agnt)
+	case s := <-sv.stopc():
+		log.Printf("got %s again, handing the running operations off", s)
+		handOff(agnt)
+	}
+
+	dctx, dcancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer dcancel()
+	if err := pbmClient.Conn.Disconnect(dctx); err != nil {
+		log.Println("[ERROR] disconnect pbm client:", err)
+	}
+	if err := node.Disconnect(dctx); err != nil {
+		log.Println("[ERROR] disconnect node client:", err)
+	}
+	return nil
+}
+
+// checkTokens returns an error unless any of the tokens lets
+// the agent of the replset in
+func checkTokens(c pbm.RegistrationConf, tokens []string, rs string) error {
+	if len(tokens) == 0 {
+		return c.Check("", rs)
+	}
+	var err error
+	for _, t := range tokens {
+		err = c.Check(t, rs)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func handOff(agnt *agent.Agent) {
+	err := agnt.HandOff()
+	if err != nil {
+		log.Println("[ERROR] hand off the running operations:", err)
+	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+)
+
+// metricsTTL is how long the collected catalog state is served from the
+// cache. The chain check reads the storage, so it isn't done on every scrape.
+const metricsTTL = time.Minute
+
+// metricsHandler serves the state of the backups catalog
+// in the Prometheus text exposition format
+type metricsHandler struct {
+	cn *pbm.PBM
+
+	mu     sync.Mutex
+	health *backup.CatalogHealth
+	at     time.Time
+}
+
+func (m *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, err := m.get()
+	if err != nil {
+		log.Println("[ERROR] metrics:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, h, time.Now())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println("[ERROR] metrics: write response:", err)
+	}
+}
+
+func (m *metricsHandler) get() (*backup.CatalogHealth, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.health != nil && time.Since(m.at) < metricsTTL {
+		return m.health, nil
+	}
+	h, err := backup.GetCatalogHealth(m.cn)
+	if err != nil {
+		return nil, err
+	}
+	m.health, m.at = h, time.Now()
+	return h, nil
+}
+
+// writeMetrics writes the catalog state as the gauges labeled with the cluster
+func writeMetrics(w io.Writer, h *backup.CatalogHealth, now time.Time) {
+	cl := label{"cluster", h.Cluster}
+
+	gauge(w, "pbm_backups", "Number of the backups in the catalog by the status.")
+	statuses := make([]string, 0, len(h.Backups))
+	for s := range h.Backups {
+		statuses = append(statuses, string(s))
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		sample(w, "pbm_backups", float64(h.Backups[pbm.Status(s)]), cl, label{"status", s})
+	}
+
+	types := make([]string, 0, len(h.Newest))
+	for t := range h.Newest {
+		types = append(types, string(t))
+	}
+	sort.Strings(types)
+	newest := func(name, help string, v func(backup.NewestBackup) float64) {
+		gauge(w, name, help)
+		for _, t := range types {
+			sample(w, name, v(h.Newest[pbm.BackupType(t)]), cl, label{"type", t})
+		}
+	}
+	newest("pbm_backup_last_success_timestamp_seconds", "Unix time the newest successful backup of the type has finished.",
+		func(b backup.NewestBackup) float64 { return float64(b.Finished) })
+	newest("pbm_backup_last_success_age_seconds", "Seconds since the newest successful backup of the type has finished.",
+		func(b backup.NewestBackup) float64 { return now.Sub(time.Unix(b.Finished, 0)).Seconds() })
+	newest("pbm_backup_last_size_bytes", "Size of the files of the newest successful backup of the type in the storage (0 for the dedup layout).",
+		func(b backup.NewestBackup) float64 { return float64(b.Size) })
+	newest("pbm_backup_last_data_bytes", "Size of the collections captured by the newest successful backup of the type.",
+		func(b backup.NewestBackup) float64 { return float64(b.Data) })
+	newest("pbm_backup_avg_size_bytes", "Average size of the files of the latest successful backups of the type in the storage.",
+		func(b backup.NewestBackup) float64 { return float64(b.AvgSize) })
+	newest("pbm_backup_last_success_verified", "1 if the newest successful backup of the type has passed the verification.",
+		func(b backup.NewestBackup) float64 { return boolValue(b.Verified) })
+
+	if h.Verify != nil {
+		gauge(w, "pbm_verify_last_timestamp_seconds", "Unix time the newest verification has finished.")
+		sample(w, "pbm_verify_last_timestamp_seconds", float64(h.Verify.FinishTS), cl)
+		gauge(w, "pbm_verify_last_success", "1 if the newest verification has succeeded.")
+		sample(w, "pbm_verify_last_success", boolValue(h.Verify.Status == pbm.StatusDone), cl, label{"backup", h.Verify.Backup})
+	}
+
+	if h.Point != nil {
+		gauge(w, "pbm_restorable_point_timestamp_seconds", "Unix time of the latest point the cluster can be restored to.")
+		sample(w, "pbm_restorable_point_timestamp_seconds", float64(h.Point.TS.T), cl, label{"backup", h.Point.Backup})
+	}
+
+	gauge(w, "pbm_backup_chain_broken", "Number of the replsets' backups which can't be restored.")
+	sample(w, "pbm_backup_chain_broken", float64(h.Broken), cl)
+}
+
+type label struct {
+	name, value string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func gauge(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+func sample(w io.Writer, name string, v float64, labels ...label) {
+	ls := make([]string, 0, len(labels))
+	for _, l := range labels {
+		ls = append(ls, fmt.Sprintf(`%s="%s"`, l.name, labelEscaper.Replace(l.value)))
+	}
+	fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(ls, ","), v)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/agent"
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// runMongos runs the agent connected to mongos which serves
+// the cluster-level operations until the supervisor stops it
+func runMongos(mongoURI, name string, sv supervisor) error {
+	// any of the mongoses of the SRV record will do,
+	// the agent doesn't have to run along with it
+	mongoURI = pbm.NormalizeURI(mongoURI)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cn, err := mongo.NewClient(options.Client().ApplyURI(mongoURI).SetAppName("pbm-agent-mongos"))
+	if err != nil {
+		return setupError{errors.Wrap(err, "create mongos client")}
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		return errors.Wrap(err, "mongos connect")
+	}
+	err = cn.Ping(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "mongos ping")
+	}
+
+	if name == "" {
+		name, err = os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "get hostname")
+		}
+	}
+
+	pbmClient, err := pbm.New(ctx, mongoURI, "pbm-agent")
+	if err != nil {
+		return errors.Wrap(err, "connect to mongodb")
+	}
+
+	serveAPI(pbmClient, false)
+	health.connected(name, pbmClient, cn, nil)
+
+	fmt.Println("pbm mongos agent is listening for the commands")
+	errc := make(chan error, 1)
+	go func() { errc <- agent.NewMongos(pbmClient, pbm.NewMongos(ctx, cn), name).Start() }()
+	sv.notify(stateReady, "listening for the commands on mongos "+name)
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "listen the commands stream")
+	case s := <-sv.stopc():
+		log.Printf("got %s, stopping", s)
+		sv.notify(stateStopping, "stopping")
+		return nil
+	}
+}
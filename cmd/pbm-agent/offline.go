@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v2"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+type offlineOpts struct {
+	pbmConfig string
+	backup    string
+	meta      string
+	replset   string
+	until     string
+}
+
+// runOffline restores the backup into the node with no cluster and no
+// agents around: the storage is taken from the config file and the
+// backup's metadata from the storage or the given file
+func runOffline(mongoURI string, o offlineOpts) error {
+	mongoURI, err := pbm.NodeURI(mongoURI)
+	if err != nil {
+		return errors.Wrap(err, "node connection string")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfgbuf, err := ioutil.ReadFile(o.pbmConfig)
+	if err != nil {
+		return errors.Wrap(err, "read pbm config file")
+	}
+	var cfg pbm.Config
+	err = yaml.UnmarshalStrict(cfgbuf, &cfg)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal pbm config")
+	}
+	err = cfg.Storage.Cast()
+	if err != nil {
+		return errors.Wrap(err, "cast storage")
+	}
+
+	var until primitive.Timestamp
+	if o.until != "" {
+		until, err = pbm.ParseTimestamp(o.until)
+		if err != nil {
+			return err
+		}
+	}
+
+	var bcp *pbm.BackupMeta
+	if o.meta != "" {
+		buf, err := ioutil.ReadFile(o.meta)
+		if err != nil {
+			return errors.Wrap(err, "read backup metadata file")
+		}
+		bcp = &pbm.BackupMeta{}
+		err = json.Unmarshal(buf, bcp)
+		if err != nil {
+			return errors.Wrap(err, "decode backup metadata")
+		}
+		if o.backup != "" && bcp.Name != o.backup {
+			return errors.Errorf("metadata file is of the backup '%s', not '%s'", bcp.Name, o.backup)
+		}
+	} else {
+		if o.backup == "" {
+			return errors.New("either the backup name or the metadata file has to be given")
+		}
+		bcp, err = restore.MetaFromStore(cfg.Storage, o.backup)
+		if err != nil {
+			return errors.Wrap(err, "get backup metadata from the storage")
+		}
+	}
+
+	cn, err := connectNode(ctx, mongoURI, "pbm-agent-restore")
+	if err != nil {
+		return err
+	}
+	defer cn.Disconnect(ctx)
+
+	// no PBM collections are set up on the node, nothing is written
+	// but the restored data
+	pbmClient, err := pbm.NewDirect(ctx, mongoURI, "pbm-agent")
+	if err != nil {
+		return errors.Wrap(err, "connect to mongodb")
+	}
+	node := pbm.NewNode(ctx, "node0", cn, mongoURI)
+
+	rsName := o.replset
+	if rsName == "" {
+		im, err := node.GetIsMaster()
+		if err != nil {
+			return errors.Wrap(err, "get isMaster data")
+		}
+		rsName = im.SetName
+		// the standalone node takes the only replset of the backup
+		if rsName == "" && len(bcp.Replsets) == 1 {
+			rsName = bcp.Replsets[0].Name
+		}
+		if rsName == "" {
+			return errors.New("backup has several replsets, define the one to restore with --replset")
+		}
+	}
+
+	log.Printf("restoring replset %s from backup '%s'", rsName, bcp.Name)
+	if until.T > 0 {
+		log.Printf("oplog is replayed up to %d,%d", until.T, until.I)
+	}
+	rst := restore.New(pbmClient, node)
+	rst.SetSigning(cfg.Signing)
+	err = rst.Offline(cfg.Storage, bcp, rsName, until)
+	if err != nil {
+		return errors.Wrap(err, "restore")
+	}
+
+	fmt.Printf("backup '%s' is restored\n", bcp.Name)
+	return nil
+}
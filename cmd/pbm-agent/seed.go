@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+type seedOpts struct {
+	sourceURI   string
+	backup      string
+	replset     string
+	oplogSizeMB int
+}
+
+// runSeed turns an empty standalone node into a would-be secondary of
+// the replset by restoring the backup instead of doing an initial sync
+func runSeed(mongoURI string, o seedOpts) error {
+	mongoURI, err := pbm.NodeURI(mongoURI)
+	if err != nil {
+		return errors.Wrap(err, "node connection string")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cn, err := connectNode(ctx, mongoURI, "pbm-agent-seed")
+	if err != nil {
+		return err
+	}
+	defer cn.Disconnect(ctx)
+
+	// backups metadata and the storage config are taken from the replset
+	// being extended, the new node itself has no PBM data yet
+	pbmClient, err := pbm.New(ctx, o.sourceURI, "pbm-agent")
+	if err != nil {
+		return errors.Wrap(err, "connect to the source cluster")
+	}
+
+	rsName := o.replset
+	if rsName == "" {
+		im, err := pbmClient.GetIsMaster()
+		if err != nil {
+			return errors.Wrap(err, "get source isMaster data")
+		}
+		rsName = im.SetName
+	}
+
+	node := pbm.NewNode(ctx, "node0", cn, mongoURI)
+	log.Printf("seeding node as a member of %s from backup '%s'", rsName, o.backup)
+	err = restore.New(pbmClient, node).Seed(o.backup, rsName, o.oplogSizeMB)
+	if err != nil {
+		return errors.Wrap(err, "seed")
+	}
+
+	fmt.Printf("node is seeded. Restart it with `--replSet %s` and add to the replset with rs.add() on the primary\n", rsName)
+	return nil
+}
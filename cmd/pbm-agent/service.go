@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// The exit codes of the agent. The supervisor (systemd, the Windows service
+// manager) restarts the agent on the failure but shouldn't restart it when
+// it's misconfigured, see RestartPreventExitStatus in pbm-agent.service.
+const (
+	exitOK = 0
+	// exitFailure is the failure the restart may help with (e.g. the
+	// connection to mongod lost)
+	exitFailure = 1
+	// exitSetup is the failure due to the agent's setup (e.g. the wrong
+	// connection string or the node type), the restart won't help
+	exitSetup = 2
+)
+
+// setupError is the failure due to the agent's setup
+type setupError struct {
+	error
+}
+
+func exitCode(err error) int {
+	switch errors.Cause(err).(type) {
+	case nil:
+		return exitOK
+	case setupError:
+		return exitSetup
+	default:
+		return exitFailure
+	}
+}
+
+type agentState int
+
+const (
+	stateReady agentState = iota
+	stateStopping
+)
+
+// supervisor is the service manager the agent runs under: it's told
+// about the agent's state and asks the agent to stop
+type supervisor interface {
+	notify(s agentState, status string)
+	// stopc receives the reasons to stop the agent
+	stopc() <-chan string
+}
+
+// sysSupervisor is the supervisor of the agent run as a plain process or
+// as the systemd service. The agent is stopped by SIGTERM or SIGINT. The
+// state is reported to systemd via sd_notify if it's started with
+// Type=notify.
+type sysSupervisor struct {
+	sig  chan os.Signal
+	stop chan string
+}
+
+func newSysSupervisor() *sysSupervisor {
+	s := &sysSupervisor{
+		sig:  make(chan os.Signal, 1),
+		stop: make(chan string),
+	}
+	signal.Notify(s.sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range s.sig {
+			s.stop <- sig.String()
+		}
+	}()
+	return s
+}
+
+func (s *sysSupervisor) stopc() <-chan string { return s.stop }
+
+func (s *sysSupervisor) notify(st agentState, status string) {
+	state := "READY=1"
+	if st == stateStopping {
+		state = "STOPPING=1"
+	}
+	err := sdNotify(state + "\nSTATUS=" + status)
+	if err != nil {
+		log.Println("[WARNING] notify systemd:", err)
+	}
+}
+
+// sdNotify sends the state to systemd. It does nothing if the agent
+// isn't started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// abstract namespace socket
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "dial notify socket")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return errors.Wrap(err, "write notify socket")
+}
+
+// sdWatchdog returns the interval systemd expects the watchdog pings
+// within or 0 if the watchdog is off (no WatchdogSec in the unit)
+func sdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings the systemd watchdog while the agent reports its status
+// (i.e. its connection to the cluster works), so systemd restarts the hung
+// agent. The status is considered lost after pbm.StaleFrameSec, the same
+// as the other agents do.
+func watchdog(lastHb func() time.Time) {
+	interval := sdWatchdog()
+	if interval == 0 {
+		return
+	}
+
+	start := time.Now()
+	tk := time.NewTicker(interval / 2)
+	defer tk.Stop()
+	for range tk.C {
+		hb := lastHb()
+		if hb.IsZero() {
+			hb = start
+		}
+		if time.Since(hb) > time.Duration(pbm.StaleFrameSec)*time.Second {
+			log.Printf("[WARNING] no status reported since %s, skipping the watchdog ping", hb.Format(time.RFC3339))
+			continue
+		}
+		err := sdNotify("WATCHDOG=1")
+		if err != nil {
+			log.Println("[WARNING] watchdog ping:", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+var errNoWinService = errors.New("the Windows service is supported on Windows only, use the systemd unit (pbm-agent.service) instead")
+
+func installService(name, user, password string, args []string) error {
+	return errNoWinService
+}
+
+func uninstallService(name string) error {
+	return errNoWinService
+}
+
+func runService(name string, run func(supervisor) error) error {
+	return setupError{errNoWinService}
+}
@@ -0,0 +1,288 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+var procRegisterServiceCtrlHandlerEx = windows.NewLazySystemDLL("advapi32.dll").NewProc("RegisterServiceCtrlHandlerExW")
+
+// serviceConfigFailureActionsFlag is SERVICE_CONFIG_FAILURE_ACTIONS_FLAG,
+// it isn't in x/sys/windows yet
+const serviceConfigFailureActionsFlag = 4
+
+// serviceFailureActionsFlag is SERVICE_FAILURE_ACTIONS_FLAG
+type serviceFailureActionsFlag struct {
+	FailureActionsOnNonCrashFailures int32
+}
+
+// the service callbacks have no context, so there is the only service
+// the process runs
+var winsvc *scmSupervisor
+
+// scmSupervisor is the supervisor of the agent run as the Windows service.
+// The agent is stopped by the service manager's stop or shutdown control.
+type scmSupervisor struct {
+	name string
+	run  func(supervisor) error
+	err  error
+
+	mu     sync.Mutex
+	h      windows.Handle
+	status windows.SERVICE_STATUS
+	stop   chan string
+}
+
+// runService runs the agent under the Windows service manager. It returns
+// once the service is stopped.
+func runService(name string, run func(supervisor) error) error {
+	winsvc = &scmSupervisor{
+		name: name,
+		run:  run,
+		stop: make(chan string, 1),
+		status: windows.SERVICE_STATUS{
+			ServiceType:  windows.SERVICE_WIN32_OWN_PROCESS,
+			CurrentState: windows.SERVICE_START_PENDING,
+			// the connection to mongo may take a while
+			WaitHint: uint32(time.Minute / time.Millisecond),
+		},
+	}
+
+	sname, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return setupError{errors.Wrap(err, "service name")}
+	}
+	t := []windows.SERVICE_TABLE_ENTRY{
+		{ServiceName: sname, ServiceProc: windows.NewCallback(serviceMain)},
+		{},
+	}
+	err = windows.StartServiceCtrlDispatcher(&t[0])
+	if err != nil {
+		return setupError{errors.Wrap(err, "connect to the service manager, <pbm-agent run --service-name> is meant to be started by it")}
+	}
+	return winsvc.err
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	s := winsvc
+	sname, _ := windows.UTF16PtrFromString(s.name)
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(
+		uintptr(unsafe.Pointer(sname)),
+		windows.NewCallback(serviceCtrlHandler),
+		0,
+	)
+	if h == 0 {
+		s.err = errors.Wrap(err, "register service control handler")
+		return 0
+	}
+	s.h = windows.Handle(h)
+	s.setState(windows.SERVICE_START_PENDING, 0)
+
+	s.err = s.run(s)
+
+	code := exitCode(s.err)
+	s.mu.Lock()
+	// the setup failures aren't reported as such, so the service
+	// manager doesn't restart the agent in vain
+	if code == exitFailure {
+		s.status.Win32ExitCode = uint32(windows.ERROR_SERVICE_SPECIFIC_ERROR)
+		s.status.ServiceSpecificExitCode = uint32(code)
+	}
+	s.mu.Unlock()
+	s.setState(windows.SERVICE_STOPPED, 0)
+	return 0
+}
+
+func serviceCtrlHandler(ctrl, evtype uint32, evdata, context uintptr) uintptr {
+	s := winsvc
+	switch ctrl {
+	case windows.SERVICE_CONTROL_STOP, windows.SERVICE_CONTROL_SHUTDOWN:
+		reason := "service stop"
+		if ctrl == windows.SERVICE_CONTROL_SHUTDOWN {
+			reason = "system shutdown"
+		}
+		select {
+		case s.stop <- reason:
+		default:
+		}
+		return 0
+	case windows.SERVICE_CONTROL_INTERROGATE:
+		s.setState(s.state(), 0)
+		return 0
+	}
+	return uintptr(windows.ERROR_CALL_NOT_IMPLEMENTED)
+}
+
+func (s *scmSupervisor) stopc() <-chan string { return s.stop }
+
+func (s *scmSupervisor) notify(st agentState, status string) {
+	switch st {
+	case stateReady:
+		s.setState(windows.SERVICE_RUNNING, windows.SERVICE_ACCEPT_STOP|windows.SERVICE_ACCEPT_SHUTDOWN)
+	case stateStopping:
+		s.setState(windows.SERVICE_STOP_PENDING, 0)
+	}
+}
+
+func (s *scmSupervisor) state() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.CurrentState
+}
+
+func (s *scmSupervisor) setState(state, accepts uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != s.status.CurrentState {
+		s.status.CheckPoint = 0
+		if state == windows.SERVICE_STOP_PENDING {
+			go s.pendingStop()
+		}
+	}
+	s.status.CurrentState = state
+	s.status.ControlsAccepted = accepts
+	// the pending states have to report the progress
+	// or the service manager considers the service hung
+	if state == windows.SERVICE_START_PENDING || state == windows.SERVICE_STOP_PENDING {
+		s.status.CheckPoint++
+	}
+	err := windows.SetServiceStatus(s.h, &s.status)
+	if err != nil {
+		log.Println("[WARNING] set service status:", err)
+	}
+}
+
+// pendingStop reports the stop progress while the agent waits for the
+// running operations to finish
+func (s *scmSupervisor) pendingStop() {
+	tk := time.NewTicker(time.Second * 10)
+	defer tk.Stop()
+	for range tk.C {
+		s.mu.Lock()
+		if s.status.CurrentState != windows.SERVICE_STOP_PENDING {
+			s.mu.Unlock()
+			return
+		}
+		s.status.CheckPoint++
+		s.status.WaitHint = uint32(time.Second * 20 / time.Millisecond)
+		windows.SetServiceStatus(s.h, &s.status)
+		s.mu.Unlock()
+	}
+}
+
+// installService registers the agent as the auto-started Windows service
+// run with the given flags, restarted by the service manager on the failure
+func installService(name, user, password string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "define executable path")
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return errors.Wrap(err, "define executable path")
+	}
+
+	cmdline := []string{windows.EscapeArg(exe), "run", windows.EscapeArg("--service-name=" + name)}
+	for _, a := range args {
+		cmdline = append(cmdline, windows.EscapeArg(a))
+	}
+
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return errors.Wrap(err, "connect to the service manager")
+	}
+	defer windows.CloseServiceHandle(m)
+
+	var startName, pass *uint16
+	if user != "" {
+		startName = utf16(user)
+		pass = utf16(password)
+	}
+	h, err := windows.CreateService(m, utf16(name), utf16(fmt.Sprintf("Percona Backup for MongoDB agent (%s)", name)),
+		windows.SERVICE_ALL_ACCESS, windows.SERVICE_WIN32_OWN_PROCESS,
+		windows.SERVICE_AUTO_START, windows.SERVICE_ERROR_NORMAL,
+		utf16(strings.Join(cmdline, " ")), nil, nil, nil, startName, pass)
+	if err != nil {
+		if err == windows.ERROR_SERVICE_EXISTS {
+			return errors.Errorf("service %s already exists", name)
+		}
+		return errors.Wrap(err, "create service")
+	}
+	defer windows.CloseServiceHandle(h)
+
+	// restart the failed agent after 5s, 30s and then each minute,
+	// the failures count is reset after a day
+	actions := []windows.SC_ACTION{
+		{Type: windows.SC_ACTION_RESTART, Delay: 5000},
+		{Type: windows.SC_ACTION_RESTART, Delay: 30000},
+		{Type: windows.SC_ACTION_RESTART, Delay: 60000},
+	}
+	fa := windows.SERVICE_FAILURE_ACTIONS{
+		ResetPeriod:  uint32(24 * time.Hour / time.Second),
+		ActionsCount: uint32(len(actions)),
+		Actions:      &actions[0],
+	}
+	err = windows.ChangeServiceConfig2(h, windows.SERVICE_CONFIG_FAILURE_ACTIONS, (*byte)(unsafe.Pointer(&fa)))
+	if err != nil {
+		log.Println("[WARNING] set service failure actions:", err)
+	}
+	// the agent reports the failure with the exit code rather than crashes
+	ff := serviceFailureActionsFlag{FailureActionsOnNonCrashFailures: 1}
+	err = windows.ChangeServiceConfig2(h, serviceConfigFailureActionsFlag, (*byte)(unsafe.Pointer(&ff)))
+	if err != nil {
+		log.Println("[WARNING] set service failure actions flag:", err)
+	}
+
+	return nil
+}
+
+// uninstallService stops the agent's Windows service and removes it
+func uninstallService(name string) error {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return errors.Wrap(err, "connect to the service manager")
+	}
+	defer windows.CloseServiceHandle(m)
+
+	h, err := windows.OpenService(m, utf16(name), windows.SERVICE_ALL_ACCESS)
+	if err != nil {
+		if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+			return errors.Errorf("service %s doesn't exist", name)
+		}
+		return errors.Wrap(err, "open service")
+	}
+	defer windows.CloseServiceHandle(h)
+
+	var st windows.SERVICE_STATUS
+	err = windows.QueryServiceStatus(h, &st)
+	if err != nil {
+		return errors.Wrap(err, "query service status")
+	}
+	if st.CurrentState != windows.SERVICE_STOPPED {
+		// the service is removed once it's stopped, so it's only asked to
+		// stop here: it may take a while for the agent to finish the backup
+		err = windows.ControlService(h, windows.SERVICE_CONTROL_STOP, &st)
+		if err != nil {
+			log.Println("[WARNING] stop service:", err)
+		}
+	}
+
+	return errors.Wrap(windows.DeleteService(h), "delete service")
+}
+
+func utf16(s string) *uint16 {
+	p, _ := windows.UTF16PtrFromString(s)
+	return p
+}
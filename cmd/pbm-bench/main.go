@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/bench"
+	"github.com/percona/percona-backup-mongodb/version"
+)
+
+func main() {
+	var (
+		benchCmd = kingpin.New("pbm-bench", "Percona Backup for MongoDB restore throughput benchmarks")
+		mURI     = benchCmd.Flag("mongodb-uri", "MongoDB connection string of the target node (a standalone or a primary)").Envar("PBM_MONGODB_URI").Required().String()
+		dbName   = benchCmd.Flag("db", "Database to generate the data in. It's dropped before and after each run").Default(bench.DefaultDB).String()
+		docSize  = benchCmd.Flag("doc-size", "Size of the documents payload in bytes").Default("1024").Int()
+		runs     = benchCmd.Flag("runs", "Number of runs, the best one is reported").Default("1").Int()
+		minOps   = benchCmd.Flag("min-ops", "Fail if the throughput is below the given ops/sec").Float64()
+
+		oplogCmd = benchCmd.Command("oplog", "Measure the oplog apply throughput")
+		oplogOps = oplogCmd.Flag("ops", "Number of the oplog entries").Default("100000").Int()
+
+		insertCmd  = benchCmd.Command("insert", "Measure the restore insert throughput")
+		insertDocs = insertCmd.Flag("docs", "Number of the documents").Default("100000").Int()
+
+		versionCmd = benchCmd.Command("version", "PBM version info")
+	)
+
+	cmd, err := benchCmd.DefaultEnvars().Parse(os.Args[1:])
+	if err != nil && cmd != versionCmd.FullCommand() {
+		log.Println("Error: Parse command line parameters:", err)
+		return
+	}
+
+	if cmd == versionCmd.FullCommand() {
+		fmt.Println(version.DefaultInfo.All(""))
+		return
+	}
+
+	ctx := context.Background()
+	cn, err := mongo.NewClient(options.Client().ApplyURI(*mURI).SetAppName("pbm-bench").SetDirect(true))
+	if err != nil {
+		log.Fatalln("Error: create node client:", err)
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		log.Fatalln("Error: node connect:", err)
+	}
+	defer cn.Disconnect(ctx)
+	node := pbm.NewNode(ctx, "node0", cn, *mURI)
+
+	var run func() (bench.Result, error)
+	switch cmd {
+	case oplogCmd.FullCommand():
+		run = func() (bench.Result, error) {
+			return bench.OplogApply(node, bench.Opts{DB: *dbName, Ops: *oplogOps, DocSize: *docSize})
+		}
+	case insertCmd.FullCommand():
+		run = func() (bench.Result, error) {
+			return bench.RestoreInsert(ctx, node, bench.Opts{DB: *dbName, Ops: *insertDocs, DocSize: *docSize})
+		}
+	}
+
+	best, err := runBest(run, *runs)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	if *runs > 1 {
+		fmt.Println("Best", best)
+	}
+
+	if *minOps > 0 && best.OpsPerSec() < *minOps {
+		log.Fatalf("Error: %s throughput %.0f ops/sec is below %.0f ops/sec", best.Name, best.OpsPerSec(), *minOps)
+	}
+}
+
+// runBest runs the benchmark `n` times and returns the fastest run
+func runBest(run func() (bench.Result, error), n int) (bench.Result, error) {
+	var best bench.Result
+	for i := 0; i < n; i++ {
+		r, err := run()
+		if err != nil {
+			return best, errors.Wrapf(err, "run %d", i+1)
+		}
+		fmt.Println(r)
+		if i == 0 || r.Took < best.Took {
+			best = r
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func printAgents(cn *pbm.PBM, f pbm.AgentFilter, lost bool, pg pbm.Page) {
+	ts, err := cn.ClusterTime()
+	if err != nil {
+		log.Fatalln("Error: read cluster time:", err)
+	}
+	if lost {
+		f.Lost = &lost
+		f.Now = ts
+	}
+
+	stats, total, err := cn.AgentsStatusPage(f, pg)
+	if err != nil {
+		log.Fatalln("Error: get agents status:", err)
+	}
+
+	fmt.Println("Agents:")
+	for _, s := range stats {
+		state := s.StateStr
+		if s.IsStale(ts) {
+			state = "LOST"
+		}
+		if s.Maintenance {
+			state += ", MAINTENANCE"
+			if s.Busy {
+				state += " (draining)"
+			}
+		}
+		fmt.Printf("  %s/%s\t[%s] lag: %ds, disk free: %dMB, load: %.2f/%d CPUs, mem available: %dMB/%dMB\n",
+			s.RS, s.Node, state, s.ReplicationLag, s.DiskFree>>20,
+			s.Host.LoadAvg, s.Host.CPUs, s.Host.MemAvailable>>20, s.Host.MemTotal>>20)
+		if len(s.Labels) > 0 {
+			fmt.Printf("    labels: %s\n", pbm.LabelsString(s.Labels))
+		}
+		for _, t := range s.Tasks {
+			fmt.Printf("    running: %s %s (since %s)\n", t.Cmd, t.Name, time.Unix(t.StartTS, 0).UTC().Format(time.RFC3339))
+		}
+		if s.Err != "" {
+			fmt.Printf("    errors: %s\n", s.Err)
+		}
+	}
+	if shown := pg.Skip + int64(len(stats)); shown < total {
+		fmt.Printf("  ... %d more, use --skip %d to see the next ones\n", total-shown, shown)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// applyJob submits the backup or restore job of the spec file ("-" for
+// stdin). The job name is the key: the job which already exists (incl. the
+// queued backup and the restore waiting for the approval) isn't submitted
+// again, so the same spec can be applied any number of times.
+func applyJob(cn *pbm.PBM, file string) error {
+	var buf []byte
+	var err error
+	if file == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return errors.Wrap(err, "read job spec")
+	}
+	j, err := pbm.ParseJobSpec(buf)
+	if err != nil {
+		return errors.Wrap(err, "parse job spec")
+	}
+
+	ref := fmt.Sprintf("%s/%s", j.Kind, j.Metadata.Name)
+	state, err := cn.JobState(j)
+	if err != nil {
+		return err
+	}
+	if state != "" {
+		fmt.Printf("%s unchanged (%s)\n", ref, state)
+		return nil
+	}
+
+	switch j.Kind {
+	case pbm.JobKindBackup:
+		bcp, err := j.BackupCmd(time.Now())
+		if err != nil {
+			return err
+		}
+		_, qpos, err := backup(cn, &bcp, "", false, j.Backup.Queue)
+		if err != nil {
+			return err
+		}
+		if qpos > 0 {
+			fmt.Printf("%s queued at position %d\n", ref, qpos)
+			return nil
+		}
+	case pbm.JobKindRestore:
+		rcmd, err := j.RestoreCmd()
+		if err != nil {
+			return err
+		}
+		approval, qpos, err := startRestore(cn, rcmd, "", j.Restore.Queue)
+		if err != nil {
+			return err
+		}
+		if approval != "" {
+			fmt.Printf("%s waits for the approval %s\n", ref, approval)
+			return nil
+		}
+		if qpos > 0 {
+			fmt.Printf("%s queued at position %d\n", ref, qpos)
+			return nil
+		}
+	}
+	fmt.Printf("%s created\n", ref)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// dispatch sends the command to the agents or, if the command needs the
+// approval, stores it as the approval request. It returns the ID of
+// the request in the latter case.
+func dispatch(cn *pbm.PBM, cmd pbm.Cmd) (string, error) {
+	required, err := approvalRequired(cn, cmd.Cmd)
+	if err != nil {
+		return "", err
+	}
+	if !required {
+		return "", errors.Wrap(cn.SendCmd(cmd), "send command")
+	}
+
+	a, err := cn.RequestApproval(cmd)
+	if err != nil {
+		return "", errors.Wrap(err, "request approval")
+	}
+	return a.ID, nil
+}
+
+// approvalRequired returns true if the command needs the approval
+func approvalRequired(cn *pbm.PBM, cmd pbm.Command) (bool, error) {
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return false, errors.Wrap(err, "get config")
+	}
+	return cfg.Approval.Required(cmd), nil
+}
+
+func printPending(id string) {
+	fmt.Printf("The request %s is waiting for the approval by another user: pbm approval approve %s\n", id, id)
+}
+
+// decideApproval approves or rejects the request. The approved
+// command is sent to the agents right away, after the safety backup
+// if the restore asks for it. The approval is signed with the private
+// key from the keyFile if it's given.
+func decideApproval(cn *pbm.PBM, id string, approve bool, comment, keyFile string, compression pbm.CompressionType) error {
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	key, err := pbm.SigningConf{PrivateKeyFile: keyFile}.SignKey()
+	if err != nil {
+		return errors.Wrap(err, "approvers' key")
+	}
+
+	a, err := cn.DecideApproval(id, approve, comment, cfg.Approval.Expire(), key)
+	if err != nil {
+		return err
+	}
+	if !approve {
+		fmt.Printf("The %s of '%s' requested by %s is rejected\n", a.Cmd.Cmd, a.Target(), a.RequestedBy)
+		return nil
+	}
+
+	cmd := a.Cmd
+	cmd.Restore.Approval = a.ID
+	cmd.Delete.Approval = a.ID
+	if cmd.Cmd == pbm.CmdRestore && cmd.Restore.Safety {
+		cmd.Restore.SafetyBackup, err = safetyBackup(cn, cmd.Restore.BackupName, compression)
+		if err != nil {
+			return errors.Wrap(err, "the restore is approved but not started: safety backup")
+		}
+	}
+	err = cn.SendCmd(cmd)
+	if err != nil {
+		return errors.Wrap(err, "send command")
+	}
+	fmt.Printf("The %s of '%s' requested by %s is approved and has started\n", a.Cmd.Cmd, a.Target(), a.RequestedBy)
+	return nil
+}
+
+func printApprovals(cn *pbm.PBM, size int64) {
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		log.Fatalln("Error: get config:", err)
+	}
+	as, err := cn.Approvals(size)
+	if err != nil {
+		log.Fatalln("Error: get approvals:", err)
+	}
+
+	fmt.Println("Approval requests:")
+	if len(as) == 0 {
+		fmt.Println("  <none>")
+		return
+	}
+	now := time.Now()
+	for _, a := range as {
+		status := string(a.Status)
+		if a.Expired(now, cfg.Approval.Expire()) {
+			status += ", expired"
+		}
+		fmt.Printf("  %s\t%s '%s'\t[%s] requested by %s at %s", a.ID, a.Cmd.Cmd, a.Target(), status,
+			a.RequestedBy, time.Unix(a.RequestedAt, 0).UTC().Format(time.RFC3339))
+		if a.DecidedBy != "" {
+			fmt.Printf(", %s by %s at %s", a.Status, a.DecidedBy, time.Unix(a.DecidedAt, 0).UTC().Format(time.RFC3339))
+		}
+		if a.Comment != "" {
+			fmt.Printf(": %s", a.Comment)
+		}
+		fmt.Println()
+	}
+}
@@ -4,14 +4,80 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func backup(cn *pbm.PBM, bcpName, compression string) (string, error) {
+// backupName returns the name of the new backup. The name given by the user
+// may be a template. If it's not given, the name is rendered from the config
+// template and made unique.
+func backupName(cn *pbm.PBM, name string) (string, error) {
+	if name != "" {
+		return cn.NewBackupName(name, time.Now(), false)
+	}
+
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return "", errors.Wrap(err, "get config")
+	}
+	return cn.NewBackupName(cfg.Backup.NameTemplate, time.Now(), true)
+}
+
+// backup sends the backup command. If there is another operation in
+// progress the backup is either rejected or, with `queue`, put into the
+// queue. In the latter case the returned position in the queue is > 0.
+// backup starts the backup. The backup replacing the existing one runs
+// under the staged name which it's given in `bcp`.
+func backup(cn *pbm.PBM, bcp *pbm.BackupCmd, idemKey string, allowOverwrite, queue bool) (store string, qpos int, err error) {
+	for k := range bcp.Tags {
+		if k == "" || strings.ContainsAny(k, ".$") {
+			return "", 0, errors.Errorf("invalid tag %q: the key can't be empty or contain '.' and '$'", k)
+		}
+	}
+
+	_, err = bcp.Profile.Settings()
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the backup name is the ID of the backup job, so it has to be unique
+	exists, err := cn.GetBackupMeta(bcp.Name)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "check backup name")
+	}
+	qpos, err = cn.QueuePosition(bcp.Name)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "check backup queue")
+	}
+	if qpos > 0 {
+		return "", 0, errors.Errorf("backup %s is already queued", bcp.Name)
+	}
+	if exists.Name != "" {
+		if !allowOverwrite {
+			return "", 0, errors.Errorf("backup %s already exists. Use --allow-overwrite to replace it", bcp.Name)
+		}
+		err = checkOverwrite(cn, exists)
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "overwrite backup %s", bcp.Name)
+		}
+		// the existing backup is kept until the new one is done
+		bcp.Replaces = bcp.Name
+		bcp.Name += overwriteSuffix
+		staged, err := cn.GetBackupMeta(bcp.Name)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "check backup name")
+		}
+		if staged.Name != "" {
+			return "", 0, errors.Errorf("backup %s of the previous overwrite exists, delete it first", bcp.Name)
+		}
+	}
+
 	locks, err := cn.GetLocks(&pbm.LockHeader{})
 	if err != nil {
 		log.Println("get locks", err)
@@ -19,43 +85,117 @@ func backup(cn *pbm.PBM, bcpName, compression string) (string, error) {
 
 	ts, err := cn.ClusterTime()
 	if err != nil {
-		return "", errors.Wrap(err, "read cluster time")
+		return "", 0, errors.Wrap(err, "read cluster time")
 	}
 
-	// Stop if there is some live operation.
+	// Stop if there is some live operation unless it's the backup of the disjoint replsets subset.
 	// But if there is some stale lock leave it for agents to deal with.
+	var busy error
+	lh := pbm.LockHeader{Type: pbm.CmdBackup, BackupName: bcp.Name, Subset: bcp.Replsets}
 	for _, l := range locks {
-		if l.Heartbeat.T+pbm.StaleFrameSec >= ts.T {
-			return "", errors.Errorf("another operation in progress, %s/%s", l.Type, l.BackupName)
+		if l.Heartbeat.T+pbm.StaleFrameSec >= ts.T && !lh.Compatible(l.LockHeader) {
+			busy = errors.Errorf("another operation in progress, %s/%s", l.Type, l.BackupName)
+			break
 		}
 	}
+	if busy != nil && !queue {
+		return "", 0, errors.Errorf("%v. Use --queue to start the backup once it's finished", busy)
+	}
+
+	maint, err := maintenanceReplsets(cn, *bcp, ts)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "check maintenance")
+	}
+	if len(maint) > 0 {
+		return "", 0, errors.Errorf("all nodes of the replsets %s are in maintenance, see <pbm maintenance list>", strings.Join(maint, ", "))
+	}
 
 	stg, err := cn.GetStorage()
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return "", errors.New("no store set. Set remote store with <pbm store set>")
+			return "", 0, errors.New("no store set. Set remote store with <pbm store set>")
 		}
-		return "", errors.Wrap(err, "get remote-store")
+		return "", 0, errors.Wrap(err, "get remote-store")
 	}
 
-	err = cn.SendCmd(pbm.Cmd{
-		Cmd: pbm.CmdBackup,
-		Backup: pbm.BackupCmd{
-			Name:        bcpName,
-			Compression: pbm.CompressionType(compression),
-		},
-	})
+	if bcp.Type == pbm.BackupTypeDifferential {
+		base, err := cn.GetBackupMeta(bcp.Base)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "get base backup metadata")
+		}
+		switch {
+		case base.Name == "":
+			return "", 0, errors.Errorf("base backup %s not found", bcp.Base)
+		case base.Status != pbm.StatusDone:
+			return "", 0, errors.Errorf("base backup %s isn't finished successfully", bcp.Base)
+		case base.Type == pbm.BackupTypeDifferential:
+			return "", 0, errors.Errorf("base backup %s is differential, the base should be a full backup", bcp.Base)
+		case base.Type == pbm.BackupTypeSchema:
+			return "", 0, errors.Errorf("base backup %s is schema-only, the base should be a full backup", bcp.Base)
+		case base.Type == pbm.BackupTypeOplog:
+			return "", 0, errors.Errorf("base backup %s is oplog-only, the base should be a full backup", bcp.Base)
+		}
+	}
+
+	if !bcp.IgnoreWindow {
+		cfg, err := cn.GetConfig()
+		if err != nil {
+			return "", 0, errors.Wrap(err, "get config")
+		}
+		err = cfg.Backup.Window.Check(time.Now())
+		if err != nil {
+			return "", 0, errors.Errorf("%v. Use --ignore-window to run it anyway", err)
+		}
+	}
+
+	store = storeString(stg)
+
+	err = checkRate(cn, pbm.CmdBackup)
 	if err != nil {
-		return "", errors.Wrap(err, "send command")
+		return "", 0, err
+	}
+
+	cmd := pbm.Cmd{
+		Cmd:            pbm.CmdBackup,
+		Backup:         *bcp,
+		IdempotencyKey: idemKey,
+	}
+	err = checkIdempotencyKey(cn, cmd)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the queued backups are started by the agents once the lock is released
+	if busy != nil {
+		qpos, err = cn.QueueJob(cmd, pbm.PriorityOnDemand)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "queue backup")
+		}
+		return store, qpos, nil
+	}
+
+	// the dispatch span lasts until the agents have confirmed the start
+	span := cn.StartSpan(pbm.TraceContext{}, "dispatch backup", "", "pbm")
+	bcp.Trace = span.Context()
+	cmd.Backup.Trace = bcp.Trace
+	err = cn.SendCmd(cmd)
+	if err != nil {
+		span.Finish(err)
+		return "", 0, errors.Wrap(err, "send command")
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
 	defer cancel()
-	err = waitForStatus(ctx, cn, bcpName)
+	err = waitForStatus(ctx, cn, bcp.Name)
+	span.Finish(err)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
+	return store, 0, nil
+}
+
+func storeString(stg pbm.Storage) string {
 	storeString := ""
 	switch stg.Type {
 	case pbm.StorageS3:
@@ -70,7 +210,7 @@ func backup(cn *pbm.PBM, bcpName, compression string) (string, error) {
 	case pbm.StorageFilesystem:
 		storeString = stg.Filesystem.Path
 	}
-	return storeString, nil
+	return storeString
 }
 
 func waitForStatus(ctx context.Context, cn *pbm.PBM, bcpName string) error {
@@ -116,8 +256,42 @@ func waitForStatus(ctx context.Context, cn *pbm.PBM, bcpName string) error {
 	}
 }
 
-func printBackupList(cn *pbm.PBM, size int64) {
-	bcps, err := cn.BackupsList(size)
+// backupFilter makes the filter of backups out of the `pbm list` flags
+func backupFilter(tags map[string]string, since, until, typ, status string) (pbm.BackupFilter, error) {
+	f := pbm.BackupFilter{
+		Tags:   tags,
+		Type:   pbm.BackupType(typ),
+		Status: pbm.Status(status),
+	}
+
+	if since != "" {
+		t, err := parseListTime(since)
+		if err != nil {
+			return f, errors.Wrap(err, "parse --since")
+		}
+		f.Since = t.Unix()
+	}
+	if until != "" {
+		t, err := parseListTime(until)
+		if err != nil {
+			return f, errors.Wrap(err, "parse --until")
+		}
+		f.Until = t.Unix()
+	}
+
+	return f, nil
+}
+
+func parseListTime(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printBackupList(cn *pbm.PBM, f pbm.BackupFilter, pg pbm.Page) {
+	bcps, total, err := cn.FindBackupsPage(f, pg)
 	if err != nil {
 		log.Fatalln("Error: unable to get backups list:", err)
 	}
@@ -127,8 +301,55 @@ func printBackupList(cn *pbm.PBM, size int64) {
 		switch b.Status {
 		case pbm.StatusDone:
 			bcp = b.Name
+			if b.Type == pbm.BackupTypeDifferential {
+				bcp += fmt.Sprintf("\t[differential of %s]", b.Base)
+			}
+			if b.Type == pbm.BackupTypeSchema {
+				bcp += "\t[schema only]"
+			}
+			if b.Type == pbm.BackupTypeOplog {
+				bcp += fmt.Sprintf("\t[oplog only %s]", oplogWindow(b))
+			}
+			if b.ConsistentTS.T > 0 {
+				bcp += fmt.Sprintf("\t[consistent since %s]", fmtTS(b.ConsistentTS))
+			}
+			if b.ExpireAt > 0 {
+				bcp += fmt.Sprintf("\t[expires %s]", time.Unix(b.ExpireAt, 0).UTC().Format(time.RFC3339))
+			}
+			if b.LegalHold {
+				bcp += "\t[legal hold]"
+			}
+			if len(b.Subset) > 0 {
+				bcp += fmt.Sprintf("\t[replsets %s]", strings.Join(b.Subset, ","))
+			}
+			if b.TopologyDrift != nil {
+				bcp += fmt.Sprintf("\t[%s]", b.TopologyDrift)
+			}
+			if len(b.Tags) > 0 {
+				bcp += fmt.Sprintf("\t[tags %s]", formatTags(b.Tags))
+			}
+			for _, g := range b.GridFS {
+				if !g.OK() {
+					bcp += fmt.Sprintf("\t[GridFS %s]", g)
+				}
+			}
+			for _, rs := range b.Replsets {
+				for _, g := range rs.GridFS {
+					if !g.OK() {
+						bcp += fmt.Sprintf("\t[%s GridFS %s]", rs.Name, g)
+					}
+				}
+				if n := uncompressedCount(rs); n > 0 {
+					bcp += fmt.Sprintf("\t[%s %d collections uncompressed]", rs.Name, n)
+				}
+				if len(rs.Skipped) > 0 {
+					bcp += fmt.Sprintf("\t[%s skipped %s]", rs.Name, strings.Join(rs.Skipped, ","))
+				}
+			}
 		case pbm.StatusError:
 			bcp = fmt.Sprintf("%s\tFailed with \"%s\"", b.Name, b.Error)
+		case pbm.StatusPartlyDone:
+			bcp = fmt.Sprintf("%s\tPartly done, %s", b.Name, b.Error)
 		default:
 			bcp, err = printBackupProgress(b, cn)
 			if err != nil {
@@ -138,6 +359,21 @@ func printBackupList(cn *pbm.PBM, size int64) {
 
 		fmt.Println(" ", bcp)
 	}
+	if shown := pg.Skip + int64(len(bcps)); shown < total {
+		fmt.Printf("  ... %d more, use --skip %d to see the next ones\n", total-shown, shown)
+	}
+}
+
+// uncompressedCount returns the number of the replset's collections
+// dumped with no compression by the adaptive compression
+func uncompressedCount(rs pbm.BackupReplset) int {
+	n := 0
+	for _, c := range rs.Compressions {
+		if c.Compression == pbm.CompressionTypeNone {
+			n++
+		}
+	}
+	return n
 }
 
 func printBackupProgress(b pbm.BackupMeta, pbmClient *pbm.PBM) (string, error) {
@@ -168,5 +404,97 @@ func printBackupProgress(b pbm.BackupMeta, pbmClient *pbm.PBM) (string, error) {
 		return fmt.Sprintf("%s\t%s", b.Name, staleMsg[:len(staleMsg)-1]), nil
 	}
 
-	return fmt.Sprintf("%s\tIn progress [%s] (Launched at %s)", b.Name, b.Status, time.Unix(b.StartTS, 0).Format(time.RFC3339)), nil
+	eta := ""
+	if d, ok := dumpETA(&b); ok {
+		eta = fmt.Sprintf(" dump ETA %v", d)
+	}
+
+	lags := ""
+	for _, rs := range b.Replsets {
+		if rs.OplogLag > 0 && (rs.Status == pbm.StatusRunning || rs.Status == pbm.StatusDumpDone) {
+			lags += fmt.Sprintf(" %s: %ds,", rs.Name, rs.OplogLag)
+		}
+	}
+	if lags != "" {
+		lags = " oplog lag:" + lags[:len(lags)-1]
+	}
+
+	return fmt.Sprintf("%s\tIn progress [%s] (Launched at %s)%s%s", b.Name, b.Status, time.Unix(b.StartTS, 0).Format(time.RFC3339), eta, lags), nil
+}
+
+// overwriteSuffix is added to the name of the backup which runs
+// to replace the existing one until it's done
+const overwriteSuffix = ".overwrite"
+
+// checkOverwrite returns an error if the backup can't be replaced.
+// It's deleted by the agents only once the new one is done.
+func checkOverwrite(cn *pbm.PBM, bmeta *pbm.BackupMeta) error {
+	if !bmeta.IsFinished() {
+		return errors.Errorf("backup is still running (%s)", bmeta.Status)
+	}
+	err := bmeta.CheckDelete(time.Now())
+	if err != nil {
+		return err
+	}
+	deps, err := cn.DependentBackups(bmeta.Name)
+	if err != nil {
+		return errors.Wrap(err, "get dependent backups")
+	}
+	if len(deps) > 0 {
+		return errors.Errorf("backup is the base for the differential backups %v", deps)
+	}
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	if cfg.Approval.Required(pbm.CmdDeleteBackup) {
+		return errors.New("deletion of the backup needs the approval by another user, delete it first")
+	}
+	return nil
+}
+
+// formatTags returns the tags as the sorted list of key=value
+func formatTags(tags map[string]string) string {
+	t := make([]string, 0, len(tags))
+	for k, v := range tags {
+		t = append(t, k+"="+v)
+	}
+	sort.Strings(t)
+	return strings.Join(t, ",")
+}
+
+// oplogWindow returns the time range the oplog-only backup covers:
+// from the earliest replset's start to the cluster last write
+func oplogWindow(b pbm.BackupMeta) string {
+	var from primitive.Timestamp
+	for _, rs := range b.Replsets {
+		if from.T == 0 || primitive.CompareTimestamp(rs.FirstWriteTS, from) < 0 {
+			from = rs.FirstWriteTS
+		}
+	}
+	return fmt.Sprintf("%s - %s",
+		time.Unix(int64(from.T), 0).UTC().Format(time.RFC3339),
+		time.Unix(int64(b.LastWriteTS.T), 0).UTC().Format(time.RFC3339))
+}
+
+// oplogWindowFlags parses the window of the oplog-only backup
+func oplogWindowFlags(from, until string) (f, u primitive.Timestamp, err error) {
+	if from == "" {
+		return f, u, errors.New("--oplog-from is required for the oplog-only backup")
+	}
+	f, err = pbm.ParseTimestamp(from)
+	if err != nil {
+		return f, u, errors.Wrap(err, "parse --oplog-from")
+	}
+	if until == "" {
+		return f, u, nil
+	}
+	u, err = pbm.ParseTimestamp(until)
+	if err != nil {
+		return f, u, errors.Wrap(err, "parse --oplog-until")
+	}
+	if primitive.CompareTimestamp(u, f) <= 0 {
+		return f, u, errors.New("--oplog-until should be after --oplog-from")
+	}
+	return f, u, nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// exportCatalog writes the catalog of the backups and the config into
+// the file. It returns the number of the backups exported.
+func exportCatalog(cn *pbm.PBM, out string, credentials bool) (int, error) {
+	c, err := cn.ExportCatalog(credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeOut(out, func(w io.Writer) (int, error) {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return len(c.Backups), errors.Wrap(enc.Encode(c), "encode catalog")
+	})
+}
+
+// importCatalog adds the backups of the catalog file and, with `config`,
+// sets the config from it. The redacted credentials of the catalog's
+// config are taken from the current config.
+func importCatalog(cn *pbm.PBM, file string, overwrite, config bool) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrap(err, "open catalog file")
+		}
+		defer f.Close()
+		r = f
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read catalog")
+	}
+	var c pbm.Catalog
+	err = json.Unmarshal(buf, &c)
+	if err != nil {
+		return errors.Wrap(err, "decode catalog")
+	}
+
+	if config {
+		if c.Config == nil {
+			return errors.New("catalog has no config")
+		}
+		cfg := *c.Config
+		if cfg.IsRedacted() {
+			cur, err := cn.GetConfig()
+			if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+				return errors.Wrap(err, "get current config")
+			}
+			cfg.UnredactFrom(cur)
+			if cfg.IsRedacted() {
+				return errors.New("catalog's config has no credentials (export it with --with-credentials) and there are none in the current config")
+			}
+		}
+		err = cn.SetConfig(cfg)
+		if err != nil {
+			return errors.Wrap(err, "set config")
+		}
+		fmt.Println("Config is imported")
+	}
+
+	res, err := cn.ImportBackups(c, overwrite)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backups imported: %d added, %d replaced\n", res.Added, res.Replaced)
+	if len(res.Skipped) > 0 {
+		fmt.Printf("Skipped (already exist or unfinished): %s\n", strings.Join(res.Skipped, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmbackup "github.com/percona/percona-backup-mongodb/pbm/backup"
+)
+
+// validateChain prints the backups chain of every replset with the gaps
+// in the oplog and the restorable points. It returns an error if some
+// of the backups can't be restored.
+func validateChain(cn *pbm.PBM, rs string) error {
+	reports, err := pbmbackup.ValidateChain(cn, rs)
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		fmt.Println("No successful backups")
+		return nil
+	}
+
+	broken := 0
+	for _, r := range reports {
+		fmt.Printf("Replset %s:\n", r.Replset)
+		for _, l := range r.Links {
+			state := "ok"
+			if l.Broken != "" {
+				state = "BROKEN: " + l.Broken
+				broken++
+			}
+			fmt.Printf("  %s\toplog %s\t%s\n", l.Backup, fmtRange(pbmbackup.TimeRange{From: l.First, To: l.Last}), state)
+		}
+		if len(r.Gaps) > 0 {
+			fmt.Println("  Oplog gaps:")
+			for _, g := range r.Gaps {
+				fmt.Printf("    %s\n", fmtRange(g))
+			}
+		}
+		printPoints("  Restorable points:", r.Points)
+	}
+	if len(reports) > 1 {
+		printPoints("Cluster restorable points:", pbmbackup.ClusterPoints(reports))
+	}
+
+	if broken > 0 {
+		return errors.Errorf("%d backups can't be restored", broken)
+	}
+	return nil
+}
+
+func printPoints(title string, pts []pbmbackup.RestorePoint) {
+	fmt.Println(title)
+	if len(pts) == 0 {
+		fmt.Println("    none")
+	}
+	for _, p := range pts {
+		fmt.Printf("    %s [%d,%d]\t%s", fmtTS(p.TS), p.TS.T, p.TS.I, p.Backup)
+		if p.From != p.TS {
+			fmt.Printf("\tconsistent since %s [%d,%d]", fmtTS(p.From), p.From.T, p.From.I)
+		}
+		fmt.Println()
+	}
+}
+
+func fmtRange(r pbmbackup.TimeRange) string {
+	return fmt.Sprintf("%s - %s [%s]", fmtTS(r.From), fmtTS(r.To), r)
+}
+
+func fmtTS(ts primitive.Timestamp) string {
+	return time.Unix(int64(ts.T), 0).UTC().Format(time.RFC3339)
+}
+
+// printRestorablePoints prints the cluster's restorable points
+// as a text or as JSON (format "json")
+func printRestorablePoints(cn *pbm.PBM, format string) error {
+	pts, err := pbmbackup.GetRestorablePoints(cn)
+	if err != nil {
+		return errors.Wrap(err, "get restorable points")
+	}
+
+	if format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(pts)
+	}
+
+	rss := make([]string, 0, len(pts.Replsets))
+	for rs := range pts.Replsets {
+		rss = append(rss, rs)
+	}
+	sort.Strings(rss)
+	for _, rs := range rss {
+		printPoints(fmt.Sprintf("Replset %s:", rs), pts.Replsets[rs])
+	}
+	if len(pts.Replsets) > 1 {
+		printPoints("Cluster:", pts.Cluster)
+	}
+	if pts.Broken > 0 {
+		fmt.Printf("%d backups can't be restored, see <pbm validate-chain>\n", pts.Broken)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmbackup "github.com/percona/percona-backup-mongodb/pbm/backup"
+)
+
+// the Nagios/Icinga plugin exit codes
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatus = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+type checkOpts struct {
+	// cluster is the name shown in the output
+	cluster string
+	maxAge  time.Duration
+	warnAge time.Duration
+	// verified requires the newest backup to pass the verification
+	verified bool
+}
+
+// runCheck checks the newest successful backup as the Nagios/Icinga plugin
+// does: it prints the one-line state with the perfdata and returns the
+// plugin exit code
+func runCheck(cn *pbm.PBM, o checkOpts) int {
+	h, err := pbmbackup.GetCatalogHealth(cn)
+	if err != nil {
+		return printCheck(checkUnknown, o.cluster, "get backups state: "+err.Error(), "")
+	}
+	if o.cluster == "" {
+		o.cluster = h.Cluster
+	}
+	code, msg, perf := checkHealth(h, o, time.Now())
+	return printCheck(code, o.cluster, msg, perf)
+}
+
+func printCheck(code int, cluster, msg, perf string) int {
+	if cluster != "" {
+		msg = cluster + ": " + msg
+	}
+	out := fmt.Sprintf("PBM %s - %s", checkStatus[code], strings.Replace(msg, "|", "/", -1))
+	if perf != "" {
+		out += " | " + perf
+	}
+	fmt.Println(out)
+	return code
+}
+
+// checkHealth returns the state of the newest successful backup which holds
+// the data (full or differential). It's critical if there is none, it's
+// older than the max age or its verification has failed.
+func checkHealth(h *pbmbackup.CatalogHealth, o checkOpts, now time.Time) (code int, msg, perf string) {
+	var last pbmbackup.NewestBackup
+	for _, t := range []pbm.BackupType{pbm.BackupTypeFull, pbm.BackupTypeDifferential} {
+		if b, ok := h.Newest[t]; ok && b.Finished > last.Finished {
+			last = b
+		}
+	}
+	if last.Name == "" {
+		return checkCritical, "no successful backups", ""
+	}
+
+	age := now.Sub(time.Unix(last.Finished, 0)).Truncate(time.Second)
+	perf = fmt.Sprintf("age=%ds;%s;%s;0 size=%dB;;;0", int64(age.Seconds()), perfSeconds(o.warnAge), perfSeconds(o.maxAge), last.Size)
+
+	var problems []string
+	code = checkOK
+	raise := func(c int, p string) {
+		if c > code {
+			code = c
+		}
+		problems = append(problems, p)
+	}
+	if o.maxAge > 0 && age > o.maxAge {
+		raise(checkCritical, fmt.Sprintf("older than %v", o.maxAge))
+	} else if o.warnAge > 0 && age > o.warnAge {
+		raise(checkWarning, fmt.Sprintf("older than %v", o.warnAge))
+	}
+	switch {
+	case h.Verify != nil && h.Verify.Backup == last.Name && h.Verify.Status == pbm.StatusError:
+		raise(checkCritical, "verification failed: "+h.Verify.Error)
+	case o.verified && !last.Verified:
+		raise(checkWarning, "not verified")
+	}
+
+	msg = fmt.Sprintf("last backup %s finished %v ago", last.Name, age)
+	if last.Verified {
+		msg += ", verified"
+	}
+	if len(problems) > 0 {
+		msg += ": " + strings.Join(problems, "; ")
+	}
+	return code, msg, perf
+}
+
+// perfSeconds returns the perfdata threshold, empty if it isn't set
+func perfSeconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", int64(d.Seconds()))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/clone"
+)
+
+// cloneCluster copies the data of the source replset into the target one
+func cloneCluster(ctx context.Context, srcURI, dstURI, transformFile string, plugin *pbm.TransformPlugin) error {
+	rules, err := readTransform(transformFile)
+	if err != nil {
+		return err
+	}
+
+	src, err := connectNode(ctx, srcURI)
+	if err != nil {
+		return errors.Wrap(err, "connect to the source")
+	}
+	defer src.Session().Disconnect(ctx)
+
+	dst, err := connectNode(ctx, dstURI)
+	if err != nil {
+		return errors.Wrap(err, "connect to the target")
+	}
+	defer dst.Session().Disconnect(ctx)
+
+	return clone.Clone(ctx, src, dst, rules, plugin)
+}
+
+func connectNode(ctx context.Context, uri string) (*pbm.Node, error) {
+	uri = pbm.NormalizeURI(uri)
+
+	cn, err := mongo.NewClient(options.Client().ApplyURI(uri).SetAppName("pbm-clone"))
+	if err != nil {
+		return nil, errors.Wrap(err, "create mongo client")
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo connect")
+	}
+	err = cn.Ping(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo ping")
+	}
+
+	return pbm.NewNode(ctx, "clone", cn, uri), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v2"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmrestore "github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// export writes documents of the namespace from the backup into the
+// file or to stdout if out is "-". The storage is taken from the PBM
+// config file if cfgFile is set, then cn may be nil. Otherwise it's
+// the storage of the cluster.
+func export(cn *pbm.PBM, cfgFile, bcpName, ns, out, format string) (int, error) {
+	var stg pbm.Storage
+	if cfgFile != "" {
+		buf, err := ioutil.ReadFile(cfgFile)
+		if err != nil {
+			return 0, errors.Wrap(err, "read config file")
+		}
+		var cfg pbm.Config
+		err = yaml.UnmarshalStrict(buf, &cfg)
+		if err != nil {
+			return 0, errors.Wrap(err, "unmarshal config file")
+		}
+		err = cfg.Storage.Cast()
+		if err != nil {
+			return 0, errors.Wrap(err, "cast storage")
+		}
+		stg = cfg.Storage
+	} else {
+		var err error
+		stg, err = cn.GetStorage()
+		if err != nil {
+			return 0, errors.Wrap(err, "get backup store")
+		}
+	}
+
+	return writeOut(out, func(w io.Writer) (int, error) {
+		return pbmrestore.Export(cn, stg, bcpName, ns, pbmrestore.ExportFormat(format), w)
+	})
+}
+
+func runExport(cn *pbm.PBM) {
+	n, err := export(cn, *exportConfig, *exportBcpName, *exportNS, *exportOut, *exportFormat)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	log.Printf("%d documents of '%s' exported from '%s'\n", n, *exportNS, *exportBcpName)
+}
+
+// extractOplog writes the oplog entries from the stored slices into the
+// file or to stdout if out is "-"
+func extractOplog(cn *pbm.PBM, from, to, ns, rs, out, format string) (int, error) {
+	opts := pbmrestore.OplogExtract{
+		NS:      ns,
+		Replset: rs,
+		Format:  pbmrestore.ExportFormat(format),
+	}
+
+	var err error
+	opts.From, err = pbm.ParseTimestamp(from)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse --from")
+	}
+	opts.To, err = pbm.ParseTimestamp(to)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse --to")
+	}
+	if primitive.CompareTimestamp(opts.From, opts.To) == 1 {
+		return 0, errors.New("--from is after --to")
+	}
+
+	return writeOut(out, func(w io.Writer) (int, error) {
+		return pbmrestore.ExtractOplog(cn, opts, w)
+	})
+}
+
+func writeOut(out string, f func(w io.Writer) (int, error)) (int, error) {
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		fl, err := os.Create(out)
+		if err != nil {
+			return 0, errors.Wrap(err, "create output file")
+		}
+		defer fl.Close()
+		w = fl
+	}
+
+	bw := bufio.NewWriter(w)
+	n, err := f(bw)
+	if err != nil {
+		return n, err
+	}
+
+	return n, errors.Wrap(bw.Flush(), "write output")
+}
+
+func printContents(cn *pbm.PBM, bcpName, db string, scan bool) error {
+	stats, err := pbmrestore.Contents(cn, bcpName, scan)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup '%s' contents:\n", bcpName)
+	rs := ""
+	for _, s := range stats {
+		if db != "" && !strings.HasPrefix(s.NS, db+".") {
+			continue
+		}
+		if s.Replset != rs {
+			rs = s.Replset
+			fmt.Printf("  %s:\n", rs)
+		}
+
+		approx := "~"
+		if s.Exact {
+			approx = ""
+		}
+		switch {
+		case s.Count == 0 && s.Size == 0 && !s.Exact:
+			fmt.Printf("    %s\n", s.NS)
+		default:
+			fmt.Printf("    %s\tdocs: %s%d, size: %s%s\n", s.NS, approx, s.Count, approx, fmtSize(s.Size))
+		}
+	}
+
+	return nil
+}
+
+func fmtSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
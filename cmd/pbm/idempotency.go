@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// startedError is returned if the job has already been started
+// by the earlier call with the same idempotency key
+type startedError struct {
+	cmd  pbm.Command
+	name string
+}
+
+func (e startedError) Error() string {
+	return fmt.Sprintf("%s '%s' has already been started with the idempotency key", e.cmd, e.name)
+}
+
+// checkIdempotencyKey checks the command's key hasn't been used by the
+// earlier call. It returns startedError if the key is bound to the job of
+// the call with the same parameters, and an error if the parameters differ.
+// The key is bound to the job by the agents once they get the command.
+func checkIdempotencyKey(cn *pbm.PBM, cmd pbm.Cmd) error {
+	if cmd.IdempotencyKey == "" {
+		return nil
+	}
+	k, err := cn.GetIdempotencyKey(cmd.IdempotencyKey)
+	if err != nil {
+		return errors.Wrap(err, "get idempotency key")
+	}
+	if k == nil {
+		return nil
+	}
+	err = k.Check(cmd)
+	if err != nil {
+		return err
+	}
+	return startedError{cmd: k.Cmd, name: k.Name}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmrestore "github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// restoreIndexes creates the indexes of the backup missing on the cluster
+// (mongos in the sharded one) without touching the data
+func restoreIndexes(ctx context.Context, cn *pbm.PBM, bcpName, rsName, targetURI string, dryRun bool) error {
+	idxs, err := pbmrestore.Indexes(cn, bcpName, rsName)
+	if err != nil {
+		return errors.Wrap(err, "read backup indexes")
+	}
+
+	node, err := connectNode(ctx, targetURI)
+	if err != nil {
+		return errors.Wrap(err, "connect to the target")
+	}
+	defer node.Session().Disconnect(ctx)
+
+	res, err := pbmrestore.RestoreIndexes(ctx, node, idxs, dryRun)
+	if err != nil {
+		return err
+	}
+
+	created, failed := 0, 0
+	for _, r := range res {
+		switch r.Status {
+		case pbmrestore.IndexExists:
+			continue
+		case pbmrestore.IndexCreated:
+			created++
+		case pbmrestore.IndexFailed:
+			failed++
+		}
+		if r.Err != "" {
+			fmt.Printf("  %s\t%s\t%s: %s\n", r.NS, r.Name, r.Status, r.Err)
+		} else {
+			fmt.Printf("  %s\t%s\t%s\n", r.NS, r.Name, r.Status)
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("%d indexes in the backup, nothing changed (dry run)\n", len(res))
+		return nil
+	}
+	fmt.Printf("%d indexes in the backup, %d created\n", len(res), created)
+	if failed > 0 {
+		return errors.Errorf("%d indexes failed", failed)
+	}
+	return nil
+}
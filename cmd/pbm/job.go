@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// getBackupJob returns the metadata of the backup job by its ID (backup name)
+func getBackupJob(cn *pbm.PBM, id string) (*pbm.BackupMeta, error) {
+	bmeta, err := cn.GetJobMeta(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup metadata")
+	}
+	if bmeta.Name == "" {
+		return nil, errors.Errorf("backup %s not found", id)
+	}
+	return bmeta, nil
+}
+
+func printJobStatus(cn *pbm.PBM, id string) error {
+	qpos, err := cn.QueuePosition(id)
+	if err != nil {
+		return errors.Wrap(err, "get backups queue")
+	}
+	if qpos > 0 {
+		fmt.Printf("Backup:  %s\n", id)
+		fmt.Printf("Status:  queued (position %d)\n", qpos)
+		return nil
+	}
+
+	bmeta, err := getBackupJob(cn, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup:  %s\n", bmeta.Name)
+	fmt.Printf("Status:  %s\n", bmeta.Status)
+	if bmeta.Error != "" {
+		fmt.Printf("Error:   %s\n", bmeta.Error)
+	}
+	fmt.Printf("Started: %s\n", time.Unix(bmeta.StartTS, 0).UTC().Format(time.RFC3339))
+	if bmeta.IsFinished() {
+		fmt.Printf("Finished: %s\n", time.Unix(bmeta.LastTransitionTS, 0).UTC().Format(time.RFC3339))
+	}
+	fmt.Println("Replsets:")
+	for _, rs := range bmeta.Replsets {
+		s := fmt.Sprintf("  %s\t%s", rs.Name, rs.Status)
+		if rs.Error != "" {
+			s += ": " + rs.Error
+		}
+		if rs.Status == pbm.StatusRunning && rs.Progress != nil {
+			s += "\t" + fmtProgress(*rs.Progress)
+		}
+		fmt.Println(s)
+	}
+	if !bmeta.IsFinished() {
+		if eta, ok := dumpETA(bmeta); ok {
+			fmt.Printf("Dump ETA: %v\n", eta)
+		}
+	}
+	return nil
+}
+
+// fmtProgress returns the dump progress, e.g. "45% (1.2GB of 2.6GB), 12.0MB/s, ETA 2m5s"
+func fmtProgress(p pbm.BackupProgress) string {
+	s := fmt.Sprintf("%d%% (%s of ~%s)", p.Percent(), fmtSize(p.Done), fmtSize(p.Total))
+	if p.Rate > 0 {
+		s += fmt.Sprintf(", %s/s, ETA %v", fmtSize(p.Rate), time.Duration(p.ETA)*time.Second)
+	}
+	return s
+}
+
+// dumpETA returns when the dumps of all replsets are expected to be done,
+// i.e. the longest of the replsets' ETAs. It's false if any of the running
+// dumps has no estimate yet.
+func dumpETA(b *pbm.BackupMeta) (time.Duration, bool) {
+	var eta int64
+	running := false
+	for _, rs := range b.Replsets {
+		if rs.Status != pbm.StatusRunning {
+			continue
+		}
+		running = true
+		if rs.Progress == nil || rs.Progress.Rate == 0 {
+			return 0, false
+		}
+		if rs.Progress.ETA > eta {
+			eta = rs.Progress.ETA
+		}
+	}
+	return time.Duration(eta) * time.Second, running
+}
+
+// waitJob waits for the backup job to finish and returns an error
+// if it hasn't finished successfully. Zero timeout means no limit.
+func waitJob(cn *pbm.PBM, id string, timeout time.Duration) (*pbm.BackupMeta, error) {
+	// the queued backup has no metadata until it's started
+	qpos, err := cn.QueuePosition(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups queue")
+	}
+	if qpos == 0 {
+		_, err = getBackupJob(cn, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	bmeta, err := cn.WaitBackup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch bmeta.Status {
+	case pbm.StatusError:
+		return bmeta, errors.Errorf("backup %s failed: %s", id, bmeta.Error)
+	case pbm.StatusPartlyDone:
+		return bmeta, errors.Errorf("backup %s is partly done: %s", id, bmeta.Error)
+	}
+	return bmeta, nil
+}
+
+// logsSkew is how far back the next poll of the followed logs goes
+// to catch the entries from the agents with the lagging clock
+const logsSkew = int64(5 * time.Second)
+
+// printJobLogs prints the agents' log lines of the backup job with at
+// least the given severity. With `follow` it keeps printing the new lines
+// until the job is finished. If the lines are already pushed out of the
+// log collection, the ones saved in the backup metadata are printed.
+func printJobLogs(cn *pbm.PBM, id string, sev pbm.Severity, follow bool) error {
+	bmeta, err := getBackupJob(cn, id)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[primitive.ObjectID]struct{})
+	var since int64
+	for {
+		logs, err := cn.GetLogs(id, since, sev)
+		if err != nil {
+			return errors.Wrap(err, "get logs")
+		}
+		if len(seen) == 0 && len(logs) == 0 && bmeta.IsFinished() {
+			for _, l := range bmeta.Logs {
+				if l.Severity >= sev {
+					fmt.Println(l)
+				}
+			}
+			return nil
+		}
+		for _, l := range logs {
+			if _, ok := seen[l.ID]; ok {
+				continue
+			}
+			seen[l.ID] = struct{}{}
+			fmt.Println(l)
+			if l.TS-logsSkew > since {
+				since = l.TS - logsSkew
+			}
+		}
+		if !follow {
+			return nil
+		}
+
+		bmeta, err = getBackupJob(cn, id)
+		if err != nil {
+			return err
+		}
+		if bmeta.IsFinished() {
+			// the last lines could have been written after the poll
+			follow = false
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func printLocks(cn *pbm.PBM) {
+	locks, err := cn.GetLocks(&pbm.LockHeader{})
+	if err != nil {
+		log.Fatalln("Error: get locks:", err)
+	}
+
+	ts, err := cn.ClusterTime()
+	if err != nil {
+		log.Fatalln("Error: read cluster time:", err)
+	}
+
+	fmt.Println("Locks:")
+	if len(locks) == 0 {
+		fmt.Println("  <none>")
+		return
+	}
+	for _, l := range locks {
+		state := "alive"
+		if l.IsStale(ts) {
+			state = "stale"
+		}
+		fmt.Printf("  %s/%s\t%s '%s'\t[%s] last beat at %s\n",
+			l.Replset, l.Node, l.Type, l.BackupName, state,
+			time.Unix(int64(l.Heartbeat.T), 0).UTC().Format(time.RFC3339))
+	}
+}
+
+func releaseLock(cn *pbm.PBM, rs string, force bool) error {
+	err := cn.ReleaseLock(pbm.LockHeader{Replset: rs}, force)
+	switch {
+	case errors.Cause(err) == mongo.ErrNoDocuments:
+		return errors.Errorf("no lock found for the replset '%s'", rs)
+	case err == pbm.ErrLockAlive:
+		return errors.Errorf("lock for the replset '%s' is alive. Use --force to release it anyway", rs)
+	}
+	return err
+}
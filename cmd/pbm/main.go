@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
@@ -17,7 +18,7 @@ import (
 
 var (
 	pbmCmd = kingpin.New("pbm", "Percona Backup for MongoDB")
-	mURL   = pbmCmd.Flag("mongodb-uri", "MongoDB connection string").String()
+	mURL   = pbmCmd.Flag("mongodb-uri", "MongoDB connection string (mongodb:// or mongodb+srv://)").String()
 
 	configCmd           = pbmCmd.Command("config", "Set, change or list the config")
 	configRsyncBcpListF = configCmd.Flag("force-resync", "Resync backup list with the current store").Bool()
@@ -30,14 +31,220 @@ var (
 	bcpCompression = pbmCmd.Flag("compression", "Compression type <none>/<gzip>").Hidden().
 			Default(pbm.CompressionTypeGZIP).
 			Enum(string(pbm.CompressionTypeNone), string(pbm.CompressionTypeGZIP))
+	bcpIgnoreWindow = backupCmd.Flag("ignore-window", "Run backup regardless of the backup window and blackout periods").Bool()
+	bcpTimeout      = backupCmd.Flag("timeout", "Abort the backup if it isn't finished in the given time (e.g. 6h). Overrides the config value").Duration()
+	bcpBase         = backupCmd.Flag("base", "Make a differential backup against the given full backup").String()
+	bcpExpireIn     = backupCmd.Flag("expire-in", "Keep the backup immutable for the given time (e.g. 720h), it's deleted with <pbm delete-backup --expired> after").Duration()
+	bcpLegalHold    = backupCmd.Flag("legal-hold", "Put the backup under the legal hold so it can't be deleted").Bool()
+	bcpCheckGridFS  = backupCmd.Flag("check-gridfs", "Check GridFS files for missing chunks and orphaned chunks during the backup. The sharded cluster is checked by the mongos agent (pbm-agent mongos)").Bool()
+	bcpFsyncLock    = backupCmd.Flag("fsync-lock", "Lock the node against writes for the time of the dump instead of relying on the oplog (allows to back up a standalone node)").Bool()
+	bcpSelector     = backupCmd.Flag("selector", "Make the backup only from the nodes which agents have the given label (e.g. dc=dr), can be repeated. The leading replset (config server) falls back to any node if none of its agents matches").StringMap()
+	bcpReplsets     = backupCmd.Flag("replset", "Back up only the given replset (shard), can be repeated. Backups of the disjoint replsets can run concurrently").Strings()
+	bcpWait         = backupCmd.Flag("wait", "Wait for the backup to finish").Bool()
+	bcpName         = backupCmd.Flag("name", "Name of the backup, may be a template with {cluster}, {date}, {time} and {seq} placeholders. Defaults to the backup.nameTemplate config value or the current time").String()
+	bcpTag          = backupCmd.Flag("tag", "Label the backup with the tag <key=value> (e.g. reason=pre-upgrade), can be repeated").StringMap()
+	bcpProfile      = backupCmd.Flag("profile", "Resources profile of the backup: low/medium/high. Overrides backup.profile from the config").Enum(string(pbm.ProfileLow), string(pbm.ProfileMedium), string(pbm.ProfileHigh))
+	bcpQueue        = backupCmd.Flag("queue", "Queue the backup if another operation is in progress instead of failing. It goes ahead of the scheduled backups").Bool()
+	bcpOverwrite    = backupCmd.Flag("allow-overwrite", "Replace the existing backup with the same name. It is deleted only once the new backup is done").Bool()
+	bcpMinCollSize  = backupCmd.Flag("min-coll-size", "Skip the collections smaller than the given size (e.g. 1KB)").Bytes()
+	bcpMaxCollSize  = backupCmd.Flag("max-coll-size", "Skip the collections bigger than the given size (e.g. 100GB)").Bytes()
+	bcpParallel     = backupCmd.Flag("parallel-collections", "Number of the collections dumped concurrently, the largest ones go first").Int()
+	bcpSchemaOnly   = backupCmd.Flag("schema-only", "Back up only the collections with their options and indexes, users and roles and the sharding metadata, without the documents").Bool()
+	bcpOplogOnly    = backupCmd.Flag("oplog-only", "Back up only the oplog since --oplog-from, no dump. It extends the point-in-time window of the data backed up by other means").Bool()
+	bcpOplogFrom    = backupCmd.Flag("oplog-from", "Start of the oplog-only backup: timestamp <T[,I]> or RFC3339 date").String()
+	bcpOplogUntil   = backupCmd.Flag("oplog-until", "End of the oplog-only backup: timestamp <T[,I]> or RFC3339 date. Defaults to the cluster last write, the future point is waited for").String()
+	bcpAdaptive     = backupCmd.Flag("adaptive-compression", "Sample the collections and dump the incompressible ones (e.g. already compressed blobs) separately with no compression").Bool()
+	bcpIdemKey      = backupCmd.Flag("idempotency-key", "Key of the call, the retried call with the same key doesn't start another backup but reports the one started by the first call. The key reused with other parameters is an error. Keys are kept for 24h").String()
 
-	restoreCmd     = pbmCmd.Command("restore", "Restore backup")
-	restoreBcpName = restoreCmd.Arg("backup_name", "Backup name to restore").Required().String()
+	restoreCmd         = pbmCmd.Command("restore", "Restore backup")
+	restoreBcpName     = restoreCmd.Arg("backup_name", "Backup name to restore").Required().String()
+	restoreTransform   = restoreCmd.Flag("transform", "YAML file with the rules to anonymize the data (hash/null/remove fields, drop collections)").String()
+	restorePlugin      = restoreCmd.Flag("plugin", "Path to the documents transformation plugin (an executable reading and writing BSON documents) on the agents' hosts").String()
+	restorePluginArg   = restoreCmd.Flag("plugin-arg", "Argument passed to the plugin <key=value>").StringMap()
+	restoreCheckGridFS = restoreCmd.Flag("check-gridfs", "Validate restored GridFS files (chunks and md5) and report broken ones. The sharded cluster is checked by the mongos agent (pbm-agent mongos)").Bool()
+	restoreParallel    = restoreCmd.Flag("parallel-collections", "Number of the dumps and the collections restored concurrently, the biggest ones first").Int()
+	restoreSessions    = restoreCmd.Flag("sessions", "Restore the sessions records of the retryable writes if the backup has them (see backup.sessions config)").Bool()
+	restoreMode        = restoreCmd.Flag("mode", "How the collections are put over the existing ones: drop and recreate (default), merge (insert skipping the existing _id) or replace (upsert by _id)").Enum(string(pbm.RestoreDrop), pbm.RestoreMerge, pbm.RestoreReplace)
+	restoreNSModes     = restoreCmd.Flag("ns-mode", "Mode of the matching namespaces <ns>=<mode>, e.g. db.*=merge. The first match wins").Strings()
+	restorePreflight   = restoreCmd.Flag("preflight", "Only check the cluster can take the restore (agents, disk space, data, FCV, balancer) and print the report").Bool()
+	restoreForce       = restoreCmd.Flag("force", "Start the restore even if the pre-flight checks fail").Bool()
+	restoreSafety      = restoreCmd.Flag("safety-backup", "Take the backup of the cluster before the restore which drops or overwrites the data, the restore starts once it's done").Bool()
+	restoreQueue       = restoreCmd.Flag("queue", "Queue the restore if another operation is in progress instead of failing").Bool()
+	restoreIdemKey     = restoreCmd.Flag("idempotency-key", "Key of the call, the retried call with the same key doesn't start another restore but reports the one started by the first call. The key reused with other parameters is an error. Keys are kept for 24h").String()
+
+	restoreWizardCmd = pbmCmd.Command("restore-wizard", "Restore the backup interactively: pick the backup, the namespaces and the mode, review the data about to be dropped or overwritten and confirm by typing the backup name")
+
+	applyCmd  = pbmCmd.Command("apply", "Submit the backup or restore job from the declarative spec (Kubernetes custom resource shaped). The job which already exists isn't submitted again")
+	applyFile = applyCmd.Flag("file", "Job spec file (yaml or json), \"-\" for stdin").Short('f').Required().String()
+
+	replayCmd      = pbmCmd.Command("replay-oplog", "Replay the oplog slices of the backups over the data restored from an external snapshot (e.g. by the infrastructure tooling)")
+	replaySnapshot = replayCmd.Flag("snapshot-ts", "Cluster time the snapshot is consistent as of: timestamp <T[,I]> or RFC3339 date").Required().String()
+	replayUntil    = replayCmd.Flag("until", "Replay the oplog up to the timestamp <T[,I]> or RFC3339 date. Defaults to the latest point covered by the oplog slices of every replset").String()
 
 	listCmd            = pbmCmd.Command("list", "Backup list")
 	listCmdRestore     = listCmd.Flag("restore", "Show last N restores").Default("false").Bool()
 	listCmdRestoreFull = listCmd.Flag("full", "Show extended restore info").Default("false").Short('f').Hidden().Bool()
+	listCmdVerify      = listCmd.Flag("verifications", "Show last N backup verifications").Default("false").Bool()
+	listCmdRehearsals  = listCmd.Flag("rehearsals", "Show last N restore rehearsals").Default("false").Bool()
 	listCmdSize        = listCmd.Flag("size", "Show last N backups").Default("0").Int64()
+	listCmdSkip        = listCmd.Flag("skip", "Skip first N backups").Default("0").Int64()
+	listCmdSort        = listCmd.Flag("sort", "Sort backups by the field: name/start/status/type, prefix with '-' for the descending order (default -start)").String()
+	listCmdTag         = listCmd.Flag("tag", "Show only backups with the given tag <key=value>, can be repeated").StringMap()
+	listCmdSince       = listCmd.Flag("since", "Show only backups started at or after the given time (RFC3339 or YYYY-MM-DD)").String()
+	listCmdUntil       = listCmd.Flag("until", "Show only backups started before the given time (RFC3339 or YYYY-MM-DD)").String()
+	listCmdType        = listCmd.Flag("type", "Show only backups of the given type").Enum(string(pbm.BackupTypeFull), string(pbm.BackupTypeDifferential), string(pbm.BackupTypeSchema), string(pbm.BackupTypeOplog))
+	listCmdStatus      = listCmd.Flag("status", "Show only backups with the given status").Enum(pbm.StatusDone, pbm.StatusPartlyDone, pbm.StatusError, string(pbm.StatusRunning))
+
+	rehearseCmd     = pbmCmd.Command("rehearse", "Restore the backup into a throwaway mongod on one of the agents' hosts and validate the data")
+	rehearseBcpName = rehearseCmd.Arg("backup_name", "Backup name to rehearse").Required().String()
+	rehearseReplset = rehearseCmd.Flag("replset", "Replset (shard) of the backup to restore. Defaults to the first one").String()
+	rehearseChecks  = rehearseCmd.Flag("checks", "YAML file with the validation queries run against the restored data").String()
+	rehearseWait    = rehearseCmd.Flag("wait", "Wait for the rehearsal to finish and print the results").Bool()
+
+	verifyCmd      = pbmCmd.Command("verify", "Read the backup files through to check they are intact and optionally rehearse the restore")
+	verifyBcpName  = verifyCmd.Arg("backup_name", "Backup name to verify").Required().String()
+	verifyRehearse = verifyCmd.Flag("rehearse", "Rehearse the restore of each replset of the backup as well (see pbm rehearse)").Bool()
+	verifyChecks   = verifyCmd.Flag("checks", "YAML file with the validation queries run against the rehearsal restores").String()
+	verifyWait     = verifyCmd.Flag("wait", "Wait for the verification to finish and print the results").Bool()
+	verifyQueue    = verifyCmd.Flag("queue", "Queue the verification if another operation is in progress").Bool()
+
+	validateChainCmd     = pbmCmd.Command("validate-chain", "Check that the backups can be restored and their oplog slices are contiguous, show the restorable points")
+	validateChainReplset = validateChainCmd.Flag("replset", "Check only the given replset (shard)").String()
+
+	pointsCmd    = pbmCmd.Command("restore-points", "Show the points in time the cluster can be restored to from the stored backups")
+	pointsFormat = pointsCmd.Flag("format", "Output format <text or json>").Default("text").Enum("text", "json")
+
+	checkCmd      = pbmCmd.Command("check", "Check the newest successful backup as the Nagios/Icinga plugin: exit with 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN)")
+	checkCluster  = checkCmd.Flag("cluster", "Cluster name shown in the output. Defaults to the replset name of --mongodb-uri").String()
+	checkMaxAge   = checkCmd.Flag("max-age", "CRITICAL if the newest successful backup has finished earlier than that (e.g. 24h)").Duration()
+	checkWarnAge  = checkCmd.Flag("warn-age", "WARNING if the newest successful backup has finished earlier than that (e.g. 12h)").Duration()
+	checkVerified = checkCmd.Flag("require-verified", "WARNING if the newest successful backup hasn't passed the verification. A failed verification is always CRITICAL").Bool()
+
+	deleteCmd        = pbmCmd.Command("delete-backup", "Delete backup")
+	deleteBcpName    = deleteCmd.Arg("backup_name", "Backup name to delete").String()
+	deleteBcpExpired = deleteCmd.Flag("expired", "Delete all expired backups").Bool()
+	deleteQueue      = deleteCmd.Flag("queue", "Queue the delete if another operation is in progress").Bool()
+
+	retentionCmd       = pbmCmd.Command("retention", "Set the backup expiry and legal hold")
+	retentionBcpName   = retentionCmd.Arg("backup_name", "Backup name").Required().String()
+	retentionExpireIn  = retentionCmd.Flag("expire-in", "Keep the backup immutable for the given time from now (e.g. 720h)").Duration()
+	retentionExpireAt  = retentionCmd.Flag("expire-at", "Keep the backup immutable until the given date (RFC3339)").String()
+	retentionNoExpire  = retentionCmd.Flag("no-expire", "Remove the expiry date").Bool()
+	retentionLegalHold = retentionCmd.Flag("legal-hold", "Set (on) or remove (off) the legal hold").Enum("on", "off")
+
+	catalogCmd             = pbmCmd.Command("catalog", "Move the backups catalog (metadata and config) between clusters")
+	catalogExportCmd       = catalogCmd.Command("export", "Export the backups metadata and the config into a file")
+	catalogExportOut       = catalogExportCmd.Flag("out", "Output file, \"-\" for stdout").Short('o').Default("-").String()
+	catalogExportCreds     = catalogExportCmd.Flag("with-credentials", "Keep the storage credentials in the exported config").Bool()
+	catalogImportCmd       = catalogCmd.Command("import", "Import the backups metadata (and the config) from the exported file")
+	catalogImportFile      = catalogImportCmd.Arg("file", "Catalog file, \"-\" for stdin").Required().String()
+	catalogImportOverwrite = catalogImportCmd.Flag("overwrite", "Replace the backups which already exist").Bool()
+	catalogImportConfig    = catalogImportCmd.Flag("config", "Set the config from the catalog as well. The redacted credentials are kept from the current config").Bool()
+	catalogResyncCmd       = catalogCmd.Command("resync", "Rebuild the catalog from the backups metadata files found on the storage")
+
+	storageCmd           = pbmCmd.Command("storage", "Inspect the backup storage")
+	storageResyncCmd     = storageCmd.Command("resync", "Match the storage files against the backups catalog and report the orphaned ones (files of failed or deleted backups, unused dedup blobs)")
+	storageResyncCleanup = storageResyncCmd.Flag("cleanup", "Remove the orphaned files").Bool()
+
+	exportCmd     = pbmCmd.Command("export", "Extract the collection from the backup into a local file")
+	exportBcpName = exportCmd.Arg("backup_name", "Backup name").Required().String()
+	exportNS      = exportCmd.Arg("namespace", "Collection to export <db.collection>").Required().String()
+	exportOut     = exportCmd.Flag("out", "Output file, \"-\" for stdout").Short('o').Default("-").String()
+	exportFormat  = exportCmd.Flag("format", "Output format <bson>/<json>").Default("bson").Enum("bson", "json")
+	exportConfig  = exportCmd.Flag("config", "PBM config file (YAML) to take the storage from. The backup is read from the storage only, --mongodb-uri isn't needed then").String()
+
+	contentsCmd     = pbmCmd.Command("contents", "List collections with documents count and size in the backup")
+	contentsBcpName = contentsCmd.Arg("backup_name", "Backup name").Required().String()
+	contentsDB      = contentsCmd.Flag("db", "Show only collections of the database").String()
+	contentsScan    = contentsCmd.Flag("scan", "Read the dumps to get the exact numbers instead of the stats recorded during the backup").Bool()
+
+	oplogExtractCmd     = pbmCmd.Command("oplog-extract", "Extract oplog entries from the stored oplog slices into a local file")
+	oplogExtractFrom    = oplogExtractCmd.Flag("from", "Start of the range <T[,I]> or RFC3339 date").Required().String()
+	oplogExtractTo      = oplogExtractCmd.Flag("to", "End of the range <T[,I]> or RFC3339 date").Required().String()
+	oplogExtractNS      = oplogExtractCmd.Flag("ns", "Extract only entries of the namespace <db.collection>").String()
+	oplogExtractReplset = oplogExtractCmd.Flag("replset", "Extract only entries of the replset").String()
+	oplogExtractOut     = oplogExtractCmd.Flag("out", "Output file, \"-\" for stdout").Short('o').Default("-").String()
+	oplogExtractFormat  = oplogExtractCmd.Flag("format", "Output format <bson>/<json>").Default("bson").Enum("bson", "json")
+
+	cloneCmd       = pbmCmd.Command("clone", "Copy the data of the replset (--mongodb-uri) into another one streaming it through this host, without the backup storage. Sharded clusters are not supported")
+	cloneTargetURI = cloneCmd.Flag("target-uri", "MongoDB connection string of the target replset").Required().String()
+	cloneTransform = cloneCmd.Flag("transform", "YAML file with the rules to anonymize the data (hash/null/remove fields, drop collections)").String()
+	clonePlugin    = cloneCmd.Flag("plugin", "Path to the documents transformation plugin (an executable reading and writing BSON documents)").String()
+	clonePluginArg = cloneCmd.Flag("plugin-arg", "Argument passed to the plugin <key=value>").StringMap()
+
+	restoreIdxCmd     = pbmCmd.Command("restore-indexes", "Create the indexes of the backup missing on the cluster, the data isn't touched")
+	restoreIdxBcpName = restoreIdxCmd.Arg("backup_name", "Backup name to take the indexes from").Required().String()
+	restoreIdxTarget  = restoreIdxCmd.Flag("target-uri", "MongoDB connection string to create the indexes through (mongos in the sharded cluster). Defaults to --mongodb-uri").String()
+	restoreIdxReplset = restoreIdxCmd.Flag("replset", "Take only the indexes of the given replset (shard) of the backup").String()
+	restoreIdxDryRun  = restoreIdxCmd.Flag("dry-run", "Only report the missing indexes").Bool()
+
+	statusCmd   = pbmCmd.Command("status", "Show the state of the backup job or the jobs queue")
+	statusJobID = statusCmd.Arg("backup_name", "Backup job ID (the backup name). Shows the queue of jobs if omitted").String()
+
+	cancelCmd   = pbmCmd.Command("cancel", "Cancel the running backup job or remove the queued job")
+	cancelJobID = cancelCmd.Arg("backup_name", "Backup job ID (the backup name) or the queued job name").Required().String()
+
+	waitCmd     = pbmCmd.Command("wait", "Wait for the backup job to finish")
+	waitJobID   = waitCmd.Arg("backup_name", "Backup job ID (the backup name)").Required().String()
+	waitTimeout = waitCmd.Flag("timeout", "Stop waiting after the given time (e.g. 1h)").Duration()
+
+	logsCmd    = pbmCmd.Command("logs", "Show the agents' logs of the backup job")
+	logsJobID  = logsCmd.Arg("backup_name", "Backup job ID (the backup name)").Required().String()
+	logsFollow = logsCmd.Flag("follow", "Keep streaming the logs until the backup is finished").Short('f').Bool()
+	logsSev    = logsCmd.Flag("severity", "Show only the entries of the given or higher severity <D>/<I>/<W>/<E>").Short('s').Default("I").Enum("D", "I", "W", "E")
+
+	traceCmd  = pbmCmd.Command("trace", "Show where the backup or restore has spent its time")
+	traceName = traceCmd.Arg("name", "Backup or restore name").Required().String()
+
+	agentsCmd     = pbmCmd.Command("agents", "Show the state of pbm-agents")
+	agentsReplset = agentsCmd.Flag("replset", "Show only agents of the replset").String()
+	agentsLost    = agentsCmd.Flag("lost", "Show only lost agents").Bool()
+	agentsSize    = agentsCmd.Flag("size", "Show first N agents").Default("0").Int64()
+	agentsSkip    = agentsCmd.Flag("skip", "Skip first N agents").Default("0").Int64()
+	agentsSort    = agentsCmd.Flag("sort", "Sort agents by the field: replset/node/lag/disk/hb, prefix with '-' for the descending order").String()
+
+	lockCmd          = pbmCmd.Command("lock", "Inspect or release operations locks")
+	lockListCmd      = lockCmd.Command("list", "List current locks").Default()
+	lockReleaseCmd   = lockCmd.Command("release", "Release stale lock of the replset")
+	lockReleaseRS    = lockReleaseCmd.Arg("replset", "Replset name which lock should be released").Required().String()
+	lockReleaseForce = lockReleaseCmd.Flag("force", "Release the lock even if it's alive").Bool()
+
+	maintCmd       = pbmCmd.Command("maintenance", "Put the agents into the maintenance mode: they finish the running operations but aren't picked for the new backups")
+	maintListCmd   = maintCmd.Command("list", "List nodes in maintenance").Default()
+	maintOnCmd     = maintCmd.Command("on", "Put the node's agent into maintenance")
+	maintOnNode    = maintOnCmd.Arg("node", "Node in the <replset/host:port> form, as shown by <pbm agents>").Required().String()
+	maintOnReason  = maintOnCmd.Flag("reason", "Reason of the maintenance (e.g. OS patching)").String()
+	maintOnWait    = maintOnCmd.Flag("wait", "Wait for the agent to finish the running operations").Bool()
+	maintOnTimeout = maintOnCmd.Flag("timeout", "Max time to wait for the agent to finish").Default("1h").Duration()
+	maintOffCmd    = maintCmd.Command("off", "Bring the node's agent back from maintenance")
+	maintOffNode   = maintOffCmd.Arg("node", "Node in the <replset/host:port> form").Required().String()
+
+	approvalCmd        = pbmCmd.Command("approval", "List, approve or reject the restores and deletes waiting for the approval (see the approval config section)")
+	approvalListCmd    = approvalCmd.Command("list", "List the approval requests, the latest first").Default()
+	approvalListSize   = approvalListCmd.Flag("size", "Show last N requests").Default("0").Int64()
+	approvalApproveCmd = approvalCmd.Command("approve", "Approve the request and run the operation. The request has to be made by another user")
+	approvalApproveID  = approvalApproveCmd.Arg("id", "Request ID").Required().String()
+	approvalApproveCmt = approvalApproveCmd.Flag("comment", "Comment kept in the audit trail (e.g. the change ticket)").String()
+	approvalApproveKey = approvalApproveCmd.Flag("key", "Approvers' private key file (PEM, PKCS#8 ed25519) the approval is signed with. Required if the agents run with --approval-key").Envar("PBM_APPROVAL_KEY").String()
+	approvalRejectCmd  = approvalCmd.Command("reject", "Reject the request")
+	approvalRejectID   = approvalRejectCmd.Arg("id", "Request ID").Required().String()
+	approvalRejectCmt  = approvalRejectCmd.Flag("comment", "Comment kept in the audit trail (e.g. the reason)").String()
+
+	tokenCmd           = pbmCmd.Command("agent-token", "Manage the agents registration tokens. Once there are tokens, the agents start only with the token bound to their replset")
+	tokenListCmd       = tokenCmd.Command("list", "List the tokens by the hash").Default()
+	tokenCreateCmd     = tokenCmd.Command("create", "Generate the token bound to the replset. It's shown only once, only its hash is kept")
+	tokenCreateReplset = tokenCreateCmd.Flag("replset", "Replset the agents with the token may serve").Required().String()
+	tokenCreateComment = tokenCreateCmd.Flag("comment", "Comment (e.g. the deployment the token is for)").String()
+	tokenRevokeCmd     = tokenCmd.Command("revoke", "Remove the token. The running agents keep working, the token is checked on the start")
+	tokenRevokeHash    = tokenRevokeCmd.Arg("sha256", "Token hash or its prefix (at least 8 chars)").Required().String()
+
+	queueCmd         = pbmCmd.Command("queue", "List, reorder or cancel the queued backups, restores, verifications and deletes. The agents start them once the running operations are finished (see the queue config section)")
+	queueListCmd     = queueCmd.Command("list", "List the queued jobs in the order they will be started").Default()
+	queuePriorityCmd = queueCmd.Command("priority", "Change the priority of the queued job, the higher goes first. The scheduled backups are 0, the on-demand jobs 10")
+	queuePriorityJob = queuePriorityCmd.Arg("job", "Queued job name").Required().String()
+	queuePriority    = queuePriorityCmd.Arg("priority", "New priority").Required().Int()
+	queueCancelCmd   = queueCmd.Command("cancel", "Remove the job from the queue")
+	queueCancelJob   = queueCancelCmd.Arg("job", "Queued job name").Required().String()
 
 	versionCmd    = pbmCmd.Command("version", "PBM version info")
 	versionShort  = versionCmd.Flag("short", "Only version info").Default("false").Bool()
@@ -67,8 +274,14 @@ func main() {
 		return
 	}
 
+	// the export from the storage doesn't need the cluster
+	if cmd == exportCmd.FullCommand() && *exportConfig != "" {
+		runExport(nil)
+		return
+	}
+
 	if *mURL == "" {
-		log.Println("Error: no mongodb connection URI supplied\n")
+		log.Print("Error: no mongodb connection URI supplied\n\n")
 		pbmCmd.Usage(os.Args[1:])
 		os.Exit(1)
 	}
@@ -78,6 +291,9 @@ func main() {
 
 	pbmClient, err := pbm.New(ctx, *mURL, "pbm-ctl")
 	if err != nil {
+		if cmd == checkCmd.FullCommand() {
+			os.Exit(printCheck(checkUnknown, *checkCluster, "connect to mongodb: "+err.Error(), ""))
+		}
 		log.Fatalln("Error: connect to mongodb:", err)
 	}
 
@@ -120,25 +336,385 @@ func main() {
 			getConfig(pbmClient)
 		}
 	case backupCmd.FullCommand():
-		bcpName := time.Now().UTC().Format(time.RFC3339)
+		bcpName, err := backupName(pbmClient, *bcpName)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
 		fmt.Printf("Starting backup '%s'", bcpName)
-		storeString, err := backup(pbmClient, bcpName, *bcpCompression)
+		bcp := pbm.BackupCmd{
+			Name:         bcpName,
+			Compression:  pbm.CompressionType(*bcpCompression),
+			IgnoreWindow: *bcpIgnoreWindow,
+			TimeoutSec:   int(bcpTimeout.Seconds()),
+		}
+		if *bcpBase != "" {
+			bcp.Type = pbm.BackupTypeDifferential
+			bcp.Base = *bcpBase
+		}
+		if *bcpSchemaOnly {
+			if *bcpBase != "" {
+				log.Fatalln("Error: --schema-only and --base can't be used together")
+			}
+			bcp.Type = pbm.BackupTypeSchema
+		}
+		if !*bcpOplogOnly && (*bcpOplogFrom != "" || *bcpOplogUntil != "") {
+			log.Fatalln("Error: --oplog-from and --oplog-until are used only with --oplog-only")
+		}
+		if *bcpOplogOnly {
+			if *bcpBase != "" || *bcpSchemaOnly {
+				log.Fatalln("Error: --oplog-only can't be used along with --base or --schema-only")
+			}
+			bcp.Type = pbm.BackupTypeOplog
+			bcp.OplogFrom, bcp.OplogUntil, err = oplogWindowFlags(*bcpOplogFrom, *bcpOplogUntil)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+		}
+		if *bcpExpireIn > 0 {
+			bcp.ExpireAt = time.Now().Add(*bcpExpireIn).Unix()
+		}
+		bcp.LegalHold = *bcpLegalHold
+		bcp.CheckGridFS = *bcpCheckGridFS
+		bcp.FsyncLock = *bcpFsyncLock
+		bcp.Selector = *bcpSelector
+		bcp.Replsets = *bcpReplsets
+		bcp.Tags = *bcpTag
+		bcp.Profile = pbm.Profile(*bcpProfile)
+		bcp.AdaptiveCompression = *bcpAdaptive
+		bcp.MinCollSize = int64(*bcpMinCollSize)
+		bcp.MaxCollSize = int64(*bcpMaxCollSize)
+		bcp.ParallelCollections = *bcpParallel
+		storeString, qpos, err := backup(pbmClient, &bcp, *bcpIdemKey, *bcpOverwrite, *bcpQueue)
+		if e, ok := errors.Cause(err).(startedError); ok {
+			fmt.Printf("\n%v\n", e)
+			break
+		}
 		if err != nil {
 			log.Fatalln("\nError starting backup:", err)
 			return
 		}
-		fmt.Printf("\nBackup '%s' to remote store '%s' has started\n", bcpName, storeString)
+		if bcp.Replaces != "" {
+			fmt.Printf("\nBackup '%s' replaces the existing one once it's done, it runs as '%s' until then", bcpName, bcp.Name)
+		}
+		if qpos > 0 {
+			fmt.Printf("\nAnother operation is in progress. Backup '%s' to remote store '%s' is queued at position %d\n", bcpName, storeString, qpos)
+		} else {
+			fmt.Printf("\nBackup '%s' to remote store '%s' has started\n", bcpName, storeString)
+		}
+		if *bcpWait {
+			fmt.Println("Waiting for the backup to finish...")
+			_, err = waitJob(pbmClient, bcp.Name, 0)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			fmt.Printf("Backup '%s' is done\n", bcpName)
+		}
 	case restoreCmd.FullCommand():
-		err := restore(pbmClient, *restoreBcpName)
+		if *restorePreflight {
+			err := printPreflight(pbmClient, *restoreBcpName)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			break
+		}
+		nsModes, err := pbm.ParseNSRestoreModes(*restoreNSModes)
+		if err != nil {
+			log.Fatalln("Error: parse --ns-mode:", err)
+		}
+		approval, qpos, err := restore(pbmClient, pbm.RestoreCmd{
+			BackupName:          *restoreBcpName,
+			Plugin:              transformPlugin(*restorePlugin, *restorePluginArg),
+			CheckGridFS:         *restoreCheckGridFS,
+			ParallelCollections: *restoreParallel,
+			Sessions:            *restoreSessions,
+			Mode:                pbm.RestoreMode(*restoreMode),
+			NSModes:             nsModes,
+		}, restoreOpts{
+			transform:   *restoreTransform,
+			force:       *restoreForce,
+			safety:      *restoreSafety,
+			compression: pbm.CompressionType(*bcpCompression),
+			queue:       *restoreQueue,
+			idemKey:     *restoreIdemKey,
+		})
+		if e, ok := errors.Cause(err).(startedError); ok {
+			fmt.Println(e)
+			break
+		}
 		if err != nil {
 			log.Fatalln("Error:", err)
 		}
+		if approval != "" {
+			printPending(approval)
+			break
+		}
+		if qpos > 0 {
+			fmt.Printf("Another operation is in progress. Restore of '%s' is queued at position %d\n", *restoreBcpName, qpos)
+			break
+		}
 		fmt.Printf("Restore of the snapshot from '%s' has started\n", *restoreBcpName)
+	case restoreWizardCmd.FullCommand():
+		bcpName, approval, err := restoreWizard(pbmClient, os.Stdin, os.Stdout, pbm.CompressionType(*bcpCompression))
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		if approval != "" {
+			printPending(approval)
+			break
+		}
+		fmt.Printf("Restore of the snapshot from '%s' has started\n", bcpName)
+	case applyCmd.FullCommand():
+		err := applyJob(pbmClient, *applyFile)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case replayCmd.FullCommand():
+		ext, approval, err := replayOplog(pbmClient, *replaySnapshot, *replayUntil)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		for _, s := range ext.Slices {
+			fmt.Printf("  %s\toplog of %s\t%d,%d - %d,%d\n", s.Replset, s.Backup, s.First.T, s.First.I, s.Last.T, s.Last.I)
+		}
+		if approval != "" {
+			printPending(approval)
+			break
+		}
+		fmt.Printf("Replay of the oplog up to %d,%d has started\n", ext.Until.T, ext.Until.I)
 	case listCmd.FullCommand():
 		if *listCmdRestore {
 			printRestoreList(pbmClient, *listCmdSize, *listCmdRestoreFull)
+		} else if *listCmdRehearsals {
+			printRehearsalList(pbmClient, *listCmdSize)
+		} else if *listCmdVerify {
+			printVerifyList(pbmClient, *listCmdSize)
+		} else {
+			f, err := backupFilter(*listCmdTag, *listCmdSince, *listCmdUntil, *listCmdType, *listCmdStatus)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			printBackupList(pbmClient, f, pbm.Page{Skip: *listCmdSkip, Limit: *listCmdSize, Sort: *listCmdSort})
+		}
+	case rehearseCmd.FullCommand():
+		name, err := rehearse(pbmClient, *rehearseBcpName, *rehearseReplset, *rehearseChecks)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		fmt.Printf("Restore rehearsal '%s' of '%s' has started\n", name, *rehearseBcpName)
+		if *rehearseWait {
+			fmt.Println("Waiting for the rehearsal to finish...")
+			err = waitRehearsal(pbmClient, name)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+		}
+	case verifyCmd.FullCommand():
+		name, qpos, err := verify(pbmClient, *verifyBcpName, *verifyRehearse, *verifyChecks, *verifyQueue)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		if qpos > 0 {
+			fmt.Printf("Another operation is in progress. Verification '%s' of '%s' is queued at position %d\n", name, *verifyBcpName, qpos)
+			break
+		}
+		fmt.Printf("Verification '%s' of '%s' has started\n", name, *verifyBcpName)
+		if *verifyWait {
+			fmt.Println("Waiting for the verification to finish...")
+			err = waitVerify(pbmClient, name)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+		}
+	case validateChainCmd.FullCommand():
+		err := validateChain(pbmClient, *validateChainReplset)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case pointsCmd.FullCommand():
+		err := printRestorablePoints(pbmClient, *pointsFormat)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case checkCmd.FullCommand():
+		os.Exit(runCheck(pbmClient, checkOpts{
+			cluster:  *checkCluster,
+			maxAge:   *checkMaxAge,
+			warnAge:  *checkWarnAge,
+			verified: *checkVerified,
+		}))
+	case deleteCmd.FullCommand():
+		approval, qpos, err := deleteBackup(pbmClient, *deleteBcpName, *deleteBcpExpired, *deleteQueue)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		if approval != "" {
+			printPending(approval)
+			break
+		}
+		if qpos > 0 {
+			fmt.Printf("Another operation is in progress. Backup deletion is queued at position %d\n", qpos)
+			break
+		}
+		fmt.Println("Backup deletion has started")
+	case retentionCmd.FullCommand():
+		err := setRetention(pbmClient, *retentionBcpName, *retentionExpireIn, *retentionExpireAt, *retentionNoExpire, *retentionLegalHold)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		fmt.Printf("Retention of the backup '%s' has been sent for update\n", *retentionBcpName)
+	case cloneCmd.FullCommand():
+		err := cloneCluster(ctx, *mURL, *cloneTargetURI, *cloneTransform, transformPlugin(*clonePlugin, *clonePluginArg))
+		if err != nil {
+			log.Fatalln("Error: clone:", err)
+		}
+		fmt.Println("Clone finished")
+	case restoreIdxCmd.FullCommand():
+		target := *restoreIdxTarget
+		if target == "" {
+			target = *mURL
+		}
+		err := restoreIndexes(ctx, pbmClient, *restoreIdxBcpName, *restoreIdxReplset, target, *restoreIdxDryRun)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case catalogExportCmd.FullCommand():
+		n, err := exportCatalog(pbmClient, *catalogExportOut, *catalogExportCreds)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		log.Printf("%d backups exported\n", n)
+	case catalogImportCmd.FullCommand():
+		err := importCatalog(pbmClient, *catalogImportFile, *catalogImportOverwrite, *catalogImportConfig)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case catalogResyncCmd.FullCommand():
+		rsync(pbmClient)
+	case approvalListCmd.FullCommand():
+		printApprovals(pbmClient, *approvalListSize)
+	case approvalApproveCmd.FullCommand():
+		err := decideApproval(pbmClient, *approvalApproveID, true, *approvalApproveCmt, *approvalApproveKey, pbm.CompressionType(*bcpCompression))
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case approvalRejectCmd.FullCommand():
+		err := decideApproval(pbmClient, *approvalRejectID, false, *approvalRejectCmt, "", "")
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case storageResyncCmd.FullCommand():
+		err := storageResync(pbmClient, *storageResyncCleanup)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case exportCmd.FullCommand():
+		runExport(pbmClient)
+	case contentsCmd.FullCommand():
+		err := printContents(pbmClient, *contentsBcpName, *contentsDB, *contentsScan)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case oplogExtractCmd.FullCommand():
+		n, err := extractOplog(pbmClient, *oplogExtractFrom, *oplogExtractTo, *oplogExtractNS, *oplogExtractReplset, *oplogExtractOut, *oplogExtractFormat)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		log.Printf("%d oplog entries extracted\n", n)
+	case statusCmd.FullCommand():
+		var err error
+		if *statusJobID == "" {
+			err = printQueue(pbmClient)
 		} else {
-			printBackupList(pbmClient, *listCmdSize)
+			err = printJobStatus(pbmClient, *statusJobID)
+		}
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case cancelCmd.FullCommand():
+		ok, err := pbmClient.UnqueueJob(*cancelJobID)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		if ok {
+			fmt.Printf("Job '%s' has been removed from the queue\n", *cancelJobID)
+			return
+		}
+		err = pbmClient.CancelBackup(*cancelJobID)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		fmt.Printf("Backup '%s' has been sent for cancellation\n", *cancelJobID)
+	case waitCmd.FullCommand():
+		bmeta, err := waitJob(pbmClient, *waitJobID, *waitTimeout)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		fmt.Printf("Backup '%s' is %s\n", bmeta.Name, bmeta.Status)
+	case logsCmd.FullCommand():
+		sev, err := pbm.ParseSeverity(*logsSev)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		err = printJobLogs(pbmClient, *logsJobID, sev, *logsFollow)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case traceCmd.FullCommand():
+		err := printTrace(pbmClient, *traceName)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case agentsCmd.FullCommand():
+		printAgents(pbmClient, pbm.AgentFilter{Replset: *agentsReplset}, *agentsLost, pbm.Page{Skip: *agentsSkip, Limit: *agentsSize, Sort: *agentsSort})
+	case lockListCmd.FullCommand():
+		printLocks(pbmClient)
+	case lockReleaseCmd.FullCommand():
+		err := releaseLock(pbmClient, *lockReleaseRS, *lockReleaseForce)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		fmt.Printf("Lock of the replset '%s' has been released\n", *lockReleaseRS)
+	case tokenListCmd.FullCommand():
+		err := printAgentTokens(pbmClient)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case tokenCreateCmd.FullCommand():
+		err := createAgentToken(pbmClient, *tokenCreateReplset, *tokenCreateComment)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case tokenRevokeCmd.FullCommand():
+		err := revokeAgentToken(pbmClient, *tokenRevokeHash)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case queueListCmd.FullCommand():
+		err := printQueue(pbmClient)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case queuePriorityCmd.FullCommand():
+		err := setQueuePriority(pbmClient, *queuePriorityJob, *queuePriority)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case queueCancelCmd.FullCommand():
+		err := unqueueJob(pbmClient, *queueCancelJob)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case maintListCmd.FullCommand():
+		printMaintenance(pbmClient)
+	case maintOnCmd.FullCommand():
+		err := maintenanceOn(pbmClient, *maintOnNode, *maintOnReason, *maintOnWait, *maintOnTimeout)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	case maintOffCmd.FullCommand():
+		err := maintenanceOff(pbmClient, *maintOffNode)
+		if err != nil {
+			log.Fatalln("Error:", err)
 		}
 	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// parseNode splits the <replset/host:port> node name
+func parseNode(n string) (rs, node string, err error) {
+	i := strings.Index(n, "/")
+	if i <= 0 || i == len(n)-1 {
+		return "", "", errors.Errorf("invalid node %q, expected <replset/host:port>", n)
+	}
+	return n[:i], n[i+1:], nil
+}
+
+// maintenanceOn puts the node's agent into the maintenance mode. With `wait`
+// it waits for the agent to finish the operations it runs.
+func maintenanceOn(cn *pbm.PBM, n, reason string, wait bool, timeout time.Duration) error {
+	rs, node, err := parseNode(n)
+	if err != nil {
+		return err
+	}
+	stat, err := cn.GetAgentStatus(rs, node)
+	if err != nil {
+		return errors.Wrapf(err, "no agent found for %s", n)
+	}
+
+	err = cn.SetMaintenance(stat.RS, stat.Node, reason)
+	if err != nil {
+		return errors.Wrap(err, "set maintenance")
+	}
+	fmt.Printf("Node %s is in maintenance, it won't be picked for the new backups\n", n)
+
+	if !wait {
+		return nil
+	}
+	fmt.Print("Waiting for the running operations to finish")
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	tout := time.After(timeout)
+	for {
+		locks, err := cn.NodeLocks(rs, node)
+		if err != nil {
+			return errors.Wrap(err, "get locks")
+		}
+		if len(locks) == 0 {
+			fmt.Println("\nNode is drained")
+			return nil
+		}
+		select {
+		case <-tk.C:
+			fmt.Print(".")
+		case <-tout:
+			return errors.Errorf("\nnode still runs %s '%s' after %v", locks[0].Type, locks[0].BackupName, timeout)
+		}
+	}
+}
+
+func maintenanceOff(cn *pbm.PBM, n string) error {
+	rs, node, err := parseNode(n)
+	if err != nil {
+		return err
+	}
+	ok, err := cn.UnsetMaintenance(rs, node)
+	if err != nil {
+		return errors.Wrap(err, "unset maintenance")
+	}
+	if !ok {
+		return errors.Errorf("node %s isn't in maintenance", n)
+	}
+	fmt.Printf("Node %s is back from maintenance\n", n)
+	return nil
+}
+
+func printMaintenance(cn *pbm.PBM) {
+	ms, err := cn.Maintenances()
+	if err != nil {
+		log.Fatalln("Error: get maintenance:", err)
+	}
+
+	fmt.Println("Nodes in maintenance:")
+	if len(ms) == 0 {
+		fmt.Println("  <none>")
+		return
+	}
+	for _, m := range ms {
+		state := "drained"
+		locks, err := cn.NodeLocks(m.RS, m.Node)
+		if err != nil {
+			state = "unknown: " + err.Error()
+		} else if len(locks) > 0 {
+			state = fmt.Sprintf("draining, runs %s '%s'", locks[0].Type, locks[0].BackupName)
+		}
+		fmt.Printf("  %s/%s\t[%s] since %s", m.RS, m.Node, state,
+			time.Unix(int64(m.Since.T), 0).UTC().Format(time.RFC3339))
+		if m.Reason != "" {
+			fmt.Printf(", reason: %s", m.Reason)
+		}
+		fmt.Println()
+	}
+}
+
+// maintenanceReplsets returns the replsets of the backup which alive
+// agents are all in the maintenance mode, so there is no node to
+// make the backup from
+func maintenanceReplsets(cn *pbm.PBM, bcp pbm.BackupCmd, ts primitive.Timestamp) ([]string, error) {
+	stats, err := cn.AgentsStatus()
+	if err != nil {
+		return nil, errors.Wrap(err, "get agents status")
+	}
+	ms, err := cn.Maintenances()
+	if err != nil {
+		return nil, errors.Wrap(err, "get maintenance")
+	}
+	inMaint := make(map[string]bool, len(ms))
+	for _, m := range ms {
+		inMaint[m.RS+"/"+m.Node] = true
+	}
+
+	alive := make(map[string]int)
+	maint := make(map[string]int)
+	for _, s := range stats {
+		if s.IsStale(ts) || !bcp.Includes(s.RS) {
+			continue
+		}
+		alive[s.RS]++
+		if inMaint[s.RS+"/"+s.Node] {
+			maint[s.RS]++
+		}
+	}
+
+	var rss []string
+	for rs, n := range alive {
+		if maint[rs] == n {
+			rss = append(rss, rs)
+		}
+	}
+	sort.Strings(rss)
+	return rss, nil
+}
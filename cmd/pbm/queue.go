@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// liveOp returns the live operation the one with the lock header `lh`
+// can't run along with, nil if there is none. The stale locks are left
+// for the agents to deal with.
+func liveOp(cn *pbm.PBM, lh pbm.LockHeader) (*pbm.LockHeader, error) {
+	locks, err := cn.GetLocks(&pbm.LockHeader{})
+	if err != nil {
+		log.Println("get locks", err)
+	}
+
+	ts, err := cn.ClusterTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "read cluster time")
+	}
+
+	for _, l := range locks {
+		if l.Heartbeat.T+pbm.StaleFrameSec >= ts.T && !lh.Compatible(l.LockHeader) {
+			return &l.LockHeader, nil
+		}
+	}
+	return nil, nil
+}
+
+// queueJob puts the command into the queue, the agents start it once the
+// running operations are finished. The commands which need the approval
+// aren't queued since the approval is given to start them right away.
+func queueJob(cn *pbm.PBM, cmd pbm.Cmd) (int, error) {
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return 0, errors.Wrap(err, "get config")
+	}
+	if cfg.Approval.Required(cmd.Cmd) {
+		return 0, errors.Errorf("%s requires the approval and can't be queued, run it once the running operation is finished", cmd.Cmd)
+	}
+
+	qpos, err := cn.QueueJob(cmd, pbm.PriorityOnDemand)
+	return qpos, errors.Wrap(err, "queue job")
+}
+
+// printQueue prints the queued jobs in the order they will be started
+func printQueue(cn *pbm.PBM) error {
+	q, err := cn.QueuedJobs()
+	if err != nil {
+		return errors.Wrap(err, "get jobs queue")
+	}
+	if len(q) == 0 {
+		fmt.Println("No queued jobs")
+		return nil
+	}
+
+	fmt.Println("Queued jobs:")
+	for i, j := range q {
+		fmt.Printf("  %d. %s %s\t[%s, queued %s", i+1, j.Type, j.Name, j.Priority,
+			time.Unix(j.TS, 0).UTC().Format(time.RFC3339))
+		if j.NotBefore > 0 {
+			fmt.Printf(", not before %s", time.Unix(j.NotBefore, 0).UTC().Format(time.RFC3339))
+		}
+		fmt.Println("]")
+	}
+	return nil
+}
+
+// setQueuePriority changes the priority of the queued job. The jobs of
+// the higher priority are started first.
+func setQueuePriority(cn *pbm.PBM, name string, prio int) error {
+	qpos, err := cn.SetQueuePriority(name, pbm.Priority(prio))
+	if err != nil {
+		if errors.Cause(err) == mongo.ErrNoDocuments {
+			return errors.Errorf("job %s isn't queued", name)
+		}
+		return errors.Wrap(err, "set priority")
+	}
+	fmt.Printf("Job '%s' is at position %d of the queue now\n", name, qpos)
+	return nil
+}
+
+// unqueueJob removes the job from the queue
+func unqueueJob(cn *pbm.PBM, name string) error {
+	ok, err := cn.UnqueueJob(name)
+	if err != nil {
+		return errors.Wrap(err, "remove from queue")
+	}
+	if !ok {
+		return errors.Errorf("job %s isn't queued", name)
+	}
+	fmt.Printf("Job '%s' has been removed from the queue\n", name)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkRate checks the request of the command fits into the user's rate
+// limits (see the rateLimit config section). The request is accounted by
+// the agents once they get the command, the check only reports the one
+// which is to be refused before it's sent.
+func checkRate(cn *pbm.PBM, cmd pbm.Command) error {
+	cfg, err := cn.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	err = cn.CheckRequestRate(cfg.RateLimit.Requests, cmd)
+	if _, ok := err.(pbm.RateLimitError); ok {
+		return err
+	}
+	return errors.Wrap(err, "check rate limit")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// rehearse sends the command to restore the backup into a throwaway mongod
+// on one of the agents' hosts and returns the name of the rehearsal
+func rehearse(cn *pbm.PBM, bcpName, rs, checksFile string) (string, error) {
+	bcp, err := cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return "", errors.Wrap(err, "get backup data")
+	}
+	if bcp.Name != bcpName {
+		return "", errors.Errorf("backup '%s' not found", bcpName)
+	}
+	if bcp.Status != pbm.StatusDone {
+		return "", errors.Errorf("backup '%s' isn't finished successfully", bcpName)
+	}
+
+	// a sharded cluster backup is rehearsed replset by replset
+	if rs == "" {
+		rs = bcp.Replsets[0].Name
+	}
+	found := false
+	for _, r := range bcp.Replsets {
+		found = found || r.Name == rs
+	}
+	if !found {
+		return "", errors.Errorf("backup '%s' has no data of replset %s", bcpName, rs)
+	}
+
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return "", errors.Wrap(err, "get config")
+	}
+	if cfg.Rehearsal.Mongod == "" && cfg.Rehearsal.DockerImage == "" {
+		return "", errors.New("no mongod for the rehearsal. Set rehearsal.mongod or rehearsal.dockerImage with <pbm config --set>")
+	}
+
+	var checks []pbm.RehearsalCheck
+	if checksFile != "" {
+		buf, err := ioutil.ReadFile(checksFile)
+		if err != nil {
+			return "", errors.Wrap(err, "read checks file")
+		}
+		checks, err = pbm.ParseRehearsalChecks(buf)
+		if err != nil {
+			return "", errors.Wrap(err, "parse checks")
+		}
+	}
+
+	// the name is used for the container as well, so no colons
+	name := time.Now().UTC().Format("20060102150405")
+	err = cn.SendCmd(pbm.Cmd{
+		Cmd: pbm.CmdRehearse,
+		Rehearsal: pbm.RehearsalCmd{
+			Name:    name,
+			Backup:  bcpName,
+			Replset: rs,
+			Checks:  checks,
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "send command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pbm.WaitActionStart)
+	defer cancel()
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			m, err := cn.GetRehearsalMeta(name)
+			if err != nil {
+				return "", errors.Wrap(err, "get rehearsal metadata")
+			}
+			if m.Name != "" {
+				return name, nil
+			}
+		case <-ctx.Done():
+			return "", errors.New("no confirmation that the rehearsal has started. Check pbm-agent logs and the rehearsal config")
+		}
+	}
+}
+
+// waitRehearsal waits for the rehearsal to finish and
+// returns an error if it has failed or some checks haven't passed
+func waitRehearsal(cn *pbm.PBM, name string) error {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for range tk.C {
+		m, err := cn.GetRehearsalMeta(name)
+		if err != nil {
+			return errors.Wrap(err, "get rehearsal metadata")
+		}
+		if m.Status == pbm.StatusRunning {
+			continue
+		}
+
+		fmt.Println(" ", formatRehearsal(m))
+		for _, c := range m.Checks {
+			fmt.Println("   ", formatCheck(c))
+		}
+		if !m.Passed() {
+			return errors.Errorf("rehearsal %s hasn't passed", name)
+		}
+		return nil
+	}
+	return nil
+}
+
+func printRehearsalList(cn *pbm.PBM, size int64) {
+	rhs, err := cn.RehearsalsList(size)
+	if err != nil {
+		log.Fatalln("Error: unable to get rehearsals list:", err)
+	}
+	fmt.Println("Restore rehearsals:")
+	for _, r := range rhs {
+		fmt.Println(" ", formatRehearsal(&r))
+		for _, c := range r.Checks {
+			if !c.OK {
+				fmt.Println("   ", formatCheck(c))
+			}
+		}
+	}
+}
+
+func formatRehearsal(r *pbm.RehearsalMeta) string {
+	s := fmt.Sprintf("%s\t%s/%s on %s\t", r.Name, r.Backup, r.Replset, r.Node)
+	switch {
+	case r.Status == pbm.StatusRunning:
+		return s + "running"
+	case r.Status == pbm.StatusError:
+		return s + fmt.Sprintf("Failed with \"%s\"", r.Error)
+	case r.Passed():
+		return s + fmt.Sprintf("passed (%d checks)", len(r.Checks))
+	}
+	return s + "checks failed"
+}
+
+func formatCheck(c pbm.RehearsalCheckResult) string {
+	switch {
+	case c.Error != "":
+		return fmt.Sprintf("%s: error: %s", c.Name, c.Error)
+	case c.OK:
+		return fmt.Sprintf("%s: ok (%d)", c.Name, c.Count)
+	}
+	return fmt.Sprintf("%s: FAILED, count %d is out of the expected range", c.Name, c.Count)
+}
@@ -2,57 +2,267 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmbackup "github.com/percona/percona-backup-mongodb/pbm/backup"
 )
 
-func restore(cn *pbm.PBM, bcpName string) error {
+// restoreOpts are the options of the restore run by the CLI
+type restoreOpts struct {
+	// transform is the file of the transform rules
+	transform string
+	// force starts the restore even if the pre-flight checks fail
+	force bool
+	// safety takes the backup of the cluster first if the restore
+	// drops or overwrites the data
+	safety bool
+	// compression is the compression of the safety backup
+	compression pbm.CompressionType
+	// queue queues the restore if another operation is running
+	queue bool
+	// idemKey is the idempotency key of the call
+	idemKey string
+}
+
+// restore sends the restore command. The backup name and restore
+// options are taken from `rcmd`, the transform rules are read from the file.
+// The restore isn't sent if the pre-flight checks of the cluster fail
+// unless forced. If the restore needs the approval, the ID of the approval
+// request is returned. If it's queued, its position in the queue is returned.
+func restore(cn *pbm.PBM, rcmd pbm.RestoreCmd, o restoreOpts) (string, int, error) {
+	rules, err := readTransform(o.transform)
+	if err != nil {
+		return "", 0, err
+	}
+	rcmd.Transform = rules
+	// the retried call is reported before it takes another safety backup
+	if o.safety && rcmd.Destructive() {
+		rcmd.Safety = true
+	}
+	err = checkIdempotencyKey(cn, pbm.Cmd{Cmd: pbm.CmdRestore, Restore: rcmd, IdempotencyKey: o.idemKey})
+	if err != nil {
+		return "", 0, err
+	}
+
+	r, err := preflight(cn, rcmd.BackupName)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, c := range r.Checks {
+		if c.Status != pbm.PreflightOK {
+			printPreflightCheck(c)
+		}
+	}
+	if r.Failed() && !o.force {
+		return "", 0, errors.New("pre-flight checks failed, fix the cluster or run with --force")
+	}
+
+	if o.safety && rcmd.Destructive() {
+		err = safetyFirst(cn, &rcmd, o.compression)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return startRestore(cn, rcmd, o.idemKey, o.queue)
+}
+
+// safetyFirst takes the safety backup before the restore. The restore
+// which needs the approval is only marked to get it, the backup is taken
+// once the restore is approved.
+func safetyFirst(cn *pbm.PBM, rcmd *pbm.RestoreCmd, compression pbm.CompressionType) error {
+	rcmd.Safety = true
+	required, err := approvalRequired(cn, pbm.CmdRestore)
+	if err != nil {
+		return err
+	}
+	if required {
+		fmt.Println("The safety backup is taken once the restore is approved")
+		return nil
+	}
+	rcmd.SafetyBackup, err = safetyBackup(cn, rcmd.BackupName, compression)
+	return errors.Wrap(err, "safety backup")
+}
+
+// safetyLockWait is how long the restore waits for the
+// safety backup to release its locks
+const safetyLockWait = time.Minute
+
+// safetyBackup takes the backup of the cluster before the restore of
+// the backup `bcpName` and waits for it. The restore isn't started if
+// it fails, so the mistyped backup name doesn't wipe out the data.
+//
+// It's restricted to the replsets the restore touches, i.e. the subset
+// of the restored backup. It can't be narrowed down to the namespaces
+// the restore drops as the backups are always taken of the whole
+// replsets. It blocks since the restore can't be started before there
+// is something to roll back to.
+func safetyBackup(cn *pbm.PBM, bcpName string, compression pbm.CompressionType) (string, error) {
+	bcp, err := cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return "", errors.Wrap(err, "get backup data")
+	}
+	name, err := backupName(cn, "")
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Taking the safety backup '%s' before the restore...\n", name)
+	_, _, err = backup(cn, &pbm.BackupCmd{
+		Name:         name,
+		Compression:  compression,
+		IgnoreWindow: true,
+		Replsets:     bcp.Subset,
+		Tags:         map[string]string{"reason": "pre-restore", "restore-of": bcpName},
+	}, "", false, false)
+	if err != nil {
+		return "", err
+	}
+	_, err = waitJob(cn, name, 0)
+	if err != nil {
+		return "", err
+	}
+
+	// the backup is done before its locks are released
+	for start := time.Now(); ; time.Sleep(time.Second) {
+		locks, err := cn.GetLocks(&pbm.LockHeader{BackupName: name})
+		if err != nil {
+			return "", errors.Wrap(err, "get locks")
+		}
+		if len(locks) == 0 {
+			break
+		}
+		if time.Since(start) > safetyLockWait {
+			return "", errors.Errorf("backup '%s' is done but its locks aren't released in %v", name, safetyLockWait)
+		}
+	}
+	fmt.Printf("Safety backup '%s' is done, roll back with <pbm restore %s> if needed\n", name, name)
+	return name, nil
+}
+
+// preflight checks the cluster can take the restore of the backup
+func preflight(cn *pbm.PBM, bcpName string) (*pbm.PreflightReport, error) {
 	bcp, err := cn.GetBackupMeta(bcpName)
 	if err != nil {
-		return errors.Wrap(err, "get backup data")
+		return nil, errors.Wrap(err, "get backup data")
 	}
 	if bcp.Name != bcpName {
-		return errors.Errorf("backup '%s' not found", bcpName)
+		return nil, errors.Errorf("backup '%s' not found", bcpName)
+	}
+	r, err := cn.RestorePreflight(bcp)
+	return r, errors.Wrap(err, "pre-flight checks")
+}
+
+// printPreflight prints the report of the pre-flight checks
+// of the backup's restore
+func printPreflight(cn *pbm.PBM, bcpName string) error {
+	r, err := preflight(cn, bcpName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pre-flight checks of the restore of '%s':\n", bcpName)
+	for _, c := range r.Checks {
+		printPreflightCheck(c)
+	}
+	if r.Failed() {
+		return errors.New("pre-flight checks failed")
+	}
+	return nil
+}
+
+func printPreflightCheck(c pbm.PreflightCheck) {
+	fmt.Printf("  [%s] %s: %s\n", c.Status, c.Name, c.Message)
+}
+
+// startRestore checks the backup can be restored and sends the restore command
+func startRestore(cn *pbm.PBM, rcmd pbm.RestoreCmd, idemKey string, queue bool) (string, int, error) {
+	bcpName := rcmd.BackupName
+	bcp, err := cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "get backup data")
+	}
+	if bcp.Name != bcpName {
+		return "", 0, errors.Errorf("backup '%s' not found", bcpName)
 	}
 	if bcp.Status != pbm.StatusDone {
-		return errors.Errorf("backup '%s' isn't finished successfully", bcpName)
+		return "", 0, errors.Errorf("backup '%s' isn't finished successfully", bcpName)
 	}
 
-	locks, err := cn.GetLocks(&pbm.LockHeader{})
+	for _, rs := range bcp.Replsets {
+		if rs.Build != nil {
+			fmt.Printf("%s: made on %s by %s\n", rs.Name, rs.Build.Node, rs.Build)
+		}
+	}
+
+	return dispatchRestore(cn, rcmd, idemKey, queue)
+}
+
+// replayOplog sends the restore command which replays the oplog slices of the
+// backups over the data restored from the external snapshot taken at `snapshot`.
+// The slices are picked here, so the gaps are reported before the start.
+func replayOplog(cn *pbm.PBM, snapshot, until string) (*pbm.ExternalRestore, string, error) {
+	sts, err := pbm.ParseTimestamp(snapshot)
 	if err != nil {
-		log.Println("get locks", err)
+		return nil, "", errors.Wrap(err, "parse --snapshot-ts")
+	}
+	var uts primitive.Timestamp
+	if until != "" {
+		uts, err = pbm.ParseTimestamp(until)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "parse --until")
+		}
+		if primitive.CompareTimestamp(uts, sts) <= 0 {
+			return nil, "", errors.New("--until should be after --snapshot-ts")
+		}
 	}
 
-	ts, err := cn.ClusterTime()
+	ext, err := pbmbackup.PlanReplay(cn, sts, uts)
 	if err != nil {
-		return errors.Wrap(err, "read cluster time")
+		return nil, "", errors.Wrap(err, "pick oplog slices")
 	}
 
-	// Stop if there is some live operation.
-	// But in case of stale lock just move on
-	// and leave it for agents to deal with.
-	for _, l := range locks {
-		if l.Heartbeat.T+pbm.StaleFrameSec >= ts.T {
-			return errors.Errorf("another operation in progress, %s/%s", l.Type, l.BackupName)
-		}
+	approval, _, err := dispatchRestore(cn, pbm.RestoreCmd{External: ext}, "", false)
+	return ext, approval, err
+}
+
+// dispatchRestore sends the restore command unless another operation is
+// running. With `queue` it's queued then, unless it needs the approval.
+// The restore is named by the current time unless it has a name.
+func dispatchRestore(cn *pbm.PBM, rcmd pbm.RestoreCmd, idemKey string, queue bool) (string, int, error) {
+	if rcmd.Name == "" {
+		rcmd.Name = time.Now().UTC().Format(time.RFC3339Nano)
 	}
 
-	err = cn.SendCmd(pbm.Cmd{
-		Cmd: pbm.CmdRestore,
-		Restore: pbm.RestoreCmd{
-			Name:       time.Now().UTC().Format(time.RFC3339Nano),
-			BackupName: bcpName,
-		},
-	})
+	busy, err := liveOp(cn, pbm.LockHeader{Type: pbm.CmdRestore, BackupName: rcmd.Name})
+	if err != nil {
+		return "", 0, err
+	}
+	if busy != nil && !queue {
+		return "", 0, errors.Errorf("another operation in progress, %s/%s", busy.Type, busy.BackupName)
+	}
+	err = checkRate(cn, pbm.CmdRestore)
 	if err != nil {
-		return errors.Wrap(err, "send command")
+		return "", 0, err
+	}
+	cmd := pbm.Cmd{
+		Cmd:            pbm.CmdRestore,
+		Restore:        rcmd,
+		IdempotencyKey: idemKey,
+	}
+	if busy != nil {
+		qpos, err := queueJob(cn, cmd)
+		return "", qpos, err
 	}
 
-	return nil
+	span := cn.StartSpan(pbm.TraceContext{}, "dispatch restore", "", "pbm")
+	cmd.Restore.Trace = span.Context()
+	approval, err := dispatch(cn, cmd)
+	span.Finish(err)
+	return approval, 0, err
 }
 
 func printRestoreList(cn *pbm.PBM, size int64, full bool) {
@@ -65,14 +275,38 @@ func printRestoreList(cn *pbm.PBM, size int64, full bool) {
 		var rprint string
 
 		name := r.Backup
+		if r.SnapshotTS.T > 0 {
+			name = fmt.Sprintf("external snapshot at %s + oplog of %s", time.Unix(int64(r.SnapshotTS.T), 0).UTC().Format(time.RFC3339), r.Backup)
+		}
 		if full {
 			name += fmt.Sprintf(" [%s]", r.Name)
+			if r.SafetyBackup != "" {
+				name += fmt.Sprintf(" [safety backup %s]", r.SafetyBackup)
+			}
 		}
 		switch r.Status {
 		case pbm.StatusDone:
 			rprint = name
+			for _, g := range r.GridFS {
+				if !g.OK() {
+					rprint += fmt.Sprintf("\t[GridFS %s]", g)
+				}
+			}
+			for _, rs := range r.Replsets {
+				for _, g := range rs.GridFS {
+					if !g.OK() {
+						rprint += fmt.Sprintf("\t[%s GridFS %s]", rs.Name, g)
+					}
+				}
+			}
+			for _, w := range r.Warnings {
+				rprint += fmt.Sprintf("\t[WARNING %s]", w)
+			}
 		case pbm.StatusError:
 			rprint = fmt.Sprintf("%s\tFailed with \"%s\"", name, r.Error)
+			if r.SafetyBackup != "" {
+				rprint += fmt.Sprintf("\t[roll back with <pbm restore %s>]", r.SafetyBackup)
+			}
 		default:
 			rprint, err = printRestoreProgress(r, cn, full)
 			if err != nil {
@@ -118,3 +352,24 @@ func printRestoreProgress(r pbm.RestoreMeta, pbmClient *pbm.PBM, full bool) (str
 
 	return fmt.Sprintf("%s\tIn progress [%s] (Launched at %s)", name, r.Status, time.Unix(r.StartTS, 0).Format(time.RFC3339)), nil
 }
+
+// readTransform reads the transform rules from the YAML file
+func readTransform(file string) ([]pbm.TransformRule, error) {
+	if file == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "read transform rules file")
+	}
+	rules, err := pbm.ParseTransformRules(buf)
+	return rules, errors.Wrap(err, "parse transform rules")
+}
+
+// transformPlugin returns the restore plugin options if the plugin is set
+func transformPlugin(path string, args map[string]string) *pbm.TransformPlugin {
+	if path == "" {
+		return nil
+	}
+	return &pbm.TransformPlugin{Path: path, Args: args}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// deleteBackup sends the command to delete the backup or the expired
+// ones. With `queue` the delete is queued if another operation is running.
+// It returns the ID of the approval request if the delete needs the
+// approval or the position in the queue if it's queued.
+func deleteBackup(cn *pbm.PBM, name string, expired, queue bool) (string, int, error) {
+	if !expired {
+		if name == "" {
+			return "", 0, errors.New("backup name or --expired should be specified")
+		}
+
+		meta, err := cn.GetBackupMeta(name)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "get backup metadata")
+		}
+		if meta.Name == "" {
+			return "", 0, errors.Errorf("backup %s not found", name)
+		}
+		err = meta.CheckDelete(time.Now())
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	cmd := pbm.Cmd{
+		Cmd: pbm.CmdDeleteBackup,
+		Delete: pbm.DeleteBackupCmd{
+			Backup:  name,
+			Expired: expired,
+		},
+	}
+	err := checkRate(cn, pbm.CmdDeleteBackup)
+	if err != nil {
+		return "", 0, err
+	}
+	if queue {
+		busy, err := liveOp(cn, pbm.LockHeader{Type: pbm.CmdDeleteBackup})
+		if err != nil {
+			return "", 0, err
+		}
+		if busy != nil {
+			qpos, err := queueJob(cn, cmd)
+			return "", qpos, err
+		}
+	}
+	approval, err := dispatch(cn, cmd)
+	return approval, 0, err
+}
+
+// setRetention changes the backup's expiry and legal hold. Options which
+// weren't set keep the current value.
+func setRetention(cn *pbm.PBM, name string, expireIn time.Duration, expireAt string, noExpire bool, hold string) error {
+	meta, err := cn.GetBackupMeta(name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	if meta.Name == "" {
+		return errors.Errorf("backup %s not found", name)
+	}
+
+	r := pbm.RetentionCmd{
+		Backup:    name,
+		ExpireAt:  meta.ExpireAt,
+		LegalHold: meta.LegalHold,
+	}
+
+	switch {
+	case noExpire:
+		r.ExpireAt = 0
+	case expireIn > 0:
+		r.ExpireAt = time.Now().Add(expireIn).Unix()
+	case expireAt != "":
+		t, err := time.Parse(time.RFC3339, expireAt)
+		if err != nil {
+			return errors.Wrap(err, "parse expiry date")
+		}
+		r.ExpireAt = t.Unix()
+	}
+
+	switch hold {
+	case "on":
+		r.LegalHold = true
+	case "off":
+		r.LegalHold = false
+	}
+
+	err = cn.SendCmd(pbm.Cmd{
+		Cmd:       pbm.CmdBackupRetention,
+		Retention: r,
+	})
+	return errors.Wrap(err, "send command")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmbackup "github.com/percona/percona-backup-mongodb/pbm/backup"
+)
+
+// storageResync matches the storage files against the backups catalog and
+// prints the orphaned ones. With `cleanup` the orphans are removed, except
+// the files of the unknown origin. No backup can start meanwhile.
+func storageResync(cn *pbm.PBM, cleanup bool) error {
+	if cleanup {
+		lock, err := pbmbackup.LockStorage(cn)
+		if err != nil {
+			return errors.Wrap(err, "lock the storage")
+		}
+		defer func() {
+			err := lock.Release()
+			if err != nil {
+				log.Println("[ERROR] release the storage lock:", err)
+			}
+		}()
+	}
+
+	orphans, err := pbmbackup.FindOrphans(cn)
+	if err != nil {
+		return errors.Wrap(err, "find orphaned files")
+	}
+
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned files found")
+		return nil
+	}
+
+	var size int64
+	fmt.Println("Orphaned files:")
+	for _, o := range orphans {
+		size += o.Size
+		fmt.Printf("  %s\t%s\t%s\t%s", o.Name, fmtSize(o.Size), o.Modified.UTC().Format(time.RFC3339), o.Reason)
+		if o.Backup != "" {
+			fmt.Printf(" [%s]", o.Backup)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total: %d files, %s\n", len(orphans), fmtSize(size))
+
+	if !cleanup {
+		fmt.Println("Run with --cleanup to remove them")
+		return nil
+	}
+
+	n, err := pbmbackup.DeleteOrphans(cn, orphans)
+	fmt.Printf("%d files removed\n", n)
+	if err == nil && n < len(orphans) {
+		fmt.Printf("%d files of the unknown origin are left, remove them manually if they aren't needed\n", len(orphans)-n)
+	}
+	return err
+}
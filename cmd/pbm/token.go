@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// minTokenPrefix is the min length of the token hash prefix to revoke by
+const minTokenPrefix = 8
+
+// createAgentToken generates the registration token bound to the replset
+// and adds its hash to the known ones. The token itself is printed only once.
+func createAgentToken(cn *pbm.PBM, rs, comment string) error {
+	reg, err := cn.GetRegistration()
+	if err != nil {
+		return errors.Wrap(err, "get registration tokens")
+	}
+
+	token, err := pbm.NewAgentToken()
+	if err != nil {
+		return err
+	}
+	t := pbm.AgentToken{
+		Replset: rs,
+		SHA256:  pbm.HashAgentToken(token),
+		Comment: comment,
+	}
+	err = cn.AddAgentToken(t)
+	if err != nil {
+		return errors.Wrap(err, "add token")
+	}
+
+	if !reg.Required() {
+		fmt.Println("The agents are required to start with the registration token from now on")
+	}
+	fmt.Printf("Token for the replset %s (sha256 %s):\n%s\n", rs, t.SHA256[:16], token)
+	return nil
+}
+
+// revokeAgentToken removes the tokens which hash starts with the prefix.
+// The running agents aren't stopped, the token is checked on the start.
+func revokeAgentToken(cn *pbm.PBM, prefix string) error {
+	if len(prefix) < minTokenPrefix {
+		return errors.Errorf("the hash prefix has to be at least %d chars", minTokenPrefix)
+	}
+	n, err := cn.RevokeAgentToken(prefix)
+	if err != nil {
+		return errors.Wrap(err, "revoke token")
+	}
+	if n == 0 {
+		return errors.Errorf("no token with the hash %s...", prefix)
+	}
+	fmt.Printf("%d tokens revoked\n", n)
+
+	reg, err := cn.GetRegistration()
+	if err != nil {
+		return errors.Wrap(err, "get registration tokens")
+	}
+	if !reg.Required() {
+		fmt.Println("No tokens left, the agents may start without the token")
+	}
+	return nil
+}
+
+func printAgentTokens(cn *pbm.PBM) error {
+	reg, err := cn.GetRegistration()
+	if err != nil {
+		return errors.Wrap(err, "get registration tokens")
+	}
+	if !reg.Required() {
+		fmt.Println("No registration tokens, the agents may start without the token")
+		return nil
+	}
+	fmt.Println("Registration tokens:")
+	for _, t := range reg.Tokens {
+		fmt.Printf("  %s\t%s\t%s\n", t.SHA256, t.Replset, t.Comment)
+	}
+	return nil
+}
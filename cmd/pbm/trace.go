@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// printTrace prints the spans tree of the backup or restore
+// with the time each step has taken
+func printTrace(cn *pbm.PBM, name string) error {
+	bmeta, err := cn.GetBackupMeta(name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	traceID := bmeta.TraceID
+	if bmeta.Name == "" {
+		rmeta, err := cn.GetRestoreMeta(name)
+		if err != nil {
+			return errors.Wrap(err, "get restore metadata")
+		}
+		if rmeta.Name == "" {
+			return errors.Errorf("no backup or restore %s found", name)
+		}
+		traceID = rmeta.TraceID
+	}
+	if traceID == "" {
+		return errors.Errorf("%s has no trace", name)
+	}
+
+	spans, err := cn.GetTrace(traceID)
+	if err != nil {
+		return errors.Wrap(err, "get trace")
+	}
+
+	children := make(map[string][]*pbm.Span)
+	ids := make(map[string]struct{}, len(spans))
+	for _, s := range spans {
+		ids[s.SpanID] = struct{}{}
+	}
+	var roots []*pbm.Span
+	for _, s := range spans {
+		if _, ok := ids[s.ParentID]; !ok {
+			roots = append(roots, s)
+			continue
+		}
+		children[s.ParentID] = append(children[s.ParentID], s)
+	}
+
+	fmt.Printf("Trace %s\n", traceID)
+	var walk func(s *pbm.Span, depth int)
+	walk = func(s *pbm.Span, depth int) {
+		fmt.Println(strings.Repeat("  ", depth) + spanString(s))
+		for _, c := range children[s.SpanID] {
+			walk(c, depth+1)
+		}
+	}
+	for _, s := range roots {
+		walk(s, 1)
+	}
+	return nil
+}
+
+func spanString(s *pbm.Span) string {
+	str := s.Name
+	if s.Replset != "" {
+		str += fmt.Sprintf(" [%s/%s]", s.Replset, s.Node)
+	}
+	str += fmt.Sprintf("\t%s", s.Duration().Round(time.Millisecond))
+
+	if len(s.Attrs) > 0 {
+		var attrs []string
+		for k, v := range s.Attrs {
+			attrs = append(attrs, k+"="+v)
+		}
+		sort.Strings(attrs)
+		str += " (" + strings.Join(attrs, " ") + ")"
+	}
+	if s.Error != "" {
+		str += "\tError: " + s.Error
+	}
+	return str
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// verify sends the command to verify the backup and returns the name of the
+// verification. With `queue` the verification is queued if another operation
+// is running, the position in the queue is returned then.
+func verify(cn *pbm.PBM, bcpName string, rehearse bool, checksFile string, queue bool) (string, int, error) {
+	bcp, err := cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "get backup data")
+	}
+	if bcp.Name != bcpName {
+		return "", 0, errors.Errorf("backup '%s' not found", bcpName)
+	}
+	if bcp.Status != pbm.StatusDone {
+		return "", 0, errors.Errorf("backup '%s' isn't finished successfully", bcpName)
+	}
+
+	var checks []pbm.RehearsalCheck
+	if checksFile != "" {
+		if !rehearse {
+			return "", 0, errors.New("--checks requires --rehearse")
+		}
+		buf, err := ioutil.ReadFile(checksFile)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "read checks file")
+		}
+		checks, err = pbm.ParseRehearsalChecks(buf)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "parse checks")
+		}
+	}
+
+	name := "verify-" + time.Now().UTC().Format("20060102150405")
+	cmd := pbm.Cmd{
+		Cmd: pbm.CmdVerify,
+		Verify: pbm.VerifyCmd{
+			Name:     name,
+			Backup:   bcpName,
+			Rehearse: rehearse,
+			Checks:   checks,
+		},
+	}
+	err = checkRate(cn, pbm.CmdVerify)
+	if err != nil {
+		return "", 0, err
+	}
+	if queue {
+		busy, err := liveOp(cn, pbm.LockHeader{Type: pbm.CmdVerify})
+		if err != nil {
+			return "", 0, err
+		}
+		if busy != nil {
+			qpos, err := queueJob(cn, cmd)
+			return name, qpos, err
+		}
+	}
+	err = cn.SendCmd(cmd)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "send command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pbm.WaitActionStart)
+	defer cancel()
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			m, err := cn.GetVerifyMeta(name)
+			if err != nil {
+				return "", 0, errors.Wrap(err, "get verification metadata")
+			}
+			if m.Name != "" {
+				return name, 0, nil
+			}
+		case <-ctx.Done():
+			return "", 0, errors.New("no confirmation that the verification has started. Check pbm-agent logs")
+		}
+	}
+}
+
+// waitVerify waits for the verification to finish and
+// returns an error if it has failed
+func waitVerify(cn *pbm.PBM, name string) error {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for range tk.C {
+		m, err := cn.GetVerifyMeta(name)
+		if err != nil {
+			return errors.Wrap(err, "get verification metadata")
+		}
+		if m.Status == pbm.StatusRunning {
+			continue
+		}
+
+		fmt.Println(" ", formatVerify(m))
+		if m.Status != pbm.StatusDone {
+			return errors.Errorf("verification %s has failed", name)
+		}
+		return nil
+	}
+	return nil
+}
+
+func printVerifyList(cn *pbm.PBM, size int64) {
+	vs, err := cn.VerificationsList(size, false)
+	if err != nil {
+		log.Fatalln("Error: unable to get verifications list:", err)
+	}
+	fmt.Println("Backup verifications:")
+	for _, v := range vs {
+		fmt.Println(" ", formatVerify(&v))
+	}
+}
+
+func formatVerify(v *pbm.VerifyMeta) string {
+	s := fmt.Sprintf("%s\t%s on %s\t", v.Name, v.Backup, v.Node)
+	if v.Scheduled {
+		s += "[scheduled] "
+	}
+	switch v.Status {
+	case pbm.StatusRunning:
+		return s + "running"
+	case pbm.StatusError:
+		return s + fmt.Sprintf("Failed with \"%s\"", v.Error)
+	}
+	s += fmt.Sprintf("ok (%d files, %d documents", v.Files, v.Docs)
+	if len(v.Rehearsals) > 0 {
+		s += fmt.Sprintf(", %d rehearsals", len(v.Rehearsals))
+	}
+	return s + ")"
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	pbmbackup "github.com/percona/percona-backup-mongodb/pbm/backup"
+)
+
+// wizardBackups is the number of the latest backups the wizard offers
+const wizardBackups = 20
+
+// wizard reads the user's answers
+type wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask prints the question and returns the answer, `def` if it's empty
+func (w *wizard) ask(q, def string) (string, error) {
+	if def != "" {
+		q += " [" + def + "]"
+	}
+	fmt.Fprint(w.out, q+": ")
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", errors.Wrap(err, "read answer")
+		}
+		return "", errors.New("no answer, aborted")
+	}
+	a := strings.TrimSpace(w.in.Text())
+	if a == "" {
+		return def, nil
+	}
+	return a, nil
+}
+
+func (w *wizard) yes(q string) (bool, error) {
+	a, err := w.ask(q+" (y/N)", "")
+	return strings.EqualFold(a, "y") || strings.EqualFold(a, "yes"), err
+}
+
+// restoreWizard walks the user through the restore: the backup, the
+// namespaces and the mode are picked interactively, the pre-flight report
+// and the data about to be dropped or overwritten are shown and the
+// restore starts only after the backup name is typed in to confirm it.
+// If the restore needs the approval, the ID of the approval request
+// is returned. The safety backup is made with the given compression.
+func restoreWizard(cn *pbm.PBM, in io.Reader, out io.Writer, compression pbm.CompressionType) (string, string, error) {
+	w := &wizard{in: bufio.NewScanner(in), out: out}
+
+	bcp, err := w.pickBackup(cn)
+	if err != nil {
+		return "", "", err
+	}
+	rcmd := pbm.RestoreCmd{BackupName: bcp.Name}
+
+	selected, rules, err := w.pickNamespaces(bcp)
+	if err != nil {
+		return "", "", err
+	}
+	rcmd.Transform = rules
+
+	im, err := cn.GetIsMaster()
+	if err != nil {
+		return "", "", errors.Wrap(err, "get isMaster")
+	}
+	target := im.SetName
+	if im.IsSharded() {
+		shards, err := cn.GetShards()
+		if err != nil {
+			return "", "", errors.Wrap(err, "get shards")
+		}
+		target = "sharded cluster of"
+		for _, s := range shards {
+			target += " " + s.ID
+		}
+	}
+	fmt.Fprintf(out, "\nTarget: %s\n", target)
+	mode, err := w.ask("Restore mode: drop (drop and recreate the collections), merge (insert skipping the existing _id) or replace (upsert by _id)", string(pbm.RestoreDrop))
+	if err != nil {
+		return "", "", err
+	}
+	rcmd.Mode, err = pbm.ParseRestoreMode(mode)
+	if err != nil {
+		return "", "", err
+	}
+
+	r, err := cn.RestorePreflight(bcp)
+	if err != nil {
+		return "", "", errors.Wrap(err, "pre-flight checks")
+	}
+	fmt.Fprintln(out, "\nPre-flight checks:")
+	for _, c := range r.Checks {
+		fmt.Fprintf(out, "  [%s] %s: %s\n", c.Status, c.Name, c.Message)
+	}
+
+	err = w.printSummary(cn, im, rcmd, selected)
+	if err != nil {
+		return "", "", err
+	}
+
+	if r.Failed() {
+		ok, err := w.yes("\nPre-flight checks failed. Start the restore anyway?")
+		if err != nil || !ok {
+			return "", "", errors.New("aborted")
+		}
+	}
+	safety := false
+	if rcmd.Destructive() {
+		safety, err = w.yes("\nTake the safety backup of the cluster before the restore?")
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	name, err := w.ask(fmt.Sprintf("\nType the backup name '%s' to start the restore", bcp.Name), "")
+	if err != nil {
+		return "", "", err
+	}
+	if name != bcp.Name {
+		return "", "", errors.New("the backup name doesn't match, aborted")
+	}
+
+	if safety {
+		err = safetyFirst(cn, &rcmd, compression)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	approval, _, err := startRestore(cn, rcmd, "", false)
+	return bcp.Name, approval, err
+}
+
+// pickBackup lists the latest successful backups, warns if some of the
+// backups can't be restored and returns the one picked by its number or name
+func (w *wizard) pickBackup(cn *pbm.PBM) (*pbm.BackupMeta, error) {
+	all, err := cn.FindBackups(pbm.BackupFilter{Status: pbm.StatusDone}, wizardBackups)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups list")
+	}
+	var bcps []pbm.BackupMeta
+	for _, b := range all {
+		if b.Type != pbm.BackupTypeOplog {
+			bcps = append(bcps, b)
+		}
+	}
+	if len(bcps) == 0 {
+		return nil, errors.New("no backups to restore")
+	}
+
+	fmt.Fprintln(w.out, "Backups:")
+	for i, b := range bcps {
+		var size int64
+		for _, rs := range b.Replsets {
+			for _, c := range rs.Collections {
+				size += c.Size
+			}
+		}
+		s := fmt.Sprintf("%3d) %s\tconsistent at %s\t%s", i+1, b.Name, fmtTS(b.LastWriteTS), fmtSize(size))
+		if b.Type != "" && b.Type != pbm.BackupTypeFull {
+			s += fmt.Sprintf("\t[%s]", b.Type)
+		}
+		if len(b.Tags) > 0 {
+			s += fmt.Sprintf("\t[tags %s]", formatTags(b.Tags))
+		}
+		fmt.Fprintln(w.out, s)
+	}
+	pts, err := pbmbackup.GetRestorablePoints(cn)
+	if err != nil {
+		fmt.Fprintf(w.out, "[WARNING] get restorable points: %v\n", err)
+	} else if pts.Broken > 0 {
+		fmt.Fprintf(w.out, "[WARNING] %d backups can't be restored, see <pbm validate-chain>\n", pts.Broken)
+	}
+
+	for {
+		a, err := w.ask("\nBackup to restore (number or name)", "1")
+		if err != nil {
+			return nil, err
+		}
+		if n, err := strconv.Atoi(a); err == nil && n >= 1 && n <= len(bcps) {
+			return &bcps[n-1], nil
+		}
+		for i := range bcps {
+			if bcps[i].Name == a {
+				return &bcps[i], nil
+			}
+		}
+		fmt.Fprintf(w.out, "No backup %q in the list\n", a)
+	}
+}
+
+// pickNamespaces shows the backup's databases and returns the namespaces
+// picked by the patterns along with the rules which skip the rest. The
+// internal databases are always restored.
+func (w *wizard) pickNamespaces(bcp *pbm.BackupMeta) ([]string, []pbm.TransformRule, error) {
+	type dbStat struct {
+		colls int
+		size  int64
+	}
+	dbs := make(map[string]*dbStat)
+	seen := make(map[string]bool)
+	var nss []string
+	for _, rs := range bcp.Replsets {
+		for _, c := range rs.Collections {
+			db := strings.SplitN(c.NS, ".", 2)[0]
+			if db == "admin" || db == "config" || db == "local" || c.View {
+				continue
+			}
+			if dbs[db] == nil {
+				dbs[db] = &dbStat{}
+			}
+			// the sharded collection is in the backup of each shard
+			if !seen[c.NS] {
+				seen[c.NS] = true
+				nss = append(nss, c.NS)
+				dbs[db].colls++
+			}
+			dbs[db].size += c.Size
+		}
+	}
+	names := make([]string, 0, len(dbs))
+	for db := range dbs {
+		names = append(names, db)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w.out, "\nDatabases of '%s':\n", bcp.Name)
+	for _, db := range names {
+		fmt.Fprintf(w.out, "    %s\t%d collections\t%s\n", db, dbs[db].colls, fmtSize(dbs[db].size))
+	}
+
+	for {
+		a, err := w.ask("Namespaces to restore, comma separated patterns (e.g. db.*,db2.coll)", "all")
+		if err != nil {
+			return nil, nil, err
+		}
+		if a == "all" {
+			return nss, nil, nil
+		}
+
+		var pats []string
+		bad := false
+		for _, p := range strings.Split(a, ",") {
+			p = strings.TrimSpace(p)
+			if _, err := path.Match(p, ""); err != nil || p == "" {
+				fmt.Fprintf(w.out, "Bad pattern %q\n", p)
+				bad = true
+			}
+			pats = append(pats, p)
+		}
+		if bad {
+			continue
+		}
+
+		var selected []string
+		var rules []pbm.TransformRule
+		for _, ns := range nss {
+			if matchAny(pats, ns) {
+				selected = append(selected, ns)
+			} else {
+				rules = append(rules, pbm.TransformRule{NS: ns, Drop: true})
+			}
+		}
+		if len(selected) == 0 {
+			fmt.Fprintln(w.out, "No namespaces of the backup match")
+			continue
+		}
+		return selected, rules, nil
+	}
+}
+
+// printSummary prints what happens to the data already on the cluster
+func (w *wizard) printSummary(cn *pbm.PBM, im *pbm.IsMaster, rcmd pbm.RestoreCmd, selected []string) error {
+	have, err := cn.ClusterDBs(im)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(have))
+	for _, db := range have {
+		exists[db] = true
+	}
+
+	action := map[pbm.RestoreMode]string{
+		pbm.RestoreDrop:    "DROPPED and recreated from the backup",
+		pbm.RestoreMerge:   "merged, the existing documents are kept",
+		pbm.RestoreReplace: "OVERWRITTEN by the documents of the backup with the same _id",
+	}
+	fmt.Fprintf(w.out, "\nSummary: restore %d namespaces of '%s'\n", len(selected), rcmd.BackupName)
+	n := 0
+	for _, ns := range selected {
+		db := strings.SplitN(ns, ".", 2)[0]
+		if !exists[db] {
+			continue
+		}
+		n++
+		fmt.Fprintf(w.out, "    %s is %s\n", ns, action[rcmd.NSMode(ns)])
+	}
+	if n == 0 {
+		fmt.Fprintln(w.out, "    none of them is in the databases already on the cluster")
+	}
+	if len(rcmd.Transform) > 0 {
+		fmt.Fprintf(w.out, "    %d namespaces of the backup are skipped\n", len(rcmd.Transform))
+	}
+	return nil
+}
+
+func matchAny(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+
+# adds the shards listed in SHARDS, e.g. "rs1/rs101:27017 rs2/rs201:27017"
+for s in $SHARDS; do
+    mongo -u dba -p test1234 admin --eval "sh.addShard(\"$s\")"
+done
@@ -7,23 +7,28 @@ sleep 25
 MONGO_USER="dba"
 MONGO_PASS="test1234"
 CONFIGSVR=${CONFIGSVR:-"false"}
+MEMBERS=${MEMBERS:-3}
 
-mongo <<EOF
+# the standalone node has no replset to initiate
+if [ -n "$REPLSET_NAME" ]; then
+    hosts=""
+    for i in $(seq 1 $MEMBERS); do
+        hosts="${hosts}{ _id: $((i-1)), host: \"${REPLSET_NAME}0${i}:27017\" },"
+    done
+
+    mongo <<EOF
 rs.initiate(
     {
         _id: '$REPLSET_NAME',
         configsvr: $CONFIGSVR,
         version: 1,
-        members: [
-            { _id: 0, host: "${REPLSET_NAME}01:27017" },
-            { _id: 1, host: "${REPLSET_NAME}02:27017" },
-            { _id: 2, host: "${REPLSET_NAME}03:27017" }
-        ]
+        members: [ ${hosts%,} ]
     }
 )
 EOF
 
-sleep 15
+    sleep 15
+fi
 
 mongo <<EOF
 db.getSiblingDB("admin").createUser({ user: "${MONGO_USER}", pwd: "${MONGO_PASS}", roles: [ "root", "userAdminAnyDatabase", "clusterAdmin" ] })
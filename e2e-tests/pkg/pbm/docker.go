@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -103,6 +104,22 @@ func (d *Docker) RestartAgents(rsName string) error {
 	return nil
 }
 
+// SetFaults sets the fault injection rules for the agents of the given
+// replicaset. The agents have to be built with the "faults" tag.
+func (d *Docker) SetFaults(rsName string, rules ...string) error {
+	return d.RunOnReplSet(rsName, time.Second*5,
+		"sh", "-c", "echo '"+strings.Join(rules, ";")+"' > "+faultsFile,
+	)
+}
+
+// ClearFaults removes the fault injection rules of the given replicaset
+func (d *Docker) ClearFaults(rsName string) error {
+	return d.RunOnReplSet(rsName, time.Second*5, "rm", "-f", faultsFile)
+}
+
+// faultsFile is the PBM_FAULTS_FILE of the agents containers
+const faultsFile = "/tmp/pbm-faults"
+
 func (d *Docker) RunOnReplSet(rsName string, wait time.Duration, cmd ...string) error {
 	fltr := filters.NewArgs()
 	fltr.Add("label", "com.percona.pbm.agent.rs="+rsName)
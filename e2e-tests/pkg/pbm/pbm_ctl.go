@@ -123,8 +123,8 @@ func (c *Ctl) CheckRestore(bcpName string, waitFor time.Duration) error {
 	}
 }
 
-func (c *Ctl) Restore(bcpName string) error {
-	_, err := c.RunCmd("pbm", "restore", bcpName)
+func (c *Ctl) Restore(bcpName string, opts ...string) error {
+	_, err := c.RunCmd(append([]string{"pbm", "restore", bcpName}, opts...)...)
 	return err
 }
 
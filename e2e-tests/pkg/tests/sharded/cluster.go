@@ -19,27 +19,44 @@ type Cluster struct {
 	mongos   *pbm.Mongo
 	shards   map[string]*pbm.Mongo
 	mongopbm *pbm.MongoPBM
+	cfgRS    string
+
+	standalone bool
 }
 
+// ClusterConf is the connections to the test cluster. Mongos and Configsrv
+// are empty if the cluster isn't sharded, the only replset (or standalone)
+// from Shards is used instead.
 type ClusterConf struct {
 	Configsrv       string
 	Mongos          string
 	Shards          map[string]string
 	DockerSocket    string
 	ConfigsrvRsName string
+	Standalone      bool
 }
 
 func New(cfg ClusterConf) *Cluster {
+	if len(cfg.Shards) > 1 && cfg.ConfigsrvRsName == "" {
+		log.Fatalln("more than one replset needs the sharded cluster")
+	}
+
 	ctx := context.Background()
 	c := &Cluster{
-		ctx:      ctx,
-		mongos:   mgoConn(ctx, cfg.Mongos),
-		mongopbm: pbmConn(ctx, cfg.Configsrv),
-		shards:   make(map[string]*pbm.Mongo),
+		ctx:    ctx,
+		shards: make(map[string]*pbm.Mongo),
+		cfgRS:  cfg.ConfigsrvRsName,
+
+		standalone: cfg.Standalone,
 	}
 	for name, uri := range cfg.Shards {
 		c.shards[name] = mgoConn(ctx, uri)
+		if cfg.Mongos == "" {
+			cfg.Mongos, cfg.Configsrv = uri, uri
+		}
 	}
+	c.mongos = mgoConn(ctx, cfg.Mongos)
+	c.mongopbm = pbmConn(ctx, cfg.Configsrv)
 
 	pbmObj, err := pbm.NewCtl(c.ctx, cfg.DockerSocket)
 	if err != nil {
@@ -77,6 +94,11 @@ func (c *Cluster) ApplyConfig(file string) {
 	}
 }
 
+// IsSharded returns true if the cluster has the config servers and mongos
+func (c *Cluster) IsSharded() bool {
+	return c.cfgRS != ""
+}
+
 func (c *Cluster) ServerVersion() string {
 	v, err := c.mongos.ServerVersion()
 	if err != nil {
@@ -94,9 +116,9 @@ func (c *Cluster) DeleteBallast() {
 	log.Printf("deleted %d documents", deleted)
 }
 
-func (c *Cluster) Restore(bcpName string) {
-	log.Println("restoring the backup")
-	err := c.pbm.Restore(bcpName)
+func (c *Cluster) Restore(bcpName string, opts ...string) {
+	log.Println("restoring the backup", opts)
+	err := c.pbm.Restore(bcpName, opts...)
 	if err != nil {
 		log.Fatalln("restoring the backup:", err)
 	}
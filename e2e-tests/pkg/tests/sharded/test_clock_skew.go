@@ -10,7 +10,10 @@ func (c *Cluster) ClockSkew() {
 	timeShifts := []string{
 		"+90m", "-195m", "+2d", "-7h", "+11m", "+42d", "-13h",
 	}
-	rsNames := []string{"cfg"}
+	var rsNames []string
+	if c.IsSharded() {
+		rsNames = append(rsNames, c.cfgRS)
+	}
 	for s := range c.shards {
 		rsNames = append(rsNames, s)
 	}
@@ -30,6 +33,9 @@ func (c *Cluster) ClockSkew() {
 		c.BackupAndRestore()
 		log.Println("[DONE] Basic Backup & Restore / ClockSkew", rs, shift)
 
+		if c.standalone {
+			continue
+		}
 		log.Println("[START] Backup Data Bounds Check / ClockSkew", rs, shift)
 		c.BackupBoundsCheck()
 		log.Println("[DONE] Backup Data Bounds Check / ClockSkew", rs, shift)
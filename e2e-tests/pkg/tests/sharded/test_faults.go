@@ -0,0 +1,58 @@
+package sharded
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// StorageWriteFault fails the storage write of one replset during
+// the backup. The backup should fail and the next one, made after
+// the fault is gone, should be restored fine.
+func (c *Cluster) StorageWriteFault() {
+	rs := ""
+	for name := range c.shards {
+		rs = name
+		break
+	}
+	if rs == "" {
+		log.Fatalln("no shards in cluster")
+	}
+
+	checkData := c.DataChecker()
+
+	log.Println("Set the storage write fault on agents", rs)
+	err := c.docker.SetFaults(rs, "storage.write:"+rs+"@1024")
+	if err != nil {
+		log.Fatalf("ERROR: set faults on %s: %v", rs, err)
+	}
+
+	bcpName := c.Backup()
+	err = c.pbm.CheckBackup(bcpName, time.Minute*25)
+	if err == nil || !strings.Contains(err.Error(), "injected fault") {
+		log.Fatalf("ERROR: backup %s expected to fail with the injected fault, got: %v", bcpName, err)
+	}
+
+	meta, err := c.mongopbm.GetBackupMeta(bcpName)
+	if err != nil {
+		log.Fatalf("ERROR: get metadata for the backup %s: %v", bcpName, err)
+	}
+	if meta.Status != pbm.StatusError {
+		log.Fatalf("ERROR: wrong state of the backup %s. Expect: %s. Got: %s", bcpName, pbm.StatusError, meta.Status)
+	}
+	log.Printf("Backup status %s/%s\n", meta.Status, meta.Error)
+
+	log.Println("Clear the faults on agents", rs)
+	err = c.docker.ClearFaults(rs)
+	if err != nil {
+		log.Fatalf("ERROR: clear faults on %s: %v", rs, err)
+	}
+
+	bcpName = c.Backup()
+	c.BackupWaitDone(bcpName)
+	c.DeleteBallast()
+	c.Restore(bcpName)
+	checkData()
+}
@@ -0,0 +1,102 @@
+package sharded
+
+import (
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	pbmt "github.com/percona/percona-backup-mongodb/pbm"
+)
+
+const (
+	modesDB   = "test"
+	modesColl = "modes"
+	modesDocs = 100
+)
+
+// RestoreModes restores the backup over the changed collection in the
+// merge and the replace modes. The collection is restored in place so
+// it keeps its UUID and the documents written after the backup.
+func (c *Cluster) RestoreModes() {
+	for _, mode := range []pbmt.RestoreMode{pbmt.RestoreMerge, pbmt.RestoreReplace} {
+		c.restoreMode(mode)
+	}
+}
+
+func (c *Cluster) restoreMode(mode pbmt.RestoreMode) {
+	coll := c.mongos.Conn().Database(modesDB).Collection(modesColl)
+
+	log.Println("generating", modesColl, "data")
+	err := coll.Drop(c.ctx)
+	if err != nil {
+		log.Fatalln("drop collection:", err)
+	}
+	docs := make([]interface{}, 0, modesDocs)
+	for i := 0; i < modesDocs; i++ {
+		docs = append(docs, bson.D{{"idx", i}, {"changed", -1}})
+	}
+	_, err = coll.InsertMany(c.ctx, docs)
+	if err != nil {
+		log.Fatalln("insert documents:", err)
+	}
+
+	bcpName := c.Backup()
+	c.BackupWaitDone(bcpName)
+
+	// changed [0,10), deleted [10,20) and new [100,110) documents
+	_, err = coll.UpdateMany(c.ctx, bson.D{{"idx", bson.D{{"$lt", 10}}}}, bson.D{{"$set", bson.D{{"changed", 1}}}})
+	if err != nil {
+		log.Fatalln("update documents:", err)
+	}
+	_, err = coll.DeleteMany(c.ctx, bson.D{{"idx", bson.D{{"$gte", 10}, {"$lt", 20}}}})
+	if err != nil {
+		log.Fatalln("delete documents:", err)
+	}
+	docs = docs[:0]
+	for i := modesDocs; i < modesDocs+10; i++ {
+		docs = append(docs, bson.D{{"idx", i}, {"changed", 1}})
+	}
+	_, err = coll.InsertMany(c.ctx, docs)
+	if err != nil {
+		log.Fatalln("insert documents:", err)
+	}
+	uuid := c.collUUID(modesColl)
+
+	c.Restore(bcpName, "--mode", string(mode))
+
+	if u := c.collUUID(modesColl); !u.Equal(uuid) {
+		log.Fatalf("%s: collection UUID changed: before %v now %v", mode, uuid, u)
+	}
+
+	// merge keeps the changed documents, replace brings them back
+	wantChanged := int64(20)
+	if mode == pbmt.RestoreReplace {
+		wantChanged = 10
+	}
+	c.checkModesCount(mode, bson.D{}, modesDocs+10)
+	c.checkModesCount(mode, bson.D{{"idx", bson.D{{"$gte", 10}, {"$lt", 20}}}}, 10)
+	c.checkModesCount(mode, bson.D{{"changed", 1}}, wantChanged)
+}
+
+func (c *Cluster) checkModesCount(mode pbmt.RestoreMode, filter bson.D, want int64) {
+	n, err := c.mongos.Conn().Database(modesDB).Collection(modesColl).CountDocuments(c.ctx, filter)
+	if err != nil {
+		log.Fatalln("count documents:", err)
+	}
+	if n != want {
+		log.Fatalf("%s: %v documents: want %d, got %d", mode, filter, want, n)
+	}
+}
+
+func (c *Cluster) collUUID(name string) bson.RawValue {
+	cur, err := c.mongos.Conn().Database(modesDB).ListCollections(c.ctx, bson.D{{"name", name}})
+	if err != nil {
+		log.Fatalln("list collections:", err)
+	}
+	defer cur.Close(c.ctx)
+
+	if !cur.Next(c.ctx) {
+		log.Fatalf("no collection %s: %v", name, cur.Err())
+	}
+	return cur.Current.Lookup("info", "uuid")
+}
@@ -0,0 +1,235 @@
+package sharded
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Topology is the spec of the test cluster. The hosts are named after
+// the replsets: <rs>01, <rs>02... for the members of the replset <rs>,
+// the replsets are rs1, rs2... and the config server replset is cfg.
+type Topology struct {
+	// Replsets is the number of the replsets, i.e. the shards
+	// if the cluster is sharded
+	Replsets int `yaml:"replsets"`
+	// Members is the number of the members in each replset
+	Members int `yaml:"members"`
+	// Sharded makes the cluster with the config servers and mongos
+	Sharded bool `yaml:"sharded"`
+	// Standalone makes the single node with no replset
+	Standalone bool `yaml:"standalone"`
+}
+
+// DefaultTopology is the 2-shards cluster with 3 members replsets
+var DefaultTopology = Topology{
+	Replsets: 2,
+	Members:  3,
+	Sharded:  true,
+}
+
+const (
+	mongoURI = "mongodb://dba:test1234@%s:27017/"
+	cfgRS    = "cfg"
+)
+
+// ReadTopology reads the topology spec from the yaml file
+func ReadTopology(file string) (Topology, error) {
+	t := Topology{}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return t, errors.Wrap(err, "read file")
+	}
+	err = yaml.UnmarshalStrict(buf, &t)
+	if err != nil {
+		return t, errors.Wrap(err, "unmarshal yaml")
+	}
+	return t, t.Check()
+}
+
+// Check returns an error if the topology can't be built
+func (t Topology) Check() error {
+	switch {
+	case t.Standalone && (t.Sharded || t.Replsets > 1 || t.Members > 1):
+		return errors.New("standalone is a single node")
+	case !t.Standalone && (t.Replsets < 1 || t.Members < 1):
+		return errors.New("at least one replset with one member is needed")
+	case !t.Sharded && t.Replsets > 1:
+		return errors.New("more than one replset needs the sharded cluster")
+	case t.Members > 9:
+		return errors.New("up to 9 members in the replset")
+	}
+	return nil
+}
+
+// RSNames returns the names of the replsets except the config servers
+func (t Topology) RSNames() []string {
+	if t.Standalone {
+		return []string{"rs1"}
+	}
+	names := make([]string, t.Replsets)
+	for i := range names {
+		names[i] = fmt.Sprintf("rs%d", i+1)
+	}
+	return names
+}
+
+func (t Topology) members(rs string) []string {
+	n := t.Members
+	if t.Standalone {
+		n = 1
+	}
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("%s%02d", rs, i+1)
+	}
+	return hosts
+}
+
+// Conf returns the connections of the cluster. The data is checked via
+// the replset itself if the cluster isn't sharded.
+func (t Topology) Conf(dockerSocket string) ClusterConf {
+	c := ClusterConf{
+		Shards:       make(map[string]string),
+		DockerSocket: dockerSocket,
+		Standalone:   t.Standalone,
+	}
+	for _, rs := range t.RSNames() {
+		c.Shards[rs] = fmt.Sprintf(mongoURI, t.members(rs)[0])
+	}
+	if t.Sharded {
+		c.Mongos = fmt.Sprintf(mongoURI, "mongos")
+		c.Configsrv = fmt.Sprintf(mongoURI, t.members(cfgRS)[0])
+		c.ConfigsrvRsName = cfgRS
+	}
+	return c
+}
+
+type composeRS struct {
+	Name      string
+	Hosts     []string
+	Configsvr bool
+	Shardsvr  bool
+}
+
+// Compose writes the docker-compose file which spins up the topology
+func (t Topology) Compose(w io.Writer) error {
+	err := t.Check()
+	if err != nil {
+		return err
+	}
+
+	var rss []composeRS
+	if t.Sharded {
+		rss = append(rss, composeRS{Name: cfgRS, Hosts: t.members(cfgRS), Configsvr: true})
+	}
+	for _, rs := range t.RSNames() {
+		rss = append(rss, composeRS{Name: rs, Hosts: t.members(rs), Shardsvr: t.Sharded})
+	}
+
+	return composeTmpl.Execute(w, struct {
+		Topology
+		RS []composeRS
+	}{t, rss})
+}
+
+var composeTmpl = template.Must(template.New("compose").Parse(`version: "3"
+services:
+  tests:
+    build:
+      dockerfile: ./e2e-tests/Dockerfile
+      context: ../..
+    command: pbm-test -topology /etc/pbm/topology.yaml
+    volumes:
+      - /var/run/docker.sock:/var/run/docker.sock
+      - ./conf/aws.yaml:/etc/pbm/aws.yaml
+      - ./conf/gcs.yaml:/etc/pbm/gcs.yaml
+      - ./conf/minio.yaml:/etc/pbm/minio.yaml
+      - ./topology.yaml:/etc/pbm/topology.yaml
+    depends_on:
+{{- range .RS}}{{range .Hosts}}
+      - {{.}}{{end}}{{end}}
+{{range $rs := .RS}}{{range $i, $h := .Hosts}}
+  {{$h}}:
+    image: percona/percona-server-mongodb:${MONGODB_VERSION:-3.6}
+    hostname: {{$h}}
+{{- if eq $i 0}}
+    environment:
+{{- if not $.Standalone}}
+      - REPLSET_NAME={{$rs.Name}}
+{{- end}}
+      - MEMBERS={{len $rs.Hosts}}
+{{- if $rs.Configsvr}}
+      - CONFIGSVR=true
+{{- end}}
+{{- end}}
+    command: mongod{{if $rs.Configsvr}} --configsvr --dbpath /data/db{{end}}{{if not $.Standalone}} --replSet {{$rs.Name}}{{end}}{{if $rs.Shardsvr}} --shardsvr{{end}} --bind_ip_all --port 27017 --keyFile /opt/keyFile --storageEngine wiredTiger --wiredTigerCacheSizeGB 1
+    volumes:
+{{- if eq $i 0}}
+      - ./scripts/start.sh:/opt/start.sh
+{{- end}}
+      - ./keyFile:/opt/keyFile
+  agent-{{$h}}:
+    container_name: "pbmagent_{{$h}}"
+    labels:
+      - "com.percona.pbm.app=agent"
+      - "com.percona.pbm.agent.rs={{$rs.Name}}"
+    environment:
+      - "PBM_MONGODB_URI=mongodb://dba:test1234@{{$h}}:27017"
+    build:
+      labels:
+        - "com.percona.pbm.app=agent"
+      dockerfile: ./e2e-tests/docker/pbm-agent/Dockerfile
+      context: ../..
+    command: pbm-agent
+    cap_add:
+      - NET_ADMIN
+    depends_on:
+      - {{$h}}
+{{- end}}{{end}}
+{{- if .Sharded}}
+
+  mongos:
+    image: percona/percona-server-mongodb:${MONGODB_VERSION:-3.6}
+    hostname: mongos
+    command: mongos --port 27017 --bind_ip_all --keyFile /opt/keyFile --configdb {{range .RS}}{{if .Configsvr}}{{.Name}}/{{range $i, $h := .Hosts}}{{if $i}},{{end}}{{$h}}:27017{{end}}{{end}}{{end}}
+    ports:
+      - "27017:27017"
+    environment:
+      - SHARDS={{range $i, $rs := .RS}}{{if $rs.Shardsvr}}{{if gt $i 1}} {{end}}{{$rs.Name}}/{{index $rs.Hosts 0}}:27017{{end}}{{end}}
+    volumes:
+      - ./scripts/sharded/mongos_init.sh:/opt/mongos_init.sh
+      - ./keyFile:/opt/keyFile
+    depends_on:
+{{- range .RS}}{{range .Hosts}}
+      - {{.}}{{end}}{{end}}
+{{- end}}
+
+  minio:
+    image: minio/minio:RELEASE.2020-01-16T22-40-29Z
+    hostname: minio
+    ports:
+      - "9000:9000"
+    volumes:
+      - backups:/backups
+    environment:
+      - "MINIO_ACCESS_KEY=minio1234"
+      - "MINIO_SECRET_KEY=minio1234"
+    command: server /backups
+  createbucket:
+    image: minio/mc
+    depends_on:
+      - minio
+    entrypoint: >
+      /bin/sh -c "
+      /usr/bin/mc config host add myminio http://minio:9000 minio1234 minio1234;
+      /usr/bin/mc mb myminio/bcp;
+      exit 0;
+      "
+volumes:
+  backups:
+`))
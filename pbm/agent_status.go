@@ -0,0 +1,79 @@
+package pbm
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AgentStat is the agent's state reported with heartbeats
+type AgentStat struct {
+	// ID is the identity of the agent persisted across its restarts
+	ID             string              `bson:"id,omitempty" json:"id,omitempty"`
+	Node           string              `bson:"n" json:"node"`
+	RS             string              `bson:"rs" json:"rs"`
+	Heartbeat      primitive.Timestamp `bson:"hb" json:"hb"`
+	StateStr       string              `bson:"state" json:"state"`
+	ReplicationLag int                 `bson:"replLag" json:"replLag"`
+	DBPath         string              `bson:"dbPath,omitempty" json:"dbPath,omitempty"`
+	DiskFree       uint64              `bson:"diskFree" json:"diskFree"`
+	Host           HostStat            `bson:"host" json:"host"`
+	// Labels are set on the agent start (e.g. dc, rack, env)
+	// to be used by the backup source selectors
+	Labels map[string]string `bson:"labels,omitempty" json:"labels,omitempty"`
+	// Maintenance is set while the agent is in the maintenance mode
+	Maintenance bool `bson:"maint,omitempty" json:"maintenance,omitempty"`
+	// Busy is set while the agent holds the operations locks
+	Busy bool `bson:"busy,omitempty" json:"busy,omitempty"`
+	// Tasks are the commands the agent is running
+	Tasks []AgentTask `bson:"tasks,omitempty" json:"tasks,omitempty"`
+	Err   string      `bson:"e,omitempty" json:"error,omitempty"`
+}
+
+// AgentTask is the command being run by the agent
+type AgentTask struct {
+	Cmd     Command `bson:"cmd" json:"cmd"`
+	Name    string  `bson:"name" json:"name"`
+	StartTS int64   `bson:"startTS" json:"startTS"`
+}
+
+// IsStale returns true if the agent didn't send a heartbeat for StaleFrameSec
+// comparing to the given cluster time
+func (s AgentStat) IsStale(ts primitive.Timestamp) bool {
+	return s.Heartbeat.T+StaleFrameSec < ts.T
+}
+
+// SetAgentStatus writes (upserts) the agent's status
+func (p *PBM) SetAgentStatus(stat AgentStat) error {
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return errors.Wrap(err, "read cluster time")
+	}
+	stat.Heartbeat = ts
+
+	_, err = p.Conn.Database(DB).Collection(AgentsStatusCollection).ReplaceOne(
+		p.ctx,
+		bson.D{{"n", stat.Node}, {"rs", stat.RS}},
+		stat,
+		options.Replace().SetUpsert(true),
+	)
+	return errors.Wrap(err, "write into db")
+}
+
+// GetAgentStatus returns the last reported status of the agent
+func (p *PBM) GetAgentStatus(rs, node string) (AgentStat, error) {
+	var s AgentStat
+	res := p.Conn.Database(DB).Collection(AgentsStatusCollection).FindOne(p.ctx, bson.D{{"n", node}, {"rs", rs}})
+	if res.Err() != nil {
+		return s, errors.Wrap(res.Err(), "query mongo")
+	}
+	err := res.Decode(&s)
+	return s, errors.Wrap(err, "decode")
+}
+
+// AgentsStatus returns statuses of all agents in the cluster
+func (p *PBM) AgentsStatus() ([]AgentStat, error) {
+	stats, _, err := p.AgentsStatusPage(AgentFilter{}, Page{})
+	return stats, err
+}
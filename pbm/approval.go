@@ -0,0 +1,420 @@
+package pbm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ApprovalConf defines the two-person approval of the restores and the
+// deletes: the operation requested by one user runs only after another user
+// approves it. The users are the MongoDB users pbm connects as, so the
+// approval requires the authentication to be enabled.
+type ApprovalConf struct {
+	Restore bool `bson:"restore,omitempty" json:"restore,omitempty" yaml:"restore,omitempty"`
+	Delete  bool `bson:"delete,omitempty" json:"delete,omitempty" yaml:"delete,omitempty"`
+	// ExpireSec is how long the request waits for the approval and then
+	// how long the approved operation may be started. Default is 24h.
+	ExpireSec int `bson:"expireSec,omitempty" json:"expireSec,omitempty" yaml:"expireSec,omitempty"`
+}
+
+// DefaultApprovalExpire is the default lifetime of the approval request
+const DefaultApprovalExpire = 24 * time.Hour
+
+// Expire returns the lifetime of the approval request
+func (c ApprovalConf) Expire() time.Duration {
+	if c.ExpireSec <= 0 {
+		return DefaultApprovalExpire
+	}
+	return time.Duration(c.ExpireSec) * time.Second
+}
+
+// Required returns true if the command has to be approved
+func (c ApprovalConf) Required(cmd Command) bool {
+	switch cmd {
+	case CmdRestore:
+		return c.Restore
+	case CmdDeleteBackup:
+		return c.Delete
+	}
+	return false
+}
+
+// ApprovalPolicy is the approval required by the agent itself. Unlike
+// the approval config it's set on the agent's host, out of reach of the
+// users who can write into the PBM collections: they can neither turn it
+// off nor forge the approval without the approvers' private key.
+type ApprovalPolicy struct {
+	Restore bool
+	Delete  bool
+	// Key is the approvers' public key. If it's set, only the approvals
+	// signed with the private one are accepted.
+	Key ed25519.PublicKey
+}
+
+// ParseApprovalPolicy makes the policy of the operations (restore, delete)
+// and the PEM encoded PKIX public key file
+func ParseApprovalPolicy(ops []string, keyFile string) (ApprovalPolicy, error) {
+	p := ApprovalPolicy{}
+	for _, op := range ops {
+		switch strings.TrimSpace(op) {
+		case "restore":
+			p.Restore = true
+		case "delete":
+			p.Delete = true
+		default:
+			return p, errors.Errorf("unknown operation '%s', expected restore or delete", op)
+		}
+	}
+
+	if keyFile == "" {
+		if p.Restore || p.Delete {
+			return p, errors.New("the approvers' public key is required, otherwise the approvals can be forged")
+		}
+		return p, nil
+	}
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return p, errors.Wrap(err, "read public key file")
+	}
+	p.Key, err = SigningConf{PublicKey: string(buf)}.VerifyKey()
+	if err != nil {
+		return p, err
+	}
+	if p.Key == nil {
+		return p, errors.Errorf("no public key in %s", keyFile)
+	}
+	return p, nil
+}
+
+// Required returns true if the command has to be approved
+func (p ApprovalPolicy) Required(cmd Command) bool {
+	return ApprovalConf{Restore: p.Restore, Delete: p.Delete}.Required(cmd)
+}
+
+// ApprovalStatus is the state of the approval request
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalRejected ApprovalStatus = "rejected"
+)
+
+// Approval is the request of the operation waiting for the approval. The
+// requests are never removed, they are the audit trail of who requested
+// and who approved (or rejected) the operations.
+type Approval struct {
+	ID          string         `bson:"id" json:"id"`
+	Cmd         Cmd            `bson:"cmd" json:"cmd"`
+	Status      ApprovalStatus `bson:"status" json:"status"`
+	RequestedBy string         `bson:"requestedBy" json:"requestedBy"`
+	RequestedAt int64          `bson:"requestedAt" json:"requestedAt"`
+	DecidedBy   string         `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	DecidedAt   int64          `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	Comment     string         `bson:"comment,omitempty" json:"comment,omitempty"`
+	// CmdHash binds the approval to the exact requested command
+	CmdHash string `bson:"cmdHash" json:"cmdHash"`
+	// Signature is the approvers' signature of the decision, see Signed
+	Signature string `bson:"signature,omitempty" json:"signature,omitempty"`
+	// UsedBy is the ID of the command the approval was used by.
+	// The approval is good for one command only.
+	UsedBy string `bson:"usedBy,omitempty" json:"usedBy,omitempty"`
+	UsedAt int64  `bson:"usedAt,omitempty" json:"usedAt,omitempty"`
+}
+
+// ApprovalHash returns the hash of the command the approval is bound to.
+// The command's ID, timestamp and the approval reference are left out as
+// they are set only when the approved command is sent.
+func ApprovalHash(cmd Cmd) string {
+	cmd.ID = primitive.ObjectID{}
+	cmd.TS = 0
+	cmd.Restore.Approval = ""
+	cmd.Delete.Approval = ""
+	// the requests made before the user was recorded are stamped on the send
+	cmd.User = ""
+	// the safety backup is taken after the approval
+	cmd.Restore.SafetyBackup = ""
+	// the restore plugin args are the map
+	h := sha256.Sum256(canonicalBSON(cmd))
+	return fmt.Sprintf("%x", h)
+}
+
+// Signed returns the data of the decision covered by the signature
+func (a Approval) Signed() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%d", a.ID, a.CmdHash, a.Status, a.DecidedBy, a.DecidedAt))
+}
+
+// Sign signs the decision with the approvers' private key
+func (a *Approval) Sign(key ed25519.PrivateKey) {
+	a.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, a.Signed()))
+}
+
+// Valid returns an error if the approval doesn't let the command run: it's
+// not approved, expired, made for another command, already used by another
+// one or, if the key is given, not signed by the approvers
+func (a Approval) Valid(cmd Cmd, now time.Time, expire time.Duration, key ed25519.PublicKey) error {
+	switch {
+	case a.ID == "":
+		return errors.New("approval not found")
+	case a.Status != ApprovalApproved:
+		return errors.Errorf("approval %s is %s", a.ID, a.Status)
+	case a.Expired(now, expire):
+		return errors.Errorf("approval %s has expired", a.ID)
+	case a.CmdHash == "" || a.CmdHash != ApprovalHash(cmd):
+		return errors.Errorf("approval %s is for another operation: %s %s", a.ID, a.Cmd.Cmd, a.Target())
+	case a.UsedBy != "" && a.UsedBy != cmd.ID.Hex():
+		return errors.Errorf("approval %s has already been used at %s", a.ID,
+			time.Unix(a.UsedAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	if key == nil {
+		return nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(a.Signature)
+	if err != nil || !ed25519.Verify(key, a.Signed(), sig) {
+		return errors.Errorf("approval %s isn't signed by the approvers", a.ID)
+	}
+	return nil
+}
+
+// Expired returns true if the pending request wasn't decided in time or
+// the approved operation wasn't started in time
+func (a Approval) Expired(now time.Time, expire time.Duration) bool {
+	switch a.Status {
+	case ApprovalPending:
+		return now.Sub(time.Unix(a.RequestedAt, 0)) > expire
+	case ApprovalApproved:
+		return now.Sub(time.Unix(a.DecidedAt, 0)) > expire
+	}
+	return false
+}
+
+// Target returns the backup the requested operation is about
+func (a Approval) Target() string {
+	switch a.Cmd.Cmd {
+	case CmdRestore:
+		if a.Cmd.Restore.External != nil {
+			return "<external snapshot>"
+		}
+		return a.Cmd.Restore.BackupName
+	case CmdDeleteBackup:
+		if a.Cmd.Delete.Expired {
+			return "<expired>"
+		}
+		return a.Cmd.Delete.Backup
+	}
+	return ""
+}
+
+// WhoAmI returns the user the connection is authenticated as (<user>@<db>)
+func (p *PBM) WhoAmI() (string, error) {
+	var res struct {
+		AuthInfo struct {
+			Users []struct {
+				User string `bson:"user"`
+				DB   string `bson:"db"`
+			} `bson:"authenticatedUsers"`
+		} `bson:"authInfo"`
+	}
+	err := p.Conn.Database(DB).RunCommand(p.ctx, bson.D{{"connectionStatus", 1}}).Decode(&res)
+	if err != nil {
+		return "", errors.Wrap(err, "run connectionStatus")
+	}
+	if len(res.AuthInfo.Users) == 0 {
+		return "", errors.New("connection isn't authenticated, the approval needs the user identity")
+	}
+	u := res.AuthInfo.Users[0]
+	return u.User + "@" + u.DB, nil
+}
+
+// user returns the user the connection is authenticated as, the anonymous
+// one if it isn't or it can't be checked
+func (p *PBM) user() string {
+	who, err := p.WhoAmI()
+	if err != nil {
+		return anonymous
+	}
+	return who
+}
+
+// RequestApproval stores the command as the request waiting for the approval
+func (p *PBM) RequestApproval(cmd Cmd) (Approval, error) {
+	var err error
+	cmd.User, err = p.WhoAmI()
+	if err != nil {
+		return Approval{}, err
+	}
+	a := Approval{
+		Cmd:         cmd,
+		Status:      ApprovalPending,
+		RequestedAt: time.Now().UTC().Unix(),
+		CmdHash:     ApprovalHash(cmd),
+	}
+
+	a.RequestedBy = cmd.User
+
+	b := make([]byte, 6)
+	_, err = rand.Read(b)
+	if err != nil {
+		return a, errors.Wrap(err, "read random")
+	}
+	a.ID = fmt.Sprintf("%x", b)
+
+	_, err = p.Conn.Database(DB).Collection(ApprovalCollection).InsertOne(p.ctx, a)
+	return a, errors.Wrap(err, "write into db")
+}
+
+// GetApproval returns the approval request. The empty one
+// is returned if there is no such request.
+func (p *PBM) GetApproval(id string) (Approval, error) {
+	a := Approval{}
+	res := p.Conn.Database(DB).Collection(ApprovalCollection).FindOne(p.ctx, bson.D{{"id", id}})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return a, nil
+		}
+		return a, errors.Wrap(res.Err(), "get")
+	}
+	err := res.Decode(&a)
+	return a, errors.Wrap(err, "decode")
+}
+
+// DecideApproval approves or rejects the pending request. It can't be done
+// by the user who has requested the operation. The decision is signed
+// if the approvers' private key is given.
+func (p *PBM) DecideApproval(id string, approve bool, comment string, expire time.Duration, key ed25519.PrivateKey) (Approval, error) {
+	me, err := p.WhoAmI()
+	if err != nil {
+		return Approval{}, err
+	}
+
+	a, err := p.GetApproval(id)
+	if err != nil {
+		return a, err
+	}
+	now := time.Now().UTC()
+	switch {
+	case a.ID == "":
+		return a, errors.Errorf("approval request %s not found", id)
+	case a.Status != ApprovalPending:
+		return a, errors.Errorf("request is already %s by %s", a.Status, a.DecidedBy)
+	case a.Expired(now, expire):
+		return a, errors.Errorf("request has expired, it had to be decided within %v", expire)
+	case approve && a.RequestedBy == me:
+		return a, errors.Errorf("request has to be approved by another user than %s", me)
+	}
+
+	a.Status = ApprovalRejected
+	if approve {
+		a.Status = ApprovalApproved
+	}
+	a.DecidedBy = me
+	a.DecidedAt = now.Unix()
+	a.Comment = comment
+	if key != nil {
+		a.Sign(key)
+	}
+	res, err := p.Conn.Database(DB).Collection(ApprovalCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"id", id}, {"status", ApprovalPending}},
+		bson.D{{"$set", bson.D{
+			{"status", a.Status},
+			{"decidedBy", a.DecidedBy},
+			{"decidedAt", a.DecidedAt},
+			{"comment", a.Comment},
+			{"signature", a.Signature},
+		}}},
+	)
+	if err != nil {
+		return a, errors.Wrap(err, "write into db")
+	}
+	if res.ModifiedCount == 0 {
+		return a, errors.New("request has been decided concurrently")
+	}
+	return a, nil
+}
+
+// Approvals returns the last approval requests, the latest first
+func (p *PBM) Approvals(limit int64) ([]Approval, error) {
+	cur, err := p.Conn.Database(DB).Collection(ApprovalCollection).Find(
+		p.ctx,
+		bson.D{},
+		options.Find().SetLimit(limit).SetSort(bson.D{{"requestedAt", -1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	as := []Approval{}
+	for cur.Next(p.ctx) {
+		a := Approval{}
+		err := cur.Decode(&a)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		as = append(as, a)
+	}
+	return as, cur.Err()
+}
+
+// CheckApproval returns an error if the command needs the approval, either
+// by the config or by the agent's policy, but it isn't approved. Otherwise
+// the approval is used up by the command, so it can't be replayed. It's
+// checked by the agents so the approval can't be bypassed by sending
+// the command directly. The agents of all replsets running the same
+// command (the one with the same ID) share the approval.
+func (p *PBM) CheckApproval(cmd Cmd, policy ApprovalPolicy) error {
+	cfg, err := p.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get config")
+	}
+	if !cfg.Approval.Required(cmd.Cmd) && !policy.Required(cmd.Cmd) {
+		return nil
+	}
+
+	id := cmd.Restore.Approval
+	if cmd.Cmd == CmdDeleteBackup {
+		id = cmd.Delete.Approval
+	}
+	if id == "" {
+		return errors.New("operation requires the approval")
+	}
+
+	a, err := p.GetApproval(id)
+	if err != nil {
+		return errors.Wrap(err, "get approval")
+	}
+	now := time.Now().UTC()
+	err = a.Valid(cmd, now, cfg.Approval.Expire(), policy.Key)
+	if err != nil {
+		return err
+	}
+
+	err = p.Conn.Database(DB).Collection(ApprovalCollection).FindOneAndUpdate(
+		p.ctx,
+		bson.D{
+			{"id", id},
+			{"status", ApprovalApproved},
+			{"cmdHash", a.CmdHash},
+			{"usedBy", bson.M{"$in": bson.A{nil, cmd.ID.Hex()}}},
+		},
+		bson.D{{"$set", bson.D{{"usedBy", cmd.ID.Hex()}, {"usedAt", now.Unix()}}}},
+	).Err()
+	if err == mongo.ErrNoDocuments {
+		return errors.Errorf("approval %s has already been used", id)
+	}
+	return errors.Wrap(err, "use approval")
+}
@@ -0,0 +1,119 @@
+package pbm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func approvedRestore(t *testing.T, key ed25519.PrivateKey) (Approval, Cmd) {
+	cmd := Cmd{Cmd: CmdRestore, Restore: RestoreCmd{Name: "r1", BackupName: "b1"}}
+	a := Approval{
+		ID:          "a1",
+		Cmd:         cmd,
+		Status:      ApprovalApproved,
+		RequestedBy: "alice@admin",
+		DecidedBy:   "bob@admin",
+		DecidedAt:   time.Now().Unix(),
+		CmdHash:     ApprovalHash(cmd),
+	}
+	if key != nil {
+		a.Sign(key)
+	}
+
+	cmd.ID = primitive.NewObjectID()
+	cmd.TS = time.Now().Unix()
+	cmd.Restore.Approval = a.ID
+	return a, cmd
+}
+
+func TestApprovalBypass(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, cmd := approvedRestore(t, priv)
+	if err := a.Valid(cmd, time.Now(), time.Hour, pub); err != nil {
+		t.Fatalf("signed approval: unexpected error: %v", err)
+	}
+
+	// the approved document inserted by the user who can write into the db
+	forged, cmd := approvedRestore(t, nil)
+	if err := forged.Valid(cmd, time.Now(), time.Hour, pub); err == nil {
+		t.Error("expected error for the unsigned approval")
+	}
+	forged, cmd = approvedRestore(t, other)
+	if err := forged.Valid(cmd, time.Now(), time.Hour, pub); err == nil {
+		t.Error("expected error for the approval signed with another key")
+	}
+
+	// the approval of one backup used for the restore of another
+	cmd.Restore.BackupName = "b2"
+	if err := a.Valid(cmd, time.Now(), time.Hour, pub); err == nil {
+		t.Error("expected error for the approval of another command")
+	}
+	a.Cmd.Restore.BackupName = "b2"
+	a.CmdHash = ApprovalHash(a.Cmd)
+	if err := a.Valid(cmd, time.Now(), time.Hour, pub); err == nil {
+		t.Error("expected error for the approval modified after the signing")
+	}
+
+	// the approval config is gone, the agent's policy still holds
+	if !(ApprovalPolicy{Restore: true, Key: pub}).Required(CmdRestore) {
+		t.Error("the agent's policy doesn't require the restore approval")
+	}
+	if _, err := ParseApprovalPolicy([]string{"restore"}, ""); err == nil {
+		t.Error("expected error for the policy without the approvers' key")
+	}
+}
+
+func TestApprovalReplay(t *testing.T) {
+	a, cmd := approvedRestore(t, nil)
+	a.UsedBy = cmd.ID.Hex()
+
+	// the agents of the other replsets run the same command
+	if err := a.Valid(cmd, time.Now(), time.Hour, nil); err != nil {
+		t.Fatalf("same command: unexpected error: %v", err)
+	}
+
+	cmd.ID = primitive.NewObjectID()
+	if err := a.Valid(cmd, time.Now(), time.Hour, nil); err == nil {
+		t.Error("expected error for the approval used by another command")
+	}
+}
+
+func TestApprovalSafetyBackup(t *testing.T) {
+	cmd := Cmd{Cmd: CmdRestore, Restore: RestoreCmd{Name: "r1", BackupName: "b1", Safety: true}}
+	h := ApprovalHash(cmd)
+
+	// the safety backup is named once the restore is approved
+	cmd.Restore.SafetyBackup = "2020-01-01T00:00:00Z"
+	if ApprovalHash(cmd) != h {
+		t.Error("the safety backup taken after the approval changes the approved command")
+	}
+	cmd.Restore.Safety = false
+	if ApprovalHash(cmd) == h {
+		t.Error("the safety backup dropped after the approval doesn't change the approved command")
+	}
+}
+
+func TestApprovalHashMaps(t *testing.T) {
+	cmd := Cmd{Cmd: CmdRestore, Restore: RestoreCmd{
+		BackupName: "b1",
+		Plugin:     &TransformPlugin{Path: "/bin/mask", Args: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}},
+	}}
+	h := ApprovalHash(cmd)
+	for i := 0; i < 50; i++ {
+		if got := ApprovalHash(cmd); got != h {
+			t.Fatalf("the same command is hashed as %s and %s", h, got)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pbm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/version"
+)
+
+// ArchiveVersion is the current version of the archive format.
+// Version 1 archives have no header and consist of data only.
+const ArchiveVersion = 2
+
+// maxArchiveHeaderSize protects from reading garbage as a header
+const maxArchiveHeaderSize = 16 << 20
+
+var archiveMagic = []byte("PBMARCH\x02")
+
+// ArchiveType is the type of data in the archive
+type ArchiveType string
+
+const (
+	ArchiveTypeDump  ArchiveType = "dump"
+	ArchiveTypeOplog ArchiveType = "oplog"
+	// ArchiveTypeSessions is the stream of the sessions records (config.transactions)
+	ArchiveTypeSessions ArchiveType = "sessions"
+)
+
+// ArchiveHeader is the metadata block written at the beginning of every
+// archive (dump or oplog) so the file is self-describing.
+// The header is written uncompressed as:
+//
+//	magic (8 bytes) | header length (uint32 big-endian) | header (JSON)
+type ArchiveHeader struct {
+	Version     int                 `json:"version"`
+	PBMVersion  string              `json:"pbm_version"`
+	GitCommit   string              `json:"git_commit,omitempty"`
+	Type        ArchiveType         `json:"type"`
+	Backup      string              `json:"backup"`
+	Replset     string              `json:"replset"`
+	OplogStart  primitive.Timestamp `json:"oplog_start"`
+	Compression CompressionType     `json:"compression"`
+	Namespaces  []string            `json:"namespaces,omitempty"`
+	CreatedAt   int64               `json:"created_at"`
+	// NoDocs means the dump has only the collections metadata (the schema)
+	NoDocs bool `json:"no_docs,omitempty"`
+}
+
+// NewArchiveHeader creates a header of the current version
+func NewArchiveHeader(typ ArchiveType, bcp, rs string, compression CompressionType) *ArchiveHeader {
+	return &ArchiveHeader{
+		Version:     ArchiveVersion,
+		PBMVersion:  version.DefaultInfo.Version,
+		GitCommit:   version.DefaultInfo.GitCommit,
+		Type:        typ,
+		Backup:      bcp,
+		Replset:     rs,
+		Compression: compression,
+	}
+}
+
+// WriteArchiveHeader writes the header into w
+func WriteArchiveHeader(w io.Writer, h *ArchiveHeader) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return errors.Wrap(err, "marshal header")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(archiveMagic)+4+len(b)))
+	buf.Write(archiveMagic)
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+
+	_, err = w.Write(buf.Bytes())
+	return errors.Wrap(err, "write header")
+}
+
+// ReadArchiveHeader reads the archive header if there is any.
+// It returns the reader positioned at the beginning of the data and
+// nil header in case of archive without the header (version 1).
+func ReadArchiveHeader(r io.Reader) (*ArchiveHeader, io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	m, err := br.Peek(len(archiveMagic))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, errors.Wrap(err, "read magic")
+	}
+	if !bytes.Equal(m, archiveMagic) {
+		return nil, br, nil
+	}
+	br.Discard(len(archiveMagic))
+
+	var l uint32
+	err = binary.Read(br, binary.BigEndian, &l)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read header length")
+	}
+	if l > maxArchiveHeaderSize {
+		return nil, nil, errors.Errorf("header size %d exceeds the limit", l)
+	}
+
+	b := make([]byte, l)
+	_, err = io.ReadFull(br, b)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read header")
+	}
+
+	h := &ArchiveHeader{}
+	err = json.Unmarshal(b, h)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unmarshal header")
+	}
+
+	return h, br, nil
+}
@@ -2,10 +2,14 @@ package backup
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +18,7 @@ import (
 	"github.com/mongodb/mongo-tools-common/progress"
 	"github.com/mongodb/mongo-tools/mongodump"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
@@ -24,6 +29,35 @@ type Backup struct {
 	cn   *pbm.PBM
 	node *pbm.Node
 	name string
+	cfg  pbm.Config
+	// dedup defines if the data is stored in the deduplicated layout
+	dedup bool
+	// subset is the replsets the backup is restricted to
+	subset []string
+	// jlog is the log of the backup job readable via `pbm logs`
+	jlog *pbm.JobLogger
+	// span is the trace span of the replset's part of the backup
+	span *pbm.Span
+	// times accounts the pipeline stages of the current step if set
+	times *pipeTimes
+	// upload are the upload part size and concurrency fitting the memory limit
+	upload pbm.UploadOpts
+	// colls are the node's collections with their sizes
+	// which the upload part size of the dump is picked by
+	colls []pbm.NSInfo
+	// sums are the checksums of the uploaded files yet to be stored in the meta
+	sums []pbm.FileChecksum
+	// prof are the settings of the backup's resources profile
+	prof pbm.ProfileSettings
+	// throttle limits the read rate of the dump and the oplog if set
+	throttle *throttle
+	// progress tracks the running dump if set
+	progress *dumpProgress
+	// parallel is the number of the collections dumped concurrently
+	parallel int
+	// primary is the replset's primary the oplog slice and the sessions
+	// are read from if the node is the delayed member
+	primary *pbm.Node
 }
 
 func New(cn *pbm.PBM, node *pbm.Node) *Backup {
@@ -45,6 +79,7 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "get cluster info")
 	}
+	b.subset = bcp.Replsets
 
 	meta := &pbm.BackupMeta{
 		Name:        bcp.Name,
@@ -53,6 +88,14 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 		Status:      pbm.StatusStarting,
 		Replsets:    []pbm.BackupReplset{},
 		LastWriteTS: primitive.Timestamp{T: 1, I: 1}, // (andrew) I dunno why, but the driver (mongo?) sets TS to the current wall clock if TS was 0, so have to init with 1
+		RetryOf:     bcp.RetryOf,
+		Attempt:     bcp.Attempt,
+		ExpireAt:    bcp.ExpireAt,
+		LegalHold:   bcp.LegalHold,
+		Subset:      bcp.Replsets,
+		TraceID:     bcp.Trace.TraceID,
+		Tags:        bcp.Tags,
+		Replaces:    bcp.Replaces,
 	}
 
 	rsName := im.SetName
@@ -66,11 +109,23 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 		StartTS:    time.Now().UTC().Unix(),
 		Status:     pbm.StatusRunning,
 		Conditions: []pbm.Condition{},
+		Node:       im.Me,
 	}
+	if im.IsStandalone() {
+		rsMeta.OplogName = ""
+	}
+	if bcp.Type == pbm.BackupTypeOplog {
+		rsMeta.DumpName = ""
+	}
+	b.jlog = b.cn.NewJobLogger(bcp.Name, rsName, im.Me)
+	b.span = b.cn.StartSpan(bcp.Trace, "backup", rsName, im.Me)
+	defer func() { b.span.Finish(err) }()
 
+	policy := pbm.FailurePolicyAbort
 	defer func() {
 		if err != nil {
-			ferr := b.MarkFailed(bcp.Name, rsMeta.Name, err.Error())
+			ferr := b.markFailed(bcp.Name, rsMeta.Name, err.Error(), policy, bcp.IsLeader(im))
+			b.jlog.Errorf("error", "backup failed: %v", err)
 			log.Printf("Mark backup as failed `%v`: %v\n", err, ferr)
 		}
 	}()
@@ -79,6 +134,41 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 	if err == nil {
 		meta.MongoVersion = ver.VersionString
 	}
+	bi, err := b.node.BuildInfo()
+	if err != nil {
+		return errors.Wrap(err, "get build info")
+	}
+	rsMeta.Build = &bi
+
+	cfg, err := b.cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to get PBM config")
+	}
+	b.cfg = cfg
+	policy = cfg.Backup.Policy()
+	// the leader signs the manifest at the very end,
+	// so the missing key shouldn't waste the whole backup
+	if bcp.IsLeader(im) {
+		_, err = cfg.Signing.SignKey()
+		if err != nil {
+			return errors.Wrap(err, "get manifest signing key")
+		}
+	}
+	meta.FailurePolicy = policy
+	meta.Retries = cfg.Backup.Retries
+	meta.Dedup = cfg.Backup.Dedup
+	meta.Profile = cfg.Backup.Profile
+	if bcp.Profile != pbm.ProfileNone {
+		meta.Profile = bcp.Profile
+	}
+	meta.Type = pbm.BackupTypeFull
+	switch bcp.Type {
+	case pbm.BackupTypeDifferential:
+		meta.Type = bcp.Type
+		meta.Base = bcp.Base
+	case pbm.BackupTypeSchema, pbm.BackupTypeOplog:
+		meta.Type = bcp.Type
+	}
 
 	stg, err := b.cn.GetStorage()
 	if err != nil {
@@ -91,12 +181,44 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 	// Erase credentials data
 	meta.Store.S3.Credentials = pbm.Credentials{}
 
-	if im.IsLeader() {
+	if bcp.IsLeader(im) {
+		meta.Settings, err = b.node.GetClusterSettings()
+		if err != nil {
+			log.Println("[WARNING] get cluster settings:", err)
+		}
+
+		err = b.checkTopology(meta, im)
+		if err != nil {
+			b.jlog.Warningf("start", "check cluster topology: %v", err)
+		}
+
+		// the refused start shouldn't leave the failed backup behind,
+		// so the window is checked before there is any meta
+		if !bcp.IgnoreWindow {
+			err = cfg.Backup.Window.Check(time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
 		err = b.cn.SetBackupMeta(meta)
 		if err != nil {
 			return errors.Wrap(err, "write backup meta to db")
 		}
 
+		if bcp.Type == pbm.BackupTypeDifferential {
+			_, err = b.baseMeta(bcp.Base)
+			if err != nil {
+				return errors.Wrap(err, "check base backup")
+			}
+		}
+
+		checkWindow := cfg.Backup.Window.Abort && !bcp.IgnoreWindow
+		timeout := cfg.Backup.Timeout()
+		if bcp.TimeoutSec > 0 {
+			timeout = time.Duration(bcp.TimeoutSec) * time.Second
+		}
+		tstart := time.Now()
 		hbstop := make(chan struct{})
 		defer close(hbstop)
 		go func() {
@@ -109,6 +231,25 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 					if err != nil {
 						log.Println("[ERROR] send pbm heartbeat:", err)
 					}
+					if checkWindow {
+						if werr := cfg.Backup.Window.Check(time.Now()); werr != nil {
+							log.Printf("[WARNING] aborting backup %s: %v", bcp.Name, werr)
+							err := b.cn.ChangeBackupState(bcp.Name, pbm.StatusError, "aborted: "+werr.Error())
+							if err != nil {
+								log.Println("[ERROR] abort backup:", err)
+							}
+							checkWindow = false
+						}
+					}
+					if timeout > 0 && time.Since(tstart) > timeout {
+						log.Printf("[WARNING] aborting backup %s: timeout %v reached", bcp.Name, timeout)
+						b.jlog.Errorf("timeout", "backup aborted: timeout %v reached", timeout)
+						err := b.cn.ChangeBackupState(bcp.Name, pbm.StatusError, "timeout")
+						if err != nil {
+							log.Println("[ERROR] abort backup:", err)
+						}
+						timeout = 0
+					}
 				case <-hbstop:
 					return
 				}
@@ -129,8 +270,15 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 		return errors.Wrap(err, "add shard's metadata")
 	}
 
-	if im.IsLeader() {
+	if bcp.IsLeader(im) {
 		err := b.reconcileStatus(bcp.Name, pbm.StatusRunning, im, &pbm.WaitActionStart)
+		if errors.Cause(err) == errConvergeTimeOut {
+			err = b.checkAbsentShards(bcp.Name, im)
+			if err != nil {
+				return errors.Wrap(err, "couldn't get response from all shards")
+			}
+			err = b.reconcileStatus(bcp.Name, pbm.StatusRunning, im, &pbm.WaitActionStart)
+		}
 		if err != nil {
 			if errors.Cause(err) == errConvergeTimeOut {
 				return errors.Wrap(err, "couldn't get response from all shards")
@@ -145,34 +293,429 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 		return errors.Wrap(err, "waiting for start")
 	}
 
+	return b.data(bcp, im, stg, rsMeta)
+}
+
+// finishStandalone completes the backup of the standalone node
+// which consists of the dump only
+func (b *Backup) finishStandalone(bcp pbm.BackupCmd, im *pbm.IsMaster, rsMeta pbm.BackupReplset, stg pbm.Storage) error {
+	err := b.reconcileStatus(bcp.Name, pbm.StatusDumpDone, im, nil)
+	if err != nil {
+		return errors.Wrap(err, "check cluster for dump done")
+	}
+
+	err = b.cn.ChangeRSState(bcp.Name, rsMeta.Name, pbm.StatusDone, "")
+	if err != nil {
+		return errors.Wrap(err, "set shard's StatusDone")
+	}
+
+	err = b.reconcileStatus(bcp.Name, pbm.StatusDone, im, nil)
+	if err != nil {
+		return errors.Wrap(err, "check cluster for backup done")
+	}
+
+	err = b.dumpClusterMeta(bcp.Name, stg)
+	if err != nil {
+		return errors.Wrap(err, "dump metadata")
+	}
+
+	b.replace(bcp, stg)
+	return nil
+}
+
+// Retry restarts the backup of the current replset after it has
+// failed on the another node. Retry is possible only for the non-leader
+// replsets and only until the cluster has reached StatusDumpDone. If the
+// failed node has done the dump, only the oplog slice is redone.
+func (b *Backup) Retry(bcp pbm.BackupCmd) (err error) {
+	im, err := b.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get cluster info")
+	}
+	if bcp.IsLeader(im) {
+		return errors.New("backup on the leader replset can't be retried")
+	}
+	b.subset = bcp.Replsets
+
+	bmeta, err := b.cn.GetBackupMeta(bcp.Name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	var rsMeta *pbm.BackupReplset
+	for i, rs := range bmeta.Replsets {
+		if rs.Name == im.SetName {
+			rsMeta = &bmeta.Replsets[i]
+		}
+	}
+	if rsMeta == nil {
+		return errors.Errorf("no metadata for replset %s", im.SetName)
+	}
+
+	b.jlog = b.cn.NewJobLogger(bcp.Name, rsMeta.Name, im.Me)
+	b.jlog.Infof("start", "retrying the backup, attempt %d", bcp.Attempt)
+	b.span = b.cn.StartSpan(bcp.Trace, "backup retry", rsMeta.Name, im.Me)
+	b.span.SetAttr("attempt", strconv.Itoa(bcp.Attempt))
+	defer func() { b.span.Finish(err) }()
+
+	defer func() {
+		if err != nil {
+			ferr := b.markFailed(bcp.Name, rsMeta.Name, err.Error(), bmeta.FailurePolicy, false)
+			b.jlog.Errorf("error", "backup failed: %v", err)
+			log.Printf("Mark backup as failed `%v`: %v\n", err, ferr)
+		}
+	}()
+
+	b.cfg, err = b.cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to get PBM config")
+	}
+
+	stg, err := b.cn.GetStorage()
+	if err != nil {
+		return errors.Wrap(err, "unable to get backup store")
+	}
+
+	err = b.cn.RetryRS(bcp.Name, rsMeta.Name, im.Me)
+	if err != nil {
+		return errors.Wrap(err, "set shard's retry state")
+	}
+
+	// the node and so its versions may differ from the failed one's
+	bi, err := b.node.BuildInfo()
+	if err != nil {
+		return errors.Wrap(err, "get build info")
+	}
+	err = b.cn.SetRSBuild(bcp.Name, rsMeta.Name, bi)
+	if err != nil {
+		return errors.Wrap(err, "set shard's build info")
+	}
+
+	return b.data(bcp, im, stg, *rsMeta)
+}
+
+// data makes the data snapshot (dump) and the oplog slice of the replset
+func (b *Backup) data(bcp pbm.BackupCmd, im *pbm.IsMaster, stg pbm.Storage, rsMeta pbm.BackupReplset) (err error) {
+	ctx, cancel := context.WithCancel(b.cn.Context())
+	defer cancel()
+	go b.watchCancel(ctx, cancel, bcp.Name)
+
+	// the lag watcher cancels the backup, so its reason
+	// is more relevant than whatever failed after the cancel
+	lagErr := make(chan error, 1)
+	defer func() {
+		select {
+		case lerr := <-lagErr:
+			err = lerr
+		default:
+		}
+	}()
+
+	// the layout is defined by the leader, so take it from the meta
+	// rather than from the config which may have changed since then
+	meta, err := b.cn.GetBackupMeta(bcp.Name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	b.dedup = meta.Dedup
+
+	b.prof, err = meta.Profile.Settings()
+	if err != nil {
+		return err
+	}
+	ucfg := b.cfg
+	if ucfg.Storage.S3.UploadConcurrency == 0 {
+		ucfg.Storage.S3.UploadConcurrency = b.prof.UploadConcurrency
+	}
+	b.upload, err = ucfg.UploadOpts()
+	if err != nil {
+		return err
+	}
+	b.sums = nil
+	b.parallel = bcp.ParallelCollections
+
+	// there is no oplog on the standalone node, so the dump is the
+	// whole backup and it is kept consistent by the fsync lock
+	standalone := im.IsStandalone()
+	if standalone && !bcp.FsyncLock {
+		return errors.New("backup of the standalone node is possible only with the fsync lock")
+	}
+	if standalone && bcp.Type == pbm.BackupTypeDifferential {
+		return errors.New("differential backup of the standalone node is not supported")
+	}
+	if standalone && bcp.Type == pbm.BackupTypeOplog {
+		return errors.New("standalone node has no oplog")
+	}
+
+	b.throttle = nil
+	if b.prof.RateLimitMBps > 0 {
+		b.throttle = newThrottle(int64(b.prof.RateLimitMBps) << 20)
+		// the log can't be written while the standalone node is locked
+		if b.prof.LatencyGuard && !standalone {
+			baseline, err := b.probeLatency(ctx)
+			if err != nil {
+				b.jlog.Warningf("profile", "latency guard is off: probe latency: %v", err)
+			} else {
+				go b.guardLatency(ctx, b.throttle, baseline)
+			}
+		}
+	}
+
 	oplog := NewOplog(b.node)
-	oplogTS, err := oplog.LastWrite()
+	if !standalone {
+		oplog, err = b.sourceOplog(bcp.Name, rsMeta)
+		if b.primary != nil {
+			defer b.primary.Session().Disconnect(context.Background())
+		}
+		if err != nil {
+			return errors.Wrap(err, "define oplog source")
+		}
+	}
+	var oplogTS primitive.Timestamp
+	if !standalone {
+		oplogTS, err = b.oplogStart(ctx, oplog, bcp, rsMeta)
+		if err != nil {
+			return errors.Wrap(err, "define oplog start position")
+		}
+		err = b.cn.SetRSFirstWrite(bcp.Name, rsMeta.Name, oplogTS)
+		if err != nil {
+			return errors.Wrap(err, "set shard's first write ts")
+		}
+		b.jlog.Debugf("start", "oplog starts at %v", oplogTS)
+
+		go b.watchOplogLag(ctx, cancel, oplog, oplogTS, bcp.Name, rsMeta.Name, lagErr)
+	}
+
+	// the dump made after the cluster last write can't be made consistent
+	if rsMeta.DumpDone() && oplogTS != rsMeta.FirstWriteTS && meta.Status != pbm.StatusStarting && meta.Status != pbm.StatusRunning {
+		return errors.Errorf("the dump is done but the node's oplog doesn't have the oplog since %v anymore", rsMeta.FirstWriteTS)
+	}
+
+	// the node of the replset was lost after its dump had been uploaded,
+	// so only the oplog slice is left to make
+	if !standalone && rsMeta.DumpDone() && oplogTS == rsMeta.FirstWriteTS {
+		b.jlog.Infof("start", "dump was done by %s, resuming with the oplog from %v", rsMeta.Node, oplogTS)
+		err = b.cn.ChangeRSState(bcp.Name, rsMeta.Name, pbm.StatusDumpDone, "")
+		if err != nil {
+			return errors.Wrap(err, "set shard's StatusDumpDone")
+		}
+		return b.finishOplog(ctx, oplog, bcp, im, stg, rsMeta, oplogTS)
+	}
+
+	if bcp.Type == pbm.BackupTypeOplog {
+		b.jlog.Infof("start", "oplog-only backup, skipping the dump")
+		err = b.cn.ChangeRSState(bcp.Name, rsMeta.Name, pbm.StatusDumpDone, "")
+		if err != nil {
+			return errors.Wrap(err, "set shard's StatusDumpDone")
+		}
+		return b.finishOplog(ctx, oplog, bcp, im, stg, rsMeta, oplogTS)
+	}
+
+	if im.IsSharded() {
+		err = b.waitBalancerHeld(ctx, bcp.Name)
+		if err != nil {
+			return errors.Wrap(err, "wait for the balancer to stop")
+		}
+	}
+
+	if !standalone {
+		err = b.setDumpPoint(bcp.Name, rsMeta.Name, false)
+		if err != nil {
+			return errors.Wrap(err, "set shard's dump start point")
+		}
+	}
+
+	colls, err := b.node.Collections()
 	if err != nil {
-		return errors.Wrap(err, "define oplog start position")
+		return errors.Wrap(err, "list collections")
+	}
+	b.colls = colls
+	err = b.cn.SetRSCollections(bcp.Name, rsMeta.Name, colls)
+	if err != nil {
+		return errors.Wrap(err, "write collections list")
+	}
+
+	colls, skipped := skipBySize(colls, bcp.MinCollSize, bcp.MaxCollSize)
+	if len(skipped) > 0 {
+		b.jlog.Infof("dump", "skipping %d collections out of the size limits: %s", len(skipped), strings.Join(skipped, ", "))
+		err = b.cn.SetRSSkipped(bcp.Name, rsMeta.Name, skipped)
+		if err != nil {
+			return errors.Wrap(err, "write skipped collections")
+		}
 	}
 
-	err = b.dump(stg, rsMeta.DumpName, bcp.Compression)
+	// the buckets of the sharded cluster are checked as a whole
+	// by the mongos agent, a shard sees only a part of them
+	if bcp.CheckGridFS && !im.IsSharded() {
+		err = b.checkGridFS(bcp.Name, rsMeta.Name, colls, !standalone)
+		if err != nil {
+			b.jlog.Warningf("gridfs", "GridFS check: %v", err)
+		}
+	}
+
+	// the dedup chunks are compressed individually and the differential
+	// dumps are small, so the sampling makes sense only for the full dump
+	var uncompressed []string
+	if bcp.AdaptiveCompression && !b.dedup && bcp.Type != pbm.BackupTypeDifferential && bcp.Type != pbm.BackupTypeSchema && bcp.Compression != pbm.CompressionTypeNone {
+		choices, err := b.sampleCompression(ctx, colls, bcp.Compression)
+		if err != nil {
+			return errors.Wrap(err, "sample compression")
+		}
+		uncompressed = uncompressedColls(choices)
+		if len(uncompressed) > 0 {
+			b.jlog.Infof("dump", "%d collections are incompressible, dumping them separately with no compression: %s",
+				len(uncompressed), strings.Join(uncompressed, ", "))
+		}
+		err = b.cn.SetRSCompressions(bcp.Name, rsMeta.Name, choices)
+		if err != nil {
+			return errors.Wrap(err, "write compression metadata")
+		}
+	}
+	// the node's dump excludes the collections by the name
+	// (see dumpNamesakes), the incompressible ones included
+	excluded := append(append([]string{}, skipped...), uncompressed...)
+
+	// there are no documents to be mixed up in the schema dump
+	var capped map[string]bson.Raw
+	if bcp.Type != pbm.BackupTypeSchema {
+		capped, err = b.cappedSnapshot(colls)
+		if err != nil {
+			return errors.Wrap(err, "snapshot capped collections")
+		}
+	}
+
+	b.jlog.Infof("dump", "dumping %d collections", len(colls))
+
+	unlock := func() error { return nil }
+	if bcp.FsyncLock {
+		hold := b.cfg.Backup.Timeout()
+		if bcp.TimeoutSec > 0 {
+			hold = time.Duration(bcp.TimeoutSec) * time.Second
+		}
+		unlock, err = b.fsyncLock(ctx, cancel, bcp.Name, im, hold)
+		if err != nil {
+			return errors.Wrap(err, "fsync lock")
+		}
+		defer unlock()
+	}
+
+	b.times = newPipeTimes()
+	dspan := b.span.Child("dump")
+	dspan.SetAttr("collections", strconv.Itoa(len(colls)))
+	dumped := nsList(colls)
+
+	b.progress = &dumpProgress{}
+	b.progress.estimate(colls, dumped)
+	pctx, stopProgress := context.WithCancel(ctx)
+	pdone := make(chan struct{})
+	go func() {
+		b.reportProgress(pctx, b.progress, bcp.Name, rsMeta.Name, im.Me)
+		close(pdone)
+	}()
+	defer func() {
+		stopProgress()
+		<-pdone
+		b.progress = nil
+	}()
+
+	if bcp.Type == pbm.BackupTypeDifferential {
+		dumped, err = b.diff(ctx, oplog, bcp, rsMeta, colls, skipped, oplogTS, stg)
+	} else {
+		hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, bcp.Compression)
+		hdr.OplogStart = oplogTS
+		hdr.Namespaces = exceptNS(dumped, uncompressed)
+		hdr.CreatedAt = time.Now().UTC().Unix()
+		hdr.NoDocs = bcp.Type == pbm.BackupTypeSchema
+
+		err = b.dump(ctx, stg, rsMeta.DumpName, hdr, "", "", collNames(excluded))
+	}
+	// the span can't be stored while the standalone node is locked
+	if lerr := unlock(); lerr != nil {
+		b.endStep(dspan, lerr)
+		return errors.Wrap(lerr, "fsync lock")
+	}
 	if err != nil {
+		b.endStep(dspan, err)
 		return errors.Wrap(err, "mongodump")
 	}
-	log.Println("mongodump finished, waiting for the oplog")
+
+	var redumps []pbm.Redump
+	if len(uncompressed) > 0 {
+		redumps, err = b.dumpUncompressed(ctx, bcp, rsMeta, uncompressed, oplogTS, stg)
+		if err != nil {
+			b.endStep(dspan, err)
+			return errors.Wrap(err, "incompressible collections")
+		}
+	}
+	if bcp.Type != pbm.BackupTypeDifferential && len(excluded) > 0 {
+		namesakes, err := b.dumpNamesakes(ctx, bcp, rsMeta, exceptNS(dumped, uncompressed), excluded, oplogTS, stg)
+		if err != nil {
+			b.endStep(dspan, err)
+			return errors.Wrap(err, "namesakes of skipped collections")
+		}
+		redumps = append(redumps, namesakes...)
+	}
+
+	if bcp.Type == pbm.BackupTypeSchema {
+		sdumps, err := b.dumpSchemaColls(ctx, bcp, im, rsMeta, oplogTS, stg)
+		if err != nil {
+			b.endStep(dspan, err)
+			return errors.Wrap(err, "users, roles and sharding metadata")
+		}
+		redumps = append(redumps, sdumps...)
+	}
+
+	err = b.redumpCapped(ctx, bcp, rsMeta, capped, dumped, redumps, oplogTS, stg)
+	b.endStep(dspan, err)
+	if err != nil {
+		return errors.Wrap(err, "capped collections")
+	}
+	stopProgress()
+	<-pdone
+	b.jlog.Infof("dump", "mongodump finished, waiting for the oplog")
+
+	err = b.storeChecksums(bcp.Name, rsMeta.Name)
+	if err != nil {
+		return errors.Wrap(err, "store dump checksums")
+	}
+
+	if !standalone {
+		err = b.setDumpPoint(bcp.Name, rsMeta.Name, true)
+		if err != nil {
+			return errors.Wrap(err, "set shard's dump end point")
+		}
+	}
 
 	err = b.cn.ChangeRSState(bcp.Name, rsMeta.Name, pbm.StatusDumpDone, "")
 	if err != nil {
 		return errors.Wrap(err, "set shard's StatusDumpDone")
 	}
 
+	if standalone {
+		return b.finishStandalone(bcp, im, rsMeta, stg)
+	}
+
+	return b.finishOplog(ctx, oplog, bcp, im, stg, rsMeta, oplogTS)
+}
+
+// finishOplog makes the oplog slice of the replset from oplogTS
+// up to the cluster last write once the dumps are done
+func (b *Backup) finishOplog(ctx context.Context, oplog *Oplog, bcp pbm.BackupCmd, im *pbm.IsMaster, stg pbm.Storage, rsMeta pbm.BackupReplset, oplogTS primitive.Timestamp) error {
 	lwts, err := oplog.LastWrite()
 	if err != nil {
 		return errors.Wrap(err, "get shard's last write ts")
 	}
+	// the oplog-only backup ends at the requested point,
+	// the slicing waits for it if it's yet to come
+	if bcp.Type == pbm.BackupTypeOplog && bcp.OplogUntil.T > 0 {
+		lwts = bcp.OplogUntil
+	}
 
 	err = b.cn.SetRSLastWrite(bcp.Name, rsMeta.Name, lwts)
 	if err != nil {
 		return errors.Wrap(err, "set shard's last write ts")
 	}
 
-	if im.IsLeader() {
+	if bcp.IsLeader(im) {
 		err := b.reconcileStatus(bcp.Name, pbm.StatusDumpDone, im, nil)
 		if err != nil {
 			return errors.Wrap(err, "check cluster for dump done")
@@ -184,51 +727,258 @@ func (b *Backup) run(bcp pbm.BackupCmd) (err error) {
 		}
 	}
 
+	sspan := b.span.Child("sync")
 	err = b.waitForStatus(bcp.Name, pbm.StatusDumpDone)
 	if err != nil {
+		sspan.Finish(err)
 		return errors.Wrap(err, "waiting for dump done")
 	}
 
 	lwTS, err := b.waitForLastWrite(bcp.Name)
+	sspan.Finish(err)
 	if err != nil {
 		return errors.Wrap(err, "waiting and reading cluster last write ts")
 	}
 
-	err = b.oplog(oplog, oplogTS, lwTS, stg, rsMeta.OplogName, bcp.Compression)
+	b.jlog.Infof("oplog", "uploading the oplog slice %v - %v", oplogTS, lwTS)
+	b.times = newPipeTimes()
+	ospan := b.span.Child("oplog")
+	err = b.oplog(ctx, oplog, bcp, rsMeta, oplogTS, lwTS, stg)
+	b.endStep(ospan, err)
 	if err != nil {
 		return errors.Wrap(err, "oplog")
 	}
+	if b.cfg.Backup.Sessions {
+		err = b.dumpSessions(ctx, bcp, rsMeta, lwTS, stg)
+		if err != nil {
+			return errors.Wrap(err, "sessions")
+		}
+	}
+	err = b.storeChecksums(bcp.Name, rsMeta.Name)
+	if err != nil {
+		return errors.Wrap(err, "store oplog checksums")
+	}
+	b.jlog.Infof("done", "replset backup finished")
 	err = b.cn.ChangeRSState(bcp.Name, rsMeta.Name, pbm.StatusDone, "")
 	if err != nil {
 		return errors.Wrap(err, "set shard's StatusDone")
 	}
 
-	if im.IsLeader() {
+	if bcp.IsLeader(im) {
 		err = b.reconcileStatus(bcp.Name, pbm.StatusDone, im, nil)
 		if err != nil {
 			return errors.Wrap(err, "check cluster for backup done")
 		}
 
+		err = b.checkCoverage(bcp.Name, im, stg)
+		if err != nil {
+			return errors.Wrap(err, "check shards coverage")
+		}
+
+		err = b.markPartlyDone(bcp.Name)
+		if err != nil {
+			return errors.Wrap(err, "check for failed shards")
+		}
+
 		err = b.dumpClusterMeta(bcp.Name, stg)
 		if err != nil {
 			return errors.Wrap(err, "dump metadata")
 		}
+
+		b.replace(bcp, stg)
 	}
 
 	return nil
 }
 
+// oplogStart returns the position the replset's oplog slice starts from.
+// The retry on the another node keeps the position recorded by the failed
+// one if the node's oplog still has it: the oplog replay over the later
+// dump is idempotent, the same as for the initial sync.
+// The oplog-only backup starts from the requested point.
+func (b *Backup) oplogStart(ctx context.Context, oplog *Oplog, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset) (primitive.Timestamp, error) {
+	if rsMeta.FirstWriteTS.T > 0 {
+		first, err := oplog.FirstTS()
+		if err == nil && primitive.CompareTimestamp(first, rsMeta.FirstWriteTS) <= 0 {
+			return rsMeta.FirstWriteTS, nil
+		}
+		if err != nil {
+			b.jlog.Warningf("start", "check the recorded oplog start: %v", err)
+		} else {
+			b.jlog.Infof("start", "oplog on the node starts at %v, after the recorded %v", first, rsMeta.FirstWriteTS)
+		}
+	}
+	if bcp.Type == pbm.BackupTypeOplog {
+		return oplog.StartAt(ctx, bcp.OplogFrom)
+	}
+	// the dump is consistent at the node's own last write, it's behind
+	// the one of the oplog source if the node is the delayed member
+	lw, err := NewOplog(b.node).LastWrite()
+	if err != nil || b.cfg.Backup.Dump.MaxStalenessSec == 0 {
+		return lw, err
+	}
+
+	// the dump may be read from the member behind the node up to the max
+	// staleness, the oplog replay over the writes it already has is
+	// idempotent
+	from := primitive.Timestamp{T: lw.T - uint32(b.cfg.Backup.Dump.Staleness()/time.Second)}
+	first, err := oplog.FirstTS()
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "get oplog start")
+	}
+	if primitive.CompareTimestamp(first, from) > 0 {
+		from = first
+	}
+	return oplog.StartAt(ctx, from)
+}
+
+// sourceOplog returns the oplog the replset's slice is read from. It's the
+// node's own one unless the node is the delayed member: its oplog is behind
+// by the delay, so the slice from the point the member has applied up to
+// the cluster last write is read from the primary instead.
+func (b *Backup) sourceOplog(bcpName string, rsMeta pbm.BackupReplset) (*Oplog, error) {
+	delay, err := b.node.Delay()
+	if err != nil {
+		return nil, errors.Wrap(err, "get node delay")
+	}
+	if delay == 0 {
+		// the failed attempt was made on the delayed member,
+		// its record stays with its dump if that is done
+		if rsMeta.Delayed != nil && !rsMeta.DumpDone() {
+			err = b.cn.SetRSDelayed(bcpName, rsMeta.Name, nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "unset shard's delayed source")
+			}
+		}
+		return NewOplog(b.node), nil
+	}
+
+	applied, err := NewOplog(b.node).LastWrite()
+	if err != nil {
+		return nil, errors.Wrap(err, "get node last write")
+	}
+	b.primary, err = b.node.ConnectPrimary("pbm-agent-oplog")
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to primary")
+	}
+	pim, err := b.primary.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get primary isMaster")
+	}
+
+	oplog := NewOplog(b.primary)
+	first, err := oplog.FirstTS()
+	if err != nil {
+		return nil, errors.Wrap(err, "get primary oplog start")
+	}
+	if primitive.CompareTimestamp(first, applied) > 0 {
+		return nil, errors.Errorf("oplog on the primary %s starts at %v, after %v applied by the node delayed by %ds", pim.Me, first, applied, delay)
+	}
+
+	b.jlog.Infof("start", "node is delayed by %ds and has applied %v, reading the oplog from the primary %s", delay, applied, pim.Me)
+	err = b.cn.SetRSDelayed(bcpName, rsMeta.Name, &pbm.DelayedSource{DelaySec: delay, AppliedTS: applied, OplogFrom: pim.Me})
+	if err != nil {
+		return nil, errors.Wrap(err, "set shard's delayed source")
+	}
+	return oplog, nil
+}
+
+// watchCancel cancels the ctx if the backup has failed (e.g. was aborted
+// by the leader due to the timeout or failed on the other replset)
+func (b *Backup) watchCancel(ctx context.Context, cancel context.CancelFunc, bcpName string) {
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			bmeta, err := b.cn.GetBackupMeta(bcpName)
+			if err != nil {
+				log.Println("[ERROR] check backup state:", err)
+				continue
+			}
+			if bmeta.Status == pbm.StatusError {
+				// cancel first, the fsync-locked standalone node
+				// can't take the log entry until it's released
+				cancel()
+				b.jlog.Warningf("cancel", "backup has been canceled: %s", bmeta.Error)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// markPartlyDone sets StatusPartlyDone for the backup if some replsets have failed.
+// It may happen only with FailurePolicyPartial.
+func (b *Backup) markPartlyDone(bcpName string) error {
+	bmeta, err := b.cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+
+	failed := bmeta.FailedReplsets()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return b.cn.ChangeBackupState(bcpName, pbm.StatusPartlyDone, "failed replsets: "+strings.Join(failed, ", "))
+}
+
+// nonTransientErrs are the markers of errors which won't go away by themselves,
+// so there is no sense to restart the backup
+var nonTransientErrs = []string{
+	"Authentication failed",
+	"not authorized",
+	"Unauthorized",
+	"AccessDenied",
+	"InvalidAccessKeyId",
+	"SignatureDoesNotMatch",
+	"NoSuchBucket",
+	"no space left on device",
+	"disk quota exceeded",
+	"store is doesn't set",
+	"backup is not allowed at the moment",
+}
+
+// IsTransient returns false if the backup error is not expected
+// to go away on the backup restart (e.g. auth error or no space left)
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, e := range nonTransientErrs {
+		if strings.Contains(msg, e) {
+			return false
+		}
+	}
+	return true
+}
+
 const maxReplicationLagTimeSec = 21
 
 // NodeSuits checks if node can perform backup
-func NodeSuits(bcp pbm.BackupCmd, node *pbm.Node) (bool, error) {
+func NodeSuits(bcp pbm.BackupCmd, node *pbm.Node, cfg pbm.BackupConf) (bool, error) {
 	im, err := node.GetIsMaster()
 	if err != nil {
 		return false, errors.Wrap(err, "get isMaster data for node")
 	}
 
 	if im.IsStandalone() {
-		return false, errors.New("mongod node can not be used to fetch a consistent backup because it has no oplog. Please restart it as a primary in a single-node replicaset to make it compatible with PBM's backup method using the oplog")
+		if !bcp.FsyncLock {
+			return false, errors.New("mongod node can not be used to fetch a consistent backup because it has no oplog. Please restart it as a primary in a single-node replicaset to make it compatible with PBM's backup method using the oplog or make the backup with the fsync lock")
+		}
+		return diskSuits(node, cfg)
+	}
+
+	// locking the primary would block the writes to the whole
+	// replset including the PBM control collections
+	if bcp.FsyncLock && im.IsMaster {
+		if len(im.Hosts) < 2 {
+			return false, errors.New("fsync lock of the primary of the single-node replset isn't possible, use the regular backup")
+		}
+		return false, nil
 	}
 
 	// for the cases when no secondary was good enough for backup or there are no secondaries alive
@@ -253,12 +1003,96 @@ func NodeSuits(bcp pbm.BackupCmd, node *pbm.Node) (bool, error) {
 		return false, errors.Wrap(err, "get node replication lag")
 	}
 
-	return replLag < maxReplicationLagTimeSec && status.Health == pbm.NodeHealthUp &&
+	// the delayed member is behind by design, the oplog it lacks
+	// is read from the primary (see Backup.sourceOplog)
+	if cfg.Delayed {
+		delay, err := node.Delay()
+		if err != nil {
+			return false, errors.Wrap(err, "get node delay")
+		}
+		replLag -= int(delay)
+	}
+
+	maxLag := maxReplicationLagTimeSec
+	if cfg.MaxReplLagSec > 0 {
+		maxLag = cfg.MaxReplLagSec
+	}
+	if replLag >= maxLag {
+		log.Printf("Node replication lag %ds exceeds %ds", replLag, maxLag)
+		return false, nil
+	}
+
+	ok, err := diskSuits(node, cfg)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return status.Health == pbm.NodeHealthUp &&
 			(status.State == pbm.NodeStatePrimary || status.State == pbm.NodeStateSecondary),
 		nil
 }
 
+// diskSuits checks if the node has enough free disk space
+func diskSuits(node *pbm.Node, cfg pbm.BackupConf) (bool, error) {
+	if cfg.MinFreeDiskMB <= 0 {
+		return true, nil
+	}
+
+	dbpath, err := node.DBPath()
+	if err != nil {
+		return false, errors.Wrap(err, "get node dbpath")
+	}
+	free, err := pbm.DiskFree(dbpath)
+	if err != nil {
+		return false, errors.Wrap(err, "get node free disk space")
+	}
+	if free < uint64(cfg.MinFreeDiskMB)<<20 {
+		log.Printf("Node free disk space %dMB is less than %dMB", free>>20, cfg.MinFreeDiskMB)
+		return false, nil
+	}
+	return true, nil
+}
+
 // rwErr multierror for the read/compress/write-to-store operations set
+// balancerHoldWait is how long the shard waits for the mongos
+// agent to stop the balancer before it starts the dump
+const balancerHoldWait = time.Minute * 3
+
+// waitBalancerHeld waits until the mongos agent (if there is any) has
+// stopped the balancer, so no chunks migrate during the dump
+func (b *Backup) waitBalancerHeld(ctx context.Context, bcpName string) error {
+	ok, err := b.cn.HasMongosAgent()
+	if err != nil {
+		return errors.Wrap(err, "check mongos agents")
+	}
+	if !ok {
+		b.jlog.Warningf("dump", "no mongos agent, the balancer isn't stopped for the backup")
+		return nil
+	}
+
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+	tout := time.NewTimer(balancerHoldWait)
+	defer tout.Stop()
+	for {
+		meta, err := b.cn.GetBackupMeta(bcpName)
+		if err != nil {
+			return errors.Wrap(err, "get backup metadata")
+		}
+		if meta.BalancerHeld {
+			return nil
+		}
+
+		select {
+		case <-tk.C:
+		case <-tout.C:
+			return errors.Errorf("the mongos agent hasn't stopped the balancer in %v", balancerHoldWait)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 type rwErr struct {
 	read     error
 	compress error
@@ -283,20 +1117,44 @@ func (rwe rwErr) nil() bool {
 	return rwe.read == nil && rwe.compress == nil && rwe.write == nil
 }
 
-func (b *Backup) oplog(oplog *Oplog, startTS, endTS primitive.Timestamp, stg pbm.Storage, name string, compression pbm.CompressionType) error {
+func (b *Backup) oplog(ctx context.Context, oplog *Oplog, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, startTS, endTS primitive.Timestamp, stg pbm.Storage) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	r, pw := io.Pipe()
 	defer r.Close()
 
-	w := Compress(pw, compression)
+	hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeOplog, bcp.Name, rsMeta.Name, bcp.Compression)
+	hdr.OplogStart = startTS
+	hdr.CreatedAt = time.Now().UTC().Unix()
+
+	tpw, tr := b.times.wrapPipe(pw, r)
+	w := b.compress(tpw, bcp.Compression)
+
+	// the entries are batched so the compressor and the storage get
+	// the large writes instead of the one per document
+	bw := newBatchWriter(w, b.cfg.Backup.OplogBatchSize(), b.cfg.Backup.OplogFlushInterval())
 
 	var err rwErr
 	go func() {
-		err.read = oplog.SliceTo(b.cn.Context(), w, startTS, endTS)
+		err.read = pbm.WriteArchiveHeader(pw, hdr)
+		if err.read == nil {
+			err.read = oplog.SliceTo(ctx, b.throttle.wrap(b.times.wrapSource(bw)), startTS, endTS)
+		}
+		ferr := bw.Close()
+		if err.read == nil {
+			err.read = ferr
+		}
 		err.compress = w.Close()
 		pw.Close()
 	}()
 
-	err.write = Save(r, stg, name)
+	// the slice can't be larger than the oplog since the entries beyond are rolled over
+	size, serr := b.node.OplogMaxSize()
+	if serr != nil {
+		b.jlog.Warningf("oplog", "unable to define the oplog size, the default upload part size is used: %v", serr)
+	}
+	err.write = b.save(tr, stg, rsMeta.OplogName, hdr.Compression, size)
 
 	if !err.nil() {
 		return err
@@ -305,10 +1163,65 @@ func (b *Backup) oplog(oplog *Oplog, startTS, endTS primitive.Timestamp, stg pbm
 	return nil
 }
 
+// watchOplogLag periodically reports how far the oplog captured by the backup
+// is behind the cluster time and cancels the backup if the lag exceeds
+// the configured limit. It runs from the oplog start, so while the dump is
+// going and nothing is sliced yet the lag is counted from startTS and
+// the node's oplog is checked to still have it.
+func (b *Backup) watchOplogLag(ctx context.Context, cancel context.CancelFunc, oplog *Oplog, startTS primitive.Timestamp, bcpName, rsName string, lagErr chan<- error) {
+	maxLag := b.cfg.Backup.MaxOplogLagSec
+
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			ct, err := b.cn.ClusterTime()
+			if err != nil {
+				log.Println("[ERROR] oplog lag: read cluster time:", err)
+				continue
+			}
+			pos := oplog.LastTS()
+			if pos.T == 0 {
+				pos = startTS
+				first, err := oplog.FirstTS()
+				if err != nil {
+					log.Println("[ERROR] oplog lag: read the first oplog entry:", err)
+				} else if primitive.CompareTimestamp(first, startTS) == 1 {
+					lagErr <- errors.Errorf("oplog has been rolled over during the dump: the first available entry %v is after the start point %v", first, startTS)
+					cancel()
+					return
+				}
+			}
+			lag := int(ct.T) - int(pos.T)
+			if lag < 0 {
+				lag = 0
+			}
+
+			err = b.cn.SetRSOplogLag(bcpName, rsName, lag)
+			if err != nil {
+				log.Println("[ERROR] oplog lag: write to db:", err)
+			}
+
+			if maxLag > 0 && lag > maxLag {
+				lagErr <- errors.Errorf("oplog lag %ds exceeds the limit of %ds", lag, maxLag)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (b *Backup) reconcileStatus(bcpName string, status pbm.Status, im *pbm.IsMaster, timeout *time.Duration) error {
+	rsName := im.SetName
+	if rsName == "" {
+		rsName = pbm.NoReplset
+	}
 	shards := []pbm.Shard{
 		{
-			ID:   im.SetName,
+			ID:   rsName,
 			Host: im.SetName + "/" + strings.Join(im.Hosts, ","),
 		},
 	}
@@ -318,7 +1231,22 @@ func (b *Backup) reconcileStatus(bcpName string, status pbm.Status, im *pbm.IsMa
 		if err != nil {
 			return errors.Wrap(err, "get shards list")
 		}
-		shards = append(shards, s...)
+		for _, sh := range s {
+			// the leader may be a shard if the backup is of the replsets subset
+			if sh.ID != rsName {
+				shards = append(shards, sh)
+			}
+		}
+	}
+
+	if len(b.subset) > 0 {
+		sub := shards[:0]
+		for _, sh := range shards {
+			if (pbm.BackupCmd{Replsets: b.subset}).Includes(sh.ID) {
+				sub = append(sub, sh)
+			}
+		}
+		shards = sub
 	}
 
 	if timeout != nil {
@@ -379,6 +1307,12 @@ func (b *Backup) converged(bcpName string, shards []pbm.Shard, status pbm.Status
 	if err != nil {
 		return false, errors.Wrap(err, "get backup metadata")
 	}
+	policy := bmeta.FailurePolicy
+
+	// backup might be aborted (e.g. due to the backup window)
+	if bmeta.Status == pbm.StatusError {
+		return false, errors.Errorf("backup failed with: %s", bmeta.Error)
+	}
 
 	clusterTime, err := b.cn.ClusterTime()
 	if err != nil {
@@ -396,13 +1330,27 @@ func (b *Backup) converged(bcpName string, shards []pbm.Shard, status pbm.Status
 				})
 
 				// nodes are cleaning its locks moving to the done status
-				// so no lock is ok and no need to ckech the heartbeats
-				if status != pbm.StatusDone && err != mongo.ErrNoDocuments {
+				// so no lock is ok and no need to ckech the heartbeats.
+				// The same is for the failed shard which lock has been released.
+				if status != pbm.StatusDone && shard.Status != pbm.StatusError && err != mongo.ErrNoDocuments {
 					if err != nil {
 						return false, errors.Wrapf(err, "unable to read lock for shard %s", shard.Name)
 					}
 					if lock.Heartbeat.T+pbm.StaleFrameSec < clusterTime.T {
-						return false, errors.Errorf("lost shard %s, last beat ts: %d", shard.Name, lock.Heartbeat.T)
+						lost := fmt.Sprintf("lost node %s, last beat ts: %d", lock.Node, lock.Heartbeat.T)
+						shard.Lost = true
+						if !bmeta.RetryAllowed(shard) {
+							return false, errors.Errorf("lost shard %s: %s", shard.Name, lost)
+						}
+						// let the standby nodes of the replset take over
+						err = b.cn.MarkRSLost(bcpName, shard.Name, lost)
+						if err != nil {
+							return false, errors.Wrapf(err, "mark shard %s failed", shard.Name)
+						}
+						b.jlog.Warningf("reconcile", "%s: %s, switching to the another node", shard.Name, lost)
+						shard.Status = pbm.StatusError
+						shard.Error = lost
+						shard.LastTransitionTS = int64(clusterTime.T)
 					}
 				}
 
@@ -411,6 +1359,13 @@ func (b *Backup) converged(bcpName string, shards []pbm.Shard, status pbm.Status
 				case status:
 					shardsToFinish--
 				case pbm.StatusError:
+					switch {
+					case b.retryPending(bmeta, shard, status, clusterTime):
+						continue
+					case policy == pbm.FailurePolicyPartial:
+						shardsToFinish--
+						continue
+					}
 					bmeta.Status = pbm.StatusError
 					bmeta.Error = shard.Error
 					return false, errors.Errorf("backup on the shard %s failed with: %s", shard.Name, bmeta.Error)
@@ -430,6 +1385,40 @@ func (b *Backup) converged(bcpName string, shards []pbm.Shard, status pbm.Status
 	return false, nil
 }
 
+// retryPending returns true if the failed shard still can be picked up by the another node.
+// Retry is possible until cluster reached StatusDumpDone (or StatusDone if the shard's
+// dump is done and only the oplog is to be redone) and the shard has attempts left,
+// see pbm.BackupMeta.RetryAllowed.
+// Standby nodes have WaitActionStart to pick up the failed shard after
+// the failed node released the lock.
+func (b *Backup) retryPending(bmeta *pbm.BackupMeta, shard pbm.BackupReplset, status pbm.Status, clusterTime primitive.Timestamp) bool {
+	switch status {
+	case pbm.StatusRunning, pbm.StatusDumpDone:
+	case pbm.StatusDone:
+		// only the oplog is left to redo
+		if !shard.DumpDone() {
+			return false
+		}
+	default:
+		return false
+	}
+	if !bmeta.RetryAllowed(shard) {
+		return false
+	}
+
+	// lock is still held by the failed node, so give it a time to release
+	lock, err := b.cn.GetLockData(&pbm.LockHeader{
+		Type:       pbm.CmdBackup,
+		BackupName: bmeta.Name,
+		Replset:    shard.Name,
+	})
+	if err == nil && !lock.IsStale(clusterTime) {
+		return true
+	}
+
+	return int64(clusterTime.T) <= shard.LastTransitionTS+int64(2*pbm.WaitActionStart/time.Second)
+}
+
 func (b *Backup) waitForStatus(bcpName string, status pbm.Status) error {
 	tk := time.NewTicker(time.Second * 1)
 	defer tk.Stop()
@@ -454,7 +1443,7 @@ func (b *Backup) waitForStatus(bcpName string, status pbm.Status) error {
 			case status:
 				return nil
 			case pbm.StatusError:
-				return errors.Wrap(err, "backup failed")
+				return errors.New("backup failed")
 			}
 		case <-b.cn.Context().Done():
 			return nil
@@ -472,6 +1461,9 @@ func (b *Backup) waitForLastWrite(bcpName string) (primitive.Timestamp, error) {
 			if err != nil {
 				return primitive.Timestamp{}, errors.Wrap(err, "get backup metadata")
 			}
+			if bmeta.Status == pbm.StatusError {
+				return primitive.Timestamp{}, errors.Errorf("backup failed with: %s", bmeta.Error)
+			}
 			if bmeta.LastWriteTS.T > 0 {
 				return bmeta.LastWriteTS, nil
 			}
@@ -487,17 +1479,98 @@ func (b *Backup) dumpClusterMeta(bcpName string, stg pbm.Storage) error {
 		return errors.Wrap(err, "get backup metadata")
 	}
 
-	return writeMeta(stg, meta)
+	key, err := b.cfg.Signing.SignKey()
+	if err != nil {
+		return errors.Wrap(err, "get manifest signing key")
+	}
+
+	err = writeMeta(stg, meta, key)
+	if err != nil {
+		return err
+	}
+
+	if meta.ExpireAt > 0 || meta.LegalHold {
+		err = protect(stg, meta, meta.Files())
+		if err != nil {
+			return errors.Wrap(err, "apply retention")
+		}
+	}
+
+	return nil
 }
 
-func writeMeta(stg pbm.Storage, meta *pbm.BackupMeta) error {
+// replace deletes the backup which the done one replaces and gives
+// the done one its name. The backup stays under the staged name if the
+// replacement fails, since it's complete anyway.
+func (b *Backup) replace(bcp pbm.BackupCmd, stg pbm.Storage) {
+	if bcp.Replaces == "" {
+		return
+	}
+
+	err := b.doReplace(bcp, stg)
+	if err == nil {
+		b.jlog.Infof("replace", "backup %s is replaced", bcp.Replaces)
+		return
+	}
+	b.jlog.Warningf("replace", "backup %s isn't replaced, the new one is kept as %s: %v", bcp.Replaces, bcp.Name, err)
+	err = b.cn.UnsetReplaces(bcp.Name)
+	if err != nil {
+		b.jlog.Errorf("replace", "unmark the replacement: %v", err)
+	}
+}
+
+func (b *Backup) doReplace(bcp pbm.BackupCmd, stg pbm.Storage) error {
+	meta, err := b.cn.GetBackupMeta(bcp.Name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	// the partly done backup doesn't replace the complete one
+	if meta.Status != pbm.StatusDone {
+		return errors.Errorf("backup is %s", meta.Status)
+	}
+
+	err = DeleteBackup(b.cn, bcp.Replaces)
+	if err != nil {
+		return errors.Wrap(err, "delete the replaced backup")
+	}
+	err = b.cn.RenameBackup(bcp.Name, bcp.Replaces)
+	if err != nil {
+		return errors.Wrap(err, "rename metadata")
+	}
+	err = b.dumpClusterMeta(bcp.Replaces, stg)
+	if err != nil {
+		return errors.Wrap(err, "dump metadata")
+	}
+	// the staged manifest is left over at worst, it's of the same backup
+	for _, f := range []string{bcp.Name + ".pbm.json", bcp.Name + ".pbm.json" + pbm.SignatureSuffix} {
+		err = Delete(stg, f)
+		if err != nil {
+			b.jlog.Warningf("replace", "delete the staged %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+// writeMeta stores the backup meta (the manifest) and its detached
+// signature if the key is given. Otherwise the signature left by
+// the previous write is removed since it doesn't match anymore.
+func writeMeta(stg pbm.Storage, meta *pbm.BackupMeta, key ed25519.PrivateKey) error {
 	b, err := json.MarshalIndent(meta, "", "\t")
 	if err != nil {
 		return errors.Wrap(err, "marshal data")
 	}
 
-	err = Save(bytes.NewReader(b), stg, meta.Name+".pbm.json")
-	return errors.Wrap(err, "write to store")
+	name := meta.Name + ".pbm.json"
+	err = Save(bytes.NewReader(b), stg, name)
+	if err != nil {
+		return errors.Wrap(err, "write to store")
+	}
+
+	if key == nil {
+		return errors.Wrap(Delete(stg, name+pbm.SignatureSuffix), "delete stale signature")
+	}
+	err = Save(bytes.NewReader(pbm.SignManifest(key, b)), stg, name+pbm.SignatureSuffix)
+	return errors.Wrap(err, "write signature to store")
 }
 
 func (b *Backup) setClusterLastWrite(bcpName string) error {
@@ -507,28 +1580,76 @@ func (b *Backup) setClusterLastWrite(bcpName string) error {
 	}
 
 	lw := primitive.Timestamp{}
+	// the backup is consistent once every replset's dump is majority
+	// committed, it's unknown if any replset hasn't recorded its point
+	ct := primitive.Timestamp{}
+	known := true
 	for _, rs := range bmeta.Replsets {
 		if primitive.CompareTimestamp(lw, rs.LastWriteTS) == -1 {
 			lw = rs.LastWriteTS
 		}
+		if rs.DumpEnd == nil {
+			known = false
+		} else if primitive.CompareTimestamp(ct, rs.DumpEnd.Majority.TS) == -1 {
+			ct = rs.DumpEnd.Majority.TS
+		}
 	}
 
 	err = b.cn.SetLastWrite(bcpName, lw)
-	return errors.Wrap(err, "set timestamp")
+	if err != nil {
+		return errors.Wrap(err, "set timestamp")
+	}
+	if !known || ct.T == 0 {
+		return nil
+	}
+	err = b.cn.SetConsistentTS(bcpName, ct)
+	return errors.Wrap(err, "set consistent timestamp")
 }
 
-func (b *Backup) dump(stg pbm.Storage, name string, compression pbm.CompressionType) error {
+// setDumpPoint records the replset's majority commit point
+// and the cluster time at the dump start or end
+func (b *Backup) setDumpPoint(bcpName, rsName string, end bool) error {
+	im, err := b.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster")
+	}
+	if end {
+		return b.cn.SetRSDumpEnd(bcpName, rsName, im.CausalPoint())
+	}
+	return b.cn.SetRSDumpStart(bcpName, rsName, im.CausalPoint())
+}
+
+// dump writes the archive header followed by the compressed mongodump archive.
+// If dbName is set only the given database except `exclude` collections is dumped,
+// if collName is set as well only this collection is dumped.
+// The dump is streamed mongodump -> compression -> upload through the
+// pipe and the upload part buffers, nothing is staged on the local disk.
+func (b *Backup) dump(ctx context.Context, stg pbm.Storage, name string, hdr *pbm.ArchiveHeader, dbName, collName string, exclude []string) error {
 	r, pw := io.Pipe()
-	w := Compress(pw, compression)
+	defer r.Close()
+	rsName := hdr.Replset
+	if rsName == pbm.NoReplset {
+		rsName = ""
+	}
+	curi, cerr := b.cfg.Backup.DumpURI(b.node.ConnURI(), rsName)
+	if cerr != nil {
+		return errors.Wrap(cerr, "define dump connection")
+	}
+
+	tpw, tr := b.times.wrapPipe(pw, r)
+	w := b.compress(tpw, hdr.Compression)
 
 	var err rwErr
 	go func() {
-		err.read = mdump(w, b.node.ConnURI())
+		err.read = pbm.WriteArchiveHeader(pw, hdr)
+		if err.read == nil {
+			err.read = mdump(ctx, b.progress.wrap(b.throttle.wrap(b.times.wrapSource(w))), curi, dbName, collName, exclude, b.parallel, hdr.NoDocs)
+		}
 		err.compress = w.Close()
 		pw.Close()
 	}()
 
-	err.write = Save(r, stg, name)
+	err.write = b.save(tr, stg, name, hdr.Compression, b.dumpSize(dbName, collName))
 
 	if !err.nil() {
 		return err
@@ -537,13 +1658,90 @@ func (b *Backup) dump(stg pbm.Storage, name string, compression pbm.CompressionT
 	return nil
 }
 
-func mdump(to io.Writer, curi string) error {
+// compress returns the compressing writer. In the dedup mode the stream
+// is left as is since chunks are compressed individually.
+func (b *Backup) compress(w io.Writer, compression pbm.CompressionType) io.WriteCloser {
+	if b.dedup {
+		return NopCloser{w}
+	}
+	return CompressLevel(w, compression, b.prof.CompressionLevel)
+}
+
+// dumpSize returns the uncompressed size of the collections the dump
+// of the db (or of the collection) takes, of the whole node if dbName
+// isn't set. It's 0 if the sizes aren't known.
+func (b *Backup) dumpSize(dbName, collName string) int64 {
+	var size int64
+	for _, c := range b.colls {
+		switch {
+		case collName != "" && c.NS != dbName+"."+collName:
+		case dbName != "" && !strings.HasPrefix(c.NS, dbName+"."):
+		default:
+			size += c.Size
+		}
+	}
+	return size
+}
+
+// save uploads the file. The upload part size is raised if needed
+// so the file of the expected size (0 if unknown) fits into the upload.
+func (b *Backup) save(r io.Reader, stg pbm.Storage, name string, compression pbm.CompressionType, size int64) error {
+	if b.dedup {
+		return SaveDedup(r, stg, name, compression)
+	}
+	opts := b.upload.ForSize(size)
+	if opts.PartSize > b.upload.PartSize {
+		b.jlog.Warningf("upload", "%s is expected to take up to %dMB, the upload part size is raised to %dMB beyond the memory limit",
+			name, size>>20, opts.PartSize>>20)
+	}
+	sum, err := SaveChecked(r, stg, name, opts)
+	if err != nil {
+		return err
+	}
+	b.sums = append(b.sums, sum)
+	return nil
+}
+
+// storeChecksums writes the checksums of the files uploaded so far into the meta.
+// It is done apart from the uploads since the meta can't be written while
+// the standalone node is fsync-locked.
+func (b *Backup) storeChecksums(bcpName, rsName string) error {
+	if len(b.sums) == 0 {
+		return nil
+	}
+	err := b.cn.SetRSChecksums(bcpName, rsName, b.sums)
+	if err != nil {
+		return err
+	}
+	b.sums = nil
+	return nil
+}
+
+// Dump writes the mongodump archive of the whole node into `to`
+func Dump(ctx context.Context, to io.Writer, curi string) error {
+	return mdump(ctx, to, curi, "", "", nil, 1, false)
+}
+
+// DumpNS writes the mongodump archive of the database (or
+// the collection if `collName` is set) into `to`
+func DumpNS(ctx context.Context, to io.Writer, curi, dbName, collName string) error {
+	return mdump(ctx, to, curi, dbName, collName, nil, 1, false)
+}
+
+// mdump writes the mongodump archive into `to`. With `parallel` > 1 the
+// collections are dumped concurrently, the largest ones first.
+// With `noDocs` only the collections metadata is dumped.
+func mdump(ctx context.Context, to io.Writer, curi string, dbName, collName string, exclude []string, parallel int, noDocs bool) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
 	opts := options.ToolOptions{
 		AppName:    "mongodump",
 		VersionStr: "0.0.1",
 		URI:        &options.URI{ConnectionString: curi},
 		Auth:       &options.Auth{},
-		Namespace:  &options.Namespace{},
+		Namespace:  &options.Namespace{DB: dbName, Collection: collName},
 		Connection: &options.Connection{},
 	}
 
@@ -554,7 +1752,7 @@ func mdump(to io.Writer, curi string) error {
 			// instead of creating a file. This is not clear at plain sight,
 			// you nee to look the code to discover it.
 			Archive:                "-",
-			NumParallelCollections: 1,
+			NumParallelCollections: parallel,
 		},
 		InputOptions:    &mongodump.InputOptions{},
 		SessionProvider: &db.SessionProvider{},
@@ -565,7 +1763,30 @@ func mdump(to io.Writer, curi string) error {
 	if err != nil {
 		return errors.Wrap(err, "init")
 	}
-	return errors.Wrap(d.Dump(), "make dump")
+	// mongodump validates the exclusions are made only along with --db but
+	// applies them to the whole node dump as well, by the name in every db
+	d.OutputOptions.ExcludedCollections = exclude
+	// the same goes for the query, the empty $in is resolved by the _id
+	// index without reading the collection
+	if noDocs {
+		d.InputOptions.Query = noDocsQuery
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.HandleInterrupt()
+		case <-done:
+		}
+	}()
+
+	err = d.Dump()
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "dump canceled")
+	}
+	return errors.Wrap(err, "make dump")
 }
 
 func getDstName(typ string, bcp pbm.BackupCmd, rsName string) string {
@@ -589,6 +1810,17 @@ func getDstName(typ string, bcp pbm.BackupCmd, rsName string) string {
 	return name
 }
 
+// markFailed marks as failed either the whole backup or only the given replset
+// depending on the failure policy. The failure of the leader fails the whole backup
+// regardless of the policy since there is no one to finish the backup.
+func (b *Backup) markFailed(bcpName, rsName, msg string, policy pbm.FailurePolicy, leader bool) error {
+	if policy == pbm.FailurePolicyAbort || leader {
+		return b.MarkFailed(bcpName, rsName, msg)
+	}
+
+	return errors.Wrap(b.cn.ChangeRSState(bcpName, rsName, pbm.StatusError, msg), "set replset state")
+}
+
 // MarkFailed set state of backup and given rs as error with msg
 func (b *Backup) MarkFailed(bcpName, rsName, msg string) error {
 	err := b.cn.ChangeBackupState(bcpName, pbm.StatusError, msg)
@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// batchWriter buffers the small writes (e.g. the oplog entries) and passes
+// them down by the batches of up to size bytes. The batch is flushed when
+// it's full or when its first bytes have been buffered for the interval.
+// On the interval the underlying writer is flushed as well if it can be
+// (e.g. the compressor), so the entries of the quiet oplog aren't held
+// in the compressor's buffer. Note that the object storages upload by
+// parts and still keep the data until the part is full or the slice ends.
+type batchWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	buf      []byte
+	first    time.Time
+	interval time.Duration
+	err      error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBatchWriter(w io.Writer, size int, interval time.Duration) *batchWriter {
+	b := &batchWriter{
+		w:        w,
+		buf:      make([]byte, 0, size),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.flushLoop()
+	return b
+}
+
+func (b *batchWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(b.buf)+len(p) > cap(b.buf) {
+		err := b.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// nothing to batch it with
+	if len(p) >= cap(b.buf) {
+		n, err := b.w.Write(p)
+		b.err = err
+		return n, err
+	}
+
+	if len(b.buf) == 0 {
+		b.first = time.Now()
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// flush writes the buffered batch. It has to be called under the lock.
+func (b *batchWriter) flush() error {
+	if b.err != nil || len(b.buf) == 0 {
+		return b.err
+	}
+	_, b.err = b.w.Write(b.buf)
+	b.buf = b.buf[:0]
+	return b.err
+}
+
+// flusher is the writer which buffers the data itself, e.g. the compressor
+type flusher interface {
+	Flush() error
+}
+
+// flushAll writes the buffered batch and flushes the underlying writer.
+// It has to be called under the lock.
+func (b *batchWriter) flushAll() error {
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+	if f, ok := b.w.(flusher); ok {
+		b.err = f.Flush()
+	}
+	return b.err
+}
+
+func (b *batchWriter) flushLoop() {
+	defer close(b.done)
+
+	tk := time.NewTicker(b.interval / 2)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			b.mu.Lock()
+			if len(b.buf) > 0 && time.Since(b.first) >= b.interval {
+				b.flushAll()
+			}
+			b.mu.Unlock()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close flushes the rest of the buffer. It doesn't close the underlying writer.
+func (b *batchWriter) Close() error {
+	close(b.stop)
+	<-b.done
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is the buffer written by the flush loop and read by the test
+type syncBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writes++
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestBatchWriterSize(t *testing.T) {
+	dst := &syncBuffer{}
+	bw := newBatchWriter(dst, 100, time.Hour)
+
+	entry := strings.Repeat("e", 10)
+	for i := 0; i < 25; i++ {
+		bw.Write([]byte(entry))
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.writes != 3 {
+		t.Errorf("got %d writes, want 3", dst.writes)
+	}
+	if got := string(dst.Bytes()); got != strings.Repeat(entry, 25) {
+		t.Errorf("got %d bytes, want %d", len(got), 25*len(entry))
+	}
+}
+
+func TestBatchWriterFlushesCompressor(t *testing.T) {
+	dst := &syncBuffer{}
+	gw := gzip.NewWriter(dst)
+	bw := newBatchWriter(gw, 1<<20, time.Millisecond*50)
+	defer bw.Close()
+
+	const entry = "quiet oplog entry"
+	bw.Write([]byte(entry))
+
+	// the entry has to get out of the compressor while the slice is still open
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		gr, err := gzip.NewReader(bytes.NewReader(dst.Bytes()))
+		if err == nil {
+			got := make([]byte, len(entry))
+			_, err = io.ReadFull(gr, got)
+			if err == nil && string(got) == entry {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the entry isn't flushed through the compressor on the interval")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
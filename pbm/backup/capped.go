@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// cappedSnapshot returns the first records (in the natural order) of the
+// capped collections. A capped collection has wrapped if its first record
+// has changed, so its dump made in between may miss or mix documents.
+func (b *Backup) cappedSnapshot(colls []pbm.NSInfo) (map[string]bson.Raw, error) {
+	snap := make(map[string]bson.Raw)
+	for _, c := range colls {
+		if !c.Capped || c.View {
+			continue
+		}
+		r, err := b.node.FirstRecord(c.NS)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get first record of %s", c.NS)
+		}
+		snap[c.NS] = r
+	}
+
+	return snap, nil
+}
+
+// wrapped returns true if the capped collection's first record differs from the snapshot
+func (b *Backup) wrapped(ns string, first bson.Raw) (bool, error) {
+	r, err := b.node.FirstRecord(ns)
+	if err != nil {
+		return false, errors.Wrapf(err, "get first record of %s", ns)
+	}
+	return !bytes.Equal(r, first), nil
+}
+
+// redumpCapped dumps once again, one by one, the capped collections which wrapped
+// during the main dump. A collection wrapping even during its own dump is
+// changing faster than it can be dumped and fails the backup.
+// The `redumps` made already are stored along with the new ones.
+func (b *Backup) redumpCapped(ctx context.Context, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, snap map[string]bson.Raw, dumped []string, redumps []pbm.Redump, oplogTS primitive.Timestamp, stg pbm.Storage) error {
+	done := make(map[string]bool, len(redumps))
+	for _, rd := range redumps {
+		done[rd.NS] = true
+	}
+	for _, ns := range dumped {
+		first, ok := snap[ns]
+		if !ok || done[ns] {
+			continue
+		}
+		wrapped, err := b.wrapped(ns, first)
+		if err != nil {
+			return err
+		}
+		if !wrapped {
+			continue
+		}
+
+		b.jlog.Infof("dump", "capped collection %s wrapped during the dump, dumping it once again", ns)
+		first, err = b.node.FirstRecord(ns)
+		if err != nil {
+			return errors.Wrapf(err, "get first record of %s", ns)
+		}
+
+		name := getDstName("redump-"+ns, bcp, rsMeta.Name)
+		hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, bcp.Compression)
+		hdr.OplogStart = oplogTS
+		hdr.Namespaces = []string{ns}
+		hdr.CreatedAt = time.Now().UTC().Unix()
+
+		db, coll := splitNS(ns)
+		err = b.dump(ctx, stg, name, hdr, db, coll, nil)
+		if err != nil {
+			return errors.Wrapf(err, "dump %s", ns)
+		}
+
+		wrapped, err = b.wrapped(ns, first)
+		if err != nil {
+			return err
+		}
+		if wrapped {
+			return errors.Errorf("capped collection %s wraps faster than it can be dumped: increase its size or exclude it from the backup", ns)
+		}
+		redumps = append(redumps, pbm.Redump{NS: ns, Name: name})
+	}
+
+	if len(redumps) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(b.cn.SetRSRedumps(bcp.Name, rsMeta.Name, redumps), "write redumps metadata")
+}
@@ -0,0 +1,280 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// ChainLink is the replset's part of the backup in the chain
+type ChainLink struct {
+	Backup string
+	Type   pbm.BackupType
+	// First and Last are the bounds of the backup's oplog slice.
+	// The data can be restored as of Last.
+	First primitive.Timestamp
+	Last  primitive.Timestamp
+	// Consistent is the backup's ConsistentTS, zero if it isn't known
+	Consistent primitive.Timestamp
+	// Broken is the reason the backup can't be restored, empty if it can
+	Broken string
+}
+
+// TimeRange is the range of the cluster time, both ends inclusive
+type TimeRange struct {
+	From primitive.Timestamp
+	To   primitive.Timestamp
+}
+
+func (r TimeRange) String() string {
+	return fmt.Sprintf("%d,%d - %d,%d", r.From.T, r.From.I, r.To.T, r.To.I)
+}
+
+// RestorePoint is the cluster time the data can be restored as of.
+// There is no point-in-time recovery, so these are only the consistency
+// points of the restorable backups.
+type RestorePoint struct {
+	Backup string
+	TS     primitive.Timestamp
+	// From is the start of the backup's window, its ConsistentTS. The
+	// offline restore may replay the oplog up to any point from it to TS.
+	// It's the same as TS if the backup's ConsistentTS isn't known.
+	From primitive.Timestamp
+}
+
+// MarshalJSON adds the wall clock time of the point for the readers
+// which don't deal with the cluster time
+func (p RestorePoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Backup   string              `json:"backup"`
+		TS       primitive.Timestamp `json:"ts"`
+		Time     string              `json:"time"`
+		From     primitive.Timestamp `json:"from"`
+		FromTime string              `json:"fromTime"`
+	}{
+		Backup:   p.Backup,
+		TS:       p.TS,
+		Time:     time.Unix(int64(p.TS.T), 0).UTC().Format(time.RFC3339),
+		From:     p.From,
+		FromTime: time.Unix(int64(p.From.T), 0).UTC().Format(time.RFC3339),
+	})
+}
+
+// point returns the restore point of the link
+func (l ChainLink) point() RestorePoint {
+	p := RestorePoint{Backup: l.Backup, TS: l.Last, From: l.Consistent}
+	if p.From.T == 0 || primitive.CompareTimestamp(p.From, p.TS) > 0 {
+		p.From = p.TS
+	}
+	return p
+}
+
+// ChainReport is the state of the replset's backups chain
+type ChainReport struct {
+	Replset string
+	// Links are the backups from the oldest
+	Links []ChainLink
+	// Gaps are the ranges not covered by any oplog slice
+	Gaps []TimeRange
+	// Points are the points the replset can be restored to, from the oldest
+	Points []RestorePoint
+}
+
+// Broken returns the links which can't be restored
+func (c *ChainReport) Broken() []ChainLink {
+	var b []ChainLink
+	for _, l := range c.Links {
+		if l.Broken != "" {
+			b = append(b, l)
+		}
+	}
+	return b
+}
+
+// ValidateChain checks that each successful backup has all its files in the
+// storage and its base (for the differential one) is restorable, and that
+// the oplog slices of the restorable backups form contiguous ranges. The
+// report is made for every replset, or for the given one only.
+func ValidateChain(cn *pbm.PBM, replset string) ([]ChainReport, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup store")
+	}
+
+	bcps, err := cn.BackupsList(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups list")
+	}
+	// backups list goes from the newest
+	for i, j := 0, len(bcps)-1; i < j; i, j = i+1, j-1 {
+		bcps[i], bcps[j] = bcps[j], bcps[i]
+	}
+
+	reports := make(map[string]*ChainReport)
+	var order []string
+	// replset -> backup -> the reason the backup is broken
+	broken := make(map[string]map[string]string)
+	for i := range bcps {
+		bcp := &bcps[i]
+		if bcp.Status != pbm.StatusDone && bcp.Status != pbm.StatusPartlyDone {
+			continue
+		}
+
+		for _, rs := range bcp.Replsets {
+			if rs.Status == pbm.StatusError || (replset != "" && rs.Name != replset) {
+				continue
+			}
+			rep, ok := reports[rs.Name]
+			if !ok {
+				rep = &ChainReport{Replset: rs.Name}
+				reports[rs.Name] = rep
+				order = append(order, rs.Name)
+				broken[rs.Name] = make(map[string]string)
+			}
+
+			l := ChainLink{
+				Backup:     bcp.Name,
+				Type:       bcp.Type,
+				First:      rs.FirstWriteTS,
+				Last:       bcp.LastWriteTS,
+				Consistent: bcp.ConsistentTS,
+			}
+			if l.First.T == 0 {
+				l.First = primitive.Timestamp{T: uint32(rs.StartTS)}
+			}
+
+			var problems []string
+			if rs.OplogName == "" {
+				problems = append(problems, "no oplog")
+			}
+			missed, err := missingFiles(stg, bcp, rs)
+			if err != nil {
+				return nil, errors.Wrapf(err, "check files of %s/%s", bcp.Name, rs.Name)
+			}
+			if len(missed) > 0 {
+				problems = append(problems, "missing files "+strings.Join(missed, ", "))
+			}
+			if bcp.Type == pbm.BackupTypeDifferential {
+				reason, known := broken[rs.Name][bcp.Base]
+				switch {
+				case !known:
+					problems = append(problems, "base backup "+bcp.Base+" not found")
+				case reason != "":
+					problems = append(problems, "base backup "+bcp.Base+" is broken")
+				}
+			}
+			l.Broken = strings.Join(problems, "; ")
+			broken[rs.Name][bcp.Name] = l.Broken
+
+			rep.Links = append(rep.Links, l)
+		}
+	}
+
+	list := make([]ChainReport, 0, len(order))
+	for _, rs := range order {
+		rep := reports[rs]
+		rep.Gaps = coverage(rep.Links)
+		for _, l := range rep.Links {
+			if l.Broken == "" && l.Type != pbm.BackupTypeSchema && l.Type != pbm.BackupTypeOplog {
+				rep.Points = append(rep.Points, l.point())
+			}
+		}
+		list = append(list, *rep)
+	}
+	return list, nil
+}
+
+// coverage returns the gaps between the contiguous ranges
+// the oplog slices of the restorable links make up. The schema
+// backups have no data to replay the oplog over, so they don't count.
+// The oplog-only backups have none either, they only extend the range
+// which reaches their start.
+func coverage(links []ChainLink) (gaps []TimeRange) {
+	var (
+		cur     TimeRange
+		started bool
+	)
+	for _, l := range links {
+		if l.Broken != "" || l.Type == pbm.BackupTypeSchema {
+			continue
+		}
+		oplogOnly := l.Type == pbm.BackupTypeOplog
+		switch {
+		case !started && oplogOnly:
+			continue
+		case !started:
+			cur, started = TimeRange{l.First, l.Last}, true
+		case primitive.CompareTimestamp(l.First, cur.To) <= 0:
+			if primitive.CompareTimestamp(l.Last, cur.To) == 1 {
+				cur.To = l.Last
+			}
+		case oplogOnly:
+			continue
+		default:
+			gaps = append(gaps, TimeRange{cur.To, l.First})
+			cur = TimeRange{l.First, l.Last}
+		}
+	}
+	return gaps
+}
+
+// ClusterPoints returns the points of the backups restorable on every
+// replset. Each point is a single backup, the points of the different
+// backups on the different replsets are never combined.
+func ClusterPoints(reports []ChainReport) []RestorePoint {
+	if len(reports) == 0 {
+		return nil
+	}
+
+	ok := make(map[string]int)
+	for _, r := range reports {
+		for _, p := range r.Points {
+			ok[p.Backup]++
+		}
+	}
+	var points []RestorePoint
+	for _, p := range reports[0].Points {
+		if ok[p.Backup] == len(reports) {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// RestorablePoints are the points the cluster can be restored to
+// from the stored backups
+type RestorablePoints struct {
+	// Replsets are the points of each replset
+	Replsets map[string][]RestorePoint `json:"replsets"`
+	// Cluster are the points restorable on all replsets
+	Cluster []RestorePoint `json:"cluster"`
+	// Broken is the number of the backups which can't be restored
+	Broken int `json:"broken"`
+}
+
+// GetRestorablePoints returns the current restorable points of the cluster
+func GetRestorablePoints(cn *pbm.PBM) (*RestorablePoints, error) {
+	reports, err := ValidateChain(cn, "")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &RestorablePoints{
+		Replsets: make(map[string][]RestorePoint, len(reports)),
+		Cluster:  ClusterPoints(reports),
+	}
+	if p.Cluster == nil {
+		p.Cluster = []RestorePoint{}
+	}
+	for _, r := range reports {
+		p.Replsets[r.Replset] = r.Points
+		p.Broken += len(r.Broken())
+	}
+	return p, nil
+}
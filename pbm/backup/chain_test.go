@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestClusterPoints(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	reports := []ChainReport{
+		{
+			Replset: "rs0",
+			Points:  []RestorePoint{{Backup: "b1", TS: ts(10)}, {Backup: "b2", TS: ts(20)}, {Backup: "b3", TS: ts(30)}},
+		},
+		{
+			// b2 is broken on rs1, b4 has been taken of rs1 only
+			Replset: "rs1",
+			Points:  []RestorePoint{{Backup: "b1", TS: ts(10)}, {Backup: "b3", TS: ts(30)}, {Backup: "b4", TS: ts(25)}},
+		},
+	}
+
+	got := ClusterPoints(reports)
+	want := []RestorePoint{{Backup: "b1", TS: ts(10)}, {Backup: "b3", TS: ts(30)}}
+	if len(got) != len(want) {
+		t.Fatalf("got points %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("point %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCoverageGaps(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	links := []ChainLink{
+		{Backup: "b1", First: ts(1), Last: ts(10)},
+		{Backup: "b2", First: ts(8), Last: ts(20)},
+		{Backup: "b3", First: ts(21), Last: ts(30), Broken: "missing files"},
+		{Backup: "b4", First: ts(40), Last: ts(50)},
+	}
+
+	gaps := coverage(links)
+	if len(gaps) != 1 || gaps[0] != (TimeRange{ts(20), ts(40)}) {
+		t.Fatalf("got gaps %v, want [%v]", gaps, TimeRange{ts(20), ts(40)})
+	}
+}
+
+func TestCoverageSkipsSchema(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	links := []ChainLink{
+		{Backup: "b1", First: ts(1), Last: ts(10)},
+		// the schema backup has no data to replay the oplog over
+		{Backup: "s1", Type: pbm.BackupTypeSchema, First: ts(10), Last: ts(20)},
+		{Backup: "b2", First: ts(20), Last: ts(30)},
+	}
+
+	gaps := coverage(links)
+	if len(gaps) != 1 || gaps[0] != (TimeRange{ts(10), ts(20)}) {
+		t.Fatalf("got gaps %v, want [%v]", gaps, TimeRange{ts(10), ts(20)})
+	}
+}
+
+func TestCoverageOplogOnly(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	links := []ChainLink{
+		// no data to replay onto yet
+		{Backup: "o1", Type: pbm.BackupTypeOplog, First: ts(1), Last: ts(5)},
+		{Backup: "b1", First: ts(10), Last: ts(20)},
+		{Backup: "o2", Type: pbm.BackupTypeOplog, First: ts(15), Last: ts(30)},
+		// doesn't reach the range end, so it can't start a new range
+		{Backup: "o3", Type: pbm.BackupTypeOplog, First: ts(40), Last: ts(50)},
+		{Backup: "b2", First: ts(45), Last: ts(60)},
+	}
+
+	gaps := coverage(links)
+	if len(gaps) != 1 || gaps[0] != (TimeRange{ts(30), ts(45)}) {
+		t.Fatalf("got gaps %v, want [%v]", gaps, TimeRange{ts(30), ts(45)})
+	}
+}
+
+func TestPointWindow(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+
+	p := ChainLink{Backup: "b1", First: ts(1), Last: ts(20), Consistent: ts(15)}.point()
+	if p.From != ts(15) || p.TS != ts(20) {
+		t.Errorf("got window %v - %v, want %v - %v", p.From, p.TS, ts(15), ts(20))
+	}
+	// the backups made before the consistent point is recorded
+	p = ChainLink{Backup: "b0", First: ts(1), Last: ts(20)}.point()
+	if p.From != ts(20) {
+		t.Errorf("got window start %v, want %v", p.From, ts(20))
+	}
+}
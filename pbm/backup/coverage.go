@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkAbsentShards handles the shards listed by the config servers with no
+// agent that took the backup by the start deadline. With the partial failure
+// policy such shards are marked as failed (and so the backup becomes partly
+// done), otherwise the backup fails.
+func (b *Backup) checkAbsentShards(bcpName string, im *pbm.IsMaster) error {
+	if !im.IsSharded() {
+		return errConvergeTimeOut
+	}
+
+	shards, err := b.cn.GetShards()
+	if err != nil {
+		return errors.Wrap(err, "get shards list")
+	}
+	bmeta, err := b.cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+
+	rss := make(map[string]bool, len(bmeta.Replsets))
+	for _, rs := range bmeta.Replsets {
+		rss[rs.Name] = true
+	}
+
+	var absent []string
+	for _, sh := range shards {
+		if !bmeta.Includes(sh.ID) {
+			continue
+		}
+		if rss[sh.ID] {
+			continue
+		}
+		absent = append(absent, sh.ID)
+		if bmeta.FailurePolicy != pbm.FailurePolicyPartial {
+			continue
+		}
+		err = b.cn.AddRSMeta(bcpName, pbm.BackupReplset{
+			Name:       sh.ID,
+			StartTS:    time.Now().UTC().Unix(),
+			Status:     pbm.StatusError,
+			Error:      "no agent took part in the backup",
+			Conditions: []pbm.Condition{},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "mark shard %s as failed", sh.ID)
+		}
+	}
+
+	if len(absent) == 0 {
+		return errConvergeTimeOut
+	}
+	if bmeta.FailurePolicy != pbm.FailurePolicyPartial {
+		return errors.Errorf("no agent took part in the backup on shards: %s", strings.Join(absent, ", "))
+	}
+	return nil
+}
+
+// checkCoverage verifies that the files of every shard that took part
+// in the backup are in the storage. With the partial failure policy
+// uncovered shards are marked as failed, otherwise the backup fails.
+func (b *Backup) checkCoverage(bcpName string, im *pbm.IsMaster, stg pbm.Storage) error {
+	if !im.IsSharded() {
+		return nil
+	}
+
+	bmeta, err := b.cn.GetBackupMeta(bcpName)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+
+	var uncovered []string
+	for _, rs := range bmeta.Replsets {
+		if rs.Status == pbm.StatusError {
+			continue
+		}
+
+		missed, err := missingFiles(stg, bmeta, rs)
+		if err != nil {
+			return errors.Wrapf(err, "check files of replset %s", rs.Name)
+		}
+		if len(missed) == 0 {
+			continue
+		}
+		msg := "missing files: " + strings.Join(missed, ", ")
+		uncovered = append(uncovered, rs.Name+": "+msg)
+		if bmeta.FailurePolicy == pbm.FailurePolicyPartial {
+			err = b.cn.ChangeRSState(bcpName, rs.Name, pbm.StatusError, msg)
+			if err != nil {
+				return errors.Wrapf(err, "mark replset %s as failed", rs.Name)
+			}
+		}
+	}
+
+	if len(uncovered) > 0 && bmeta.FailurePolicy != pbm.FailurePolicyPartial {
+		return errors.Errorf("backup doesn't cover all replsets: %s", strings.Join(uncovered, "; "))
+	}
+
+	return nil
+}
+
+// missingFiles returns the replset's files of the backup absent in the storage
+func missingFiles(stg pbm.Storage, bmeta *pbm.BackupMeta, rs pbm.BackupReplset) ([]string, error) {
+	var files []string
+	switch bmeta.Type {
+	case pbm.BackupTypeDifferential:
+		files = append(files, rs.DiffDumps...)
+	case pbm.BackupTypeOplog:
+	default:
+		files = append(files, rs.DumpName)
+	}
+	for _, r := range rs.Redumps {
+		files = append(files, r.Name)
+	}
+	if rs.OplogName != "" {
+		files = append(files, rs.OplogName)
+	}
+	if rs.SessionsName != "" {
+		files = append(files, rs.SessionsName)
+	}
+
+	var missed []string
+	for _, f := range files {
+		ok, err := Exists(stg, f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "check %s", f)
+		}
+		if !ok {
+			missed = append(missed, f)
+		}
+	}
+	return missed, nil
+}
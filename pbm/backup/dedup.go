@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// content-defined chunking params
+const (
+	chunkMin  = 256 << 10
+	chunkMax  = 4 << 20
+	chunkMask = 1<<20 - 1 // ~1Mb average chunk
+)
+
+// gear is the table of the gear rolling hash
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with the fixed seed so the chunks boundaries
+	// are stable across the versions
+	x := uint64(0x50424d5f44454455)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   bufio.NewReaderSize(r, 1<<20),
+		buf: make([]byte, 0, chunkMax),
+	}
+}
+
+// next returns the next chunk of data. The returned slice is valid
+// until the next call.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var h uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.buf = append(c.buf, b)
+		h = (h << 1) + gear[b]
+		if len(c.buf) >= chunkMin && h&chunkMask == 0 || len(c.buf) >= chunkMax {
+			return c.buf, nil
+		}
+	}
+}
+
+// SaveDedup splits the data into content-defined chunks and stores
+// each chunk compressed as the sha256 addressed blob unless the storage
+// already has it. The list of chunks is saved as the `name` file.
+func SaveDedup(data io.Reader, stg pbm.Storage, name string, compression pbm.CompressionType) error {
+	idx := pbm.DedupIndex{Compression: compression}
+	c := newChunker(data)
+	cbuf := new(bytes.Buffer)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read data")
+		}
+
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		idx.Chunks = append(idx.Chunks, pbm.DedupChunk{Hash: hash, Size: len(chunk)})
+		idx.Size += int64(len(chunk))
+
+		blob := pbm.DedupBlobPath(hash, compression)
+		ok, err := Exists(stg, blob)
+		if err != nil {
+			return errors.Wrapf(err, "check blob %s", blob)
+		}
+		if ok {
+			continue
+		}
+
+		cbuf.Reset()
+		w := Compress(cbuf, compression)
+		_, err = w.Write(chunk)
+		if err != nil {
+			return errors.Wrap(err, "compress chunk")
+		}
+		err = w.Close()
+		if err != nil {
+			return errors.Wrap(err, "compress chunk")
+		}
+
+		// the chunk fits into one part
+		err = SaveParts(cbuf, stg, blob, pbm.UploadOpts{PartSize: pbm.MinUploadPartSize, Concurrency: 1})
+		if err != nil {
+			return errors.Wrapf(err, "save blob %s", blob)
+		}
+	}
+
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return errors.Wrap(err, "marshal index")
+	}
+
+	return errors.Wrap(Save(bytes.NewReader(b), stg, name), "save index")
+}
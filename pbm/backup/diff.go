@@ -0,0 +1,304 @@
+package backup
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// baseMeta returns the metadata of the base backup for the differential one
+func (b *Backup) baseMeta(name string) (*pbm.BackupMeta, error) {
+	if name == "" {
+		return nil, errors.New("base backup isn't set")
+	}
+
+	base, err := b.cn.GetBackupMeta(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get metadata")
+	}
+	switch {
+	case base.Name == "":
+		return nil, errors.Errorf("backup %s not found", name)
+	case base.Status != pbm.StatusDone:
+		return nil, errors.Errorf("backup %s isn't finished successfully: %s", name, base.Status)
+	case base.Type == pbm.BackupTypeDifferential:
+		return nil, errors.Errorf("backup %s is differential, the base should be a full backup", name)
+	case base.Type == pbm.BackupTypeSchema:
+		return nil, errors.Errorf("backup %s is schema-only, the base should be a full backup", name)
+	case base.Type == pbm.BackupTypeOplog:
+		return nil, errors.Errorf("backup %s is oplog-only, the base should be a full backup", name)
+	}
+
+	return base, nil
+}
+
+// diff dumps collections which have changed since the base backup.
+// The collection considered changed if it has a different UUID
+// (e.g. was recreated) or there are oplog entries for it since the base's oplog start.
+// The dump is made per database with unchanged and `skipped` collections excluded.
+// It returns the changed (dumped) namespaces.
+func (b *Backup) diff(ctx context.Context, oplog *Oplog, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, colls []pbm.NSInfo, skipped []string, oplogTS primitive.Timestamp, stg pbm.Storage) ([]string, error) {
+	base, err := b.baseMeta(bcp.Base)
+	if err != nil {
+		return nil, errors.Wrap(err, "check base backup")
+	}
+
+	var baseRS *pbm.BackupReplset
+	for i, rs := range base.Replsets {
+		if rs.Name == rsMeta.Name {
+			baseRS = &base.Replsets[i]
+			break
+		}
+	}
+	if baseRS == nil {
+		return nil, errors.Errorf("base backup %s has no replset %s", base.Name, rsMeta.Name)
+	}
+	if len(baseRS.Collections) == 0 {
+		return nil, errors.Errorf("base backup %s has no collections info", base.Name)
+	}
+
+	// the base dump can be taken at any point of its oplog range, and
+	// the oplog of the base isn't replayed on the restore of the diff,
+	// so the changes are counted from the start of the base's oplog
+	if baseRS.FirstWriteTS.T == 0 {
+		return nil, errors.Errorf("base backup %s has no oplog start for replset %s", base.Name, rsMeta.Name)
+	}
+	chg, err := oplog.changes(ctx, b.node, baseRS.FirstWriteTS, oplogTS)
+	if err != nil {
+		return nil, errors.Wrap(err, "define changes since the base backup")
+	}
+
+	baseUUID := make(map[string]string, len(baseRS.Collections))
+	for _, c := range baseRS.Collections {
+		baseUUID[c.NS] = c.UUID
+	}
+
+	var changed []string
+	unchanged := make(map[string][]string)
+	dbs := make(map[string][]string)
+	for _, c := range colls {
+		db, coll := splitNS(c.NS)
+		uuid, ok := baseUUID[c.NS]
+		if !ok || uuid != c.UUID || chg.has(c.NS) {
+			changed = append(changed, c.NS)
+			dbs[db] = append(dbs[db], c.NS)
+			continue
+		}
+		unchanged[db] = append(unchanged[db], coll)
+	}
+	for _, ns := range skipped {
+		db, coll := splitNS(ns)
+		unchanged[db] = append(unchanged[db], coll)
+	}
+
+	b.progress.estimate(colls, changed)
+
+	dbNames := make([]string, 0, len(dbs))
+	for db := range dbs {
+		dbNames = append(dbNames, db)
+	}
+	sort.Strings(dbNames)
+
+	var dumps []string
+	for _, db := range dbNames {
+		name := getDstName("dump-"+db, bcp, rsMeta.Name)
+
+		hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, bcp.Compression)
+		hdr.OplogStart = oplogTS
+		hdr.Namespaces = dbs[db]
+		hdr.CreatedAt = time.Now().UTC().Unix()
+
+		err = b.dump(ctx, stg, name, hdr, db, "", unchanged[db])
+		if err != nil {
+			return nil, errors.Wrapf(err, "dump db %s", db)
+		}
+		dumps = append(dumps, name)
+	}
+	log.Printf("differential dump: %d of %d collections have changed since %s", len(changed), len(colls), base.Name)
+
+	return changed, errors.Wrap(b.cn.SetRSDiff(bcp.Name, rsMeta.Name, changed, dumps), "write diff metadata")
+}
+
+func splitNS(ns string) (db, coll string) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return ns, ""
+	}
+	return ns[:i], ns[i+1:]
+}
+
+func nsList(colls []pbm.NSInfo) []string {
+	nss := make([]string, 0, len(colls))
+	for _, c := range colls {
+		nss = append(nss, c.NS)
+	}
+	return nss
+}
+
+// nsChanges is the set of namespaces touched by the oplog entries
+type nsChanges struct {
+	colls map[string]struct{}
+	// dbs changed as a whole (e.g. dropped)
+	dbs map[string]struct{}
+	// all is set when the changes can't be narrowed down
+	all bool
+}
+
+func (c *nsChanges) has(ns string) bool {
+	if c.all {
+		return true
+	}
+	if _, ok := c.colls[ns]; ok {
+		return true
+	}
+	db, _ := splitNS(ns)
+	_, ok := c.dbs[db]
+	return ok
+}
+
+func (c *nsChanges) add(op, ns string, o bson.D) {
+	switch pbm.Operation(op) {
+	case pbm.OperationNoop:
+	case pbm.OperationCommand:
+		c.cmd(ns, o)
+	default:
+		c.crud(ns)
+	}
+}
+
+func (c *nsChanges) crud(ns string) {
+	db, coll := splitNS(ns)
+	// index builds prior to 4.2 are inserts into system.indexes
+	if coll == "system.indexes" {
+		c.dbs[db] = struct{}{}
+		return
+	}
+	c.colls[ns] = struct{}{}
+}
+
+func (c *nsChanges) cmd(ns string, o bson.D) {
+	db := strings.TrimSuffix(ns, ".$cmd")
+	if len(o) == 0 {
+		c.dbs[db] = struct{}{}
+		return
+	}
+
+	switch o[0].Key {
+	case "applyOps":
+		ops, ok := o[0].Value.(bson.A)
+		if !ok {
+			c.all = true
+			return
+		}
+		for _, op := range ops {
+			d, ok := op.(bson.D)
+			if !ok {
+				c.all = true
+				return
+			}
+			m := d.Map()
+			opType, _ := m["op"].(string)
+			opNS, _ := m["ns"].(string)
+			opO, _ := m["o"].(bson.D)
+			c.add(opType, opNS, opO)
+		}
+	case "renameCollection":
+		for _, e := range o {
+			if e.Key != "renameCollection" && e.Key != "to" {
+				continue
+			}
+			if rns, ok := e.Value.(string); ok {
+				c.colls[rns] = struct{}{}
+			}
+		}
+	case "dropDatabase":
+		c.dbs[db] = struct{}{}
+	case "commitTransaction", "abortTransaction":
+		// operations are in the preceding applyOps
+	default:
+		// create, drop, createIndexes, collMod etc.
+		if coll, ok := o[0].Value.(string); ok {
+			c.colls[db+"."+coll] = struct{}{}
+			return
+		}
+		c.dbs[db] = struct{}{}
+	}
+}
+
+// changes returns namespaces touched by the oplog entries in the (from, to] range.
+// It fails if the oplog doesn't cover `from` anymore. The namespaces are
+// aggregated by the node itself so it needs the live session.
+func (ot *Oplog) changes(ctx context.Context, node *pbm.Node, from, to primitive.Timestamp) (*nsChanges, error) {
+	clName, err := ot.collectionName()
+	if err != nil {
+		return nil, errors.Wrap(err, "determine oplog collection name")
+	}
+	cl := node.Session().Database("local").Collection(clName)
+
+	first := struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}{}
+	err = cl.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{"$natural", 1}})).Decode(&first)
+	if err != nil {
+		return nil, errors.Wrap(err, "get the first oplog entry")
+	}
+	if primitive.CompareTimestamp(first.TS, from) == 1 {
+		return nil, errors.Errorf("oplog doesn't cover the base backup anymore: the first available entry %v is after %v", first.TS, from)
+	}
+
+	chg := &nsChanges{
+		colls: make(map[string]struct{}),
+		dbs:   make(map[string]struct{}),
+	}
+	rng := bson.M{"$gt": from, "$lte": to}
+
+	cur, err := cl.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"ts": rng, "op": bson.M{"$in": bson.A{pbm.OperationInsert, pbm.OperationUpdate, pbm.OperationDelete}}}},
+		bson.M{"$group": bson.M{"_id": "$ns"}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "aggregate crud namespaces")
+	}
+	for cur.Next(ctx) {
+		ns, ok := cur.Current.Lookup("_id").StringValueOK()
+		if ok {
+			chg.crud(ns)
+		}
+	}
+	err = cur.Err()
+	cur.Close(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "read crud namespaces")
+	}
+
+	cur, err = cl.Find(ctx,
+		bson.M{"ts": rng, "op": pbm.OperationCommand},
+		options.Find().SetProjection(bson.M{"ns": 1, "o": 1}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "find commands")
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		e := struct {
+			NS string `bson:"ns"`
+			O  bson.D `bson:"o"`
+		}{}
+		err := cur.Decode(&e)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode command")
+		}
+		chg.cmd(e.NS, e.O)
+	}
+
+	return chg, errors.Wrap(cur.Err(), "read commands")
+}
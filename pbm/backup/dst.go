@@ -3,12 +3,16 @@ package backup
 import (
 	"compress/gzip"
 	"io"
+	"net/http"
 	"os"
 	"path"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/golang/snappy"
 	"github.com/minio/minio-go"
@@ -16,6 +20,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/fault"
 )
 
 type NopCloser struct {
@@ -25,8 +30,20 @@ type NopCloser struct {
 func (NopCloser) Close() error { return nil }
 
 func Compress(w io.Writer, compression pbm.CompressionType) io.WriteCloser {
+	return CompressLevel(w, compression, 0)
+}
+
+// CompressLevel is the same as Compress with the given compression level.
+// The level applies to gzip only, 0 means the default one.
+func CompressLevel(w io.Writer, compression pbm.CompressionType, level int) io.WriteCloser {
 	switch compression {
 	case pbm.CompressionTypeGZIP:
+		if level != 0 {
+			gw, err := gzip.NewWriterLevel(w, level)
+			if err == nil {
+				return gw
+			}
+		}
 		return gzip.NewWriter(w)
 	case pbm.CompressionTypeLZ4:
 		return lz4.NewWriter(w)
@@ -39,15 +56,45 @@ func Compress(w io.Writer, compression pbm.CompressionType) io.WriteCloser {
 
 // Save writes data to given store
 func Save(data io.Reader, stg pbm.Storage, name string) error {
+	return SaveParts(data, stg, name, pbm.UploadOpts{PartSize: pbm.DefaultUploadPartSize, Concurrency: 1})
+}
+
+// SaveParts writes data to given store. The S3 upload buffers
+// the data by `opts.PartSize` parts and sends up to `opts.Concurrency`
+// of them in parallel, so it bounds the memory taken by the upload
+// and the max size of the data (10000 parts).
+// The reads are blocked while the buffers are full.
+// The GCS upload is a single stream regardless of the options.
+func SaveParts(data io.Reader, stg pbm.Storage, name string, opts pbm.UploadOpts) error {
+	data = fault.Reader(data, name)
+
 	switch stg.Type {
 	case pbm.StorageFilesystem:
 		filepath := path.Join(stg.Filesystem.Path, name)
-		fw, err := os.Create(filepath)
+		err := os.MkdirAll(path.Dir(filepath), 0755)
 		if err != nil {
-			return errors.Wrapf(err, "create destination file <%s>", filepath)
+			return errors.Wrapf(err, "create destination dir <%s>", path.Dir(filepath))
+		}
+		// the file gets its name only when it's completely written,
+		// so the interrupted write doesn't leave the truncated file
+		partial := filepath + PartialSuffix
+		fw, err := os.Create(partial)
+		if err != nil {
+			return errors.Wrapf(err, "create destination file <%s>", partial)
 		}
 		_, err = io.Copy(fw, data)
-		return errors.Wrap(err, "write to file")
+		if err == nil {
+			err = fw.Sync()
+		}
+		cerr := fw.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(partial)
+			return errors.Wrap(err, "write to file")
+		}
+		return errors.Wrap(os.Rename(partial, filepath), "rename partial file")
 	case pbm.StorageS3:
 		switch stg.S3.Provider {
 		default:
@@ -64,15 +111,27 @@ func Save(data io.Reader, stg pbm.Storage, name string) error {
 			if err != nil {
 				return errors.Wrap(err, "create AWS session")
 			}
+			concurrency := opts.Concurrency
+			if opts.Adaptive {
+				concurrency = uploadTuner.next(opts.Concurrency)
+			}
+			if concurrency < 1 {
+				concurrency = 1
+			}
+			cr := &countReader{r: data}
+			start := time.Now()
 			_, err = s3manager.NewUploader(awsSession, func(u *s3manager.Uploader) {
-				u.PartSize = 32 * 1024 * 1024 // 32MB part size
-				u.LeavePartsOnError = true    // Don't delete the parts if the upload fails.
-				u.Concurrency = 1
+				u.PartSize = opts.PartSize
+				u.LeavePartsOnError = true // Don't delete the parts if the upload fails.
+				u.Concurrency = concurrency
 			}).Upload(&s3manager.UploadInput{
 				Bucket: aws.String(stg.S3.Bucket),
 				Key:    aws.String(path.Join(stg.S3.Prefix, name)),
-				Body:   data,
+				Body:   cr,
 			})
+			if err == nil && opts.Adaptive {
+				uploadTuner.report(concurrency, cr.n, time.Since(start), opts.PartSize)
+			}
 			return errors.Wrap(err, "upload to S3")
 		case pbm.S3ProviderGCS:
 			// using minio client with GCS because it
@@ -88,3 +147,136 @@ func Save(data io.Reader, stg pbm.Storage, name string) error {
 		return errors.New("unknown storage type")
 	}
 }
+
+// SaveChecked writes data to given store the same way as SaveParts and
+// returns the checksum of the data calculated on the way. The S3 upload
+// is checked against the ETag of the stored object.
+func SaveChecked(data io.Reader, stg pbm.Storage, name string, opts pbm.UploadOpts) (pbm.FileChecksum, error) {
+	cs := pbm.NewChecksummer(name, opts.PartSize)
+	err := SaveParts(io.TeeReader(data, cs), stg, name, opts)
+	if err != nil {
+		return pbm.FileChecksum{}, err
+	}
+
+	// GCS uploads are a single stream so its ETag isn't
+	// the parts' one and the filesystem has no ETag at all
+	if stg.Type == pbm.StorageS3 && stg.S3.Provider != pbm.S3ProviderGCS {
+		err = checkETag(stg.S3, name, cs)
+		if err != nil {
+			return pbm.FileChecksum{}, errors.Wrapf(err, "check uploaded '%s'", name)
+		}
+	}
+
+	return cs.Sum(), nil
+}
+
+func checkETag(stg pbm.S3, name string, cs *pbm.Checksummer) error {
+	awsSession, err := s3Session(stg)
+	if err != nil {
+		return errors.Wrap(err, "create AWS session")
+	}
+	h, err := s3.New(awsSession).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(stg.Bucket),
+		Key:    aws.String(path.Join(stg.Prefix, name)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "get object info")
+	}
+	// the ETag of the encrypted with KMS or customer keys object isn't its MD5
+	if aws.StringValue(h.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || h.SSECustomerAlgorithm != nil {
+		return nil
+	}
+	return cs.CheckETag(aws.StringValue(h.ETag))
+}
+
+// Exists checks if the file with the given name exists in the store
+func Exists(stg pbm.Storage, name string) (bool, error) {
+	switch stg.Type {
+	case pbm.StorageFilesystem:
+		_, err := os.Stat(path.Join(stg.Filesystem.Path, name))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	case pbm.StorageS3:
+		switch stg.S3.Provider {
+		default:
+			awsSession, err := s3Session(stg.S3)
+			if err != nil {
+				return false, errors.Wrap(err, "create AWS session")
+			}
+			_, err = s3.New(awsSession).HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(stg.S3.Bucket),
+				Key:    aws.String(path.Join(stg.S3.Prefix, name)),
+			})
+			if err != nil {
+				if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+					return false, nil
+				}
+				return false, errors.Wrap(err, "get S3 object header")
+			}
+			return true, nil
+		case pbm.S3ProviderGCS:
+			mc, err := minio.NewWithRegion(pbm.GCSEndpointURL, stg.S3.Credentials.AccessKeyID, stg.S3.Credentials.SecretAccessKey, true, stg.S3.Region)
+			if err != nil {
+				return false, errors.Wrap(err, "NewWithRegion")
+			}
+			_, err = mc.StatObject(stg.S3.Bucket, path.Join(stg.S3.Prefix, name), minio.StatObjectOptions{})
+			if err != nil {
+				if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+					return false, nil
+				}
+				return false, errors.Wrap(err, "get GCS object info")
+			}
+			return true, nil
+		}
+	default:
+		return false, errors.New("unknown storage type")
+	}
+}
+
+// Delete deletes the file from the store. It's not an error if there is no such file.
+func Delete(stg pbm.Storage, name string) error {
+	switch stg.Type {
+	case pbm.StorageFilesystem:
+		err := os.Remove(path.Join(stg.Filesystem.Path, name))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove file")
+		}
+		return nil
+	case pbm.StorageS3:
+		switch stg.S3.Provider {
+		default:
+			awsSession, err := s3Session(stg.S3)
+			if err != nil {
+				return errors.Wrap(err, "create AWS session")
+			}
+			_, err = s3.New(awsSession).DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(stg.S3.Bucket),
+				Key:    aws.String(path.Join(stg.S3.Prefix, name)),
+			})
+			return errors.Wrap(err, "delete S3 object")
+		case pbm.S3ProviderGCS:
+			mc, err := minio.NewWithRegion(pbm.GCSEndpointURL, stg.S3.Credentials.AccessKeyID, stg.S3.Credentials.SecretAccessKey, true, stg.S3.Region)
+			if err != nil {
+				return errors.Wrap(err, "NewWithRegion")
+			}
+			return errors.Wrap(mc.RemoveObject(stg.S3.Bucket, path.Join(stg.S3.Prefix, name)), "delete GCS object")
+		}
+	default:
+		return errors.New("unknown storage type")
+	}
+}
+
+func s3Session(stg pbm.S3) (*session.Session, error) {
+	return session.NewSession(&aws.Config{
+		Region:   aws.String(stg.Region),
+		Endpoint: aws.String(stg.EndpointURL),
+		Credentials: credentials.NewStaticCredentials(
+			stg.Credentials.AccessKeyID,
+			stg.Credentials.SecretAccessKey,
+			"",
+		),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+}
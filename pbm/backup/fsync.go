@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// fsyncLock locks the node against writes for the time of the dump.
+// The returned func releases the lock. Besides, the watchdog releases
+// it once the backup is canceled or `hold` (if any) has passed.
+// In the latter case the dump isn't consistent anymore, so the watchdog
+// cancels the backup and the returned func reports the error.
+// If the agent dies holding the lock, the lock is released by
+// UnlockStale on the agent's next start.
+//
+// While the node is locked no writes to it are possible, including
+// the PBM control collections if they reside on the same node.
+func (b *Backup) fsyncLock(ctx context.Context, cancel context.CancelFunc, bcpName string, im *pbm.IsMaster, hold time.Duration) (func() error, error) {
+	err := b.cn.SetFsyncLock(pbm.FsyncLockMeta{
+		Node:    im.Me,
+		Replset: im.SetName,
+		Backup:  bcpName,
+		TS:      time.Now().UTC().Unix(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "mark the node as locked")
+	}
+
+	err = b.node.FsyncLock()
+	if err != nil {
+		derr := b.cn.DeleteFsyncLock(im.SetName, im.Me)
+		if derr != nil {
+			log.Println("[ERROR] fsync lock: delete the lock mark:", derr)
+		}
+		return nil, err
+	}
+	// nothing can be written to the PBM collections of the standalone node
+	// until it's unlocked, so the job log isn't used while it's locked
+	log.Printf("node %s is fsync-locked for the backup %s", im.Me, bcpName)
+
+	var (
+		once sync.Once
+		mu   sync.Mutex
+		lerr error
+	)
+	done := make(chan struct{})
+	unlock := func() {
+		once.Do(func() {
+			close(done)
+			_, err := b.node.FsyncUnlock()
+			if err != nil {
+				log.Println("[ERROR] fsync unlock:", err)
+				return
+			}
+			err = b.cn.DeleteFsyncLock(im.SetName, im.Me)
+			if err != nil {
+				log.Println("[ERROR] fsync unlock: delete the lock mark:", err)
+			}
+			b.jlog.Infof("dump", "node %s is unlocked", im.Me)
+		})
+	}
+
+	go func() {
+		var tout <-chan time.Time
+		if hold > 0 {
+			t := time.NewTimer(hold)
+			defer t.Stop()
+			tout = t.C
+		}
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			log.Printf("[WARNING] backup %s is canceled, releasing the fsync lock", bcpName)
+		case <-tout:
+			mu.Lock()
+			lerr = errors.Errorf("the fsync lock is held longer than %v, the dump can't be consistent anymore", hold)
+			mu.Unlock()
+			log.Printf("[WARNING] backup %s: %v, releasing the lock", bcpName, lerr)
+			cancel()
+		}
+		unlock()
+	}()
+
+	return func() error {
+		unlock()
+		mu.Lock()
+		defer mu.Unlock()
+		return lerr
+	}, nil
+}
+
+// UnlockStale releases the fsync lock left on the node by the
+// backup which hasn't been finished (e.g. due to the agent's crash)
+func UnlockStale(cn *pbm.PBM, node *pbm.Node) error {
+	im, err := node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster")
+	}
+
+	m, err := cn.GetFsyncLock(im.SetName, im.Me)
+	if err != nil {
+		return errors.Wrap(err, "get the lock mark")
+	}
+	if m == nil {
+		return nil
+	}
+
+	locked, err := node.IsFsyncLocked()
+	if err != nil {
+		return errors.Wrap(err, "check the node lock")
+	}
+	// the locks are nested, the node is writable
+	// only once every one of them is released
+	if locked {
+		log.Printf("[WARNING] node is left fsync-locked by the backup %s, unlocking", m.Backup)
+		for {
+			n, err := node.FsyncUnlock()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			log.Printf("[WARNING] node still has %d fsync locks, unlocking", n)
+		}
+	}
+
+	return errors.Wrap(cn.DeleteFsyncLock(im.SetName, im.Me), "delete the lock mark")
+}
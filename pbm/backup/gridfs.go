@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkGridFS checks the chunks completeness of the replset's GridFS buckets.
+// Broken files don't fail the backup, they're reported in the log and the metadata.
+// The buckets are read at a snapshot unless the node is locked anyway (snapshot is false).
+func (b *Backup) checkGridFS(bcpName, rsName string, colls []pbm.NSInfo, snapshot bool) error {
+	checks, err := b.node.CheckGridFSBuckets(colls, false, snapshot)
+	if err != nil {
+		return errors.Wrap(err, "check buckets")
+	}
+	for _, c := range checks {
+		if !c.OK() {
+			log.Printf("[WARNING] GridFS %s", c)
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(b.cn.SetRSGridFS(bcpName, rsName, checks), "write check results")
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// sizeTrendDepth is the number of the latest successful backups
+// of the type the average size is taken over
+const sizeTrendDepth = 7
+
+// CatalogHealth is the state of the backups catalog for the monitoring
+type CatalogHealth struct {
+	// Cluster is the replset name of the PBM control collections
+	Cluster string
+	// Backups is the number of the backups by the status
+	Backups map[pbm.Status]int
+	// Newest are the newest successful backups by the type
+	Newest map[pbm.BackupType]NewestBackup
+	// Verify is the newest finished verification, nil if there is none
+	Verify *pbm.VerifyMeta
+	// Point is the latest point the cluster can be restored to, nil if there is none
+	Point *RestorePoint
+	// Broken is the number of the backups chain links which can't be restored
+	Broken int
+}
+
+// NewestBackup is the newest successful backup of the type
+type NewestBackup struct {
+	Name string
+	// Finished is the unix time the backup has finished
+	Finished int64
+	// Size is the size of the backup files in the storage, unknown (zero)
+	// for the dedup layout. Data is the size of the backed up collections.
+	Size int64
+	Data int64
+	// AvgSize is the average size of the latest sizeTrendDepth backups of the type
+	AvgSize int64
+	// Verified means the backup has passed the verification
+	Verified bool
+}
+
+// GetCatalogHealth collects the state of the backups catalog: the newest
+// backups, their sizes, the verification results and the restorable point
+func GetCatalogHealth(cn *pbm.PBM) (*CatalogHealth, error) {
+	h := &CatalogHealth{
+		Backups: make(map[pbm.Status]int),
+		Newest:  make(map[pbm.BackupType]NewestBackup),
+	}
+
+	im, err := cn.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get cluster name")
+	}
+	h.Cluster = im.SetName
+	if h.Cluster == "" {
+		h.Cluster = pbm.NoReplset
+	}
+
+	vs, err := cn.VerificationsList(0, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "get verifications list")
+	}
+	verified := make(map[string]bool)
+	for i, v := range vs {
+		if v.Status == pbm.StatusDone {
+			verified[v.Backup] = true
+		}
+		if h.Verify == nil && (v.Status == pbm.StatusDone || v.Status == pbm.StatusError) {
+			h.Verify = &vs[i]
+		}
+	}
+
+	// the list goes from the newest
+	bcps, err := cn.BackupsList(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups list")
+	}
+	sizes := make(map[pbm.BackupType][]int64)
+	for _, b := range bcps {
+		h.Backups[b.Status]++
+		if b.Status != pbm.StatusDone {
+			continue
+		}
+
+		typ := b.Type
+		if typ == "" {
+			typ = pbm.BackupTypeFull
+		}
+		size, data := backupSize(&b)
+		if len(sizes[typ]) < sizeTrendDepth {
+			sizes[typ] = append(sizes[typ], size)
+		}
+		if _, ok := h.Newest[typ]; ok {
+			continue
+		}
+		h.Newest[typ] = NewestBackup{
+			Name:     b.Name,
+			Finished: b.LastTransitionTS,
+			Size:     size,
+			Data:     data,
+			Verified: verified[b.Name],
+		}
+	}
+	for typ, n := range h.Newest {
+		var sum int64
+		for _, s := range sizes[typ] {
+			sum += s
+		}
+		n.AvgSize = sum / int64(len(sizes[typ]))
+		h.Newest[typ] = n
+	}
+
+	pts, err := GetRestorablePoints(cn)
+	if err != nil {
+		return nil, errors.Wrap(err, "get restorable points")
+	}
+	h.Broken = pts.Broken
+	if len(pts.Cluster) > 0 {
+		last := pts.Cluster[len(pts.Cluster)-1]
+		h.Point = &last
+	}
+
+	return h, nil
+}
+
+// backupSize returns the size of the backup files in the storage
+// and the size of the backed up collections
+func backupSize(b *pbm.BackupMeta) (size, data int64) {
+	for _, rs := range b.Replsets {
+		for _, c := range rs.Checksums {
+			size += c.Size
+		}
+		for _, c := range rs.Collections {
+			data += c.Size
+		}
+	}
+	return size, data
+}
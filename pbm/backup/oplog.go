@@ -3,22 +3,25 @@ package backup
 import (
 	"context"
 	"io"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/fault"
 )
 
 // Oplog is used for reading the Mongodb oplog
 type Oplog struct {
-	node *pbm.Node
+	node pbm.Cluster
+	// lastTS is the timestamp of the last written oplog entry packed as T<<32|I
+	lastTS uint64
 }
 
 // NewOplog creates a new Oplog instance
-func NewOplog(node *pbm.Node) *Oplog {
+func NewOplog(node pbm.Cluster) *Oplog {
 	return &Oplog{
 		node: node,
 	}
@@ -34,42 +37,124 @@ func (ot *Oplog) SliceTo(ctx context.Context, w io.Writer, from, to primitive.Ti
 	if err != nil {
 		return errors.Wrap(err, "determine oplog collection name")
 	}
-	cl := ot.node.Session().Database("local").Collection(clName)
-
-	cur, err := cl.Find(ctx,
-		bson.M{
-			"ts": bson.M{"$gte": from},
-		},
-		options.Find().SetCursorType(options.Tailable),
-	)
+	cur, err := ot.node.OplogCursor(ctx, clName, from, true)
 	if err != nil {
 		return errors.Wrap(err, "get the oplog cursor")
 	}
 	defer cur.Close(ctx)
 
+	atomic.StoreUint64(&ot.lastTS, uint64(from.T)<<32|uint64(from.I))
+
 	opts := primitive.Timestamp{}
 	var ok bool
+	first := true
+	kill, n := fault.Limit(fault.OplogTail, ""), int64(0)
 	for cur.Next(ctx) {
-		opts.T, opts.I, ok = cur.Current.Lookup("ts").TimestampOK()
+		if kill >= 0 && n >= kill {
+			return fault.Injected{Point: fault.OplogTail}
+		}
+		n++
+
+		doc := cur.Doc()
+		opts.T, opts.I, ok = doc.Lookup("ts").TimestampOK()
 		if !ok {
-			return errors.Errorf("get the timestamp of record %v", cur.Current)
+			// don't dump the whole record, it can be up to 16MB
+			return errors.Errorf("no timestamp in the oplog record of %d bytes after %v", len(doc), ot.LastTS())
+		}
+		// `from` is the existing oplog entry, if it's not found
+		// the oplog has been rolled over and the slice would have a gap
+		if first {
+			if primitive.CompareTimestamp(opts, from) == 1 {
+				return errors.Errorf("oplog has been rolled over: the first available entry %v is after the start point %v", opts, from)
+			}
+			first = false
 		}
 		if primitive.CompareTimestamp(to, opts) == -1 {
 			return nil
 		}
+		atomic.StoreUint64(&ot.lastTS, uint64(opts.T)<<32|uint64(opts.I))
+
+		err = ot.txnHead(ctx, clName, w, doc, from)
+		if err != nil {
+			return errors.Wrapf(err, "transaction of %v", opts)
+		}
 
 		// skip noop operations
-		if cur.Current.Lookup("op").String() == string(pbm.OperationNoop) {
+		if doc.Lookup("op").String() == string(pbm.OperationNoop) {
 			continue
 		}
 
-		_, err = w.Write([]byte(cur.Current))
+		_, err = w.Write([]byte(doc))
 		if err != nil {
 			return errors.Wrap(err, "write to pipe")
 		}
 	}
 
-	return cur.Err()
+	return errors.Wrapf(cur.Err(), "read the oplog after %v", ot.LastTS())
+}
+
+// txnHead writes the entries of the transaction the doc belongs to which
+// precede the slice start. The entries of the multi-entry (4.2+) and the
+// prepared transactions are chained by prevOpTime and applied at the commit,
+// so the slice started in the middle of the transaction needs its head.
+// The head precedes the first entry of the transaction in the slice.
+func (ot *Oplog) txnHead(ctx context.Context, clName string, w io.Writer, doc bson.Raw, from primitive.Timestamp) error {
+	var head []bson.Raw
+	for {
+		prev, ok := txnPrev(doc)
+		if !ok || prev.T == 0 || primitive.CompareTimestamp(prev, from) >= 0 {
+			break
+		}
+
+		cur, err := ot.node.OplogCursor(ctx, clName, prev, false)
+		if err != nil {
+			return errors.Wrap(err, "get the oplog cursor")
+		}
+		var ts primitive.Timestamp
+		if cur.Next(ctx) {
+			doc = append(bson.Raw(nil), cur.Doc()...)
+			ts.T, ts.I, _ = doc.Lookup("ts").TimestampOK()
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "read the entry %v", prev)
+		}
+		if ts != prev {
+			return errors.Errorf("oplog has been rolled over: no transaction's entry %v", prev)
+		}
+		head = append(head, doc)
+	}
+
+	for i := len(head) - 1; i >= 0; i-- {
+		_, err := w.Write([]byte(head[i]))
+		if err != nil {
+			return errors.Wrap(err, "write to pipe")
+		}
+	}
+	return nil
+}
+
+// txnPrev returns the timestamp of the transaction's entry preceding
+// the doc. False if the doc isn't the transaction's entry.
+func txnPrev(doc bson.Raw) (primitive.Timestamp, bool) {
+	if op, _ := doc.Lookup("op").StringValueOK(); op != string(pbm.OperationCommand) {
+		return primitive.Timestamp{}, false
+	}
+	if _, err := doc.LookupErr("lsid"); err != nil {
+		return primitive.Timestamp{}, false
+	}
+	if _, err := doc.LookupErr("txnNumber"); err != nil {
+		return primitive.Timestamp{}, false
+	}
+	t, i, ok := doc.Lookup("prevOpTime", "ts").TimestampOK()
+	return primitive.Timestamp{T: t, I: i}, ok
+}
+
+// LastTS returns the timestamp of the last oplog entry read by SliceTo
+func (ot *Oplog) LastTS() primitive.Timestamp {
+	v := atomic.LoadUint64(&ot.lastTS)
+	return primitive.Timestamp{T: uint32(v >> 32), I: uint32(v)}
 }
 
 var errMongoTimestampNil = errors.New("timestamp is nil")
@@ -86,6 +171,61 @@ func (ot *Oplog) LastWrite() (primitive.Timestamp, error) {
 	return isMaster.LastWrite.MajorityOpTime.TS, nil
 }
 
+// FirstTS returns the timestamp of the oldest entry in the node's oplog
+func (ot *Oplog) FirstTS() (primitive.Timestamp, error) {
+	coll, err := ot.collectionName()
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "define oplog collection")
+	}
+	r, err := ot.node.FirstRecord("local." + coll)
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "get the first oplog entry")
+	}
+	if r == nil {
+		return primitive.Timestamp{}, errors.New("oplog is empty")
+	}
+	t, i, ok := r.Lookup("ts").TimestampOK()
+	if !ok {
+		return primitive.Timestamp{}, errors.New("no ts in the first oplog entry")
+	}
+	return primitive.Timestamp{T: t, I: i}, nil
+}
+
+// StartAt returns the timestamp of the first oplog entry at or after `ts`,
+// waiting for it if there is none yet. The slice started from it covers
+// the oplog since `ts` unless the oplog has been rolled over past `ts`.
+func (ot *Oplog) StartAt(ctx context.Context, ts primitive.Timestamp) (primitive.Timestamp, error) {
+	first, err := ot.FirstTS()
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	if primitive.CompareTimestamp(first, ts) == 1 {
+		return primitive.Timestamp{}, errors.Errorf("oplog has been rolled over: the first available entry %v is after the start point %v", first, ts)
+	}
+
+	clName, err := ot.collectionName()
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "determine oplog collection name")
+	}
+	cur, err := ot.node.OplogCursor(ctx, clName, ts, true)
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "get the oplog cursor")
+	}
+	defer cur.Close(ctx)
+
+	if !cur.Next(ctx) {
+		if err := cur.Err(); err != nil {
+			return primitive.Timestamp{}, errors.Wrapf(err, "read the oplog after %v", ts)
+		}
+		return primitive.Timestamp{}, errors.Wrapf(ctx.Err(), "wait for the oplog after %v", ts)
+	}
+	t, i, ok := cur.Doc().Lookup("ts").TimestampOK()
+	if !ok {
+		return primitive.Timestamp{}, errors.Errorf("no timestamp in the oplog record after %v", ts)
+	}
+	return primitive.Timestamp{T: t, I: i}, nil
+}
+
 func (ot *Oplog) collectionName() (string, error) {
 	isMaster, err := ot.node.GetIsMaster()
 	if err != nil {
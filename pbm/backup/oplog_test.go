@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/fake"
+)
+
+func TestSliceToMaxSizeEntry(t *testing.T) {
+	node := fake.NewReplset("rs0", "rs0:27017")
+	// the entry of the max size document is larger than the document itself
+	big := bson.D{{"_id", 1}, {"data", strings.Repeat("x", 16<<20-64)}}
+	err := node.InsertOplog(
+		fake.OplogEntry{TS: primitive.Timestamp{T: 1}, Op: pbm.OperationInsert, NS: "db.c", O: bson.D{{"_id", 0}}},
+		fake.OplogEntry{TS: primitive.Timestamp{T: 2}, Op: pbm.OperationInsert, NS: "db.c", O: big},
+		fake.OplogEntry{TS: primitive.Timestamp{T: 3}, Op: pbm.OperationNoop, NS: "", O: bson.D{{"msg", "noop"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	ot := NewOplog(node)
+	err = ot.SliceTo(context.Background(), buf, primitive.Timestamp{T: 1}, primitive.Timestamp{T: 2})
+	if err != nil {
+		t.Fatalf("slice: %v", err)
+	}
+	if ot.LastTS() != (primitive.Timestamp{T: 2}) {
+		t.Errorf("last ts %v, expected %v", ot.LastTS(), primitive.Timestamp{T: 2})
+	}
+
+	src := db.NewBufferlessBSONSource(ioutil.NopCloser(buf))
+	src.SetMaxBSONSize(pbm.MaxOplogEntrySize)
+	var sizes []int
+	for raw := src.LoadNext(); raw != nil; raw = src.LoadNext() {
+		sizes = append(sizes, len(raw))
+	}
+	if src.Err() != nil {
+		t.Fatalf("read the slice: %v", src.Err())
+	}
+	if len(sizes) != 2 {
+		t.Fatalf("got %d entries in the slice, expected 2", len(sizes))
+	}
+	if sizes[1] <= 16<<20 {
+		t.Errorf("the max size entry is %d bytes, expected more than 16MB", sizes[1])
+	}
+}
+
+func TestSliceToRolledOver(t *testing.T) {
+	node := fake.NewReplset("rs0", "rs0:27017")
+	err := node.InsertOplog(
+		fake.OplogEntry{TS: primitive.Timestamp{T: 5}, Op: pbm.OperationInsert, NS: "db.c", O: bson.D{{"_id", 0}}},
+		fake.OplogEntry{TS: primitive.Timestamp{T: 6}, Op: pbm.OperationNoop, NS: "", O: bson.D{{"msg", "noop"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewOplog(node).SliceTo(context.Background(), ioutil.Discard, primitive.Timestamp{T: 1}, primitive.Timestamp{T: 5})
+	if err == nil || !strings.Contains(err.Error(), "rolled over") {
+		t.Errorf("expected the rolled over oplog error, got %v", err)
+	}
+}
+
+func TestStartAtWaits(t *testing.T) {
+	node := fake.NewReplset("rs0", "rs0:27017")
+	err := node.InsertOplog(fake.OplogEntry{TS: primitive.Timestamp{T: 1}, Op: pbm.OperationNoop, O: bson.D{{"msg", "noop"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		node.InsertOplog(fake.OplogEntry{TS: primitive.Timestamp{T: 3}, Op: pbm.OperationNoop, O: bson.D{{"msg", "noop"}}})
+	}()
+
+	ts, err := NewOplog(node).StartAt(ctx, primitive.Timestamp{T: 2})
+	if err != nil {
+		t.Fatalf("start at: %v", err)
+	}
+	if ts != (primitive.Timestamp{T: 3}) {
+		t.Errorf("started at %v, expected %v", ts, primitive.Timestamp{T: 3})
+	}
+}
+
+func TestOplogOfStandalone(t *testing.T) {
+	node := fake.NewNode(pbm.IsMaster{IsMaster: true})
+	err := node.InsertOplog(fake.OplogEntry{TS: primitive.Timestamp{T: 7}, Op: pbm.OperationNoop, O: bson.D{{"msg", "noop"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ot := NewOplog(node)
+	first, err := ot.FirstTS()
+	if err != nil {
+		t.Fatalf("first ts: %v", err)
+	}
+	if first != (primitive.Timestamp{T: 7}) {
+		t.Errorf("first ts %v, expected %v", first, primitive.Timestamp{T: 7})
+	}
+
+	node.SetIsMaster(pbm.IsMaster{})
+	if _, err := ot.FirstTS(); err == nil {
+		t.Error("expected error for the secondary with no replset")
+	}
+}
@@ -0,0 +1,383 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// StorageFile is the file in the backup storage
+type StorageFile struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// Orphan is the storage file no finished backup in the catalog refers to
+type Orphan struct {
+	StorageFile
+	// Backup is the backup the file belongs to if it's known
+	Backup string
+	Reason string
+}
+
+// the reasons of the file being orphaned. The files of the unknown
+// origin are only reported, they may be not PBM's.
+const (
+	OrphanFailed    = "failed backup"
+	OrphanNoCatalog = "no catalog entry"
+	OrphanLeftover  = "not referenced by its backup"
+	OrphanPartial   = "partial upload"
+	OrphanDedupBlob = "unreferenced dedup blob"
+	OrphanUnknown   = "unknown file"
+)
+
+const metaSuffix = ".pbm.json"
+
+// FindOrphans lists the storage files and matches them against the backups
+// catalog. The files which aren't referenced by any finished backup are
+// returned. The files written after the start of the running backups are
+// skipped since these backups are yet to refer to them. The files of the
+// failed backups under the legal hold or not expired yet aren't orphans.
+func FindOrphans(cn *pbm.PBM) ([]Orphan, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "get storage")
+	}
+
+	bcps, err := cn.BackupsList(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups list")
+	}
+
+	files, err := List(stg)
+	if err != nil {
+		return nil, errors.Wrap(err, "list storage")
+	}
+
+	// the file is referenced by a failed backup only if no other backup
+	// (e.g. the differential one based on the failed) refers to it
+	used := make(map[string]bool)
+	failed := make(map[string]string)
+	names := make(map[string]bool, len(bcps))
+	now := time.Now()
+	var running time.Time
+	for i := range bcps {
+		b := &bcps[i]
+		names[b.Name] = true
+
+		if !b.IsFinished() {
+			st := time.Unix(b.StartTS, 0)
+			if running.IsZero() || st.Before(running) {
+				running = st
+			}
+		}
+
+		refs := append(b.Files(), b.Name+metaSuffix+pbm.SignatureSuffix)
+		if b.Dedup {
+			blobs, err := dedupBlobs(stg, b)
+			if err != nil {
+				return nil, errors.Wrapf(err, "get dedup blobs of %s", b.Name)
+			}
+			refs = append(refs, blobs...)
+		}
+
+		for _, f := range refs {
+			if f == "" {
+				continue
+			}
+			if b.Status == pbm.StatusError && b.CheckDelete(now) == nil {
+				if !used[f] {
+					failed[f] = b.Name
+				}
+				continue
+			}
+			used[f] = true
+			delete(failed, f)
+		}
+	}
+
+	var orphans []Orphan
+	for _, f := range files {
+		if used[f.Name] || !running.IsZero() && !f.Modified.Before(running) {
+			continue
+		}
+
+		o := Orphan{StorageFile: f}
+		switch {
+		case failed[f.Name] != "":
+			o.Backup = failed[f.Name]
+			o.Reason = OrphanFailed
+		case strings.HasSuffix(f.Name, PartialSuffix) && fileBackup(f.Name, names) != "":
+			o.Backup = fileBackup(f.Name, names)
+			o.Reason = OrphanPartial
+		case isDedupBlob(f.Name):
+			o.Reason = OrphanDedupBlob
+		default:
+			o.Backup = fileBackup(f.Name, names)
+			o.Reason = OrphanUnknown
+			if o.Backup != "" {
+				o.Reason = OrphanLeftover
+			}
+		}
+		orphans = append(orphans, o)
+	}
+
+	// the backup files with no catalog entry are recognized by
+	// the name of their metadata file
+	for i, o := range orphans {
+		if o.Reason != OrphanUnknown {
+			continue
+		}
+		for _, m := range orphans {
+			if !strings.HasSuffix(m.Name, metaSuffix) {
+				continue
+			}
+			name := strings.TrimSuffix(m.Name, metaSuffix)
+			if o.Name == m.Name || strings.HasPrefix(o.Name, name+"_") || strings.HasPrefix(o.Name, name+".") {
+				orphans[i].Backup = name
+				orphans[i].Reason = OrphanNoCatalog
+				break
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// Removable returns true if the file is named the way PBM names its
+// files, so it's safe to remove it
+func (o Orphan) Removable() bool {
+	return o.Reason != OrphanUnknown
+}
+
+// isDedupBlob returns true if the name is the one pbm.DedupBlobPath makes
+func isDedupBlob(name string) bool {
+	p := strings.Split(name, "/")
+	if len(p) != 3 || p[0] != pbm.DedupBlobsDir || len(p[1]) != 2 {
+		return false
+	}
+	hash := strings.SplitN(p[2], ".", 2)[0]
+	if len(hash) < 2 || hash[:2] != p[1] {
+		return false
+	}
+	for _, c := range hash {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileBackup returns the backup of the catalog the file is named after.
+// Backups only refer to their own files so such a file is a leftover of
+// the failed attempt (e.g. the replaced dump).
+func fileBackup(name string, names map[string]bool) string {
+	for n := range names {
+		if strings.HasPrefix(name, n+"_") || strings.HasPrefix(name, n+".") {
+			return n
+		}
+	}
+	return ""
+}
+
+// dedupBlobs returns the blobs the dedup indexes of the backup refer to.
+// The indexes which aren't in the storage are skipped, it's up to
+// the verification to report them.
+func dedupBlobs(stg pbm.Storage, b *pbm.BackupMeta) ([]string, error) {
+	var blobs []string
+	for _, rs := range b.Replsets {
+		dumps := []string{rs.DumpName}
+		if b.Type == pbm.BackupTypeDifferential {
+			dumps = rs.DiffDumps
+		}
+		for _, name := range dumps {
+			if name == "" {
+				continue
+			}
+			ok, err := Exists(stg, name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "check %s", name)
+			}
+			if !ok {
+				continue
+			}
+
+			r, _, err := restore.Source(stg, name, pbm.CompressionTypeNone)
+			if err != nil {
+				return nil, errors.Wrapf(err, "open index %s", name)
+			}
+			idx := pbm.DedupIndex{}
+			err = json.NewDecoder(r).Decode(&idx)
+			r.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode index %s", name)
+			}
+			for _, c := range idx.Chunks {
+				blobs = append(blobs, pbm.DedupBlobPath(c.Hash, idx.Compression))
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// LockStorage takes the lock which keeps the backups from being started
+// while the orphaned files are looked up and removed. The files are to
+// be looked up after the lock is taken, the lock is released by the caller.
+func LockStorage(cn *pbm.PBM) (*pbm.Lock, error) {
+	lock := cn.NewLock(pbm.LockHeader{
+		Type:    pbm.CmdCleanupStorage,
+		Replset: pbm.StorageReplset,
+	})
+	got, err := lock.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	if !got {
+		return nil, errors.New("another cleanup of the storage is running")
+	}
+	return lock, nil
+}
+
+// DeleteOrphans removes the orphaned files of the known origin from the
+// storage, see Orphan.Removable. The orphans are to be looked up and removed
+// under the LockStorage lock. It returns the number of files removed.
+func DeleteOrphans(cn *pbm.PBM, orphans []Orphan) (int, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return 0, errors.Wrap(err, "get storage")
+	}
+
+	n := 0
+	for _, o := range orphans {
+		if !o.Removable() {
+			continue
+		}
+		err := Delete(stg, o.Name)
+		if err != nil {
+			return n, errors.Wrapf(err, "delete %s", o.Name)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// List returns all files of the storage sorted by name. The names
+// are relative to the storage root (the path or the bucket prefix).
+func List(stg pbm.Storage) ([]StorageFile, error) {
+	var (
+		files []StorageFile
+		err   error
+	)
+	switch stg.Type {
+	case pbm.StorageFilesystem:
+		files, err = listFS(stg.Filesystem.Path)
+	case pbm.StorageS3:
+		if stg.S3.Provider == pbm.S3ProviderGCS {
+			files, err = listGCS(stg.S3)
+		} else {
+			files, err = listS3(stg.S3)
+		}
+	default:
+		return nil, errors.New("unknown storage type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func listFS(root string) ([]StorageFile, error) {
+	var files []StorageFile
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return errors.Wrapf(err, "relative path of %s", p)
+		}
+		files = append(files, StorageFile{
+			Name:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	return files, errors.Wrap(err, "walk storage dir")
+}
+
+// s3Prefix returns the prefix of the storage keys ending with "/"
+func s3Prefix(stg pbm.S3) string {
+	if stg.Prefix == "" || strings.HasSuffix(stg.Prefix, "/") {
+		return stg.Prefix
+	}
+	return stg.Prefix + "/"
+}
+
+func listS3(stg pbm.S3) ([]StorageFile, error) {
+	awsSession, err := s3Session(stg)
+	if err != nil {
+		return nil, errors.Wrap(err, "create AWS session")
+	}
+
+	prefix := s3Prefix(stg)
+	var files []StorageFile
+	err = s3.New(awsSession).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(stg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, o := range page.Contents {
+			files = append(files, StorageFile{
+				Name:     strings.TrimPrefix(aws.StringValue(o.Key), prefix),
+				Size:     aws.Int64Value(o.Size),
+				Modified: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
+	})
+	return files, errors.Wrap(err, "list S3 objects")
+}
+
+func listGCS(stg pbm.S3) ([]StorageFile, error) {
+	mc, err := minio.NewWithRegion(pbm.GCSEndpointURL, stg.Credentials.AccessKeyID, stg.Credentials.SecretAccessKey, true, stg.Region)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewWithRegion")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	prefix := s3Prefix(stg)
+	var files []StorageFile
+	for o := range mc.ListObjects(stg.Bucket, prefix, true, done) {
+		if o.Err != nil {
+			return nil, errors.Wrap(o.Err, "list GCS objects")
+		}
+		files = append(files, StorageFile{
+			Name:     strings.TrimPrefix(o.Key, prefix),
+			Size:     o.Size,
+			Modified: o.LastModified,
+		})
+	}
+	return files, nil
+}
@@ -0,0 +1,23 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestIsDedupBlob(t *testing.T) {
+	hash := "ab0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcd"
+	for name, want := range map[string]bool{
+		pbm.DedupBlobPath(hash, pbm.CompressionTypeNone): true,
+		pbm.DedupBlobPath(hash, pbm.CompressionTypeGZIP): true,
+		pbm.DedupBlobsDir + "/ab/notes.txt":              false,
+		pbm.DedupBlobsDir + "/cd/" + hash:                false,
+		pbm.DedupBlobsDir + "/" + hash:                   false,
+		"data/ab/" + hash:                                false,
+	} {
+		if got := isDedupBlob(name); got != want {
+			t.Errorf("isDedupBlob(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
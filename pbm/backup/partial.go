@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// PartialSuffix marks the file being written to the filesystem storage.
+// The file is renamed to the final name once it's completely written.
+const PartialSuffix = ".partial"
+
+// PartialMaxAge is the age after which the partial file (or the S3
+// incomplete multipart upload) is considered abandoned by the crashed
+// or failed backup
+const PartialMaxAge = 24 * time.Hour
+
+// SweepPartials removes the abandoned partial files from the storage
+// and aborts the abandoned S3 multipart uploads (which parts are kept
+// on failures). The files are written continuously so the partial file
+// older than `olderThan` has no writer. The multipart uploads are dated by
+// the start, so they are left untouched while any backup is running.
+func SweepPartials(cn *pbm.PBM, olderThan time.Duration) (int, error) {
+	stg, err := cn.GetStorage()
+	if errors.Cause(err) == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "get storage")
+	}
+
+	before := time.Now().Add(-olderThan)
+	switch stg.Type {
+	case pbm.StorageFilesystem:
+		return sweepFS(stg.Filesystem.Path, before)
+	case pbm.StorageS3:
+		if stg.S3.Provider == pbm.S3ProviderGCS {
+			// GCS objects are uploaded in one piece
+			return 0, nil
+		}
+		locks, err := cn.GetLocks(&pbm.LockHeader{Type: pbm.CmdBackup})
+		if err != nil {
+			return 0, errors.Wrap(err, "get locks")
+		}
+		if len(locks) > 0 {
+			return 0, nil
+		}
+		return sweepS3(stg.S3, before)
+	}
+	return 0, nil
+}
+
+func sweepFS(root string, before time.Time) (int, error) {
+	n := 0
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, PartialSuffix) || info.ModTime().After(before) {
+			return nil
+		}
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove %s", p)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func sweepS3(stg pbm.S3, before time.Time) (int, error) {
+	awsSession, err := s3Session(stg)
+	if err != nil {
+		return 0, errors.Wrap(err, "create AWS session")
+	}
+	s3s := s3.New(awsSession)
+
+	n := 0
+	var aerr error
+	in := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(stg.Bucket),
+		Prefix: aws.String(stg.Prefix),
+	}
+	err = s3s.ListMultipartUploadsPages(in, func(out *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, u := range out.Uploads {
+			if u.Initiated == nil || u.Initiated.After(before) {
+				continue
+			}
+			_, aerr = s3s.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(stg.Bucket),
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			if aerr != nil {
+				aerr = errors.Wrapf(aerr, "abort upload of %s", aws.StringValue(u.Key))
+				return false
+			}
+			n++
+		}
+		return true
+	})
+	if err != nil {
+		return n, errors.Wrap(err, "list multipart uploads")
+	}
+	return n, aerr
+}
@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+const (
+	// progressWindow is the period the throughput is averaged over
+	progressWindow = time.Minute
+	// progressInterval is how often the progress is reported
+	progressInterval = 5 * time.Second
+)
+
+// progresses are the latest dump progress of each node the agent is
+// backing up by <replset>/<node>, exposed via expvar as "backup_progress".
+// The agent may serve the nodes of the different clusters with the same
+// replset names.
+var progresses sync.Map
+
+func init() {
+	expvar.Publish("backup_progress", expvar.Func(func() interface{} {
+		m := make(map[string]pbm.BackupProgress)
+		progresses.Range(func(k, v interface{}) bool {
+			m[k.(string)] = v.(pbm.BackupProgress)
+			return true
+		})
+		return m
+	}))
+}
+
+type progressSample struct {
+	at   time.Time
+	done int64
+}
+
+// dumpProgress tracks the data read by the dump and its rolling throughput
+type dumpProgress struct {
+	// done is the number of the bytes read so far
+	done int64
+	// total is the estimated size of the dump
+	total   int64
+	samples []progressSample
+}
+
+// estimate sets the dump size to the size of the `dumped` collections
+func (p *dumpProgress) estimate(colls []pbm.NSInfo, dumped []string) {
+	if p == nil {
+		return
+	}
+	ns := make(map[string]bool, len(dumped))
+	for _, n := range dumped {
+		ns[n] = true
+	}
+	var total int64
+	for _, c := range colls {
+		if ns[c.NS] {
+			total += c.Size
+		}
+	}
+	atomic.StoreInt64(&p.total, total)
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// wrap counts the data the dump writes into w. With nil dumpProgress
+// it's returned as is.
+func (p *dumpProgress) wrap(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return countWriter{w, &p.done}
+}
+
+// sample takes the current state and returns the progress with the
+// throughput over the last progressWindow and the ETA based on it
+func (p *dumpProgress) sample(now time.Time) pbm.BackupProgress {
+	done := atomic.LoadInt64(&p.done)
+	p.samples = append(p.samples, progressSample{now, done})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressWindow {
+		p.samples = p.samples[1:]
+	}
+
+	pr := pbm.BackupProgress{
+		Done:      done,
+		Total:     atomic.LoadInt64(&p.total),
+		UpdatedAt: now.Unix(),
+	}
+	// the collections grow during the dump
+	if pr.Total < pr.Done {
+		pr.Total = pr.Done
+	}
+
+	first := p.samples[0]
+	if d := now.Sub(first.at); d > 0 {
+		pr.Rate = int64(float64(done-first.done) / d.Seconds())
+	}
+	if pr.Rate > 0 {
+		pr.ETA = (pr.Total - pr.Done) / pr.Rate
+	}
+	return pr
+}
+
+// reportProgress periodically stores the dump progress of the replset
+// until ctx is done. The final state is stored with no ETA.
+func (b *Backup) reportProgress(ctx context.Context, p *dumpProgress, bcpName, rsName, node string) {
+	key := rsName + "/" + node
+	defer progresses.Delete(key)
+
+	tk := time.NewTicker(progressInterval)
+	defer tk.Stop()
+
+	p.sample(time.Now())
+	for {
+		select {
+		case <-tk.C:
+			pr := p.sample(time.Now())
+			progresses.Store(key, pr)
+			err := b.cn.SetRSProgress(bcpName, rsName, pr)
+			if err != nil {
+				log.Println("[ERROR] dump progress: write to db:", err)
+			}
+		case <-ctx.Done():
+			pr := p.sample(time.Now())
+			pr.Total, pr.ETA = pr.Done, 0
+			err := b.cn.SetRSProgress(bcpName, rsName, pr)
+			if err != nil {
+				log.Println("[ERROR] dump progress: write to db:", err)
+			}
+			return
+		}
+	}
+}
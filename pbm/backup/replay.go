@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// PlanReplay picks the oplog slices of the restorable backups which bring
+// every replset from the external snapshot taken at `snapshot` up to `until`.
+// Zero `until` is the latest point the oplog of every replset reaches
+// contiguously. The snapshot time has to fall within the oplog slices.
+func PlanReplay(cn *pbm.PBM, snapshot, until primitive.Timestamp) (*pbm.ExternalRestore, error) {
+	reports, err := ValidateChain(cn, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "check backups chain")
+	}
+	if len(reports) == 0 {
+		return nil, errors.New("no backups with the oplog")
+	}
+
+	if until.T == 0 {
+		for _, rep := range reports {
+			_, end, err := replayChain(rep, snapshot, until)
+			if err != nil {
+				return nil, errors.Wrapf(err, "replset %s", rep.Replset)
+			}
+			if until.T == 0 || primitive.CompareTimestamp(end, until) < 0 {
+				until = end
+			}
+		}
+	}
+
+	ext := &pbm.ExternalRestore{SnapshotTS: snapshot, Until: until}
+	for _, rep := range reports {
+		slices, _, err := replayChain(rep, snapshot, until)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replset %s", rep.Replset)
+		}
+		ext.Slices = append(ext.Slices, slices...)
+	}
+	return ext, nil
+}
+
+// replayChain picks the replset's slices covering the oplog after `from`
+// up to `until` or as far as they go contiguously if it's zero. Each next
+// slice is the one reaching the farthest from the end of the previous.
+func replayChain(rep ChainReport, from, until primitive.Timestamp) ([]pbm.OplogSlice, primitive.Timestamp, error) {
+	covered := from
+	var slices []pbm.OplogSlice
+	for until.T == 0 || primitive.CompareTimestamp(covered, until) < 0 {
+		best := -1
+		for i, l := range rep.Links {
+			if l.Broken != "" || primitive.CompareTimestamp(l.First, covered) > 0 || primitive.CompareTimestamp(l.Last, covered) <= 0 {
+				continue
+			}
+			if best < 0 || primitive.CompareTimestamp(l.Last, rep.Links[best].Last) > 0 {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		l := rep.Links[best]
+		slices = append(slices, pbm.OplogSlice{Replset: rep.Replset, Backup: l.Backup, First: l.First, Last: l.Last})
+		covered = l.Last
+	}
+
+	if len(slices) == 0 {
+		return nil, covered, errors.Errorf("snapshot time %d,%d is out of the oplog slices of the restorable backups, see pbm validate-chain", from.T, from.I)
+	}
+	if until.T > 0 && primitive.CompareTimestamp(covered, until) < 0 {
+		return nil, covered, errors.Errorf("oplog slices end at %d,%d (there is a gap or no later backups), can't replay up to %d,%d", covered.T, covered.I, until.T, until.I)
+	}
+	return slices, covered, nil
+}
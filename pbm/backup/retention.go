@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"log"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// SetRetention updates the expiry and the legal hold of the backup
+// both in the metadata and in the storage
+func SetRetention(cn *pbm.PBM, name string, expireAt int64, hold bool) error {
+	meta, err := cn.GetBackupMeta(name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	if meta.Name == "" {
+		return errors.Errorf("backup %s not found", name)
+	}
+
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return errors.Wrap(err, "get backup store")
+	}
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	key, err := cfg.Signing.SignKey()
+	if err != nil {
+		return errors.Wrap(err, "get manifest signing key")
+	}
+
+	meta.ExpireAt = expireAt
+	meta.LegalHold = hold
+
+	done := meta.Status == pbm.StatusDone || meta.Status == pbm.StatusPartlyDone
+
+	// the storage goes first: if it refuses the new retention
+	// the metadata is left as it was rather than diverge from it
+	if done {
+		err = protect(stg, meta, meta.Files())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cn.SetBackupRetention(name, expireAt, hold)
+	if err != nil {
+		return errors.Wrap(err, "update metadata")
+	}
+
+	if done {
+		err = writeMeta(stg, meta, key)
+		if err != nil {
+			return errors.Wrap(err, "dump metadata")
+		}
+		// the rewritten metadata is the new object
+		return protect(stg, meta, []string{meta.Name + ".pbm.json"})
+	}
+
+	return nil
+}
+
+// DeleteBackup deletes the backup files from the storage and its metadata
+func DeleteBackup(cn *pbm.PBM, name string) error {
+	meta, err := cn.GetBackupMeta(name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	if meta.Name == "" {
+		return errors.Errorf("backup %s not found", name)
+	}
+
+	err = meta.CheckDelete(time.Now())
+	if err != nil {
+		return err
+	}
+
+	deps, err := cn.DependentBackups(name)
+	if err != nil {
+		return errors.Wrap(err, "get dependent backups")
+	}
+	if len(deps) > 0 {
+		return errors.Errorf("backup %s is the base for the differential backups %v", name, deps)
+	}
+
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return errors.Wrap(err, "get backup store")
+	}
+
+	for _, f := range append(meta.Files(), meta.Name+".pbm.json"+pbm.SignatureSuffix) {
+		if f == "" {
+			continue
+		}
+		err = Delete(stg, f)
+		if err != nil {
+			return errors.Wrapf(err, "delete %s", f)
+		}
+	}
+
+	return errors.Wrap(cn.DeleteBackupMeta(name), "delete metadata")
+}
+
+// DeleteExpired deletes all backups which expiry date has passed.
+// Backups under the legal hold and bases of the existing
+// differential backups are left intact.
+func DeleteExpired(cn *pbm.PBM) error {
+	bcps, err := cn.BackupsList(0)
+	if err != nil {
+		return errors.Wrap(err, "get backups list")
+	}
+
+	now := time.Now()
+	// differential backups go first so their bases could be deleted after
+	for _, typ := range []pbm.BackupType{pbm.BackupTypeDifferential, pbm.BackupTypeFull} {
+		for _, b := range bcps {
+			if !b.Expired(now) || b.LegalHold || (b.Type == pbm.BackupTypeDifferential) != (typ == pbm.BackupTypeDifferential) {
+				continue
+			}
+
+			err := DeleteBackup(cn, b.Name)
+			if err != nil {
+				log.Printf("[WARNING] delete expired backup %s: %v", b.Name, err)
+				continue
+			}
+			log.Printf("[INFO] expired backup %s deleted", b.Name)
+		}
+	}
+
+	return nil
+}
+
+// protect applies the backup expiry and legal hold to the given files
+// as S3 Object Lock retention and legal hold if the bucket has Object Lock enabled.
+// Otherwise these are only honored by PBM itself.
+// The retain-until date is always set to the backup's RetainUntil, so
+// a shortened or removed expiry is applied as well (in the governance
+// mode it requires the s3:BypassGovernanceRetention permission).
+func protect(stg pbm.Storage, meta *pbm.BackupMeta, files []string) error {
+	if stg.Type != pbm.StorageS3 || stg.S3.Provider == pbm.S3ProviderGCS {
+		return nil
+	}
+
+	awsSession, err := s3Session(stg.S3)
+	if err != nil {
+		return errors.Wrap(err, "create AWS session")
+	}
+	cli := s3.New(awsSession)
+
+	lc, err := cli.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(stg.S3.Bucket),
+	})
+	if err != nil || lc.ObjectLockConfiguration == nil ||
+		aws.StringValue(lc.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return nil
+	}
+
+	hold := s3.ObjectLockLegalHoldStatusOff
+	if meta.LegalHold {
+		hold = s3.ObjectLockLegalHoldStatusOn
+	}
+
+	// an empty retention clears the existing one
+	retention := &s3.ObjectLockRetention{}
+	if until := meta.RetainUntil(); !until.IsZero() {
+		retention.Mode = aws.String(s3.ObjectLockRetentionModeGovernance)
+		retention.RetainUntilDate = aws.Time(until)
+	}
+
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		key := aws.String(path.Join(stg.S3.Prefix, f))
+
+		_, err = cli.PutObjectRetention(&s3.PutObjectRetentionInput{
+			Bucket:                    aws.String(stg.S3.Bucket),
+			Key:                       key,
+			Retention:                 retention,
+			BypassGovernanceRetention: aws.Bool(true),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "set object retention for %s", f)
+		}
+
+		_, err = cli.PutObjectLegalHold(&s3.PutObjectLegalHoldInput{
+			Bucket:    aws.String(stg.S3.Bucket),
+			Key:       key,
+			LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(hold)},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "set object legal hold for %s", f)
+		}
+	}
+
+	return nil
+}
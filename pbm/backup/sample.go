@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+const (
+	// sampleSize is how much of each collection is read to measure its compressibility
+	sampleSize = 4 << 20
+	// incompressible is the compressed to the raw size ratio from which
+	// the compression isn't worth the CPU (e.g. the already compressed blobs)
+	incompressible = 0.9
+)
+
+// sampleCompression measures the compressibility of the collections and
+// picks the compression for each of them: either the backup's one or none
+func (b *Backup) sampleCompression(ctx context.Context, colls []pbm.NSInfo, compression pbm.CompressionType) ([]pbm.CollCompression, error) {
+	var choices []pbm.CollCompression
+	for _, c := range colls {
+		if c.View {
+			continue
+		}
+		sampled, zipped, err := b.sampleColl(ctx, c.NS, compression)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sample %s", c.NS)
+		}
+		if sampled == 0 {
+			continue
+		}
+
+		cc := pbm.CollCompression{
+			NS:          c.NS,
+			Ratio:       math.Round(float64(zipped)/float64(sampled)*1000) / 1000,
+			Sampled:     sampled,
+			Compression: compression,
+		}
+		if cc.Ratio >= incompressible {
+			cc.Compression = pbm.CompressionTypeNone
+		}
+		choices = append(choices, cc)
+	}
+	return choices, nil
+}
+
+// uncompressedColls returns the collections the compression isn't chosen for
+func uncompressedColls(choices []pbm.CollCompression) []string {
+	var nss []string
+	for _, c := range choices {
+		if c.Compression == pbm.CompressionTypeNone {
+			nss = append(nss, c.NS)
+		}
+	}
+	return nss
+}
+
+// dumpUncompressed dumps each of the collections separately with
+// no compression. They are excluded from the node's dump, which is
+// the single stream compressed as a whole.
+func (b *Backup) dumpUncompressed(ctx context.Context, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, nss []string, oplogTS primitive.Timestamp, stg pbm.Storage) ([]pbm.Redump, error) {
+	c := bcp
+	c.Compression = pbm.CompressionTypeNone
+
+	redumps := make([]pbm.Redump, 0, len(nss))
+	for _, ns := range nss {
+		name := getDstName("redump-"+ns, c, rsMeta.Name)
+		hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, pbm.CompressionTypeNone)
+		hdr.OplogStart = oplogTS
+		hdr.Namespaces = []string{ns}
+		hdr.CreatedAt = time.Now().UTC().Unix()
+
+		db, coll := splitNS(ns)
+		err := b.dump(ctx, stg, name, hdr, db, coll, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "dump %s", ns)
+		}
+		redumps = append(redumps, pbm.Redump{NS: ns, Name: name})
+	}
+	return redumps, nil
+}
+
+// exceptNS returns the namespaces but the excluded ones
+func exceptNS(nss, exclude []string) []string {
+	ex := make(map[string]bool, len(exclude))
+	for _, ns := range exclude {
+		ex[ns] = true
+	}
+	keep := make([]string, 0, len(nss))
+	for _, ns := range nss {
+		if !ex[ns] {
+			keep = append(keep, ns)
+		}
+	}
+	return keep
+}
+
+// sampleColl compresses up to sampleSize of the collection's documents
+// and returns the raw and the compressed size of them
+func (b *Backup) sampleColl(ctx context.Context, ns string, compression pbm.CompressionType) (sampled, compressed int64, err error) {
+	db, coll := splitNS(ns)
+	cur, err := b.node.Session().Database(db).Collection(coll).Find(ctx, bson.D{}, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "query")
+	}
+	defer cur.Close(ctx)
+
+	var zn int64
+	w := CompressLevel(countWriter{ioutil.Discard, &zn}, compression, b.prof.CompressionLevel)
+	for sampled < sampleSize && cur.Next(ctx) {
+		n, err := w.Write(cur.Current)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "compress")
+		}
+		sampled += int64(n)
+	}
+	if err := cur.Err(); err != nil {
+		return 0, 0, errors.Wrap(err, "read")
+	}
+	err = w.Close()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "compress")
+	}
+
+	return sampled, zn, nil
+}
@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// noDocsQuery matches no documents. The empty $in is resolved by the
+// _id index, so the collection isn't scanned.
+const noDocsQuery = `{"_id":{"$in":[]}}`
+
+// schemaColls are the collections which the schema-only backup dumps
+// with the documents: users and roles, and the sharding metadata
+// on the config server
+var schemaColls = map[string][]string{
+	"admin":  {"system.users", "system.roles", "system.version"},
+	"config": {"databases", "collections", "chunks", "tags"},
+}
+
+// dumpSchemaColls dumps the users and roles and, on the config server,
+// the sharding metadata with the documents as the separate dumps
+func (b *Backup) dumpSchemaColls(ctx context.Context, bcp pbm.BackupCmd, im *pbm.IsMaster, rsMeta pbm.BackupReplset, oplogTS primitive.Timestamp, stg pbm.Storage) ([]pbm.Redump, error) {
+	dbs := []string{"admin"}
+	if im.ReplsetRole() == pbm.ReplRoleConfigSrv {
+		dbs = append(dbs, "config")
+	}
+
+	var redumps []pbm.Redump
+	for _, db := range dbs {
+		colls, err := b.node.Session().Database(db).ListCollectionNames(ctx, bson.D{{"name", bson.M{"$in": schemaColls[db]}}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "list %s collections", db)
+		}
+
+		for _, coll := range colls {
+			ns := db + "." + coll
+			name := getDstName("redump-"+ns, bcp, rsMeta.Name)
+			hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, bcp.Compression)
+			hdr.OplogStart = oplogTS
+			hdr.Namespaces = []string{ns}
+			hdr.CreatedAt = time.Now().UTC().Unix()
+
+			err = b.dump(ctx, stg, name, hdr, db, coll, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "dump %s", ns)
+			}
+			redumps = append(redumps, pbm.Redump{NS: ns, Name: name})
+		}
+	}
+	return redumps, nil
+}
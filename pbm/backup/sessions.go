@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// dumpSessions writes the replset's sessions records (config.transactions)
+// as of the end of the oplog slice. mongodump leaves them out, so the
+// write retried by the client after the restore would be applied again.
+// The records of the transactions in progress aren't captured.
+func (b *Backup) dumpSessions(ctx context.Context, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, end primitive.Timestamp, stg pbm.Storage) error {
+	name := getDstName("sessions", bcp, rsMeta.Name)
+	hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeSessions, bcp.Name, rsMeta.Name, bcp.Compression)
+	hdr.CreatedAt = time.Now().UTC().Unix()
+
+	r, pw := io.Pipe()
+	defer r.Close()
+	w := b.compress(pw, bcp.Compression)
+
+	var err rwErr
+	go func() {
+		err.read = pbm.WriteArchiveHeader(pw, hdr)
+		if err.read == nil {
+			err.read = b.copySessions(ctx, w, end)
+		}
+		err.compress = w.Close()
+		pw.Close()
+	}()
+
+	err.write = b.save(r, stg, name, hdr.Compression, 0)
+	if !err.nil() {
+		return err
+	}
+
+	return errors.Wrap(b.cn.SetRSSessions(bcp.Name, rsMeta.Name, name), "set sessions file")
+}
+
+// sessionsFilter selects the records of the sessions which last write
+// is in the oplog slice ending at `end`. The records are read after the
+// slice is closed, and the one of the write beyond the slice would make
+// the server take the client's retry of this write as done, so the write
+// would be lost. The session loses its record then, and the retry of
+// its earlier write is applied again as without the records at all.
+func sessionsFilter(end primitive.Timestamp) bson.D {
+	return bson.D{
+		{"state", bson.D{{"$nin", bson.A{"inProgress", "prepared"}}}},
+		{"lastWriteOpTime.ts", bson.D{{"$lte", end}}},
+	}
+}
+
+func (b *Backup) copySessions(ctx context.Context, w io.Writer, end primitive.Timestamp) error {
+	// the delayed member's sessions are behind the end of the oplog slice,
+	// they are read from the primary which is ahead of it, up to the end
+	src := b.node
+	if b.primary != nil {
+		src = b.primary
+	}
+	cur, err := src.Session().Database("config").Collection("transactions").Find(ctx, sessionsFilter(end))
+	if err != nil {
+		return errors.Wrap(err, "query config.transactions")
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		_, err = w.Write(cur.Current)
+		if err != nil {
+			return errors.Wrap(err, "write to pipe")
+		}
+	}
+	return errors.Wrap(cur.Err(), "read config.transactions")
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// skipBySize splits the collections into the ones to back up and the
+// namespaces out of the [min, max] size limits. Zero limit is no limit.
+// Views have no size of their own, so they are always kept.
+func skipBySize(colls []pbm.NSInfo, min, max int64) (keep []pbm.NSInfo, skipped []string) {
+	if min <= 0 && max <= 0 {
+		return colls, nil
+	}
+
+	keep = make([]pbm.NSInfo, 0, len(colls))
+	for _, c := range colls {
+		if !c.View && (min > 0 && c.Size < min || max > 0 && c.Size > max) {
+			skipped = append(skipped, c.NS)
+			continue
+		}
+		keep = append(keep, c)
+	}
+	return keep, skipped
+}
+
+// collNames returns the distinct collection names of the namespaces
+func collNames(nss []string) []string {
+	seen := make(map[string]bool, len(nss))
+	names := make([]string, 0, len(nss))
+	for _, ns := range nss {
+		_, coll := splitNS(ns)
+		if !seen[coll] {
+			seen[coll] = true
+			names = append(names, coll)
+		}
+	}
+	return names
+}
+
+// dumpNamesakes dumps separately the collections which have the same name as
+// the skipped ones. The dump of the whole node excludes the collections by
+// the name in every database, so they are missing from the main dump.
+func (b *Backup) dumpNamesakes(ctx context.Context, bcp pbm.BackupCmd, rsMeta pbm.BackupReplset, dumped, skipped []string, oplogTS primitive.Timestamp, stg pbm.Storage) ([]pbm.Redump, error) {
+	excluded := make(map[string]bool, len(skipped))
+	for _, c := range collNames(skipped) {
+		excluded[c] = true
+	}
+
+	var redumps []pbm.Redump
+	for _, ns := range dumped {
+		db, coll := splitNS(ns)
+		if !excluded[coll] {
+			continue
+		}
+
+		b.jlog.Infof("dump", "%s has the name of the skipped collection, dumping it separately", ns)
+		name := getDstName("redump-"+ns, bcp, rsMeta.Name)
+		hdr := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, bcp.Name, rsMeta.Name, bcp.Compression)
+		hdr.OplogStart = oplogTS
+		hdr.Namespaces = []string{ns}
+		hdr.CreatedAt = time.Now().UTC().Unix()
+		hdr.NoDocs = bcp.Type == pbm.BackupTypeSchema
+
+		err := b.dump(ctx, stg, name, hdr, db, coll, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "dump %s", ns)
+		}
+		redumps = append(redumps, pbm.Redump{NS: ns, Name: name})
+	}
+	return redumps, nil
+}
@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+const (
+	// minRate is the rate the latency guard doesn't go below
+	// so the backup still makes progress
+	minRate = 1 << 20
+	// minP99Threshold is the p99 latency (micros) the guard doesn't
+	// act below since the idle node's latency is too noisy
+	minP99Threshold = 1000
+	latencySample   = time.Second * 5
+	probeInterval   = time.Millisecond * 100
+)
+
+// throttle limits the rate of the writes into w, so the source
+// (mongodump or the oplog slicer) reads the node at most at that rate.
+// The rate can be changed while writing.
+type throttle struct {
+	w    io.Writer
+	rate int64 // bytes per second
+
+	winRate  int64
+	winStart time.Time
+	winBytes int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate}
+}
+
+func (t *throttle) setRate(r int64) { atomic.StoreInt64(&t.rate, r) }
+func (t *throttle) getRate() int64  { return atomic.LoadInt64(&t.rate) }
+
+// wrap returns the writer limited by the throttle. There has to be
+// only one writer in use at a time.
+func (t *throttle) wrap(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	t.w = w
+	t.winRate = 0
+	return t
+}
+
+func (t *throttle) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		rate := t.getRate()
+		if rate <= 0 {
+			m, err := t.w.Write(p)
+			return n + m, err
+		}
+
+		// write by ~100ms of the rate so the sleeps are short
+		chunk := p
+		if max := rate/10 + 1; int64(len(chunk)) > max {
+			chunk = p[:max]
+		}
+		m, err := t.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		t.wait(rate, m)
+	}
+	return n, nil
+}
+
+func (t *throttle) wait(rate int64, n int) {
+	if rate != t.winRate || time.Since(t.winStart) > time.Minute {
+		t.winRate = rate
+		t.winStart = time.Now()
+		t.winBytes = 0
+	}
+	t.winBytes += int64(n)
+
+	ahead := time.Duration(float64(t.winBytes)/float64(rate)*float64(time.Second)) - time.Since(t.winStart)
+	if ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// probeLatency returns the p99 latency (micros) of the probe reads
+// done every probeInterval during latencySample
+func (b *Backup) probeLatency(ctx context.Context) (int64, error) {
+	var lat []time.Duration
+	tk := time.NewTicker(probeInterval)
+	defer tk.Stop()
+	end := time.After(latencySample)
+	for {
+		select {
+		case <-tk.C:
+		case <-end:
+			return pbm.LatencyP99(lat), nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+
+		l, err := b.node.ProbeLatency()
+		if err != nil {
+			return 0, err
+		}
+		lat = append(lat, l)
+	}
+}
+
+// guardLatency halves the read rate while the node's p99 probe latency is
+// over the baseline by pbm.LatencyGuardFactor and brings it back gradually
+// after. The observed latencies are reported to the backup's log.
+func (b *Backup) guardLatency(ctx context.Context, t *throttle, baseline int64) {
+	threshold := int64(float64(baseline) * pbm.LatencyGuardFactor)
+	if threshold < minP99Threshold {
+		threshold = minP99Threshold
+	}
+	maxRate := t.getRate()
+	var maxP99 int64
+	slowdowns := 0
+	defer func() {
+		b.jlog.Infof("profile", "p99 probe latency: before the backup %dus, max %dus, threshold %dus, slowdowns %d",
+			baseline, maxP99, threshold, slowdowns)
+	}()
+
+	for {
+		p99, err := b.probeLatency(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			b.jlog.Warningf("profile", "probe latency: %v", err)
+			continue
+		}
+		if p99 > maxP99 {
+			maxP99 = p99
+		}
+
+		rate := t.getRate()
+		switch {
+		case p99 > threshold && rate > minRate:
+			rate /= 2
+			if rate < minRate {
+				rate = minRate
+			}
+			slowdowns++
+			b.jlog.Debugf("profile", "p99 probe latency %dus is over %dus, slowing down to %dMB/s", p99, threshold, rate>>20)
+		case p99 <= threshold && rate < maxRate:
+			rate += rate / 4
+			if rate > maxRate {
+				rate = maxRate
+			}
+		}
+		t.setRate(rate)
+	}
+}
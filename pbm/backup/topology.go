@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkTopology records the current cluster topology into the backup
+// metadata and compares it with the previous successful backup's one.
+// Added or removed replsets and members are flagged in the metadata.
+func (b *Backup) checkTopology(meta *pbm.BackupMeta, im *pbm.IsMaster) error {
+	topo, err := b.cn.Topology(im)
+	if err != nil {
+		return errors.Wrap(err, "get topology")
+	}
+	meta.Topology = topo
+
+	bcps, err := b.cn.BackupsList(0)
+	if err != nil {
+		return errors.Wrap(err, "get backups list")
+	}
+	for _, prev := range bcps {
+		if prev.Name == meta.Name || len(prev.Topology) == 0 ||
+			(prev.Status != pbm.StatusDone && prev.Status != pbm.StatusPartlyDone) {
+			continue
+		}
+
+		drift := pbm.DiffTopology(prev.Name, prev.Topology, topo)
+		if !drift.Empty() {
+			b.jlog.Warningf("start", "%s", drift)
+			meta.TopologyDrift = &drift
+		}
+		return nil
+	}
+
+	return nil
+}
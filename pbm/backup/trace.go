@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// pipeTimes accounts the time the dump/oplog pipeline
+// (read -> compress -> upload) spends in each stage
+type pipeTimes struct {
+	start time.Time
+	// write is the time the reader spent writing into the compressor
+	write int64
+	// pipe is the time the compressor waited for the upload to take the data
+	pipe int64
+	// wait is the time the upload waited for the data
+	wait int64
+}
+
+func newPipeTimes() *pipeTimes {
+	return &pipeTimes{start: time.Now()}
+}
+
+type timedWriter struct {
+	w io.Writer
+	d *int64
+}
+
+func (t timedWriter) Write(p []byte) (int, error) {
+	s := time.Now()
+	n, err := t.w.Write(p)
+	atomic.AddInt64(t.d, int64(time.Since(s)))
+	return n, err
+}
+
+type timedReader struct {
+	r io.Reader
+	d *int64
+}
+
+func (t timedReader) Read(p []byte) (int, error) {
+	s := time.Now()
+	n, err := t.r.Read(p)
+	atomic.AddInt64(t.d, int64(time.Since(s)))
+	return n, err
+}
+
+// setAttrs records the time of each stage into the span.
+// The stages run concurrently so the times overlap
+// with each other and with the waiting on the slower ones.
+func (t *pipeTimes) setAttrs(span *pbm.Span) {
+	total := time.Since(t.start)
+	write := time.Duration(atomic.LoadInt64(&t.write))
+	pipe := time.Duration(atomic.LoadInt64(&t.pipe))
+	wait := time.Duration(atomic.LoadInt64(&t.wait))
+
+	span.SetAttr("read", (total - write).Round(time.Millisecond).String())
+	span.SetAttr("compress", (write - pipe).Round(time.Millisecond).String())
+	span.SetAttr("upload", (total - wait).Round(time.Millisecond).String())
+}
+
+// wrapPipe wraps the compressor's and the upload's ends of the pipe.
+// With nil times they are returned as is.
+func (t *pipeTimes) wrapPipe(w io.Writer, r io.Reader) (io.Writer, io.Reader) {
+	if t == nil {
+		return w, r
+	}
+	return timedWriter{w, &t.pipe}, timedReader{r, &t.wait}
+}
+
+// wrapSource wraps the compressor the reader writes to
+func (t *pipeTimes) wrapSource(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return timedWriter{w, &t.write}
+}
+
+// endStep finishes the span of the backup step
+// recording the pipeline stages time into it
+func (b *Backup) endStep(span *pbm.Span, err error) {
+	if b.times != nil {
+		b.times.setAttrs(span)
+		b.times = nil
+	}
+	span.Finish(err)
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// uploadTuner picks the concurrency of the adaptive S3 uploads of the agent
+var uploadTuner = &concurrencyTuner{rates: make(map[int]tunerRate)}
+
+const (
+	// tunerGain is the throughput gain an extra upload stream
+	// has to give to be worth the memory it takes
+	tunerGain = 1.1
+	// tunerStale is the time after which the observed throughput is
+	// forgotten, so the tuner re-explores as the bandwidth changes
+	tunerStale = time.Hour
+)
+
+type tunerRate struct {
+	bps float64
+	ts  time.Time
+}
+
+// concurrencyTuner does a hill climbing of the upload concurrency:
+// it adds a stream while it gives a noticeable throughput gain
+// and steps back once it doesn't.
+type concurrencyTuner struct {
+	mu    sync.Mutex
+	cur   int
+	rates map[int]tunerRate
+}
+
+// next returns the concurrency for the next upload
+func (t *concurrencyTuner) next(max int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cur < 1 {
+		t.cur = 1
+	}
+	if t.cur > max {
+		t.cur = max
+	}
+	return t.cur
+}
+
+// report takes the throughput of the upload done with `c` parallel parts.
+// Uploads too small to keep all the streams busy say nothing
+// about the concurrency and are ignored.
+func (t *concurrencyTuner) report(c int, n int64, d time.Duration, partSize int64) {
+	if n < 2*int64(c)*partSize || d <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(n) / d.Seconds()
+	t.rates[c] = tunerRate{bps: rate, ts: now}
+
+	lower, okl := t.rate(c-1, now)
+	upper, oku := t.rate(c+1, now)
+	switch {
+	case okl && rate < lower*tunerGain:
+		t.cur = c - 1
+	case !oku || upper > rate*tunerGain:
+		t.cur = c + 1
+	default:
+		t.cur = c
+	}
+}
+
+func (t *concurrencyTuner) rate(c int, now time.Time) (float64, bool) {
+	r, ok := t.rates[c]
+	if !ok || now.Sub(r.ts) > tunerStale {
+		return 0, false
+	}
+	return r.bps, true
+}
+
+// countReader counts the bytes read from the underlying reader
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,82 @@
+package pbm
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BalancerHold is the record of the operations holding the balancer stopped.
+// The balancer is put back by the last of them to finish.
+type BalancerHold struct {
+	// Holders are the names of the operations holding the balancer
+	Holders []string `bson:"holders" json:"holders"`
+	// WasOn is the balancer state before the first holder stopped it
+	WasOn bool `bson:"wasOn" json:"wasOn"`
+}
+
+const balancerHoldID = "balancer"
+
+// AddBalancerHolder adds the operation to the balancer holders. The balancer
+// state `on` is recorded only if the operation is the first holder.
+func (p *PBM) AddBalancerHolder(op string, on bool) error {
+	_, err := p.Conn.Database(DB).Collection(BalancerHoldCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"_id", balancerHoldID}},
+		bson.D{
+			{"$addToSet", bson.M{"holders": op}},
+			{"$setOnInsert", bson.M{"wasOn": on}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return errors.Wrap(err, "write into db")
+}
+
+// RemoveBalancerHolders removes the operations from the balancer holders.
+// It returns the hold record if there are no holders left, which means
+// the caller is the one to put the balancer back, and nil otherwise.
+func (p *PBM) RemoveBalancerHolders(ops ...string) (*BalancerHold, error) {
+	h := new(BalancerHold)
+	err := p.Conn.Database(DB).Collection(BalancerHoldCollection).FindOneAndUpdate(
+		p.ctx,
+		bson.D{{"_id", balancerHoldID}},
+		bson.D{{"$pull", bson.M{"holders": bson.M{"$in": ops}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(h)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "write into db")
+	}
+	if len(h.Holders) > 0 {
+		return nil, nil
+	}
+
+	// someone may have become a holder in the meantime
+	res, err := p.Conn.Database(DB).Collection(BalancerHoldCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"_id", balancerHoldID}, {"holders", bson.M{"$size": 0}}},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "delete from db")
+	}
+	if res.DeletedCount == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// GetBalancerHold returns the balancer hold record, nil if there is none
+func (p *PBM) GetBalancerHold() (*BalancerHold, error) {
+	h := new(BalancerHold)
+	err := p.Conn.Database(DB).Collection(BalancerHoldCollection).FindOne(
+		p.ctx,
+		bson.D{{"_id", balancerHoldID}},
+	).Decode(h)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return h, errors.Wrap(err, "query mongo")
+}
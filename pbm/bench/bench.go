@@ -0,0 +1,208 @@
+// Package bench measures the throughput of the restore pipeline: the oplog
+// replay and the dump insertion. The data is generated in the dedicated
+// database of the target node, which is dropped before and after each run.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// DefaultDB is the database the benchmark data is generated in
+const DefaultDB = "pbmbench"
+
+const benchColl = "data"
+
+// Opts are the options of the benchmark run
+type Opts struct {
+	// DB is the database to generate the data in. It's dropped!
+	DB string
+	// Ops is the number of the oplog entries or the documents
+	Ops int
+	// DocSize is the size of the payload of each document in bytes
+	DocSize int
+}
+
+// Result is the outcome of the benchmark run
+type Result struct {
+	Name  string
+	Ops   int
+	Bytes int64
+	Took  time.Duration
+}
+
+// OpsPerSec returns the throughput in operations per second
+func (r Result) OpsPerSec() float64 {
+	if r.Took <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Took.Seconds()
+}
+
+// BytesPerSec returns the throughput in bytes per second
+func (r Result) BytesPerSec() float64 {
+	if r.Took <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Took.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s: %d ops, %d bytes in %v: %.0f ops/sec, %.2f MB/sec",
+		r.Name, r.Ops, r.Bytes, r.Took.Round(time.Millisecond), r.OpsPerSec(), r.BytesPerSec()/1024/1024)
+}
+
+// OplogApply measures how fast the oplog is applied to the node. The oplog
+// is the mix of inserts (60%), updates (30%) and deletes (10%) generated
+// in memory beforehand so only the replay is timed.
+func OplogApply(node *pbm.Node, o Opts) (Result, error) {
+	res := Result{Name: "oplog apply", Ops: o.Ops}
+
+	ver, err := node.GetMongoVersion()
+	if err != nil || len(ver.Version) < 1 {
+		return res, errors.Wrap(err, "define mongo version")
+	}
+
+	var buf bytes.Buffer
+	err = GenOplog(&buf, o.DB+"."+benchColl, o.Ops, o.DocSize)
+	if err != nil {
+		return res, errors.Wrap(err, "generate oplog")
+	}
+	res.Bytes = int64(buf.Len())
+
+	err = drop(node, o.DB)
+	if err != nil {
+		return res, err
+	}
+	defer drop(node, o.DB)
+
+	err = node.Session().Database(o.DB).RunCommand(node.Context(), bson.D{{"create", benchColl}}).Err()
+	if err != nil {
+		return res, errors.Wrap(err, "create collection")
+	}
+
+	start := time.Now()
+	err = restore.NewOplog(node, ver, false).Apply(ioutil.NopCloser(&buf))
+	res.Took = time.Since(start)
+	return res, errors.Wrap(err, "apply oplog")
+}
+
+// GenOplog writes `n` oplog entries on the namespace `ns` into `w`
+func GenOplog(w io.Writer, ns string, n, docSize int) error {
+	payload := make([]byte, docSize)
+	_, err := rand.Read(payload)
+	if err != nil {
+		return errors.Wrap(err, "read random")
+	}
+
+	ts := primitive.Timestamp{T: uint32(time.Now().Unix())}
+	inserted, deleted := 0, 0
+	for i := 0; i < n; i++ {
+		ts.I++
+		e := db.Oplog{
+			Timestamp: ts,
+			Version:   2,
+			Namespace: ns,
+		}
+		switch {
+		case i%10 < 6 || inserted == deleted:
+			e.Operation = "i"
+			e.Object = bson.D{{"_id", inserted}, {"payload", payload}}
+			inserted++
+		case i%10 < 9:
+			e.Operation = "u"
+			e.Query = bson.D{{"_id", deleted + i%(inserted-deleted)}}
+			e.Object = bson.D{{"$set", bson.D{{"updated", i}}}}
+		default:
+			e.Operation = "d"
+			e.Object = bson.D{{"_id", deleted}}
+			deleted++
+		}
+
+		b, err := bson.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err, "marshal entry")
+		}
+		_, err = w.Write(b)
+		if err != nil {
+			return errors.Wrap(err, "write entry")
+		}
+	}
+	return nil
+}
+
+// RestoreInsert measures how fast the dump is restored into the node.
+// The documents are inserted and dumped beforehand so only the restore
+// (mongorestore with the pbm options) is timed.
+func RestoreInsert(ctx context.Context, node *pbm.Node, o Opts) (Result, error) {
+	res := Result{Name: "restore insert", Ops: o.Ops}
+
+	err := drop(node, o.DB)
+	if err != nil {
+		return res, err
+	}
+	defer drop(node, o.DB)
+
+	err = seed(node, o)
+	if err != nil {
+		return res, errors.Wrap(err, "seed data")
+	}
+
+	var buf bytes.Buffer
+	err = backup.DumpNS(ctx, &buf, node.ConnURI(), o.DB, "")
+	if err != nil {
+		return res, errors.Wrap(err, "dump data")
+	}
+	res.Bytes = int64(buf.Len())
+
+	// the restore drops the collection before the insert
+	start := time.Now()
+	err = restore.New(nil, node).RestoreArchive(&buf, false)
+	res.Took = time.Since(start)
+	return res, errors.Wrap(err, "restore dump")
+}
+
+func seed(node *pbm.Node, o Opts) error {
+	payload := make([]byte, o.DocSize)
+	_, err := rand.Read(payload)
+	if err != nil {
+		return errors.Wrap(err, "read random")
+	}
+
+	const batch = 1000
+	coll := node.Session().Database(o.DB).Collection(benchColl)
+	docs := make([]interface{}, 0, batch)
+	for i := 0; i < o.Ops; i++ {
+		docs = append(docs, bson.D{{"_id", i}, {"payload", payload}})
+		if len(docs) == batch || i == o.Ops-1 {
+			_, err := coll.InsertMany(node.Context(), docs)
+			if err != nil {
+				return errors.Wrap(err, "insert")
+			}
+			docs = docs[:0]
+		}
+	}
+	return nil
+}
+
+func drop(node *pbm.Node, dbName string) error {
+	if dbName == "" || dbName == pbm.DB || dbName == "admin" || dbName == "local" || dbName == "config" {
+		return errors.Errorf("database %s can't be used for the benchmark", dbName)
+	}
+	err := node.Session().Database(dbName).Drop(node.Context())
+	return errors.Wrapf(err, "drop database %s", dbName)
+}
@@ -0,0 +1,68 @@
+package bench
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+const docSize = 1024
+
+func BenchmarkGenOplog(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err := GenOplog(ioutil.Discard, DefaultDB+"."+benchColl, 1000, docSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchNode connects to the node given by PBM_MONGODB_URI, the benchmarks
+// against the node are skipped if it's not set. The node is disconnected
+// by the returned func.
+func benchNode(b *testing.B) (*pbm.Node, func()) {
+	uri := os.Getenv("PBM_MONGODB_URI")
+	if uri == "" {
+		b.Skip("PBM_MONGODB_URI isn't set")
+	}
+
+	ctx := context.Background()
+	cn, err := mongo.NewClient(options.Client().ApplyURI(uri).SetAppName("pbm-bench").SetDirect(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return pbm.NewNode(ctx, "node0", cn, uri), func() { cn.Disconnect(ctx) }
+}
+
+func report(b *testing.B, res Result, err error) {
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(res.Bytes / int64(res.Ops))
+	b.ReportMetric(res.OpsPerSec(), "ops/s")
+}
+
+func BenchmarkOplogApply(b *testing.B) {
+	node, done := benchNode(b)
+	defer done()
+	res, err := OplogApply(node, Opts{DB: DefaultDB, Ops: b.N, DocSize: docSize})
+	report(b, res, err)
+}
+
+func BenchmarkRestoreInsert(b *testing.B) {
+	node, done := benchNode(b)
+	defer done()
+	res, err := RestoreInsert(context.Background(), node, Opts{DB: DefaultDB, Ops: b.N, DocSize: docSize})
+	report(b, res, err)
+}
@@ -6,6 +6,11 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// MaxOplogEntrySize is the max size of the oplog entry. It's greater than
+// the max document size (16MB) since the entry of the max size document
+// carries the document along with the entry's own fields.
+const MaxOplogEntrySize = 16*1024*1024 + 16*1024
+
 type OpTime struct {
 	TS   primitive.Timestamp `bson:"ts" json:"ts"`
 	Term int64               `bson:"t" json:"t"`
@@ -68,6 +73,23 @@ func (im *IsMaster) ReplsetRole() ReplRole {
 	}
 }
 
+// CausalPoint returns the node's majority commit point and cluster time
+func (im *IsMaster) CausalPoint() CausalPoint {
+	p := CausalPoint{Majority: im.LastWrite.MajorityOpTime}
+	if im.ClusterTime != nil {
+		p.ClusterTime = im.ClusterTime.ClusterTime
+	}
+	return p
+}
+
+// CausalPoint is the position of the replset in the cluster time
+type CausalPoint struct {
+	// Majority is the replset's majority committed opTime
+	Majority OpTime `bson:"majority" json:"majority"`
+	// ClusterTime is the cluster time as seen by the node
+	ClusterTime primitive.Timestamp `bson:"cluster_time" json:"cluster_time"`
+}
+
 // IsStandalone returns true if node is not a part of replica set
 func (im *IsMaster) IsStandalone() bool {
 	return im.SetName == ""
@@ -205,3 +227,24 @@ type Shard struct {
 	ID   string `bson:"_id"`
 	Host string `bson:"host"`
 }
+
+// RSConfig is a replica set configuration document
+// https://docs.mongodb.com/manual/reference/replica-configuration/
+type RSConfig struct {
+	ID        string     `bson:"_id" json:"_id" yaml:"_id"`
+	Version   int        `bson:"version" json:"version" yaml:"version,omitempty"`
+	ConfigSvr bool       `bson:"configsvr,omitempty" json:"configsvr,omitempty" yaml:"configsvr,omitempty"`
+	Members   []RSMember `bson:"members" json:"members" yaml:"members"`
+}
+
+// RSMember is a member of the replica set configuration
+type RSMember struct {
+	ID          int      `bson:"_id" json:"_id" yaml:"_id"`
+	Host        string   `bson:"host" json:"host" yaml:"host"`
+	ArbiterOnly bool     `bson:"arbiterOnly,omitempty" json:"arbiterOnly,omitempty" yaml:"arbiterOnly,omitempty"`
+	Hidden      bool     `bson:"hidden,omitempty" json:"hidden,omitempty" yaml:"hidden,omitempty"`
+	Priority    *float64 `bson:"priority,omitempty" json:"priority,omitempty" yaml:"priority,omitempty"`
+	Votes       *int     `bson:"votes,omitempty" json:"votes,omitempty" yaml:"votes,omitempty"`
+	// SlaveDelay is the delay (sec) of the delayed member
+	SlaveDelay int64 `bson:"slaveDelay,omitempty" json:"slaveDelay,omitempty" yaml:"slaveDelay,omitempty"`
+}
@@ -0,0 +1,151 @@
+package pbm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/version"
+)
+
+// BuildInfo is the versions of the tool and of the server
+// of the node which has made the replset's part of the backup
+type BuildInfo struct {
+	Node            string `bson:"node" json:"node"`
+	PBMVersion      string `bson:"pbm_version" json:"pbm_version"`
+	GitCommit       string `bson:"git_commit,omitempty" json:"git_commit,omitempty"`
+	GoVersion       string `bson:"go_version,omitempty" json:"go_version,omitempty"`
+	MongoVersion    string `bson:"mongodb_version" json:"mongodb_version"`
+	MongoGitVersion string `bson:"mongodb_git_version,omitempty" json:"mongodb_git_version,omitempty"`
+	StorageEngine   string `bson:"storage_engine,omitempty" json:"storage_engine,omitempty"`
+	FCV             string `bson:"fcv,omitempty" json:"fcv,omitempty"`
+}
+
+func (b BuildInfo) String() string {
+	s := fmt.Sprintf("PBM %s", b.PBMVersion)
+	if b.GitCommit != "" {
+		s += fmt.Sprintf(" (%s)", b.GitCommit)
+	}
+	s += fmt.Sprintf(", MongoDB %s", b.MongoVersion)
+	if b.StorageEngine != "" {
+		s += fmt.Sprintf(" %s", b.StorageEngine)
+	}
+	if b.FCV != "" {
+		s += fmt.Sprintf(", FCV %s", b.FCV)
+	}
+	return s
+}
+
+// BuildInfo returns the versions of the tool and of the node's server
+func (n *Node) BuildInfo() (BuildInfo, error) {
+	bi := BuildInfo{
+		PBMVersion: version.DefaultInfo.Version,
+		GitCommit:  version.DefaultInfo.GitCommit,
+		GoVersion:  version.DefaultInfo.GoVersion,
+	}
+
+	im, err := n.GetIsMaster()
+	if err != nil {
+		return bi, errors.Wrap(err, "get isMaster")
+	}
+	bi.Node = im.Me
+
+	build := struct {
+		Version    string `bson:"version"`
+		GitVersion string `bson:"gitVersion"`
+	}{}
+	err = n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"buildInfo", 1}}).Decode(&build)
+	if err != nil {
+		return bi, errors.Wrap(err, "run buildInfo")
+	}
+	bi.MongoVersion, bi.MongoGitVersion = build.Version, build.GitVersion
+
+	status := struct {
+		StorageEngine struct {
+			Name string `bson:"name"`
+		} `bson:"storageEngine"`
+	}{}
+	err = n.cn.Database(DB).RunCommand(n.ctx, bson.D{
+		{"serverStatus", 1},
+		{"repl", 0},
+		{"metrics", 0},
+		{"locks", 0},
+	}).Decode(&status)
+	if err != nil {
+		return bi, errors.Wrap(err, "run serverStatus")
+	}
+	bi.StorageEngine = status.StorageEngine.Name
+
+	// the standalone node of the old versions has no FCV
+	bi.FCV, _ = n.fcv()
+
+	return bi, nil
+}
+
+// CheckCompat checks that the backup made on `from` can be restored on `to`.
+// The backup of the newer PBM may have the format the older one doesn't know,
+// and the data of the newer MongoDB may not fit the older one, these are the
+// errors. The rest of the differences are the warnings.
+func CheckCompat(from, to BuildInfo) (warns []string, err error) {
+	fpbm, fok := majorMinor(from.PBMVersion)
+	tpbm, tok := majorMinor(to.PBMVersion)
+	switch {
+	case !fok || !tok:
+		warns = append(warns, fmt.Sprintf("can't compare PBM versions %q of the backup and %q of the agent", from.PBMVersion, to.PBMVersion))
+	case compareVersions(fpbm, tpbm) > 0:
+		return warns, errors.Errorf("backup is made by PBM %s, newer than %s of the agent, upgrade the agents", from.PBMVersion, to.PBMVersion)
+	}
+
+	fdb, fok := majorMinor(from.MongoVersion)
+	tdb, tok := majorMinor(to.MongoVersion)
+	switch {
+	case !fok || !tok:
+		warns = append(warns, fmt.Sprintf("can't compare MongoDB versions %q of the backup and %q of the node", from.MongoVersion, to.MongoVersion))
+	case compareVersions(fdb, tdb) > 0:
+		return warns, errors.Errorf("backup is made on MongoDB %s, restore to the older %s isn't supported", from.MongoVersion, to.MongoVersion)
+	case compareVersions(fdb, tdb) < 0:
+		warns = append(warns, fmt.Sprintf("backup is made on MongoDB %s, restoring to %s", from.MongoVersion, to.MongoVersion))
+	}
+
+	if from.StorageEngine != "" && to.StorageEngine != "" && from.StorageEngine != to.StorageEngine {
+		warns = append(warns, fmt.Sprintf("backup is made on %s storage engine, restoring to %s", from.StorageEngine, to.StorageEngine))
+	}
+	if from.FCV != "" && to.FCV != "" && from.FCV != to.FCV {
+		warns = append(warns, fmt.Sprintf("backup is made with featureCompatibilityVersion %s, the node has %s", from.FCV, to.FCV))
+	}
+
+	return warns, nil
+}
+
+// majorMinor parses the major and minor numbers of the version
+// like 1.2.3, v1.2 or 4.2.1-ent
+func majorMinor(v string) ([2]int, bool) {
+	var mm [2]int
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	if len(parts) < 2 {
+		return mm, false
+	}
+	for i := range mm {
+		n, err := strconv.Atoi(strings.SplitN(parts[i], "-", 2)[0])
+		if err != nil {
+			return mm, false
+		}
+		mm[i] = n
+	}
+	return mm, true
+}
+
+func compareVersions(a, b [2]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
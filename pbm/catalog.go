@@ -0,0 +1,96 @@
+package pbm
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CatalogVersion is the version of the catalog file format
+const CatalogVersion = 1
+
+// Catalog is the portable copy of the backups metadata and the config
+// to move them to another cluster
+type Catalog struct {
+	Version    int          `json:"version"`
+	ExportedAt int64        `json:"exported_at"`
+	Config     *Config      `json:"config,omitempty"`
+	Backups    []BackupMeta `json:"backups"`
+}
+
+// ExportCatalog returns the catalog of all backups and the config.
+// The storage credentials are hidden unless `credentials` is true.
+func (p *PBM) ExportCatalog(credentials bool) (Catalog, error) {
+	c := Catalog{
+		Version:    CatalogVersion,
+		ExportedAt: time.Now().UTC().Unix(),
+	}
+
+	cfg, err := p.GetConfig()
+	switch {
+	case err == nil:
+		if !credentials {
+			cfg.Redact()
+		}
+		c.Config = &cfg
+	case errors.Cause(err) != mongo.ErrNoDocuments:
+		return c, errors.Wrap(err, "get config")
+	}
+
+	c.Backups, err = p.FindBackups(BackupFilter{}, 0)
+	return c, errors.Wrap(err, "get backups")
+}
+
+// CatalogImport is the result of the catalog import
+type CatalogImport struct {
+	Added    int
+	Replaced int
+	// Skipped are the backups which already exist or aren't finished
+	Skipped []string
+}
+
+// ImportBackups adds the backups of the catalog. The existing ones are
+// replaced only if `overwrite` is set. The backups which weren't finished
+// are skipped since there is no agent to finish them.
+func (p *PBM) ImportBackups(c Catalog, overwrite bool) (CatalogImport, error) {
+	var res CatalogImport
+	if c.Version != CatalogVersion {
+		return res, errors.Errorf("unsupported catalog version %d, expected %d", c.Version, CatalogVersion)
+	}
+
+	for _, b := range c.Backups {
+		if b.Status != StatusDone && b.Status != StatusError {
+			res.Skipped = append(res.Skipped, b.Name)
+			continue
+		}
+
+		cur, err := p.GetBackupMeta(b.Name)
+		if err != nil {
+			return res, errors.Wrapf(err, "check backup %s", b.Name)
+		}
+		if cur.Name != "" && !overwrite {
+			res.Skipped = append(res.Skipped, b.Name)
+			continue
+		}
+
+		_, err = p.Conn.Database(DB).Collection(BcpCollection).ReplaceOne(
+			p.ctx,
+			bson.D{{"name", b.Name}},
+			b,
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil {
+			return res, errors.Wrapf(err, "write backup %s", b.Name)
+		}
+		if cur.Name != "" {
+			res.Replaced++
+		} else {
+			res.Added++
+		}
+	}
+
+	return res, nil
+}
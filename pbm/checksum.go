@@ -0,0 +1,201 @@
+package pbm
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FileChecksum is the checksum of the file as it's stored
+// (i.e. compressed and with the archive header)
+type FileChecksum struct {
+	Name   string `bson:"name" json:"name"`
+	Size   int64  `bson:"size" json:"size"`
+	CRC32C string `bson:"crc32c" json:"crc32c"`
+	SHA256 string `bson:"sha256" json:"sha256"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// parallelSumMin is the size of the write which is worth to hash in parallel
+const parallelSumMin = 64 << 10
+
+// Checksummer calculates the CRC32C and the SHA-256 of the data written into it.
+// Both use the CPU instructions (SSE4.2/ARMv8 CRC32, SHA-NI/AVX2) where
+// available and the big writes are hashed by both in parallel, so it can be
+// put in the stream without slowing it down.
+//
+// It also calculates the MD5 of each part of the given size so the ETag of
+// the S3 upload can be checked.
+type Checksummer struct {
+	name string
+	crc  hash.Hash32
+	sha  hash.Hash
+	size int64
+
+	partSize int64
+	part     hash.Hash
+	partN    int64
+	parts    [][]byte
+}
+
+// NewChecksummer creates the Checksummer of the file `name`.
+// If partSize is 0 the parts' MD5s aren't calculated.
+func NewChecksummer(name string, partSize int64) *Checksummer {
+	c := &Checksummer{
+		name:     name,
+		crc:      crc32.New(crc32cTable),
+		sha:      sha256.New(),
+		partSize: partSize,
+	}
+	if partSize > 0 {
+		c.part = md5.New()
+	}
+	return c
+}
+
+func (c *Checksummer) Write(p []byte) (int, error) {
+	if len(p) < parallelSumMin {
+		c.crc.Write(p)
+		c.writeParts(p)
+		c.sha.Write(p)
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			c.sha.Write(p)
+			wg.Done()
+		}()
+		c.crc.Write(p)
+		c.writeParts(p)
+		wg.Wait()
+	}
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+func (c *Checksummer) writeParts(p []byte) {
+	if c.part == nil {
+		return
+	}
+	for len(p) > 0 {
+		n := c.partSize - c.partN
+		if int64(len(p)) < n {
+			n = int64(len(p))
+		}
+		c.part.Write(p[:n])
+		c.partN += n
+		p = p[n:]
+		if c.partN == c.partSize {
+			c.parts = append(c.parts, c.part.Sum(nil))
+			c.part.Reset()
+			c.partN = 0
+		}
+	}
+}
+
+// Sum returns the checksum of the data written so far
+func (c *Checksummer) Sum() FileChecksum {
+	return FileChecksum{
+		Name:   c.name,
+		Size:   c.size,
+		CRC32C: hex.EncodeToString(c.crc.Sum(nil)),
+		SHA256: hex.EncodeToString(c.sha.Sum(nil)),
+	}
+}
+
+// ETags returns the ETags the S3 may give to the uploaded data: the MD5 of
+// the data for the single part upload and the MD5 of the parts' MD5s
+// followed by the number of the parts for the multipart one
+func (c *Checksummer) ETags() []string {
+	if c.part == nil {
+		return nil
+	}
+	parts := c.parts
+	if c.partN > 0 || len(parts) == 0 {
+		parts = append(parts, c.part.Sum(nil))
+	}
+
+	var etags []string
+	if len(parts) == 1 {
+		etags = append(etags, hex.EncodeToString(parts[0]))
+	}
+	h := md5.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return append(etags, fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(parts)))
+}
+
+// CheckETag checks the ETag given by the storage against the data
+func (c *Checksummer) CheckETag(etag string) error {
+	etag = strings.Trim(etag, `"`)
+	for _, e := range c.ETags() {
+		if e == etag {
+			return nil
+		}
+	}
+	return errors.Errorf("ETag mismatch: got %s, expected one of %v", etag, c.ETags())
+}
+
+// Check compares the checksum of the data read with the given one
+func (c *Checksummer) Check(sum FileChecksum) error {
+	got := c.Sum()
+	switch {
+	case got.Size != sum.Size:
+		return errors.Errorf("size mismatch: got %d, expected %d", got.Size, sum.Size)
+	case got.CRC32C != sum.CRC32C:
+		return errors.Errorf("crc32c mismatch: got %s, expected %s", got.CRC32C, sum.CRC32C)
+	case got.SHA256 != sum.SHA256:
+		return errors.Errorf("sha256 mismatch: got %s, expected %s", got.SHA256, sum.SHA256)
+	}
+	return nil
+}
+
+// FindChecksum returns the checksum of the file in the replset's meta
+func (r BackupReplset) FindChecksum(name string) (FileChecksum, bool) {
+	for _, c := range r.Checksums {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return FileChecksum{}, false
+}
+
+// SetRSChecksums adds the checksums of the files written by the replset
+// replacing the ones of the same files left by the previous attempts
+func (p *PBM) SetRSChecksums(bcpName string, rsName string, sums []FileChecksum) error {
+	names := make([]string, 0, len(sums))
+	for _, s := range sums {
+		names = append(names, s.Name)
+	}
+
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$pull", bson.M{"replsets.$.checksums": bson.M{"name": bson.M{"$in": names}}}},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "remove previous checksums")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$push", bson.M{"replsets.$.checksums": bson.M{"$each": sums}}},
+		},
+	)
+
+	return errors.Wrap(err, "add checksums")
+}
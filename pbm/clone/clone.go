@@ -0,0 +1,101 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// Clone copies the data of the source replica set into the target one.
+// The dump is streamed straight into mongorestore on the target and then
+// the oplog written on the source during the dump is applied on top of it.
+// So the target ends up as a consistent copy of the source as of the end
+// of the dump, without any intermediate copy in the backup storage.
+// PBM's own collections on the target are left intact. The transform
+// rules and the plugin (if any) are applied to the documents before they are inserted.
+//
+// The data goes through the host the clone runs on rather than from the
+// source agents to the target ones, and only a replica set to a replica set
+// is supported. Sharded clusters (either a shard, a config server or mongos)
+// are rejected since the per-shard copies wouldn't be consistent
+// with each other.
+func Clone(ctx context.Context, src, dst *pbm.Node, rules []pbm.TransformRule, plugin *pbm.TransformPlugin) error {
+	for _, n := range []*pbm.Node{src, dst} {
+		im, err := n.GetIsMaster()
+		if err != nil {
+			return errors.Wrap(err, "get isMaster data")
+		}
+		switch {
+		case im.IsMongos(), im.IsSharded():
+			return errors.New("sharded clusters are not supported, only a replica set can be cloned into a replica set")
+		case im.IsStandalone():
+			return errors.New("standalone nodes are not supported, only a replica set can be cloned into a replica set")
+		}
+	}
+
+	ver, err := dst.GetMongoVersion()
+	if err != nil || len(ver.Version) < 1 {
+		return errors.Wrap(err, "define target mongo version")
+	}
+	preserveUUID := ver.Version[0] >= 4
+
+	rst := restore.New(nil, dst)
+	err = rst.SetTransform(rules, plugin)
+	if err != nil {
+		return errors.Wrap(err, "set transform")
+	}
+	defer rst.Close()
+
+	oplog := backup.NewOplog(src)
+	from, err := oplog.LastWrite()
+	if err != nil {
+		return errors.Wrap(err, "define oplog start position")
+	}
+
+	log.Println("streaming the dump")
+	err = stream(
+		func(w io.Writer) error { return backup.Dump(ctx, w, src.ConnURI()) },
+		func(r io.ReadCloser) error { return rst.RestoreArchive(r, preserveUUID) },
+	)
+	if err != nil {
+		return errors.Wrap(err, "dump")
+	}
+
+	to, err := oplog.LastWrite()
+	if err != nil {
+		return errors.Wrap(err, "define oplog end position")
+	}
+
+	log.Printf("streaming the oplog %v - %v", from, to)
+	err = stream(
+		func(w io.Writer) error { return oplog.SliceTo(ctx, w, from, to) },
+		func(r io.ReadCloser) error { return rst.ApplyOplog(r, ver, preserveUUID) },
+	)
+	return errors.Wrap(err, "oplog")
+}
+
+// stream pipes the output of `write` into `read`
+func stream(write func(io.Writer) error, read func(io.ReadCloser) error) error {
+	r, w := io.Pipe()
+
+	werr := make(chan error, 1)
+	go func() {
+		err := write(w)
+		w.CloseWithError(err)
+		werr <- err
+	}()
+
+	err := read(r)
+	// unblock the writer if the reader has quit halfway
+	r.CloseWithError(errors.New("reader closed"))
+	if err != nil {
+		return errors.Wrap(err, "read")
+	}
+	return errors.Wrap(<-werr, "write")
+}
@@ -0,0 +1,83 @@
+package pbm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Cluster is the part of the node's session the cluster and the oplog logic
+// relies on. It's implemented by Node and by the in-memory fake.Node so the
+// logic can be run without a live cluster.
+type Cluster interface {
+	GetIsMaster() (*IsMaster, error)
+	// ListShards returns the shards of the cluster the node belongs to
+	ListShards() ([]Shard, error)
+	// FirstRecord returns the first document of the collection in
+	// the natural order or nil if the collection is empty
+	FirstRecord(ns string) (bson.Raw, error)
+	// OplogCursor returns the entries of the oplog collection (local.<coll>)
+	// starting from `from`. The tailable cursor waits for the new entries
+	// instead of being exhausted at the end of the oplog.
+	OplogCursor(ctx context.Context, coll string, from primitive.Timestamp, tailable bool) (Cursor, error)
+}
+
+// Cursor iterates over the documents returned by the Cluster
+type Cursor interface {
+	Next(ctx context.Context) bool
+	// Doc returns the current document, it's valid until the next call of Next
+	Doc() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+type mongoCursor struct {
+	*mongo.Cursor
+}
+
+func (c mongoCursor) Doc() bson.Raw {
+	return c.Current
+}
+
+// ListShards returns the shards of the cluster. It reads config.shards
+// so it works on the config server nodes as well as on mongos.
+func (n *Node) ListShards() ([]Shard, error) {
+	cur, err := n.cn.Database("config").Collection("shards").Find(n.ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(n.ctx)
+
+	shards := []Shard{}
+	for cur.Next(n.ctx) {
+		s := Shard{}
+		err := cur.Decode(&s)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		shards = append(shards, s)
+	}
+	return shards, cur.Err()
+}
+
+// OplogCursor returns the cursor over the oplog entries starting from `from`
+func (n *Node) OplogCursor(ctx context.Context, coll string, from primitive.Timestamp, tailable bool) (Cursor, error) {
+	if !strings.HasPrefix(coll, "oplog.") {
+		return nil, errors.Errorf("%s isn't an oplog collection", coll)
+	}
+
+	opts := options.Find()
+	if tailable {
+		opts.SetCursorType(options.Tailable)
+	}
+	cur, err := n.cn.Database("local").Collection(coll).Find(ctx, bson.M{"ts": bson.M{"$gte": from}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return mongoCursor{cur}, nil
+}
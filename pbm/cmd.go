@@ -6,6 +6,7 @@ import (
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type ErrorCursor struct {
@@ -68,7 +69,11 @@ func (p *PBM) ListenCmd() (<-chan Cmd, <-chan error, error) {
 }
 
 func (p *PBM) SendCmd(cmd Cmd) error {
+	cmd.ID = primitive.NewObjectID()
 	cmd.TS = time.Now().UTC().Unix()
+	if cmd.User == "" {
+		cmd.User = p.user()
+	}
 	_, err := p.Conn.Database(DB).Collection(CmdStreamCollection).InsertOne(p.ctx, cmd)
 	return err
 }
@@ -1,20 +1,496 @@
 package pbm
 
 import (
+	"fmt"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"gopkg.in/yaml.v2"
 )
 
 // Config is a pbm config
 type Config struct {
-	Storage Storage `bson:"storage" json:"storage" yaml:"storage"`
+	Storage Storage    `bson:"storage" json:"storage" yaml:"storage"`
+	Backup  BackupConf `bson:"backup" json:"backup" yaml:"backup,omitempty"`
+	// Restore is the restore options
+	Restore RestoreConf `bson:"restore,omitempty" json:"restore,omitempty" yaml:"restore,omitempty"`
+	// Rehearsal is the throwaway mongod for the restore rehearsals
+	Rehearsal RehearsalConf `bson:"rehearsal,omitempty" json:"rehearsal,omitempty" yaml:"rehearsal,omitempty"`
+	// Verify is the periodic verification of the latest backup
+	Verify VerifyConf `bson:"verify,omitempty" json:"verify,omitempty" yaml:"verify,omitempty"`
+	// Signing is the signing of the backup manifests to detect tampering
+	Signing SigningConf `bson:"signing,omitempty" json:"signing,omitempty" yaml:"signing,omitempty"`
+	// Approval is the two-person approval of the restores and deletes
+	Approval ApprovalConf `bson:"approval,omitempty" json:"approval,omitempty" yaml:"approval,omitempty"`
+	// PMM is the PMM server the backups and restores are annotated on
+	PMM PMMConf `bson:"pmm,omitempty" json:"pmm,omitempty" yaml:"pmm,omitempty"`
+	// Queue defines how the queued jobs are started
+	Queue QueueConf `bson:"queue,omitempty" json:"queue,omitempty" yaml:"queue,omitempty"`
+	// RateLimit limits the users' requests and the agents registrations
+	RateLimit RateLimitConf `bson:"rateLimit,omitempty" json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+}
+
+// BackupConf is the backup options
+type BackupConf struct {
+	// FailurePolicy defines what to do if backup on some replset has failed
+	FailurePolicy FailurePolicy `bson:"failurePolicy,omitempty" json:"failurePolicy,omitempty" yaml:"failurePolicy,omitempty"`
+	// Retries is the max number of attempts to restart the failed replset's backup
+	// on the another node. Makes sense only with FailurePolicyRetry
+	Retries int `bson:"retries,omitempty" json:"retries,omitempty" yaml:"retries,omitempty"`
+	// AutoRetry defines the restart of the whole failed backup
+	AutoRetry AutoRetry `bson:"autoRetry" json:"autoRetry" yaml:"autoRetry,omitempty"`
+	// Window defines the time when backups are allowed
+	Window BackupWindow `bson:"window" json:"window" yaml:"window,omitempty"`
+	// MaxReplLagSec is the max replication lag of the node to be
+	// selected for the backup. Default is 21 sec.
+	MaxReplLagSec int `bson:"maxReplLagSec,omitempty" json:"maxReplLagSec,omitempty" yaml:"maxReplLagSec,omitempty"`
+	// Delayed lets the delayed members make the backup, their replication
+	// lag is counted over the delay. The oplog the member is yet to apply
+	// is read from the primary, so the primary's oplog window has to be
+	// longer than the delay.
+	Delayed bool `bson:"delayed,omitempty" json:"delayed,omitempty" yaml:"delayed,omitempty"`
+	// MinFreeDiskMB is the min free space on the node's data volume
+	// to be selected for the backup. 0 means no check.
+	MinFreeDiskMB int `bson:"minFreeDiskMB,omitempty" json:"minFreeDiskMB,omitempty" yaml:"minFreeDiskMB,omitempty"`
+	// MaxOplogLagSec fails the backup if the oplog captured by the backup
+	// falls behind the cluster time more than that. 0 means no limit.
+	// The lag is sampled from the backup start and the slicing starts
+	// after the dump, so it should be greater than the expected dump duration.
+	MaxOplogLagSec int `bson:"maxOplogLagSec,omitempty" json:"maxOplogLagSec,omitempty" yaml:"maxOplogLagSec,omitempty"`
+	// TimeoutSec is the max duration of the backup after which it's aborted.
+	// 0 means no limit.
+	TimeoutSec int `bson:"timeoutSec,omitempty" json:"timeoutSec,omitempty" yaml:"timeoutSec,omitempty"`
+	// Dedup enables the deduplicated storage layout: data is split into
+	// content-defined chunks which are stored once and shared between backups
+	Dedup bool `bson:"dedup,omitempty" json:"dedup,omitempty" yaml:"dedup,omitempty"`
+	// MaxMemoryMB limits the memory each agent's dump/upload pipeline
+	// buffers may take. 0 means no limit: 32MB upload parts and up to 4
+	// of them uploaded in parallel (~208MB).
+	// Since an S3 upload is limited to 10000 parts, the part size of
+	// the file expected to be larger is raised beyond the limit.
+	MaxMemoryMB int `bson:"maxMemoryMB,omitempty" json:"maxMemoryMB,omitempty" yaml:"maxMemoryMB,omitempty"`
+	// NameTemplate is the template of the names of backups started without
+	// an explicit name. E.g. "{cluster}-{date}-{seq}". See NewBackupName.
+	NameTemplate string `bson:"nameTemplate,omitempty" json:"nameTemplate,omitempty" yaml:"nameTemplate,omitempty"`
+	// Profile is the default preset (low/medium/high) of the resources the
+	// backup takes on the node: upload concurrency, compression level and
+	// the read rate limit. "low" also slows down the reads while they hurt
+	// the node's ops latency. Empty means no limits.
+	Profile Profile `bson:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`
+	// OplogBatchKB is the size the oplog entries are buffered up to before
+	// they're compressed and written to the storage. Default is 1024 (1MB).
+	OplogBatchKB int `bson:"oplogBatchKB,omitempty" json:"oplogBatchKB,omitempty" yaml:"oplogBatchKB,omitempty"`
+	// OplogFlushSec is the max time the oplog entries stay in the buffer
+	// if the batch isn't filled up. Default is 10 sec.
+	OplogFlushSec int `bson:"oplogFlushSec,omitempty" json:"oplogFlushSec,omitempty" yaml:"oplogFlushSec,omitempty"`
+	// OplogNoopSec makes the agent of each replset's primary write the
+	// no-op oplog entry if there were no writes for that long. So the oplog
+	// slicing on the idle cluster reaches its end point and the oplog has
+	// no gaps longer than that. 0 means rely on the mongod's periodic
+	// no-ops (writePeriodicNoops, enabled by default).
+	OplogNoopSec int `bson:"oplogNoopSec,omitempty" json:"oplogNoopSec,omitempty" yaml:"oplogNoopSec,omitempty"`
+	// Sessions makes the backup capture the sessions records
+	// (config.transactions) of the retryable writes, which mongodump
+	// leaves out. They are restored with the restore's sessions option.
+	Sessions bool `bson:"sessions,omitempty" json:"sessions,omitempty" yaml:"sessions,omitempty"`
+	// ReadConcern is the read concern level of the dump: local, majority
+	// or available. Default is the one of the node's connection string.
+	// The majority doesn't dump the writes which may be rolled back.
+	ReadConcern string `bson:"readConcern,omitempty" json:"readConcern,omitempty" yaml:"readConcern,omitempty"`
+	// Dump defines how the dump connects to the replset. Default is the
+	// direct connection to the node chosen for the backup.
+	Dump DumpConnConf `bson:"dump,omitempty" json:"dump,omitempty" yaml:"dump,omitempty"`
+}
+
+// minMaxStalenessSec is the least max staleness the driver accepts
+const minMaxStalenessSec = 90
+
+// DumpConnConf is the connection of the dump for the environments where
+// the agent can't reach the members of the replset directly (e.g. only the
+// load balancer in front of the replset is reachable) or the dump should
+// be read from the member other than the one making the backup.
+type DumpConnConf struct {
+	// URIs are the connection strings the replsets (by name) are dumped
+	// through instead of the node's one
+	URIs map[string]string `bson:"uris,omitempty" json:"uris,omitempty" yaml:"uris,omitempty"`
+	// ReadPreference is the read preference mode of the dump: primary,
+	// primaryPreferred, secondary, secondaryPreferred or nearest. The dump
+	// connects to the whole replset, not only to the node, if it's set.
+	ReadPreference string `bson:"readPreference,omitempty" json:"readPreference,omitempty" yaml:"readPreference,omitempty"`
+	// MaxStalenessSec is how far the member the dump is read from may be
+	// behind the primary, at least 90 sec. It's required unless the dump
+	// is read from the primary: the oplog slice starts that much earlier
+	// to cover the writes the stale member is yet to apply.
+	MaxStalenessSec int `bson:"maxStalenessSec,omitempty" json:"maxStalenessSec,omitempty" yaml:"maxStalenessSec,omitempty"`
+}
+
+// Validate checks the dump connection options
+func (d DumpConnConf) Validate() error {
+	if d.MaxStalenessSec != 0 && d.ReadPreference == "" {
+		return errors.New("maxStalenessSec requires the non-primary read preference")
+	}
+	if d.ReadPreference != "" {
+		m, err := readpref.ModeFromString(d.ReadPreference)
+		if err != nil {
+			return errors.Wrap(err, "read preference")
+		}
+		if m != readpref.PrimaryMode && d.MaxStalenessSec == 0 {
+			return errors.Errorf("maxStalenessSec is required with the %s read preference", d.ReadPreference)
+		}
+		if m == readpref.PrimaryMode && d.MaxStalenessSec > 0 {
+			return errors.New("maxStalenessSec can't be used with the primary read preference")
+		}
+	}
+	if d.MaxStalenessSec != 0 && d.MaxStalenessSec < minMaxStalenessSec {
+		return errors.Errorf("maxStalenessSec should be at least %d", minMaxStalenessSec)
+	}
+	for rs, u := range d.URIs {
+		_, err := url.Parse(u)
+		if err != nil {
+			return errors.Wrapf(err, "parse connection string of %s", rs)
+		}
+	}
+	return nil
+}
+
+// Staleness returns how far the dump may be behind the node making the backup
+func (d DumpConnConf) Staleness() time.Duration {
+	return time.Duration(d.MaxStalenessSec) * time.Second
+}
+
+const (
+	defaultOplogBatchKB  = 1 << 10
+	defaultOplogFlushSec = 10
+)
+
+// OplogBatchSize returns the size of the oplog writes batch
+func (b BackupConf) OplogBatchSize() int {
+	if b.OplogBatchKB <= 0 {
+		return defaultOplogBatchKB << 10
+	}
+	return b.OplogBatchKB << 10
+}
+
+// OplogFlushInterval returns the max time the oplog entries stay buffered
+func (b BackupConf) OplogFlushInterval() time.Duration {
+	if b.OplogFlushSec <= 0 {
+		return defaultOplogFlushSec * time.Second
+	}
+	return time.Duration(b.OplogFlushSec) * time.Second
+}
+
+// Timeout returns the backup timeout. 0 means no timeout.
+func (b BackupConf) Timeout() time.Duration {
+	return time.Duration(b.TimeoutSec) * time.Second
+}
+
+// DumpURI returns the connection string the replset `rsName` is dumped
+// through with the read concern and the read preference
+func (b BackupConf) DumpURI(curi, rsName string) (string, error) {
+	switch b.ReadConcern {
+	case "", "local", "majority", "available":
+	default:
+		return "", errors.Errorf("unsupported read concern %q, expected local, majority or available", b.ReadConcern)
+	}
+	err := b.Dump.Validate()
+	if err != nil {
+		return "", errors.Wrap(err, "dump connection")
+	}
+
+	duri, viaURI := b.Dump.URIs[rsName]
+	if viaURI {
+		curi = duri
+	}
+	if b.ReadConcern == "" && b.Dump.ReadPreference == "" && b.Dump.MaxStalenessSec == 0 {
+		return curi, nil
+	}
+
+	u, err := url.Parse(curi)
+	if err != nil {
+		return "", errors.Wrap(err, "parse connection string")
+	}
+	q := u.Query()
+	if b.ReadConcern != "" {
+		q.Set("readConcernLevel", b.ReadConcern)
+	}
+	if b.Dump.ReadPreference != "" {
+		q.Set("readPreference", b.Dump.ReadPreference)
+		// the node's connection string is of the node alone,
+		// the replset name makes the driver discover the rest
+		if !viaURI && rsName != "" && q.Get("replicaSet") == "" {
+			q.Set("replicaSet", rsName)
+		}
+		q.Del("connect")
+		q.Del("directConnection")
+	}
+	if b.Dump.MaxStalenessSec > 0 {
+		q.Set("maxStalenessSeconds", strconv.Itoa(b.Dump.MaxStalenessSec))
+	}
+	u.RawQuery = q.Encode()
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// RestoreConf is the restore options
+type RestoreConf struct {
+	// WriteConcern is the write concern of the dump restore and the oplog
+	// replay: majority, the number of the nodes or the tag set name. The
+	// w:1 restore on the loaded replset may be rolled back on the election.
+	// If it isn't set, the dump is restored with majority and the oplog
+	// is replayed with the server's default.
+	WriteConcern string `bson:"writeConcern,omitempty" json:"writeConcern,omitempty" yaml:"writeConcern,omitempty"`
+	// WTimeoutMS is the wtimeout of the write concern. 0 means no timeout.
+	WTimeoutMS int `bson:"wtimeoutMS,omitempty" json:"wtimeoutMS,omitempty" yaml:"wtimeoutMS,omitempty"`
+	// MaxRateMB caps the rate (MB/s) the dumps are read and restored
+	// at. 0 means no limit.
+	MaxRateMB int `bson:"maxRateMB,omitempty" json:"maxRateMB,omitempty" yaml:"maxRateMB,omitempty"`
+	// MaxOpsPerSec caps the rate the oplog entries are applied at.
+	// 0 means no limit.
+	MaxOpsPerSec int `bson:"maxOpsPerSec,omitempty" json:"maxOpsPerSec,omitempty" yaml:"maxOpsPerSec,omitempty"`
+	// MaxReplLagSec pauses the restore while any secondary of the target
+	// replset lags behind more than that, so the restore into the replset
+	// still serving the traffic yields to the replication. 0 means no check.
+	MaxReplLagSec int `bson:"maxReplLagSec,omitempty" json:"maxReplLagSec,omitempty" yaml:"maxReplLagSec,omitempty"`
+}
+
+// W returns the write concern of the dump restore in the form
+// mongorestore takes it
+func (r RestoreConf) W() string {
+	w := r.WriteConcern
+	if w == "" {
+		w = "majority"
+	}
+	if r.WTimeoutMS == 0 {
+		return w
+	}
+	if n, err := strconv.Atoi(w); err == nil {
+		return fmt.Sprintf(`{"w": %d, "wtimeout": %d}`, n, r.WTimeoutMS)
+	}
+	return fmt.Sprintf(`{"w": %q, "wtimeout": %d}`, w, r.WTimeoutMS)
+}
+
+// WriteConcernDoc returns the writeConcern document of the oplog replay
+// commands, nil means the server's default
+func (r RestoreConf) WriteConcernDoc() bson.D {
+	var wc bson.D
+	if n, err := strconv.Atoi(r.WriteConcern); err == nil {
+		wc = append(wc, bson.E{"w", n})
+	} else if r.WriteConcern != "" {
+		wc = append(wc, bson.E{"w", r.WriteConcern})
+	}
+	if r.WTimeoutMS > 0 {
+		wc = append(wc, bson.E{"wtimeout", r.WTimeoutMS})
+	}
+	return wc
+}
+
+// Validate checks the write concern. The name other than majority
+// is the tag set name, it's checked by the PBM against the replset.
+func (r RestoreConf) Validate() error {
+	if n, err := strconv.Atoi(r.WriteConcern); err == nil && n < 0 {
+		return errors.Errorf("invalid writeConcern %d, expected the number of the nodes >= 0", n)
+	}
+	if strings.TrimSpace(r.WriteConcern) != r.WriteConcern {
+		return errors.Errorf("invalid writeConcern %q", r.WriteConcern)
+	}
+	if r.WTimeoutMS < 0 {
+		return errors.Errorf("invalid wtimeoutMS %d, expected >= 0", r.WTimeoutMS)
+	}
+	return nil
+}
+
+// writeTag returns the custom write concern name if it's such
+func (r RestoreConf) writeTag() string {
+	if r.WriteConcern == "" || r.WriteConcern == "majority" {
+		return ""
+	}
+	if _, err := strconv.Atoi(r.WriteConcern); err == nil {
+		return ""
+	}
+	return r.WriteConcern
+}
+
+// checkRestoreConf validates the restore options. The tag set name has to be
+// defined (settings.getLastErrorModes) on the replset the config is set on.
+func (p *PBM) checkRestoreConf(r RestoreConf) error {
+	err := r.Validate()
+	if err != nil {
+		return err
+	}
+	tag := r.writeTag()
+	if tag == "" {
+		return nil
+	}
+
+	res := struct {
+		Config struct {
+			Settings struct {
+				Modes map[string]bson.Raw `bson:"getLastErrorModes"`
+			} `bson:"settings"`
+		} `bson:"config"`
+	}{}
+	err = p.Conn.Database("admin").RunCommand(p.ctx, bson.D{{"replSetGetConfig", 1}}).Decode(&res)
+	if err != nil {
+		return errors.Wrap(err, "get replset config to check the writeConcern tag")
+	}
+	if _, ok := res.Config.Settings.Modes[tag]; !ok {
+		return errors.Errorf("unknown writeConcern %q, expected majority, the number of the nodes or the tag set name of settings.getLastErrorModes", tag)
+	}
+	return nil
+}
+
+const (
+	// DefaultUploadPartSize is the size of the upload part
+	// when no memory limit is set
+	DefaultUploadPartSize = 32 << 20
+	// MinUploadPartSize is the min part size of the S3 multipart upload
+	MinUploadPartSize = 5 << 20
+	// MaxUploadParts is the max number of parts of the S3 multipart upload
+	MaxUploadParts = 10000
+	// DefaultMaxUploadConcurrency is the max number of the parts
+	// uploaded in parallel when the concurrency isn't set
+	DefaultMaxUploadConcurrency = 4
+	// dumpBufferSize is the buffer of the dumped collection
+	// which has to fit the max BSON document
+	dumpBufferSize = 16 << 20
+	// uploadSpareParts is the number of the parts the upload holds in memory
+	// besides the ones being uploaded: the queued one and the one being read
+	uploadSpareParts = 2
+)
+
+// UploadOpts are the options of the S3 multipart upload
+type UploadOpts struct {
+	PartSize int64
+	// Concurrency is the (max) number of the parts uploaded in parallel
+	Concurrency int
+	// Adaptive makes the upload pick the concurrency up to
+	// the max by the throughput observed before
+	Adaptive bool
+}
+
+// UploadOpts returns the upload options which keep the pipeline buffers
+// within backup.maxMemoryMB. If both the part size and the concurrency are
+// set, the part size is reduced to fit the memory, otherwise the max
+// concurrency is.
+func (c Config) UploadOpts() (UploadOpts, error) {
+	o := UploadOpts{
+		PartSize:    DefaultUploadPartSize,
+		Concurrency: c.Storage.S3.UploadConcurrency,
+	}
+	if c.Storage.S3.UploadPartSizeMB > 0 {
+		o.PartSize = int64(c.Storage.S3.UploadPartSizeMB) << 20
+		if o.PartSize < MinUploadPartSize {
+			return o, errors.Errorf("s3.uploadPartSizeMB %d is too low, it has to be at least %d",
+				c.Storage.S3.UploadPartSizeMB, MinUploadPartSize>>20)
+		}
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultMaxUploadConcurrency
+		o.Adaptive = true
+	}
+	if c.Backup.MaxMemoryMB <= 0 {
+		return o, nil
+	}
+
+	budget := int64(c.Backup.MaxMemoryMB)<<20 - dumpBufferSize
+	fits := func() bool { return o.PartSize*int64(o.Concurrency+uploadSpareParts) <= budget }
+	if c.Storage.S3.UploadPartSizeMB > 0 || o.Adaptive {
+		for o.Concurrency > 1 && !fits() {
+			o.Concurrency--
+		}
+	}
+	if !fits() {
+		o.PartSize = budget / int64(o.Concurrency+uploadSpareParts)
+	}
+	if o.PartSize < MinUploadPartSize {
+		return o, errors.Errorf("backup.maxMemoryMB %d is too low, it has to be at least %d",
+			c.Backup.MaxMemoryMB, (dumpBufferSize+int64(o.Concurrency+uploadSpareParts)*MinUploadPartSize)>>20)
+	}
+	return o, nil
+}
+
+// ForSize returns the options with the part size raised (if needed) so
+// the object of the expected size fits into MaxUploadParts. The larger
+// part takes more memory than backup.maxMemoryMB allows, but the object
+// can't be uploaded otherwise. 0 size leaves the options as is.
+func (o UploadOpts) ForSize(size int64) UploadOpts {
+	// leave the room for the size estimate error
+	const parts = MaxUploadParts * 8 / 10
+	if need := (size + parts - 1) / parts; need > o.PartSize {
+		o.PartSize = (need + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	return o
+}
+
+// AutoRetry is the options of the automatic restart of the failed backup
+type AutoRetry struct {
+	// Attempts is the max number of the backup restarts. 0 means no restarts.
+	Attempts int `bson:"attempts,omitempty" json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	// BackoffSec is the delay before the first restart. Every next delay is doubled.
+	BackoffSec int `bson:"backoffSec,omitempty" json:"backoffSec,omitempty" yaml:"backoffSec,omitempty"`
+	// MaxBackoffSec is the upper limit for the delay between restarts
+	MaxBackoffSec int `bson:"maxBackoffSec,omitempty" json:"maxBackoffSec,omitempty" yaml:"maxBackoffSec,omitempty"`
+}
+
+const (
+	defaultRetryBackoff    = time.Minute
+	defaultRetryMaxBackoff = time.Hour
+)
+
+// Backoff returns the delay before the given restart attempt (starting from 1)
+// without a jitter
+func (a AutoRetry) Backoff(attempt int) time.Duration {
+	base := defaultRetryBackoff
+	if a.BackoffSec > 0 {
+		base = time.Duration(a.BackoffSec) * time.Second
+	}
+	max := defaultRetryMaxBackoff
+	if a.MaxBackoffSec > 0 {
+		max = time.Duration(a.MaxBackoffSec) * time.Second
+	}
+
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// FailurePolicy is the policy of handling the failure of some replset during the backup
+type FailurePolicy string
+
+const (
+	// FailurePolicyAbort fails the whole backup (default)
+	FailurePolicyAbort FailurePolicy = "abort"
+	// FailurePolicyPartial lets the rest replsets to finish the backup
+	// and marks the backup as partly done
+	FailurePolicyPartial = "partial"
+	// FailurePolicyRetry tries to restart the backup of the failed replset
+	// on the another node up to BackupConf.Retries times
+	FailurePolicyRetry = "retry"
+)
+
+// Policy returns the failure policy with respect to the default one
+func (b BackupConf) Policy() FailurePolicy {
+	switch b.FailurePolicy {
+	case FailurePolicyPartial, FailurePolicyRetry:
+		return b.FailurePolicy
+	default:
+		return FailurePolicyAbort
+	}
 }
 
 type StorageType string
@@ -46,6 +522,39 @@ type S3 struct {
 	Bucket      string      `bson:"bucket" json:"bucket" yaml:"bucket"`
 	Prefix      string      `bson:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
 	Credentials Credentials `bson:"credentials" json:"credentials,omitempty" yaml:"credentials"`
+	// UploadPartSizeMB is the size of the multipart upload part. Default is
+	// 32MB or less if it doesn't fit backup.maxMemoryMB.
+	UploadPartSizeMB int `bson:"uploadPartSizeMB,omitempty" json:"uploadPartSizeMB,omitempty" yaml:"uploadPartSizeMB,omitempty"`
+	// UploadConcurrency is the number of the parts uploaded in parallel.
+	// By default it's picked by the observed throughput, up to 4 (or less
+	// if the parts don't fit backup.maxMemoryMB).
+	UploadConcurrency int `bson:"uploadConcurrency,omitempty" json:"uploadConcurrency,omitempty" yaml:"uploadConcurrency,omitempty"`
+	// DownloadConcurrency is the number of the ranges of the file read in
+	// parallel during the restore. Default is 4, 1 means a single stream.
+	DownloadConcurrency int `bson:"downloadConcurrency,omitempty" json:"downloadConcurrency,omitempty" yaml:"downloadConcurrency,omitempty"`
+	// DownloadPartSizeMB is the size of the range read during the restore. Default is 16MB.
+	DownloadPartSizeMB int `bson:"downloadPartSizeMB,omitempty" json:"downloadPartSizeMB,omitempty" yaml:"downloadPartSizeMB,omitempty"`
+}
+
+const (
+	// DefaultDownloadConcurrency is the number of the ranges read in parallel
+	DefaultDownloadConcurrency = 4
+	// DefaultDownloadPartSize is the size of the range read from S3
+	DefaultDownloadPartSize = 16 << 20
+)
+
+// DownloadOpts returns the number of the ranges of the file
+// read in parallel and the size of the range
+func (s S3) DownloadOpts() (int, int64) {
+	c := s.DownloadConcurrency
+	if c <= 0 {
+		c = DefaultDownloadConcurrency
+	}
+	part := int64(s.DownloadPartSizeMB) << 20
+	if part <= 0 {
+		part = DefaultDownloadPartSize
+	}
+	return c, part
 }
 
 type Filesystem struct {
@@ -96,6 +605,22 @@ func (p *PBM) SetConfig(cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "cast storage")
 	}
+	_, err = cfg.Backup.Profile.Settings()
+	if err != nil {
+		return errors.Wrap(err, "backup.profile")
+	}
+	err = cfg.Backup.Dump.Validate()
+	if err != nil {
+		return errors.Wrap(err, "backup.dump")
+	}
+	err = cfg.Backup.Window.Validate()
+	if err != nil {
+		return errors.Wrap(err, "backup.window")
+	}
+	err = p.checkRestoreConf(cfg.Restore)
+	if err != nil {
+		return errors.Wrap(err, "restore")
+	}
 
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
@@ -119,15 +644,71 @@ func (p *PBM) SetConfigVar(key, val string) error {
 		}
 		return err
 	}
+	v, err := castConfigVal(key, val)
+	if err != nil {
+		return errors.Wrapf(err, "cast value for the key '%s'", key)
+	}
+	if key == "backup.profile" {
+		_, err = Profile(val).Settings()
+		if err != nil {
+			return err
+		}
+	}
+	switch key {
+	case "restore.writeConcern":
+		err = p.checkRestoreConf(RestoreConf{WriteConcern: val})
+	case "restore.wtimeoutMS":
+		err = RestoreConf{WTimeoutMS: int(v.(int64))}.Validate()
+	}
+	if err != nil {
+		return err
+	}
+
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
 		bson.D{},
-		bson.M{"$set": bson.M{key: val}},
+		bson.M{"$set": bson.M{key: v}},
 	)
 
 	return errors.Wrap(err, "write to db")
 }
 
+// castConfigVal converts the given string value to the type of the config field
+// defined by the key, so the value would be stored with the right type
+func castConfigVal(key, val string) (interface{}, error) {
+	t := reflect.TypeOf(Config{})
+	for _, name := range strings.Split(key, ".") {
+		f, ok := fieldByBSONName(t, name)
+		if !ok {
+			return nil, errors.New("unknown key")
+		}
+		t = f.Type
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(val, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(val, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(val)
+	default:
+		return val, nil
+	}
+}
+
+func fieldByBSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if strings.TrimSpace(strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]) == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
 // GetConfigVar returns value of given config vaiable
 func (p *PBM) GetConfigVar(key string) (string, error) {
 	if !ValidateConfigKey(key) {
@@ -158,24 +739,95 @@ func (p *PBM) GetConfigYaml(fieldRedaction bool) ([]byte, error) {
 	}
 
 	if fieldRedaction {
-		if c.Storage.S3.Credentials.AccessKeyID != "" {
-			c.Storage.S3.Credentials.AccessKeyID = "***"
-		}
-		if c.Storage.S3.Credentials.SecretAccessKey != "" {
-			c.Storage.S3.Credentials.SecretAccessKey = "***"
-		}
-		if c.Storage.S3.Credentials.Vault.Secret != "" {
-			c.Storage.S3.Credentials.Vault.Secret = "***"
-		}
-		if c.Storage.S3.Credentials.Vault.Token != "" {
-			c.Storage.S3.Credentials.Vault.Token = "***"
-		}
+		c.Redact()
 	}
 
 	b, err := yaml.Marshal(c)
 	return b, errors.Wrap(err, "marshal yaml")
 }
 
+// redacted replaces the secrets in the shown or exported config
+const redacted = "***"
+
+// Redact hides the storage and the PMM server credentials
+func (c *Config) Redact() {
+	if c.Storage.S3.Credentials.AccessKeyID != "" {
+		c.Storage.S3.Credentials.AccessKeyID = redacted
+	}
+	if c.Storage.S3.Credentials.SecretAccessKey != "" {
+		c.Storage.S3.Credentials.SecretAccessKey = redacted
+	}
+	if c.Storage.S3.Credentials.Vault.Secret != "" {
+		c.Storage.S3.Credentials.Vault.Secret = redacted
+	}
+	if c.Storage.S3.Credentials.Vault.Token != "" {
+		c.Storage.S3.Credentials.Vault.Token = redacted
+	}
+	if c.PMM.Password != "" {
+		c.PMM.Password = redacted
+	}
+	if c.PMM.APIKey != "" {
+		c.PMM.APIKey = redacted
+	}
+	for rs, u := range c.Backup.Dump.URIs {
+		c.Backup.Dump.URIs[rs] = redactURI(u)
+	}
+}
+
+// redactURI hides the password in the connection string
+func redactURI(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// isRedactedURI returns true if the password in the connection string is hidden
+func isRedactedURI(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return false
+	}
+	p, _ := u.User.Password()
+	return p == redacted
+}
+
+// IsRedacted returns true if the credentials are hidden by Redact
+func (c Config) IsRedacted() bool {
+	cr := c.Storage.S3.Credentials
+	return cr.AccessKeyID == redacted || cr.SecretAccessKey == redacted ||
+		cr.Vault.Secret == redacted || cr.Vault.Token == redacted ||
+		c.PMM.Password == redacted || c.PMM.APIKey == redacted ||
+		c.dumpURIsRedacted()
+}
+
+func (c Config) dumpURIsRedacted() bool {
+	for _, u := range c.Backup.Dump.URIs {
+		if isRedactedURI(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnredactFrom takes the credentials hidden by Redact from the given config
+func (c *Config) UnredactFrom(cur Config) {
+	c.Storage.S3.Credentials = cur.Storage.S3.Credentials
+	if c.PMM.Password == redacted || c.PMM.APIKey == redacted {
+		c.PMM.Password, c.PMM.APIKey = cur.PMM.Password, cur.PMM.APIKey
+	}
+	for rs, u := range c.Backup.Dump.URIs {
+		if isRedactedURI(u) {
+			c.Backup.Dump.URIs[rs] = cur.Backup.Dump.URIs[rs]
+		}
+	}
+}
+
 func (p *PBM) GetConfig() (Config, error) {
 	var c Config
 	res := p.Conn.Database(DB).Collection(ConfigCollection).FindOne(p.ctx, bson.D{})
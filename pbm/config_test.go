@@ -0,0 +1,74 @@
+package pbm
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRestoreWriteConcern(t *testing.T) {
+	// the oplog replay keeps the server's default, the dump restore majority
+	if wc := (RestoreConf{}).WriteConcernDoc(); wc != nil {
+		t.Errorf("default: got the replay write concern %v, want none", wc)
+	}
+	if w := (RestoreConf{}).W(); w != "majority" {
+		t.Errorf("default: got the dump restore write concern %q, want majority", w)
+	}
+
+	cases := []struct {
+		conf RestoreConf
+		doc  bson.D
+		w    string
+	}{
+		{RestoreConf{WriteConcern: "2"}, bson.D{{"w", 2}}, "2"},
+		{RestoreConf{WriteConcern: "dc"}, bson.D{{"w", "dc"}}, "dc"},
+		{RestoreConf{WriteConcern: "majority", WTimeoutMS: 500}, bson.D{{"w", "majority"}, {"wtimeout", 500}}, `{"w": "majority", "wtimeout": 500}`},
+		{RestoreConf{WriteConcern: "1", WTimeoutMS: 500}, bson.D{{"w", 1}, {"wtimeout", 500}}, `{"w": 1, "wtimeout": 500}`},
+	}
+	for _, c := range cases {
+		if doc := c.conf.WriteConcernDoc(); !reflect.DeepEqual(doc, c.doc) {
+			t.Errorf("%+v: got the replay write concern %v, want %v", c.conf, doc, c.doc)
+		}
+		if w := c.conf.W(); w != c.w {
+			t.Errorf("%+v: got the dump restore write concern %q, want %q", c.conf, w, c.w)
+		}
+		if err := c.conf.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c.conf, err)
+		}
+	}
+
+	for _, c := range []RestoreConf{{WriteConcern: "-1"}, {WriteConcern: " dc"}, {WTimeoutMS: -1}} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+	if tag := (RestoreConf{WriteConcern: "majority"}).writeTag(); tag != "" {
+		t.Errorf("majority is taken as the tag %q", tag)
+	}
+}
+
+func TestDumpConnValidate(t *testing.T) {
+	for _, c := range []DumpConnConf{
+		{},
+		{ReadPreference: "primary"},
+		{ReadPreference: "secondary", MaxStalenessSec: 90},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+
+	for _, c := range []DumpConnConf{
+		// the URI would get maxStalenessSeconds with the primary read preference
+		{MaxStalenessSec: 90},
+		{ReadPreference: "primary", MaxStalenessSec: 90},
+		{ReadPreference: "secondary"},
+		{ReadPreference: "secondary", MaxStalenessSec: 10},
+		{ReadPreference: "secondary", MaxStalenessSec: -90},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
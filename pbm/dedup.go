@@ -0,0 +1,33 @@
+package pbm
+
+import (
+	"path"
+)
+
+// DedupBlobsDir is the storage directory for the deduplicated data chunks
+const DedupBlobsDir = "blobs"
+
+// DedupIndex is the content of the archive stored in the deduplicated
+// layout. The archive data is the concatenation of the chunks.
+type DedupIndex struct {
+	Compression CompressionType `json:"compression"`
+	Size        int64           `json:"size"`
+	Chunks      []DedupChunk    `json:"chunks"`
+}
+
+// DedupChunk describes the single data chunk
+type DedupChunk struct {
+	// Hash is the hex-encoded sha256 sum of the uncompressed chunk
+	Hash string `json:"h"`
+	Size int    `json:"s"`
+}
+
+// DedupBlobPath returns the storage path of the chunk. Chunks with different
+// compression are stored as different blobs.
+func DedupBlobPath(hash string, compression CompressionType) string {
+	name := hash
+	if compression != CompressionTypeNone && compression != "" {
+		name += "." + string(compression)
+	}
+	return path.Join(DedupBlobsDir, hash[:2], name)
+}
@@ -0,0 +1,247 @@
+package pbm
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventType is the kind of the cluster event
+type EventType string
+
+const (
+	// EventAgentConnected is sent when the agent starts sending the
+	// heartbeats (or resumes it after being lost)
+	EventAgentConnected EventType = "agent_connected"
+	// EventAgentLost is sent when the agent's heartbeat becomes stale
+	EventAgentLost EventType = "agent_lost"
+	// EventAgentError is sent when the agent reports a new error
+	// (e.g. the storage isn't reachable)
+	EventAgentError EventType = "agent_error"
+	// EventBackup is sent on the change of the backup's status or the status
+	// of its replset. The error ones carry the error.
+	EventBackup EventType = "backup"
+	// EventRestore is sent on the change of the restore's status or the
+	// status of its replset
+	EventRestore EventType = "restore"
+)
+
+// Event is the change of the cluster state
+type Event struct {
+	// TS is the unix time the change has been noticed
+	TS      int64     `json:"ts"`
+	Type    EventType `json:"type"`
+	Replset string    `json:"replset,omitempty"`
+	Node    string    `json:"node,omitempty"`
+	// Name is the name of the backup or the restore
+	Name   string `json:"name,omitempty"`
+	Status Status `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// eventsDepth is the number of the latest backups and restores
+// watched for the changes
+const eventsDepth = 20
+
+// eventsState is the cluster state the next poll is compared to
+type eventsState struct {
+	agents map[agentKey]agentState
+	// ops are the states of the backups and restores and of their replsets
+	ops map[opKey]opState
+}
+
+type agentKey struct {
+	rs, node string
+}
+
+func sortedAgents(m map[agentKey]agentState) []agentKey {
+	keys := make([]agentKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rs != keys[j].rs {
+			return keys[i].rs < keys[j].rs
+		}
+		return keys[i].node < keys[j].node
+	})
+	return keys
+}
+
+type agentState struct {
+	alive bool
+	err   string
+}
+
+// opKey is the backup or restore (the replset is empty) or its replset
+type opKey struct {
+	typ      EventType
+	name, rs string
+}
+
+type opState struct {
+	status Status
+	err    string
+}
+
+// sortedOps returns the keys by the operation, the replsets of
+// the operation go before the operation itself
+func sortedOps(m map[opKey]opState) []opKey {
+	keys := make([]opKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch {
+		case a.typ != b.typ:
+			return a.typ < b.typ
+		case a.name != b.name:
+			return a.name < b.name
+		case a.rs == "" || b.rs == "":
+			return b.rs == ""
+		}
+		return a.rs < b.rs
+	})
+	return keys
+}
+
+// WatchEvents polls the agents' heartbeats, the backups and the restores
+// every interval and sends the changes since the start as the events. The
+// channel is closed once the ctx is done. The poll errors are sent
+// to errc, the watch goes on after them.
+func (p *PBM) WatchEvents(ctx context.Context, interval time.Duration) (<-chan Event, <-chan error) {
+	evc := make(chan Event)
+	errc := make(chan error)
+
+	go func() {
+		defer close(evc)
+		defer close(errc)
+
+		var prev *eventsState
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		for {
+			cur, err := p.eventsState()
+			if err != nil {
+				select {
+				case errc <- err:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				if prev != nil {
+					for _, e := range prev.diff(cur, time.Now().Unix()) {
+						select {
+						case evc <- e:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				prev = cur
+			}
+
+			select {
+			case <-tk.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return evc, errc
+}
+
+func (p *PBM) eventsState() (*eventsState, error) {
+	s := &eventsState{
+		agents: make(map[agentKey]agentState),
+		ops:    make(map[opKey]opState),
+	}
+
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "read cluster time")
+	}
+	agents, err := p.AgentsStatus()
+	if err != nil {
+		return nil, errors.Wrap(err, "get agents status")
+	}
+	for _, a := range agents {
+		s.agents[agentKey{a.RS, a.Node}] = agentState{alive: !a.IsStale(ts), err: a.Err}
+	}
+
+	bcps, err := p.BackupsList(eventsDepth)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backups list")
+	}
+	for _, b := range bcps {
+		s.ops[opKey{EventBackup, b.Name, ""}] = opState{b.Status, b.Error}
+		for _, rs := range b.Replsets {
+			s.ops[opKey{EventBackup, b.Name, rs.Name}] = opState{rs.Status, rs.Error}
+		}
+	}
+
+	cur, err := p.Conn.Database(DB).Collection(RestoresCollection).Find(
+		p.ctx,
+		bson.D{},
+		options.Find().SetLimit(eventsDepth).SetSort(bson.D{{"start_ts", -1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query restores")
+	}
+	defer cur.Close(p.ctx)
+	for cur.Next(p.ctx) {
+		r := RestoreMeta{}
+		err := cur.Decode(&r)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode restore")
+		}
+		s.ops[opKey{EventRestore, r.Name, ""}] = opState{r.Status, r.Error}
+		for _, rs := range r.Replsets {
+			s.ops[opKey{EventRestore, r.Name, rs.Name}] = opState{rs.Status, rs.Error}
+		}
+	}
+	if cur.Err() != nil {
+		return nil, errors.Wrap(cur.Err(), "read restores")
+	}
+
+	return s, nil
+}
+
+// diff returns the events which turn the state into the given one.
+// The events of the same poll go in the same order every time.
+func (s *eventsState) diff(cur *eventsState, now int64) []Event {
+	var evs []Event
+	for _, k := range sortedAgents(cur.agents) {
+		a := cur.agents[k]
+		was, ok := s.agents[k]
+		switch {
+		case a.alive && !was.alive:
+			evs = append(evs, Event{TS: now, Type: EventAgentConnected, Replset: k.rs, Node: k.node})
+		case !a.alive && ok && was.alive:
+			evs = append(evs, Event{TS: now, Type: EventAgentLost, Replset: k.rs, Node: k.node})
+		}
+		if a.err != "" && a.err != was.err {
+			evs = append(evs, Event{TS: now, Type: EventAgentError, Replset: k.rs, Node: k.node, Error: a.err})
+		}
+	}
+	for _, k := range sortedAgents(s.agents) {
+		if _, ok := cur.agents[k]; !ok && s.agents[k].alive {
+			evs = append(evs, Event{TS: now, Type: EventAgentLost, Replset: k.rs, Node: k.node})
+		}
+	}
+
+	for _, k := range sortedOps(cur.ops) {
+		op := cur.ops[k]
+		if s.ops[k].status == op.status {
+			continue
+		}
+		evs = append(evs, Event{TS: now, Type: k.typ, Name: k.name, Replset: k.rs, Status: op.status, Error: op.err})
+	}
+	return evs
+}
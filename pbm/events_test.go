@@ -0,0 +1,47 @@
+package pbm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventsDiffOrder(t *testing.T) {
+	prev := &eventsState{
+		agents: map[agentKey]agentState{
+			{"rs1", "n1"}: {alive: true},
+		},
+		ops: map[opKey]opState{},
+	}
+	cur := &eventsState{
+		agents: map[agentKey]agentState{
+			{"rs1", "n1"}: {alive: false},
+			{"rs0", "n2"}: {alive: true},
+			{"rs0", "n1"}: {alive: true},
+		},
+		ops: map[opKey]opState{
+			{EventRestore, "r1", ""}:    {status: StatusRunning},
+			{EventBackup, "b1", ""}:     {status: StatusDone},
+			{EventBackup, "b1", "rs1"}:  {status: StatusDone},
+			{EventBackup, "b1", "rs0"}:  {status: StatusDone},
+			{EventRestore, "r1", "rs0"}: {status: StatusRunning},
+		},
+	}
+
+	want := []Event{
+		{Type: EventAgentConnected, Replset: "rs0", Node: "n1"},
+		{Type: EventAgentConnected, Replset: "rs0", Node: "n2"},
+		{Type: EventAgentLost, Replset: "rs1", Node: "n1"},
+		{Type: EventBackup, Name: "b1", Replset: "rs0", Status: StatusDone},
+		{Type: EventBackup, Name: "b1", Replset: "rs1", Status: StatusDone},
+		{Type: EventBackup, Name: "b1", Status: StatusDone},
+		{Type: EventRestore, Name: "r1", Replset: "rs0", Status: StatusRunning},
+		{Type: EventRestore, Name: "r1", Status: StatusRunning},
+	}
+	// the order must hold on every run whatever the maps order is
+	for i := 0; i < 10; i++ {
+		got := prev.diff(cur, 0)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got events\n%v\nwant\n%v", got, want)
+		}
+	}
+}
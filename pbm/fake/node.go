@@ -0,0 +1,210 @@
+// Package fake provides the in-memory implementation of pbm.Cluster so
+// the cluster and the oplog logic can be run without a live cluster.
+package fake
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// Node is the in-memory node. Its isMaster data, shards and collections
+// are set by the caller and can be changed while the node is in use.
+type Node struct {
+	mu     sync.Mutex
+	im     pbm.IsMaster
+	shards []pbm.Shard
+	colls  map[string][]bson.Raw
+	added  chan struct{}
+}
+
+var _ pbm.Cluster = (*Node)(nil)
+
+// NewReplset returns the primary of the replset `rs` with the given members
+func NewReplset(rs string, hosts ...string) *Node {
+	n := NewNode(pbm.IsMaster{
+		SetName:  rs,
+		Hosts:    hosts,
+		IsMaster: true,
+	})
+	if len(hosts) > 0 {
+		n.im.Me = hosts[0]
+		n.im.Primary = hosts[0]
+	}
+	return n
+}
+
+// NewNode returns the node with the given isMaster data
+func NewNode(im pbm.IsMaster) *Node {
+	return &Node{
+		im:    im,
+		colls: make(map[string][]bson.Raw),
+		added: make(chan struct{}),
+	}
+}
+
+// SetIsMaster replaces the isMaster data of the node
+func (n *Node) SetIsMaster(im pbm.IsMaster) {
+	n.mu.Lock()
+	n.im = im
+	n.mu.Unlock()
+}
+
+// SetShards replaces the shards of the cluster
+func (n *Node) SetShards(shards ...pbm.Shard) {
+	n.mu.Lock()
+	n.shards = shards
+	n.mu.Unlock()
+}
+
+// Insert appends the documents to the collection `ns` (<db>.<collection>).
+// The oplog entries should be appended in the order of their timestamps.
+func (n *Node) Insert(ns string, docs ...interface{}) error {
+	raws := make([]bson.Raw, 0, len(docs))
+	for _, d := range docs {
+		b, err := bson.Marshal(d)
+		if err != nil {
+			return errors.Wrap(err, "marshal document")
+		}
+		raws = append(raws, b)
+	}
+
+	n.mu.Lock()
+	n.colls[ns] = append(n.colls[ns], raws...)
+	close(n.added)
+	n.added = make(chan struct{})
+	n.mu.Unlock()
+	return nil
+}
+
+// OplogEntry is the oplog entry with the fields the pbm logic looks at
+type OplogEntry struct {
+	TS primitive.Timestamp `bson:"ts"`
+	Op pbm.Operation       `bson:"op"`
+	NS string              `bson:"ns"`
+	O  bson.D              `bson:"o"`
+}
+
+// InsertOplog appends the entries to the node's oplog
+func (n *Node) InsertOplog(entries ...OplogEntry) error {
+	docs := make([]interface{}, len(entries))
+	for i := range entries {
+		docs[i] = entries[i]
+	}
+	return n.Insert("local."+n.oplogColl(), docs...)
+}
+
+func (n *Node) oplogColl() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.im.Hosts) == 0 {
+		return "oplog.$main"
+	}
+	return "oplog.rs"
+}
+
+// GetIsMaster returns the isMaster data of the node
+func (n *Node) GetIsMaster() (*pbm.IsMaster, error) {
+	n.mu.Lock()
+	im := n.im
+	n.mu.Unlock()
+	return &im, nil
+}
+
+// ListShards returns the shards set by SetShards
+func (n *Node) ListShards() ([]pbm.Shard, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]pbm.Shard{}, n.shards...), nil
+}
+
+// FirstRecord returns the first document of the collection
+// or nil if the collection is empty
+func (n *Node) FirstRecord(ns string) (bson.Raw, error) {
+	if !strings.Contains(ns, ".") {
+		return nil, errors.Errorf("bad namespace %s", ns)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.colls[ns]) == 0 {
+		return nil, nil
+	}
+	return n.colls[ns][0], nil
+}
+
+// OplogCursor returns the cursor over the oplog entries starting from
+// `from`. The tailable cursor waits for the entries inserted later
+// until the context is done.
+func (n *Node) OplogCursor(ctx context.Context, coll string, from primitive.Timestamp, tailable bool) (pbm.Cursor, error) {
+	if !strings.HasPrefix(coll, "oplog.") {
+		return nil, errors.Errorf("%s isn't an oplog collection", coll)
+	}
+	return &cursor{
+		n:        n,
+		ns:       "local." + coll,
+		from:     from,
+		tailable: tailable,
+	}, nil
+}
+
+type cursor struct {
+	n        *Node
+	ns       string
+	from     primitive.Timestamp
+	tailable bool
+	pos      int
+	cur      bson.Raw
+	err      error
+	closed   bool
+}
+
+func (c *cursor) Next(ctx context.Context) bool {
+	for !c.closed && c.err == nil {
+		c.n.mu.Lock()
+		docs, added := c.n.colls[c.ns], c.n.added
+		c.n.mu.Unlock()
+
+		for c.pos < len(docs) {
+			d := docs[c.pos]
+			c.pos++
+			t, i, ok := d.Lookup("ts").TimestampOK()
+			if !ok {
+				c.err = errors.New("no ts in the oplog entry")
+				return false
+			}
+			if primitive.CompareTimestamp(primitive.Timestamp{T: t, I: i}, c.from) >= 0 {
+				c.cur = d
+				return true
+			}
+		}
+		if !c.tailable {
+			return false
+		}
+
+		select {
+		case <-added:
+		case <-ctx.Done():
+			c.err = ctx.Err()
+		}
+	}
+	return false
+}
+
+func (c *cursor) Doc() bson.Raw {
+	return c.cur
+}
+
+func (c *cursor) Err() error {
+	return c.err
+}
+
+func (c *cursor) Close(context.Context) error {
+	c.closed = true
+	return nil
+}
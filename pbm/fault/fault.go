@@ -0,0 +1,37 @@
+// Package fault provides the fault injection points for the resilience
+// tests. The points do nothing unless the binary is built with the
+// "faults" build tag. Then the faults are defined by the rules taken
+// from the PBM_FAULTS env variable and the file set by PBM_FAULTS_FILE.
+// The file is read on each check so the faults can be switched on and off
+// in the running agent.
+//
+// The rules are separated by ";" or new lines:
+//
+//	storage.write[:<name>]@<bytes>  fails the write of the storage file which
+//	                                name contains <name> after <bytes> written
+//	backup.phase:<status>           fails the replset's backup when it's about
+//	                                to reach the status (e.g. dumpDone)
+//	oplog.tail@<entries>            kills the oplog tailing after <entries> read
+package fault
+
+import "fmt"
+
+// The fault injection points
+const (
+	StorageWrite = "storage.write"
+	BackupPhase  = "backup.phase"
+	OplogTail    = "oplog.tail"
+)
+
+// Injected is the error of the triggered fault
+type Injected struct {
+	Point string
+	At    string
+}
+
+func (e Injected) Error() string {
+	if e.At == "" {
+		return fmt.Sprintf("injected fault at %s", e.Point)
+	}
+	return fmt.Sprintf("injected fault at %s:%s", e.Point, e.At)
+}
@@ -0,0 +1,18 @@
+//go:build !faults
+// +build !faults
+
+package fault
+
+import "io"
+
+// Check returns the Injected error if there is the fault
+// at the point for `at` (a status, a file name)
+func Check(point, at string) error { return nil }
+
+// Limit returns the number of the bytes or entries after which the point
+// fails for `at` or -1 if there is no such fault
+func Limit(point, at string) int64 { return -1 }
+
+// Reader returns the reader which fails after the number of bytes set by the
+// StorageWrite fault for the file `name`
+func Reader(r io.Reader, name string) io.Reader { return r }
@@ -0,0 +1,117 @@
+//go:build faults
+// +build faults
+
+package fault
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type rule struct {
+	point string
+	at    string
+	after int64
+}
+
+func (r rule) matches(point, at string) bool {
+	if r.point != point {
+		return false
+	}
+	if point == StorageWrite {
+		return strings.Contains(at, r.at)
+	}
+	return r.at == "" || r.at == at
+}
+
+// rules parses the rules from the env and the file
+func rules() []rule {
+	src := os.Getenv("PBM_FAULTS")
+	if f := os.Getenv("PBM_FAULTS_FILE"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[FAULT] read %s: %v", f, err)
+		}
+		src += "\n" + string(b)
+	}
+
+	var rs []rule
+	for _, s := range strings.FieldsFunc(src, func(c rune) bool { return c == ';' || c == '\n' }) {
+		s = strings.TrimSpace(s)
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		r := rule{after: -1}
+		if i := strings.LastIndex(s, "@"); i != -1 {
+			n, err := strconv.ParseInt(s[i+1:], 10, 64)
+			if err != nil {
+				log.Printf("[FAULT] invalid rule %q: %v", s, err)
+				continue
+			}
+			r.after = n
+			s = s[:i]
+		}
+		r.point = s
+		if i := strings.Index(s, ":"); i != -1 {
+			r.point, r.at = s[:i], s[i+1:]
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// Check returns the Injected error if there is the fault
+// at the point for `at` (a status, a file name)
+func Check(point, at string) error {
+	for _, r := range rules() {
+		if r.matches(point, at) && r.after < 0 {
+			log.Printf("[FAULT] %s:%s triggered", point, at)
+			return Injected{Point: point, At: at}
+		}
+	}
+	return nil
+}
+
+// Limit returns the number of the bytes or entries after which the point
+// fails for `at` or -1 if there is no such fault
+func Limit(point, at string) int64 {
+	for _, r := range rules() {
+		if r.matches(point, at) && r.after >= 0 {
+			return r.after
+		}
+	}
+	return -1
+}
+
+// Reader returns the reader which fails after the number of bytes set by the
+// StorageWrite fault for the file `name`
+func Reader(r io.Reader, name string) io.Reader {
+	n := Limit(StorageWrite, name)
+	if n < 0 {
+		return r
+	}
+	return &failReader{r: r, left: n, name: name}
+}
+
+type failReader struct {
+	r    io.Reader
+	left int64
+	name string
+}
+
+func (f *failReader) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		log.Printf("[FAULT] %s:%s triggered", StorageWrite, f.name)
+		return 0, Injected{Point: StorageWrite, At: f.name}
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,50 @@
+package pbm
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FsyncLockMeta marks the node which is fsync-locked by the backup
+type FsyncLockMeta struct {
+	Node    string `bson:"node" json:"node"`
+	Replset string `bson:"rs" json:"rs"`
+	Backup  string `bson:"backup" json:"backup"`
+	TS      int64  `bson:"ts" json:"ts"`
+}
+
+// SetFsyncLock marks the node as fsync-locked.
+// It has to be written before the node is actually locked.
+func (p *PBM) SetFsyncLock(m FsyncLockMeta) error {
+	_, err := p.Conn.Database(DB).Collection(FsyncLockCollection).ReplaceOne(
+		p.ctx,
+		bson.D{{"node", m.Node}, {"rs", m.Replset}},
+		m,
+		options.Replace().SetUpsert(true),
+	)
+	return errors.Wrap(err, "write into db")
+}
+
+// GetFsyncLock returns the fsync lock mark of the node if there is any
+func (p *PBM) GetFsyncLock(rs, node string) (*FsyncLockMeta, error) {
+	m := new(FsyncLockMeta)
+	err := p.Conn.Database(DB).Collection(FsyncLockCollection).FindOne(
+		p.ctx,
+		bson.D{{"node", node}, {"rs", rs}},
+	).Decode(m)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return m, errors.Wrap(err, "query mongo")
+}
+
+// DeleteFsyncLock removes the fsync lock mark of the node
+func (p *PBM) DeleteFsyncLock(rs, node string) error {
+	_, err := p.Conn.Database(DB).Collection(FsyncLockCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"node", node}, {"rs", rs}},
+	)
+	return errors.Wrap(err, "delete from db")
+}
@@ -0,0 +1,324 @@
+package pbm
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+)
+
+// GridFSCheck is the result of the GridFS bucket integrity check
+type GridFSCheck struct {
+	// Bucket is the bucket's `db.prefix`
+	Bucket string `bson:"bucket" json:"bucket"`
+	Files  int64  `bson:"files" json:"files"`
+	Chunks int64  `bson:"chunks" json:"chunks"`
+	// Incomplete is the number of files with missing or extra chunks
+	Incomplete int64 `bson:"incomplete" json:"incomplete"`
+	// Orphaned is the number of chunks which have no file
+	Orphaned int64 `bson:"orphaned" json:"orphaned"`
+	// Corrupted is the number of files which data doesn't match the md5
+	Corrupted int64 `bson:"corrupted,omitempty" json:"corrupted,omitempty"`
+	// Samples are ids of some broken files
+	Samples []string `bson:"samples,omitempty" json:"samples,omitempty"`
+}
+
+const gridfsSamples = 10
+
+// OK returns true if no problems were found
+func (g GridFSCheck) OK() bool {
+	return g.Incomplete == 0 && g.Orphaned == 0 && g.Corrupted == 0
+}
+
+func (g *GridFSCheck) sample(id interface{}) {
+	if len(g.Samples) < gridfsSamples {
+		g.Samples = append(g.Samples, fmt.Sprint(id))
+	}
+}
+
+// GridFSBuckets returns GridFS buckets (`db.prefix`) among the given collections
+func GridFSBuckets(colls []NSInfo) []string {
+	exists := make(map[string]struct{}, len(colls))
+	for _, c := range colls {
+		exists[c.NS] = struct{}{}
+	}
+
+	var buckets []string
+	for _, c := range colls {
+		if c.View || !strings.HasSuffix(c.NS, ".files") {
+			continue
+		}
+		b := strings.TrimSuffix(c.NS, ".files")
+		if _, ok := exists[b+".chunks"]; ok {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+type gridfsFile struct {
+	ID        interface{} `bson:"_id"`
+	Length    int64       `bson:"length"`
+	ChunkSize int64       `bson:"chunkSize"`
+	MD5       string      `bson:"md5,omitempty"`
+}
+
+func (f gridfsFile) chunks() int64 {
+	if f.ChunkSize <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(f.Length) / float64(f.ChunkSize)))
+}
+
+// CheckGridFS verifies that each file of the bucket has all its chunks
+// and there are no chunks without files. If checkMD5 is set the data of
+// files with the md5 is read and validated as well.
+// With snapshot the files and the chunks are read at the same point in
+// time so the files being written at the moment aren't reported as broken.
+// It's done in the read-only transaction, hence it's bound by its
+// lifetime limit and isn't for the md5 check that reads all the data.
+//
+// The node has to see the whole bucket: in the sharded cluster the files
+// and the chunks may lie on different shards, so it's checked via mongos.
+func (n *Node) CheckGridFS(bucket string, checkMD5, snapshot bool) (GridFSCheck, error) {
+	return checkGridFS(n.ctx, n.cn, bucket, checkMD5, snapshot)
+}
+
+// CheckGridFS checks the bucket across the whole sharded cluster, see Node.CheckGridFS
+func (m *Mongos) CheckGridFS(bucket string, checkMD5, snapshot bool) (GridFSCheck, error) {
+	return checkGridFS(m.ctx, m.cn, bucket, checkMD5, snapshot)
+}
+
+func checkGridFS(ctx context.Context, cn *mongo.Client, bucket string, checkMD5, snapshot bool) (GridFSCheck, error) {
+	if !snapshot {
+		return readGridFS(ctx, cn, bucket, checkMD5)
+	}
+
+	sess, err := cn.StartSession()
+	if err != nil {
+		return GridFSCheck{Bucket: bucket}, errors.Wrap(err, "start session")
+	}
+	defer sess.EndSession(ctx)
+
+	err = sess.StartTransaction(options.Transaction().SetReadConcern(readconcern.Snapshot()))
+	if err != nil {
+		return GridFSCheck{Bucket: bucket}, errors.Wrap(err, "start snapshot transaction")
+	}
+	// nothing is written, so it's never committed
+	defer sess.AbortTransaction(ctx)
+
+	var res GridFSCheck
+	err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+		var err error
+		res, err = readGridFS(sc, cn, bucket, checkMD5)
+		return err
+	})
+	return res, err
+}
+
+func readGridFS(ctx context.Context, cn *mongo.Client, bucket string, checkMD5 bool) (GridFSCheck, error) {
+	res := GridFSCheck{Bucket: bucket}
+
+	i := strings.Index(bucket, ".")
+	if i < 0 {
+		return res, errors.Errorf("bad bucket name %s", bucket)
+	}
+	db := cn.Database(bucket[:i])
+	files := db.Collection(bucket[i+1:] + ".files")
+	chunks := db.Collection(bucket[i+1:] + ".chunks")
+
+	// expected number of chunks by file id
+	expected := make(map[string]gridfsFile)
+	cur, err := files.Find(ctx, bson.D{}, options.Find().SetProjection(bson.D{
+		{"_id", 1}, {"length", 1}, {"chunkSize", 1}, {"md5", 1},
+	}))
+	if err != nil {
+		return res, errors.Wrap(err, "get files")
+	}
+	for cur.Next(ctx) {
+		var f gridfsFile
+		err := cur.Decode(&f)
+		if err != nil {
+			cur.Close(ctx)
+			return res, errors.Wrap(err, "decode file")
+		}
+		expected[idKey(cur.Current.Lookup("_id"))] = f
+		res.Files++
+	}
+	err = cur.Err()
+	cur.Close(ctx)
+	if err != nil {
+		return res, errors.Wrap(err, "read files")
+	}
+
+	cur, err = chunks.Aggregate(ctx,
+		bson.A{
+			bson.D{{"$group", bson.D{
+				{"_id", "$files_id"},
+				{"n", bson.D{{"$sum", 1}}},
+				{"max", bson.D{{"$max", "$n"}}},
+			}}},
+		},
+		options.Aggregate().SetAllowDiskUse(true),
+	)
+	if err != nil {
+		return res, errors.Wrap(err, "group chunks")
+	}
+	for cur.Next(ctx) {
+		var g struct {
+			ID  interface{} `bson:"_id"`
+			N   int64       `bson:"n"`
+			Max int64       `bson:"max"`
+		}
+		err := cur.Decode(&g)
+		if err != nil {
+			cur.Close(ctx)
+			return res, errors.Wrap(err, "decode chunks group")
+		}
+		res.Chunks += g.N
+
+		id := idKey(cur.Current.Lookup("_id"))
+		f, ok := expected[id]
+		if !ok {
+			res.Orphaned += g.N
+			continue
+		}
+		delete(expected, id)
+		if g.N != f.chunks() || g.Max != f.chunks()-1 {
+			res.Incomplete++
+			res.sample(f.ID)
+			continue
+		}
+		if checkMD5 && f.MD5 != "" {
+			ok, err := gridfsMD5(ctx, chunks, f)
+			if err != nil {
+				cur.Close(ctx)
+				return res, errors.Wrapf(err, "check md5 of %v", f.ID)
+			}
+			if !ok {
+				res.Corrupted++
+				res.sample(f.ID)
+			}
+		}
+	}
+	err = cur.Err()
+	cur.Close(ctx)
+	if err != nil {
+		return res, errors.Wrap(err, "read chunks groups")
+	}
+
+	// files with no chunks at all
+	for _, f := range expected {
+		if f.chunks() > 0 {
+			res.Incomplete++
+			res.sample(f.ID)
+		}
+	}
+
+	return res, nil
+}
+
+// idKey returns the map key of the bson value
+func idKey(v bson.RawValue) string {
+	return string(append([]byte{byte(v.Type)}, v.Value...))
+}
+
+// gridfsMD5 reads the file's chunks and validates them against the file's md5
+func gridfsMD5(ctx context.Context, chunks *mongo.Collection, f gridfsFile) (bool, error) {
+	cur, err := chunks.Find(ctx,
+		bson.D{{"files_id", f.ID}},
+		options.Find().SetSort(bson.D{{"n", 1}}).SetProjection(bson.D{{"data", 1}}),
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "get chunks")
+	}
+	defer cur.Close(ctx)
+
+	h := md5.New()
+	for cur.Next(ctx) {
+		var c struct {
+			Data primitive.Binary `bson:"data"`
+		}
+		err := cur.Decode(&c)
+		if err != nil {
+			return false, errors.Wrap(err, "decode chunk")
+		}
+		h.Write(c.Data.Data)
+	}
+	if err := cur.Err(); err != nil {
+		return false, errors.Wrap(err, "read chunks")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(f.MD5), nil
+}
+
+// CheckGridFSBuckets checks all GridFS buckets among the given collections
+func (n *Node) CheckGridFSBuckets(colls []NSInfo, checkMD5, snapshot bool) ([]GridFSCheck, error) {
+	var checks []GridFSCheck
+	for _, b := range GridFSBuckets(colls) {
+		c, err := n.CheckGridFS(b, checkMD5, snapshot)
+		if err != nil {
+			return checks, errors.Wrapf(err, "check bucket %s", b)
+		}
+		checks = append(checks, c)
+	}
+	return checks, nil
+}
+
+// CheckGridFSBuckets checks all GridFS buckets of the sharded cluster
+func (m *Mongos) CheckGridFSBuckets(checkMD5, snapshot bool) ([]GridFSCheck, error) {
+	dbs, err := m.cn.ListDatabaseNames(m.ctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "list databases")
+	}
+
+	var colls []NSInfo
+	for _, db := range dbs {
+		if db == "admin" || db == "config" || db == "local" {
+			continue
+		}
+		names, err := m.cn.Database(db).ListCollectionNames(m.ctx, bson.D{{"type", "collection"}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "list collections of %s", db)
+		}
+		for _, n := range names {
+			colls = append(colls, NSInfo{NS: db + "." + n})
+		}
+	}
+
+	var checks []GridFSCheck
+	for _, b := range GridFSBuckets(colls) {
+		c, err := m.CheckGridFS(b, checkMD5, snapshot)
+		if err != nil {
+			return checks, errors.Wrapf(err, "check bucket %s", b)
+		}
+		checks = append(checks, c)
+	}
+	return checks, nil
+}
+
+func (g GridFSCheck) String() string {
+	s := fmt.Sprintf("%s: %d files, %d chunks", g.Bucket, g.Files, g.Chunks)
+	if g.Incomplete > 0 {
+		s += fmt.Sprintf(", %d incomplete files", g.Incomplete)
+	}
+	if g.Corrupted > 0 {
+		s += fmt.Sprintf(", %d files with md5 mismatch", g.Corrupted)
+	}
+	if g.Orphaned > 0 {
+		s += fmt.Sprintf(", %d orphaned chunks", g.Orphaned)
+	}
+	if len(g.Samples) > 0 {
+		s += fmt.Sprintf(" (e.g. %s)", strings.Join(g.Samples, ", "))
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package pbm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IdempotencyKeyTTL is how long the idempotency key stays bound to the
+// job. The retries of the call are expected to come in much earlier.
+const IdempotencyKeyTTL = time.Hour * 24
+
+// IdempotencyKey binds the key the client passes along with the call which
+// starts the job to that job, so the retried call doesn't start another one
+type IdempotencyKey struct {
+	Key  string  `bson:"_id" json:"key"`
+	Cmd  Command `bson:"cmd" json:"cmd"`
+	Name string  `bson:"name" json:"name"`
+	// Params is the hash of the call's parameters, see IdempotencyParams
+	Params string `bson:"params" json:"params"`
+	// CreatedAt is the time the TTL index expires the key by
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// IdempotencyParams returns the hash of the parameters of the command.
+// The values each call makes up anew (the job name, the trace, the
+// expiration time) aren't the parameters, they differ on the retry.
+func IdempotencyParams(cmd Cmd) string {
+	cmd.ID = primitive.ObjectID{}
+	cmd.TS = 0
+	cmd.User = ""
+	cmd.Backup.Name = ""
+	cmd.Backup.Replaces = ""
+	cmd.Backup.Trace = TraceContext{}
+	cmd.Backup.ExpireAt = 0
+	cmd.Restore.Name = ""
+	cmd.Restore.Trace = TraceContext{}
+	cmd.Restore.Approval = ""
+	cmd.Restore.SafetyBackup = ""
+	h := sha256.Sum256(canonicalBSON(cmd))
+	return fmt.Sprintf("%x", h)
+}
+
+// canonicalBSON returns the BSON of v with the keys of all its documents
+// sorted. The maps (e.g. the backup tags) are marshaled in the random
+// order, so the hash of the same value would differ otherwise.
+func canonicalBSON(v interface{}) []byte {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		// can't happen for the struct
+		panic(err)
+	}
+	var d bson.D
+	err = bson.Unmarshal(b, &d)
+	if err != nil {
+		panic(err)
+	}
+	b, err = bson.Marshal(sortedDoc(d))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// sortedDoc returns the document with the keys of it
+// and of the nested documents sorted
+func sortedDoc(d bson.D) bson.D {
+	s := make(bson.D, len(d))
+	for i, e := range d {
+		s[i] = bson.E{Key: e.Key, Value: sortedValue(e.Value)}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].Key < s[j].Key })
+	return s
+}
+
+func sortedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return sortedDoc(v)
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i := range v {
+			a[i] = sortedValue(v[i])
+		}
+		return a
+	}
+	return v
+}
+
+// Check returns an error if the key is bound to the call with the other
+// command or parameters, the reuse of the key is a client's bug then
+func (k IdempotencyKey) Check(cmd Cmd) error {
+	if k.Cmd != cmd.Cmd {
+		return errors.Errorf("the idempotency key is already used by the %s %s", k.Cmd, k.Name)
+	}
+	if k.Params != IdempotencyParams(cmd) {
+		return errors.Errorf("the idempotency key is already used by the %s %s with the other parameters", k.Cmd, k.Name)
+	}
+	return nil
+}
+
+// GetIdempotencyKey returns the key, nil if it isn't bound to any job
+func (p *PBM) GetIdempotencyKey(key string) (*IdempotencyKey, error) {
+	k := new(IdempotencyKey)
+	err := p.Conn.Database(DB).Collection(IdempotencyCollection).FindOne(p.ctx, bson.D{{"_id", key}}).Decode(k)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get")
+	}
+	return k, nil
+}
+
+// ClaimIdempotencyKey binds the command's key to its job. If the key is
+// already bound to another job of the same call, the name of that job is
+// returned, empty if the key is claimed by this command or it's the job
+// of the key. The agents of all replsets claim the key of the command,
+// so only the one of the concurrent commands with the key is run.
+func (p *PBM) ClaimIdempotencyKey(cmd Cmd) (string, error) {
+	name := cmd.JobName()
+	_, err := p.Conn.Database(DB).Collection(IdempotencyCollection).InsertOne(
+		p.ctx,
+		IdempotencyKey{
+			Key:       cmd.IdempotencyKey,
+			Cmd:       cmd.Cmd,
+			Name:      name,
+			Params:    IdempotencyParams(cmd),
+			CreatedAt: time.Now().UTC(),
+		},
+	)
+	if err == nil {
+		return "", nil
+	}
+	if !strings.Contains(err.Error(), "E11000 duplicate key error") {
+		return "", errors.Wrap(err, "insert")
+	}
+
+	k, err := p.GetIdempotencyKey(cmd.IdempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	// expired in between
+	if k == nil {
+		return p.ClaimIdempotencyKey(cmd)
+	}
+	err = k.Check(cmd)
+	if err != nil {
+		return "", err
+	}
+	if k.Name == name {
+		return "", nil
+	}
+	return k.Name, nil
+}
@@ -0,0 +1,54 @@
+package pbm
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIdempotencyKeyCheck(t *testing.T) {
+	cmd := Cmd{Cmd: CmdBackup, Backup: BackupCmd{Name: "b1", Compression: CompressionTypeGZIP}, IdempotencyKey: "k1"}
+	k := IdempotencyKey{Key: "k1", Cmd: CmdBackup, Name: "b1", Params: IdempotencyParams(cmd)}
+
+	// the retried call names the backup anew
+	retry := cmd
+	retry.ID = primitive.NewObjectID()
+	retry.Backup.Name = "b2"
+	retry.Backup.Trace = TraceContext{TraceID: "t2"}
+	if err := k.Check(retry); err != nil {
+		t.Errorf("retried call: unexpected error: %v", err)
+	}
+
+	other := cmd
+	other.Backup.Compression = CompressionTypeNone
+	if err := k.Check(other); err == nil {
+		t.Error("expected error for the key reused with other parameters")
+	}
+	if err := k.Check(Cmd{Cmd: CmdRestore, Restore: RestoreCmd{BackupName: "b1"}, IdempotencyKey: "k1"}); err == nil {
+		t.Error("expected error for the key reused by another command")
+	}
+}
+
+func TestIdempotencyParamsMaps(t *testing.T) {
+	cmd := func() Cmd {
+		return Cmd{Cmd: CmdBackup, Backup: BackupCmd{
+			Name:     "b1",
+			Tags:     map[string]string{"env": "prod", "team": "db", "reason": "nightly", "dc": "east"},
+			Selector: map[string]string{"dc": "east", "rack": "r1", "env": "prod", "disk": "ssd"},
+		}}
+	}
+
+	// the agents of all replsets hash the command they get on their own
+	p := IdempotencyParams(cmd())
+	for i := 0; i < 50; i++ {
+		if got := IdempotencyParams(cmd()); got != p {
+			t.Fatalf("the same command is hashed as %s and %s", p, got)
+		}
+	}
+
+	other := cmd()
+	other.Backup.Tags["env"] = "stage"
+	if IdempotencyParams(other) == p {
+		t.Error("the other tags are hashed the same")
+	}
+}
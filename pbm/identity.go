@@ -0,0 +1,94 @@
+package pbm
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var agentIDRe = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// NewAgentID generates the random (v4) UUID
+func NewAgentID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "read random")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// DefaultAgentIDFile returns the file the identity of the agent
+// of the given node is stored in by default
+func DefaultAgentIDFile(node string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "define config dir")
+	}
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(node)
+	return filepath.Join(dir, "pbm-agent", name+".id"), nil
+}
+
+// LoadAgentID reads the agent's identity from the file. If there is
+// no file yet, the new identity is generated and stored in it.
+func LoadAgentID(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if !agentIDRe.MatchString(id) {
+			return "", errors.Errorf("invalid agent id %q in %s", id, file)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "read id file")
+	}
+
+	id, err := NewAgentID()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return "", errors.Wrap(err, "create id file dir")
+	}
+	err = ioutil.WriteFile(file, []byte(id+"\n"), 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "write id file")
+	}
+	return id, nil
+}
+
+// SetAgentID sets the identity of the agent the connection belongs to.
+// The locks taken via the connection are marked with it.
+func (p *PBM) SetAgentID(id string) {
+	p.agentID = id
+}
+
+// RemoveGhostAgents removes the statuses reported by the agent with the
+// given identity for the other nodes, e.g. before the host was renamed
+func (p *PBM) RemoveGhostAgents(id, rs, node string) (int64, error) {
+	res, err := p.Conn.Database(DB).Collection(AgentsStatusCollection).DeleteMany(
+		p.ctx,
+		bson.D{
+			{"id", id},
+			{"$or", bson.A{
+				bson.D{{"n", bson.D{{"$ne", node}}}},
+				bson.D{{"rs", bson.D{{"$ne", rs}}}},
+			}},
+		},
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "delete statuses")
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,81 @@
+package pbm
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CanceledByUser is the error message of the backup canceled via `pbm cancel`
+const CanceledByUser = "canceled by user"
+
+// IsFinished returns true if the backup is in one of the final states
+func (b *BackupMeta) IsFinished() bool {
+	switch b.Status {
+	case StatusDone, StatusPartlyDone, StatusError:
+		return true
+	}
+	return false
+}
+
+// CancelBackup cancels the running backup job. The agents watch the backup
+// state and abort their part of the backup once it turns into an error.
+func (p *PBM) CancelBackup(name string) error {
+	bmeta, err := p.GetBackupMeta(name)
+	if err != nil {
+		return errors.Wrap(err, "get backup metadata")
+	}
+	if bmeta.Name == "" {
+		return errors.Errorf("backup %s not found", name)
+	}
+	if bmeta.IsFinished() {
+		return errors.Errorf("backup %s is already finished with status %s", name, bmeta.Status)
+	}
+
+	ts := time.Now().UTC().Unix()
+	// don't overwrite the state of the backup finished in the meantime
+	res, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{
+			{"name", name},
+			{"status", bson.D{{"$nin", []Status{StatusDone, StatusPartlyDone, StatusError}}}},
+		},
+		bson.D{
+			{"$set", bson.M{"status": StatusError}},
+			{"$set", bson.M{"last_transition_ts": ts}},
+			{"$set", bson.M{"error": CanceledByUser}},
+			{"$push", bson.M{"conditions": Condition{Timestamp: ts, Status: StatusError, Error: CanceledByUser}}},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "update backup state")
+	}
+	if res.MatchedCount == 0 {
+		return errors.Errorf("backup %s has finished before it could be canceled", name)
+	}
+
+	return nil
+}
+
+// WaitBackup blocks until the backup job is finished and returns its final
+// metadata. It's up to the caller to limit the waiting via `ctx`.
+func (p *PBM) WaitBackup(ctx context.Context, name string) (*BackupMeta, error) {
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			bmeta, err := p.GetJobMeta(name)
+			if err != nil {
+				return nil, errors.Wrap(err, "get backup metadata")
+			}
+			if bmeta.IsFinished() && !bmeta.IsReplacing() {
+				return bmeta, nil
+			}
+		case <-ctx.Done():
+			return nil, errors.Errorf("backup %s isn't finished in time", name)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package pbm
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v2"
+)
+
+// JobSpecAPIVersion is the version of the job spec schema
+const JobSpecAPIVersion = "pbm.percona.com/v1"
+
+// JobKind is the kind of the job spec
+type JobKind string
+
+const (
+	JobKindBackup  JobKind = "Backup"
+	JobKindRestore         = "Restore"
+)
+
+// JobSpec is the declarative backup or restore job shaped as the Kubernetes
+// custom resource, so an operator can pass its resources through. The job
+// name is the backup name (the restore name for the restores): the job which
+// already exists isn't submitted again.
+//
+//	apiVersion: pbm.percona.com/v1
+//	kind: Backup
+//	metadata:
+//	  name: nightly-2020-06-01
+//	spec:
+//	  type: full
+//	  tags: {reason: nightly}
+type JobSpec struct {
+	APIVersion string      `json:"apiVersion" yaml:"apiVersion"`
+	Kind       JobKind     `json:"kind" yaml:"kind"`
+	Metadata   JobMetadata `json:"metadata" yaml:"metadata"`
+	// Backup is the spec of the Backup kind
+	Backup *BackupJobSpec `json:"-" yaml:"-"`
+	// Restore is the spec of the Restore kind
+	Restore *RestoreJobSpec `json:"-" yaml:"-"`
+}
+
+// JobMetadata is the metadata of the job. Labels
+// and annotations are accepted and ignored.
+type JobMetadata struct {
+	Name        string            `json:"name" yaml:"name"`
+	Namespace   string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// BackupJobSpec is the spec of the backup job, see BackupCmd
+type BackupJobSpec struct {
+	// Type is full (default), differential, schema or oplog
+	Type BackupType `json:"type,omitempty" yaml:"type,omitempty"`
+	// Base is the full backup the differential one is made against
+	Base        string          `json:"base,omitempty" yaml:"base,omitempty"`
+	Compression CompressionType `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// Timeout (e.g. 6h) overrides the config one
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// ExpireIn (e.g. 720h) keeps the backup immutable for the time
+	ExpireIn            time.Duration     `json:"expireIn,omitempty" yaml:"expireIn,omitempty"`
+	LegalHold           bool              `json:"legalHold,omitempty" yaml:"legalHold,omitempty"`
+	CheckGridFS         bool              `json:"checkGridFS,omitempty" yaml:"checkGridFS,omitempty"`
+	FsyncLock           bool              `json:"fsyncLock,omitempty" yaml:"fsyncLock,omitempty"`
+	Selector            map[string]string `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Replsets            []string          `json:"replsets,omitempty" yaml:"replsets,omitempty"`
+	Tags                map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Profile             Profile           `json:"profile,omitempty" yaml:"profile,omitempty"`
+	AdaptiveCompression bool              `json:"adaptiveCompression,omitempty" yaml:"adaptiveCompression,omitempty"`
+	ParallelCollections int               `json:"parallelCollections,omitempty" yaml:"parallelCollections,omitempty"`
+	// OplogFrom and OplogUntil (<T[,I]> or RFC3339) are
+	// the window of the oplog-only backup
+	OplogFrom  string `json:"oplogFrom,omitempty" yaml:"oplogFrom,omitempty"`
+	OplogUntil string `json:"oplogUntil,omitempty" yaml:"oplogUntil,omitempty"`
+	// IgnoreWindow runs the backup out of the backup window
+	IgnoreWindow bool `json:"ignoreWindow,omitempty" yaml:"ignoreWindow,omitempty"`
+	// Queue queues the backup if another operation is in progress
+	Queue bool `json:"queue,omitempty" yaml:"queue,omitempty"`
+}
+
+// RestoreJobSpec is the spec of the restore job, see RestoreCmd
+type RestoreJobSpec struct {
+	// Backup is the name of the backup to restore
+	Backup              string          `json:"backup" yaml:"backup"`
+	CheckGridFS         bool            `json:"checkGridFS,omitempty" yaml:"checkGridFS,omitempty"`
+	ParallelCollections int             `json:"parallelCollections,omitempty" yaml:"parallelCollections,omitempty"`
+	Sessions            bool            `json:"sessions,omitempty" yaml:"sessions,omitempty"`
+	Mode                RestoreMode     `json:"mode,omitempty" yaml:"mode,omitempty"`
+	NSModes             []NSRestoreMode `json:"nsModes,omitempty" yaml:"nsModes,omitempty"`
+	Transform           []TransformRule `json:"transform,omitempty" yaml:"transform,omitempty"`
+	// Queue queues the restore if another operation is in progress
+	Queue bool `json:"queue,omitempty" yaml:"queue,omitempty"`
+}
+
+// ParseJobSpec parses the YAML (or JSON) job spec. The unknown
+// fields of the spec are rejected.
+func ParseJobSpec(buf []byte) (*JobSpec, error) {
+	j := &JobSpec{}
+	err := yaml.Unmarshal(buf, j)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+	if j.APIVersion != JobSpecAPIVersion {
+		return nil, errors.Errorf("unsupported apiVersion %q, expected %q", j.APIVersion, JobSpecAPIVersion)
+	}
+
+	switch j.Kind {
+	case JobKindBackup:
+		var v struct {
+			JobSpec `yaml:",inline"`
+			Spec    BackupJobSpec `yaml:"spec"`
+		}
+		err = yaml.UnmarshalStrict(buf, &v)
+		j.Backup = &v.Spec
+	case JobKindRestore:
+		var v struct {
+			JobSpec `yaml:",inline"`
+			Spec    RestoreJobSpec `yaml:"spec"`
+		}
+		err = yaml.UnmarshalStrict(buf, &v)
+		j.Restore = &v.Spec
+	default:
+		return nil, errors.Errorf("unknown kind %q, expected %s or %s", j.Kind, JobKindBackup, JobKindRestore)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal spec")
+	}
+
+	if j.Metadata.Name == "" {
+		return nil, errors.New("metadata.name is required")
+	}
+	// the names end up in the storage paths
+	if err := ValidateBackupName(j.Metadata.Name); err != nil {
+		return nil, errors.Wrap(err, "metadata.name")
+	}
+	if j.Restore != nil {
+		if j.Restore.Backup == "" {
+			return nil, errors.New("spec.backup is required")
+		}
+		if err := ValidateBackupName(j.Restore.Backup); err != nil {
+			return nil, errors.Wrap(err, "spec.backup")
+		}
+	}
+	return j, nil
+}
+
+// JobState returns the state of the job: the status of the backup or the
+// restore, its position in the queue or the approval it waits for. It's
+// empty if there is no such job.
+func (p *PBM) JobState(j *JobSpec) (string, error) {
+	name := j.Metadata.Name
+	switch j.Kind {
+	case JobKindBackup:
+		bmeta, err := p.GetBackupMeta(name)
+		if err != nil {
+			return "", errors.Wrap(err, "get backup metadata")
+		}
+		if bmeta.Name != "" {
+			return string(bmeta.Status), nil
+		}
+	case JobKindRestore:
+		rmeta, err := p.GetRestoreMeta(name)
+		if err != nil {
+			return "", errors.Wrap(err, "get restore metadata")
+		}
+		if rmeta.Name != "" {
+			return string(rmeta.Status), nil
+		}
+	}
+
+	qpos, err := p.QueuePosition(name)
+	if err != nil {
+		return "", errors.Wrap(err, "check jobs queue")
+	}
+	if qpos > 0 {
+		return fmt.Sprintf("queued at position %d", qpos), nil
+	}
+
+	if j.Kind != JobKindRestore {
+		return "", nil
+	}
+	as, err := p.Approvals(0)
+	if err != nil {
+		return "", errors.Wrap(err, "get approval requests")
+	}
+	for _, a := range as {
+		if a.Cmd.Cmd == CmdRestore && a.Cmd.Restore.Name == name && a.Status != ApprovalRejected {
+			return fmt.Sprintf("approval %s %s", a.ID, a.Status), nil
+		}
+	}
+	return "", nil
+}
+
+// SubmitJob queues the job, the agents start it once the running
+// operations allow. The restore which needs the approval is stored
+// as the approval request instead. It returns the state of the job.
+func (p *PBM) SubmitJob(j *JobSpec, now time.Time) (string, error) {
+	cmd := Cmd{}
+	var err error
+	switch j.Kind {
+	case JobKindBackup:
+		cmd.Cmd = CmdBackup
+		cmd.Backup, err = j.BackupCmd(now)
+	case JobKindRestore:
+		cmd.Cmd = CmdRestore
+		cmd.Restore, err = j.RestoreCmd()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cfg, err := p.GetConfig()
+	if err != nil && errors.Cause(err) != mongo.ErrNoDocuments {
+		return "", errors.Wrap(err, "get config")
+	}
+	if cfg.Approval.Required(cmd.Cmd) {
+		a, err := p.RequestApproval(cmd)
+		if err != nil {
+			return "", errors.Wrap(err, "request approval")
+		}
+		return fmt.Sprintf("approval %s %s", a.ID, a.Status), nil
+	}
+
+	qpos, err := p.QueueJob(cmd, PriorityOnDemand)
+	if err != nil {
+		return "", errors.Wrap(err, "queue job")
+	}
+	return fmt.Sprintf("queued at position %d", qpos), nil
+}
+
+// BackupCmd returns the backup command of the job
+func (j *JobSpec) BackupCmd(now time.Time) (BackupCmd, error) {
+	s := j.Backup
+	if s == nil {
+		return BackupCmd{}, errors.Errorf("%s job isn't a backup", j.Kind)
+	}
+
+	bcp := BackupCmd{
+		Name:                j.Metadata.Name,
+		Type:                s.Type,
+		Base:                s.Base,
+		Compression:         s.Compression,
+		IgnoreWindow:        s.IgnoreWindow,
+		TimeoutSec:          int(s.Timeout.Seconds()),
+		LegalHold:           s.LegalHold,
+		CheckGridFS:         s.CheckGridFS,
+		FsyncLock:           s.FsyncLock,
+		Selector:            s.Selector,
+		Replsets:            s.Replsets,
+		Tags:                s.Tags,
+		Profile:             s.Profile,
+		AdaptiveCompression: s.AdaptiveCompression,
+		ParallelCollections: s.ParallelCollections,
+	}
+	if bcp.Compression == "" {
+		bcp.Compression = CompressionTypeGZIP
+	}
+	if s.ExpireIn > 0 {
+		bcp.ExpireAt = now.Add(s.ExpireIn).Unix()
+	}
+
+	switch bcp.Type {
+	case "", BackupTypeFull:
+		bcp.Type = ""
+	case BackupTypeDifferential:
+		if bcp.Base == "" {
+			return bcp, errors.New("spec.base is required for the differential backup")
+		}
+	case BackupTypeSchema:
+	case BackupTypeOplog:
+		if s.OplogFrom == "" {
+			return bcp, errors.New("spec.oplogFrom is required for the oplog-only backup")
+		}
+		var err error
+		bcp.OplogFrom, err = ParseTimestamp(s.OplogFrom)
+		if err != nil {
+			return bcp, errors.Wrap(err, "parse spec.oplogFrom")
+		}
+		if s.OplogUntil != "" {
+			bcp.OplogUntil, err = ParseTimestamp(s.OplogUntil)
+			if err != nil {
+				return bcp, errors.Wrap(err, "parse spec.oplogUntil")
+			}
+			if primitive.CompareTimestamp(bcp.OplogUntil, bcp.OplogFrom) <= 0 {
+				return bcp, errors.New("spec.oplogUntil should be after spec.oplogFrom")
+			}
+		}
+	default:
+		return bcp, errors.Errorf("unknown backup type %q", bcp.Type)
+	}
+	if bcp.Base != "" && bcp.Type != BackupTypeDifferential {
+		return bcp, errors.New("spec.base is used only with the differential backup")
+	}
+	if (s.OplogFrom != "" || s.OplogUntil != "") && bcp.Type != BackupTypeOplog {
+		return bcp, errors.New("spec.oplogFrom and spec.oplogUntil are used only with the oplog backup")
+	}
+	return bcp, nil
+}
+
+// RestoreCmd returns the restore command of the job
+func (j *JobSpec) RestoreCmd() (RestoreCmd, error) {
+	s := j.Restore
+	if s == nil {
+		return RestoreCmd{}, errors.Errorf("%s job isn't a restore", j.Kind)
+	}
+	if _, err := ParseRestoreMode(string(s.Mode)); err != nil {
+		return RestoreCmd{}, errors.Wrap(err, "spec.mode")
+	}
+	for i, m := range s.NSModes {
+		if _, err := path.Match(m.NS, ""); err != nil || m.NS == "" {
+			return RestoreCmd{}, errors.Errorf("spec.nsModes[%d]: bad ns pattern %q", i, m.NS)
+		}
+		if _, err := ParseRestoreMode(string(m.Mode)); err != nil || m.Mode == "" {
+			return RestoreCmd{}, errors.Errorf("spec.nsModes[%d]: unknown mode %q", i, m.Mode)
+		}
+	}
+	return RestoreCmd{
+		Name:                j.Metadata.Name,
+		BackupName:          s.Backup,
+		CheckGridFS:         s.CheckGridFS,
+		ParallelCollections: s.ParallelCollections,
+		Sessions:            s.Sessions,
+		Mode:                s.Mode,
+		NSModes:             s.NSModes,
+		Transform:           s.Transform,
+	}, nil
+}
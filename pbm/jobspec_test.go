@@ -0,0 +1,31 @@
+package pbm
+
+import "testing"
+
+func TestParseJobSpecNames(t *testing.T) {
+	spec := func(kind, name, backup string) []byte {
+		s := "apiVersion: " + JobSpecAPIVersion + "\nkind: " + kind + "\nmetadata:\n  name: " + name + "\n"
+		if backup != "" {
+			s += "spec:\n  backup: " + backup + "\n"
+		}
+		return []byte(s)
+	}
+
+	cases := []struct {
+		spec []byte
+		ok   bool
+	}{
+		{spec("Backup", "nightly-2020-06-01", ""), true},
+		{spec("Backup", "../../etc", ""), false},
+		{spec("Backup", "a/b", ""), false},
+		{spec("Restore", "r1", "nightly-2020-06-01"), true},
+		{spec("Restore", "r/1", "nightly-2020-06-01"), false},
+		{spec("Restore", "r1", "../nightly"), false},
+	}
+	for _, c := range cases {
+		_, err := ParseJobSpec(c.spec)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got error %v, expected ok %v", c.spec, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package pbm
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MatchLabels returns true if the labels have all key-values of the selector.
+// An empty selector matches any labels.
+func MatchLabels(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelsString returns labels as a sorted `k=v,k=v` list
+func LabelsString(labels map[string]string) string {
+	l := make([]string, 0, len(labels))
+	for k, v := range labels {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// HasLabeledAgent returns true if there is a live agent of the replset
+// which labels match the selector
+func (p *PBM) HasLabeledAgent(rs string, selector map[string]string) (bool, error) {
+	stats, err := p.AgentsStatus()
+	if err != nil {
+		return false, errors.Wrap(err, "get agents status")
+	}
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return false, errors.Wrap(err, "read cluster time")
+	}
+	for _, s := range stats {
+		if s.RS == rs && !s.IsStale(ts) && MatchLabels(selector, s.Labels) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -21,6 +21,35 @@ type LockHeader struct {
 	Replset    string  `bson:"replset,omitempty"`
 	Node       string  `bson:"node,omitempty"`
 	BackupName string  `bson:"backup,omitempty"`
+	// Subset is the replsets the backup is restricted to
+	Subset []string `bson:"subset,omitempty"`
+	// AgentID is the identity of the agent holding the lock
+	AgentID string `bson:"agent,omitempty"`
+}
+
+// Compatible returns true if the operations of the locks may run concurrently.
+// It's either the same operation (on the other replset) or the backups
+// of the disjoint replsets subsets.
+func (l LockHeader) Compatible(o LockHeader) bool {
+	if l.Type == o.Type && l.BackupName == o.BackupName {
+		return true
+	}
+	// the rehearsal works on the sandbox and doesn't touch the cluster
+	if l.Type == CmdRehearse || o.Type == CmdRehearse {
+		return l.Type != o.Type
+	}
+	return l.Type == CmdBackup && o.Type == CmdBackup &&
+		len(l.Subset) > 0 && len(o.Subset) > 0 &&
+		!contains(l.Subset, o.Replset) && !contains(o.Subset, l.Replset)
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
 }
 
 type LockData struct {
@@ -28,6 +57,14 @@ type LockData struct {
 	Heartbeat  primitive.Timestamp `bson:"hb"` // separated in order the lock can be searchable by the header
 }
 
+// RehearsalReplset is the name the rehearsals lock under so they
+// don't take the lock of the leader replset from the cluster operations
+const RehearsalReplset = "rehearsal"
+
+// StorageReplset is the name the removal of the orphaned storage files
+// locks under, it's not bound to any replset
+const StorageReplset = "storage"
+
 // Lock is a lock for the PBM operation (e.g. backup, restore)
 type Lock struct {
 	LockData
@@ -39,6 +76,9 @@ type Lock struct {
 // NewLock creates a new Lock object from geven header. Returned lock has no state.
 // So Acquire() and Release() methods should be called.
 func (p *PBM) NewLock(h LockHeader) *Lock {
+	if h.AgentID == "" {
+		h.AgentID = p.agentID
+	}
 	return &Lock{
 		LockData: LockData{
 			LockHeader: h,
@@ -61,7 +101,40 @@ func (e ErrConcurrentOp) Error() string {
 // lock already acquired by another process or some error happend.
 // In case there is already concurrent lock exists, it checks if the concurrent lock isn't stale
 // and clear the rot and tries again if it's happened to be so.
+//
+// The locks are per replset and the operations are told apart only by
+// the replsets they run on. There is no per-namespace locking, e.g. two
+// restores of the disjoint namespaces can't run concurrently.
 func (l *Lock) Acquire() (bool, error) {
+	// there might be some other operation running on the other replsets
+	// (e.g. restore while we're about to start backup)
+	err := l.checkCluster()
+	if err != nil {
+		return false, err
+	}
+
+	got, err := l.acquireRS()
+	if err != nil || !got {
+		return got, err
+	}
+
+	// the other operation may have taken its lock on the other replset
+	// between the check and the insert. The check is repeated with our
+	// lock in place so at least one of them sees the other and backs off.
+	err = l.checkCluster()
+	if err != nil {
+		rerr := l.Release()
+		if rerr != nil {
+			log.Printf("[ERROR] release the lock of the concurrent operation: %v", rerr)
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// acquireRS acquires the lock of the replset taking over the stale one
+func (l *Lock) acquireRS() (bool, error) {
 	got, err := l.acquire()
 
 	if err != nil {
@@ -84,7 +157,7 @@ func (l *Lock) Acquire() (bool, error) {
 	}
 
 	// peer is alive
-	if peer.Heartbeat.T+StaleFrameSec >= ts.T {
+	if !peer.IsStale(ts) {
 		if l.BackupName != peer.BackupName {
 			return false, ErrConcurrentOp{Lock: peer.LockHeader}
 		}
@@ -96,6 +169,11 @@ func (l *Lock) Acquire() (bool, error) {
 		return false, errors.Wrap(err, "delete stale lock")
 	}
 
+	// the node of the same backup was lost and this one takes over
+	if l.Type == CmdBackup && peer.Type == CmdBackup && l.BackupName == peer.BackupName {
+		return l.acquire()
+	}
+
 	err = l.p.markBcpStale(peer.BackupName)
 	if err != nil {
 		log.Printf("Failed to mark stale backup '%s' as failed: %v", peer.BackupName, err)
@@ -104,6 +182,36 @@ func (l *Lock) Acquire() (bool, error) {
 	return l.acquire()
 }
 
+// checkCluster returns ErrConcurrentOp if there is an alive lock in the cluster
+// that belongs to the other operation. Locks of the same operation
+// (e.g. the same backup on the other replsets) and of the backups of
+// the disjoint replsets subsets are fine.
+func (l *Lock) checkCluster() error {
+	locks, err := l.p.GetLocks(&LockHeader{})
+	if err != nil {
+		return errors.Wrap(err, "get cluster locks")
+	}
+	if len(locks) == 0 {
+		return nil
+	}
+
+	ts, err := l.p.ClusterTime()
+	if err != nil {
+		return errors.Wrap(err, "read cluster time")
+	}
+
+	for _, lk := range locks {
+		if lk.IsStale(ts) {
+			continue
+		}
+		if !l.Compatible(lk.LockHeader) {
+			return ErrConcurrentOp{Lock: lk.LockHeader}
+		}
+	}
+
+	return nil
+}
+
 func (p *PBM) markBcpStale(bcpName string) error {
 	bcp, err := p.GetBackupMeta(bcpName)
 	if err != nil {
@@ -184,6 +292,49 @@ func (l *Lock) beat() error {
 	return errors.Wrap(err, "set timestamp")
 }
 
+// IsStale returns true if the lock's heartbeat is older than StaleFrameSec
+// comparing to the given cluster time
+func (l LockData) IsStale(ts primitive.Timestamp) bool {
+	return l.Heartbeat.T+StaleFrameSec < ts.T
+}
+
+// ErrLockAlive means an attempt to release the lock which is still in use
+var ErrLockAlive = errors.New("lock is alive")
+
+// ReleaseLock deletes the lock matching the given header. Only stale locks
+// can be released unless force is set. Releasing of the backup lock marks
+// the respective backup as failed.
+func (p *PBM) ReleaseLock(lh LockHeader, force bool) error {
+	l, err := p.GetLockData(&lh)
+	if err != nil {
+		return errors.Wrap(err, "get lock")
+	}
+
+	if !force {
+		ts, err := p.ClusterTime()
+		if err != nil {
+			return errors.Wrap(err, "read cluster time")
+		}
+		if !l.IsStale(ts) {
+			return ErrLockAlive
+		}
+	}
+
+	_, err = p.Conn.Database(DB).Collection(LockCollection).DeleteOne(p.ctx, l.LockHeader)
+	if err != nil {
+		return errors.Wrap(err, "delete lock")
+	}
+
+	if l.Type == CmdBackup && l.BackupName != "" {
+		err = p.markBcpStale(l.BackupName)
+		if err != nil {
+			return errors.Wrapf(err, "mark backup '%s' as failed", l.BackupName)
+		}
+	}
+
+	return nil
+}
+
 func (p *PBM) GetLockData(lh *LockHeader) (LockData, error) {
 	var l LockData
 	r := p.Conn.Database(DB).Collection(LockCollection).FindOne(p.ctx, lh)
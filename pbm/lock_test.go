@@ -0,0 +1,35 @@
+package pbm
+
+import "testing"
+
+func TestMongosLockSubsetBackups(t *testing.T) {
+	// two backups of the disjoint subsets served by the same mongos agent
+	b1 := []LockHeader{
+		{Type: CmdBackup, Replset: "rs0", BackupName: "b1", Subset: []string{"rs0"}},
+		{Type: CmdBackup, Replset: MongosLockReplset("b1"), Node: "mongos1", BackupName: "b1", Subset: []string{"rs0"}},
+	}
+	b2 := []LockHeader{
+		{Type: CmdBackup, Replset: "rs1", BackupName: "b2", Subset: []string{"rs1"}},
+		{Type: CmdBackup, Replset: MongosLockReplset("b2"), Node: "mongos1", BackupName: "b2", Subset: []string{"rs1"}},
+	}
+
+	// the locks are unique by the replset
+	if b1[1].Replset == b2[1].Replset {
+		t.Fatalf("the mongos locks of both backups are taken under %s", b1[1].Replset)
+	}
+	for _, l1 := range b1 {
+		for _, l2 := range b2 {
+			if !l1.Compatible(l2) || !l2.Compatible(l1) {
+				t.Errorf("%s of %s conflicts with %s of %s", l1.Replset, l1.BackupName, l2.Replset, l2.BackupName)
+			}
+		}
+	}
+
+	restore := LockHeader{Type: CmdRestore, Replset: MongosLockReplset("r1"), BackupName: "r1"}
+	if restore.Compatible(b1[1]) {
+		t.Error("the restore is compatible with the backup")
+	}
+	if !IsMongosLock(b1[1].Replset) || IsMongosLock("rs0") {
+		t.Error("the mongos locks aren't told from the replset ones")
+	}
+}
@@ -0,0 +1,234 @@
+package pbm
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Severity is the level of the log entry
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityDebug:
+		return "D"
+	case SeverityInfo:
+		return "I"
+	case SeverityWarning:
+		return "W"
+	case SeverityError:
+		return "E"
+	}
+	return "?"
+}
+
+// ParseSeverity returns the severity by its short name (D, I, W, E)
+func ParseSeverity(s string) (Severity, error) {
+	for _, sv := range []Severity{SeverityDebug, SeverityInfo, SeverityWarning, SeverityError} {
+		if sv.String() == s {
+			return sv, nil
+		}
+	}
+	return SeverityDebug, errors.Errorf("unknown severity %s", s)
+}
+
+const (
+	// recentLogSize is how many of the recent entries
+	// of the job the agent keeps in memory
+	recentLogSize = 100
+	// JobLogKeep is how many of the last shipped entries
+	// are kept in the backup metadata
+	JobLogKeep = 100
+)
+
+// LogEntry is the agent-side log line of the job
+type LogEntry struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	// TS is the time of the entry in nanoseconds
+	TS       int64    `bson:"ts" json:"ts"`
+	Severity Severity `bson:"s" json:"s"`
+	Job      string   `bson:"job" json:"job"`
+	Replset  string   `bson:"rs" json:"rs"`
+	Node     string   `bson:"node" json:"node"`
+	Phase    string   `bson:"phase" json:"phase"`
+	Msg      string   `bson:"msg" json:"msg"`
+}
+
+func (e LogEntry) String() string {
+	return fmt.Sprintf("%s %s [%s/%s] [%s] %s",
+		time.Unix(0, e.TS).UTC().Format(time.RFC3339Nano), e.Severity, e.Replset, e.Node, e.Phase, e.Msg)
+}
+
+// JobLogger writes the log lines of the job to the agent's log and to
+// the PBM log collection so they can be read via `pbm logs` (the debug
+// ones are shown with `-s D`) and keeps them in the ring buffer of
+// the recent entries. Warnings and
+// errors are shipped into the backup metadata so they survive the log
+// collection rotation. An error ships the buffered entries preceding it
+// as well to give the context for the post-mortem.
+type JobLogger struct {
+	cn   *PBM
+	job  string
+	rs   string
+	node string
+
+	mu     sync.Mutex
+	recent []recentEntry
+	next   int
+}
+
+type recentEntry struct {
+	LogEntry
+	shipped bool
+}
+
+// NewJobLogger creates the logger of the job's part on the given replset node
+func (p *PBM) NewJobLogger(job, rs, node string) *JobLogger {
+	return &JobLogger{
+		cn:     p,
+		job:    job,
+		rs:     rs,
+		node:   node,
+		recent: make([]recentEntry, 0, recentLogSize),
+	}
+}
+
+// Debugf logs the debug message of the job's phase
+func (l *JobLogger) Debugf(phase, format string, v ...interface{}) {
+	l.output(SeverityDebug, phase, fmt.Sprintf(format, v...))
+}
+
+// Infof logs the message of the job's phase
+func (l *JobLogger) Infof(phase, format string, v ...interface{}) {
+	l.output(SeverityInfo, phase, fmt.Sprintf(format, v...))
+}
+
+// Warningf logs the warning of the job's phase
+func (l *JobLogger) Warningf(phase, format string, v ...interface{}) {
+	l.output(SeverityWarning, phase, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs the error of the job's phase
+func (l *JobLogger) Errorf(phase, format string, v ...interface{}) {
+	l.output(SeverityError, phase, fmt.Sprintf(format, v...))
+}
+
+// Recent returns the buffered recent entries in the chronological order
+func (l *JobLogger) Recent() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ent := make([]LogEntry, 0, len(l.recent))
+	for i := range l.recent {
+		ent = append(ent, l.recent[(l.next+i)%len(l.recent)].LogEntry)
+	}
+	return ent
+}
+
+// output writes the entry. The failure to write it into the db doesn't
+// affect the job and only ends up in the agent's log. Calling it on the
+// nil logger only writes to the agent's log.
+func (l *JobLogger) output(sev Severity, phase, msg string) {
+	if l == nil {
+		log.Printf("%s [%s] %s", sev, phase, msg)
+		return
+	}
+
+	// the agent may serve several nodes
+	log.Printf("%s %s %s/%s [%s] %s", sev, l.job, l.rs, l.node, phase, msg)
+	e := LogEntry{
+		TS:       time.Now().UnixNano(),
+		Severity: sev,
+		Job:      l.job,
+		Replset:  l.rs,
+		Node:     l.node,
+		Phase:    phase,
+		Msg:      msg,
+	}
+
+	ship := l.buffer(e)
+
+	_, err := l.cn.Conn.Database(DB).Collection(LogCollection).InsertOne(l.cn.ctx, e)
+	if err != nil {
+		log.Println("[ERROR] write job log:", err)
+	}
+	if len(ship) > 0 {
+		err := l.cn.AddBackupLogs(l.job, ship)
+		if err != nil {
+			log.Println("[ERROR] ship job log:", err)
+		}
+	}
+}
+
+// buffer puts the entry into the ring buffer and returns
+// the entries which have to be shipped into the backup metadata
+func (l *JobLogger) buffer(e LogEntry) []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	re := recentEntry{LogEntry: e, shipped: e.Severity == SeverityWarning}
+	if len(l.recent) < recentLogSize {
+		l.recent = append(l.recent, re)
+	} else {
+		l.recent[l.next] = re
+		l.next = (l.next + 1) % recentLogSize
+	}
+
+	switch e.Severity {
+	case SeverityWarning:
+		return []LogEntry{e}
+	case SeverityError:
+		var ship []LogEntry
+		for i := range l.recent {
+			r := &l.recent[(l.next+i)%len(l.recent)]
+			if !r.shipped {
+				r.shipped = true
+				ship = append(ship, r.LogEntry)
+			}
+		}
+		return ship
+	}
+	return nil
+}
+
+// AddBackupLogs stores the log entries in the backup metadata
+// keeping only the last JobLogKeep of them
+func (p *PBM) AddBackupLogs(bcpName string, ent []LogEntry) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}},
+		bson.D{{"$push", bson.M{"logs": bson.M{"$each": ent, "$slice": -JobLogKeep}}}},
+	)
+	return errors.Wrap(err, "update backup meta")
+}
+
+// GetLogs returns the log entries of the job written not earlier
+// than `since` (ns) with at least the given severity
+func (p *PBM) GetLogs(job string, since int64, sev Severity) ([]LogEntry, error) {
+	cur, err := p.Conn.Database(DB).Collection(LogCollection).Find(
+		p.ctx,
+		bson.D{{"job", job}, {"ts", bson.D{{"$gte", since}}}, {"s", bson.D{{"$gte", sev}}}},
+		options.Find().SetSort(bson.D{{"ts", 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query logs")
+	}
+
+	logs := []LogEntry{}
+	err = cur.All(p.ctx, &logs)
+	return logs, errors.Wrap(err, "decode logs")
+}
@@ -0,0 +1,99 @@
+package pbm
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Maintenance marks the node which agent is in the maintenance mode.
+// Such agent finishes the operations it runs but isn't a source
+// of the new backups.
+type Maintenance struct {
+	RS     string              `bson:"rs" json:"rs"`
+	Node   string              `bson:"n" json:"node"`
+	Since  primitive.Timestamp `bson:"since" json:"since"`
+	Reason string              `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// SetMaintenance puts the agent of the node into the maintenance mode
+func (p *PBM) SetMaintenance(rs, node, reason string) error {
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return errors.Wrap(err, "read cluster time")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(MaintenanceCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"rs", rs}, {"n", node}},
+		bson.D{
+			{"$set", bson.D{{"reason", reason}}},
+			{"$setOnInsert", bson.D{{"since", ts}}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return errors.Wrap(err, "write into db")
+}
+
+// UnsetMaintenance brings the agent of the node out of the maintenance mode.
+// It returns false if the node wasn't in the maintenance.
+func (p *PBM) UnsetMaintenance(rs, node string) (bool, error) {
+	res, err := p.Conn.Database(DB).Collection(MaintenanceCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"rs", rs}, {"n", node}},
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "delete from db")
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// GetMaintenance returns the maintenance mark of the node and
+// false if the node isn't in the maintenance
+func (p *PBM) GetMaintenance(rs, node string) (Maintenance, bool, error) {
+	m := Maintenance{}
+	res := p.Conn.Database(DB).Collection(MaintenanceCollection).FindOne(p.ctx, bson.D{{"rs", rs}, {"n", node}})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return m, false, nil
+		}
+		return m, false, errors.Wrap(res.Err(), "query mongo")
+	}
+	err := res.Decode(&m)
+	if err != nil {
+		return m, false, errors.Wrap(err, "decode")
+	}
+	return m, true, nil
+}
+
+// Maintenances returns the nodes in the maintenance mode
+func (p *PBM) Maintenances() ([]Maintenance, error) {
+	cur, err := p.Conn.Database(DB).Collection(MaintenanceCollection).Find(
+		p.ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{"rs", 1}, {"n", 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	ms := []Maintenance{}
+	for cur.Next(p.ctx) {
+		m := Maintenance{}
+		err := cur.Decode(&m)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		ms = append(ms, m)
+	}
+	return ms, cur.Err()
+}
+
+// NodeLocks returns the operations locks held by the agent of the node.
+// The node in the maintenance is drained when there are none.
+func (p *PBM) NodeLocks(rs, node string) ([]LockData, error) {
+	return p.GetLocks(&LockHeader{Replset: rs, Node: node})
+}
@@ -0,0 +1,137 @@
+package pbm
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongosReplset is the name the mongos agents report and lock under
+// since mongos isn't a part of any replset
+const MongosReplset = "mongos"
+
+// MongosLockReplset returns the name the mongos agent locks the operation
+// under. The lock is per operation, so the mongos agents serve the
+// concurrent ones (e.g. the backups of the disjoint replsets subsets),
+// and only one of them serves each operation. The balancer is still
+// handled by one of them at a time, see AddBalancerHolder.
+func MongosLockReplset(op string) string {
+	return MongosReplset + "/" + op
+}
+
+// IsMongosLock returns true if the lock of the replset is the mongos agent's one
+func IsMongosLock(rs string) bool {
+	return strings.HasPrefix(rs, MongosReplset+"/")
+}
+
+// HasMongosAgent returns true if there is a live mongos agent in the cluster
+func (p *PBM) HasMongosAgent() (bool, error) {
+	stats, err := p.AgentsStatus()
+	if err != nil {
+		return false, errors.Wrap(err, "get agents status")
+	}
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return false, errors.Wrap(err, "read cluster time")
+	}
+	for _, s := range stats {
+		if s.RS == MongosReplset && !s.IsStale(ts) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsMongos returns true if the node is mongos
+func (im *IsMaster) IsMongos() bool {
+	return im.Msg == "isdbgrid"
+}
+
+// Mongos performs the cluster-level operations via mongos
+type Mongos struct {
+	ctx context.Context
+	cn  *mongo.Client
+}
+
+func NewMongos(ctx context.Context, cn *mongo.Client) *Mongos {
+	return &Mongos{
+		ctx: ctx,
+		cn:  cn,
+	}
+}
+
+// BalancerStatus is the state of the sharded cluster balancer
+type BalancerStatus struct {
+	Mode            string `bson:"mode" json:"mode"`
+	InBalancerRound bool   `bson:"inBalancerRound" json:"inBalancerRound"`
+}
+
+// IsOn returns true if the balancer is enabled
+func (b BalancerStatus) IsOn() bool {
+	return b.Mode == "full"
+}
+
+// ShardedColl is the sharded collection's metadata
+type ShardedColl struct {
+	NS     string `bson:"_id" json:"ns"`
+	Key    bson.D `bson:"key" json:"key"`
+	Unique bool   `bson:"unique" json:"unique"`
+}
+
+// GetIsMaster returns the mongos isMaster data
+func (m *Mongos) GetIsMaster() (*IsMaster, error) {
+	im := &IsMaster{}
+	err := m.cn.Database(DB).RunCommand(m.ctx, bson.D{{"isMaster", 1}}).Decode(im)
+	return im, errors.Wrap(err, "run mongo command isMaster")
+}
+
+// ListShards returns the shards of the cluster
+func (m *Mongos) ListShards() ([]Shard, error) {
+	res := struct {
+		Shards []Shard `bson:"shards"`
+	}{}
+	err := m.cn.Database(DB).RunCommand(m.ctx, bson.D{{"listShards", 1}}).Decode(&res)
+	if err != nil {
+		return nil, errors.Wrap(err, "run mongo command listShards")
+	}
+	return res.Shards, nil
+}
+
+// BalancerStatus returns the current state of the balancer
+func (m *Mongos) BalancerStatus() (*BalancerStatus, error) {
+	s := new(BalancerStatus)
+	err := m.cn.Database(DB).RunCommand(m.ctx, bson.D{{"balancerStatus", 1}}).Decode(s)
+	return s, errors.Wrap(err, "run mongo command balancerStatus")
+}
+
+// BalancerStop disables the balancer and waits up to
+// `timeout` for the current balancing round to finish
+func (m *Mongos) BalancerStop(timeout time.Duration) error {
+	err := m.cn.Database(DB).RunCommand(m.ctx, bson.D{
+		{"balancerStop", 1},
+		{"maxTimeMS", int64(timeout / time.Millisecond)},
+	}).Err()
+	return errors.Wrap(err, "run mongo command balancerStop")
+}
+
+// BalancerStart enables the balancer
+func (m *Mongos) BalancerStart() error {
+	err := m.cn.Database(DB).RunCommand(m.ctx, bson.D{{"balancerStart", 1}}).Err()
+	return errors.Wrap(err, "run mongo command balancerStart")
+}
+
+// ShardedCollections returns the metadata of the sharded collections
+func (m *Mongos) ShardedCollections() ([]ShardedColl, error) {
+	cur, err := m.cn.Database("config").Collection("collections").Find(m.ctx, bson.D{{"dropped", bson.D{{"$ne", true}}}})
+	if err != nil {
+		return nil, errors.Wrap(err, "query config.collections")
+	}
+
+	colls := []ShardedColl{}
+	err = cur.All(m.ctx, &colls)
+	return colls, errors.Wrap(err, "decode config.collections")
+}
@@ -0,0 +1,102 @@
+package pbm
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBackupNameTemplate is the backup name template
+// used when neither the name nor the config template is set
+const DefaultBackupNameTemplate = "{time}"
+
+// the name is used as the prefix of the storage files
+var validBackupName = regexp.MustCompile(`^[a-zA-Z0-9_:+-][a-zA-Z0-9_.:+-]*$`)
+
+var namePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// ValidateBackupName checks if the name can be used as the backup name
+func ValidateBackupName(name string) error {
+	if !validBackupName.MatchString(name) || strings.Contains(name, "..") {
+		return errors.Errorf("invalid backup name %q: only letters, digits and _.:+- are allowed", name)
+	}
+	return nil
+}
+
+// NewBackupName renders the backup name template. {cluster} is replaced with
+// the replset name of the PBM control collections, {date} with the current
+// date (YYYYMMDD), {time} with the current time (RFC3339) and {seq} with the
+// lowest number which makes the name unique.
+// With `unique` the name which is already taken gets the "-N" suffix.
+// Otherwise it's up to the caller to decide what to do with the existing backup.
+func (p *PBM) NewBackupName(tmpl string, now time.Time, unique bool) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultBackupNameTemplate
+	}
+	now = now.UTC()
+
+	var err error
+	cluster := ""
+	name := namePlaceholder.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		switch ph {
+		case "{cluster}":
+			if cluster == "" {
+				im, ierr := p.GetIsMaster()
+				if ierr != nil {
+					err = errors.Wrap(ierr, "get cluster name")
+					return ""
+				}
+				cluster = im.SetName
+				if cluster == "" {
+					cluster = NoReplset
+				}
+			}
+			return cluster
+		case "{date}":
+			return now.Format("20060102")
+		case "{time}":
+			return now.Format(time.RFC3339)
+		case "{seq}":
+			return ph
+		default:
+			err = errors.Errorf("unknown placeholder %s in the backup name template", ph)
+			return ""
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	seq := strings.Contains(name, "{seq}")
+	if !seq && !unique {
+		return name, ValidateBackupName(name)
+	}
+
+	for i := 1; ; i++ {
+		n := name
+		switch {
+		case seq:
+			n = strings.Replace(name, "{seq}", strconv.Itoa(i), -1)
+		case i > 1:
+			n = name + "-" + strconv.Itoa(i)
+		}
+		if err := ValidateBackupName(n); err != nil {
+			return "", err
+		}
+
+		bmeta, err := p.GetBackupMeta(n)
+		if err != nil {
+			return "", errors.Wrapf(err, "check backup %s", n)
+		}
+		qpos, err := p.QueuePosition(n)
+		if err != nil {
+			return "", errors.Wrapf(err, "check queued backup %s", n)
+		}
+		if bmeta.Name == "" && qpos == 0 {
+			return n, nil
+		}
+	}
+}
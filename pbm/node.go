@@ -2,10 +2,16 @@ package pbm
 
 import (
 	"context"
+	"encoding/hex"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Node struct {
@@ -125,6 +131,306 @@ func (n *Node) ReplicationLag() (int, error) {
 	return primaryOptime - nodeOptime, nil
 }
 
+// Delay returns the delay (sec) of the node if it's the delayed member, 0 otherwise
+func (n *Node) Delay() (int64, error) {
+	cfg, err := n.GetReplsetConfig()
+	if err != nil {
+		return 0, errors.Wrap(err, "get replset config")
+	}
+	name, err := n.Name()
+	if err != nil {
+		return 0, errors.Wrap(err, "get node name")
+	}
+	for _, m := range cfg.Members {
+		if m.Host == name {
+			return m.SlaveDelay, nil
+		}
+	}
+	return 0, nil
+}
+
+// ConnectPrimary connects to the primary of the node's replset. The
+// connection follows the primary if it changes. The caller should
+// disconnect it once done.
+func (n *Node) ConnectPrimary(appName string) (*Node, error) {
+	im, err := n.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get isMaster")
+	}
+	cn, err := mongo.NewClient(options.Client().ApplyURI(n.curi).SetAppName(appName).SetReplicaSet(im.SetName).SetDirect(false))
+	if err != nil {
+		return nil, errors.Wrap(err, "create client")
+	}
+	err = cn.Connect(n.ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect")
+	}
+	err = cn.Ping(n.ctx, readpref.Primary())
+	if err != nil {
+		cn.Disconnect(n.ctx)
+		return nil, errors.Wrap(err, "ping primary")
+	}
+	return NewNode(n.ctx, n.name, cn, n.curi), nil
+}
+
+// SecondariesLag returns the max replication lag in seconds of the
+// healthy secondaries behind the primary. The delayed member's lag is
+// counted over its delay.
+func (n *Node) SecondariesLag() (int, error) {
+	s, err := n.GetReplsetStatus()
+	if err != nil {
+		return -1, errors.Wrap(err, "get replset status")
+	}
+	cfg, err := n.GetReplsetConfig()
+	if err != nil {
+		return -1, errors.Wrap(err, "get replset config")
+	}
+	delay := make(map[string]int64, len(cfg.Members))
+	for _, m := range cfg.Members {
+		delay[m.Host] = m.SlaveDelay
+	}
+
+	var primary int64
+	for _, m := range s.Members {
+		if m.StateStr == "PRIMARY" && m.Optime != nil {
+			primary = int64(m.Optime.TS.T)
+		}
+	}
+	lag := 0
+	for _, m := range s.Members {
+		if m.StateStr != "SECONDARY" || m.Health != NodeHealthUp || m.Optime == nil {
+			continue
+		}
+		if l := int(primary - int64(m.Optime.TS.T) - delay[m.Name]); l > lag {
+			lag = l
+		}
+	}
+	return lag, nil
+}
+
+// Namespaces returns the list of the node's collections (except the `local` db)
+// in the `db.collection` format
+func (n *Node) Namespaces() ([]string, error) {
+	colls, err := n.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	nss := make([]string, 0, len(colls))
+	for _, c := range colls {
+		nss = append(nss, c.NS)
+	}
+
+	return nss, nil
+}
+
+// Collections returns namespaces, UUIDs and stats of the node's collections
+// (except the `local` db). Views and collections on versions prior
+// to 3.6 have no UUID. Stats are approximate as reported by collStats.
+func (n *Node) Collections() ([]NSInfo, error) {
+	dbs, err := n.cn.ListDatabaseNames(n.ctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "list databases")
+	}
+
+	var colls []NSInfo
+	for _, db := range dbs {
+		if db == "local" {
+			continue
+		}
+		cur, err := n.cn.Database(db).ListCollections(n.ctx, bson.D{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "list collections of %s", db)
+		}
+		var dbColls []NSInfo
+		for cur.Next(n.ctx) {
+			c := struct {
+				Name string `bson:"name"`
+				Type string `bson:"type"`
+				Info struct {
+					UUID primitive.Binary `bson:"uuid"`
+				} `bson:"info"`
+				Options struct {
+					Capped bool  `bson:"capped"`
+					Size   int64 `bson:"size"`
+					Max    int64 `bson:"max"`
+				} `bson:"options"`
+			}{}
+			err := cur.Decode(&c)
+			if err != nil {
+				cur.Close(n.ctx)
+				return nil, errors.Wrapf(err, "decode collection info of %s", db)
+			}
+			dbColls = append(dbColls, NSInfo{
+				NS:   db + "." + c.Name,
+				UUID: hex.EncodeToString(c.Info.UUID.Data),
+				View: c.Type == "view",
+
+				Capped:     c.Options.Capped,
+				CappedSize: c.Options.Size,
+				CappedMax:  c.Options.Max,
+			})
+		}
+		err = cur.Err()
+		cur.Close(n.ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list collections of %s", db)
+		}
+
+		for i, c := range dbColls {
+			if c.View {
+				continue
+			}
+			stat := struct {
+				Count int64 `bson:"count"`
+				Size  int64 `bson:"size"`
+			}{}
+			err := n.cn.Database(db).RunCommand(n.ctx, bson.D{{"collStats", c.NS[len(db)+1:]}}).Decode(&stat)
+			if err != nil {
+				// stats are informational only
+				continue
+			}
+			dbColls[i].Count = stat.Count
+			dbColls[i].Size = stat.Size
+		}
+		colls = append(colls, dbColls...)
+	}
+
+	return colls, nil
+}
+
+// FirstRecord returns the first document of the collection in the natural order
+// or nil if the collection is empty
+func (n *Node) FirstRecord(ns string) (bson.Raw, error) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return nil, errors.Errorf("bad namespace %s", ns)
+	}
+	r, err := n.cn.Database(ns[:i]).Collection(ns[i+1:]).FindOne(n.ctx,
+		bson.D{},
+		options.FindOne().SetSort(bson.D{{"$natural", 1}}),
+	).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return r, err
+}
+
+// OplogMaxSize returns the max size of the replset node's oplog
+func (n *Node) OplogMaxSize() (int64, error) {
+	stat := struct {
+		MaxSize int64 `bson:"maxSize"`
+	}{}
+	err := n.cn.Database("local").RunCommand(n.ctx, bson.D{{"collStats", "oplog.rs"}}).Decode(&stat)
+	return stat.MaxSize, errors.Wrap(err, "get oplog stats")
+}
+
+// DBPath returns the data directory of the mongod
+func (n *Node) DBPath() (string, error) {
+	opts := struct {
+		Parsed struct {
+			Storage struct {
+				DBPath string `bson:"dbPath"`
+			} `bson:"storage"`
+		} `bson:"parsed"`
+	}{}
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"getCmdLineOpts", 1}}).Decode(&opts)
+	if err != nil {
+		return "", errors.Wrap(err, "run mongo command getCmdLineOpts")
+	}
+
+	if opts.Parsed.Storage.DBPath == "" {
+		return defaultDBPath, nil
+	}
+	return opts.Parsed.Storage.DBPath, nil
+}
+
+const defaultDBPath = "/data/db"
+
+// GetReplsetConfig returns the current replica set configuration
+func (n *Node) GetReplsetConfig() (*RSConfig, error) {
+	res := struct {
+		Config RSConfig `bson:"config"`
+	}{}
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"replSetGetConfig", 1}}).Decode(&res)
+	if err != nil {
+		return nil, errors.Wrap(err, "run mongo command replSetGetConfig")
+	}
+	return &res.Config, nil
+}
+
+// ReplsetInitiate initiates a new replica set with the given config
+func (n *Node) ReplsetInitiate(cfg RSConfig) error {
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"replSetInitiate", cfg}}).Err()
+	return errors.Wrap(err, "run mongo command replSetInitiate")
+}
+
+// ReplsetReconfig applies the given replica set config.
+// The config version is expected to be already bumped by the caller.
+func (n *Node) ReplsetReconfig(cfg RSConfig) error {
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"replSetReconfig", cfg}}).Err()
+	return errors.Wrap(err, "run mongo command replSetReconfig")
+}
+
+// WaitForPrimary waits until the node becomes the primary
+func (n *Node) WaitForPrimary(timeout time.Duration) error {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+	tout := time.After(timeout)
+	for {
+		select {
+		case <-tk.C:
+			im, err := n.GetIsMaster()
+			if err != nil {
+				return errors.Wrap(err, "get isMaster")
+			}
+			if im.IsMaster && im.SetName != "" {
+				return nil
+			}
+		case <-tout:
+			return errors.Errorf("node hasn't become a primary in %v", timeout)
+		}
+	}
+}
+
+// AppendOplogNote writes the no-op entry with the given data into the
+// oplog. The node has to be the primary.
+func (n *Node) AppendOplogNote(data interface{}) error {
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"appendOplogNote", 1}, {"data", data}}).Err()
+	return errors.Wrap(err, "run mongo command appendOplogNote")
+}
+
+// FsyncLock flushes all pending writes to the disk and locks the node against writes
+func (n *Node) FsyncLock() error {
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"fsync", 1}, {"lock", true}}).Err()
+	return errors.Wrap(err, "run mongo command fsync lock")
+}
+
+// FsyncUnlock releases the lock taken by FsyncLock.
+// It returns the number of the locks still held on the node.
+func (n *Node) FsyncUnlock() (int, error) {
+	res := struct {
+		LockCount int `bson:"lockCount"`
+	}{}
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"fsyncUnlock", 1}}).Decode(&res)
+	if err != nil {
+		return 0, errors.Wrap(err, "run mongo command fsyncUnlock")
+	}
+	return res.LockCount, nil
+}
+
+// IsFsyncLocked returns true if the node is locked against writes by fsync
+func (n *Node) IsFsyncLocked() (bool, error) {
+	res := struct {
+		FsyncLock bool `bson:"fsyncLock"`
+	}{}
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"currentOp", 1}, {"active", true}}).Decode(&res)
+	if err != nil {
+		return false, errors.Wrap(err, "run mongo command currentOp")
+	}
+	return res.FsyncLock, nil
+}
+
 func (n *Node) ConnURI() string {
 	return n.curi
 }
@@ -132,3 +438,8 @@ func (n *Node) ConnURI() string {
 func (n *Node) Session() *mongo.Client {
 	return n.cn
 }
+
+// Context returns the node's context
+func (n *Node) Context() context.Context {
+	return n.ctx
+}
@@ -0,0 +1,174 @@
+package pbm
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxPageLimit is the max number of the items returned at once
+const MaxPageLimit = 1000
+
+// Page is the window of the list: up to Limit items after the Skip ones
+// in the order of the Sort field. The "-" prefix of the field means the
+// descending order. Limit 0 means no limit.
+type Page struct {
+	Skip  int64
+	Limit int64
+	Sort  string
+}
+
+// options returns the find options of the page. `fields` maps the names
+// allowed to sort by to the documents' fields, `dflt` is the default order.
+// The ties are broken by the default order.
+func (pg Page) options(fields map[string]string, dflt bson.D) (*options.FindOptions, error) {
+	if pg.Skip < 0 || pg.Limit < 0 {
+		return nil, errors.New("skip and limit can't be negative")
+	}
+
+	order := dflt
+	if pg.Sort != "" {
+		name := strings.TrimPrefix(pg.Sort, "-")
+		f, ok := fields[name]
+		if !ok {
+			allowed := make([]string, 0, len(fields))
+			for k := range fields {
+				allowed = append(allowed, k)
+			}
+			sort.Strings(allowed)
+			return nil, errors.Errorf("unknown sort field %q, allowed: %s", name, strings.Join(allowed, ", "))
+		}
+		dir := 1
+		if strings.HasPrefix(pg.Sort, "-") {
+			dir = -1
+		}
+		order = bson.D{{f, dir}}
+		for _, e := range dflt {
+			if e.Key != f {
+				order = append(order, e)
+			}
+		}
+	}
+
+	return options.Find().SetSkip(pg.Skip).SetLimit(pg.Limit).SetSort(order), nil
+}
+
+var backupSortFields = map[string]string{
+	"name":   "name",
+	"start":  "start_ts",
+	"status": "status",
+	"type":   "type",
+}
+
+// FindBackupsPage returns the page of the backups matching the filter
+// (the latest first by default) and the total number of the matching ones
+func (p *PBM) FindBackupsPage(f BackupFilter, pg Page) ([]BackupMeta, int64, error) {
+	opts, err := pg.options(backupSortFields, bson.D{{"start_ts", -1}, {"name", 1}})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c := p.Conn.Database(DB).Collection(BcpCollection)
+	total, err := c.CountDocuments(p.ctx, f.query())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "count backups")
+	}
+
+	cur, err := c.Find(p.ctx, f.query(), opts)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	backups := []BackupMeta{}
+	for cur.Next(p.ctx) {
+		b := BackupMeta{}
+		err := cur.Decode(&b)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "message decode")
+		}
+		backups = append(backups, b)
+	}
+
+	return backups, total, cur.Err()
+}
+
+// AgentFilter is the filter of the agents list
+type AgentFilter struct {
+	Replset string
+	Node    string
+	// Labels the agent has to have all of
+	Labels map[string]string
+	// Lost, if set, selects only the agents which do or don't
+	// send the heartbeats as of the given cluster time
+	Lost *bool
+	Now  primitive.Timestamp
+}
+
+func (f AgentFilter) query() bson.D {
+	q := bson.D{}
+	if f.Replset != "" {
+		q = append(q, bson.E{"rs", f.Replset})
+	}
+	if f.Node != "" {
+		q = append(q, bson.E{"n", f.Node})
+	}
+	for k, v := range f.Labels {
+		q = append(q, bson.E{"labels." + k, v})
+	}
+	if f.Lost != nil {
+		alive := primitive.Timestamp{T: f.Now.T - StaleFrameSec}
+		op := "$gte"
+		if *f.Lost {
+			op = "$lt"
+		}
+		q = append(q, bson.E{"hb", bson.D{{op, alive}}})
+	}
+	return q
+}
+
+var agentSortFields = map[string]string{
+	"replset": "rs",
+	"node":    "n",
+	"lag":     "replLag",
+	"disk":    "diskFree",
+	"hb":      "hb",
+}
+
+// AgentsStatusPage returns the page of the agents' statuses matching the filter
+// (ordered by the replset and the node by default) and the total number
+// of the matching ones
+func (p *PBM) AgentsStatusPage(f AgentFilter, pg Page) ([]AgentStat, int64, error) {
+	opts, err := pg.options(agentSortFields, bson.D{{"rs", 1}, {"n", 1}})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c := p.Conn.Database(DB).Collection(AgentsStatusCollection)
+	total, err := c.CountDocuments(p.ctx, f.query())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "count agents")
+	}
+
+	cur, err := c.Find(p.ctx, f.query(), opts)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	stats := []AgentStat{}
+	for cur.Next(p.ctx) {
+		s := AgentStat{}
+		err := cur.Decode(&s)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "message decode")
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, total, cur.Err()
+}
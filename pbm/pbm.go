@@ -3,6 +3,7 @@ package pbm
 import (
 	"context"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +15,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"github.com/percona/percona-backup-mongodb/pbm/fault"
 )
 
 const (
@@ -34,6 +37,36 @@ const (
 	RestoresCollection = "pbmRestores"
 	// CmdStreamCollection is the name of the mongo collection that contains backup/restore commands stream
 	CmdStreamCollection = "pbmCmd"
+	// AgentsStatusCollection is the collection where agents report its state (heartbeats)
+	AgentsStatusCollection = "pbmAgents"
+	// FsyncLockCollection keeps track of the nodes locked by the
+	// backup so the lock can be released if the agent has died
+	FsyncLockCollection = "pbmFsyncLock"
+	// BalancerHoldCollection keeps track of the operations holding
+	// the balancer stopped, so the last one to finish puts it back
+	BalancerHoldCollection = "pbmBalancerHold"
+	// TraceCollection is the collection for the trace spans of the backups and restores
+	TraceCollection = "pbmTraces"
+	// QueueCollection keeps the jobs waiting for the running operations to finish
+	QueueCollection = "pbmQueue"
+	// RehearsalCollection is a collection for the restore rehearsals results
+	RehearsalCollection = "pbmRehearsals"
+	// VerifyCollection is a collection for the backup verifications results
+	VerifyCollection = "pbmVerifications"
+	// MaintenanceCollection keeps the nodes which agents are in the maintenance mode
+	MaintenanceCollection = "pbmMaintenance"
+	// ApprovalCollection keeps the restores and deletes requests waiting
+	// for the approval and the decisions made on them
+	ApprovalCollection = "pbmApprovals"
+	// IdempotencyCollection keeps the idempotency keys of the calls
+	// which have started the backups and restores
+	IdempotencyCollection = "pbmIdempotency"
+	// RequestsCollection keeps the recent requests accounted by the rate limits
+	RequestsCollection = "pbmRequests"
+	// AgentTokensCollection keeps the hashes of the agents registration
+	// tokens. It's apart from the config so the write on it may be
+	// granted only to the users who provision the agents.
+	AgentTokensCollection = "pbmAgentTokens"
 )
 
 const (
@@ -48,24 +81,239 @@ const (
 	CmdBackup                   = "backup"
 	CmdRestore                  = "restore"
 	CmdResyncBackupList         = "resyncBcpList"
+	CmdDeleteBackup             = "deleteBackup"
+	CmdBackupRetention          = "backupRetention"
+	CmdRehearse                 = "rehearse"
+	CmdVerify                   = "verify"
+	// CmdCleanupStorage isn't sent to the agents, it's the type
+	// of the lock the orphaned files are removed under
+	CmdCleanupStorage = "cleanupStorage"
 )
 
 type Cmd struct {
-	Cmd     Command    `bson:"cmd"`
-	Backup  BackupCmd  `bson:"backup,omitempty"`
-	Restore RestoreCmd `bson:"restore,omitempty"`
-	TS      int64      `bson:"ts"`
+	// ID is the ID of the command in the stream, it's unique for every sent one
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Cmd       Command            `bson:"cmd"`
+	Backup    BackupCmd          `bson:"backup,omitempty"`
+	Restore   RestoreCmd         `bson:"restore,omitempty"`
+	Delete    DeleteBackupCmd    `bson:"delete,omitempty"`
+	Retention RetentionCmd       `bson:"retention,omitempty"`
+	Rehearsal RehearsalCmd       `bson:"rehearsal,omitempty"`
+	Verify    VerifyCmd          `bson:"verify,omitempty"`
+	TS        int64              `bson:"ts"`
+	// IdempotencyKey is the key of the call which has sent the backup or
+	// the restore. The agents run only the first command with the key.
+	IdempotencyKey string `bson:"idempotencyKey,omitempty"`
+	// User is the user who has sent the command, the rate limits are
+	// accounted for it. It's written by the client and is trusted as is.
+	User string `bson:"user,omitempty"`
+}
+
+// JobName returns the ID of the job of the command: the backup, the
+// restore, the rehearsal or the verification name, delete-<backup>
+// (delete-expired) for the delete and retention-<backup> for the retention
+func (c Cmd) JobName() string {
+	switch c.Cmd {
+	case CmdBackup:
+		return c.Backup.Name
+	case CmdRestore:
+		return c.Restore.Name
+	case CmdRehearse:
+		return c.Rehearsal.Name
+	case CmdVerify:
+		return c.Verify.Name
+	case CmdDeleteBackup:
+		if c.Delete.Expired {
+			return "delete-expired"
+		}
+		return "delete-" + c.Delete.Backup
+	case CmdBackupRetention:
+		return "retention-" + c.Retention.Backup
+	}
+	return string(c.Cmd)
 }
 
 type BackupCmd struct {
 	Name        string          `bson:"name"`
 	Compression CompressionType `bson:"compression"`
 	StoreName   string          `bson:"store,omitempty"`
+	// RetryOf is the name of the failed backup which is restarted by this command
+	RetryOf string `bson:"retryOf,omitempty"`
+	// Attempt is the number of the restart
+	Attempt int `bson:"attempt,omitempty"`
+	// IgnoreWindow allows to run backup out of the backup window
+	IgnoreWindow bool `bson:"ignoreWindow,omitempty"`
+	// TimeoutSec overrides the backup timeout from the config
+	TimeoutSec int `bson:"timeoutSec,omitempty"`
+	// Type is the backup type, full by default
+	Type BackupType `bson:"type,omitempty"`
+	// Base is the full backup which the differential backup is made against
+	Base string `bson:"base,omitempty"`
+	// ExpireAt is the unix time until which the backup can't be deleted
+	ExpireAt  int64 `bson:"expireAt,omitempty"`
+	LegalHold bool  `bson:"legalHold,omitempty"`
+	// CheckGridFS enables the GridFS buckets integrity check
+	CheckGridFS bool `bson:"checkGridFS,omitempty"`
+	// FsyncLock makes the dump consistent by locking the node against
+	// writes for its time instead of relying on the oplog. It allows
+	// to back up a standalone node.
+	FsyncLock bool `bson:"fsyncLock,omitempty"`
+	// Selector restricts the nodes the backup is made from
+	// to the ones which agent labels match it
+	Selector map[string]string `bson:"selector,omitempty"`
+	// Replsets restricts the backup to the given replsets (shards).
+	// Backups of the disjoint subsets may run concurrently.
+	Replsets []string `bson:"replsets,omitempty"`
+	// Trace is the context of the dispatching span
+	Trace TraceContext `bson:"trace,omitempty"`
+	// Tags are the arbitrary user's labels of the backup (e.g. reason=pre-upgrade)
+	Tags map[string]string `bson:"tags,omitempty"`
+	// Profile overrides the backup resources profile from the config
+	Profile Profile `bson:"profile,omitempty"`
+	// AdaptiveCompression samples the collections before the dump and
+	// doesn't compress the dump which data turns out incompressible
+	AdaptiveCompression bool `bson:"adaptiveCompression,omitempty"`
+	// MinCollSize and MaxCollSize (bytes) skip the collections of the
+	// smaller and the bigger size respectively. Zero means no limit.
+	MinCollSize int64 `bson:"minCollSize,omitempty"`
+	MaxCollSize int64 `bson:"maxCollSize,omitempty"`
+	// ParallelCollections is the number of the collections dumped
+	// concurrently, the largest ones go first
+	ParallelCollections int `bson:"parallelCollections,omitempty"`
+	// OplogFrom and OplogUntil are the window of the oplog-only backup.
+	// Zero OplogUntil means the cluster last write at the backup time.
+	OplogFrom  primitive.Timestamp `bson:"oplogFrom,omitempty"`
+	OplogUntil primitive.Timestamp `bson:"oplogUntil,omitempty"`
+	// Replaces is the name of the existing backup which is deleted once
+	// this one is done, and this one takes its name. Until then the
+	// backup runs under the staged name (`Name`).
+	Replaces string `bson:"replaces,omitempty"`
+}
+
+// MaxSwitchovers is the number of times the replset's backup is switched
+// to another node when the node is lost, unless the retries allow more
+const MaxSwitchovers = 2
+
+// RetryAllowed returns true if the failed replset's backup can be taken
+// over by another node. The backup of the lost node is switched over
+// whatever the failure policy is.
+func (b *BackupMeta) RetryAllowed(rs BackupReplset) bool {
+	if rs.Lost {
+		return rs.Attempts < MaxSwitchovers || rs.Attempts < b.Retries
+	}
+	return b.FailurePolicy == FailurePolicyRetry && rs.Attempts < b.Retries
 }
 
+// DumpDone returns true if the replset has reached StatusDumpDone,
+// even though it might have failed after
+func (r BackupReplset) DumpDone() bool {
+	for _, c := range r.Conditions {
+		if c.Status == StatusDumpDone {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes returns true if the replset takes part in the backup
+func (b BackupCmd) Includes(rs string) bool {
+	return len(b.Replsets) == 0 || contains(b.Replsets, rs)
+}
+
+// IsLeader returns true if the node's replset leads the backup. The backup
+// of the replsets subset is led by the first replset of the subset, the
+// backup of the whole cluster - by the config server (or the only replset).
+func (b BackupCmd) IsLeader(im *IsMaster) bool {
+	if len(b.Replsets) == 0 {
+		return im.IsLeader()
+	}
+	return im.SetName == b.Replsets[0]
+}
+
+// BackupType is the type of the backup
+type BackupType string
+
+const (
+	// BackupTypeFull captures all data (default)
+	BackupTypeFull BackupType = "full"
+	// BackupTypeDifferential captures only collections which have
+	// changed since the base full backup
+	BackupTypeDifferential = "differential"
+	// BackupTypeSchema captures the collections with their options and
+	// indexes, users and roles and the sharding metadata but no documents
+	BackupTypeSchema BackupType = "schema"
+	// BackupTypeOplog captures only the oplog over the requested window
+	// to replay it over the data restored by other means
+	BackupTypeOplog BackupType = "oplog"
+)
+
 type RestoreCmd struct {
-	Name       string `bson:"name"`
-	BackupName string `bson:"backupName"`
+	Name       string           `bson:"name"`
+	BackupName string           `bson:"backupName"`
+	Transform  []TransformRule  `bson:"transform,omitempty"`
+	Plugin     *TransformPlugin `bson:"plugin,omitempty"`
+	// CheckGridFS enables the GridFS buckets integrity
+	// (including md5) check after the restore
+	CheckGridFS bool `bson:"checkGridFS,omitempty"`
+	// Trace is the context of the dispatching span
+	Trace TraceContext `bson:"trace,omitempty"`
+	// Approval is the ID of the approved request of the restore
+	Approval string `bson:"approval,omitempty"`
+	// ParallelCollections is the number of the dumps of the replset and the
+	// collections of each dump restored concurrently, the biggest ones first
+	ParallelCollections int `bson:"parallelCollections,omitempty"`
+	// External is the restore over the data restored from an external
+	// snapshot, no backup is restored but the oplog slices are replayed
+	External *ExternalRestore `bson:"external,omitempty"`
+	// Sessions restores the sessions records (config.transactions) if the
+	// backup has them, so the writes retried by the clients after the
+	// restore aren't applied twice
+	Sessions bool `bson:"sessions,omitempty"`
+	// Mode is how the restored collections are put over the existing
+	// ones, the drop mode by default
+	Mode RestoreMode `bson:"mode,omitempty"`
+	// NSModes override the mode of the matching namespaces, the first match wins
+	NSModes []NSRestoreMode `bson:"nsModes,omitempty"`
+
+	// Safety asks for the safety backup before the restore. The restore
+	// which needs the approval gets it once approved, so it isn't stale
+	// by the start.
+	Safety bool `bson:"safety,omitempty"`
+	// SafetyBackup is the backup of the cluster taken right before the
+	// restore, so the cluster can be rolled back to it
+	SafetyBackup string `bson:"safetyBackup,omitempty"`
+}
+
+// ExternalRestore is the replay of the backups oplog slices
+// over the data restored from an external snapshot
+type ExternalRestore struct {
+	// SnapshotTS is the cluster time the snapshot is consistent as of
+	SnapshotTS primitive.Timestamp `bson:"snapshotTS"`
+	// Until is the point the oplog is replayed up to
+	Until primitive.Timestamp `bson:"until"`
+	// Slices are the oplog slices to replay in order
+	Slices []OplogSlice `bson:"slices"`
+}
+
+// OplogSlice is the replset's oplog slice of the backup
+type OplogSlice struct {
+	Replset string              `bson:"replset"`
+	Backup  string              `bson:"backup"`
+	First   primitive.Timestamp `bson:"first"`
+	Last    primitive.Timestamp `bson:"last"`
+}
+
+// Backups returns the distinct backups which oplog slices are replayed
+func (e *ExternalRestore) Backups() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range e.Slices {
+		if !seen[s.Backup] {
+			seen[s.Backup] = true
+			names = append(names, s.Backup)
+		}
+	}
+	return names
 }
 
 type CompressionType string
@@ -82,13 +330,15 @@ var WaitActionStart = time.Second * 15
 type PBM struct {
 	Conn *mongo.Client
 	ctx  context.Context
+	// agentID is the identity of the agent the connection belongs to
+	agentID string
 }
 
 // New creates a new PBM object.
 // In the sharded cluster both agents and ctls should have a connection to ConfigServer replica set in order to communicate via PBM collections.
 // If agent's or ctl's local node is not a member of CongigServer, after discovering current topology connection will be established to ConfigServer.
 func New(ctx context.Context, uri, appName string) (*PBM, error) {
-	uri = "mongodb://" + strings.Replace(uri, "mongodb://", "", 1)
+	uri = NormalizeURI(uri)
 
 	client, err := connect(ctx, uri, "pbm-discovery")
 	if err != nil {
@@ -124,6 +374,12 @@ func New(ctx context.Context, uri, appName string) (*PBM, error) {
 		return nil, errors.Wrapf(err, "define config server connetion URI from %s", csvr.URI)
 	}
 
+	// the hosts of the config server replace the SRV ones, the options
+	// of the TXT record (e.g. authSource) are still needed
+	uri, err = ResolveURI(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve mongo-uri")
+	}
 	curi, err := url.Parse(uri)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parse mongo-uri '%s'", uri)
@@ -142,6 +398,18 @@ func New(ctx context.Context, uri, appName string) (*PBM, error) {
 	return pbm, errors.Wrap(pbm.setupNewDB(), "setup a new backups db")
 }
 
+// NewDirect creates a new PBM object connected to the given node only.
+// Unlike New it neither switches to the ConfigServer nor sets up the PBM
+// collections, so nothing is written on connect. It's for the offline
+// operations when there is no cluster around the node.
+func NewDirect(ctx context.Context, uri, appName string) (*PBM, error) {
+	client, err := connect(ctx, NormalizeURI(uri), appName)
+	if err != nil {
+		return nil, errors.Wrap(err, "create mongo connection")
+	}
+	return &PBM{Conn: client, ctx: ctx}, nil
+}
+
 // setup a new DB for PBM
 func (p *PBM) setupNewDB() error {
 	err := p.Conn.Database(DB).RunCommand(
@@ -160,6 +428,86 @@ func (p *PBM) setupNewDB() error {
 		return errors.Wrap(err, "ensure lock collection")
 	}
 
+	// the logs of the jobs are kept until they are pushed out by the newer ones
+	err = p.Conn.Database(DB).RunCommand(
+		p.ctx,
+		bson.D{{"create", LogCollection}, {"capped", true}, {"size", 1 << 20 * 50}},
+	).Err()
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure log collection")
+	}
+	_, err = p.Conn.Database(DB).Collection(LogCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys: bson.D{{"job", 1}, {"ts", 1}},
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure log index")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(TraceCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys: bson.D{{"trace_id", 1}},
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure trace index")
+	}
+	_, err = p.Conn.Database(DB).Collection(TraceCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{"createdAt", 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(TraceTTL.Seconds())),
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure trace expiration index")
+	}
+
+	// the queue used to keep only the backups, by their name
+	err = p.migrateQueue()
+	if err != nil {
+		return errors.Wrap(err, "migrate queued backups")
+	}
+	_, err = p.Conn.Database(DB).Collection(QueueCollection).Indexes().DropOne(p.ctx, "backup.name_1")
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return errors.Wrap(err, "drop old queue index")
+	}
+	_, err = p.Conn.Database(DB).Collection(QueueCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{"name", 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure queue index")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(IdempotencyCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{"createdAt", 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(IdempotencyKeyTTL.Seconds())),
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure idempotency keys index")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(RequestsCollection).Indexes().CreateOne(
+		p.ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{"ts", 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(MaxRatePeriod.Seconds())),
+		},
+	)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrap(err, "ensure requests index")
+	}
+
 	// create index for Locks
 	c := p.Conn.Database(DB).Collection(LockCollection)
 	_, err = c.Indexes().CreateOne(
@@ -216,7 +564,75 @@ type BackupMeta struct {
 	Status           Status              `bson:"status" json:"status"`
 	Conditions       []Condition         `bson:"conditions" json:"conditions"`
 	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
+	FailurePolicy    FailurePolicy       `bson:"failure_policy,omitempty" json:"failure_policy,omitempty"`
+	Retries          int                 `bson:"retries,omitempty" json:"retries,omitempty"`
+	RetryOf          string              `bson:"retry_of,omitempty" json:"retry_of,omitempty"`
+	Attempt          int                 `bson:"attempt,omitempty" json:"attempt,omitempty"`
+	Dedup            bool                `bson:"dedup,omitempty" json:"dedup,omitempty"`
+	Type             BackupType          `bson:"type,omitempty" json:"type,omitempty"`
+	Base             string              `bson:"base,omitempty" json:"base,omitempty"`
+	ExpireAt         int64               `bson:"expire_at,omitempty" json:"expire_at,omitempty"`
+	LegalHold        bool                `bson:"legal_hold,omitempty" json:"legal_hold,omitempty"`
+	// Settings are the cluster-wide parameters at the time of the backup
+	Settings *ClusterSettings `bson:"settings,omitempty" json:"settings,omitempty"`
+	// ShardedColls are the sharded collections at the time of the backup
+	ShardedColls []ShardedColl `bson:"sharded_colls,omitempty" json:"sharded_colls,omitempty"`
+	// BalancerHeld is set by the mongos agent once the balancer is stopped
+	// for the time of the backup. The shards don't start the dump until then.
+	BalancerHeld bool `bson:"balancer_held,omitempty" json:"balancer_held,omitempty"`
+	// GridFS are the results of the GridFS buckets check of the sharded
+	// cluster made via mongos. The replsets of the sharded cluster
+	// don't check the buckets by themselves.
+	GridFS []GridFSCheck `bson:"gridfs,omitempty" json:"gridfs,omitempty"`
+	// Topology is the cluster's replsets and their members at the time of the backup
+	Topology []TopologyRS `bson:"topology,omitempty" json:"topology,omitempty"`
+	// TopologyDrift is the change of the topology since the previous backup
+	TopologyDrift *TopologyDrift `bson:"topology_drift,omitempty" json:"topology_drift,omitempty"`
+	// Logs are the last warnings and errors of the agents with the context
+	// preceding the errors, kept for the post-mortem
+	Logs []LogEntry `bson:"logs,omitempty" json:"logs,omitempty"`
+	// Subset is the replsets the backup is restricted to
+	Subset []string `bson:"subset,omitempty" json:"subset,omitempty"`
+	// TraceID is the ID of the backup's trace
+	TraceID string `bson:"trace_id,omitempty" json:"trace_id,omitempty"`
+	// Tags are the arbitrary user's labels of the backup
+	Tags map[string]string `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Profile is the resources profile the backup is made with
+	Profile Profile `bson:"profile,omitempty" json:"profile,omitempty"`
+	// ConsistentTS is the earliest cluster time the backup can be restored
+	// to: the latest of the replsets' majority commit points at the dump end.
+	// The restore to any point from it up to LastWriteTS is consistent.
+	ConsistentTS primitive.Timestamp `bson:"consistent_ts,omitempty" json:"consistent_ts,omitempty"`
+	// Replaces is the backup which is to be replaced by this one once
+	// it's done. It's unset when the replacement is over.
+	Replaces string `bson:"replaces,omitempty" json:"replaces,omitempty"`
+	// StagedName is the name the backup has run under
+	// before it has replaced the backup of its name
+	StagedName string `bson:"staged_name,omitempty" json:"staged_name,omitempty"`
+}
+
+// IsReplacing returns true if the backup is done but
+// hasn't replaced the backup of its final name yet
+func (b *BackupMeta) IsReplacing() bool {
+	return b.Replaces != "" && b.Status == StatusDone
+}
+
+// Includes returns true if the replset is a part of the backup
+func (b *BackupMeta) Includes(rs string) bool {
+	return len(b.Subset) == 0 || contains(b.Subset, rs)
+}
+
+// FailedReplsets returns names of replsets which backup has failed
+func (b *BackupMeta) FailedReplsets() []string {
+	var rs []string
+	for _, r := range b.Replsets {
+		if r.Status == StatusError {
+			rs = append(rs, r.Name)
+		}
+	}
+	return rs
 }
+
 type Condition struct {
 	Timestamp int64  `bson:"timestamp" json:"timestamp"`
 	Status    Status `bson:"status" json:"status"`
@@ -231,8 +647,121 @@ type BackupReplset struct {
 	Status           Status              `bson:"status" json:"status"`
 	LastTransitionTS int64               `bson:"last_transition_ts" json:"last_transition_ts"`
 	LastWriteTS      primitive.Timestamp `bson:"last_write_ts" json:"last_write_ts"`
+	FirstWriteTS     primitive.Timestamp `bson:"first_write_ts" json:"first_write_ts"`
 	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
 	Conditions       []Condition         `bson:"conditions" json:"conditions"`
+	Node             string              `bson:"node,omitempty" json:"node,omitempty"`
+	Attempts         int                 `bson:"attempts,omitempty" json:"attempts,omitempty"`
+	// Lost means the replset's node was lost and another node
+	// of the replset is to take the backup over
+	Lost bool `bson:"lost,omitempty" json:"lost,omitempty"`
+	// OplogLag is how far (in seconds) the oplog captured by the backup is behind the cluster time
+	OplogLag int `bson:"oplog_lag,omitempty" json:"oplog_lag,omitempty"`
+	// Collections are the replset's collections at the moment of the backup
+	Collections []NSInfo `bson:"collections,omitempty" json:"collections,omitempty"`
+	// Changed are the namespaces captured by the differential backup
+	Changed []string `bson:"changed,omitempty" json:"changed,omitempty"`
+	// DiffDumps are the dumps (one per database) of the differential backup
+	DiffDumps []string `bson:"diff_dumps,omitempty" json:"diff_dumps,omitempty"`
+	// GridFS are the results of the GridFS buckets check
+	GridFS []GridFSCheck `bson:"gridfs,omitempty" json:"gridfs,omitempty"`
+	// Redumps are the collections dumped separately from the main dump:
+	// the capped ones which wrapped during the dump and the namesakes
+	// of the skipped ones
+	Redumps []Redump `bson:"redumps,omitempty" json:"redumps,omitempty"`
+	// Checksums are the checksums of the replset's files calculated
+	// during the upload. There are none for the dedup layout.
+	Checksums []FileChecksum `bson:"checksums,omitempty" json:"checksums,omitempty"`
+	// Progress is the progress of the replset's dump
+	Progress *BackupProgress `bson:"progress,omitempty" json:"progress,omitempty"`
+	// Compressions are the per-collection results of the compressibility
+	// sampling. The collections with no compression are dumped separately.
+	Compressions []CollCompression `bson:"compressions,omitempty" json:"compressions,omitempty"`
+	// Skipped are the namespaces left out of the backup by the size limits
+	Skipped []string `bson:"skipped,omitempty" json:"skipped,omitempty"`
+	// Build is the versions of the tool and the server of the node
+	// which has made the replset's backup
+	Build *BuildInfo `bson:"build,omitempty" json:"build,omitempty"`
+	// SessionsName is the file of the replset's sessions records
+	// (config.transactions) as of the end of the oplog slice
+	SessionsName string `bson:"sessions_name,omitempty" json:"sessions_name,omitempty"`
+	// DumpStart and DumpEnd are the replset's majority commit point and
+	// cluster time when the dump has started and has finished
+	DumpStart *CausalPoint `bson:"dump_start,omitempty" json:"dump_start,omitempty"`
+	DumpEnd   *CausalPoint `bson:"dump_end,omitempty" json:"dump_end,omitempty"`
+	// Delayed is set if the replset's dump has been made on the delayed
+	// member, the oplog slice is read from the primary then
+	Delayed *DelayedSource `bson:"delayed,omitempty" json:"delayed,omitempty"`
+}
+
+// DelayedSource is the delayed member the replset's backup is made on. The
+// dump is consistent at the point the member has applied, the oplog slice
+// from that point up to the cluster last write is read from the primary,
+// so the restore still reaches the backup's end.
+type DelayedSource struct {
+	DelaySec int64 `bson:"delay_sec" json:"delay_sec"`
+	// AppliedTS is the member's last applied write at the backup start
+	AppliedTS primitive.Timestamp `bson:"applied_ts" json:"applied_ts"`
+	// OplogFrom is the primary the oplog slice is read from
+	OplogFrom string `bson:"oplog_from" json:"oplog_from"`
+}
+
+// BackupProgress is the progress of the replset's dump reported
+// by the agent while the dump is running
+type BackupProgress struct {
+	// Done is the size of the data dumped so far (uncompressed)
+	Done int64 `bson:"done" json:"done"`
+	// Total is the estimated size of the data to dump, the size
+	// of the collections at the start of the dump
+	Total int64 `bson:"total" json:"total"`
+	// Rate is the throughput over the last minute, bytes per second
+	Rate int64 `bson:"rate" json:"rate"`
+	// ETA is the estimated time left to the end of the dump in seconds
+	ETA       int64 `bson:"eta" json:"eta"`
+	UpdatedAt int64 `bson:"updated_at" json:"updated_at"`
+}
+
+// Percent returns the dumped part of the data in percents
+func (p BackupProgress) Percent() int {
+	if p.Total <= 0 {
+		return 0
+	}
+	pct := int(p.Done * 100 / p.Total)
+	if pct > 100 {
+		pct = 100
+	}
+	return pct
+}
+
+// NSInfo is the collection's namespace, UUID and stats
+type NSInfo struct {
+	NS    string `bson:"ns" json:"ns"`
+	UUID  string `bson:"uuid,omitempty" json:"uuid,omitempty"`
+	View  bool   `bson:"view,omitempty" json:"view,omitempty"`
+	Count int64  `bson:"count,omitempty" json:"count,omitempty"`
+	Size  int64  `bson:"size,omitempty" json:"size,omitempty"`
+	// Capped options of the collection
+	Capped     bool  `bson:"capped,omitempty" json:"capped,omitempty"`
+	CappedSize int64 `bson:"capped_size,omitempty" json:"capped_size,omitempty"`
+	CappedMax  int64 `bson:"capped_max,omitempty" json:"capped_max,omitempty"`
+}
+
+// Redump is the separate dump of the collection which was changing
+// too fast to be consistent in the main dump or was excluded from
+// it for having the name of the skipped collection
+type Redump struct {
+	NS   string `bson:"ns" json:"ns"`
+	Name string `bson:"name" json:"name"`
+}
+
+// CollCompression is the compressibility of the collection measured on
+// the sample of its documents and the compression chosen for it
+type CollCompression struct {
+	NS string `bson:"ns" json:"ns"`
+	// Ratio is the compressed to the raw size of the sample
+	Ratio       float64         `bson:"ratio" json:"ratio"`
+	Sampled     int64           `bson:"sampled" json:"sampled"`
+	Compression CompressionType `bson:"compression" json:"compression"`
 }
 
 // Status is backup current status
@@ -244,6 +773,9 @@ const (
 	StatusDumpDone        = "dumpDone"
 	StatusDone            = "done"
 	StatusError           = "error"
+	// StatusPartlyDone means backup is done but some replsets have failed
+	// (only with FailurePolicyPartial)
+	StatusPartlyDone = "partlyDone"
 )
 
 func (p *PBM) SetBackupMeta(m *BackupMeta) error {
@@ -303,6 +835,32 @@ func (p *PBM) SetLastWrite(bcpName string, ts primitive.Timestamp) error {
 	return err
 }
 
+// SetConsistentTS sets the earliest point the backup can be restored to
+func (p *PBM) SetConsistentTS(bcpName string, ts primitive.Timestamp) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}},
+		bson.D{
+			{"$set", bson.M{"consistent_ts": ts}},
+		},
+	)
+
+	return err
+}
+
+// SetShardedColls writes the sharded collections metadata of the backup
+func (p *PBM) SetShardedColls(bcpName string, colls []ShardedColl) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}},
+		bson.D{
+			{"$set", bson.M{"sharded_colls": colls}},
+		},
+	)
+
+	return err
+}
+
 func (p *PBM) AddRSMeta(bcpName string, rs BackupReplset) error {
 	rs.LastTransitionTS = rs.StartTS
 	rs.Conditions = append(rs.Conditions, Condition{
@@ -319,6 +877,13 @@ func (p *PBM) AddRSMeta(bcpName string, rs BackupReplset) error {
 }
 
 func (p *PBM) ChangeRSState(bcpName string, rsName string, s Status, msg string) error {
+	if s != StatusError {
+		err := fault.Check(fault.BackupPhase, string(s))
+		if err != nil {
+			return err
+		}
+	}
+
 	ts := time.Now().UTC().Unix()
 	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
 		p.ctx,
@@ -334,6 +899,188 @@ func (p *PBM) ChangeRSState(bcpName string, rsName string, s Status, msg string)
 	return err
 }
 
+// SetRSOplogLag updates the replset's oplog slicing lag
+func (p *PBM) SetRSOplogLag(bcpName string, rsName string, lag int) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.oplog_lag": lag}},
+		},
+	)
+
+	return err
+}
+
+// SetRSProgress updates the replset's dump progress
+func (p *PBM) SetRSProgress(bcpName string, rsName string, pr BackupProgress) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.progress": pr}},
+		},
+	)
+
+	return err
+}
+
+// SetRSCollections writes the list of the replset's collections
+func (p *PBM) SetRSCollections(bcpName string, rsName string, colls []NSInfo) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.collections": colls}},
+		},
+	)
+
+	return err
+}
+
+// SetRSDiff writes the changed namespaces and the dumps of the differential backup
+func (p *PBM) SetRSDiff(bcpName string, rsName string, changed, dumps []string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.changed": changed}},
+			{"$set", bson.M{"replsets.$.diff_dumps": dumps}},
+		},
+	)
+
+	return err
+}
+
+// SetBalancerHeld marks the balancer as stopped for the time of the backup
+func (p *PBM) SetBalancerHeld(bcpName string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}},
+		bson.D{
+			{"$set", bson.M{"balancer_held": true}},
+		},
+	)
+
+	return err
+}
+
+// SetGridFS writes the results of the cluster-wide GridFS buckets check
+func (p *PBM) SetGridFS(bcpName string, checks []GridFSCheck) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}},
+		bson.D{
+			{"$set", bson.M{"gridfs": checks}},
+		},
+	)
+
+	return err
+}
+
+// SetRSGridFS writes the results of the replset's GridFS buckets check
+func (p *PBM) SetRSGridFS(bcpName string, rsName string, checks []GridFSCheck) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.gridfs": checks}},
+		},
+	)
+
+	return err
+}
+
+// SetRSRedumps writes the separate dumps of the replset's collections
+func (p *PBM) SetRSRedumps(bcpName string, rsName string, redumps []Redump) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.redumps": redumps}},
+		},
+	)
+
+	return err
+}
+
+// SetRSSkipped sets the namespaces left out of the replset's backup
+func (p *PBM) SetRSSkipped(bcpName string, rsName string, skipped []string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.skipped": skipped}},
+		},
+	)
+
+	return err
+}
+
+// SetRSBuild sets the versions of the node which makes the replset's backup
+func (p *PBM) SetRSBuild(bcpName string, rsName string, bi BuildInfo) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.build": bi}},
+		},
+	)
+
+	return err
+}
+
+// SetRSCompressions sets the compressibility of the replset's collections
+// and the compression chosen for each of them
+func (p *PBM) SetRSCompressions(bcpName string, rsName string, colls []CollCompression) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{{"$set", bson.M{"replsets.$.compressions": colls}}},
+	)
+
+	return err
+}
+
+// RetryRS moves failed replset back to the running state on behalf of the given node
+// MarkRSLost marks the replset as failed due to its node was lost,
+// so another node of the replset takes the backup over
+func (p *PBM) MarkRSLost(bcpName, rsName, msg string) error {
+	ts := time.Now().UTC().Unix()
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.status": StatusError}},
+			{"$set", bson.M{"replsets.$.last_transition_ts": ts}},
+			{"$set", bson.M{"replsets.$.error": msg}},
+			{"$set", bson.M{"replsets.$.lost": true}},
+			{"$push", bson.M{"replsets.$.conditions": Condition{Timestamp: ts, Status: StatusError, Error: msg}}},
+		},
+	)
+
+	return err
+}
+
+func (p *PBM) RetryRS(bcpName, rsName, node string) error {
+	ts := time.Now().UTC().Unix()
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.status": StatusRunning}},
+			{"$set", bson.M{"replsets.$.last_transition_ts": ts}},
+			{"$set", bson.M{"replsets.$.error": ""}},
+			{"$set", bson.M{"replsets.$.node": node}},
+			{"$set", bson.M{"replsets.$.lost": false}},
+			{"$inc", bson.M{"replsets.$.attempts": 1}},
+			{"$push", bson.M{"replsets.$.conditions": Condition{Timestamp: ts, Status: StatusRunning}}},
+		},
+	)
+
+	return err
+}
+
 func (p *PBM) SetRSLastWrite(bcpName string, rsName string, ts primitive.Timestamp) error {
 	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
 		p.ctx,
@@ -346,6 +1093,72 @@ func (p *PBM) SetRSLastWrite(bcpName string, rsName string, ts primitive.Timesta
 	return err
 }
 
+// SetRSSessions sets the file of the replset's sessions records
+func (p *PBM) SetRSSessions(bcpName string, rsName string, name string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.sessions_name": name}},
+		},
+	)
+
+	return err
+}
+
+// SetRSDumpStart sets the replset's causal point at the dump start
+func (p *PBM) SetRSDumpStart(bcpName string, rsName string, cp CausalPoint) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.dump_start": cp}},
+		},
+	)
+
+	return err
+}
+
+// SetRSDumpEnd sets the replset's causal point at the dump end
+func (p *PBM) SetRSDumpEnd(bcpName string, rsName string, cp CausalPoint) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.dump_end": cp}},
+		},
+	)
+
+	return err
+}
+
+// SetRSDelayed records the delayed member the replset's backup is made on,
+// nil unsets it
+func (p *PBM) SetRSDelayed(bcpName string, rsName string, d *DelayedSource) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.delayed": d}},
+		},
+	)
+
+	return err
+}
+
+// SetRSFirstWrite sets the start point of the replset's oplog slice
+func (p *PBM) SetRSFirstWrite(bcpName string, rsName string, ts primitive.Timestamp) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.first_write_ts": ts}},
+		},
+	)
+
+	return err
+}
+
 func (p *PBM) GetBackupMeta(name string) (*BackupMeta, error) {
 	b := new(BackupMeta)
 	res := p.Conn.Database(DB).Collection(BcpCollection).FindOne(p.ctx, bson.D{{"name", name}})
@@ -359,29 +1172,101 @@ func (p *PBM) GetBackupMeta(name string) (*BackupMeta, error) {
 	return b, errors.Wrap(err, "decode")
 }
 
-func (p *PBM) BackupsList(limit int64) ([]BackupMeta, error) {
-	cur, err := p.Conn.Database(DB).Collection(BcpCollection).Find(
+// GetJobMeta returns the metadata of the backup started under the name,
+// even if it has replaced the existing backup and taken its name since
+func (p *PBM) GetJobMeta(name string) (*BackupMeta, error) {
+	b := new(BackupMeta)
+	err := p.Conn.Database(DB).Collection(BcpCollection).FindOne(
 		p.ctx,
-		bson.M{},
-		options.Find().SetLimit(limit).SetSort(bson.D{{"start_ts", -1}}),
+		bson.D{{"$or", bson.A{bson.D{{"name", name}}, bson.D{{"staged_name", name}}}}},
+	).Decode(b)
+	if err == mongo.ErrNoDocuments {
+		return b, nil
+	}
+	return b, errors.Wrap(err, "get")
+}
+
+// RenameBackup gives the backup the new name keeping the current one as staged
+func (p *PBM) RenameBackup(name, newName string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{
+			{"$set", bson.M{"name": newName, "staged_name": name}},
+			{"$unset", bson.M{"replaces": ""}},
+		},
 	)
-	if err != nil {
-		return nil, errors.Wrap(err, "query mongo")
+	return err
+}
+
+// UnsetReplaces marks the replacement of the backup by this one as over
+func (p *PBM) UnsetReplaces(name string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$unset", bson.M{"replaces": ""}}},
+	)
+	return err
+}
+
+func (p *PBM) BackupsList(limit int64) ([]BackupMeta, error) {
+	return p.FindBackups(BackupFilter{}, limit)
+}
+
+// BackupFilter defines the backups to be found. Empty fields match any backup.
+type BackupFilter struct {
+	// Tags the backup has to have all of
+	Tags map[string]string
+	// Since and Until are the range (unix time) the backup start falls into.
+	// Until is exclusive.
+	Since int64
+	Until int64
+	Type  BackupType
+	// Status of the backup. Running backups have one of the intermediate statuses.
+	Status Status
+}
+
+func (f BackupFilter) query() bson.D {
+	q := bson.D{}
+	for k, v := range f.Tags {
+		q = append(q, bson.E{"tags." + k, v})
 	}
 
-	defer cur.Close(p.ctx)
+	ts := bson.D{}
+	if f.Since > 0 {
+		ts = append(ts, bson.E{"$gte", f.Since})
+	}
+	if f.Until > 0 {
+		ts = append(ts, bson.E{"$lt", f.Until})
+	}
+	if len(ts) > 0 {
+		q = append(q, bson.E{"start_ts", ts})
+	}
 
-	backups := []BackupMeta{}
-	for cur.Next(p.ctx) {
-		b := BackupMeta{}
-		err := cur.Decode(&b)
-		if err != nil {
-			return nil, errors.Wrap(err, "message decode")
-		}
-		backups = append(backups, b)
+	switch f.Type {
+	case "":
+	case BackupTypeFull:
+		// full backups made by the older versions have no type
+		q = append(q, bson.E{"type", bson.D{{"$nin", []BackupType{BackupTypeDifferential, BackupTypeSchema, BackupTypeOplog}}}})
+	default:
+		q = append(q, bson.E{"type", f.Type})
+	}
+
+	switch f.Status {
+	case "":
+	case StatusRunning:
+		q = append(q, bson.E{"status", bson.D{{"$in", []Status{StatusStarting, StatusRunning, StatusDumpDone}}}})
+	default:
+		q = append(q, bson.E{"status", f.Status})
 	}
 
-	return backups, cur.Err()
+	return q
+}
+
+// FindBackups returns the backups matching the filter, the latest first
+func (p *PBM) FindBackups(f BackupFilter, limit int64) ([]BackupMeta, error) {
+	b, _, err := p.FindBackupsPage(f, Page{Limit: limit})
+	return b, err
 }
 
 // GetShards gets list of shards
@@ -436,8 +1321,37 @@ func (p *PBM) ClusterTime() (primitive.Timestamp, error) {
 	}
 
 	if im.ClusterTime == nil {
-		return primitive.Timestamp{}, errors.Wrap(err, "no clusterTime in response")
+		// there is no cluster time on the standalone node
+		if im.IsStandalone() {
+			return primitive.Timestamp{T: uint32(time.Now().Unix())}, nil
+		}
+		return primitive.Timestamp{}, errors.New("no clusterTime in response")
 	}
 
 	return im.ClusterTime.ClusterTime, nil
 }
+
+// ParseTimestamp parses the timestamp either in <T[,I]> format
+// where T is unix seconds or as a RFC3339 date
+func ParseTimestamp(s string) (primitive.Timestamp, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return primitive.Timestamp{T: uint32(t.Unix())}, nil
+	}
+
+	ts := primitive.Timestamp{}
+	parts := strings.SplitN(s, ",", 2)
+	t, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return ts, errors.Errorf("invalid timestamp %q, expected <T[,I]> or RFC3339 date", s)
+	}
+	ts.T = uint32(t)
+	if len(parts) == 2 {
+		i, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return ts, errors.Errorf("invalid timestamp %q, expected <T[,I]> or RFC3339 date", s)
+		}
+		ts.I = uint32(i)
+	}
+
+	return ts, nil
+}
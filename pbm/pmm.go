@@ -0,0 +1,86 @@
+package pbm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PMMConf defines the integration with the PMM (Percona Monitoring and
+// Management) server. The agents put the start and the end of the backups
+// and the restores as the annotations on the PMM dashboards, so their impact
+// is seen along with the query analytics of the nodes. The catalog metrics
+// (the agent's /metrics, see --diag-addr) are scraped by PMM once added with
+// `pmm-admin add external --listen-port=<diag port> --metrics-path=/metrics`.
+type PMMConf struct {
+	// URL is the PMM server address, e.g. https://pmm.example.com.
+	// The annotations are off if it's empty.
+	URL string `bson:"url,omitempty" json:"url,omitempty" yaml:"url,omitempty"`
+	// User and Password are the PMM server basic auth credentials
+	User     string `bson:"user,omitempty" json:"user,omitempty" yaml:"user,omitempty"`
+	Password string `bson:"password,omitempty" json:"password,omitempty" yaml:"password,omitempty"`
+	// APIKey is the PMM (Grafana) API key used instead of the user
+	APIKey string `bson:"apiKey,omitempty" json:"apiKey,omitempty" yaml:"apiKey,omitempty"`
+	// InsecureSkipVerify turns off the check of the server's
+	// certificate, e.g. for the PMM default self-signed one
+	InsecureSkipVerify bool `bson:"insecureSkipVerify,omitempty" json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Enabled returns true if the PMM server is set
+func (c PMMConf) Enabled() bool {
+	return c.URL != ""
+}
+
+// PMMAnnotation is the event put on the PMM dashboards
+type PMMAnnotation struct {
+	Text string   `json:"text"`
+	Tags []string `json:"tags,omitempty"`
+	// ServiceNames bind the annotation to the dashboards of the services
+	// (as they are added with pmm-admin). It's shown on all of them if empty.
+	ServiceNames []string `json:"service_names,omitempty"`
+}
+
+// pmmTimeout is the max duration of the request to the PMM server
+const pmmTimeout = time.Second * 10
+
+// Annotate adds the annotation to the PMM server
+func (c PMMConf) Annotate(a PMMAnnotation) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "marshal annotation")
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.URL, "/")+"/v1/management/Annotations/Add", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case c.APIKey != "":
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	case c.User != "":
+		req.SetBasicAuth(c.User, c.Password)
+	}
+
+	cl := &http.Client{Timeout: pmmTimeout}
+	if c.InsecureSkipVerify {
+		cl.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("PMM server responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
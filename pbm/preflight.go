@@ -0,0 +1,257 @@
+package pbm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PreflightStatus is the result of the restore pre-flight check
+type PreflightStatus string
+
+const (
+	PreflightOK      PreflightStatus = "ok"
+	PreflightWarning PreflightStatus = "warning"
+	PreflightFailed  PreflightStatus = "failed"
+)
+
+// PreflightCheck is the result of the single check of the restore target
+type PreflightCheck struct {
+	Name    string          `json:"name"`
+	Status  PreflightStatus `json:"status"`
+	Message string          `json:"message,omitempty"`
+}
+
+// PreflightReport is the state of the restore target checked before the
+// restore is started, so it doesn't fail halfway
+type PreflightReport struct {
+	Backup string           `json:"backup"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// Failed returns true if any check has failed
+func (r *PreflightReport) Failed() bool {
+	for _, c := range r.Checks {
+		if c.Status == PreflightFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PreflightReport) add(name string, st PreflightStatus, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Status: st, Message: fmt.Sprintf(format, a...)})
+}
+
+// RestorePreflight checks the cluster can take the restore of the backup:
+// each replset of the backup has the agent connected to its node, the
+// primaries have the disk space for the data, the backup's databases
+// aren't there, the FCV is compatible and the balancer is stopped.
+func (p *PBM) RestorePreflight(bcp *BackupMeta) (*PreflightReport, error) {
+	r := &PreflightReport{Backup: bcp.Name}
+
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "read cluster time")
+	}
+	stats, err := p.AgentsStatus()
+	if err != nil {
+		return nil, errors.Wrap(err, "get agents status")
+	}
+
+	var dbs []string
+	for _, rs := range bcp.Replsets {
+		var alive, primary *AgentStat
+		for i, s := range stats {
+			if s.RS != rs.Name || s.IsStale(ts) {
+				continue
+			}
+			if alive == nil || s.Err == "" {
+				alive = &stats[i]
+			}
+			if s.StateStr == "PRIMARY" {
+				primary = &stats[i]
+			}
+		}
+		switch {
+		case alive == nil:
+			r.add("agents", PreflightFailed, "%s: no agent is connected to the replset's nodes", rs.Name)
+		case alive.Err != "":
+			r.add("agents", PreflightWarning, "%s: agent on %s reports: %s", rs.Name, alive.Node, alive.Err)
+		default:
+			r.add("agents", PreflightOK, "%s: agent on %s is connected", rs.Name, alive.Node)
+		}
+
+		var size int64
+		for _, c := range rs.Collections {
+			size += c.Size
+			db := strings.SplitN(c.NS, ".", 2)[0]
+			if db != DB && db != "config" && db != "local" {
+				dbs = append(dbs, db)
+			}
+		}
+		r.disk(rs.Name, primary, size)
+	}
+
+	node := NewNode(p.ctx, "", p.Conn, "")
+	im, err := node.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get isMaster")
+	}
+
+	err = p.preflightData(r, im, dbs)
+	if err != nil {
+		return nil, err
+	}
+	err = preflightFCV(r, node, bcp)
+	if err != nil {
+		return nil, err
+	}
+	if im.ReplsetRole() == ReplRoleConfigSrv {
+		err = p.preflightBalancer(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// disk checks the replset's primary has the space for the data of `size`
+func (r *PreflightReport) disk(rs string, primary *AgentStat, size int64) {
+	switch {
+	case primary == nil:
+		r.add("disk", PreflightWarning, "%s: no agent on the primary to check its free space", rs)
+	case primary.DiskFree == 0:
+		// the agent couldn't read the free space of the dbpath
+		r.add("disk", PreflightWarning, "%s: free space of %s is unknown, the backup's data is %dMB uncompressed", rs, primary.Node, size>>20)
+	case primary.DiskFree < uint64(size):
+		r.add("disk", PreflightFailed, "%s: %s has %dMB free, the backup's data is %dMB uncompressed", rs, primary.Node, primary.DiskFree>>20, size>>20)
+	default:
+		r.add("disk", PreflightOK, "%s: %s has %dMB free, the backup's data is %dMB uncompressed", rs, primary.Node, primary.DiskFree>>20, size>>20)
+	}
+}
+
+// preflightData checks the target has none of the backup's databases
+func (p *PBM) preflightData(r *PreflightReport, im *IsMaster, dbs []string) error {
+	have, err := p.ClusterDBs(im)
+	if err != nil {
+		return err
+	}
+
+	backup := make(map[string]bool, len(dbs))
+	for _, db := range dbs {
+		backup[db] = true
+	}
+	var clash []string
+	for _, db := range have {
+		if backup[db] {
+			clash = append(clash, db)
+			backup[db] = false
+		}
+	}
+	if len(clash) == 0 {
+		r.add("data", PreflightOK, "the cluster has none of the backup's databases")
+		return nil
+	}
+	sort.Strings(clash)
+	r.add("data", PreflightWarning, "the cluster has the backup's databases %s, their collections are dropped unless restored with --mode merge or replace", strings.Join(clash, ", "))
+	return nil
+}
+
+// preflightFCV checks the target's binaries can take the data of the
+// backup's feature compatibility version
+func preflightFCV(r *PreflightReport, node *Node, bcp *BackupMeta) error {
+	fcv := bcp.MongoVersion
+	if bcp.Settings != nil && bcp.Settings.FCV != "" {
+		fcv = bcp.Settings.FCV
+	}
+	if fcv == "" {
+		r.add("fcv", PreflightWarning, "the backup has no version recorded")
+		return nil
+	}
+
+	ver, err := node.GetMongoVersion()
+	if err != nil {
+		return errors.Wrap(err, "get mongo version")
+	}
+	cur, err := node.fcv()
+	if err != nil {
+		return err
+	}
+
+	bmm, ok := majorMinor(fcv)
+	if !ok {
+		r.add("fcv", PreflightWarning, "the backup's version %s can't be parsed", fcv)
+		return nil
+	}
+	if len(ver.Version) >= 2 && (bmm[0] > ver.Version[0] || bmm[0] == ver.Version[0] && bmm[1] > ver.Version[1]) {
+		r.add("fcv", PreflightFailed, "the backup is of %s, the cluster runs %s", fcv, ver.VersionString)
+		return nil
+	}
+	if cmm, ok := majorMinor(cur); ok && cmm != bmm {
+		r.add("fcv", PreflightWarning, "the backup is of %s, the cluster's featureCompatibilityVersion is %s", fcv, cur)
+		return nil
+	}
+	r.add("fcv", PreflightOK, "the backup is of %s, the cluster runs %s", fcv, ver.VersionString)
+	return nil
+}
+
+// preflightBalancer checks the balancer of the sharded cluster is stopped,
+// the chunks moved during the restore end up on the wrong shards. The
+// mongos agent stops it for the restore, so it's only a warning then.
+func (p *PBM) preflightBalancer(r *PreflightReport) error {
+	s := struct {
+		Stopped bool   `bson:"stopped"`
+		Mode    string `bson:"mode"`
+	}{}
+	err := p.Conn.Database("config").Collection("settings").FindOne(p.ctx, bson.D{{"_id", "balancer"}}).Decode(&s)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "get balancer settings")
+	}
+	if s.Stopped || s.Mode == "off" {
+		r.balancer(true, false)
+		return nil
+	}
+	mongos, err := p.HasMongosAgent()
+	if err != nil {
+		return errors.Wrap(err, "check mongos agents")
+	}
+	r.balancer(false, mongos)
+	return nil
+}
+
+func (r *PreflightReport) balancer(stopped, mongosAgent bool) {
+	switch {
+	case stopped:
+		r.add("balancer", PreflightOK, "the balancer is stopped")
+	case mongosAgent:
+		r.add("balancer", PreflightWarning, "the balancer is running, the mongos agent stops it for the restore")
+	default:
+		r.add("balancer", PreflightFailed, "the balancer is running, stop it via mongos with sh.stopBalancer() or run the mongos agent")
+	}
+}
+
+// ClusterDBs returns the databases of the cluster. The sharded
+// cluster's databases are read from config.databases.
+func (p *PBM) ClusterDBs(im *IsMaster) ([]string, error) {
+	if im.ReplsetRole() != ReplRoleConfigSrv {
+		dbs, err := p.Conn.ListDatabaseNames(p.ctx, bson.D{})
+		return dbs, errors.Wrap(err, "list databases")
+	}
+
+	ids, err := p.Conn.Database("config").Collection("databases").Distinct(p.ctx, "_id", bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "get config.databases")
+	}
+	var dbs []string
+	for _, id := range ids {
+		if db, ok := id.(string); ok {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs, nil
+}
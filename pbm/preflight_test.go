@@ -0,0 +1,23 @@
+package pbm
+
+import "testing"
+
+func TestPreflightUnknown(t *testing.T) {
+	r := &PreflightReport{}
+	r.disk("rs0", &AgentStat{Node: "rs0:27017"}, 10<<20)
+	r.disk("rs1", &AgentStat{Node: "rs1:27017", DiskFree: 1 << 20}, 10<<20)
+	r.balancer(false, true)
+
+	want := []PreflightStatus{PreflightWarning, PreflightFailed, PreflightWarning}
+	for i, c := range r.Checks {
+		if c.Status != want[i] {
+			t.Errorf("%s %q: got %s, want %s", c.Name, c.Message, c.Status, want[i])
+		}
+	}
+
+	r = &PreflightReport{}
+	r.balancer(false, false)
+	if !r.Failed() {
+		t.Error("the running balancer with no mongos agent doesn't fail the check")
+	}
+}
@@ -0,0 +1,93 @@
+package pbm
+
+import (
+	"compress/gzip"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Profile is the preset of the resources the backup may take on the node
+type Profile string
+
+const (
+	// ProfileNone means the backup takes as much as the settings allow
+	ProfileNone   Profile = ""
+	ProfileLow    Profile = "low"
+	ProfileMedium Profile = "medium"
+	ProfileHigh   Profile = "high"
+)
+
+// ProfileSettings are the knobs the profile sets
+type ProfileSettings struct {
+	// UploadConcurrency is the number of the upload parts sent in parallel.
+	// The explicitly configured s3.uploadConcurrency takes precedence.
+	UploadConcurrency int
+	// CompressionLevel is the gzip compression level, 0 is the default one
+	CompressionLevel int
+	// RateLimitMBps limits the rate of reading the data
+	// (dump and oplog) from the node. 0 means no limit.
+	RateLimitMBps int
+	// LatencyGuard makes the backup watch the node's p99 probe reads latency and
+	// slow down the reads while it's above LatencyGuardFactor times the
+	// latency before the backup
+	LatencyGuard bool
+}
+
+// LatencyGuardFactor is the increase of the node's p99 probe reads latency
+// the latency guard allows
+const LatencyGuardFactor = 1.5
+
+var profiles = map[Profile]ProfileSettings{
+	ProfileLow: {
+		UploadConcurrency: 1,
+		CompressionLevel:  gzip.BestSpeed,
+		RateLimitMBps:     20,
+		LatencyGuard:      true,
+	},
+	ProfileMedium: {
+		UploadConcurrency: 2,
+		RateLimitMBps:     100,
+	},
+	ProfileHigh: {
+		UploadConcurrency: 8,
+	},
+}
+
+// Settings returns the knobs of the profile
+func (p Profile) Settings() (ProfileSettings, error) {
+	if p == ProfileNone {
+		return ProfileSettings{}, nil
+	}
+	s, ok := profiles[p]
+	if !ok {
+		return s, errors.Errorf("unknown profile %q, the profile is one of low/medium/high", p)
+	}
+	return s, nil
+}
+
+// ProbeLatency returns the round trip time of a small read from the node.
+// The latency guard probes the node on its own connection rather than reads
+// the node's opLatencies since those include the backup's own reads.
+func (n *Node) ProbeLatency() (time.Duration, error) {
+	start := time.Now()
+	err := n.cn.Database("admin").Collection("system.version").FindOne(n.ctx, bson.D{}).Err()
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, errors.Wrap(err, "probe read")
+	}
+	return time.Since(start), nil
+}
+
+// LatencyP99 returns the p99 of the latencies in micros, -1 if there are none
+func LatencyP99(lat []time.Duration) int64 {
+	if len(lat) == 0 {
+		return -1
+	}
+	l := make([]time.Duration, len(lat))
+	copy(l, lat)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return int64(l[(len(l)*99+99)/100-1] / time.Microsecond)
+}
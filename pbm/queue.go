@@ -0,0 +1,309 @@
+package pbm
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Priority defines the order in which the queued jobs are started
+type Priority int
+
+const (
+	// PriorityScheduled is the priority of the backups started by schedule
+	PriorityScheduled Priority = 0
+	// PriorityOnDemand is the priority of the jobs started by an operator.
+	// They go ahead of the scheduled ones.
+	PriorityOnDemand Priority = 10
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityScheduled:
+		return "scheduled"
+	case PriorityOnDemand:
+		return "on-demand"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// QueueConf defines how the queued jobs are started
+type QueueConf struct {
+	// MaxConcurrent is the max number of the operations run at a time on
+	// the cluster. Only the backups of the disjoint replsets subsets may
+	// run concurrently. Default is 1.
+	MaxConcurrent int `bson:"maxConcurrent,omitempty" json:"maxConcurrent,omitempty" yaml:"maxConcurrent,omitempty"`
+}
+
+// Concurrency returns the max number of the operations run at a time
+func (c QueueConf) Concurrency() int {
+	if c.MaxConcurrent < 1 {
+		return 1
+	}
+	return c.MaxConcurrent
+}
+
+// QueuedJob is the backup, restore, verification or delete waiting
+// for the running operations to finish
+type QueuedJob struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// Name is the job ID, see Cmd.JobName
+	Name     string   `bson:"name" json:"name"`
+	Type     Command  `bson:"type" json:"type"`
+	Cmd      Cmd      `bson:"cmd" json:"-"`
+	Priority Priority `bson:"priority" json:"priority"`
+	TS       int64    `bson:"ts" json:"ts"`
+	// ClaimTS is the time the job has been claimed by the agent to start it.
+	// The job is removed from the queue only once its command is sent.
+	ClaimTS int64 `bson:"claimTS,omitempty" json:"-"`
+	// NotBefore is the time the job may be started at, e.g. the backoff
+	// of the backup restart. Zero means right away.
+	NotBefore int64 `bson:"notBefore,omitempty" json:"notBefore,omitempty"`
+}
+
+// Lock returns the lock header the job's operation takes
+func (j QueuedJob) Lock() LockHeader {
+	l := LockHeader{Type: j.Cmd.Cmd}
+	switch j.Cmd.Cmd {
+	case CmdBackup:
+		l.BackupName, l.Subset = j.Cmd.Backup.Name, j.Cmd.Backup.Replsets
+	case CmdRestore:
+		l.BackupName = j.Cmd.Restore.Name
+	}
+	return l
+}
+
+// the higher priority goes first, then the earlier queued
+var queueOrder = bson.D{{"priority", -1}, {"ts", 1}, {"_id", 1}}
+
+// QueueBackup puts the backup into the queue and
+// returns its position (starting from 1)
+func (p *PBM) QueueBackup(bcp BackupCmd, prio Priority) (int, error) {
+	return p.QueueJob(Cmd{Cmd: CmdBackup, Backup: bcp}, prio)
+}
+
+// QueueJob puts the backup, restore, verify or delete command into the
+// queue and returns its position (starting from 1)
+func (p *PBM) QueueJob(cmd Cmd, prio Priority) (int, error) {
+	return p.QueueJobAt(cmd, prio, time.Time{})
+}
+
+// QueueJobAt queues the command which isn't started before the given time
+func (p *PBM) QueueJobAt(cmd Cmd, prio Priority, notBefore time.Time) (int, error) {
+	switch cmd.Cmd {
+	case CmdBackup, CmdRestore, CmdVerify, CmdDeleteBackup:
+	default:
+		return 0, errors.Errorf("%s can't be queued", cmd.Cmd)
+	}
+
+	name := cmd.JobName()
+	qpos, err := p.QueuePosition(name)
+	if err != nil {
+		return 0, err
+	}
+	if qpos > 0 {
+		return 0, errors.Errorf("job %s is already queued", name)
+	}
+	if cmd.User == "" {
+		cmd.User = p.user()
+	}
+
+	_, err = p.Conn.Database(DB).Collection(QueueCollection).InsertOne(
+		p.ctx,
+		QueuedJob{
+			Name:      name,
+			Type:      cmd.Cmd,
+			Cmd:       cmd,
+			Priority:  prio,
+			TS:        time.Now().UTC().Unix(),
+			NotBefore: unixOrZero(notBefore),
+		},
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "insert")
+	}
+
+	return p.QueuePosition(name)
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// QueuedJobs returns the queued jobs in the order they will be started
+func (p *PBM) QueuedJobs() ([]QueuedJob, error) {
+	cur, err := p.Conn.Database(DB).Collection(QueueCollection).Find(
+		p.ctx,
+		bson.D{},
+		options.Find().SetSort(queueOrder),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query")
+	}
+	defer cur.Close(p.ctx)
+
+	q := []QueuedJob{}
+	for cur.Next(p.ctx) {
+		var j QueuedJob
+		err := cur.Decode(&j)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode")
+		}
+		q = append(q, j)
+	}
+
+	return q, cur.Err()
+}
+
+// QueuePosition returns the position of the job in the queue
+// (starting from 1) or 0 if the job isn't queued
+func (p *PBM) QueuePosition(name string) (int, error) {
+	q, err := p.QueuedJobs()
+	if err != nil {
+		return 0, err
+	}
+	for i, j := range q {
+		if j.Name == name {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// queueClaimExpire is how long the claim of the job lasts. The job claimed
+// by the agent which has died before starting it is taken by another one.
+const queueClaimExpire = 60
+
+// ClaimQueuedJob marks the job as being started. It returns false if the job
+// is gone (e.g. cancelled) or claimed by another agent.
+func (p *PBM) ClaimQueuedJob(id primitive.ObjectID) (bool, error) {
+	now := time.Now().Unix()
+	res, err := p.Conn.Database(DB).Collection(QueueCollection).UpdateOne(
+		p.ctx,
+		bson.D{
+			{"_id", id},
+			{"$or", bson.A{
+				bson.D{{"claimTS", bson.M{"$exists": false}}},
+				bson.D{{"claimTS", bson.M{"$lt": now - queueClaimExpire}}},
+			}},
+		},
+		bson.D{{"$set", bson.M{"claimTS": now}}},
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "update")
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// ReleaseQueuedJob drops the claim of the job which hasn't been started
+func (p *PBM) ReleaseQueuedJob(id primitive.ObjectID) error {
+	_, err := p.Conn.Database(DB).Collection(QueueCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"_id", id}},
+		bson.D{{"$unset", bson.M{"claimTS": ""}}},
+	)
+	return errors.Wrap(err, "update")
+}
+
+// TakeQueuedJob removes the started job from the queue. It returns
+// false if the job is already gone (e.g. cancelled).
+func (p *PBM) TakeQueuedJob(id primitive.ObjectID) (bool, error) {
+	res, err := p.Conn.Database(DB).Collection(QueueCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"_id", id}},
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "delete")
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// UnqueueJob removes the job from the queue. It returns false
+// if the job isn't queued (e.g. it's already started).
+func (p *PBM) UnqueueJob(name string) (bool, error) {
+	res, err := p.Conn.Database(DB).Collection(QueueCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"name", name}},
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "delete")
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// SetQueuePriority changes the priority of the queued job and returns
+// its new position in the queue
+func (p *PBM) SetQueuePriority(name string, prio Priority) (int, error) {
+	res, err := p.Conn.Database(DB).Collection(QueueCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$set", bson.M{"priority": prio}}},
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "update")
+	}
+	if res.MatchedCount == 0 {
+		return 0, mongo.ErrNoDocuments
+	}
+	return p.QueuePosition(name)
+}
+
+// legacyQueuedBackup is the queued backup as it's kept by the versions
+// which have queued only the backups
+type legacyQueuedBackup struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Backup   BackupCmd          `bson:"backup"`
+	Priority Priority           `bson:"priority"`
+	TS       int64              `bson:"ts"`
+}
+
+func (b legacyQueuedBackup) job() QueuedJob {
+	cmd := Cmd{Cmd: CmdBackup, Backup: b.Backup}
+	return QueuedJob{
+		ID:       b.ID,
+		Name:     cmd.JobName(),
+		Type:     cmd.Cmd,
+		Cmd:      cmd,
+		Priority: b.Priority,
+		TS:       b.TS,
+	}
+}
+
+// migrateQueue converts the backups queued by the older versions into the
+// jobs, keeping their place in the queue. It has to be done before the
+// unique index on the job name is built, they have no name.
+func (p *PBM) migrateQueue() error {
+	cur, err := p.Conn.Database(DB).Collection(QueueCollection).Find(
+		p.ctx,
+		bson.D{{"name", bson.M{"$exists": false}}, {"backup", bson.M{"$exists": true}}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "query")
+	}
+	defer cur.Close(p.ctx)
+
+	for cur.Next(p.ctx) {
+		var b legacyQueuedBackup
+		err := cur.Decode(&b)
+		if err != nil {
+			return errors.Wrap(err, "decode")
+		}
+		_, err = p.Conn.Database(DB).Collection(QueueCollection).ReplaceOne(
+			p.ctx,
+			bson.D{{"_id", b.ID}, {"name", bson.M{"$exists": false}}},
+			b.job(),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "replace queued backup %s", b.Backup.Name)
+		}
+	}
+	return cur.Err()
+}
@@ -0,0 +1,38 @@
+package pbm
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLegacyQueuedBackup(t *testing.T) {
+	id := primitive.NewObjectID()
+	// the document queued by the version which has queued only the backups
+	raw, err := bson.Marshal(bson.D{
+		{"_id", id},
+		{"backup", bson.D{{"name", "2020-01-01T00:00:00Z"}, {"compression", "gzip"}}},
+		{"priority", int(PriorityOnDemand)},
+		{"ts", int64(100)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b legacyQueuedBackup
+	err = bson.Unmarshal(raw, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := b.job()
+	if j.ID != id || j.Name != "2020-01-01T00:00:00Z" || j.Type != CmdBackup || j.Priority != PriorityOnDemand || j.TS != 100 {
+		t.Errorf("got job %+v", j)
+	}
+	if j.Cmd.Cmd != CmdBackup || j.Cmd.Backup.Compression != CompressionTypeGZIP {
+		t.Errorf("got job's command %+v", j.Cmd)
+	}
+	if l := j.Lock(); l.BackupName != "2020-01-01T00:00:00Z" {
+		t.Errorf("got job's lock %+v", l)
+	}
+}
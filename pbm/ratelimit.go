@@ -0,0 +1,232 @@
+package pbm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxRatePeriod is the longest period the rate is limited over,
+// the requests are kept for that long
+const MaxRatePeriod = time.Hour * 24 * 7
+
+// CmdRegister is the agent's registration accounted by the rate limit
+const CmdRegister Command = "register"
+
+// anonymous is the user of the command sent by the connection
+// which isn't authenticated
+const anonymous = "<anonymous>"
+
+// RateLimitConf defines the limits of the requests the users make and of
+// the agents registrations. The users are the MongoDB users pbm connects
+// as. The limits are enforced by the agents, so the commands the agents
+// send themselves (the scheduled backups and verifications, the restarts
+// of the failed backups) are accounted for the agents' user. No limits are
+// applied by default.
+//
+// The user is the one the client stamps on the command (see Cmd.User),
+// the agents can't tell who has written the command document. So the
+// limits guard against the runaway scripts and the operators' mistakes,
+// not against the user who can write into the PBM control collections:
+// such user can send the commands in the name of anyone. The access to
+// the admin database has to be restricted by the MongoDB roles instead.
+type RateLimitConf struct {
+	// Requests are the per-user limits of the commands,
+	// e.g. 2 restores per hour
+	Requests []RateLimit `bson:"requests,omitempty" json:"requests,omitempty" yaml:"requests,omitempty"`
+	// Registrations limits the agent registrations (starts) of each node,
+	// e.g. to keep the crash-looping agent from flooding the cluster
+	Registrations RateLimit `bson:"registrations,omitempty" json:"registrations,omitempty" yaml:"registrations,omitempty"`
+}
+
+// RateLimit is the max number of the requests in the period
+type RateLimit struct {
+	// Cmd is the command limited, any command if empty
+	Cmd       Command `bson:"cmd,omitempty" json:"cmd,omitempty" yaml:"cmd,omitempty"`
+	Max       int     `bson:"max" json:"max" yaml:"max"`
+	PeriodSec int     `bson:"periodSec" json:"periodSec" yaml:"periodSec"`
+}
+
+// Period returns the period the rate is limited over
+func (l RateLimit) Period() time.Duration {
+	p := time.Duration(l.PeriodSec) * time.Second
+	if p > MaxRatePeriod {
+		return MaxRatePeriod
+	}
+	return p
+}
+
+// enabled returns true if the limit applies
+func (l RateLimit) enabled() bool {
+	return l.Max > 0 && l.PeriodSec > 0
+}
+
+// RateLimitError is returned when the request is over the limit
+type RateLimitError struct {
+	Cmd   Command
+	Who   string
+	Limit RateLimit
+	// RetryAt is the time the request fits into the limit again
+	RetryAt time.Time
+}
+
+func (e RateLimitError) Error() string {
+	what := "requests"
+	if e.Limit.Cmd != "" {
+		what = string(e.Limit.Cmd) + " requests"
+	}
+	return fmt.Sprintf("rate limit exceeded for %s: %d %s per %v, retry after %s",
+		e.Who, e.Limit.Max, what, e.Limit.Period(), e.RetryAt.Format(time.RFC3339))
+}
+
+// rateWindow is the requests counted by the limit in its fixed
+// window, it's the atomic counter of the requests
+type rateWindow struct {
+	ID string `bson:"_id"`
+	// Reqs are the IDs of the requests counted
+	Reqs []string `bson:"reqs"`
+	// TS is the window start, the records expire by it
+	TS time.Time `bson:"ts"`
+}
+
+// rateLimited returns true if the command is accounted by the limits
+func rateLimited(cmd Command) bool {
+	switch cmd {
+	case CmdBackup, CmdRestore, CmdDeleteBackup, CmdVerify:
+		return true
+	}
+	return false
+}
+
+// applied returns the limits which apply to the command
+func applied(limits []RateLimit, cmd Command) []RateLimit {
+	var apply []RateLimit
+	for _, l := range limits {
+		if l.enabled() && (l.Cmd == "" || l.Cmd == cmd) {
+			apply = append(apply, l)
+		}
+	}
+	return apply
+}
+
+// window returns the ID and the start of the limit's window `ts` is in
+func (l RateLimit) window(who string, ts time.Time) (string, time.Time) {
+	start := ts.Truncate(l.Period()).UTC()
+	return fmt.Sprintf("%s/%s/%d/%d", who, l.Cmd, l.PeriodSec, start.Unix()), start
+}
+
+// CheckRequestRate checks the command requested by the user the
+// connection is authenticated as fits into the limits. It returns
+// RateLimitError if any of the limits is exceeded. The request isn't
+// accounted, the agents account the command they get (see AccountRequest),
+// the check only spares sending the command which is to be refused.
+func (p *PBM) CheckRequestRate(limits []RateLimit, cmd Command) error {
+	apply := applied(limits, cmd)
+	if len(apply) == 0 || !rateLimited(cmd) {
+		return nil
+	}
+
+	who := p.user()
+	now := time.Now().UTC()
+	for _, l := range apply {
+		id, start := l.window(who, now)
+		var w rateWindow
+		err := p.Conn.Database(DB).Collection(RequestsCollection).FindOne(p.ctx, bson.D{{"_id", id}}).Decode(&w)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "get requests")
+		}
+		if len(w.Reqs) >= l.Max {
+			return RateLimitError{Cmd: cmd, Who: who, Limit: l, RetryAt: start.Add(l.Period())}
+		}
+	}
+	return nil
+}
+
+// AccountRequest accounts the command against the limits of the user who
+// has sent it. It returns RateLimitError if any of the limits is exceeded,
+// the command isn't accounted then. The agents of all nodes account the
+// command they get, it's counted once. The user is taken from the command
+// as is, see RateLimitConf on why it isn't verified.
+func (p *PBM) AccountRequest(limits []RateLimit, cmd Cmd) error {
+	apply := applied(limits, cmd.Cmd)
+	if len(apply) == 0 || !rateLimited(cmd.Cmd) {
+		return nil
+	}
+
+	who := cmd.User
+	if who == "" {
+		who = anonymous
+	}
+	return p.account(apply, cmd.Cmd, cmd.ID.Hex(), who, time.Unix(cmd.TS, 0))
+}
+
+// CheckRegistrationRate accounts the registration of the agent of the
+// node `who` against the limit. The limit is per node, so the restart
+// of all the nodes isn't locked out by the others.
+func (p *PBM) CheckRegistrationRate(l RateLimit, who string) error {
+	if !l.enabled() {
+		return nil
+	}
+	l.Cmd = CmdRegister
+	return p.account([]RateLimit{l}, CmdRegister, primitive.NewObjectID().Hex(), who, time.Now())
+}
+
+// account adds the request `id` made at `ts` to the windows of the limits.
+// The request is added only if it's already there or the window isn't
+// full, so the concurrent requests can't exceed the limit.
+func (p *PBM) account(limits []RateLimit, cmd Command, id, who string, ts time.Time) error {
+	c := p.Conn.Database(DB).Collection(RequestsCollection)
+	var added []string
+	for _, l := range limits {
+		wid, start := l.window(who, ts)
+		f := bson.D{
+			{"_id", wid},
+			{"$or", bson.A{
+				bson.M{"reqs": id},
+				bson.M{fmt.Sprintf("reqs.%d", l.Max-1): bson.M{"$exists": false}},
+			}},
+		}
+		upd := bson.D{
+			{"$addToSet", bson.M{"reqs": id}},
+			{"$setOnInsert", bson.M{"ts": start}},
+		}
+		_, err := c.UpdateOne(p.ctx, f, upd, options.Update().SetUpsert(true))
+		if err != nil && strings.Contains(err.Error(), "E11000 duplicate key error") {
+			// the window is full or has been created by the concurrent request
+			var res *mongo.UpdateResult
+			res, err = c.UpdateOne(p.ctx, f, upd)
+			if err == nil && res.MatchedCount == 0 {
+				p.unaccount(added, id)
+				return RateLimitError{Cmd: cmd, Who: who, Limit: l, RetryAt: start.Add(l.Period())}
+			}
+		}
+		if err != nil {
+			p.unaccount(added, id)
+			return errors.Wrap(err, "account request")
+		}
+		added = append(added, wid)
+	}
+	return nil
+}
+
+// unaccount removes the refused request from the windows
+// it has been added to
+func (p *PBM) unaccount(windows []string, id string) {
+	if len(windows) == 0 {
+		return
+	}
+	p.Conn.Database(DB).Collection(RequestsCollection).UpdateMany(
+		p.ctx,
+		bson.D{{"_id", bson.M{"$in": windows}}},
+		bson.D{{"$pull", bson.M{"reqs": id}}},
+	)
+}
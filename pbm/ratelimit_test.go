@@ -0,0 +1,45 @@
+package pbm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateWindow(t *testing.T) {
+	l := RateLimit{Cmd: CmdRestore, Max: 2, PeriodSec: 3600}
+	ts := time.Date(2020, 1, 1, 10, 20, 0, 0, time.UTC)
+
+	// the agents of all nodes get the same command, they count it in the same window
+	id, start := l.window("alice@admin", ts)
+	id2, _ := l.window("alice@admin", ts.Add(time.Minute*30))
+	if id != id2 {
+		t.Errorf("the requests of the same hour are in the windows %s and %s", id, id2)
+	}
+	if want := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("got window start %v, want %v", start, want)
+	}
+	if id3, _ := l.window("alice@admin", ts.Add(time.Hour)); id3 == id {
+		t.Error("the requests of the next hour are in the same window")
+	}
+	if id4, _ := l.window("bob@admin", ts); id4 == id {
+		t.Error("the requests of another user are in the same window")
+	}
+}
+
+func TestRateLimitsApplied(t *testing.T) {
+	limits := []RateLimit{
+		{Cmd: CmdRestore, Max: 2, PeriodSec: 3600},
+		{Max: 10, PeriodSec: 3600},
+		// disabled
+		{Cmd: CmdBackup, PeriodSec: 3600},
+	}
+	if got := applied(limits, CmdRestore); len(got) != 2 {
+		t.Errorf("restore: got %d limits, want 2", len(got))
+	}
+	if got := applied(limits, CmdBackup); len(got) != 1 || got[0].Cmd != "" {
+		t.Errorf("backup: got limits %v, want the one of any command", got)
+	}
+	if rateLimited(CmdBackupRetention) || !rateLimited(CmdVerify) {
+		t.Error("only the commands the users request are limited")
+	}
+}
@@ -0,0 +1,121 @@
+package pbm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RegistrationConf defines the agents registration by the pre-generated
+// tokens, e.g. put into the secrets by the deployment automation. The agent
+// started with the token may serve only the replset the token is bound
+// to. Any agent is let in if there are no tokens.
+//
+// The tokens are kept in the AgentTokensCollection rather than in the
+// config, so the users who set the config and send the commands can't
+// add or drop them unless they're granted the write on that collection.
+type RegistrationConf struct {
+	Tokens []AgentToken
+}
+
+// AgentToken is the registration token of the agents. Only its hash is kept.
+type AgentToken struct {
+	// SHA256 is the hex encoded SHA-256 hash of the token
+	SHA256 string `bson:"_id" json:"sha256"`
+	// Replset is the replset the agents with the token may serve
+	Replset string `bson:"replset" json:"replset"`
+	Comment string `bson:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// NewAgentToken returns the random registration token
+func NewAgentToken() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "read random")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashAgentToken returns the hash the token is kept in the db by
+func HashAgentToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Required returns true if the agents have to be started with the token
+func (c RegistrationConf) Required() bool {
+	return len(c.Tokens) > 0
+}
+
+// Check returns an error if the agent with the token may not serve the replset
+func (c RegistrationConf) Check(token, rs string) error {
+	if !c.Required() {
+		return nil
+	}
+	if token == "" {
+		return errors.New("the cluster requires the agents registration token, start the agent with --token")
+	}
+
+	h := HashAgentToken(strings.TrimSpace(token))
+	var bound []string
+	for _, t := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(strings.ToLower(t.SHA256))) != 1 {
+			continue
+		}
+		if t.Replset == rs {
+			return nil
+		}
+		bound = append(bound, t.Replset)
+	}
+	if len(bound) == 0 {
+		return errors.New("the registration token isn't known to the cluster")
+	}
+	return errors.Errorf("the registration token is bound to the replset %s, the node is of %s", strings.Join(bound, ", "), rs)
+}
+
+// GetRegistration returns the registration tokens known to the cluster
+func (p *PBM) GetRegistration() (RegistrationConf, error) {
+	var c RegistrationConf
+	cur, err := p.Conn.Database(DB).Collection(AgentTokensCollection).Find(p.ctx, bson.M{})
+	if err != nil {
+		return c, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	for cur.Next(p.ctx) {
+		var t AgentToken
+		err := cur.Decode(&t)
+		if err != nil {
+			return c, errors.Wrap(err, "message decode")
+		}
+		c.Tokens = append(c.Tokens, t)
+	}
+	return c, cur.Err()
+}
+
+// AddAgentToken adds the token hash to the known ones
+func (p *PBM) AddAgentToken(t AgentToken) error {
+	t.SHA256 = strings.ToLower(t.SHA256)
+	_, err := p.Conn.Database(DB).Collection(AgentTokensCollection).InsertOne(p.ctx, t)
+	return errors.Wrap(err, "write into db")
+}
+
+// RevokeAgentToken removes the tokens which hash starts with the
+// prefix. It returns the number of the tokens removed.
+func (p *PBM) RevokeAgentToken(prefix string) (int, error) {
+	res, err := p.Conn.Database(DB).Collection(AgentTokensCollection).DeleteMany(
+		p.ctx,
+		bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(strings.ToLower(prefix))}},
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "delete from db")
+	}
+	return int(res.DeletedCount), nil
+}
@@ -0,0 +1,28 @@
+package pbm
+
+import "testing"
+
+func TestRegistrationCheck(t *testing.T) {
+	token, err := NewAgentToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := RegistrationConf{Tokens: []AgentToken{{SHA256: HashAgentToken(token), Replset: "rs0"}}}
+
+	if err := c.Check(token, "rs0"); err != nil {
+		t.Errorf("token of the replset: unexpected error: %v", err)
+	}
+	if err := c.Check(token, "rs1"); err == nil {
+		t.Error("expected error for the token of another replset")
+	}
+	if err := c.Check("", "rs0"); err == nil {
+		t.Error("expected error for the agent without the token")
+	}
+	// the hash itself isn't the token
+	if err := c.Check(HashAgentToken(token), "rs0"); err == nil {
+		t.Error("expected error for the token hash used as the token")
+	}
+	if err := (RegistrationConf{}).Check("", "rs0"); err != nil {
+		t.Errorf("no tokens: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package pbm
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v2"
+)
+
+// RehearsalConf defines how the agent launches the throwaway mongod
+// the backup is restored into. Either Mongod or DockerImage has to be set.
+type RehearsalConf struct {
+	// Mongod is the path to the mongod binary on the agents' hosts
+	Mongod string `bson:"mongod,omitempty" json:"mongod,omitempty" yaml:"mongod,omitempty"`
+	// DockerImage is the mongod image (e.g. percona/percona-server-mongodb:4.2)
+	// run with the docker CLI on the agents' hosts
+	DockerImage string `bson:"dockerImage,omitempty" json:"dockerImage,omitempty" yaml:"dockerImage,omitempty"`
+	// DataDir is where the data directory of the mongod is created.
+	// Defaults to the system temp dir.
+	DataDir string `bson:"dataDir,omitempty" json:"dataDir,omitempty" yaml:"dataDir,omitempty"`
+	// Port of the mongod. Defaults to a random free port.
+	Port int `bson:"port,omitempty" json:"port,omitempty" yaml:"port,omitempty"`
+	// StartTimeoutSec is how long to wait for the mongod to accept
+	// connections. Default is 60 sec.
+	StartTimeoutSec int `bson:"startTimeoutSec,omitempty" json:"startTimeoutSec,omitempty" yaml:"startTimeoutSec,omitempty"`
+}
+
+// StartTimeout returns how long to wait for the throwaway mongod to start
+func (c RehearsalConf) StartTimeout() time.Duration {
+	if c.StartTimeoutSec <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.StartTimeoutSec) * time.Second
+}
+
+// RehearsalCheck is the user's validation query run against the restored data.
+// It counts the documents of the collection matching the filter.
+type RehearsalCheck struct {
+	Name       string `bson:"name" json:"name" yaml:"name"`
+	DB         string `bson:"db" json:"db" yaml:"db"`
+	Collection string `bson:"collection" json:"collection" yaml:"collection"`
+	// Filter is the query in the extended JSON. Empty means all documents.
+	Filter string `bson:"filter,omitempty" json:"filter,omitempty" yaml:"filter,omitempty"`
+	// MinCount and MaxCount are the bounds of the expected count.
+	// Not set MaxCount means no upper bound.
+	MinCount int64  `bson:"minCount" json:"minCount" yaml:"minCount"`
+	MaxCount *int64 `bson:"maxCount,omitempty" json:"maxCount,omitempty" yaml:"maxCount,omitempty"`
+}
+
+// Match returns true if the count is within the check's bounds
+func (c RehearsalCheck) Match(count int64) bool {
+	return count >= c.MinCount && (c.MaxCount == nil || count <= *c.MaxCount)
+}
+
+// ParseFilter returns the check's filter as a document
+func (c RehearsalCheck) ParseFilter() (bson.D, error) {
+	f := bson.D{}
+	if strings.TrimSpace(c.Filter) == "" {
+		return f, nil
+	}
+	err := bson.UnmarshalExtJSON([]byte(c.Filter), false, &f)
+	return f, err
+}
+
+// ParseRehearsalChecks parses and validates the YAML list of checks
+func ParseRehearsalChecks(buf []byte) ([]RehearsalCheck, error) {
+	var checks []RehearsalCheck
+	err := yaml.UnmarshalStrict(buf, &checks)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal yaml")
+	}
+
+	for i, c := range checks {
+		if c.Name == "" {
+			return nil, errors.Errorf("check %d: name is not set", i)
+		}
+		if c.DB == "" || c.Collection == "" {
+			return nil, errors.Errorf("check %s: db and collection should be set", c.Name)
+		}
+		if _, err := c.ParseFilter(); err != nil {
+			return nil, errors.Wrapf(err, "check %s: bad filter", c.Name)
+		}
+		if c.MaxCount != nil && *c.MaxCount < c.MinCount {
+			return nil, errors.Errorf("check %s: maxCount is less than minCount", c.Name)
+		}
+	}
+
+	return checks, nil
+}
+
+// RehearsalCmd is the command to restore the backup
+// into a throwaway mongod and validate the data
+type RehearsalCmd struct {
+	Name    string           `bson:"name"`
+	Backup  string           `bson:"backup"`
+	Replset string           `bson:"replset,omitempty"`
+	Checks  []RehearsalCheck `bson:"checks,omitempty"`
+}
+
+// RehearsalCheckResult is the outcome of the check
+type RehearsalCheckResult struct {
+	Name  string `bson:"name" json:"name"`
+	Count int64  `bson:"count" json:"count"`
+	OK    bool   `bson:"ok" json:"ok"`
+	Error string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// RehearsalMeta is the state and the results of the restore rehearsal
+type RehearsalMeta struct {
+	Name     string                 `bson:"name" json:"name"`
+	Backup   string                 `bson:"backup" json:"backup"`
+	Replset  string                 `bson:"replset" json:"replset"`
+	Node     string                 `bson:"node" json:"node"`
+	StartTS  int64                  `bson:"start_ts" json:"start_ts"`
+	FinishTS int64                  `bson:"finish_ts,omitempty" json:"finish_ts,omitempty"`
+	Status   Status                 `bson:"status" json:"status"`
+	Error    string                 `bson:"error,omitempty" json:"error,omitempty"`
+	Checks   []RehearsalCheckResult `bson:"checks,omitempty" json:"checks,omitempty"`
+}
+
+// Passed returns true if the rehearsal is done and all checks are passed
+func (m *RehearsalMeta) Passed() bool {
+	if m.Status != StatusDone {
+		return false
+	}
+	for _, c := range m.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PBM) SetRehearsalMeta(m *RehearsalMeta) error {
+	_, err := p.Conn.Database(DB).Collection(RehearsalCollection).InsertOne(p.ctx, m)
+	return err
+}
+
+// FinishRehearsal sets the final state and the checks results of the rehearsal
+func (p *PBM) FinishRehearsal(name string, status Status, errStr string, checks []RehearsalCheckResult) error {
+	_, err := p.Conn.Database(DB).Collection(RehearsalCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$set", bson.M{
+			"status":    status,
+			"error":     errStr,
+			"checks":    checks,
+			"finish_ts": time.Now().UTC().Unix(),
+		}}},
+	)
+	return err
+}
+
+func (p *PBM) GetRehearsalMeta(name string) (*RehearsalMeta, error) {
+	m := &RehearsalMeta{}
+	res := p.Conn.Database(DB).Collection(RehearsalCollection).FindOne(p.ctx, bson.D{{"name", name}})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return m, nil
+		}
+		return nil, errors.Wrap(res.Err(), "get")
+	}
+	err := res.Decode(m)
+	return m, errors.Wrap(err, "decode")
+}
+
+// RehearsalsList returns the last rehearsals, the latest first
+func (p *PBM) RehearsalsList(limit int64) ([]RehearsalMeta, error) {
+	cur, err := p.Conn.Database(DB).Collection(RehearsalCollection).Find(
+		p.ctx,
+		bson.M{},
+		options.Find().SetLimit(limit).SetSort(bson.D{{"start_ts", -1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	rhs := []RehearsalMeta{}
+	for cur.Next(p.ctx) {
+		m := RehearsalMeta{}
+		err := cur.Decode(&m)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		rhs = append(rhs, m)
+	}
+
+	return rhs, cur.Err()
+}
@@ -0,0 +1,83 @@
+// Package rehearsal tests the backups by restoring them into a throwaway
+// mongod launched on the agent's host and validating the restored data
+// with the user's queries.
+package rehearsal
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+// Run restores the backup's replset into the throwaway mongod, runs the
+// checks against it and tears the mongod down. The outcome is recorded
+// in the rehearsal's metadata.
+func Run(cn *pbm.PBM, node string, cmd pbm.RehearsalCmd) (err error) {
+	meta := &pbm.RehearsalMeta{
+		Name:    cmd.Name,
+		Backup:  cmd.Backup,
+		Replset: cmd.Replset,
+		Node:    node,
+		StartTS: time.Now().UTC().Unix(),
+		Status:  pbm.StatusRunning,
+	}
+	err = cn.SetRehearsalMeta(meta)
+	if err != nil {
+		return errors.Wrap(err, "write rehearsal meta to db")
+	}
+
+	var checks []pbm.RehearsalCheckResult
+	defer func() {
+		status, estr := pbm.Status(pbm.StatusDone), ""
+		if err != nil {
+			status, estr = pbm.StatusError, err.Error()
+		}
+		ferr := cn.FinishRehearsal(cmd.Name, status, estr, checks)
+		if ferr != nil {
+			log.Printf("[ERROR] rehearsal: save results: %v", ferr)
+		}
+	}()
+
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+
+	ctx, cancel := context.WithCancel(cn.Context())
+	defer cancel()
+
+	sb, mcn, err := startSandbox(ctx, cfg.Rehearsal, "pbm-rehearsal-"+cmd.Name)
+	if err != nil {
+		return errors.Wrap(err, "start mongod")
+	}
+	defer sb.stop()
+	defer mcn.Disconnect(ctx)
+	log.Printf("rehearsal: mongod started on %s", sb.uri())
+
+	err = restore.New(cn, pbm.NewNode(ctx, "rehearsal", mcn, sb.uri())).Standalone(cmd.Backup, cmd.Replset)
+	if err != nil {
+		return errors.Wrap(err, "restore")
+	}
+	log.Printf("rehearsal: backup %s/%s restored, running %d checks", cmd.Backup, cmd.Replset, len(cmd.Checks))
+
+	for _, c := range cmd.Checks {
+		res := pbm.RehearsalCheckResult{Name: c.Name}
+		f, err := c.ParseFilter()
+		if err == nil {
+			res.Count, err = mcn.Database(c.DB).Collection(c.Collection).CountDocuments(ctx, f)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.OK = c.Match(res.Count)
+		}
+		checks = append(checks, res)
+	}
+
+	return nil
+}
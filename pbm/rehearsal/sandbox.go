@@ -0,0 +1,176 @@
+package rehearsal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// sandbox is the throwaway standalone mongod the backup is restored into
+type sandbox struct {
+	name string
+	dir  string
+	port int
+	// either the local process or the docker container
+	proc      *exec.Cmd
+	exited    chan error
+	container string
+	stderr    bytes.Buffer
+}
+
+// startSandbox launches the mongod defined by the config and
+// waits until it accepts connections
+func startSandbox(ctx context.Context, conf pbm.RehearsalConf, name string) (*sandbox, *mongo.Client, error) {
+	if conf.Mongod == "" && conf.DockerImage == "" {
+		return nil, nil, errors.New("neither rehearsal.mongod nor rehearsal.dockerImage is set in the config")
+	}
+
+	s := &sandbox{name: name, port: conf.Port}
+	if s.port == 0 {
+		p, err := freePort()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "find free port")
+		}
+		s.port = p
+	}
+
+	var err error
+	if conf.DockerImage != "" {
+		err = s.startContainer(conf.DockerImage)
+	} else {
+		err = s.startProcess(conf.Mongod, conf.DataDir)
+	}
+	if err != nil {
+		s.stop()
+		return nil, nil, err
+	}
+
+	cn, err := s.connect(ctx, conf.StartTimeout())
+	if err != nil {
+		s.stop()
+		return nil, nil, err
+	}
+
+	return s, cn, nil
+}
+
+func (s *sandbox) startProcess(mongod, dataDir string) error {
+	dir, err := ioutil.TempDir(dataDir, "pbm-rehearsal-")
+	if err != nil {
+		return errors.Wrap(err, "create data dir")
+	}
+	s.dir = dir
+
+	s.proc = exec.Command(mongod,
+		"--dbpath", dir,
+		"--port", strconv.Itoa(s.port),
+		"--bind_ip", "127.0.0.1",
+		"--logpath", filepath.Join(dir, "mongod.log"),
+	)
+	s.proc.Stderr = &s.stderr
+	err = s.proc.Start()
+	if err != nil {
+		return errors.Wrapf(err, "start %s", mongod)
+	}
+
+	s.exited = make(chan error, 1)
+	go func() { s.exited <- s.proc.Wait() }()
+	return nil
+}
+
+func (s *sandbox) startContainer(image string) error {
+	s.container = s.name
+	out, err := exec.Command("docker", "run", "--detach", "--rm",
+		"--name", s.container,
+		"--publish", fmt.Sprintf("127.0.0.1:%d:27017", s.port),
+		image,
+	).CombinedOutput()
+	if err != nil {
+		s.container = ""
+		return errors.Wrapf(err, "run container: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (s *sandbox) uri() string {
+	return fmt.Sprintf("mongodb://127.0.0.1:%d", s.port)
+}
+
+// connect waits until the mongod accepts connections
+func (s *sandbox) connect(ctx context.Context, timeout time.Duration) (*mongo.Client, error) {
+	cn, err := mongo.NewClient(options.Client().ApplyURI(s.uri()).SetAppName("pbm-rehearsal").SetDirect(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "create mongo client")
+	}
+	err = cn.Connect(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo connect")
+	}
+
+	tk := time.NewTicker(time.Second * 1)
+	defer tk.Stop()
+	tout := time.NewTimer(timeout)
+	defer tout.Stop()
+	for {
+		select {
+		case <-tk.C:
+			pctx, cancel := context.WithTimeout(ctx, time.Second*1)
+			err = cn.Ping(pctx, nil)
+			cancel()
+			if err == nil {
+				return cn, nil
+			}
+		case err := <-s.exited:
+			cn.Disconnect(ctx)
+			return nil, errors.Errorf("mongod has exited: %v: %s", err, bytes.TrimSpace(s.stderr.Bytes()))
+		case <-tout.C:
+			cn.Disconnect(ctx)
+			return nil, errors.Errorf("mongod isn't ready in %v: %v", timeout, err)
+		}
+	}
+}
+
+// stop kills the mongod and removes its data
+func (s *sandbox) stop() {
+	if s.container != "" {
+		out, err := exec.Command("docker", "rm", "--force", s.container).CombinedOutput()
+		if err != nil {
+			log.Printf("[WARNING] rehearsal: remove container %s: %v: %s", s.container, err, bytes.TrimSpace(out))
+		}
+	}
+	if s.proc != nil && s.proc.Process != nil {
+		err := s.proc.Process.Kill()
+		if err == nil {
+			<-s.exited
+		}
+	}
+	if s.dir != "" {
+		err := os.RemoveAll(s.dir)
+		if err != nil {
+			log.Printf("[WARNING] rehearsal: remove data dir %s: %v", s.dir, err)
+		}
+	}
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -20,6 +20,19 @@ type RestoreMeta struct {
 	Status           Status              `bson:"status" json:"status"`
 	Conditions       []Condition         `bson:"conditions" json:"conditions"`
 	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
+	// Warnings are the problems which don't fail the restore
+	// but have to be fixed by hand (e.g. cluster settings mismatch)
+	Warnings []string `bson:"warnings,omitempty" json:"warnings,omitempty"`
+	// TraceID is the ID of the restore's trace
+	TraceID string `bson:"trace_id,omitempty" json:"trace_id,omitempty"`
+	// SnapshotTS is the cluster time of the external snapshot the oplog
+	// of the backups is replayed over, zero for the restore of the backup
+	SnapshotTS primitive.Timestamp `bson:"snapshot_ts,omitempty" json:"snapshot_ts,omitempty"`
+	// SafetyBackup is the backup taken right before the restore
+	// the cluster can be rolled back to
+	SafetyBackup string `bson:"safety_backup,omitempty" json:"safety_backup,omitempty"`
+	// GridFS are the results of the GridFS buckets check of the sharded cluster made via mongos
+	GridFS []GridFSCheck `bson:"gridfs,omitempty" json:"gridfs,omitempty"`
 }
 
 type RestoreReplset struct {
@@ -30,6 +43,8 @@ type RestoreReplset struct {
 	LastWriteTS      primitive.Timestamp `bson:"last_write_ts" json:"last_write_ts"`
 	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
 	Conditions       []Condition         `bson:"conditions" json:"conditions"`
+	// GridFS are the results of the restored GridFS buckets check
+	GridFS []GridFSCheck `bson:"gridfs,omitempty" json:"gridfs,omitempty"`
 }
 
 func (p *PBM) SetRestoreMeta(m *RestoreMeta) error {
@@ -121,6 +136,43 @@ func (p *PBM) ChangeRestoreRSState(name string, rsName string, s Status, msg str
 	return err
 }
 
+// SetRestoreGridFS writes the results of the cluster-wide GridFS buckets check
+func (p *PBM) SetRestoreGridFS(name string, checks []GridFSCheck) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{
+			{"$set", bson.M{"gridfs": checks}},
+		},
+	)
+
+	return err
+}
+
+// SetRestoreRSGridFS writes the results of the replset's GridFS buckets check
+func (p *PBM) SetRestoreRSGridFS(name string, rsName string, checks []GridFSCheck) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.gridfs": checks}},
+		},
+	)
+
+	return err
+}
+
+// AddRestoreWarnings appends the warnings to the restore
+func (p *PBM) AddRestoreWarnings(name string, warns []string) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$push", bson.M{"warnings": bson.M{"$each": warns}}}},
+	)
+
+	return err
+}
+
 func (p *PBM) RestoresList(limit int64) ([]RestoreMeta, error) {
 	cur, err := p.Conn.Database(DB).Collection(RestoresCollection).Find(
 		p.ctx,
@@ -0,0 +1,124 @@
+package restore
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// archiveReader is the decompressed archive (dump or oplog) of the backup.
+// The file read from the storage is hashed on the way if the backup has
+// its checksum, see Verify.
+type archiveReader struct {
+	io.ReadCloser
+	// raw is the rest of the stored file (the compressed one)
+	raw io.Reader
+	cs  *pbm.Checksummer
+	sum pbm.FileChecksum
+}
+
+// Verify reads the rest of the stored file and checks it against the
+// checksum recorded by the backup, so the tampered or corrupted file
+// fails the restore. It's called once the archive has been read.
+// Nothing is checked if the file has no checksum (the dedup layout or
+// the backups made before the checksums).
+func (a *archiveReader) Verify() error {
+	if a.cs == nil {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, a.raw)
+	if err != nil {
+		return errors.Wrap(err, "read the rest of the file")
+	}
+	return errors.Wrap(a.cs.Check(a.sum), "checksum")
+}
+
+// openArchive returns the reader of the decompressed archive (dump or oplog) of the backup
+func openArchive(stg pbm.Storage, bcp *pbm.BackupMeta, name string) (*archiveReader, *pbm.ArchiveHeader, error) {
+	if bcp.Dedup {
+		r, hdr, err := SourceDedup(stg, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &archiveReader{ReadCloser: r}, hdr, nil
+	}
+
+	a := &archiveReader{}
+	var tee io.Writer
+	for _, rs := range bcp.Replsets {
+		if sum, ok := rs.FindChecksum(name); ok {
+			a.cs, a.sum = pbm.NewChecksummer(name, 0), sum
+			tee = a.cs
+			break
+		}
+	}
+
+	r, rc, hdr, err := source(stg, name, bcp.Compression, true, tee)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.ReadCloser, a.raw = r, r
+	if rc != nil {
+		a.ReadCloser = readCloser{Reader: r, Closer: multiCloser{r, rc}}
+		if raw, ok := rc.(io.Reader); ok {
+			a.raw = raw
+		}
+	}
+	return a, hdr, nil
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ReadArchive parses the mongodump archive and calls fn for every
+// document in it. The archive prelude is returned.
+func ReadArchive(r io.Reader, fn func(ns string, doc bson.Raw) error) (*archive.Prelude, error) {
+	prelude := &archive.Prelude{}
+	err := prelude.Read(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read prelude")
+	}
+
+	parser := archive.Parser{In: r}
+	err = parser.ReadAllBlocks(&archiveConsumer{fn: fn})
+	if err != nil {
+		return nil, errors.Wrap(err, "read archive")
+	}
+
+	return prelude, nil
+}
+
+type archiveConsumer struct {
+	fn func(ns string, doc bson.Raw) error
+	ns string
+}
+
+func (c *archiveConsumer) HeaderBSON(data []byte) error {
+	h := archive.NamespaceHeader{}
+	err := bson.Unmarshal(data, &h)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal namespace header")
+	}
+	c.ns = h.Database + "." + h.Collection
+	return nil
+}
+
+func (c *archiveConsumer) BodyBSON(data []byte) error {
+	return c.fn(c.ns, bson.Raw(data))
+}
+
+func (c *archiveConsumer) End() error { return nil }
@@ -0,0 +1,160 @@
+package restore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestArchiveVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbm-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const name = "bcp_rs0.dump.gz"
+	data := strings.Repeat("some dump data ", 1000)
+
+	file := &bytes.Buffer{}
+	err = pbm.WriteArchiveHeader(file, pbm.NewArchiveHeader(pbm.ArchiveTypeDump, "bcp", "rs0", pbm.CompressionTypeGZIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(file)
+	gw.Write([]byte(data))
+	gw.Close()
+
+	cs := pbm.NewChecksummer(name, 0)
+	cs.Write(file.Bytes())
+
+	stg := pbm.Storage{Type: pbm.StorageFilesystem, Filesystem: pbm.Filesystem{Path: dir}}
+	bcp := &pbm.BackupMeta{
+		Name:        "bcp",
+		Compression: pbm.CompressionTypeGZIP,
+		Replsets:    []pbm.BackupReplset{{Name: "rs0", Checksums: []pbm.FileChecksum{cs.Sum()}}},
+	}
+
+	read := func(t *testing.T, n int64) error {
+		r, _, err := openArchive(stg, bcp, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		// the consumer may not read the archive till the end
+		_, err = io.CopyN(ioutil.Discard, r, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Verify()
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name), file.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int64{10, int64(len(data))} {
+		if err := read(t, n); err != nil {
+			t.Errorf("read %d bytes: unexpected error: %v", n, err)
+		}
+	}
+
+	tampered := append([]byte{}, file.Bytes()...)
+	tampered[len(tampered)-1] ^= 0xff
+	err = ioutil.WriteFile(filepath.Join(dir, name), tampered, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read(t, 10); err == nil {
+		t.Error("expected checksum error for the tampered file")
+	}
+}
+
+func TestCheckArchiveCollCompression(t *testing.T) {
+	bcp := &pbm.BackupMeta{
+		Name:        "bcp",
+		Compression: pbm.CompressionTypeGZIP,
+		Replsets: []pbm.BackupReplset{{
+			Name: "rs0",
+			Compressions: []pbm.CollCompression{
+				{NS: "db.images", Ratio: 0.99, Compression: pbm.CompressionTypeNone},
+				{NS: "db.users", Ratio: 0.2, Compression: pbm.CompressionTypeGZIP},
+			},
+		}},
+	}
+
+	hdr := func(compression pbm.CompressionType, nss ...string) *pbm.ArchiveHeader {
+		h := pbm.NewArchiveHeader(pbm.ArchiveTypeDump, "bcp", "rs0", compression)
+		h.Namespaces = nss
+		return h
+	}
+
+	if err := checkArchive(hdr(pbm.CompressionTypeNone, "db.images"), pbm.ArchiveTypeDump, bcp, "rs0"); err != nil {
+		t.Errorf("uncompressed dump of the incompressible collection: unexpected error: %v", err)
+	}
+	if err := checkArchive(hdr(pbm.CompressionTypeNone, "db.users"), pbm.ArchiveTypeDump, bcp, "rs0"); err == nil {
+		t.Error("expected compression mismatch for the compressible collection")
+	}
+	if err := checkArchive(hdr(pbm.CompressionTypeNone, "db.images", "db.users"), pbm.ArchiveTypeDump, bcp, "rs0"); err == nil {
+		t.Error("expected compression mismatch for the node's dump")
+	}
+}
+
+func TestRestoreReplacedBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbm-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the backup run with --allow-overwrite under the staged name
+	const staged, name = "bcp.staged", "bcp"
+	const file = "bcp.staged_rs0.dump.gz"
+	buf := &bytes.Buffer{}
+	err = pbm.WriteArchiveHeader(buf, pbm.NewArchiveHeader(pbm.ArchiveTypeDump, staged, "rs0", pbm.CompressionTypeGZIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(buf)
+	gw.Write([]byte("some dump data"))
+	gw.Close()
+	err = ioutil.WriteFile(filepath.Join(dir, file), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stg := pbm.Storage{Type: pbm.StorageFilesystem, Filesystem: pbm.Filesystem{Path: dir}}
+	// the metadata as RenameBackup leaves it once the old backup is replaced
+	bcp := &pbm.BackupMeta{
+		Name:        name,
+		StagedName:  staged,
+		Compression: pbm.CompressionTypeGZIP,
+		Replsets:    []pbm.BackupReplset{{Name: "rs0", DumpName: file}},
+	}
+
+	r, hdr, err := openArchive(stg, bcp, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := checkArchive(hdr, pbm.ArchiveTypeDump, bcp, "rs0"); err != nil {
+		t.Errorf("restore of the replaced backup: unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "some dump data" {
+		t.Errorf("got %q, %v, want the dump data", data, err)
+	}
+
+	other := *bcp
+	other.StagedName = ""
+	if err := checkArchive(hdr, pbm.ArchiveTypeDump, &other, "rs0"); err == nil {
+		t.Error("expected error for the archive of another backup")
+	}
+}
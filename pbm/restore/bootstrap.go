@@ -0,0 +1,170 @@
+package restore
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// Bootstrap restores the backup (data and oplog) into the node on its own,
+// without any coordination with other agents. It's meant to be run on
+// a freshly initiated replica set which has no running agents yet.
+func (r *Restore) Bootstrap(bcpName string) error {
+	im, err := r.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster data")
+	}
+	if !im.IsMaster {
+		return errors.New("node is not a primary")
+	}
+
+	_, err = r.restoreLocal(bcpName, im.SetName)
+	return err
+}
+
+// restoreLocal restores the data and the oplog of the given replset
+// from the backup into the node. It returns the backup's metadata.
+func (r *Restore) restoreLocal(bcpName, rsName string) (*pbm.BackupMeta, error) {
+	stg, err := r.cn.GetStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup store")
+	}
+	cfg, err := r.cn.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	r.signing = cfg.Signing
+
+	bcp, err := GetMeta(r.cn, bcpName, stg)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup metadata")
+	}
+
+	return bcp, r.restoreRS(bcp, stg, rsName)
+}
+
+// restoreRS restores the data and the oplog of the given replset
+// from the backup into the node
+func (r *Restore) restoreRS(bcp *pbm.BackupMeta, stg pbm.Storage, rsName string) error {
+	if bcp.Status != pbm.StatusDone {
+		return errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	}
+
+	err := CheckSignature(r.signing, stg, bcp)
+	if err != nil {
+		return errors.Wrap(err, "check signature")
+	}
+
+	rsBackup, err := backupRS(bcp, rsName)
+	if err != nil {
+		return err
+	}
+	if len(bcp.Replsets) > 1 {
+		log.Printf("[WARNING] backup '%s' is of a sharded cluster, only replset %s is going to be restored", bcp.Name, rsName)
+	}
+
+	_, err = r.checkBuild(bcp, rsBackup)
+	if err != nil {
+		return errors.Wrap(err, "check compatibility")
+	}
+
+	ver, err := r.node.GetMongoVersion()
+	if err != nil || len(ver.Version) < 1 {
+		return errors.Wrap(err, "define mongo version")
+	}
+	preserveUUID := ver.Version[0] >= 4
+
+	err = r.restoreData(bcp, rsBackup, stg, preserveUUID)
+	if err != nil {
+		return err
+	}
+	log.Println("mongorestore finished")
+
+	log.Println("starting the oplog replay")
+	err = r.restoreOplog(bcp, rsBackup, stg, ver, preserveUUID)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(r.checkCapped(rsBackup.Collections), "check capped collections")
+}
+
+func backupRS(bcp *pbm.BackupMeta, rsName string) (pbm.BackupReplset, error) {
+	var names []string
+	for _, v := range bcp.Replsets {
+		if v.Name == rsName {
+			return v, nil
+		}
+		names = append(names, v.Name)
+	}
+	return pbm.BackupReplset{}, errors.Errorf("backup has no data for replset %s, available: %v", rsName, names)
+}
+
+// Standalone restores the backup's data and oplog of the replset into the
+// standalone node, e.g. the throwaway one of the restore rehearsal
+func (r *Restore) Standalone(bcpName, rsName string) error {
+	im, err := r.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster data")
+	}
+	if !im.IsStandalone() {
+		return errors.New("node should be started as a standalone (without --replSet)")
+	}
+
+	_, err = r.restoreLocal(bcpName, rsName)
+	return err
+}
+
+// Offline restores the replset's data from the backup and replays its oplog
+// (up to `until` if it's set) into the node when there is no cluster and no
+// agents left: the storage and the backup's metadata are given rather than
+// read from the PBM collections and no PBM state is written. The node
+// should be a primary or a standalone.
+//
+// The restored data is consistent only as of the backup's ConsistentTS (the
+// end of the replset's dump for the backups made before it's recorded),
+// so `until` can't be earlier. Nor it can be past the backup's oplog.
+func (r *Restore) Offline(stg pbm.Storage, bcp *pbm.BackupMeta, rsName string, until primitive.Timestamp) error {
+	im, err := r.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster data")
+	}
+	if !im.IsMaster && !im.IsStandalone() {
+		return errors.New("node is neither a primary nor a standalone")
+	}
+
+	if until.T > 0 {
+		rs, err := backupRS(bcp, rsName)
+		if err != nil {
+			return err
+		}
+		if rs.OplogName == "" {
+			return errors.New("backup has no oplog, it can be restored only as of its end")
+		}
+		if bcp.ConsistentTS.T > 0 && primitive.CompareTimestamp(until, bcp.ConsistentTS) < 0 {
+			return errors.Errorf("the data is consistent since %d,%d, can't restore to an earlier time",
+				bcp.ConsistentTS.T, bcp.ConsistentTS.I)
+		}
+		for _, c := range rs.Conditions {
+			if bcp.ConsistentTS.T == 0 && c.Status == pbm.StatusDumpDone && int64(until.T) < c.Timestamp {
+				return errors.Errorf("the data is consistent since the end of the dump at %s, can't restore to an earlier time",
+					time.Unix(c.Timestamp, 0).UTC().Format(time.RFC3339))
+			}
+		}
+		if primitive.CompareTimestamp(until, rs.LastWriteTS) > 0 {
+			return errors.Errorf("backup's oplog ends at %d,%d", rs.LastWriteTS.T, rs.LastWriteTS.I)
+		}
+	}
+	r.until = until
+
+	return r.restoreRS(bcp, stg, rsName)
+}
+
+// MetaFromStore reads the backup's metadata kept along with its files
+func MetaFromStore(stg pbm.Storage, bcpName string) (*pbm.BackupMeta, error) {
+	return getMetaFromStore(bcpName, stg)
+}
@@ -0,0 +1,111 @@
+package restore
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// errOplogOnly is returned by the reads of the dumps of the oplog-only backup
+var errOplogOnly = errors.New("the oplog-only backup has no dumps")
+
+// restoreData restores the replset's dumps of the backup. The oplog-only
+// backup has none, its oplog is replayed over the data restored by other means.
+func (r *Restore) restoreData(bcp *pbm.BackupMeta, rsBackup pbm.BackupReplset, stg pbm.Storage, preserveUUID bool) error {
+	switch bcp.Type {
+	case pbm.BackupTypeDifferential:
+		return r.restoreDiff(bcp, rsBackup, stg, preserveUUID)
+	case pbm.BackupTypeOplog:
+		log.Println("oplog-only backup, no dumps to restore")
+		return nil
+	}
+	return r.restoreFull(bcp, rsBackup, stg, nil, preserveUUID)
+}
+
+// restoreFull restores the replset's dump of the full backup except `exclude` namespaces.
+// Capped collections which were dumped once again are taken from their own dumps.
+func (r *Restore) restoreFull(bcp *pbm.BackupMeta, rsBackup pbm.BackupReplset, stg pbm.Storage, exclude []string, preserveUUID bool) error {
+	main := dumpUnit{
+		name:    rsBackup.DumpName,
+		exclude: append(redumpNS(rsBackup), exclude...),
+		what:    "the dump",
+	}
+	for _, c := range rsBackup.Collections {
+		main.size += c.Size
+	}
+
+	units := append([]dumpUnit{main}, redumpUnits(rsBackup, exclude)...)
+	return r.restoreUnits(bcp, rsBackup.Name, units, stg, preserveUUID)
+}
+
+// redumpUnits returns the separate dumps of the collections (the wrapped capped
+// ones and the namesakes of the skipped ones) except `exclude` namespaces
+func redumpUnits(rsBackup pbm.BackupReplset, exclude []string) []dumpUnit {
+	skip := make(map[string]struct{}, len(exclude))
+	for _, ns := range exclude {
+		skip[ns] = struct{}{}
+	}
+
+	colls := collsInfo(rsBackup)
+	var units []dumpUnit
+	for _, rd := range rsBackup.Redumps {
+		if _, ok := skip[rd.NS]; ok {
+			continue
+		}
+		units = append(units, newDumpUnit(rd.Name, "the collection "+rd.NS, []string{rd.NS}, colls))
+	}
+
+	return units
+}
+
+func redumpNS(rs pbm.BackupReplset) []string {
+	nss := make([]string, 0, len(rs.Redumps))
+	for _, rd := range rs.Redumps {
+		nss = append(nss, rd.NS)
+	}
+	return nss
+}
+
+// checkCapped makes sure the restored collections which were capped
+// at the time of the backup are capped, converting them otherwise
+func (r *Restore) checkCapped(colls []pbm.NSInfo) error {
+	for _, c := range colls {
+		if !c.Capped || c.View {
+			continue
+		}
+		if r.tf != nil && r.tf.dropped(c.NS) {
+			continue
+		}
+
+		db, coll := splitNS(c.NS)
+		cur, err := r.node.Session().Database(db).ListCollections(r.cn.Context(), bson.D{{"name", coll}})
+		if err != nil {
+			return errors.Wrapf(err, "list collection %s", c.NS)
+		}
+		var info []struct {
+			Options struct {
+				Capped bool `bson:"capped"`
+			} `bson:"options"`
+		}
+		err = cur.All(r.cn.Context(), &info)
+		if err != nil {
+			return errors.Wrapf(err, "decode collection %s info", c.NS)
+		}
+		if len(info) == 0 || info[0].Options.Capped {
+			continue
+		}
+
+		log.Printf("[WARNING] collection %s was restored uncapped, converting it to capped (size %d)", c.NS, c.CappedSize)
+		err = r.node.Session().Database(db).RunCommand(r.cn.Context(),
+			bson.D{{"convertToCapped", coll}, {"size", c.CappedSize}},
+		).Err()
+		if err != nil {
+			return errors.Wrapf(err, "convert %s to capped", c.NS)
+		}
+	}
+
+	return nil
+}
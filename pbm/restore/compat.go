@@ -0,0 +1,32 @@
+package restore
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkBuild prints the versions the replset's backup was made with and
+// checks the node can restore it. The differences which don't prevent
+// the restore are returned as the warnings.
+func (r *Restore) checkBuild(bcp *pbm.BackupMeta, rs pbm.BackupReplset) ([]string, error) {
+	if rs.Build == nil {
+		log.Printf("backup '%s' of %s has no build info, made by PBM before it was recorded (MongoDB %s)", bcp.Name, rs.Name, bcp.MongoVersion)
+		return nil, nil
+	}
+
+	cur, err := r.node.BuildInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "get node build info")
+	}
+	log.Printf("backup '%s' of %s is made on %s by %s", bcp.Name, rs.Name, rs.Build.Node, rs.Build)
+	log.Printf("restoring on %s by %s", cur.Node, cur)
+
+	warns, err := pbm.CheckCompat(*rs.Build, cur)
+	for _, w := range warns {
+		log.Println("[WARNING]", w)
+	}
+	return warns, err
+}
@@ -0,0 +1,181 @@
+package restore
+
+import (
+	"sort"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// NSStat is the namespace stats in the backup
+type NSStat struct {
+	Replset string
+	NS      string
+	Count   int64
+	Size    int64
+	// Exact is true if the stats were obtained by reading the dump
+	Exact bool
+}
+
+// Contents returns namespaces of the backup with their document counts and sizes.
+// By default stats are taken from the backup metadata (collStats at the moment
+// of the backup) or, for backups without such info, only namespaces are read from
+// the dumps prelude. With `scan` the dumps are read entirely to get the exact stats.
+// The dumps of the schema-only backup are always read as they have no documents
+// but the users, roles and sharding metadata.
+func Contents(cn *pbm.PBM, bcpName string, scan bool) ([]NSStat, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup store")
+	}
+
+	bcp, err := GetMeta(cn, bcpName, stg)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup metadata")
+	}
+	if bcp.Type == pbm.BackupTypeOplog {
+		return nil, errOplogOnly
+	}
+
+	var stats []NSStat
+	for _, rs := range bcp.Replsets {
+		if rs.Status == pbm.StatusError {
+			continue
+		}
+
+		var rstats []NSStat
+		switch {
+		case scan, bcp.Type == pbm.BackupTypeSchema:
+			rstats, err = scanContents(cn, stg, bcp, rs)
+		case len(rs.Collections) > 0:
+			for _, c := range rs.Collections {
+				rstats = append(rstats, NSStat{NS: c.NS, Count: c.Count, Size: c.Size})
+			}
+		default:
+			rstats, err = preludeContents(stg, bcp, rs)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "replset %s", rs.Name)
+		}
+
+		sort.Slice(rstats, func(i, j int) bool { return rstats[i].NS < rstats[j].NS })
+		for i := range rstats {
+			rstats[i].Replset = rs.Name
+		}
+		stats = append(stats, rstats...)
+	}
+
+	return stats, nil
+}
+
+func preludeContents(stg pbm.Storage, bcp *pbm.BackupMeta, rs pbm.BackupReplset) ([]NSStat, error) {
+	if bcp.Type == pbm.BackupTypeDifferential {
+		return nil, errors.New("no collections info in the differential backup")
+	}
+
+	r, _, err := openArchive(stg, bcp, rs.DumpName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open dump %s", rs.DumpName)
+	}
+	defer r.Close()
+
+	prelude := &archive.Prelude{}
+	err = prelude.Read(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read prelude of %s", rs.DumpName)
+	}
+
+	var stats []NSStat
+	for _, m := range prelude.NamespaceMetadatas {
+		stats = append(stats, NSStat{NS: m.Database + "." + m.Collection})
+	}
+	return stats, nil
+}
+
+// scanContents reads all dumps of the replset counting documents and bytes.
+// For the differential backup unchanged collections are counted from the base.
+func scanContents(cn *pbm.PBM, stg pbm.Storage, bcp *pbm.BackupMeta, rs pbm.BackupReplset) ([]NSStat, error) {
+	stats := make(map[string]*NSStat)
+	count := func(filter func(ns string) bool) func(ns string, doc bson.Raw) error {
+		return func(ns string, doc bson.Raw) error {
+			if filter != nil && !filter(ns) {
+				return nil
+			}
+			s, ok := stats[ns]
+			if !ok {
+				s = &NSStat{NS: ns, Exact: true}
+				stats[ns] = s
+			}
+			s.Count++
+			s.Size += int64(len(doc))
+			return nil
+		}
+	}
+
+	// capped collections which were dumped once again
+	// are counted from their own dumps only
+	read := func(b *pbm.BackupMeta, brs pbm.BackupReplset, dumps []string, filter func(ns string) bool) error {
+		redumped := make(map[string]bool, len(brs.Redumps))
+		for _, rd := range brs.Redumps {
+			redumped[rd.NS] = true
+		}
+		for _, d := range dumps {
+			err := readDump(stg, b, d, "", count(func(ns string) bool {
+				return !redumped[ns] && (filter == nil || filter(ns))
+			}))
+			if err != nil {
+				return errors.Wrapf(err, "read dump %s", d)
+			}
+		}
+		for _, rd := range brs.Redumps {
+			err := readDump(stg, b, rd.Name, rd.NS, count(filter))
+			if err != nil {
+				return errors.Wrapf(err, "read dump %s", rd.Name)
+			}
+		}
+		return nil
+	}
+
+	if bcp.Type != pbm.BackupTypeDifferential {
+		err := read(bcp, rs, []string{rs.DumpName}, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := read(bcp, rs, rs.DiffDumps, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		fromBase := make(map[string]bool)
+		for _, c := range rs.Collections {
+			fromBase[c.NS] = true
+		}
+		for _, c := range rs.Changed {
+			delete(fromBase, c)
+		}
+
+		base, err := GetMeta(cn, bcp.Base, stg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get base backup %s metadata", bcp.Base)
+		}
+		for _, brs := range base.Replsets {
+			if brs.Name != rs.Name {
+				continue
+			}
+			err = read(base, brs, []string{brs.DumpName}, func(ns string) bool { return fromBase[ns] })
+			if err != nil {
+				return nil, errors.Wrap(err, "read base backup")
+			}
+		}
+	}
+
+	list := make([]NSStat, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, *s)
+	}
+	return list, nil
+}
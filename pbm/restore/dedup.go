@@ -0,0 +1,88 @@
+package restore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// SourceDedup returns the reader of the archive stored in the deduplicated
+// layout. The data is returned decompressed, chunks are verified against
+// their hashes. The archive header is stripped and returned separately.
+func SourceDedup(stg pbm.Storage, name string) (io.ReadCloser, *pbm.ArchiveHeader, error) {
+	ir, _, err := Source(stg, name, pbm.CompressionTypeNone)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open index")
+	}
+	defer ir.Close()
+
+	idx := pbm.DedupIndex{}
+	err = json.NewDecoder(ir).Decode(&idx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "decode index '%s'", name)
+	}
+
+	dr := &dedupReader{stg: stg, idx: idx}
+	hdr, data, err := pbm.ReadArchiveHeader(dr)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read header of '%s'", name)
+	}
+
+	return ioutil.NopCloser(data), hdr, nil
+}
+
+type dedupReader struct {
+	stg  pbm.Storage
+	idx  pbm.DedupIndex
+	next int
+	buf  bytes.Reader
+}
+
+func (d *dedupReader) Read(p []byte) (int, error) {
+	for d.buf.Len() == 0 {
+		if d.next >= len(d.idx.Chunks) {
+			return 0, io.EOF
+		}
+		err := d.load(d.idx.Chunks[d.next])
+		if err != nil {
+			return 0, err
+		}
+		d.next++
+	}
+
+	return d.buf.Read(p)
+}
+
+func (d *dedupReader) load(c pbm.DedupChunk) error {
+	blob := pbm.DedupBlobPath(c.Hash, d.idx.Compression)
+	r, rc, _, err := source(d.stg, blob, d.idx.Compression, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "open blob %s", blob)
+	}
+	defer func() {
+		r.Close()
+		if rc != nil {
+			rc.Close()
+		}
+	}()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "read blob %s", blob)
+	}
+
+	sum := sha256.Sum256(b)
+	if len(b) != c.Size || hex.EncodeToString(sum[:]) != c.Hash {
+		return errors.Errorf("blob %s is corrupted", blob)
+	}
+
+	d.buf.Reset(b)
+	return nil
+}
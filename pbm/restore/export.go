@@ -0,0 +1,163 @@
+package restore
+
+import (
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// ExportFormat is the output format of the exported documents
+type ExportFormat string
+
+const (
+	// ExportFormatBSON is the stream of BSON documents as in mongodump .bson files
+	ExportFormatBSON ExportFormat = "bson"
+	// ExportFormatJSON is the relaxed extended JSON document per line
+	ExportFormatJSON = "json"
+)
+
+// Export extracts documents of the namespace from the stored backup into w.
+// It reads the storage only, no mongod is needed to restore the data to.
+// With nil cn the backups metadata is read from the storage as well,
+// so no cluster is needed at all.
+// Returns the number of exported documents.
+func Export(cn *pbm.PBM, stg pbm.Storage, bcpName, ns string, format ExportFormat, w io.Writer) (int, error) {
+	bcp, err := GetMeta(cn, bcpName, stg)
+	if err != nil {
+		return 0, errors.Wrap(err, "get backup metadata")
+	}
+	if bcp.Status != pbm.StatusDone && bcp.Status != pbm.StatusPartlyDone {
+		return 0, errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	}
+	if bcp.Type == pbm.BackupTypeOplog {
+		return 0, errOplogOnly
+	}
+
+	cnt := 0
+	write := func(dns string, doc bson.Raw) error {
+		if dns != ns {
+			return nil
+		}
+
+		err := writeDoc(w, doc, format)
+		if err != nil {
+			return err
+		}
+		cnt++
+		return nil
+	}
+
+	for _, rs := range bcp.Replsets {
+		if rs.Status == pbm.StatusError {
+			log.Printf("[WARNING] skipping failed replset %s", rs.Name)
+			continue
+		}
+
+		dumps, err := nsDumps(cn, stg, bcp, rs, ns)
+		if err != nil {
+			return cnt, errors.Wrapf(err, "define dumps of replset %s", rs.Name)
+		}
+
+		for _, d := range dumps {
+			err = readDump(stg, d.bcp, d.name, ns, write)
+			if err != nil {
+				return cnt, errors.Wrapf(err, "read dump %s", d.name)
+			}
+		}
+	}
+
+	return cnt, nil
+}
+
+type dumpRef struct {
+	bcp  *pbm.BackupMeta
+	name string
+}
+
+// nsDumps returns the dumps which may contain the namespace data of the replset.
+// For differential backup it's either the backup's own dumps if the
+// namespace has changed or the base backup dump otherwise.
+func nsDumps(cn *pbm.PBM, stg pbm.Storage, bcp *pbm.BackupMeta, rs pbm.BackupReplset, ns string) ([]dumpRef, error) {
+	if name, ok := redumpOf(rs, ns); ok {
+		return []dumpRef{{bcp, name}}, nil
+	}
+	if bcp.Type != pbm.BackupTypeDifferential {
+		return []dumpRef{{bcp, rs.DumpName}}, nil
+	}
+
+	for _, c := range rs.Changed {
+		if c == ns {
+			var dumps []dumpRef
+			for _, d := range rs.DiffDumps {
+				dumps = append(dumps, dumpRef{bcp, d})
+			}
+			return dumps, nil
+		}
+	}
+
+	exists := false
+	for _, c := range rs.Collections {
+		if c.NS == ns {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	base, err := GetMeta(cn, bcp.Base, stg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get base backup %s metadata", bcp.Base)
+	}
+	for _, brs := range base.Replsets {
+		if brs.Name == rs.Name {
+			if name, ok := redumpOf(brs, ns); ok {
+				return []dumpRef{{base, name}}, nil
+			}
+			return []dumpRef{{base, brs.DumpName}}, nil
+		}
+	}
+
+	return nil, errors.Errorf("no replset %s in the base backup %s", rs.Name, base.Name)
+}
+
+// redumpOf returns the separate dump of the capped collection if there is one
+func redumpOf(rs pbm.BackupReplset, ns string) (string, bool) {
+	for _, rd := range rs.Redumps {
+		if rd.NS == ns {
+			return rd.Name, true
+		}
+	}
+	return "", false
+}
+
+// readDump reads the dump calling fn for every document. If `ns` is set
+// and the archive header shows there is no such namespace, the dump is skipped.
+func readDump(stg pbm.Storage, bcp *pbm.BackupMeta, name, ns string, fn func(ns string, doc bson.Raw) error) error {
+	r, hdr, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer r.Close()
+
+	if hdr != nil && ns != "" && len(hdr.Namespaces) > 0 {
+		found := false
+		for _, n := range hdr.Namespaces {
+			if n == ns {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	_, err = ReadArchive(r, fn)
+	return err
+}
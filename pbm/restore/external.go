@@ -0,0 +1,65 @@
+package restore
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// replaySlices replays the replset's oplog slices of the external restore
+// in order. The snapshot has the entries up to its cluster time and each
+// slice picks up after the previous one, so the overlaps aren't reapplied.
+func (r *Restore) replaySlices(ext *pbm.ExternalRestore, rsName string, stg pbm.Storage, ver *pbm.MongoVersion, preserveUUID bool) error {
+	defer func() { r.since, r.until = primitive.Timestamp{}, primitive.Timestamp{} }()
+
+	r.since, r.until = ext.SnapshotTS, ext.Until
+	n := 0
+	for _, s := range ext.Slices {
+		if s.Replset != rsName {
+			continue
+		}
+		n++
+
+		bcp, rs, err := r.backupOf(s.Backup, rsName, stg)
+		if err != nil {
+			return errors.Wrapf(err, "backup %s", s.Backup)
+		}
+		if rs.OplogName == "" {
+			return errors.Errorf("backup %s has no oplog", s.Backup)
+		}
+		_, err = r.checkBuild(bcp, rs)
+		if err != nil {
+			return errors.Wrapf(err, "check compatibility of %s", s.Backup)
+		}
+
+		rd, hdr, err := openArchive(stg, bcp, rs.OplogName)
+		if err != nil {
+			return errors.Wrapf(err, "open oplog %s", rs.OplogName)
+		}
+		err = checkArchive(hdr, pbm.ArchiveTypeOplog, bcp, rsName)
+		if err != nil {
+			rd.Close()
+			return errors.Wrapf(err, "check oplog %s", rs.OplogName)
+		}
+
+		log.Printf("replaying the oplog of %s after %d,%d", s.Backup, r.since.T, r.since.I)
+		err = r.applyOplog(ioutil.NopCloser(rd), ver, preserveUUID, nil, false)
+		if err == nil {
+			err = rd.Verify()
+		}
+		rd.Close()
+		if err != nil {
+			return errors.Wrapf(err, "replay oplog of %s", s.Backup)
+		}
+		r.since = s.Last
+	}
+	if n == 0 {
+		return errors.Errorf("no oplog slices for replset %s", rsName)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package restore
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// checkGridFS validates the restored GridFS buckets: chunks completeness and md5s.
+// Broken files don't fail the restore, they're reported in the log and the metadata.
+func (r *Restore) checkGridFS(name, rsName string) error {
+	colls, err := r.node.Collections()
+	if err != nil {
+		return errors.Wrap(err, "list collections")
+	}
+
+	// nothing else is written during the restore, and the
+	// md5 reads don't fit into the snapshot transaction anyway
+	checks, err := r.node.CheckGridFSBuckets(colls, true, false)
+	if err != nil {
+		return errors.Wrap(err, "check buckets")
+	}
+	for _, c := range checks {
+		if !c.OK() {
+			log.Printf("[WARNING] GridFS %s", c)
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(r.cn.SetRestoreRSGridFS(name, rsName, checks), "write check results")
+}
@@ -0,0 +1,300 @@
+package restore
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/mongodb/mongo-tools/mongorestore"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// BackupIndex is the index definition of the collection in the backup
+type BackupIndex struct {
+	NS   string
+	Name string
+	// Spec is the index document for the createIndexes command
+	Spec bson.D
+}
+
+// IndexStatus is the outcome of the index restore
+type IndexStatus string
+
+const (
+	IndexCreated IndexStatus = "created"
+	IndexExists  IndexStatus = "exists"
+	// IndexMissing means the index would have been created (the dry run)
+	IndexMissing IndexStatus = "missing"
+	// IndexNoColl means there is no such collection on the node
+	IndexNoColl IndexStatus = "no collection"
+	IndexFailed IndexStatus = "failed"
+)
+
+// IndexResult is the outcome of the restore of the backup index
+type IndexResult struct {
+	NS     string
+	Name   string
+	Status IndexStatus
+	Err    string
+}
+
+// Indexes returns the index definitions of the backup's collections read from
+// the dumps prelude. With `rsName` only the given replset's ones are returned.
+// For the differential backup the unchanged collections' ones are read from
+// the base backup. The indexes of the sharded collections are returned once.
+func Indexes(cn *pbm.PBM, bcpName, rsName string) ([]BackupIndex, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup store")
+	}
+
+	bcp, err := GetMeta(cn, bcpName, stg)
+	if err != nil {
+		return nil, errors.Wrap(err, "get backup metadata")
+	}
+	if bcp.Status != pbm.StatusDone {
+		return nil, errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	}
+	if bcp.Type == pbm.BackupTypeOplog {
+		return nil, errOplogOnly
+	}
+
+	found := false
+	idxs := make(map[string]BackupIndex)
+	for _, rs := range bcp.Replsets {
+		if rsName != "" && rs.Name != rsName {
+			continue
+		}
+		found = true
+
+		err = replsetIndexes(cn, stg, bcp, rs, idxs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replset %s", rs.Name)
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("no replset %s in the backup", rsName)
+	}
+
+	list := make([]BackupIndex, 0, len(idxs))
+	for _, i := range idxs {
+		list = append(list, i)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].NS != list[j].NS {
+			return list[i].NS < list[j].NS
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func replsetIndexes(cn *pbm.PBM, stg pbm.Storage, bcp *pbm.BackupMeta, rs pbm.BackupReplset, idxs map[string]BackupIndex) error {
+	dumps := []string{rs.DumpName}
+	if bcp.Type == pbm.BackupTypeDifferential {
+		dumps = rs.DiffDumps
+	}
+	for _, rd := range rs.Redumps {
+		dumps = append(dumps, rd.Name)
+	}
+	for _, d := range dumps {
+		err := preludeIndexes(stg, bcp, d, nil, idxs)
+		if err != nil {
+			return errors.Wrapf(err, "read dump %s", d)
+		}
+	}
+
+	if bcp.Type != pbm.BackupTypeDifferential {
+		return nil
+	}
+
+	fromBase := make(map[string]bool)
+	for _, c := range rs.Collections {
+		fromBase[c.NS] = true
+	}
+	for _, c := range rs.Changed {
+		delete(fromBase, c)
+	}
+
+	base, err := GetMeta(cn, bcp.Base, stg)
+	if err != nil {
+		return errors.Wrapf(err, "get base backup %s metadata", bcp.Base)
+	}
+	for _, brs := range base.Replsets {
+		if brs.Name != rs.Name {
+			continue
+		}
+		err = preludeIndexes(stg, base, brs.DumpName, func(ns string) bool { return fromBase[ns] }, idxs)
+		if err != nil {
+			return errors.Wrapf(err, "read base backup dump %s", brs.DumpName)
+		}
+	}
+
+	return nil
+}
+
+// preludeIndexes reads the index definitions of the `filter` collections
+// from the dump's prelude into `idxs`. The data isn't read.
+func preludeIndexes(stg pbm.Storage, bcp *pbm.BackupMeta, name string, filter func(ns string) bool, idxs map[string]BackupIndex) error {
+	r, _, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer r.Close()
+
+	prelude := &archive.Prelude{}
+	err = prelude.Read(r)
+	if err != nil {
+		return errors.Wrap(err, "read prelude")
+	}
+
+	for _, m := range prelude.NamespaceMetadatas {
+		ns := m.Database + "." + m.Collection
+		// the cluster's own collections are managed by the cluster
+		if m.Metadata == "" || m.Database == pbm.DB || m.Database == "config" || m.Database == "local" || strings.HasPrefix(m.Collection, "system.") {
+			continue
+		}
+		if filter != nil && !filter(ns) {
+			continue
+		}
+
+		meta := mongorestore.Metadata{}
+		err := bson.UnmarshalExtJSON([]byte(m.Metadata), true, &meta)
+		if err != nil {
+			return errors.Wrapf(err, "parse %s metadata", ns)
+		}
+
+		collation := false
+		for _, o := range meta.Options {
+			if o.Key == "collation" {
+				collation = true
+			}
+		}
+		for _, idx := range meta.Indexes {
+			i := backupIndex(ns, idx, collation)
+			if _, ok := idxs[i.NS+"."+i.Name]; !ok {
+				idxs[i.NS+"."+i.Name] = i
+			}
+		}
+	}
+
+	return nil
+}
+
+// backupIndex returns the index document as mongorestore creates it:
+// with no namespace and version and with the simple collation set
+// explicitly if the collection has the default one
+func backupIndex(ns string, idx mongorestore.IndexDocument, collation bool) BackupIndex {
+	i := BackupIndex{NS: ns}
+	i.Name, _ = idx.Options["name"].(string)
+
+	i.Spec = bson.D{{"key", idx.Key}}
+	opts := make([]string, 0, len(idx.Options))
+	for k := range idx.Options {
+		opts = append(opts, k)
+	}
+	sort.Strings(opts)
+	hasCollation := false
+	for _, k := range opts {
+		switch k {
+		case "ns", "v", "key":
+			continue
+		case "collation":
+			hasCollation = true
+		}
+		i.Spec = append(i.Spec, bson.E{k, idx.Options[k]})
+	}
+	if len(idx.PartialFilterExpression) > 0 {
+		i.Spec = append(i.Spec, bson.E{"partialFilterExpression", idx.PartialFilterExpression})
+	}
+	if collation && !hasCollation {
+		i.Spec = append(i.Spec, bson.E{"collation", bson.D{{"locale", "simple"}}})
+	}
+	return i
+}
+
+// RestoreIndexes creates the backup indexes missing on the node (mongos in the
+// sharded cluster). The data isn't touched: the indexes of the collections which
+// don't exist on the node are skipped. An index with the same name is considered
+// existing. With `dryRun` the missing indexes are only reported.
+func RestoreIndexes(ctx context.Context, node *pbm.Node, idxs []BackupIndex, dryRun bool) ([]IndexResult, error) {
+	byNS := make(map[string][]BackupIndex)
+	var nss []string
+	for _, i := range idxs {
+		if _, ok := byNS[i.NS]; !ok {
+			nss = append(nss, i.NS)
+		}
+		byNS[i.NS] = append(byNS[i.NS], i)
+	}
+
+	var res []IndexResult
+	for _, ns := range nss {
+		existing, ok, err := nodeIndexes(ctx, node, ns)
+		if err != nil {
+			return res, errors.Wrapf(err, "list indexes of %s", ns)
+		}
+
+		for _, i := range byNS[ns] {
+			r := IndexResult{NS: ns, Name: i.Name}
+			switch {
+			case !ok:
+				r.Status = IndexNoColl
+			case existing[i.Name]:
+				r.Status = IndexExists
+			case dryRun:
+				r.Status = IndexMissing
+			default:
+				r.Status = IndexCreated
+				err := createIndex(ctx, node, i)
+				if err != nil {
+					r.Status, r.Err = IndexFailed, err.Error()
+				}
+			}
+			res = append(res, r)
+		}
+	}
+
+	return res, nil
+}
+
+// nodeIndexes returns the names of the collection's indexes
+// and false if there is no such collection on the node
+func nodeIndexes(ctx context.Context, node *pbm.Node, ns string) (map[string]bool, bool, error) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return nil, false, errors.Errorf("bad namespace %s", ns)
+	}
+	db := node.Session().Database(ns[:i])
+
+	colls, err := db.ListCollectionNames(ctx, bson.D{{"name", ns[i+1:]}})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "list collections")
+	}
+	if len(colls) == 0 {
+		return nil, false, nil
+	}
+
+	cur, err := db.Collection(ns[i+1:]).Indexes().List(ctx)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "list indexes")
+	}
+	defer cur.Close(ctx)
+
+	names := make(map[string]bool)
+	for cur.Next(ctx) {
+		names[cur.Current.Lookup("name").StringValue()] = true
+	}
+	return names, true, cur.Err()
+}
+
+func createIndex(ctx context.Context, node *pbm.Node, i BackupIndex) error {
+	n := strings.Index(i.NS, ".")
+	return node.Session().Database(i.NS[:n]).RunCommand(ctx, bson.D{
+		{"createIndexes", i.NS[n+1:]},
+		{"indexes", []bson.D{i.Spec}},
+	}).Err()
+}
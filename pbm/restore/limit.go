@@ -0,0 +1,136 @@
+package restore
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// lagCheckInterval is how often the target's replication lag is checked
+const lagCheckInterval = time.Second * 5
+
+// limiter caps the pace of the restore into the live target: the rate
+// the dumps are read at, the rate the oplog entries are applied at, and
+// it pauses while the target's secondaries lag behind.
+type limiter struct {
+	node   *pbm.Node
+	bytes  *rateWindow
+	ops    *rateWindow
+	maxLag int
+
+	mu        sync.Mutex
+	lagUntil  time.Time
+	lagLogged bool
+}
+
+func newLimiter(node *pbm.Node, cfg pbm.RestoreConf) *limiter {
+	if cfg.MaxRateMB <= 0 && cfg.MaxOpsPerSec <= 0 && cfg.MaxReplLagSec <= 0 {
+		return nil
+	}
+	return &limiter{
+		node:   node,
+		bytes:  newRateWindow(int64(cfg.MaxRateMB) << 20),
+		ops:    newRateWindow(int64(cfg.MaxOpsPerSec)),
+		maxLag: cfg.MaxReplLagSec,
+	}
+}
+
+// reader returns the reader limited by the rate and the replication lag
+func (l *limiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return limitedReader{r, l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *limiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	// read by ~100ms of the rate so the sleeps are short
+	if max := lr.l.bytes.rate/10 + 1; lr.l.bytes.rate > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.bytes.wait(int64(n))
+	lr.l.yield()
+	return n, err
+}
+
+// op waits for the oplog entry to be applied
+func (l *limiter) op() {
+	if l == nil {
+		return
+	}
+	l.ops.wait(1)
+	l.yield()
+}
+
+// yield blocks while the secondaries lag behind more than allowed.
+// The lag is checked once in lagCheckInterval, the failure to get
+// it doesn't stop the restore.
+func (l *limiter) yield() {
+	if l.maxLag <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for time.Now().After(l.lagUntil) {
+		lag, err := l.node.SecondariesLag()
+		if err != nil {
+			log.Println("[WARNING] restore limit: get replication lag:", err)
+			l.lagUntil = time.Now().Add(lagCheckInterval)
+			return
+		}
+		if lag <= l.maxLag {
+			if l.lagLogged {
+				log.Printf("restore limit: replication lag %ds, resuming", lag)
+				l.lagLogged = false
+			}
+			l.lagUntil = time.Now().Add(lagCheckInterval)
+			return
+		}
+		if !l.lagLogged {
+			log.Printf("restore limit: replication lag %ds exceeds %ds, pausing", lag, l.maxLag)
+			l.lagLogged = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// rateWindow holds the pace at rate units per second
+type rateWindow struct {
+	mu    sync.Mutex
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newRateWindow(rate int64) *rateWindow {
+	return &rateWindow{rate: rate}
+}
+
+func (w *rateWindow) wait(n int64) {
+	if w.rate <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if time.Since(w.start) > time.Minute {
+		w.start = time.Now()
+		w.n = 0
+	}
+	w.n += n
+
+	ahead := time.Duration(float64(w.n)/float64(w.rate)*float64(time.Second)) - time.Since(w.start)
+	if ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
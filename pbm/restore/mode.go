@@ -0,0 +1,196 @@
+package restore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/mongodb/mongo-tools/mongorestore"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// tmpCollPrefix is the prefix of the temp collections the namespaces
+// restored in the merge and the replace modes go to. They are put over
+// the existing collections after the dump is restored.
+const tmpCollPrefix = "pbmRestore."
+
+// mergeBatch is the number of the documents written over the existing
+// collection at a time
+const mergeBatch = 1000
+
+// modeApplies returns false for the namespaces which are always restored
+// in the drop mode: the system collections and the internal databases
+func modeApplies(db, coll string) bool {
+	switch db {
+	case "admin", "config", "local":
+		return false
+	}
+	return !strings.HasPrefix(coll, "system.")
+}
+
+// mergedNS reads the prelude of the archive and returns the namespaces
+// of the archive restored not in the drop mode. The returned reader
+// is the whole archive.
+func (r *Restore) mergedNS(rd io.Reader) (io.Reader, []string, error) {
+	prelude := &archive.Prelude{}
+	err := prelude.Read(rd)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read prelude")
+	}
+	buf := &bytes.Buffer{}
+	err = prelude.Write(buf)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "write prelude")
+	}
+
+	var nss []string
+	for _, m := range prelude.NamespaceMetadatas {
+		ns := m.Database + "." + m.Collection
+		if modeApplies(m.Database, m.Collection) && r.mode(ns) != pbm.RestoreDrop {
+			nss = append(nss, ns)
+		}
+	}
+	return io.MultiReader(buf, rd), nss, nil
+}
+
+// restoreSplit restores the archive in two concurrent passes over the
+// same stream. The merged namespaces go to the temp collections with
+// the new UUIDs since the existing collections of an in-place restore
+// still hold the original ones. The rest of the archive is restored
+// preserving UUIDs if asked so.
+func (r *Restore) restoreSplit(rd io.Reader, exclude, merged []string, preserveUUID bool) error {
+	mainExclude := append([]string{}, exclude...)
+	var nsFrom, nsTo []string
+	for _, ns := range merged {
+		dbName, coll := splitNS(ns)
+		nsFrom = append(nsFrom, escapeNS(ns))
+		nsTo = append(nsTo, escapeNS(dbName+"."+tmpCollPrefix+coll))
+		mainExclude = append(mainExclude, escapeNS(ns))
+	}
+
+	pr, pw := io.Pipe()
+	mergedDone := make(chan error, 1)
+	go func() {
+		err := r.restorePass(pr, &mongorestore.NSOptions{
+			NSInclude: nsFrom,
+			NSExclude: exclude,
+			NSFrom:    nsFrom,
+			NSTo:      nsTo,
+		}, false)
+		if err == nil {
+			// the tail of the archive after the last namespace
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		// don't leave the main pass blocked on the write
+		pr.CloseWithError(err)
+		mergedDone <- err
+	}()
+
+	trd := io.TeeReader(rd, pw)
+	err := r.restorePass(trd, &mongorestore.NSOptions{NSExclude: mainExclude}, preserveUUID)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, trd)
+	}
+	pw.CloseWithError(err)
+
+	merr := <-mergedDone
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(merr, "restore merged namespaces")
+}
+
+// putOver puts the namespace restored into the temp collection over the
+// existing collection according to its mode. The temp collection is
+// renamed if there is no such collection. Otherwise its documents are
+// inserted (merge) or upserted (replace) by _id, the existing collection
+// keeps its indexes and options.
+func (r *Restore) putOver(ns string) error {
+	dbName, coll := splitNS(ns)
+	db := r.node.Session().Database(dbName)
+	ctx := r.node.Context()
+
+	names, err := db.ListCollectionNames(ctx, bson.D{{"name", coll}})
+	if err != nil {
+		return errors.Wrap(err, "list collections")
+	}
+	if len(names) == 0 {
+		err = r.node.Session().Database("admin").RunCommand(ctx, bson.D{
+			{"renameCollection", dbName + "." + tmpCollPrefix + coll},
+			{"to", ns},
+		}).Err()
+		return errors.Wrap(err, "rename temp collection")
+	}
+
+	mode := r.mode(ns)
+	tmp := db.Collection(tmpCollPrefix + coll)
+	cur, err := tmp.Find(ctx, bson.D{})
+	if err != nil {
+		return errors.Wrap(err, "read temp collection")
+	}
+	defer cur.Close(ctx)
+
+	var n, skipped int64
+	c := db.Collection(coll)
+	models := make([]mongo.WriteModel, 0, mergeBatch)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if res != nil {
+			n += res.InsertedCount + res.ModifiedCount + res.UpsertedCount
+		}
+		models = models[:0]
+		if err == nil {
+			return nil
+		}
+		bwe, ok := err.(mongo.BulkWriteException)
+		if !ok || mode != pbm.RestoreMerge || bwe.WriteConcernError != nil {
+			return err
+		}
+		for _, we := range bwe.WriteErrors {
+			if we.Code != 11000 {
+				return err
+			}
+		}
+		skipped += int64(len(bwe.WriteErrors))
+		return nil
+	}
+
+	for cur.Next(ctx) {
+		doc := append(bson.Raw(nil), cur.Current...)
+		if mode == pbm.RestoreReplace {
+			models = append(models, mongo.NewReplaceOneModel().
+				SetFilter(bson.D{{"_id", doc.Lookup("_id")}}).
+				SetReplacement(doc).
+				SetUpsert(true))
+		} else {
+			models = append(models, mongo.NewInsertOneModel().SetDocument(doc))
+		}
+		if len(models) == mergeBatch {
+			err = flush()
+			if err != nil {
+				return errors.Wrapf(err, "write into %s", ns)
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return errors.Wrap(err, "read temp collection")
+	}
+	err = flush()
+	if err != nil {
+		return errors.Wrapf(err, "write into %s", ns)
+	}
+	log.Printf("%s %s: %d documents written, %d skipped as existing", mode, ns, n, skipped)
+
+	return errors.Wrap(tmp.Drop(ctx), "drop temp collection")
+}
@@ -29,6 +29,12 @@ func init() {
 	}
 }
 
+// maxTxnBatch is the max size of the transaction's ops applied at
+// once, the applyOps command has to fit the max BSON document. The
+// larger transactions are applied by several applyOps, so they aren't
+// atomic and may be seen half applied until the last batch is done.
+const maxTxnBatch = 8 << 20
+
 // Oplog is the oplog applyer
 type Oplog struct {
 	dst               *pbm.Node
@@ -36,6 +42,22 @@ type Oplog struct {
 	txnBuffer         *txn.Buffer
 	needIdxWorkaround bool
 	preserveUUID      bool
+	tf                *transformer
+	// until is the timestamp the entries after which
+	// aren't applied, zero means all entries are
+	until primitive.Timestamp
+	// since is the timestamp the entries up to which (inclusive)
+	// aren't applied as the data already has them
+	since primitive.Timestamp
+	// exclude are the namespaces which entries aren't applied
+	exclude map[string]struct{}
+	// commandsOnly means only the commands (collections and indexes
+	// changes) are applied but not the documents writes
+	commandsOnly bool
+	// wc is the write concern of the applyOps, nil means the server's default
+	wc bson.D
+	// limit is the pace of the replay, nil means no limits
+	limit *limiter
 }
 
 // NewOplog creates an object for an oplog applying
@@ -50,12 +72,16 @@ func NewOplog(dst *pbm.Node, sv *pbm.MongoVersion, preserveUUID bool) *Oplog {
 
 // Apply applys an oplog from a given source
 func (o *Oplog) Apply(src io.ReadCloser) error {
-	bsonSource := db.NewDecodedBSONSource(db.NewBufferlessBSONSource(src))
+	bsrc := db.NewBufferlessBSONSource(src)
+	bsrc.SetMaxBSONSize(pbm.MaxOplogEntrySize)
+	bsonSource := db.NewDecodedBSONSource(bsrc)
 	defer bsonSource.Close()
 
 	o.txnBuffer = txn.NewBuffer()
 	defer o.txnBuffer.Stop()
 
+	// the last applied entry to point at the broken one
+	var last primitive.Timestamp
 	for {
 		rawOplogEntry := bsonSource.LoadNext()
 		if rawOplogEntry == nil {
@@ -64,7 +90,18 @@ func (o *Oplog) Apply(src io.ReadCloser) error {
 		oe := db.Oplog{}
 		err := bson.Unmarshal(rawOplogEntry, &oe)
 		if err != nil {
-			return errors.Wrap(err, "reading oplog")
+			return errors.Wrapf(err, "decode oplog entry of %d bytes after %v", len(rawOplogEntry), last)
+		}
+		if o.until.T > 0 && primitive.CompareTimestamp(oe.Timestamp, o.until) > 0 {
+			return nil
+		}
+		last = oe.Timestamp
+		if o.since.T > 0 && primitive.CompareTimestamp(oe.Timestamp, o.since) <= 0 {
+			err = o.skipTxnOp(oe)
+			if err != nil {
+				return errors.Wrapf(err, "skip the transaction entry %v", oe.Timestamp)
+			}
+			continue
 		}
 
 		if _, ok := skipNs[oe.Namespace]; ok {
@@ -75,6 +112,7 @@ func (o *Oplog) Apply(src io.ReadCloser) error {
 		if oe.Operation == "n" {
 			continue
 		}
+		o.limit.op()
 
 		meta, err := txn.NewMeta(oe)
 		if err != nil {
@@ -89,12 +127,14 @@ func (o *Oplog) Apply(src io.ReadCloser) error {
 		} else {
 			err = o.handleNonTxnOp(oe)
 			if err != nil {
-				return errors.Wrap(err, "applying an entry")
+				return errors.Wrapf(err, "applying an entry %v on %s", oe.Timestamp, oe.Namespace)
 			}
 		}
 	}
 
-	return nil
+	// the stream is cut on the malformed or oversized entry,
+	// it mustn't be taken as the end of the oplog
+	return errors.Wrapf(bsonSource.Err(), "read oplog entry after %v", last)
 }
 
 func (o *Oplog) handleTxnOp(meta txn.Meta, op db.Oplog) error {
@@ -117,7 +157,25 @@ func (o *Oplog) handleTxnOp(meta txn.Meta, op db.Oplog) error {
 
 	// From here, we're applying transaction entries
 	ops, errs := o.txnBuffer.GetTxnStream(meta)
+	err = o.applyTxn(ops, errs, o.applyOps)
+	if err != nil {
+		return err
+	}
 
+	err = o.txnBuffer.PurgeTxn(meta)
+	if err != nil {
+		return errors.Wrap(err, "cleaning up transaction buffer")
+	}
+
+	return nil
+}
+
+// applyTxn applies the transaction's ops by the applyOps batches. The
+// transaction up to maxTxnBatch is applied by the single applyOps, so
+// atomically, the larger one is split into the batches of up to that size.
+func (o *Oplog) applyTxn(ops <-chan db.Oplog, errs <-chan error, apply func([]interface{}) error) error {
+	var batch []interface{}
+	size := 0
 Loop:
 	for {
 		select {
@@ -125,10 +183,26 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			err = o.handleNonTxnOp(op)
+			op, ok, err := o.prepareOp(op)
+			if err != nil {
+				return errors.Wrapf(err, "prepare transaction op on %s", op.Namespace)
+			}
+			if !ok {
+				continue
+			}
+			raw, err := bson.Marshal(op)
 			if err != nil {
-				return errors.Wrap(err, "applying transaction op")
+				return errors.Wrap(err, "encode transaction op")
+			}
+			if len(batch) > 0 && size+len(raw) > maxTxnBatch {
+				err = apply(batch)
+				if err != nil {
+					return errors.Wrap(err, "applying transaction ops")
+				}
+				batch, size = nil, 0
 			}
+			batch = append(batch, bson.Raw(raw))
+			size += len(raw)
 		case err := <-errs:
 			if err != nil {
 				return errors.Wrap(err, "replaying transaction")
@@ -136,28 +210,92 @@ Loop:
 			break Loop
 		}
 	}
+	if len(batch) > 0 {
+		err := apply(batch)
+		if err != nil {
+			return errors.Wrap(err, "applying transaction ops")
+		}
+	}
+	return nil
+}
 
-	err = o.txnBuffer.PurgeTxn(meta)
+// skipTxnOp buffers the entry of the transaction preceding the restored
+// point. The data has the transactions committed by then, so they are
+// dropped, but the ones committed later need their head.
+func (o *Oplog) skipTxnOp(op db.Oplog) error {
+	meta, err := txn.NewMeta(op)
 	if err != nil {
-		return errors.Wrap(err, "cleaning up transaction buffer")
+		return errors.Wrap(err, "getting op metadata")
+	}
+	if !meta.IsTxn() {
+		return nil
 	}
 
+	err = o.txnBuffer.AddOp(meta, op)
+	if err != nil {
+		return errors.Wrap(err, "buffering entry")
+	}
+	if meta.IsFinal() {
+		return o.txnBuffer.PurgeTxn(meta)
+	}
 	return nil
 }
 
 func (o *Oplog) handleNonTxnOp(op db.Oplog) error {
+	op, ok, err := o.prepareOp(op)
+	if err != nil || !ok {
+		return err
+	}
+	return o.applyOps([]interface{}{stripSession(op)})
+}
+
+// stripSession removes the session of the retryable write from the entry.
+// The session isn't known to the target, the applyOps is rejected with it
+// by some versions. The sessions records are restored apart if needed.
+func stripSession(op db.Oplog) db.Oplog {
+	op.LSID, op.TxnNumber, op.PrevOpTime = nil, nil, nil
+	return op
+}
+
+// prepareOp filters and transforms the entry before it's applied.
+// False means the entry isn't applied.
+func (o *Oplog) prepareOp(op db.Oplog) (db.Oplog, bool, error) {
+	if _, ok := o.exclude[op.Namespace]; ok {
+		return op, false, nil
+	}
+	if o.commandsOnly && (op.Operation != "c" || isApplyOpsCmd(op.Object)) {
+		return op, false, nil
+	}
+
+	if o.tf != nil {
+		var (
+			ok  bool
+			err error
+		)
+		op, ok, err = o.tf.op(op)
+		if err != nil {
+			return op, false, errors.Wrap(err, "transform")
+		}
+		if !ok {
+			return op, false, nil
+		}
+	}
+
 	op, err := o.filterUUIDs(op)
 	if err != nil {
-		return errors.Wrap(err, "filtering UUIDs from oplog")
+		return op, false, errors.Wrap(err, "filtering UUIDs from oplog")
 	}
-
-	return o.applyOps([]interface{}{op})
+	return op, true, nil
 }
 
 // applyOps is a wrapper for the applyOps database command, we pass in
 // a session to avoid opening a new connection for a few inserts at a time.
 func (o *Oplog) applyOps(entries []interface{}) error {
-	singleRes := o.dst.Session().Database("admin").RunCommand(nil, bson.D{{"applyOps", entries}})
+	cmd := bson.D{{"applyOps", entries}}
+	if o.wc != nil {
+		cmd = append(cmd, bson.E{"writeConcern", o.wc})
+	}
+	singleRes := o.dst.Session().Database("admin").RunCommand(nil, cmd)
 	if err := singleRes.Err(); err != nil {
 		return errors.Wrap(err, "applyOps")
 	}
@@ -179,7 +317,7 @@ func (o *Oplog) filterUUIDs(op db.Oplog) (db.Oplog, error) {
 
 		// The createIndexes oplog command requires 'ui' for some server versions, so
 		// in that case we fall back to an old-style system.indexes insert.
-		if op.Operation == "c" && op.Object[0].Key == "createIndexes" && o.needIdxWorkaround {
+		if op.Operation == "c" && len(op.Object) > 0 && op.Object[0].Key == "createIndexes" && o.needIdxWorkaround {
 			return convertCreateIndexToIndexInsert(op)
 		}
 	}
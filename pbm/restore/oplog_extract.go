@@ -0,0 +1,248 @@
+package restore
+
+import (
+	"io"
+	"log"
+	"strings"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// OplogExtract defines what to extract from the stored oplog slices
+type OplogExtract struct {
+	From primitive.Timestamp
+	To   primitive.Timestamp
+	// NS is the namespace to extract, all if empty
+	NS string
+	// Replset to extract from, all if empty
+	Replset string
+	Format  ExportFormat
+}
+
+// ExtractOplog writes oplog entries from the stored oplog slices of all
+// backups which are in the given time range into w. Entries of different
+// replsets are written one replset after another. Returns the number of
+// written entries.
+func ExtractOplog(cn *pbm.PBM, opts OplogExtract, w io.Writer) (int, error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return 0, errors.Wrap(err, "get backup store")
+	}
+
+	bcps, err := cn.BackupsList(0)
+	if err != nil {
+		return 0, errors.Wrap(err, "get backups list")
+	}
+
+	// backups list goes from the newest
+	for i, j := 0, len(bcps)-1; i < j; i, j = i+1, j-1 {
+		bcps[i], bcps[j] = bcps[j], bcps[i]
+	}
+
+	// replset -> the end of the previous slice to detect gaps
+	covered := make(map[string]primitive.Timestamp)
+	cnt := 0
+	for i := range bcps {
+		bcp := &bcps[i]
+		if bcp.Status != pbm.StatusDone && bcp.Status != pbm.StatusPartlyDone {
+			continue
+		}
+		if primitive.CompareTimestamp(bcp.LastWriteTS, opts.From) == -1 {
+			continue
+		}
+
+		for _, rs := range bcp.Replsets {
+			if rs.Status == pbm.StatusError || rs.OplogName == "" || (opts.Replset != "" && rs.Name != opts.Replset) {
+				continue
+			}
+			first := rs.FirstWriteTS
+			if first.T == 0 {
+				first = primitive.Timestamp{T: uint32(rs.StartTS)}
+			}
+			if primitive.CompareTimestamp(first, opts.To) == 1 {
+				continue
+			}
+
+			from := opts.From
+			if last, ok := covered[rs.Name]; ok {
+				from = last
+			}
+			if primitive.CompareTimestamp(first, from) == 1 {
+				log.Printf("[WARNING] replset %s: no oplog for %v - %v", rs.Name, from, first)
+			}
+
+			n, err := extractSlice(stg, bcp, rs.OplogName, opts, w)
+			cnt += n
+			if err != nil {
+				return cnt, errors.Wrapf(err, "extract from %s", rs.OplogName)
+			}
+			covered[rs.Name] = bcp.LastWriteTS
+		}
+	}
+
+	for rs, last := range covered {
+		if primitive.CompareTimestamp(last, opts.To) == -1 {
+			log.Printf("[WARNING] replset %s: no oplog for %v - %v", rs, last, opts.To)
+		}
+	}
+
+	return cnt, nil
+}
+
+func extractSlice(stg pbm.Storage, bcp *pbm.BackupMeta, name string, opts OplogExtract, w io.Writer) (int, error) {
+	r, _, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return 0, errors.Wrap(err, "open")
+	}
+	defer r.Close()
+
+	src := db.NewBufferlessBSONSource(r)
+	src.SetMaxBSONSize(pbm.MaxOplogEntrySize)
+	cnt := 0
+	for {
+		raw := src.LoadNext()
+		if raw == nil {
+			break
+		}
+
+		var (
+			ets primitive.Timestamp
+			ok  bool
+		)
+		ets.T, ets.I, ok = bson.Raw(raw).Lookup("ts").TimestampOK()
+		if !ok {
+			return cnt, errors.New("oplog entry without ts")
+		}
+		if primitive.CompareTimestamp(ets, opts.From) == -1 {
+			continue
+		}
+		if primitive.CompareTimestamp(ets, opts.To) == 1 {
+			break
+		}
+
+		entry := bson.Raw(raw)
+		if opts.NS != "" {
+			entry, err = filterOplogEntry(entry, opts.NS)
+			if err != nil {
+				return cnt, errors.Wrapf(err, "filter entry %v", ets)
+			}
+			if entry == nil {
+				continue
+			}
+		}
+
+		err = writeDoc(w, entry, opts.Format)
+		if err != nil {
+			return cnt, errors.Wrap(err, "write entry")
+		}
+		cnt++
+	}
+
+	return cnt, errors.Wrap(src.Err(), "read oplog")
+}
+
+func writeDoc(w io.Writer, doc bson.Raw, format ExportFormat) error {
+	if format == ExportFormatJSON {
+		b, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			return errors.Wrap(err, "marshal to json")
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+
+	_, err := w.Write(doc)
+	return err
+}
+
+// filterOplogEntry returns the entry if it's related to the namespace.
+// For the applyOps (transactions) only related operations are left.
+// Returns nil if the entry isn't related.
+func filterOplogEntry(raw bson.Raw, ns string) (bson.Raw, error) {
+	op, _ := raw.Lookup("op").StringValueOK()
+	ens, _ := raw.Lookup("ns").StringValueOK()
+	if op != string(pbm.OperationCommand) {
+		if ens == ns {
+			return raw, nil
+		}
+		return nil, nil
+	}
+
+	e := bson.D{}
+	err := bson.Unmarshal(raw, &e)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	for i, el := range e {
+		if el.Key != "o" {
+			continue
+		}
+		o, ok := el.Value.(bson.D)
+		if !ok || len(o) == 0 {
+			return nil, nil
+		}
+
+		if o[0].Key != "applyOps" {
+			if cmdTouches(ens, o, ns) {
+				return raw, nil
+			}
+			return nil, nil
+		}
+
+		ops, _ := o[0].Value.(bson.A)
+		var keep bson.A
+		for _, iop := range ops {
+			d, ok := iop.(bson.D)
+			if !ok {
+				continue
+			}
+			b, err := bson.Marshal(d)
+			if err != nil {
+				return nil, errors.Wrap(err, "marshal applyOps entry")
+			}
+			f, err := filterOplogEntry(b, ns)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				keep = append(keep, d)
+			}
+		}
+		if len(keep) == 0 {
+			return nil, nil
+		}
+
+		o[0].Value = keep
+		e[i].Value = o
+		b, err := bson.Marshal(e)
+		return b, errors.Wrap(err, "marshal")
+	}
+
+	return nil, nil
+}
+
+// cmdTouches checks if the command (o) issued on the cmdNS (`db.$cmd`)
+// is related to the namespace
+func cmdTouches(cmdNS string, o bson.D, ns string) bool {
+	db := strings.TrimSuffix(cmdNS, ".$cmd")
+	switch o[0].Key {
+	case "renameCollection":
+		for _, e := range o {
+			if v, ok := e.Value.(string); ok && (e.Key == "renameCollection" || e.Key == "to") && v == ns {
+				return true
+			}
+		}
+		return false
+	case "dropDatabase":
+		return strings.HasPrefix(ns, db+".")
+	default:
+		coll, ok := o[0].Value.(string)
+		return ok && db+"."+coll == ns
+	}
+}
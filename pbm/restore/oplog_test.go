@@ -0,0 +1,155 @@
+package restore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// skippedEntry returns the entry of the namespace which isn't applied,
+// so the stream can be replayed without the node
+func skippedEntry(t *testing.T, ts uint32, o bson.D) []byte {
+	b, err := bson.Marshal(bson.D{
+		{"ts", primitive.Timestamp{T: ts}},
+		{"op", "i"},
+		{"ns", "config.system.sessions"},
+		{"o", o},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestApplyEdgeCaseEntries(t *testing.T) {
+	nested := bson.D{{"v", 1}}
+	for i := 0; i < 90; i++ {
+		nested = bson.D{{"n", nested}}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(skippedEntry(t, 1, bson.D{{"_id", 1}, {"data", strings.Repeat("x", 16<<20-64)}}))
+	buf.Write(skippedEntry(t, 2, bson.D{
+		{"_id", 2},
+		{"sym", primitive.Symbol("legacy")},
+		{"ptr", primitive.DBPointer{DB: "db.c", Pointer: primitive.NewObjectID()}},
+		{"ref", bson.D{{"$ref", "c"}, {"$id", 1}, {"$db", "db"}}},
+		{"nested", nested},
+	}))
+
+	err := NewOplog(nil, &pbm.MongoVersion{Version: []int{4, 2, 0}}, true).Apply(ioutil.NopCloser(buf))
+	if err != nil {
+		t.Errorf("apply: %v", err)
+	}
+}
+
+func TestApplyBrokenStream(t *testing.T) {
+	e := skippedEntry(t, 1, bson.D{{"_id", 1}})
+	buf := new(bytes.Buffer)
+	buf.Write(e)
+	// the stream is cut in the middle of the next entry
+	buf.Write(e[:len(e)/2])
+
+	err := NewOplog(nil, &pbm.MongoVersion{Version: []int{4, 2, 0}}, true).Apply(ioutil.NopCloser(buf))
+	if err == nil {
+		t.Fatal("the broken stream is taken as the end of the oplog")
+	}
+	if !strings.Contains(err.Error(), "after {1 0}") {
+		t.Errorf("the error doesn't point at the last applied entry: %v", err)
+	}
+}
+
+func TestFilterUUIDsEmptyCommand(t *testing.T) {
+	o := &Oplog{needIdxWorkaround: true}
+	_, err := o.filterUUIDs(db.Oplog{Operation: "c", Namespace: "db.$cmd"})
+	if err != nil {
+		t.Errorf("filter: %v", err)
+	}
+}
+
+func TestApplyTxnBatches(t *testing.T) {
+	apply := func(t *testing.T, n, docSize int) [][]interface{} {
+		ops := make(chan db.Oplog, n)
+		errs := make(chan error, 1)
+		for i := 0; i < n; i++ {
+			ops <- db.Oplog{
+				Operation: "i",
+				Namespace: "db.c",
+				Object:    bson.D{{"_id", i}, {"data", strings.Repeat("x", docSize)}},
+			}
+		}
+		close(ops)
+
+		var batches [][]interface{}
+		err := (&Oplog{preserveUUID: true}).applyTxn(ops, errs, func(b []interface{}) error {
+			batches = append(batches, b)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return batches
+	}
+
+	// the transaction fitting the applyOps is applied atomically
+	if b := apply(t, 100, 1<<10); len(b) != 1 || len(b[0]) != 100 {
+		t.Errorf("small transaction: got %d batches, want 1 of 100 ops", len(b))
+	}
+
+	// the oversized one is split
+	batches := apply(t, 20, 1<<20)
+	if len(batches) < 3 {
+		t.Fatalf("oversized transaction: got %d batches, want at least 3", len(batches))
+	}
+	ops := 0
+	for i, b := range batches {
+		size := 0
+		for _, op := range b {
+			size += len(op.(bson.Raw))
+		}
+		if size > maxTxnBatch {
+			t.Errorf("batch %d: size %d exceeds %d", i, size, maxTxnBatch)
+		}
+		ops += len(b)
+	}
+	if ops != 20 {
+		t.Errorf("got %d ops applied, want 20", ops)
+	}
+}
+
+// BenchmarkApplyDecode measures the replay pipeline up to the writes:
+// the stream decoding and the entries filtering
+func BenchmarkApplyDecode(b *testing.B) {
+	buf := new(bytes.Buffer)
+	payload := strings.Repeat("x", 1024)
+	for i := 0; i < 1000; i++ {
+		e, err := bson.Marshal(bson.D{
+			{"ts", primitive.Timestamp{T: 1, I: uint32(i)}},
+			{"op", "i"},
+			{"ns", "config.system.sessions"},
+			{"o", bson.D{{"_id", i}, {"payload", payload}}},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Write(e)
+	}
+	stream := buf.Bytes()
+
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := NewOplog(nil, &pbm.MongoVersion{Version: []int{4, 2, 0}}, true).Apply(ioutil.NopCloser(bytes.NewReader(stream)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
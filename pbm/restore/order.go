@@ -0,0 +1,147 @@
+package restore
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// dumpUnit is the dump of the replset restored by a single mongorestore run
+type dumpUnit struct {
+	name string
+	// exclude are the namespaces of the dump which aren't restored
+	exclude []string
+	// size is the size of the dump's collections at the backup time
+	size int64
+	// views means there are only views in the dump, they are restored
+	// after the collections they may be based on
+	views bool
+	// auth means the dump is of the admin db which holds users and roles
+	auth bool
+	// what is the dump for the log
+	what string
+}
+
+// phase returns the order of the dump's group: the collections go first,
+// then the views and the users and roles last
+func (u dumpUnit) phase() int {
+	switch {
+	case u.auth:
+		return 2
+	case u.views:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// newDumpUnit returns the unit of the dump of `nss` namespaces
+// described by the replset's collections info
+func newDumpUnit(name, what string, nss []string, colls map[string]pbm.NSInfo) dumpUnit {
+	u := dumpUnit{name: name, what: what, views: len(nss) > 0}
+	for _, ns := range nss {
+		c := colls[ns]
+		u.size += c.Size
+		u.views = u.views && c.View
+		if strings.HasPrefix(ns, "admin.") {
+			u.auth = true
+		}
+	}
+	return u
+}
+
+// collsInfo indexes the replset's collections info by the namespace
+func collsInfo(rs pbm.BackupReplset) map[string]pbm.NSInfo {
+	m := make(map[string]pbm.NSInfo, len(rs.Collections))
+	for _, c := range rs.Collections {
+		m[c.NS] = c
+	}
+	return m
+}
+
+// scheduleDumps groups the dumps into the phases restored one after another.
+// Within the phase the biggest dumps go first so the parallel workers
+// finish at about the same time (the longest processing time first).
+func scheduleDumps(units []dumpUnit) [][]dumpUnit {
+	sort.SliceStable(units, func(i, j int) bool {
+		if units[i].phase() != units[j].phase() {
+			return units[i].phase() < units[j].phase()
+		}
+		return units[i].size > units[j].size
+	})
+
+	var phases [][]dumpUnit
+	for i, u := range units {
+		if i == 0 || u.phase() != units[i-1].phase() {
+			phases = append(phases, nil)
+		}
+		phases[len(phases)-1] = append(phases[len(phases)-1], u)
+	}
+	return phases
+}
+
+// restoreUnits restores the dumps of the backup phase by phase
+// by up to r.parallel dumps at a time
+func (r *Restore) restoreUnits(bcp *pbm.BackupMeta, rsName string, units []dumpUnit, stg pbm.Storage, preserveUUID bool) error {
+	workers := r.parallel
+	// the transformer spills the rerouted documents of the single archive at a time
+	if workers < 1 || r.tf != nil {
+		workers = 1
+	}
+
+	for _, phase := range scheduleDumps(units) {
+		queue := make(chan dumpUnit, len(phase))
+		for _, u := range phase {
+			queue <- u
+		}
+		close(queue)
+
+		n := workers
+		if n > len(phase) {
+			n = len(phase)
+		}
+		errs := make(chan error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range queue {
+					log.Printf("restoring %s from %s", u.what, u.name)
+					err := r.restoreDump(bcp, rsName, u.name, stg, u.exclude, preserveUUID)
+					if err != nil {
+						errs <- errors.Wrapf(err, "restore %s", u.what)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diffDumpDB returns the database of the differential dump
+// by its name <backup>_<rs>.dump-<db>[.<compression>]
+func diffDumpDB(name string) string {
+	i := strings.LastIndex(name, ".dump-")
+	if i < 0 {
+		return ""
+	}
+	db := name[i+len(".dump-"):]
+	if j := strings.Index(db, "."); j >= 0 {
+		db = db[:j]
+	}
+	return db
+}
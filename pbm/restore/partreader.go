@@ -0,0 +1,158 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	partRetries    = 3
+	partRetryPause = time.Second
+)
+
+// partReader reads the S3 object by the ranges fetched in parallel.
+// The ranges are returned in order, and no more than `concurrency` of
+// them are being fetched or wait to be read at a time.
+type partReader struct {
+	cli      *s3.S3
+	bucket   string
+	key      string
+	size     int64
+	partSize int64
+
+	parts chan chan partResult
+	cur   io.Reader
+	err   error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+func newPartReader(cli *s3.S3, bucket, key string, size, partSize int64, concurrency int) *partReader {
+	r := &partReader{
+		cli:      cli,
+		bucket:   bucket,
+		key:      key,
+		size:     size,
+		partSize: partSize,
+		// the one being read is out of the channel
+		parts: make(chan chan partResult, concurrency-1),
+		done:  make(chan struct{}),
+	}
+	go r.fetch()
+	return r
+}
+
+func (r *partReader) fetch() {
+	defer close(r.parts)
+
+	for off := int64(0); off < r.size; off += r.partSize {
+		end := off + r.partSize - 1
+		if end >= r.size {
+			end = r.size - 1
+		}
+
+		slot := make(chan partResult, 1)
+		select {
+		case r.parts <- slot:
+		case <-r.done:
+			return
+		}
+		go func(off, end int64) {
+			slot <- r.get(off, end)
+		}(off, end)
+	}
+}
+
+// get fetches the range retrying on failures since the
+// transient error in the middle of the restore is costly
+func (r *partReader) get(off, end int64) partResult {
+	var err error
+	for i := 0; i < partRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(partRetryPause):
+			case <-r.done:
+				return partResult{err: errors.New("reader closed")}
+			}
+		}
+
+		var data []byte
+		data, err = r.getRange(off, end)
+		if err == nil {
+			return partResult{data: data}
+		}
+	}
+	return partResult{err: errors.Wrapf(err, "get range %d-%d of '%s/%s'", off, end, r.bucket, r.key)}
+}
+
+func (r *partReader) getRange(off, end int64) ([]byte, error) {
+	obj, err := r.cli.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read body")
+	}
+	if int64(len(data)) != end-off+1 {
+		return nil, errors.Errorf("got %d bytes, expected %d", len(data), end-off+1)
+	}
+	return data, nil
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err == io.EOF {
+				r.cur = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		slot, ok := <-r.parts
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		res := <-slot
+		if res.err != nil {
+			r.err = res.err
+			continue
+		}
+		r.cur = bytes.NewReader(res.data)
+	}
+}
+
+// Close stops fetching the ranges
+func (r *partReader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return nil
+}
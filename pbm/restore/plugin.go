@@ -0,0 +1,117 @@
+package restore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// execFilter is the restore plugin run as a separate process.
+// See pbm.DocTransformer for the protocol.
+type execFilter struct {
+	path string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *db.BSONSource
+}
+
+type filterRequest struct {
+	NS     string   `bson:"ns"`
+	Doc    bson.Raw `bson:"doc"`
+	Update bool     `bson:"update,omitempty"`
+}
+
+type filterReply struct {
+	NS   string   `bson:"ns,omitempty"`
+	Doc  bson.Raw `bson:"doc,omitempty"`
+	Drop bool     `bson:"drop,omitempty"`
+}
+
+// startPlugin runs the restore plugin with its args as `key=value` arguments
+func startPlugin(p *pbm.TransformPlugin) (*execFilter, error) {
+	keys := make([]string, 0, len(p.Args))
+	for k := range p.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys))
+	for _, k := range keys {
+		args = append(args, k+"="+p.Args[k])
+	}
+
+	cmd := exec.Command(p.Path, args...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "plugin stdin")
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "plugin stdout")
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.Wrapf(err, "start plugin %s", p.Path)
+	}
+
+	src := db.NewBufferlessBSONSource(ioutil.NopCloser(out))
+	// the reply wraps the max size document
+	src.MaxBSONSize += 16 << 10
+
+	return &execFilter{
+		path: p.Path,
+		cmd:  cmd,
+		in:   in,
+		out:  src,
+	}, nil
+}
+
+func (f *execFilter) Transform(ns string, doc bson.Raw, update bool) (string, bson.Raw, bool, error) {
+	req, err := bson.Marshal(filterRequest{NS: ns, Doc: doc, Update: update})
+	if err != nil {
+		return "", nil, false, errors.Wrap(err, "marshal request")
+	}
+	_, err = f.in.Write(req)
+	if err != nil {
+		return "", nil, false, errors.Wrap(err, "write to plugin")
+	}
+
+	raw := f.out.LoadNext()
+	if raw == nil {
+		err = f.out.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, false, errors.Wrap(err, "read from plugin")
+	}
+
+	var rep filterReply
+	err = bson.Unmarshal(raw, &rep)
+	if err != nil {
+		return "", nil, false, errors.Wrap(err, "unmarshal plugin's reply")
+	}
+	if rep.Drop {
+		return "", nil, false, nil
+	}
+	if len(rep.Doc) == 0 {
+		return "", nil, false, errors.New("no doc in the plugin's reply")
+	}
+	if rep.NS == "" {
+		rep.NS = ns
+	}
+	return rep.NS, rep.Doc, true, nil
+}
+
+// Close lets the plugin know there are no more documents and waits for it to exit
+func (f *execFilter) Close() error {
+	f.in.Close()
+	return errors.Wrapf(f.cmd.Wait(), "plugin %s", f.path)
+}
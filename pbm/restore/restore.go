@@ -2,6 +2,8 @@ package restore
 
 import (
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"log"
 	"strings"
 	"time"
@@ -10,6 +12,7 @@ import (
 	"github.com/mongodb/mongo-tools-common/options"
 	"github.com/mongodb/mongo-tools/mongorestore"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
@@ -22,6 +25,14 @@ var excludeFromDumpRestore = []string{
 	pbm.DB + "." + pbm.BcpCollection,
 	pbm.DB + "." + pbm.RestoresCollection,
 	pbm.DB + "." + pbm.LockCollection,
+	pbm.DB + "." + pbm.AgentsStatusCollection,
+	pbm.DB + "." + pbm.TraceCollection,
+	pbm.DB + "." + pbm.QueueCollection,
+	pbm.DB + "." + pbm.RehearsalCollection,
+	pbm.DB + "." + pbm.VerifyCollection,
+	pbm.DB + "." + pbm.MaintenanceCollection,
+	pbm.DB + "." + pbm.ApprovalCollection,
+	pbm.DB + "." + pbm.AgentTokensCollection,
 	"config.version",
 	"config.mongos",
 }
@@ -31,33 +42,74 @@ type Restore struct {
 	node   *pbm.Node
 	name   string
 	backup string
+	// namespaces which are never restored from the dump
+	nsExclude []string
+	tf        *transformer
+	// span is the trace span of the replset's part of the restore
+	span *pbm.Span
+	// until is the timestamp the oplog is replayed up to, zero means the whole oplog
+	until primitive.Timestamp
+	// since is the timestamp the oplog is replayed after, zero means the whole oplog
+	since primitive.Timestamp
+	// signing defines the verification of the backup manifests signatures
+	signing pbm.SigningConf
+	// parallel is the number of the dumps (and the collections
+	// of each dump) restored concurrently
+	parallel int
+	// conf is the restore config, the offline restore has the defaults
+	conf *pbm.RestoreConf
+	// limit is the pace of the restore, nil means no limits
+	limit *limiter
+	// mode returns the restore mode of the namespace,
+	// nil if all namespaces are restored in the drop mode
+	mode func(ns string) pbm.RestoreMode
 }
 
 // New creates a new restore object
 func New(cn *pbm.PBM, node *pbm.Node) *Restore {
 	return &Restore{
-		cn:   cn,
-		node: node,
+		cn:        cn,
+		node:      node,
+		nsExclude: excludeFromDumpRestore,
 	}
 }
 
-func (r *Restore) Run(cmd pbm.RestoreCmd) error {
-	stg, err := r.cn.GetStorage()
+// SetSigning sets the verification of the backup manifests signatures.
+// The restores run by the agents take it from the config.
+func (r *Restore) SetSigning(sc pbm.SigningConf) {
+	r.signing = sc
+}
+
+func (r *Restore) Run(cmd pbm.RestoreCmd) (err error) {
+	r.span = r.cn.StartSpan(cmd.Trace, "restore", "", "")
+	defer func() { r.span.Finish(err) }()
+
+	return r.run(cmd)
+}
+
+func (r *Restore) run(cmd pbm.RestoreCmd) error {
+	err := r.SetTransform(cmd.Transform, cmd.Plugin)
 	if err != nil {
-		return errors.Wrap(err, "get backup store")
+		return errors.Wrap(err, "set transform")
 	}
-
-	bcp, err := r.cn.GetBackupMeta(cmd.BackupName)
-	if errors.Cause(err) == mongo.ErrNoDocuments {
-		bcp, err = getMetaFromStore(cmd.BackupName, stg)
+	defer r.Close()
+	r.parallel = cmd.ParallelCollections
+	if !cmd.DropOnly() {
+		r.mode = cmd.NSMode
 	}
+
+	stg, err := r.cn.GetStorage()
 	if err != nil {
-		return errors.Wrap(err, "get backup metadata")
+		return errors.Wrap(err, "get backup store")
 	}
 
-	if bcp.Status != pbm.StatusDone {
-		return errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	cfg, err := r.cn.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "get config")
 	}
+	r.signing = cfg.Signing
+	r.conf = &cfg.Restore
+	r.limit = newLimiter(r.node, cfg.Restore)
 
 	im, err := r.node.GetIsMaster()
 	if err != nil {
@@ -68,27 +120,33 @@ func (r *Restore) Run(cmd pbm.RestoreCmd) error {
 	if rsName == "" {
 		rsName = pbm.NoReplset
 	}
+	r.span.Replset, r.span.Node = rsName, im.Me
 
+	// the data of the external restore is already there,
+	// only the oplog slices of the backups are replayed
 	var (
+		bcp      *pbm.BackupMeta
 		rsBackup pbm.BackupReplset
-		ok       bool
 	)
-	for _, v := range bcp.Replsets {
-		if v.Name == rsName {
-			rsBackup = v
-			ok = true
+	if cmd.External == nil {
+		bcp, rsBackup, err = r.backupOf(cmd.BackupName, rsName, stg)
+		if err != nil {
+			return err
 		}
 	}
-	if !ok {
-		return errors.Errorf("metadata for replset/shard %s is not found", rsName)
-	}
 
 	meta := &pbm.RestoreMeta{
-		Name:     cmd.Name,
-		Backup:   cmd.BackupName,
-		StartTS:  time.Now().Unix(),
-		Status:   pbm.StatusStarting,
-		Replsets: []pbm.RestoreReplset{},
+		Name:         cmd.Name,
+		Backup:       cmd.BackupName,
+		StartTS:      time.Now().Unix(),
+		Status:       pbm.StatusStarting,
+		Replsets:     []pbm.RestoreReplset{},
+		TraceID:      cmd.Trace.TraceID,
+		SafetyBackup: cmd.SafetyBackup,
+	}
+	if cmd.External != nil {
+		meta.Backup = strings.Join(cmd.External.Backups(), ",")
+		meta.SnapshotTS = cmd.External.SnapshotTS
 	}
 	if im.IsLeader() {
 		err = r.cn.SetRestoreMeta(meta)
@@ -156,17 +214,6 @@ func (r *Restore) Run(cmd pbm.RestoreCmd) error {
 		return errors.Wrap(err, "waiting for start")
 	}
 
-	dumpReader, dumpCloser, err := Source(stg, rsBackup.DumpName, pbm.CompressionTypeNone) //, bcp.Compression)
-	if err != nil {
-		return errors.Wrap(err, "create source object for the dump restore")
-	}
-	defer func() {
-		dumpReader.Close()
-		if dumpCloser != nil {
-			dumpCloser.Close()
-		}
-	}()
-
 	ver, err := r.node.GetMongoVersion()
 	if err != nil || len(ver.Version) < 1 {
 		return errors.Wrap(err, "define mongo version")
@@ -176,51 +223,29 @@ func (r *Restore) Run(cmd pbm.RestoreCmd) error {
 		preserveUUID = false
 	}
 
-	topts := options.ToolOptions{
-		AppName:    "mongodump",
-		VersionStr: "0.0.1",
-		URI:        &options.URI{ConnectionString: r.node.ConnURI()},
-		Auth:       &options.Auth{},
-		Namespace:  &options.Namespace{},
-		Connection: &options.Connection{},
-		Direct:     true,
-	}
-
-	rsession, err := db.NewSessionProvider(topts)
-	if err != nil {
-		return errors.Wrap(err, "create session for the dump restore")
-	}
-
-	mr := mongorestore.MongoRestore{
-		SessionProvider: rsession,
-		ToolOptions:     &topts,
-		InputOptions: &mongorestore.InputOptions{
-			Gzip:    bcp.Compression == pbm.CompressionTypeGZIP,
-			Archive: "-",
-		},
-		OutputOptions: &mongorestore.OutputOptions{
-			BulkBufferSize:           2000,
-			BypassDocumentValidation: true,
-			Drop:                     true,
-			NumInsertionWorkers:      20,
-			NumParallelCollections:   1,
-			PreserveUUID:             preserveUUID,
-			StopOnError:              true,
-			TempRolesColl:            "temproles",
-			TempUsersColl:            "tempusers",
-			WriteConcern:             "majority",
-		},
-		NSOptions: &mongorestore.NSOptions{
-			NSExclude: excludeFromDumpRestore,
-		},
-		InputReader: dumpReader,
-	}
+	if cmd.External == nil {
+		var warns []string
+		warns, err = r.checkBuild(bcp, rsBackup)
+		if err != nil {
+			return errors.Wrap(err, "check compatibility")
+		}
+		if len(warns) > 0 {
+			for i := range warns {
+				warns[i] = rsName + ": " + warns[i]
+			}
+			err = r.cn.AddRestoreWarnings(cmd.Name, warns)
+			if err != nil {
+				return errors.Wrap(err, "write warnings")
+			}
+		}
 
-	rdumpResult := mr.Restore()
-	if rdumpResult.Err != nil {
-		return errors.Wrapf(rdumpResult.Err, "restore mongo dump (successes: %d / fails: %d)", rdumpResult.Successes, rdumpResult.Failures)
+		dspan := r.span.Child("restore data")
+		err = r.restoreData(bcp, rsBackup, stg, preserveUUID)
+		dspan.Finish(err)
+		if err != nil {
+			return err
+		}
 	}
-	mr.Close()
 
 	err = r.cn.ChangeRestoreRSState(cmd.Name, rsMeta.Name, pbm.StatusDumpDone, "")
 	if err != nil {
@@ -235,25 +260,53 @@ func (r *Restore) Run(cmd pbm.RestoreCmd) error {
 		}
 	}
 
+	sspan := r.span.Child("sync")
 	err = r.waitForStatus(cmd.Name, pbm.StatusDumpDone)
+	sspan.Finish(err)
 	if err != nil {
 		return errors.Wrap(err, "waiting for start")
 	}
 
 	log.Println("starting the oplog replay")
 
-	oplogReader, oplogCloser, err := Source(stg, rsBackup.OplogName, bcp.Compression)
+	ospan := r.span.Child("oplog replay")
+	if cmd.External != nil {
+		err = r.replaySlices(cmd.External, rsName, stg, ver, preserveUUID)
+	} else {
+		err = r.restoreOplog(bcp, rsBackup, stg, ver, preserveUUID)
+	}
+	ospan.Finish(err)
 	if err != nil {
-		return errors.Wrap(err, "create source object for the oplog restore")
+		return err
 	}
-	defer func() {
-		oplogReader.Close()
-		if oplogCloser != nil {
-			oplogCloser.Close()
+
+	if cmd.Sessions && cmd.External == nil {
+		err = r.restoreSessions(bcp, rsBackup, stg)
+		if err != nil {
+			return errors.Wrap(err, "restore sessions")
 		}
-	}()
+	}
 
-	err = NewOplog(r.node, ver, preserveUUID).Apply(oplogReader)
+	err = r.checkCapped(rsBackup.Collections)
+	if err != nil {
+		return errors.Wrap(err, "check capped collections")
+	}
+
+	// the buckets of the sharded cluster are checked as
+	// a whole by the mongos agent once the restore is done
+	if cmd.CheckGridFS && !im.IsSharded() {
+		err := r.checkGridFS(cmd.Name, rsMeta.Name)
+		if err != nil {
+			log.Println("[ERROR] GridFS check:", err)
+		}
+	}
+
+	if im.IsLeader() && bcp != nil && bcp.Settings != nil {
+		err = r.applySettings(cmd.Name, bcp.Settings)
+		if err != nil {
+			return errors.Wrap(err, "apply cluster settings")
+		}
+	}
 
 	err = r.cn.ChangeRestoreRSState(cmd.Name, rsMeta.Name, pbm.StatusDone, "")
 	if err != nil {
@@ -448,3 +501,342 @@ func getMetaFromStore(bcpName string, stg pbm.Storage) (*pbm.BackupMeta, error)
 
 	return b, errors.Wrap(err, "decode")
 }
+
+// GetMeta returns the backup metadata from the db or,
+// if there is no such backup in the db, from the storage
+func GetMeta(cn *pbm.PBM, name string, stg pbm.Storage) (*pbm.BackupMeta, error) {
+	// no cluster to ask, e.g. the export from the storage
+	if cn == nil {
+		return getMetaFromStore(name, stg)
+	}
+
+	bcp, err := cn.GetBackupMeta(name)
+	if err == nil && bcp.Name == "" {
+		err = mongo.ErrNoDocuments
+	}
+	if errors.Cause(err) == mongo.ErrNoDocuments {
+		bcp, err = getMetaFromStore(name, stg)
+	}
+	return bcp, err
+}
+
+// backupOf returns the metadata of the backup to restore
+// and of its replset `rsName`
+func (r *Restore) backupOf(bcpName, rsName string, stg pbm.Storage) (*pbm.BackupMeta, pbm.BackupReplset, error) {
+	bcp, err := GetMeta(r.cn, bcpName, stg)
+	if err != nil {
+		return nil, pbm.BackupReplset{}, errors.Wrap(err, "get backup metadata")
+	}
+
+	if bcp.Status != pbm.StatusDone {
+		return nil, pbm.BackupReplset{}, errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	}
+
+	err = CheckSignature(r.signing, stg, bcp)
+	if err != nil {
+		return nil, pbm.BackupReplset{}, errors.Wrap(err, "check signature")
+	}
+
+	for _, v := range bcp.Replsets {
+		if v.Name == rsName {
+			return bcp, v, nil
+		}
+	}
+	return nil, pbm.BackupReplset{}, errors.Errorf("metadata for replset/shard %s is not found", rsName)
+}
+
+// restoreOplog replays the replset's oplog slice of the backup
+func (r *Restore) restoreOplog(bcp *pbm.BackupMeta, rs pbm.BackupReplset, stg pbm.Storage, ver *pbm.MongoVersion, preserveUUID bool) error {
+	// the backup of the standalone node has no oplog
+	if rs.OplogName == "" {
+		return nil
+	}
+
+	oplogReader, oplogHdr, err := openArchive(stg, bcp, rs.OplogName)
+	if err != nil {
+		return errors.Wrap(err, "create source object for the oplog restore")
+	}
+	defer oplogReader.Close()
+
+	err = checkArchive(oplogHdr, pbm.ArchiveTypeOplog, bcp, rs.Name)
+	if err != nil {
+		return errors.Wrapf(err, "check oplog '%s'", rs.OplogName)
+	}
+
+	// the schema-only backup has no documents to apply the writes to
+	err = r.applyOplog(ioutil.NopCloser(oplogReader), ver, preserveUUID, rs.Skipped, bcp.Type == pbm.BackupTypeSchema)
+	if err != nil {
+		return errors.Wrap(err, "apply oplog")
+	}
+	return errors.Wrapf(oplogReader.Verify(), "oplog '%s'", rs.OplogName)
+}
+
+// restoreDump restores the given dump of the backup except `exclude` namespaces
+func (r *Restore) restoreDump(bcp *pbm.BackupMeta, rsName, name string, stg pbm.Storage, exclude []string, preserveUUID bool) error {
+	dumpReader, dumpHdr, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return errors.Wrap(err, "create source object for the dump restore")
+	}
+	defer dumpReader.Close()
+
+	err = checkArchive(dumpHdr, pbm.ArchiveTypeDump, bcp, rsName)
+	if err != nil {
+		return errors.Wrapf(err, "check dump '%s'", name)
+	}
+
+	err = r.mrestore(dumpReader, exclude, preserveUUID)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(dumpReader.Verify(), "dump '%s'", name)
+}
+
+// SetTransform sets the rules and the plugin (if any)
+// applied to the documents before they are inserted.
+// The plugin is started here and stopped by Close.
+func (r *Restore) SetTransform(rules []pbm.TransformRule, p *pbm.TransformPlugin) error {
+	var plugin pbm.DocTransformer
+	if p != nil {
+		f, err := startPlugin(p)
+		if err != nil {
+			return errors.Wrap(err, "start plugin")
+		}
+		plugin = f
+	}
+	r.tf = newTransformer(rules, plugin)
+	return nil
+}
+
+// Close releases what the restore holds beyond its run, i.e. the plugin process
+func (r *Restore) Close() {
+	if r.tf == nil {
+		return
+	}
+	err := r.tf.close()
+	if err != nil {
+		log.Printf("[WARNING] stop the restore plugin: %v", err)
+	}
+}
+
+// ApplyOplog applies the oplog read from `rc` to the node
+func (r *Restore) ApplyOplog(rc io.ReadCloser, ver *pbm.MongoVersion, preserveUUID bool) error {
+	return r.applyOplog(rc, ver, preserveUUID, nil, false)
+}
+
+// applyOplog applies the oplog except the entries on `exclude` namespaces
+// (e.g. the collections skipped by the backup). With `commandsOnly` only
+// the commands are applied.
+func (r *Restore) applyOplog(rc io.ReadCloser, ver *pbm.MongoVersion, preserveUUID bool, exclude []string, commandsOnly bool) error {
+	o := NewOplog(r.node, ver, preserveUUID)
+	o.tf = r.tf
+	o.until = r.until
+	o.since = r.since
+	o.commandsOnly = commandsOnly
+	if r.conf != nil {
+		o.wc = r.conf.WriteConcernDoc()
+	}
+	o.limit = r.limit
+	if len(exclude) > 0 {
+		o.exclude = make(map[string]struct{}, len(exclude))
+		for _, ns := range exclude {
+			o.exclude[ns] = struct{}{}
+		}
+	}
+	return o.Apply(rc)
+}
+
+// writeConcern returns the write concern of the dump restore
+func (r *Restore) writeConcern() string {
+	if r.conf == nil {
+		return "majority"
+	}
+	return r.conf.W()
+}
+
+// RestoreArchive restores the mongodump archive read from `rd` into the node
+func (r *Restore) RestoreArchive(rd io.Reader, preserveUUID bool) error {
+	return r.mrestore(rd, nil, preserveUUID)
+}
+
+func (r *Restore) mrestore(rd io.Reader, exclude []string, preserveUUID bool) error {
+	rd = r.limit.reader(rd)
+
+	nsExclude := append([]string{}, r.nsExclude...)
+	for _, ns := range exclude {
+		nsExclude = append(nsExclude, escapeNS(ns))
+	}
+	var tfDone <-chan error
+	if r.tf != nil {
+		nsExclude = append(nsExclude, r.tf.excluded()...)
+		var trd io.ReadCloser
+		trd, tfDone = r.tf.archive(rd)
+		defer trd.Close()
+		defer r.tf.cleanup()
+		rd = trd
+	}
+
+	// the namespaces which aren't dropped are restored into the
+	// temp collections and put over the existing ones afterwards
+	var merged []string
+	if r.mode != nil {
+		var err error
+		rd, merged, err = r.mergedNS(rd)
+		if err != nil {
+			return errors.Wrap(err, "read dump namespaces")
+		}
+	}
+
+	var err error
+	if len(merged) == 0 {
+		err = r.restorePass(rd, &mongorestore.NSOptions{NSExclude: nsExclude}, preserveUUID)
+	} else {
+		err = r.restoreSplit(rd, nsExclude, merged, preserveUUID)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range merged {
+		err = r.putOver(ns)
+		if err != nil {
+			return errors.Wrapf(err, "%s %s", r.mode(ns), ns)
+		}
+	}
+
+	if r.tf != nil {
+		if err := <-tfDone; err != nil {
+			return errors.Wrap(err, "transform dump")
+		}
+		return errors.Wrap(r.tf.insertRerouted(r.node), "insert rerouted documents")
+	}
+
+	return nil
+}
+
+// restorePass runs mongorestore over the archive for the namespaces
+// selected by nso
+func (r *Restore) restorePass(rd io.Reader, nso *mongorestore.NSOptions, preserveUUID bool) error {
+	topts := options.ToolOptions{
+		AppName:    "mongodump",
+		VersionStr: "0.0.1",
+		URI:        &options.URI{ConnectionString: r.node.ConnURI()},
+		Auth:       &options.Auth{},
+		Namespace:  &options.Namespace{},
+		Connection: &options.Connection{},
+		Direct:     true,
+	}
+
+	rsession, err := db.NewSessionProvider(topts)
+	if err != nil {
+		return errors.Wrap(err, "create session for the dump restore")
+	}
+
+	mr := mongorestore.MongoRestore{
+		SessionProvider: rsession,
+		ToolOptions:     &topts,
+		InputOptions: &mongorestore.InputOptions{
+			Archive: "-",
+		},
+		OutputOptions: &mongorestore.OutputOptions{
+			BulkBufferSize:           2000,
+			BypassDocumentValidation: true,
+			Drop:                     true,
+			NumInsertionWorkers:      20,
+			NumParallelCollections:   r.parallelColls(),
+			PreserveUUID:             preserveUUID,
+			StopOnError:              true,
+			TempRolesColl:            "temproles",
+			TempUsersColl:            "tempusers",
+			WriteConcern:             r.writeConcern(),
+		},
+		NSOptions:   nso,
+		InputReader: rd,
+	}
+	defer mr.Close()
+
+	rdumpResult := mr.Restore()
+	if rdumpResult.Err != nil {
+		return errors.Wrapf(rdumpResult.Err, "restore mongo dump (successes: %d / fails: %d)", rdumpResult.Successes, rdumpResult.Failures)
+	}
+
+	return nil
+}
+
+// restoreDiff restores the base backup dump without namespaces
+// which were changed or dropped since then and the differential dumps on top of it
+func (r *Restore) restoreDiff(bcp *pbm.BackupMeta, rsBackup pbm.BackupReplset, stg pbm.Storage, preserveUUID bool) error {
+	base, err := GetMeta(r.cn, bcp.Base, stg)
+	if err != nil {
+		return errors.Wrapf(err, "get base backup %s metadata", bcp.Base)
+	}
+	if base.Status != pbm.StatusDone {
+		return errors.Errorf("base backup %s wasn't successfull: status: %s, error: %s", base.Name, base.Status, base.Error)
+	}
+	err = CheckSignature(r.signing, stg, base)
+	if err != nil {
+		return errors.Wrap(err, "check base backup signature")
+	}
+
+	var baseRS *pbm.BackupReplset
+	for i, rs := range base.Replsets {
+		if rs.Name == rsBackup.Name {
+			baseRS = &base.Replsets[i]
+			break
+		}
+	}
+	if baseRS == nil {
+		return errors.Errorf("metadata for replset/shard %s is not found in the base backup %s", rsBackup.Name, base.Name)
+	}
+
+	exists := make(map[string]struct{}, len(rsBackup.Collections))
+	for _, c := range rsBackup.Collections {
+		exists[c.NS] = struct{}{}
+	}
+	exclude := append([]string{}, rsBackup.Changed...)
+	for _, c := range baseRS.Collections {
+		if _, ok := exists[c.NS]; !ok {
+			exclude = append(exclude, c.NS)
+		}
+	}
+
+	log.Printf("restoring the base backup %s", base.Name)
+	err = r.restoreFull(base, *baseRS, stg, exclude, preserveUUID)
+	if err != nil {
+		return errors.Wrapf(err, "restore base backup %s", base.Name)
+	}
+
+	colls := collsInfo(rsBackup)
+	changed := make(map[string][]string)
+	for _, ns := range rsBackup.Changed {
+		db := ns
+		if i := strings.Index(ns, "."); i >= 0 {
+			db = ns[:i]
+		}
+		changed[db] = append(changed[db], ns)
+	}
+
+	redumps := redumpNS(rsBackup)
+	units := redumpUnits(rsBackup, nil)
+	for _, d := range rsBackup.DiffDumps {
+		u := newDumpUnit(d, "the differential dump", changed[diffDumpDB(d)], colls)
+		u.exclude = redumps
+		units = append(units, u)
+	}
+
+	return r.restoreUnits(bcp, rsBackup.Name, units, stg, preserveUUID)
+}
+
+// parallelColls returns the number of the collections of the dump
+// restored concurrently. The archive made by the parallel dump
+// raises it up to the number of the collections dumped concurrently.
+func (r *Restore) parallelColls() int {
+	if r.parallel < 1 {
+		return 1
+	}
+	return r.parallel
+}
+
+// escapeNS escapes the namespace to be used as mongorestore ns pattern
+func escapeNS(ns string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`).Replace(ns)
+}
@@ -0,0 +1,131 @@
+package restore
+
+import (
+	"log"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// Seed prepares a standalone node to join the replset `rsName` as
+// a secondary without an initial sync. It restores the backup's data
+// and oplog with the original collections UUIDs and seeds the node's
+// local oplog with the last applied entry, so once the node restarted with
+// `--replSet` and added to the replset it catches up from the primary's oplog.
+// The primary's oplog has to still contain the backup's last write.
+func (r *Restore) Seed(bcpName, rsName string, oplogSizeMB int) error {
+	im, err := r.node.GetIsMaster()
+	if err != nil {
+		return errors.Wrap(err, "get isMaster data")
+	}
+	if !im.IsStandalone() {
+		return errors.New("node should be started as a standalone (without --replSet)")
+	}
+
+	ver, err := r.node.GetMongoVersion()
+	if err != nil || len(ver.Version) < 1 {
+		return errors.Wrap(err, "define mongo version")
+	}
+	if ver.Version[0] < 4 {
+		return errors.Errorf("seeding requires mongod v4.0 or newer, got %s", ver.VersionString)
+	}
+
+	// the node has to be an exact copy of the replset,
+	// including PBM's own collections
+	r.nsExclude = nil
+	bcp, err := r.restoreLocal(bcpName, rsName)
+	if err != nil {
+		return err
+	}
+
+	stg, err := r.cn.GetStorage()
+	if err != nil {
+		return errors.Wrap(err, "get backup store")
+	}
+	rs, err := backupRS(bcp, rsName)
+	if err != nil {
+		return err
+	}
+	if rs.OplogName == "" {
+		return errors.Errorf("backup %s has no oplog to seed the node with", bcp.Name)
+	}
+	last, err := lastOplogEntry(stg, bcp, rs.OplogName)
+	if err != nil {
+		return errors.Wrap(err, "get the last oplog entry")
+	}
+
+	return errors.Wrap(r.seedOplog(last, oplogSizeMB), "seed local oplog")
+}
+
+// seedOplog creates the local oplog with the given entry in it
+// and sets the node's minValid point to it
+func (r *Restore) seedOplog(last bson.Raw, sizeMB int) error {
+	var (
+		ts primitive.Timestamp
+		ok bool
+	)
+	ts.T, ts.I, ok = last.Lookup("ts").TimestampOK()
+	if !ok {
+		return errors.New("oplog entry without ts")
+	}
+	term, _ := last.Lookup("t").Int64OK()
+
+	local := r.node.Session().Database("local")
+	err := local.RunCommand(r.cn.Context(), bson.D{
+		{"create", "oplog.rs"},
+		{"capped", true},
+		{"size", int64(sizeMB) * 1024 * 1024},
+	}).Err()
+	if err != nil {
+		return errors.Wrap(err, "create oplog collection")
+	}
+
+	_, err = local.Collection("oplog.rs").InsertOne(r.cn.Context(), last)
+	if err != nil {
+		return errors.Wrap(err, "insert oplog entry")
+	}
+
+	_, err = local.Collection("replset.minvalid").InsertOne(r.cn.Context(), bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"ts", ts},
+		{"t", term},
+	})
+	if err != nil {
+		return errors.Wrap(err, "set minvalid")
+	}
+
+	log.Printf("local oplog seeded with the entry %v", ts)
+	return nil
+}
+
+// lastOplogEntry returns the last entry of the backup's oplog slice
+func lastOplogEntry(stg pbm.Storage, bcp *pbm.BackupMeta, name string) (bson.Raw, error) {
+	r, _, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open oplog")
+	}
+	defer r.Close()
+
+	src := db.NewBufferlessBSONSource(r)
+	src.SetMaxBSONSize(pbm.MaxOplogEntrySize)
+	var last []byte
+	for {
+		raw := src.LoadNext()
+		if raw == nil {
+			break
+		}
+		last = append(last[:0], raw...)
+	}
+	if err := src.Err(); err != nil {
+		return nil, errors.Wrap(err, "read oplog")
+	}
+	if last == nil {
+		return nil, errors.New("oplog is empty")
+	}
+
+	return bson.Raw(last), nil
+}
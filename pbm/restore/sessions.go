@@ -0,0 +1,64 @@
+package restore
+
+import (
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// restoreSessions restores the sessions records (config.transactions) of
+// the replset's backup after the oplog replay. The record which is already
+// there is replaced: the restored data is as of the backup's end.
+func (r *Restore) restoreSessions(bcp *pbm.BackupMeta, rs pbm.BackupReplset, stg pbm.Storage) error {
+	if rs.SessionsName == "" {
+		return errors.New("the backup has no sessions records")
+	}
+
+	rd, hdr, err := openArchive(stg, bcp, rs.SessionsName)
+	if err != nil {
+		return errors.Wrap(err, "open sessions file")
+	}
+	defer rd.Close()
+
+	err = checkArchive(hdr, pbm.ArchiveTypeSessions, bcp, rs.Name)
+	if err != nil {
+		return errors.Wrapf(err, "check sessions '%s'", rs.SessionsName)
+	}
+
+	src := db.NewBufferlessBSONSource(rd)
+	coll := r.node.Session().Database("config").Collection("transactions")
+	opts := options.Replace().SetUpsert(true)
+	for {
+		raw := src.LoadNext()
+		if raw == nil {
+			break
+		}
+		doc := bson.Raw(raw)
+		if sessionAfter(doc, r.until) {
+			continue
+		}
+		_, err = coll.ReplaceOne(r.node.Context(), bson.D{{"_id", doc.Lookup("_id")}}, doc, opts)
+		if err != nil {
+			return errors.Wrap(err, "write session record")
+		}
+	}
+	if src.Err() != nil {
+		return errors.Wrap(src.Err(), "read sessions file")
+	}
+	return errors.Wrapf(rd.Verify(), "sessions '%s'", rs.SessionsName)
+}
+
+// sessionAfter returns true if the session's last write is beyond the
+// point the oplog is replayed up to, zero `until` means the whole oplog.
+// The data has no such write, so its retry has to be applied.
+func sessionAfter(rec bson.Raw, until primitive.Timestamp) bool {
+	if until.T == 0 {
+		return false
+	}
+	t, i, ok := rec.Lookup("lastWriteOpTime", "ts").TimestampOK()
+	return ok && primitive.CompareTimestamp(primitive.Timestamp{T: t, I: i}, until) > 0
+}
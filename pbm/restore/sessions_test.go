@@ -0,0 +1,56 @@
+package restore
+
+import (
+	"testing"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSessionAfter(t *testing.T) {
+	rec := func(ts uint32) bson.Raw {
+		b, err := bson.Marshal(bson.D{
+			{"_id", bson.D{{"id", primitive.Binary{Subtype: 4, Data: make([]byte, 16)}}}},
+			{"txnNum", int64(1)},
+			{"lastWriteOpTime", bson.D{{"ts", primitive.Timestamp{T: ts}}, {"t", int64(1)}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	until := primitive.Timestamp{T: 20}
+	if sessionAfter(rec(10), until) {
+		t.Error("the session written before the restore point is skipped")
+	}
+	if sessionAfter(rec(20), until) {
+		t.Error("the session written at the restore point is skipped")
+	}
+	// the data has no such write, the client's retry has to be applied
+	if !sessionAfter(rec(30), until) {
+		t.Error("the session written after the restore point is restored")
+	}
+	if sessionAfter(rec(30), primitive.Timestamp{}) {
+		t.Error("the session is skipped on the restore of the whole oplog")
+	}
+}
+
+func TestStripSession(t *testing.T) {
+	txn := int64(5)
+	op := stripSession(db.Oplog{
+		Operation:  "i",
+		Namespace:  "db.c",
+		Object:     bson.D{{"_id", 1}},
+		LSID:       bson.Raw{},
+		TxnNumber:  &txn,
+		PrevOpTime: bson.Raw{},
+	})
+	if op.LSID != nil || op.TxnNumber != nil || op.PrevOpTime != nil {
+		t.Errorf("the retryable write keeps its session: %+v", op)
+	}
+	if op.Namespace != "db.c" || len(op.Object) != 1 {
+		t.Errorf("the write itself is changed: %+v", op)
+	}
+}
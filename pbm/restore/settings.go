@@ -0,0 +1,26 @@
+package restore
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// applySettings reapplies the cluster settings captured by the backup.
+// Mismatches which can't be fixed are recorded as the restore warnings.
+func (r *Restore) applySettings(name string, s *pbm.ClusterSettings) error {
+	warns, err := r.node.ApplyClusterSettings(s)
+	if err != nil {
+		return err
+	}
+	if len(warns) == 0 {
+		return nil
+	}
+
+	for _, w := range warns {
+		log.Println("[WARNING] cluster settings:", w)
+	}
+	return errors.Wrap(r.cn.AddRestoreWarnings(name, warns), "write warnings")
+}
@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// CheckSignature verifies the signature of the backup manifest stored
+// along with the backup and that the given meta (from the db or elsewhere)
+// matches the signed one. Nothing is checked if there is no public key in
+// the config. The unsigned backups pass with a warning unless the signature
+// is required.
+func CheckSignature(sc pbm.SigningConf, stg pbm.Storage, bcp *pbm.BackupMeta) error {
+	key, err := sc.VerifyKey()
+	if err != nil {
+		return errors.Wrap(err, "get signature verification key")
+	}
+	if key == nil {
+		return nil
+	}
+
+	name := bcp.Name + ".pbm.json"
+	sig, err := readAll(stg, name+pbm.SignatureSuffix)
+	if err != nil {
+		if sc.Required {
+			return errors.Wrap(err, "backup isn't signed")
+		}
+		log.Printf("[WARNING] backup '%s' signature isn't checked: %v", bcp.Name, err)
+		return nil
+	}
+	data, err := readAll(stg, name)
+	if err != nil {
+		return errors.Wrap(err, "read manifest")
+	}
+
+	err = pbm.VerifyManifest(key, data, sig)
+	if err != nil {
+		return errors.Wrapf(err, "backup '%s'", bcp.Name)
+	}
+
+	signed := &pbm.BackupMeta{}
+	err = json.Unmarshal(data, signed)
+	if err != nil {
+		return errors.Wrap(err, "decode manifest")
+	}
+	err = bcp.SameFiles(signed)
+	return errors.Wrapf(err, "backup '%s' metadata doesn't match the signed manifest", bcp.Name)
+}
+
+func readAll(stg pbm.Storage, name string) ([]byte, error) {
+	r, _, err := Source(stg, name, pbm.CompressionTypeNone)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
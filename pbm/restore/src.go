@@ -22,9 +22,26 @@ import (
 // In case compression are used it alse return io.Closer wich should be used
 // to close undelying Reader
 func Source(stg pbm.Storage, name string, compression pbm.CompressionType) (io.ReadCloser, io.Closer, error) {
+	rr, rc, _, err := SourceArchive(stg, name, compression)
+	return rr, rc, err
+}
+
+// SourceArchive is the same as Source but it also returns the archive header.
+// The header is stripped from the returned data. It is nil for archives
+// created before the archive format v2.
+func SourceArchive(stg pbm.Storage, name string, compression pbm.CompressionType) (io.ReadCloser, io.Closer, *pbm.ArchiveHeader, error) {
+	return source(stg, name, compression, true, nil)
+}
+
+// source opens the file in the storage. It reads and strips the archive
+// header only if `header` is set since the raw data (e.g. dedup chunks)
+// may start with the same bytes. If `tee` is set the data is written into
+// it as it's read from the storage.
+func source(stg pbm.Storage, name string, compression pbm.CompressionType, header bool, tee io.Writer) (io.ReadCloser, io.Closer, *pbm.ArchiveHeader, error) {
 	var (
-		rr io.ReadCloser
-		rc io.Closer
+		rr  io.ReadCloser
+		rc  io.Closer
+		hdr *pbm.ArchiveHeader
 	)
 
 	switch stg.Type {
@@ -32,7 +49,7 @@ func Source(stg pbm.Storage, name string, compression pbm.CompressionType) (io.R
 		filepath := path.Join(stg.Filesystem.Path, name)
 		fr, err := os.Open(filepath)
 		if err != nil {
-			return nil, nil, errors.Wrapf(err, "open file '%s'", filepath)
+			return nil, nil, nil, errors.Wrapf(err, "open file '%s'", filepath)
 		}
 		rr = fr
 	case pbm.StorageS3:
@@ -47,17 +64,60 @@ func Source(stg pbm.Storage, name string, compression pbm.CompressionType) (io.R
 			S3ForcePathStyle: aws.Bool(true),
 		})
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "cannot create AWS session")
+			return nil, nil, nil, errors.Wrap(err, "cannot create AWS session")
 		}
 
-		s3obj, err := s3.New(awsSession).GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(stg.S3.Bucket),
-			Key:    aws.String(path.Join(stg.S3.Prefix, name)),
-		})
+		cli := s3.New(awsSession)
+		key := path.Join(stg.S3.Prefix, name)
+
+		// files bigger than a part are read by ranges in parallel
+		size := int64(-1)
+		concurrency, partSize := stg.S3.DownloadOpts()
+		if concurrency > 1 {
+			h, err := cli.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(stg.S3.Bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "get '%s/%s' file size from S3", stg.S3.Bucket, name)
+			}
+			size = aws.Int64Value(h.ContentLength)
+		}
+
+		if size > partSize {
+			rr = newPartReader(cli, stg.S3.Bucket, key, size, partSize, concurrency)
+		} else {
+			s3obj, err := cli.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(stg.S3.Bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "read '%s/%s' file from S3", stg.S3.Bucket, name)
+			}
+			rr = ioutil.NopCloser(s3obj.Body)
+		}
+	}
+
+	if tee != nil {
+		rr = readCloser{Reader: io.TeeReader(rr, tee), Closer: rr}
+	}
+
+	if header {
+		var (
+			data io.Reader
+			err  error
+		)
+		hdr, data, err = pbm.ReadArchiveHeader(rr)
 		if err != nil {
-			return nil, nil, errors.Wrapf(err, "read '%s/%s' file from S3", stg.S3.Bucket, name)
+			rr.Close()
+			return nil, nil, nil, errors.Wrapf(err, "read header of '%s'", name)
+		}
+		rr = readCloser{Reader: data, Closer: rr}
+		// the dump of the collection may be compressed other than the backup
+		// (see the adaptive compression), the header knows for sure
+		if hdr != nil {
+			compression = hdr.Compression
 		}
-		rr = ioutil.NopCloser(s3obj.Body)
 	}
 
 	switch compression {
@@ -66,7 +126,7 @@ func Source(stg pbm.Storage, name string, compression pbm.CompressionType) (io.R
 		var err error
 		rr, err = gzip.NewReader(rr)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "gzip reader")
+			return nil, nil, nil, errors.Wrap(err, "gzip reader")
 		}
 	case pbm.CompressionTypeLZ4:
 		rc = rr
@@ -76,5 +136,53 @@ func Source(stg pbm.Storage, name string, compression pbm.CompressionType) (io.R
 		rr = ioutil.NopCloser(snappy.NewReader(rr))
 	}
 
-	return rr, rc, nil
+	return rr, rc, hdr, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// checkArchive validates the archive header (if any) against the backup meta
+func checkArchive(h *pbm.ArchiveHeader, typ pbm.ArchiveType, bcp *pbm.BackupMeta, rsName string) error {
+	if h == nil {
+		return nil
+	}
+
+	switch {
+	case h.Version > pbm.ArchiveVersion:
+		return errors.Errorf("unsupported archive version %d, max supported is %d", h.Version, pbm.ArchiveVersion)
+	case h.Type != typ:
+		return errors.Errorf("archive type mismatch: expected %s, got %s", typ, h.Type)
+	// the backup which has replaced another one wrote its archives
+	// under the name it has run with
+	case h.Backup != bcp.Name && (bcp.StagedName == "" || h.Backup != bcp.StagedName):
+		return errors.Errorf("archive belongs to another backup: %s", h.Backup)
+	case h.Replset != rsName:
+		return errors.Errorf("archive belongs to another replica set: %s", h.Replset)
+	case h.Compression != bcp.Compression && !(typ == pbm.ArchiveTypeDump && h.Compression == collCompression(bcp, rsName, h.Namespaces)):
+		return errors.Errorf("archive compression mismatch: expected %s, got %s", bcp.Compression, h.Compression)
+	}
+
+	return nil
+}
+
+// collCompression returns the compression chosen by the adaptive
+// compression for the separate dump of the collection
+func collCompression(bcp *pbm.BackupMeta, rsName string, nss []string) pbm.CompressionType {
+	if len(nss) != 1 {
+		return bcp.Compression
+	}
+	for _, rs := range bcp.Replsets {
+		if rs.Name != rsName {
+			continue
+		}
+		for _, c := range rs.Compressions {
+			if c.NS == nss[0] {
+				return c.Compression
+			}
+		}
+	}
+	return bcp.Compression
 }
@@ -0,0 +1,572 @@
+package restore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// transformer applies the user's transform rules and the restore plugin
+// to the documents on their way to the database: both in the dump and in the oplog
+type transformer struct {
+	rules  []pbm.TransformRule
+	plugin pbm.DocTransformer
+	// rerouted are the dump's documents the plugin has moved to another
+	// namespace. They are kept aside and inserted after the dump.
+	rerouted map[string]*spilled
+	// spillMem is the size of the rerouted documents kept in memory
+	spillMem int
+}
+
+// spillMemLimit is the size of the rerouted documents kept in memory.
+// Only the documents beyond it go to the temp files, so the agents
+// without the local disk (e.g. diskless pods) are fine with the
+// usual rerouting of a few collections.
+const spillMemLimit = 64 << 20
+
+// spilled are the rerouted documents of the namespace. They are kept in
+// memory until the transformer's memory limit is hit and then moved to
+// the temp file.
+type spilled struct {
+	buf bytes.Buffer
+	f   *os.File
+}
+
+func (s *spilled) reader() (io.Reader, error) {
+	if s.f == nil {
+		return &s.buf, nil
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	return s.f, errors.Wrapf(err, "seek %s", s.f.Name())
+}
+
+func newTransformer(rules []pbm.TransformRule, plugin pbm.DocTransformer) *transformer {
+	if len(rules) == 0 && plugin == nil {
+		return nil
+	}
+	return &transformer{
+		rules:    rules,
+		plugin:   plugin,
+		rerouted: make(map[string]*spilled),
+	}
+}
+
+// excluded returns the patterns of namespaces which shouldn't be restored at all
+func (t *transformer) excluded() []string {
+	var ex []string
+	for _, r := range t.rules {
+		if r.Drop {
+			ex = append(ex, r.NS)
+		}
+	}
+	return ex
+}
+
+func (t *transformer) dropped(ns string) bool {
+	for _, r := range t.rules {
+		if r.Drop && r.Match(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns rules with fields actions for the namespace
+func (t *transformer) matching(ns string) []pbm.TransformRule {
+	var rules []pbm.TransformRule
+	for _, r := range t.rules {
+		if len(r.Fields) > 0 && r.Match(ns) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// transformDoc applies the fields actions of the rules to the document
+func transformDoc(rules []pbm.TransformRule, doc bson.D) (bson.D, error) {
+	var err error
+	for _, r := range rules {
+		for _, f := range r.Fields {
+			doc, err = applyField(doc, strings.Split(f.Path, "."), f.Action, r.Salt)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field '%s'", f.Path)
+			}
+		}
+	}
+	return doc, nil
+}
+
+func applyField(doc bson.D, path []string, action pbm.TransformAction, salt string) (bson.D, error) {
+	for i := 0; i < len(doc); i++ {
+		if doc[i].Key != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			if action == pbm.TransformRemove {
+				return append(doc[:i], doc[i+1:]...), nil
+			}
+			v, err := transformValue(doc[i].Value, action, salt)
+			if err != nil {
+				return nil, err
+			}
+			doc[i].Value = v
+			return doc, nil
+		}
+
+		v, err := applyNested(doc[i].Value, path[1:], action, salt)
+		if err != nil {
+			return nil, err
+		}
+		doc[i].Value = v
+		return doc, nil
+	}
+
+	return doc, nil
+}
+
+// applyNested applies the action to the subdocument or
+// to each subdocument in the array
+func applyNested(v interface{}, path []string, action pbm.TransformAction, salt string) (interface{}, error) {
+	switch val := v.(type) {
+	case bson.D:
+		return applyField(val, path, action, salt)
+	case bson.A:
+		for i := range val {
+			nv, err := applyNested(val[i], path, action, salt)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = nv
+		}
+		return val, nil
+	}
+	return v, nil
+}
+
+func transformValue(v interface{}, action pbm.TransformAction, salt string) (interface{}, error) {
+	switch action {
+	case pbm.TransformNull:
+		return nil, nil
+	case pbm.TransformHash:
+		if v == nil {
+			return nil, nil
+		}
+		var b []byte
+		if s, ok := v.(string); ok {
+			b = []byte(s)
+		} else {
+			raw, err := bson.Marshal(bson.D{{"v", v}})
+			if err != nil {
+				return nil, errors.Wrap(err, "marshal value")
+			}
+			b = raw
+		}
+		h := sha256.New()
+		h.Write([]byte(salt))
+		h.Write(b)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return v, nil
+}
+
+// op transforms the oplog entry. It returns false if the entry should be skipped.
+func (t *transformer) op(op db.Oplog) (db.Oplog, bool, error) {
+	var err error
+	switch op.Operation {
+	case "i", "u", "d":
+		if t.dropped(op.Namespace) {
+			return op, false, nil
+		}
+		if op.Operation == "d" {
+			return op, true, nil
+		}
+
+		update := op.Operation == "u" && len(op.Object) > 0 && strings.HasPrefix(op.Object[0].Key, "$")
+		if rules := t.matching(op.Namespace); len(rules) > 0 {
+			if update {
+				op.Object, err = transformUpdate(rules, op.Object)
+			} else {
+				op.Object, err = transformDoc(rules, op.Object)
+			}
+			if err != nil {
+				return op, false, err
+			}
+		}
+		if t.plugin == nil {
+			return op, true, nil
+		}
+		return t.pluginOp(op, update)
+	case "c":
+		if isApplyOpsCmd(op.Object) {
+			ops, err := unwrapNestedApplyOps(op.Object)
+			if err != nil {
+				return op, false, err
+			}
+			kept := make([]db.Oplog, 0, len(ops))
+			for _, o := range ops {
+				o, ok, err := t.op(o)
+				if err != nil {
+					return op, false, err
+				}
+				if ok {
+					kept = append(kept, o)
+				}
+			}
+			if len(kept) == 0 {
+				return op, false, nil
+			}
+			op.Object, err = wrapNestedApplyOps(kept)
+			return op, true, err
+		}
+		if len(op.Object) > 0 {
+			if coll, ok := op.Object[0].Value.(string); ok {
+				dbName := strings.TrimSuffix(op.Namespace, ".$cmd")
+				if t.dropped(dbName + "." + coll) {
+					return op, false, nil
+				}
+			}
+		}
+	}
+
+	return op, true, nil
+}
+
+// pluginOp passes the document of the insert, replace or update
+// oplog entry through the plugin
+func (t *transformer) pluginOp(op db.Oplog, update bool) (db.Oplog, bool, error) {
+	raw, err := bson.Marshal(op.Object)
+	if err != nil {
+		return op, false, errors.Wrap(err, "marshal document")
+	}
+	ns, doc, keep, err := t.plugin.Transform(op.Namespace, raw, update)
+	if err != nil {
+		return op, false, errors.Wrap(err, "plugin")
+	}
+	if !keep {
+		return op, false, nil
+	}
+	// the document to update is where it was restored to,
+	// which the plugin might have changed for its insert
+	if update && ns != op.Namespace {
+		return op, false, errors.Errorf("plugin: the update of %s can't be moved to %s", op.Namespace, ns)
+	}
+
+	var obj bson.D
+	err = bson.Unmarshal(doc, &obj)
+	if err != nil {
+		return op, false, errors.Wrap(err, "unmarshal plugin's document")
+	}
+	op.Object = obj
+	if ns != "" && ns != op.Namespace {
+		op.Namespace = ns
+		// the uuid belongs to the original collection
+		op.UI = nil
+	}
+	return op, true, nil
+}
+
+// transformUpdate applies rules to the update operators document ($set, $unset, etc.)
+func transformUpdate(rules []pbm.TransformRule, upd bson.D) (bson.D, error) {
+	for i, u := range upd {
+		if u.Key != "$set" && u.Key != "$setOnInsert" {
+			continue
+		}
+		set, ok := u.Value.(bson.D)
+		if !ok {
+			continue
+		}
+
+		for _, r := range rules {
+			for _, f := range r.Fields {
+				var err error
+				set, err = transformSet(set, f, r.Salt)
+				if err != nil {
+					return nil, errors.Wrapf(err, "field '%s'", f.Path)
+				}
+			}
+		}
+		upd[i].Value = set
+	}
+	return upd, nil
+}
+
+// transformSet applies the field action to the $set document which keys are
+// dot separated paths and may point to the field itself, its parent or child
+func transformSet(set bson.D, f pbm.TransformField, salt string) (bson.D, error) {
+	for i := 0; i < len(set); i++ {
+		k := set[i].Key
+		switch {
+		case k == f.Path || strings.HasPrefix(k, f.Path+"."):
+			if f.Action == pbm.TransformRemove {
+				set = append(set[:i], set[i+1:]...)
+				i--
+				continue
+			}
+			v, err := transformValue(set[i].Value, f.Action, salt)
+			if err != nil {
+				return nil, err
+			}
+			set[i].Value = v
+		case strings.HasPrefix(f.Path, k+"."):
+			v, err := applyNested(set[i].Value, strings.Split(strings.TrimPrefix(f.Path, k+"."), "."), f.Action, salt)
+			if err != nil {
+				return nil, err
+			}
+			set[i].Value = v
+		}
+	}
+	return set, nil
+}
+
+// archive returns the reader of the mongodump archive `r` with the
+// documents transformed. The CRCs of the changed collections are updated.
+// The result of the rewriting is sent to the returned channel once it's done.
+func (t *transformer) archive(r io.Reader) (io.ReadCloser, <-chan error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := t.rewriteArchive(r, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return pr, done
+}
+
+func (t *transformer) rewriteArchive(r io.Reader, w io.Writer) error {
+	prelude := &archive.Prelude{}
+	err := prelude.Read(r)
+	if err != nil {
+		return errors.Wrap(err, "read prelude")
+	}
+	err = prelude.Write(w)
+	if err != nil {
+		return errors.Wrap(err, "write prelude")
+	}
+
+	parser := archive.Parser{In: r}
+	return parser.ReadAllBlocks(&archiveRewriter{
+		t:   t,
+		w:   w,
+		crc: make(map[string]hash.Hash64),
+	})
+}
+
+var archiveTerminator = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+
+// archiveRewriter writes the parsed archive blocks back transforming the documents
+type archiveRewriter struct {
+	t      *transformer
+	w      io.Writer
+	open   bool
+	ns     string
+	rules  []pbm.TransformRule
+	active bool
+	crc    map[string]hash.Hash64
+}
+
+func (a *archiveRewriter) HeaderBSON(data []byte) error {
+	if a.open {
+		_, err := a.w.Write(archiveTerminator)
+		if err != nil {
+			return err
+		}
+	}
+
+	h := archive.NamespaceHeader{}
+	err := bson.Unmarshal(data, &h)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal namespace header")
+	}
+	a.ns = h.Database + "." + h.Collection
+	a.rules = a.t.matching(a.ns)
+	a.active = len(a.rules) > 0 || a.t.plugin != nil
+
+	if a.active && !h.EOF {
+		if _, ok := a.crc[a.ns]; !ok {
+			a.crc[a.ns] = crc64.New(crc64.MakeTable(crc64.ECMA))
+		}
+	}
+
+	if h.EOF {
+		if crc, ok := a.crc[a.ns]; ok {
+			h.CRC = int64(crc.Sum64())
+			data, err = bson.Marshal(h)
+			if err != nil {
+				return errors.Wrap(err, "marshal namespace header")
+			}
+		}
+	}
+
+	_, err = a.w.Write(data)
+	a.open = true
+	return err
+}
+
+func (a *archiveRewriter) BodyBSON(data []byte) error {
+	if !a.active {
+		_, err := a.w.Write(data)
+		return err
+	}
+
+	if len(a.rules) > 0 {
+		var doc bson.D
+		err := bson.Unmarshal(data, &doc)
+		if err != nil {
+			return errors.Wrap(err, "unmarshal document")
+		}
+		doc, err = transformDoc(a.rules, doc)
+		if err != nil {
+			return errors.Wrapf(err, "transform %s document", a.ns)
+		}
+		data, err = bson.Marshal(doc)
+		if err != nil {
+			return errors.Wrap(err, "marshal document")
+		}
+	}
+
+	if a.t.plugin != nil {
+		ns, doc, keep, err := a.t.plugin.Transform(a.ns, data, false)
+		if err != nil {
+			return errors.Wrapf(err, "plugin: %s document", a.ns)
+		}
+		if !keep {
+			return nil
+		}
+		if ns != "" && ns != a.ns {
+			return a.t.spill(ns, doc)
+		}
+		data = doc
+	}
+
+	a.crc[a.ns].Write(data)
+	_, err := a.w.Write(data)
+	return err
+}
+
+func (a *archiveRewriter) End() error {
+	if !a.open {
+		return nil
+	}
+	_, err := a.w.Write(archiveTerminator)
+	return err
+}
+
+// spill saves the rerouted document aside, in memory
+// or in the temp file of its namespace
+func (t *transformer) spill(ns string, doc []byte) error {
+	sp, ok := t.rerouted[ns]
+	if !ok {
+		sp = &spilled{}
+		t.rerouted[ns] = sp
+	}
+
+	if sp.f == nil && t.spillMem+len(doc) > spillMemLimit {
+		f, err := ioutil.TempFile("", "pbm-rerouted-")
+		if err != nil {
+			return errors.Wrap(err, "create temp file for the rerouted documents")
+		}
+		sp.f = f
+		t.spillMem -= sp.buf.Len()
+		_, err = sp.buf.WriteTo(f)
+		if err != nil {
+			return errors.Wrapf(err, "spill rerouted documents to %s", f.Name())
+		}
+	}
+
+	if sp.f == nil {
+		t.spillMem += len(doc)
+		sp.buf.Write(doc)
+		return nil
+	}
+	_, err := sp.f.Write(doc)
+	return errors.Wrapf(err, "spill rerouted document to %s", sp.f.Name())
+}
+
+// insertRerouted inserts the spilled documents into their namespaces
+func (t *transformer) insertRerouted(node *pbm.Node) error {
+	defer t.cleanup()
+
+	// the batch is limited by size as well so the max size
+	// documents don't pile up in memory
+	const (
+		batch      = 1000
+		batchBytes = 16 << 20
+	)
+	for ns, sp := range t.rerouted {
+		r, err := sp.reader()
+		if err != nil {
+			return err
+		}
+
+		dbName, coll := splitNS(ns)
+		c := node.Session().Database(dbName).Collection(coll)
+		src := db.NewBufferlessBSONSource(ioutil.NopCloser(r))
+		docs := make([]interface{}, 0, batch)
+		size := 0
+		for {
+			raw := src.LoadNext()
+			if raw != nil {
+				docs = append(docs, bson.Raw(raw))
+				size += len(raw)
+			}
+			if len(docs) == batch || size >= batchBytes || (raw == nil && len(docs) > 0) {
+				_, err = c.InsertMany(node.Context(), docs)
+				if err != nil {
+					return errors.Wrapf(err, "insert into %s", ns)
+				}
+				docs = docs[:0]
+				size = 0
+			}
+			if raw == nil {
+				break
+			}
+		}
+		if err := src.Err(); err != nil {
+			return errors.Wrapf(err, "read rerouted %s", ns)
+		}
+	}
+
+	return nil
+}
+
+// close stops the plugin if there is one
+func (t *transformer) close() error {
+	if c, ok := t.plugin.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// cleanup drops the rerouted documents and removes their temp files
+func (t *transformer) cleanup() {
+	for ns, sp := range t.rerouted {
+		if sp.f != nil {
+			sp.f.Close()
+			os.Remove(sp.f.Name())
+		}
+		delete(t.rerouted, ns)
+	}
+	t.spillMem = 0
+}
+
+func splitNS(ns string) (db, coll string) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return ns, ""
+	}
+	return ns[:i], ns[i+1:]
+}
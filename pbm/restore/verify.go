@@ -0,0 +1,112 @@
+package restore
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/mongodb/mongo-tools-common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// Verify reads every dump and oplog archive of the backup through. It
+// checks the manifest signature (if the verification key is set) and
+// validates the compression checksums (the chunks hashes for the dedup
+// layout), the checksums of the stored files calculated during the
+// upload and the framing of each document. It returns the number of
+// the archives and the documents read.
+func Verify(cn *pbm.PBM, bcpName string) (files int, docs int64, err error) {
+	stg, err := cn.GetStorage()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get backup store")
+	}
+
+	bcp, err := GetMeta(cn, bcpName, stg)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get backup metadata")
+	}
+	if bcp.Status != pbm.StatusDone {
+		return 0, 0, errors.Errorf("backup wasn't successfull: status: %s, error: %s", bcp.Status, bcp.Error)
+	}
+
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get config")
+	}
+	err = CheckSignature(cfg.Signing, stg, bcp)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "check signature")
+	}
+
+	count := func(string, bson.Raw) error {
+		docs++
+		return nil
+	}
+	for _, rs := range bcp.Replsets {
+		var dumps []string
+		switch bcp.Type {
+		case pbm.BackupTypeDifferential:
+			dumps = append(dumps, rs.DiffDumps...)
+		case pbm.BackupTypeOplog:
+		default:
+			dumps = append(dumps, rs.DumpName)
+		}
+		for _, rd := range rs.Redumps {
+			dumps = append(dumps, rd.Name)
+		}
+
+		for _, d := range dumps {
+			err = verifyArchive(stg, bcp, rs, d, func(r io.Reader) error {
+				_, err := ReadArchive(r, count)
+				return err
+			})
+			if err != nil {
+				return files, docs, errors.Wrapf(err, "dump %s", d)
+			}
+			files++
+		}
+
+		if rs.OplogName == "" {
+			continue
+		}
+		err = verifyArchive(stg, bcp, rs, rs.OplogName, func(r io.Reader) error {
+			src := db.NewBufferlessBSONSource(ioutil.NopCloser(r))
+			src.SetMaxBSONSize(pbm.MaxOplogEntrySize)
+			for src.LoadNext() != nil {
+				docs++
+			}
+			return src.Err()
+		})
+		if err != nil {
+			return files, docs, errors.Wrapf(err, "oplog %s", rs.OplogName)
+		}
+		files++
+	}
+
+	return files, docs, nil
+}
+
+// verifyArchive parses the archive with fn and reads the rest of it,
+// so the decompressor reaches the end of the stream and checks its trailer.
+// If the file has the checksum in the meta, it's checked on the way.
+func verifyArchive(stg pbm.Storage, bcp *pbm.BackupMeta, rs pbm.BackupReplset, name string, fn func(io.Reader) error) error {
+	r, _, err := openArchive(stg, bcp, name)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer r.Close()
+
+	err = fn(r)
+	if err != nil {
+		return errors.Wrap(err, "parse")
+	}
+
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return errors.Wrap(err, "read")
+	}
+
+	return r.Verify()
+}
@@ -0,0 +1,108 @@
+package pbm
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RestoreMode is how the restored collections are put
+// over the collections which are already there
+type RestoreMode string
+
+const (
+	// RestoreDrop drops the collections and recreates them from the backup.
+	// It's the default.
+	RestoreDrop RestoreMode = "drop"
+	// RestoreMerge inserts the documents of the backup skipping
+	// the ones with the _id which is already there
+	RestoreMerge = "merge"
+	// RestoreReplace upserts the documents of the backup by their _id
+	RestoreReplace = "replace"
+)
+
+// ParseRestoreMode returns the restore mode, empty string is the default one
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	switch RestoreMode(s) {
+	case "", RestoreDrop:
+		return RestoreDrop, nil
+	case RestoreMerge, RestoreReplace:
+		return RestoreMode(s), nil
+	}
+	return "", errors.Errorf("unknown restore mode %q, expected %s, %s or %s", s, RestoreDrop, RestoreMerge, RestoreReplace)
+}
+
+// NSRestoreMode overrides the restore mode of the matching namespaces.
+// NS is `db.collection` and may have `*` wildcards (e.g. `db.*`).
+type NSRestoreMode struct {
+	NS   string      `bson:"ns" json:"ns" yaml:"ns"`
+	Mode RestoreMode `bson:"mode" json:"mode" yaml:"mode"`
+}
+
+// Match returns true if the override applies to the namespace
+func (m NSRestoreMode) Match(ns string) bool {
+	ok, _ := path.Match(m.NS, ns)
+	return ok
+}
+
+// ParseNSRestoreModes parses the overrides given as <ns>=<mode>
+func ParseNSRestoreModes(specs []string) ([]NSRestoreMode, error) {
+	var modes []NSRestoreMode
+	for _, s := range specs {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("%q: expected <ns>=<mode>", s)
+		}
+		if _, err := path.Match(kv[0], ""); err != nil {
+			return nil, errors.Wrapf(err, "%q: bad ns pattern", s)
+		}
+		m, err := ParseRestoreMode(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%q", s)
+		}
+		modes = append(modes, NSRestoreMode{NS: kv[0], Mode: m})
+	}
+	return modes, nil
+}
+
+// NSMode returns the restore mode of the namespace: the mode of the first
+// matching override or the command's mode
+func (r RestoreCmd) NSMode(ns string) RestoreMode {
+	for _, m := range r.NSModes {
+		if m.Match(ns) {
+			return m.Mode
+		}
+	}
+	if r.Mode == "" {
+		return RestoreDrop
+	}
+	return r.Mode
+}
+
+// DropOnly returns true if all namespaces are restored in the drop mode
+func (r RestoreCmd) DropOnly() bool {
+	if r.Mode != "" && r.Mode != RestoreDrop {
+		return false
+	}
+	for _, m := range r.NSModes {
+		if m.Mode != RestoreDrop {
+			return false
+		}
+	}
+	return true
+}
+
+// Destructive returns true if the restore drops or overwrites
+// the existing data, i.e. not all namespaces are merged
+func (r RestoreCmd) Destructive() bool {
+	if r.Mode != RestoreMerge {
+		return true
+	}
+	for _, m := range r.NSModes {
+		if m.Mode != RestoreMerge {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package pbm
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeleteBackupCmd deletes either the given backup or all expired ones
+type DeleteBackupCmd struct {
+	Backup  string `bson:"backup,omitempty"`
+	Expired bool   `bson:"expired,omitempty"`
+	// Approval is the ID of the approved request of the delete
+	Approval string `bson:"approval,omitempty"`
+}
+
+// RetentionCmd sets the expiry and the legal hold of the backup
+type RetentionCmd struct {
+	Backup    string `bson:"backup"`
+	ExpireAt  int64  `bson:"expireAt,omitempty"`
+	LegalHold bool   `bson:"legalHold,omitempty"`
+}
+
+// Files returns the names of the backup's files in the storage
+func (b *BackupMeta) Files() []string {
+	files := []string{b.Name + ".pbm.json"}
+	for _, rs := range b.Replsets {
+		switch b.Type {
+		case BackupTypeDifferential:
+			files = append(files, rs.DiffDumps...)
+		case BackupTypeOplog:
+		default:
+			files = append(files, rs.DumpName)
+		}
+		for _, r := range rs.Redumps {
+			files = append(files, r.Name)
+		}
+		if rs.OplogName != "" {
+			files = append(files, rs.OplogName)
+		}
+		if rs.SessionsName != "" {
+			files = append(files, rs.SessionsName)
+		}
+	}
+	return files
+}
+
+// RetainUntil returns the time until which the backup can't be deleted,
+// zero if it has no expiry. Both PBM and the storage object lock
+// (if any) take it from here so they can't diverge.
+func (b *BackupMeta) RetainUntil() time.Time {
+	if b.ExpireAt <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(b.ExpireAt, 0).UTC()
+}
+
+// Expired returns true if the backup has an expiry date which has passed
+func (b *BackupMeta) Expired(now time.Time) bool {
+	t := b.RetainUntil()
+	return !t.IsZero() && !t.After(now)
+}
+
+// CheckDelete returns an error if the backup can't be deleted at the moment
+func (b *BackupMeta) CheckDelete(now time.Time) error {
+	switch {
+	case b.LegalHold:
+		return errors.Errorf("backup %s is under the legal hold", b.Name)
+	case b.RetainUntil().After(now):
+		return errors.Errorf("backup %s is immutable until %s", b.Name, b.RetainUntil().Format(time.RFC3339))
+	}
+
+	switch b.Status {
+	case StatusDone, StatusPartlyDone, StatusError:
+		return nil
+	default:
+		return errors.Errorf("backup %s is in progress", b.Name)
+	}
+}
+
+// SetBackupRetention sets the expiry and the legal hold of the backup
+func (p *PBM) SetBackupRetention(name string, expireAt int64, hold bool) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$set", bson.M{"expire_at": expireAt, "legal_hold": hold}}},
+	)
+
+	return err
+}
+
+// DeleteBackupMeta removes the backup metadata
+func (p *PBM) DeleteBackupMeta(name string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).DeleteOne(p.ctx, bson.D{{"name", name}})
+	return err
+}
+
+// DependentBackups returns names of the differential backups made against the given one
+func (p *PBM) DependentBackups(name string) ([]string, error) {
+	cur, err := p.Conn.Database(DB).Collection(BcpCollection).Find(p.ctx, bson.D{{"base", name}})
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	var names []string
+	for cur.Next(p.ctx) {
+		b := BackupMeta{}
+		err := cur.Decode(&b)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		names = append(names, b.Name)
+	}
+
+	return names, cur.Err()
+}
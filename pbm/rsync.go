@@ -88,7 +88,7 @@ func getBackupListFS(stg Filesystem) ([]BackupMeta, error) {
 
 	var bcps []BackupMeta
 	for _, f := range files {
-		if f.IsDir() {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".pbm.json") {
 			continue
 		}
 
@@ -0,0 +1,150 @@
+package pbm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ClusterSettings are the cluster-wide parameters captured by the backup
+type ClusterSettings struct {
+	// FCV is the feature compatibility version
+	FCV string `bson:"fcv,omitempty" json:"fcv,omitempty"`
+	// AuthSchemaVersion is the version of the users and roles schema
+	AuthSchemaVersion int `bson:"auth_schema_version,omitempty" json:"auth_schema_version,omitempty"`
+	// Config are the documents of `config.settings` (chunk size,
+	// balancer state and window, autosplit) of the sharded cluster
+	Config []bson.M `bson:"config,omitempty" json:"config,omitempty"`
+}
+
+// BalancerStopped returns the recorded state of the balancer,
+// ok is false if there is no record of it
+func (s *ClusterSettings) BalancerStopped() (stopped, ok bool) {
+	if s == nil {
+		return false, false
+	}
+	for _, doc := range s.Config {
+		if doc["_id"] != "balancer" {
+			continue
+		}
+		stopped, _ = doc["stopped"].(bool)
+		if mode, _ := doc["mode"].(string); mode == "off" {
+			stopped = true
+		}
+		return stopped, true
+	}
+	return false, false
+}
+
+// GetClusterSettings reads the cluster-wide parameters.
+// `config.settings` is read only on the config server.
+func (n *Node) GetClusterSettings() (*ClusterSettings, error) {
+	s := new(ClusterSettings)
+
+	var err error
+	s.FCV, err = n.fcv()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := struct {
+		CurrentVersion int `bson:"currentVersion"`
+	}{}
+	err = n.cn.Database(DB).Collection("system.version").FindOne(n.ctx, bson.D{{"_id", "authSchema"}}).Decode(&auth)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, errors.Wrap(err, "get auth schema version")
+	}
+	s.AuthSchemaVersion = auth.CurrentVersion
+
+	im, err := n.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get isMaster")
+	}
+	if im.ReplsetRole() != ReplRoleConfigSrv {
+		return s, nil
+	}
+
+	cur, err := n.cn.Database("config").Collection("settings").Find(n.ctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "query config.settings")
+	}
+	err = cur.All(n.ctx, &s.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode config.settings")
+	}
+
+	return s, nil
+}
+
+// ApplyClusterSettings reapplies the settings captured by the backup and
+// returns mismatches which can't be fixed by PBM. `config.settings` are
+// written back as they were. The FCV is set only on the non-sharded
+// replset since on the sharded cluster it has to be set via mongos.
+// It's only raised: the downgrade disables the features the data of the
+// node may already use, so it's left to the user and reported instead.
+func (n *Node) ApplyClusterSettings(s *ClusterSettings) ([]string, error) {
+	cur, err := n.GetClusterSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "get current settings")
+	}
+
+	im, err := n.GetIsMaster()
+	if err != nil {
+		return nil, errors.Wrap(err, "get isMaster")
+	}
+
+	var warns []string
+	if s.FCV != "" && s.FCV != cur.FCV {
+		bv, bok := majorMinor(s.FCV)
+		cv, cok := majorMinor(cur.FCV)
+		switch {
+		case !bok || !cok:
+			warns = append(warns, fmt.Sprintf("featureCompatibilityVersion is %s but was %s at the time of the backup, can't compare them", cur.FCV, s.FCV))
+		case compareVersions(bv, cv) < 0:
+			warns = append(warns, fmt.Sprintf("featureCompatibilityVersion is %s but was %s at the time of the backup, it isn't downgraded by the restore", cur.FCV, s.FCV))
+		case im.IsSharded():
+			warns = append(warns, fmt.Sprintf("featureCompatibilityVersion is %s but was %s at the time of the backup, set it via mongos", cur.FCV, s.FCV))
+		default:
+			log.Printf("setting featureCompatibilityVersion %s (current %s)", s.FCV, cur.FCV)
+			err = n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"setFeatureCompatibilityVersion", s.FCV}}).Err()
+			if err != nil {
+				return warns, errors.Wrapf(err, "set featureCompatibilityVersion %s", s.FCV)
+			}
+		}
+	}
+
+	if s.AuthSchemaVersion != 0 && s.AuthSchemaVersion != cur.AuthSchemaVersion {
+		warns = append(warns, fmt.Sprintf("auth schema version is %d but was %d at the time of the backup", cur.AuthSchemaVersion, s.AuthSchemaVersion))
+	}
+
+	if im.ReplsetRole() != ReplRoleConfigSrv {
+		return warns, nil
+	}
+	for _, doc := range s.Config {
+		_, err = n.cn.Database("config").Collection("settings").ReplaceOne(n.ctx,
+			bson.D{{"_id", doc["_id"]}},
+			doc,
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil {
+			return warns, errors.Wrapf(err, "write config.settings %v", doc["_id"])
+		}
+	}
+
+	return warns, nil
+}
+
+// fcv returns the feature compatibility version of the node
+func (n *Node) fcv() (string, error) {
+	fcv := struct {
+		FCV struct {
+			Version string `bson:"version"`
+		} `bson:"featureCompatibilityVersion"`
+	}{}
+	err := n.cn.Database(DB).RunCommand(n.ctx, bson.D{{"getParameter", 1}, {"featureCompatibilityVersion", 1}}).Decode(&fcv)
+	return fcv.FCV.Version, errors.Wrap(err, "get featureCompatibilityVersion")
+}
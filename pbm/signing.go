@@ -0,0 +1,129 @@
+package pbm
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureSuffix is the suffix of the detached signature of the backup
+// manifest, the signature of "<backup>.pbm.json" is "<backup>.pbm.json.sig"
+const SignatureSuffix = ".sig"
+
+// SigningConf defines the ed25519 signing of the backup manifests (the
+// metadata files stored along with the backups). The manifest holds the
+// checksums of the backup files so the signature covers the data as well.
+// The keys are the PEM encoded PKCS#8 private and PKIX public ones, e.g.
+// made with `openssl genpkey -algorithm ed25519`.
+type SigningConf struct {
+	// PrivateKeyFile is the path to the private key on the agents' hosts.
+	// The manifests are signed only if it's set.
+	PrivateKeyFile string `bson:"privateKeyFile,omitempty" json:"privateKeyFile,omitempty" yaml:"privateKeyFile,omitempty"`
+	// PublicKey is the key the signatures are verified with before
+	// the restore. Nothing is verified if it's empty.
+	PublicKey string `bson:"publicKey,omitempty" json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+	// Required fails the restore of the backups with no signature. Otherwise
+	// such backups (e.g. made before the signing was set up) are restored
+	// with a warning.
+	Required bool `bson:"required,omitempty" json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+// SignKey reads the private key the manifests are signed with.
+// It returns nil if the signing is off.
+func (s SigningConf) SignKey() (ed25519.PrivateKey, error) {
+	if s.PrivateKeyFile == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(s.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read private key file")
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil {
+		return nil, errors.Errorf("no PEM data in %s", s.PrivateKeyFile)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("private key is %T, expected ed25519", k)
+	}
+	return key, nil
+}
+
+// VerifyKey returns the public key the signatures are verified with.
+// It returns nil if the verification is off.
+func (s SigningConf) VerifyKey() (ed25519.PublicKey, error) {
+	if strings.TrimSpace(s.PublicKey) == "" {
+		return nil, nil
+	}
+	blk, _ := pem.Decode([]byte(s.PublicKey))
+	if blk == nil {
+		return nil, errors.New("no PEM data in signing.publicKey")
+	}
+	k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key")
+	}
+	key, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("public key is %T, expected ed25519", k)
+	}
+	return key, nil
+}
+
+// SignManifest returns the detached signature of the manifest data
+func SignManifest(key ed25519.PrivateKey, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)))
+}
+
+// VerifyManifest checks the detached signature of the manifest data
+func VerifyManifest(key ed25519.PublicKey, data, sig []byte) error {
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+	if !ed25519.Verify(key, data, s) {
+		return errors.New("signature mismatch, the manifest was modified or signed with another key")
+	}
+	return nil
+}
+
+// SameFiles checks that both metas refer to the same files with the same
+// checksums. It's used to make sure the backup meta taken from the db
+// or elsewhere matches the signed manifest.
+func (b *BackupMeta) SameFiles(o *BackupMeta) error {
+	files, ofiles := b.Files(), o.Files()
+	if len(files) != len(ofiles) {
+		return errors.Errorf("%d files, expected %d", len(files), len(ofiles))
+	}
+	for i := range files {
+		if files[i] != ofiles[i] {
+			return errors.Errorf("file %s, expected %s", files[i], ofiles[i])
+		}
+	}
+
+	for _, rs := range o.Replsets {
+		for _, sum := range rs.Checksums {
+			found := false
+			for _, r := range b.Replsets {
+				if r.Name != rs.Name {
+					continue
+				}
+				s, ok := r.FindChecksum(sum.Name)
+				found = ok && s == sum
+			}
+			if !found {
+				return errors.Errorf("checksum of %s differs", sum.Name)
+			}
+		}
+	}
+	return nil
+}
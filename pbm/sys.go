@@ -0,0 +1,83 @@
+package pbm
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HostStat is the resources usage of the host
+type HostStat struct {
+	// LoadAvg is the 1 minute load average
+	LoadAvg float64 `bson:"loadAvg" json:"loadAvg"`
+	// CPUs is the number of logical CPUs
+	CPUs int `bson:"cpus" json:"cpus"`
+	// MemTotal and MemAvailable are in bytes
+	MemTotal     uint64 `bson:"memTotal" json:"memTotal"`
+	MemAvailable uint64 `bson:"memAvailable" json:"memAvailable"`
+}
+
+// GetHostStat returns the current resources usage of the host.
+// Data is read from /proc so it's available on Linux only.
+func GetHostStat() (HostStat, error) {
+	var s HostStat
+
+	la, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return s, errors.Wrap(err, "read loadavg")
+	}
+	f := strings.Fields(string(la))
+	if len(f) > 0 {
+		s.LoadAvg, _ = strconv.ParseFloat(f[0], 64)
+	}
+
+	s.CPUs, err = cpus()
+	if err != nil {
+		return s, errors.Wrap(err, "read cpuinfo")
+	}
+
+	mi, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return s, errors.Wrap(err, "open meminfo")
+	}
+	defer mi.Close()
+
+	sc := bufio.NewScanner(mi)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// values are in kB
+		switch f[0] {
+		case "MemTotal:":
+			s.MemTotal = v * 1024
+		case "MemAvailable:":
+			s.MemAvailable = v * 1024
+		}
+	}
+
+	return s, errors.Wrap(sc.Err(), "read meminfo")
+}
+
+func cpus() (int, error) {
+	ci, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range strings.Split(string(ci), "\n") {
+		if strings.HasPrefix(l, "processor") {
+			n++
+		}
+	}
+	return n, nil
+}
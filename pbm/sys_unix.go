@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package pbm
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DiskFree returns the number of bytes available to the unprivileged user
+// on the filesystem of the given path
+func DiskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, errors.Wrapf(err, "statfs '%s'", path)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
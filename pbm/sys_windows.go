@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package pbm
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+var procGetDiskFreeSpaceEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// DiskFree returns the number of bytes available to the user
+// on the volume of the given path
+func DiskFree(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "convert path '%s'", path)
+	}
+
+	var avail, total, free uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&avail)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+	if r == 0 {
+		return 0, errors.Wrapf(err, "GetDiskFreeSpaceEx '%s'", path)
+	}
+	return avail, nil
+}
@@ -0,0 +1,139 @@
+package pbm
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TopologyRS is the replset (shard) of the cluster and its members
+type TopologyRS struct {
+	Name    string   `bson:"name" json:"name"`
+	Members []string `bson:"members" json:"members"`
+}
+
+// TopologyDrift is the change of the cluster topology since the previous backup
+type TopologyDrift struct {
+	// Since is the previous backup the topology is compared to
+	Since          string   `bson:"since" json:"since"`
+	AddedRS        []string `bson:"added_rs,omitempty" json:"added_rs,omitempty"`
+	RemovedRS      []string `bson:"removed_rs,omitempty" json:"removed_rs,omitempty"`
+	AddedMembers   []string `bson:"added_members,omitempty" json:"added_members,omitempty"`
+	RemovedMembers []string `bson:"removed_members,omitempty" json:"removed_members,omitempty"`
+}
+
+// Empty returns true if the topology hasn't changed
+func (d TopologyDrift) Empty() bool {
+	return len(d.AddedRS) == 0 && len(d.RemovedRS) == 0 &&
+		len(d.AddedMembers) == 0 && len(d.RemovedMembers) == 0
+}
+
+func (d TopologyDrift) String() string {
+	var s []string
+	if len(d.AddedRS) > 0 {
+		s = append(s, "added replsets: "+strings.Join(d.AddedRS, ", "))
+	}
+	if len(d.RemovedRS) > 0 {
+		s = append(s, "removed replsets: "+strings.Join(d.RemovedRS, ", "))
+	}
+	if len(d.AddedMembers) > 0 {
+		s = append(s, "added members: "+strings.Join(d.AddedMembers, ", "))
+	}
+	if len(d.RemovedMembers) > 0 {
+		s = append(s, "removed members: "+strings.Join(d.RemovedMembers, ", "))
+	}
+	return "topology changed since " + d.Since + ": " + strings.Join(s, "; ")
+}
+
+// Topology returns the replsets of the cluster with their members.
+// The shards are taken from `config.shards` so it has to be called
+// on the config server in the sharded cluster.
+func (p *PBM) Topology(im *IsMaster) ([]TopologyRS, error) {
+	name := im.SetName
+	if name == "" {
+		name = NoReplset
+	}
+	topo := []TopologyRS{{Name: name, Members: sortedCopy(im.Hosts)}}
+	if !im.IsSharded() {
+		return topo, nil
+	}
+
+	shards, err := p.GetShards()
+	if err != nil {
+		return nil, errors.Wrap(err, "get shards")
+	}
+	for _, s := range shards {
+		rs := TopologyRS{Name: s.ID}
+		// host is `rsName/host1,host2,...`
+		h := s.Host
+		if i := strings.Index(h, "/"); i >= 0 {
+			h = h[i+1:]
+		}
+		if h != "" {
+			rs.Members = sortedCopy(strings.Split(h, ","))
+		}
+		topo = append(topo, rs)
+	}
+
+	return topo, nil
+}
+
+// DiffTopology returns the changes of the `cur` topology comparing to the `prev`
+func DiffTopology(since string, prev, cur []TopologyRS) TopologyDrift {
+	d := TopologyDrift{Since: since}
+
+	pm := make(map[string][]string, len(prev))
+	for _, rs := range prev {
+		pm[rs.Name] = rs.Members
+	}
+	cm := make(map[string][]string, len(cur))
+	for _, rs := range cur {
+		cm[rs.Name] = rs.Members
+	}
+
+	for _, rs := range cur {
+		members, ok := pm[rs.Name]
+		if !ok {
+			d.AddedRS = append(d.AddedRS, rs.Name)
+			continue
+		}
+		d.AddedMembers = append(d.AddedMembers, qualify(rs.Name, missing(members, rs.Members))...)
+		d.RemovedMembers = append(d.RemovedMembers, qualify(rs.Name, missing(rs.Members, members))...)
+	}
+	for _, rs := range prev {
+		if _, ok := cm[rs.Name]; !ok {
+			d.RemovedRS = append(d.RemovedRS, rs.Name)
+		}
+	}
+
+	return d
+}
+
+// missing returns the elements of b which aren't in a
+func missing(a, b []string) []string {
+	in := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		in[s] = struct{}{}
+	}
+	var m []string
+	for _, s := range b {
+		if _, ok := in[s]; !ok {
+			m = append(m, s)
+		}
+	}
+	return m
+}
+
+func qualify(rs string, hosts []string) []string {
+	for i := range hosts {
+		hosts[i] = rs + "/" + hosts[i]
+	}
+	return hosts
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
@@ -0,0 +1,136 @@
+package pbm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TraceContext is the span context propagated with the commands
+// from the CLI to the agents. IDs are W3C Trace Context compatible.
+type TraceContext struct {
+	TraceID string `bson:"traceID,omitempty" json:"trace_id,omitempty"`
+	SpanID  string `bson:"spanID,omitempty" json:"span_id,omitempty"`
+}
+
+// IsZero returns true if there is no trace to join
+func (t TraceContext) IsZero() bool {
+	return t.TraceID == ""
+}
+
+// TraceTTL is how long the finished spans are kept
+const TraceTTL = time.Hour * 24 * 30
+
+// Span is the timed operation of the backup or restore flow
+type Span struct {
+	TraceID  string `bson:"trace_id" json:"trace_id"`
+	SpanID   string `bson:"span_id" json:"span_id"`
+	ParentID string `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Name     string `bson:"name" json:"name"`
+	Replset  string `bson:"rs,omitempty" json:"rs,omitempty"`
+	Node     string `bson:"node,omitempty" json:"node,omitempty"`
+	// Start and End are in nanoseconds
+	Start int64             `bson:"start" json:"start"`
+	End   int64             `bson:"end" json:"end"`
+	Attrs map[string]string `bson:"attrs,omitempty" json:"attrs,omitempty"`
+	Error string            `bson:"error,omitempty" json:"error,omitempty"`
+	// CreatedAt is the time the span is stored at, the spans expire by it
+	CreatedAt time.Time `bson:"createdAt" json:"-"`
+
+	cn *PBM
+	mu sync.Mutex
+}
+
+// StartSpan starts the span of the operation. With the empty parent
+// context the new trace is started. The span is stored only once finished.
+func (p *PBM) StartSpan(parent TraceContext, name, rs, node string) *Span {
+	s := &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   randomID(8),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Replset:  rs,
+		Node:     node,
+		Start:    time.Now().UnixNano(),
+		cn:       p,
+	}
+	if s.TraceID == "" {
+		s.TraceID = randomID(16)
+	}
+	return s
+}
+
+// Context returns the context to propagate to the child spans
+func (s *Span) Context() TraceContext {
+	return TraceContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// Child starts the child span on the same node
+func (s *Span) Child(name string) *Span {
+	return s.cn.StartSpan(s.Context(), name, s.Replset, s.Node)
+}
+
+// SetAttr sets the span's attribute
+func (s *Span) SetAttr(k, v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	s.Attrs[k] = v
+}
+
+// Finish ends the span and stores it. The failure to store the span
+// doesn't affect the operation and only ends up in the agent's log.
+func (s *Span) Finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.End = time.Now().UnixNano()
+	s.CreatedAt = time.Now().UTC()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	_, ierr := s.cn.Conn.Database(DB).Collection(TraceCollection).InsertOne(s.cn.ctx, s)
+	if ierr != nil {
+		log.Printf("[ERROR] write trace span %s: %v", s.Name, ierr)
+	}
+}
+
+// Duration returns the duration of the finished span
+func (s *Span) Duration() time.Duration {
+	return time.Duration(s.End - s.Start)
+}
+
+// GetTrace returns the spans of the trace ordered by the start time
+func (p *PBM) GetTrace(traceID string) ([]*Span, error) {
+	cur, err := p.Conn.Database(DB).Collection(TraceCollection).Find(
+		p.ctx,
+		bson.D{{"trace_id", traceID}},
+		options.Find().SetSort(bson.D{{"start", 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query spans")
+	}
+
+	spans := []*Span{}
+	err = cur.All(p.ctx, &spans)
+	return spans, errors.Wrap(err, "decode spans")
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		// the time-based ID is good enough to tell the spans apart
+		for i := range b {
+			b[i] = byte(time.Now().UnixNano() >> uint(i*8))
+		}
+	}
+	return hex.EncodeToString(b)
+}
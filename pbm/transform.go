@@ -0,0 +1,112 @@
+package pbm
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// TransformAction is what is done with the document field during the restore
+type TransformAction string
+
+const (
+	// TransformHash replaces the value with its sha256 hex digest
+	TransformHash TransformAction = "hash"
+	// TransformNull sets the value to null
+	TransformNull TransformAction = "null"
+	// TransformRemove removes the field
+	TransformRemove TransformAction = "remove"
+)
+
+// TransformRule describes how documents of the matching namespaces are
+// changed before they are inserted during the restore.
+// NS is `db.collection` and may have `*` wildcards (e.g. `db.*`).
+type TransformRule struct {
+	NS     string           `bson:"ns" json:"ns" yaml:"ns"`
+	Drop   bool             `bson:"drop,omitempty" json:"drop,omitempty" yaml:"drop,omitempty"`
+	Salt   string           `bson:"salt,omitempty" json:"salt,omitempty" yaml:"salt,omitempty"`
+	Fields []TransformField `bson:"fields,omitempty" json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// TransformField is the action applied to the field. Path is a dot
+// separated path to the field in the document (e.g. `address.zip`).
+type TransformField struct {
+	Path   string          `bson:"path" json:"path" yaml:"path"`
+	Action TransformAction `bson:"action" json:"action" yaml:"action"`
+}
+
+// Match returns true if the rule applies to the namespace
+func (t TransformRule) Match(ns string) bool {
+	ok, _ := path.Match(t.NS, ns)
+	return ok
+}
+
+// ParseTransformRules parses and validates the YAML list of transform rules
+func ParseTransformRules(buf []byte) ([]TransformRule, error) {
+	var rules []TransformRule
+	err := yaml.UnmarshalStrict(buf, &rules)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal yaml")
+	}
+
+	for i, r := range rules {
+		if !strings.Contains(r.NS, ".") {
+			return nil, errors.Errorf("rule %d: ns should be in the `db.collection` format, got '%s'", i, r.NS)
+		}
+		if _, err := path.Match(r.NS, ""); err != nil {
+			return nil, errors.Wrapf(err, "rule %d: bad ns pattern '%s'", i, r.NS)
+		}
+		if r.Drop && len(r.Fields) > 0 {
+			return nil, errors.Errorf("rule %d: drop can't be combined with fields", i)
+		}
+		for _, f := range r.Fields {
+			if f.Path == "" || f.Path == "_id" {
+				return nil, errors.Errorf("rule %d: bad field path '%s'", i, f.Path)
+			}
+			switch f.Action {
+			case TransformHash, TransformNull, TransformRemove:
+			default:
+				return nil, errors.Errorf("rule %d: unknown action '%s' for '%s'", i, f.Action, f.Path)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// DocTransformer is the interface of the restore plugin. Transform is
+// called for every document of the dump and for every document inserted,
+// replaced or updated by the oplog. For the oplog updates `update` is true
+// and the doc is the update operators document (`$set` etc.).
+// It returns the namespace the document should be restored into (the given
+// `ns` to leave it in place), the document itself, possibly modified, and
+// false if the document should be dropped. The given doc is valid only
+// during the call. Documents of the dump moved to another namespace
+// are inserted after the dump is restored. Updates can't be moved.
+//
+// The plugin is an executable on the agent's host. It's started once per
+// restore with the plugin args as `key=value` arguments and gets the
+// BSON documents
+//
+//	{ns: <string>, doc: <document>, update: <bool>}
+//
+// on its stdin one by one. For each of them it has to write the reply
+//
+//	{ns: <string>, doc: <document>, drop: <bool>}
+//
+// to its stdout, where the empty ns means the same namespace. The plugin's
+// stderr goes to the agent's log. Its stdin is closed at the end of
+// the restore and it should exit then.
+type DocTransformer interface {
+	Transform(ns string, doc bson.Raw, update bool) (newNS string, newDoc bson.Raw, keep bool, err error)
+}
+
+// TransformPlugin is the restore plugin to run on agents
+type TransformPlugin struct {
+	// Path is the path to the plugin's executable on the agents' hosts
+	Path string            `bson:"path" json:"path"`
+	Args map[string]string `bson:"args,omitempty" json:"args,omitempty"`
+}
@@ -0,0 +1,153 @@
+package pbm
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/dns"
+)
+
+const (
+	schemeMongoDB = "mongodb://"
+	// schemeSRV is the scheme of the connection string which hosts
+	// and options are given by the DNS SRV and TXT records
+	schemeSRV = "mongodb+srv://"
+)
+
+// NormalizeURI adds the scheme to the connection string given without it
+func NormalizeURI(uri string) string {
+	if strings.HasPrefix(uri, schemeSRV) {
+		return uri
+	}
+	return schemeMongoDB + strings.Replace(uri, schemeMongoDB, "", 1)
+}
+
+// IsSRV returns true if the hosts of the connection string are given by the SRV record
+func IsSRV(uri string) bool {
+	return strings.HasPrefix(uri, schemeSRV)
+}
+
+// ResolveURI turns the SRV connection string into the regular one with the
+// hosts of the SRV records and the options of the TXT record, the options
+// of the string itself take over. TLS is on unless the string turns it off,
+// the same as the driver does for SRV. The regular string is returned as is.
+func ResolveURI(uri string) (string, error) {
+	uri = NormalizeURI(uri)
+	if !IsSRV(uri) {
+		return uri, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Wrap(err, "parse connection string")
+	}
+	hosts, err := dns.DefaultResolver.ParseHosts(u.Host, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve SRV record of %s", u.Host)
+	}
+	txt, err := dns.DefaultResolver.GetConnectionArgsFromTXT(u.Host)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve TXT record of %s", u.Host)
+	}
+
+	q := url.Values{}
+	for _, kv := range txt {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) == 2 {
+			q.Set(p[0], p[1])
+		}
+	}
+	for k, v := range u.Query() {
+		q[k] = v
+	}
+	if q.Get("tls") == "" && q.Get("ssl") == "" {
+		q.Set("tls", "true")
+	}
+
+	u.Scheme = strings.TrimSuffix(schemeMongoDB, "://")
+	u.Host = strings.Join(hosts, ",")
+	u.RawQuery = q.Encode()
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// NodeURI returns the connection string of the node the agent runs along
+// with. The SRV string is resolved, if it gives several hosts the one on
+// this machine is taken. The string connects directly to the node, so the
+// dump reads from it rather than from the replset primary.
+func NodeURI(uri string) (string, error) {
+	if !IsSRV(NormalizeURI(uri)) {
+		return NormalizeURI(uri), nil
+	}
+
+	ruri, err := ResolveURI(uri)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(ruri)
+	if err != nil {
+		return "", errors.Wrap(err, "parse resolved connection string")
+	}
+	hosts := strings.Split(u.Host, ",")
+	if len(hosts) == 1 {
+		return directURI(u, hosts[0]), nil
+	}
+
+	var local []string
+	for _, h := range hosts {
+		if isLocalHost(h) {
+			local = append(local, h)
+		}
+	}
+	if len(local) != 1 {
+		return "", errors.Errorf("SRV record gives %d hosts %v, %d of them on this machine; set the node's own connection string", len(hosts), hosts, len(local))
+	}
+	return directURI(u, local[0]), nil
+}
+
+// directURI returns the connection string of the host with the options
+// of `u`. The replset of the TXT record is dropped, the driver would
+// connect to the whole replset otherwise.
+func directURI(u *url.URL, host string) string {
+	d := *u
+	d.Host = host
+	q := d.Query()
+	q.Del("replicaSet")
+	q.Set("connect", "direct")
+	d.RawQuery = q.Encode()
+	return d.String()
+}
+
+// isLocalHost returns true if the host (host:port) is on this machine
+func isLocalHost(hostport string) bool {
+	h, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		h = hostport
+	}
+	if hn, err := os.Hostname(); err == nil && strings.EqualFold(strings.TrimSuffix(h, "."), hn) {
+		return true
+	}
+
+	addrs, err := net.LookupHost(h)
+	if err != nil {
+		return false
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		for _, ia := range ifaddrs {
+			if n, ok := ia.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package pbm
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDirectURI(t *testing.T) {
+	u, err := url.Parse("mongodb://pbm:secret@h1:27017,h2:27017/?authSource=admin&replicaSet=rs0&tls=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := url.Parse(directURI(u, "h2:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Host != "h2:27017" || d.User.String() != "pbm:secret" {
+		t.Errorf("got %s, want the credentials and the host h2:27017", d)
+	}
+	q := d.Query()
+	if q.Get("replicaSet") != "" || q.Get("connect") != "direct" {
+		t.Errorf("got %s, want the direct connection without the replset", d)
+	}
+	if q.Get("authSource") != "admin" || q.Get("tls") != "true" {
+		t.Errorf("got %s, want the TXT record options kept", d)
+	}
+	if u.Host != "h1:27017,h2:27017" {
+		t.Error("the resolved connection string is changed")
+	}
+}
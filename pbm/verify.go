@@ -0,0 +1,123 @@
+package pbm
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// VerifyConf defines the periodic verification of the latest backup
+type VerifyConf struct {
+	// IntervalSec is how often the latest successful backup is verified.
+	// 0 means no periodic verification.
+	IntervalSec int `bson:"intervalSec,omitempty" json:"intervalSec,omitempty" yaml:"intervalSec,omitempty"`
+	// Rehearse makes the verification restore each replset of the backup
+	// into the throwaway mongod (see RehearsalConf) in addition to reading
+	// the backup files through
+	Rehearse bool `bson:"rehearse,omitempty" json:"rehearse,omitempty" yaml:"rehearse,omitempty"`
+	// Checks are run against the rehearsal restores
+	Checks []RehearsalCheck `bson:"checks,omitempty" json:"checks,omitempty" yaml:"checks,omitempty"`
+	// AlertURL receives the verification metadata (JSON POST) if it has failed
+	AlertURL string `bson:"alertURL,omitempty" json:"alertURL,omitempty" yaml:"alertURL,omitempty"`
+}
+
+// Interval returns the verification interval. 0 means no periodic verification.
+func (c VerifyConf) Interval() time.Duration {
+	return time.Duration(c.IntervalSec) * time.Second
+}
+
+// VerifyCmd is the command to verify the backup
+type VerifyCmd struct {
+	Name     string           `bson:"name"`
+	Backup   string           `bson:"backup"`
+	Rehearse bool             `bson:"rehearse,omitempty"`
+	Checks   []RehearsalCheck `bson:"checks,omitempty"`
+	// Scheduled is true for the periodic verification
+	Scheduled bool `bson:"scheduled,omitempty"`
+}
+
+// VerifyMeta is the state and the results of the backup verification
+type VerifyMeta struct {
+	Name      string `bson:"name" json:"name"`
+	Backup    string `bson:"backup" json:"backup"`
+	Node      string `bson:"node" json:"node"`
+	Scheduled bool   `bson:"scheduled,omitempty" json:"scheduled,omitempty"`
+	StartTS   int64  `bson:"start_ts" json:"start_ts"`
+	FinishTS  int64  `bson:"finish_ts,omitempty" json:"finish_ts,omitempty"`
+	Status    Status `bson:"status" json:"status"`
+	Error     string `bson:"error,omitempty" json:"error,omitempty"`
+	// Files is the number of the archives read through
+	Files int `bson:"files" json:"files"`
+	// Docs is the number of the documents and oplog entries read
+	Docs int64 `bson:"docs" json:"docs"`
+	// Rehearsals are the names of the rehearsals made by the verification
+	Rehearsals []string `bson:"rehearsals,omitempty" json:"rehearsals,omitempty"`
+}
+
+func (p *PBM) SetVerifyMeta(m *VerifyMeta) error {
+	_, err := p.Conn.Database(DB).Collection(VerifyCollection).InsertOne(p.ctx, m)
+	return err
+}
+
+// FinishVerify sets the final state and the results of the verification
+func (p *PBM) FinishVerify(m *VerifyMeta) error {
+	_, err := p.Conn.Database(DB).Collection(VerifyCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", m.Name}},
+		bson.D{{"$set", bson.M{
+			"status":     m.Status,
+			"error":      m.Error,
+			"files":      m.Files,
+			"docs":       m.Docs,
+			"rehearsals": m.Rehearsals,
+			"finish_ts":  m.FinishTS,
+		}}},
+	)
+	return err
+}
+
+func (p *PBM) GetVerifyMeta(name string) (*VerifyMeta, error) {
+	m := &VerifyMeta{}
+	res := p.Conn.Database(DB).Collection(VerifyCollection).FindOne(p.ctx, bson.D{{"name", name}})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return m, nil
+		}
+		return nil, errors.Wrap(res.Err(), "get")
+	}
+	err := res.Decode(m)
+	return m, errors.Wrap(err, "decode")
+}
+
+// VerificationsList returns the last verifications, the latest first.
+// With `scheduled` only the periodic ones are returned.
+func (p *PBM) VerificationsList(limit int64, scheduled bool) ([]VerifyMeta, error) {
+	q := bson.D{}
+	if scheduled {
+		q = append(q, bson.E{"scheduled", true})
+	}
+	cur, err := p.Conn.Database(DB).Collection(VerifyCollection).Find(
+		p.ctx,
+		q,
+		options.Find().SetLimit(limit).SetSort(bson.D{{"start_ts", -1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "query mongo")
+	}
+	defer cur.Close(p.ctx)
+
+	vs := []VerifyMeta{}
+	for cur.Next(p.ctx) {
+		m := VerifyMeta{}
+		err := cur.Decode(&m)
+		if err != nil {
+			return nil, errors.Wrap(err, "message decode")
+		}
+		vs = append(vs, m)
+	}
+
+	return vs, cur.Err()
+}
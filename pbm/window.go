@@ -0,0 +1,188 @@
+package pbm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupWindow restricts the time of the day when backups are allowed to run
+type BackupWindow struct {
+	// Start and End of the window in "HH:MM" format. The window may wrap midnight
+	// (e.g. 22:00-04:00). Empty window means any time is allowed.
+	Start string `bson:"start,omitempty" json:"start,omitempty" yaml:"start,omitempty"`
+	End   string `bson:"end,omitempty" json:"end,omitempty" yaml:"end,omitempty"`
+	// Timezone is the IANA name of the time zone (e.g. "Europe/Berlin")
+	// the window and blackouts are defined in. Default is UTC.
+	Timezone string `bson:"timezone,omitempty" json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	// Abort the running backup once the window is over
+	Abort bool `bson:"abort,omitempty" json:"abort,omitempty" yaml:"abort,omitempty"`
+	// Blackouts are the periods when backups are forbidden regardless of the window
+	Blackouts []TimeRange `bson:"blackouts,omitempty" json:"blackouts,omitempty" yaml:"blackouts,omitempty"`
+}
+
+// TimeRange is the period of time
+type TimeRange struct {
+	// Start and End in RFC3339 format (e.g. "2020-03-01T00:00:00Z")
+	// or "HH:MM" for the daily recurring period
+	Start string `bson:"start" json:"start" yaml:"start"`
+	End   string `bson:"end" json:"end" yaml:"end"`
+}
+
+// ErrOutsideWindow means that the backup can't be run at the moment
+type ErrOutsideWindow struct {
+	Reason string
+}
+
+func (e ErrOutsideWindow) Error() string {
+	return "backup is not allowed at the moment: " + e.Reason
+}
+
+// Check returns ErrOutsideWindow if the given time is out of the backup window
+// or falls into some blackout period
+func (w BackupWindow) Check(t time.Time) error {
+	loc := time.UTC
+	if w.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return errors.Wrapf(err, "load timezone '%s'", w.Timezone)
+		}
+	}
+	t = t.In(loc)
+
+	if w.Start != "" || w.End != "" {
+		in, err := inDaily(t, w.Start, w.End)
+		if err != nil {
+			return errors.Wrap(err, "backup window")
+		}
+		if !in {
+			return ErrOutsideWindow{Reason: fmt.Sprintf("out of the backup window %s-%s %s", w.Start, w.End, loc)}
+		}
+	}
+
+	for _, b := range w.Blackouts {
+		in, err := b.contains(t)
+		if err != nil {
+			return errors.Wrap(err, "blackout period")
+		}
+		if in {
+			return ErrOutsideWindow{Reason: fmt.Sprintf("blackout period %s - %s", b.Start, b.End)}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the window and the blackouts. The window with equal
+// bounds never opens, so it's rejected. The blackout needs both bounds
+// in the daily form and at least one in the dates form, the daily
+// blackout with an open bound or the empty one covers the whole days.
+func (w BackupWindow) Validate() error {
+	if w.Timezone != "" {
+		_, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return errors.Wrapf(err, "load timezone '%s'", w.Timezone)
+		}
+	}
+
+	for _, hm := range []string{w.Start, w.End} {
+		if hm == "" {
+			continue
+		}
+		_, err := minuteOfDay(hm)
+		if err != nil {
+			return errors.Wrapf(err, "parse window bound '%s'", hm)
+		}
+	}
+	if w.Start != "" && w.Start == w.End {
+		return errors.Errorf("empty window %s-%s", w.Start, w.End)
+	}
+
+	for _, b := range w.Blackouts {
+		err := b.validate()
+		if err != nil {
+			return errors.Wrapf(err, "blackout %s - %s", b.Start, b.End)
+		}
+	}
+
+	return nil
+}
+
+func (r TimeRange) validate() error {
+	if r.Start == "" && r.End == "" {
+		return errors.New("no bounds")
+	}
+
+	start, errs := time.Parse(time.RFC3339, r.Start)
+	end, erre := time.Parse(time.RFC3339, r.End)
+	switch {
+	case errs == nil && erre == nil:
+		if !start.Before(end) {
+			return errors.New("start isn't before end")
+		}
+		return nil
+	case errs == nil && r.End == "", erre == nil && r.Start == "":
+		return nil
+	}
+
+	s, err := minuteOfDay(r.Start)
+	if err != nil {
+		return errors.Wrapf(err, "parse start '%s'", r.Start)
+	}
+	e, err := minuteOfDay(r.End)
+	if err != nil {
+		return errors.Wrapf(err, "parse end '%s'", r.End)
+	}
+	if s == e {
+		return errors.New("empty daily period")
+	}
+	return nil
+}
+
+// contains checks if t is within the range. The missing bound is open.
+func (r TimeRange) contains(t time.Time) (bool, error) {
+	start, errs := time.Parse(time.RFC3339, r.Start)
+	end, erre := time.Parse(time.RFC3339, r.End)
+	// the dates range, one of the dates may be missing
+	if (errs == nil && (erre == nil || r.End == "")) || (erre == nil && r.Start == "") {
+		return (r.Start == "" || !t.Before(start)) && (r.End == "" || t.Before(end)), nil
+	}
+
+	return inDaily(t, r.Start, r.End)
+}
+
+// inDaily checks if the time of the day of t is within [start, end).
+// The missing start is the beginning of the day, the missing end is its end.
+func inDaily(t time.Time, start, end string) (bool, error) {
+	s, e := 0, 24*60
+	var err error
+	if start != "" {
+		s, err = minuteOfDay(start)
+		if err != nil {
+			return false, errors.Wrapf(err, "parse start '%s'", start)
+		}
+	}
+	if end != "" {
+		e, err = minuteOfDay(end)
+		if err != nil {
+			return false, errors.Wrapf(err, "parse end '%s'", end)
+		}
+	}
+
+	m := t.Hour()*60 + t.Minute()
+	if s <= e {
+		return m >= s && m < e, nil
+	}
+	// wraps midnight
+	return m >= s || m < e, nil
+}
+
+func minuteOfDay(hm string) (int, error) {
+	t, err := time.Parse("15:04", hm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,96 @@
+package pbm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupWindowOpenBounds(t *testing.T) {
+	at := func(hm string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", "2020-03-01 "+hm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	cases := []struct {
+		w    BackupWindow
+		t    string
+		open bool
+	}{
+		{BackupWindow{Start: "22:00", End: "04:00"}, "23:00", true},
+		{BackupWindow{Start: "22:00", End: "04:00"}, "12:00", false},
+		{BackupWindow{Start: "22:00"}, "23:59", true},
+		{BackupWindow{Start: "22:00"}, "21:59", false},
+		{BackupWindow{End: "04:00"}, "00:00", true},
+		{BackupWindow{End: "04:00"}, "04:00", false},
+		{BackupWindow{}, "12:00", true},
+	}
+	for _, c := range cases {
+		err := c.w.Check(at(c.t))
+		if c.open && err != nil {
+			t.Errorf("%+v at %s: unexpected error %v", c.w, c.t, err)
+		}
+		if !c.open {
+			if _, ok := err.(ErrOutsideWindow); !ok {
+				t.Errorf("%+v at %s: expected ErrOutsideWindow, got %v", c.w, c.t, err)
+			}
+		}
+	}
+}
+
+func TestBlackoutOpenBounds(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-03-01T12:00:00Z")
+	cases := []struct {
+		r  TimeRange
+		in bool
+	}{
+		{TimeRange{Start: "2020-03-01T00:00:00Z"}, true},
+		{TimeRange{Start: "2020-03-02T00:00:00Z"}, false},
+		{TimeRange{End: "2020-03-02T00:00:00Z"}, true},
+		{TimeRange{End: "2020-03-01T00:00:00Z"}, false},
+		{TimeRange{Start: "11:00"}, true},
+		{TimeRange{End: "11:00"}, false},
+	}
+	for _, c := range cases {
+		in, err := c.r.contains(now)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.r, err)
+		}
+		if in != c.in {
+			t.Errorf("%+v: got %v, expected %v", c.r, in, c.in)
+		}
+	}
+}
+
+func TestBackupWindowValidate(t *testing.T) {
+	cases := []struct {
+		w     BackupWindow
+		valid bool
+	}{
+		{BackupWindow{}, true},
+		{BackupWindow{Start: "22:00", End: "04:00"}, true},
+		{BackupWindow{Start: "22:00"}, true},
+		{BackupWindow{Start: "22:00", End: "22:00"}, false},
+		{BackupWindow{Start: "25:00"}, false},
+		{BackupWindow{Timezone: "Nowhere/Land"}, false},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "01:00", End: "02:00"}}}, true},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "2020-03-01T00:00:00Z"}}}, true},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "2020-03-01T00:00:00Z", End: "2020-03-02T00:00:00Z"}}}, true},
+		{BackupWindow{Blackouts: []TimeRange{{}}}, false},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "11:00"}}}, false},
+		{BackupWindow{Blackouts: []TimeRange{{End: "11:00"}}}, false},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "11:00", End: "11:00"}}}, false},
+		{BackupWindow{Blackouts: []TimeRange{{Start: "2020-03-02T00:00:00Z", End: "2020-03-01T00:00:00Z"}}}, false},
+	}
+	for _, c := range cases {
+		err := c.w.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%+v: unexpected error %v", c.w, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%+v: expected an error", c.w)
+		}
+	}
+}